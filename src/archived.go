@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// archivedModes are the values ARCHIVED_OBJECTS accepts.
+var archivedModes = []string{"fail", "skip", "restore"}
+
+// restoreDays is how long a restored copy of an archived object is kept,
+// and restoreTier how fast it is restored.
+const (
+	restoreDays = 7
+	restoreTier = "Standard"
+)
+
+func validateArchived(config *Config) error {
+	if !contains(archivedModes, config.ArchivedObjects) {
+		return fmt.Errorf("invalid ARCHIVED_OBJECTS %q: must be one of %s", config.ArchivedObjects, strings.Join(archivedModes, ", "))
+	}
+	return nil
+}
+
+// archivedObject reports whether err is S3 refusing to read an object in
+// the GLACIER or DEEP_ARCHIVE storage class that hasn't been restored.
+func archivedObject(err error) bool {
+	var s3Err *s3Error
+	return errors.As(err, &s3Err) && s3Err.code == "InvalidObjectState"
+}
+
+// archivedReport collects the archived source objects a run with
+// ARCHIVED_OBJECTS=skip or restore didn't copy, across its attempts.
+type archivedReport struct {
+	mu       sync.Mutex
+	keys     map[string]bool
+	restores int
+	// rcloneExitCode is that of an rclone run that failed only on archived
+	// objects and so counts as a success.
+	rcloneExitCode *int
+}
+
+func newArchivedReport() *archivedReport {
+	return &archivedReport{keys: make(map[string]bool)}
+}
+
+// skip records key and reports whether it is new, as rclone reports the
+// objects again on each of its retries.
+func (r *archivedReport) skip(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.keys[key] {
+		return false
+	}
+	r.keys[key] = true
+	return true
+}
+
+func (r *archivedReport) restored() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.restores++
+}
+
+func (r *archivedReport) rcloneExited(code int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rcloneExitCode = &code
+}
+
+func (r *archivedReport) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.keys)
+}
+
+// summarize adds the counts to the run summary.
+func (r *archivedReport) summarize(report *runSummary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report.ArchivedObjects = len(r.keys)
+	report.RestoreRequests = r.restores
+	if r.rcloneExitCode != nil {
+		report.RcloneExitCode = r.rcloneExitCode
+	}
+}
+
+// onlyArchived reports whether the errors of a failed rclone run were all
+// about archived objects that were skipped. The rcloneLog doesn't count
+// those among the errors, so there are no others.
+func onlyArchived(config *Config, classes []classCount) bool {
+	return config.archived != nil && config.archived.count() > 0 && len(classes) == 0
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateArchived(t *testing.T) {
+	_, err := loadTestConfig(t, map[string]string{"ARCHIVED_OBJECTS": "thaw"})
+	wantError(t, err, `invalid ARCHIVED_OBJECTS "thaw": must be one of fail, skip, restore`)
+	if config, err := loadTestConfig(t, map[string]string{"ARCHIVED_OBJECTS": "Skip"}); err != nil || config.ArchivedObjects != "skip" {
+		t.Errorf("ARCHIVED_OBJECTS=Skip loaded as %v, %v", config, err)
+	}
+}
+
+// archivedRclone fails the copy of the GLACIER object b.txt, and of c.txt
+// with AccessDenied if denied is set, keeping what rcat writes under dir.
+func archivedRclone(t *testing.T, dir string, denied bool) (path, calls string) {
+	more := ""
+	if denied {
+		more = `echo '{"level":"error","msg":"c.txt: Failed to copy: AccessDenied: Access Denied","object":"c.txt"}' >&2`
+	}
+	return fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+if [ "$1" = rcat ]; then
+	mkdir -p "`+dir+`/$(dirname "$2")"
+	cat > "`+dir+`/$2"
+	exit 0
+fi
+if [ "$1" = sync ]; then
+	echo '{"level":"info","msg":"Copied (new)","object":"a.txt","size":3}' >&2
+	echo '{"level":"error","msg":"b.txt: Failed to copy: InvalidObjectState: The operation is not valid for the object'"'"'s storage class","object":"b.txt","size":5}' >&2
+	`+more+`
+	echo '{"level":"error","msg":"Not deleting files as there were IO errors"}' >&2
+	echo '{"level":"notice","msg":"stats","stats":{"bytes":3,"transfers":1,"errors":1}}' >&2
+	exit 1
+fi
+exit 0`)
+}
+
+// runArchived runs a sync with env and returns its exit code, summary and
+// log entries.
+func runArchived(t *testing.T, env map[string]string) (int, runSummary, []map[string]any) {
+	t.Helper()
+	setTestEnv(t, withEnv(env))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	summaries := readSummaries(t, out)
+	if len(summaries) != 1 {
+		t.Fatalf("summaries %+v:\n%s", summaries, out)
+	}
+	return result.code, summaries[0], logEntries(t, out)
+}
+
+func TestArchivedSkip(t *testing.T) {
+	dir := t.TempDir()
+	path, _ := archivedRclone(t, dir, false)
+	code, summary, entries := runArchived(t, map[string]string{"RCLONE_PATH": path, "ARCHIVED_OBJECTS": "skip", "REPORT_PREFIX": "_reports", "MANIFEST": "true"})
+	if code != 0 {
+		t.Fatalf("run = %d, want 0 with the archived object skipped", code)
+	}
+	if summary.ArchivedObjects != 1 || summary.RcloneExitCode == nil || *summary.RcloneExitCode != 1 {
+		t.Errorf("summary counts %d archived objects, rclone exit code %v", summary.ArchivedObjects, summary.RcloneExitCode)
+	}
+	if e := findEntry(entries, "Skipped an archived source object"); e == nil || e["level"] != "warning" || e["object"] != "b.txt" {
+		t.Errorf("skip logged as %v", e)
+	}
+	if findEntry(entries, "rclone skipped archived source objects and synced the rest") == nil {
+		t.Error("the skipped objects are not logged with the result")
+	}
+
+	// The manifest lists the skipped object to chase up.
+	manifests, _ := filepath.Glob(filepath.Join(dir, "dest:dest-bucket", "_reports", "*", "manifest.jsonl.gz"))
+	if len(manifests) != 1 {
+		t.Fatalf("manifests %q, want one", manifests)
+	}
+	f, err := os.Open(manifests[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(gz)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); !slices.Contains(lines, `{"action":"archived","key":"b.txt","size":5}`) {
+		t.Errorf("manifest = %q, want b.txt as archived", lines)
+	}
+}
+
+func TestArchivedFail(t *testing.T) {
+	path, _ := archivedRclone(t, t.TempDir(), false)
+	code, summary, _ := runArchived(t, map[string]string{"RCLONE_PATH": path})
+	if code != exitSyncFailed || summary.ArchivedObjects != 0 {
+		t.Errorf("run = %d with %d archived objects, want %d by default", code, summary.ArchivedObjects, exitSyncFailed)
+	}
+}
+
+func TestArchivedSkipWithOtherErrors(t *testing.T) {
+	// Other failures still fail the run.
+	path, _ := archivedRclone(t, t.TempDir(), true)
+	code, summary, _ := runArchived(t, map[string]string{"RCLONE_PATH": path, "ARCHIVED_OBJECTS": "skip"})
+	if code != exitSyncFailed || summary.ArchivedObjects != 1 {
+		t.Errorf("run = %d with %d archived objects, want %d", code, summary.ArchivedObjects, exitSyncFailed)
+	}
+}
+
+func TestNativeArchived(t *testing.T) {
+	for _, mode := range []string{"skip", "restore"} {
+		t.Run(mode, func(t *testing.T) {
+			src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+			src.put("source-bucket", "a.txt", "new", nil)
+			src.put("source-bucket", "b.txt", "frozen", nil).archived = true
+			dst.put("dest-bucket", "source-bucket/old.txt", "old", nil)
+			path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+			code, summary, _ := runArchived(t, map[string]string{"RCLONE_PATH": path, "ENGINE": "native", "SOURCE_S3_ENDPOINT": src.URL, "DEST_S3_ENDPOINT": dst.URL, "ARCHIVED_OBJECTS": mode})
+			if code != 0 {
+				t.Fatalf("run = %d, want 0", code)
+			}
+			// The rest is synced, deletions included.
+			if got := dst.keys("dest-bucket"); !slices.Equal(got, []string{"source-bucket/a.txt"}) {
+				t.Errorf("destination holds %q, want a.txt only", got)
+			}
+			restores := src.ops("RestoreObject")
+			if summary.ArchivedObjects != 1 || summary.RestoreRequests != len(restores) {
+				t.Errorf("summary counts %d archived objects and %d restores, sent %q", summary.ArchivedObjects, summary.RestoreRequests, restores)
+			}
+			if want := mode == "restore"; want != (len(restores) == 1) {
+				t.Errorf("ARCHIVED_OBJECTS=%s sent %q", mode, restores)
+			}
+		})
+	}
+}
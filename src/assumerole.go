@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The session length of an assumed role: STS defaults to an hour and allows
+// up to 12 hours if the role's maximum session duration is raised as well.
+const (
+	defaultRoleDuration = time.Hour
+	minRoleDuration     = 15 * time.Minute
+	maxRoleDuration     = 12 * time.Hour
+	defaultRoleSession  = "s3-sync"
+)
+
+// roleSessionNamePattern is what STS accepts as RoleSessionName.
+var roleSessionNamePattern = regexp.MustCompile(`^[\w+=,.@-]{2,64}$`)
+
+func validateRole(remote RemoteConfig, side string) error {
+	if remote.RoleARN == "" {
+		for _, option := range []struct {
+			key string
+			set bool
+		}{
+			{side + "_ROLE_EXTERNAL_ID", remote.RoleExternalID != ""},
+			{side + "_ROLE_SESSION_NAME", remote.RoleSessionName != ""},
+			{side + "_ROLE_DURATION", remote.RoleDuration != ""},
+		} {
+			if option.set {
+				return fmt.Errorf("%s requires %s_ROLE_ARN", option.key, side)
+			}
+		}
+		return nil
+	}
+	switch {
+	case !strings.HasPrefix(remote.RoleARN, "arn:") || !strings.Contains(remote.RoleARN, ":role/"):
+		return fmt.Errorf("invalid %s_ROLE_ARN %q: must look like arn:aws:iam::<account>:role/<name>", side, remote.RoleARN)
+	case remote.Anonymous:
+		return fmt.Errorf("%s_ROLE_ARN can't be combined with %s_ANONYMOUS", side, side)
+	case remote.RoleSessionName != "" && !roleSessionNamePattern.MatchString(remote.RoleSessionName):
+		return fmt.Errorf("invalid %s_ROLE_SESSION_NAME %q: must be 2 to 64 letters, digits or +=,.@_-", side, remote.RoleSessionName)
+	}
+	if remote.RoleDuration != "" {
+		d, err := time.ParseDuration(remote.RoleDuration)
+		if err != nil || d < minRoleDuration || d > maxRoleDuration {
+			return fmt.Errorf("invalid %s_ROLE_DURATION %q: must be a duration between 15m and 12h", side, remote.RoleDuration)
+		}
+	}
+	return nil
+}
+
+func assumesRole(config *Config) bool {
+	return config.Source.RoleARN != "" || config.Dest.RoleARN != ""
+}
+
+// assumeRole calls STS AssumeRole for the _ROLE_ARN of remote, signed with
+// the credentials of base.
+func assumeRole(ctx context.Context, remote RemoteConfig, base credentialProvider) (awsCredentials, error) {
+	creds, err := base.retrieve(ctx)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	duration := defaultRoleDuration
+	if d, err := time.ParseDuration(remote.RoleDuration); err == nil {
+		duration = d
+	}
+	sessionName := remote.RoleSessionName
+	if sessionName == "" {
+		sessionName = defaultRoleSession
+	}
+	params := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {remote.RoleARN},
+		"RoleSessionName": {sessionName},
+		"DurationSeconds": {strconv.Itoa(int(duration.Seconds()))},
+	}
+	if remote.RoleExternalID != "" {
+		params.Set("ExternalId", remote.RoleExternalID)
+	}
+	body := []byte(params.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, stsEndpoint(), bytes.NewReader(body))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signV4(req, body, "sts", stsRegion(), creds, time.Now())
+	data, err := fetchCredentials(req, "STS AssumeRole credentials")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var result struct {
+		Credentials stsCredentials `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid STS AssumeRole response: %w", err)
+	}
+	return result.Credentials.credentials()
+}
+
+// assumeRoles assumes the roles of the remotes at the start of a run, so
+// that a role that can't be assumed fails it before anything is copied.
+func assumeRoles(config *Config, logger *logrus.Logger) error {
+	for _, r := range configuredRemotes(config) {
+		if r.remote.RoleARN == "" {
+			continue
+		}
+		creds, err := r.remote.credentials.retrieve(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to assume %s_ROLE_ARN %s: %w", strings.ToUpper(r.name), r.remote.RoleARN, err)
+		}
+		logger.WithFields(logrus.Fields{
+			"remote":     r.name,
+			"role_arn":   r.remote.RoleARN,
+			"expires_at": creds.expires.UTC().Format(time.RFC3339),
+		}).Info("Assumed role")
+	}
+	return nil
+}
+
+// runRoleSessions runs the sync in rclone runs that each end before the
+// credentials of the assumed roles expire. rclone can't be given new
+// credentials while it runs, so each run is limited with --max-duration to
+// shortly before the expiry, and the next one continues the sync with
+// renewed credentials, skipping what has been copied already. MAX_DURATION
+// still limits the sync as a whole.
+func runRoleSessions(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) (RunStats, error) {
+	maxDuration, cutoffMode := config.MaxDuration, config.CutoffMode
+	defer func() { config.MaxDuration, config.CutoffMode = maxDuration, cutoffMode }()
+	budget, _ := time.ParseDuration(maxDuration)
+	if cutoffMode == "" {
+		// Transfers in flight when a run is stopped are finished, with
+		// credentialsRefreshWindow left to do so.
+		config.CutoffMode = "soft"
+	}
+
+	start := time.Now()
+	var total RunStats
+	for session := 1; ; session++ {
+		if err := remotes.refreshRoles(context.Background(), config); err != nil {
+			return total, err
+		}
+		limit := time.Until(remotes.rolesExpire()) - credentialsRefreshWindow
+		limitedByBudget := false
+		if remaining := budget - time.Since(start); budget > 0 && remaining <= limit {
+			limit, limitedByBudget = remaining, true
+		}
+		config.MaxDuration = max(limit, time.Second).Round(time.Second).String()
+
+		stats, err := runSync(config, remotes, logger)
+		total.add(stats)
+		var budgetErr *budgetError
+		if limitedByBudget || !errors.As(err, &budgetErr) || budgetErr.budget != "MAX_DURATION" {
+			return total, err
+		}
+		logger.WithFields(logrus.Fields{
+			"session":             session,
+			"bytes_transferred":   stats.Bytes,
+			"objects_transferred": stats.Transfers,
+		}).Info("The credentials of the assumed role expire soon; continuing the sync in a new rclone run with renewed ones")
+	}
+}
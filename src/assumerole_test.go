@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testRoleARN = "arn:aws:iam::123456789012:role/sync"
+
+// fakeSTS is an STS endpoint answering AssumeRole with credentials that
+// expire after expiresIn.
+type fakeSTS struct {
+	mu        sync.Mutex
+	expiresIn time.Duration
+	requests  []url.Values
+	// auth is the Authorization header of the last request.
+	auth string
+}
+
+func newFakeSTS(t *testing.T, expiresIn time.Duration) *fakeSTS {
+	t.Helper()
+	sts := &fakeSTS{expiresIn: expiresIn}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sts.mu.Lock()
+		defer sts.mu.Unlock()
+		sts.requests = append(sts.requests, r.PostForm)
+		sts.auth = r.Header.Get("Authorization")
+		if r.PostForm.Get("RoleArn") != testRoleARN {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<ErrorResponse><Error><Code>AccessDenied</Code><Message>not authorized to assume the role</Message></Error></ErrorResponse>`)
+			return
+		}
+		n := len(sts.requests)
+		fmt.Fprintf(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>
+<AccessKeyId>ASIA%d</AccessKeyId><SecretAccessKey>role-secret-%d</SecretAccessKey><SessionToken>role-token-%d</SessionToken>
+<Expiration>%s</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`, n, n, n, time.Now().Add(sts.expiresIn).UTC().Format(time.RFC3339))
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ENDPOINT_URL_STS", server.URL)
+	return sts
+}
+
+func (s *fakeSTS) calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+// roleEnv assumes testRoleARN for the destination.
+var roleEnv = map[string]string{"DEST_ROLE_ARN": testRoleARN}
+
+// loadRoleConfig loads a configuration with roleEnv and overrides, with the
+// roles assumed from a fakeSTS.
+func loadRoleConfig(t *testing.T, expiresIn time.Duration, overrides map[string]string) (*Config, *fakeSTS) {
+	t.Helper()
+	env := withEnv(roleEnv)
+	for key, value := range overrides {
+		env[key] = value
+	}
+	setTestEnv(t, env)
+	sts := newFakeSTS(t, expiresIn)
+	configs, err := loadConfigs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return configs[0], sts
+}
+
+func TestAssumeRole(t *testing.T) {
+	config, sts := loadRoleConfig(t, time.Hour, map[string]string{
+		"DEST_ROLE_EXTERNAL_ID":  "external",
+		"DEST_ROLE_SESSION_NAME": "nightly",
+		"DEST_ROLE_DURATION":     "15m",
+	})
+	creds, err := config.Dest.credentials.retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.accessKey != "ASIA1" || creds.sessionToken != "role-token-1" {
+		t.Errorf("credentials = %+v, want those of the role", creds)
+	}
+	if time.Until(creds.expires) < 59*time.Minute {
+		t.Errorf("credentials expire at %v, want in an hour", creds.expires)
+	}
+
+	got := sts.requests[0]
+	for key, want := range map[string]string{
+		"Action":          "AssumeRole",
+		"RoleArn":         testRoleARN,
+		"RoleSessionName": "nightly",
+		"ExternalId":      "external",
+		"DurationSeconds": "900",
+	} {
+		if got.Get(key) != want {
+			t.Errorf("%s = %q, want %q", key, got.Get(key), want)
+		}
+	}
+	// The request is signed with the destination's own keys.
+	if !strings.Contains(sts.auth, "Credential=dest-access/") || !strings.Contains(sts.auth, "/sts/aws4_request") {
+		t.Errorf("Authorization = %q, want it signed for sts with dest-access", sts.auth)
+	}
+	// The source has no role.
+	if creds, _ := config.Source.credentials.retrieve(context.Background()); creds.accessKey != "source-access" {
+		t.Errorf("source credentials = %+v, want its keys", creds)
+	}
+}
+
+func TestAssumeRoleDenied(t *testing.T) {
+	config, _ := loadRoleConfig(t, time.Hour, map[string]string{"DEST_ROLE_ARN": "arn:aws:iam::123456789012:role/other"})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	err := assumeRoles(config, logger)
+	wantError(t, err, "failed to assume DEST_ROLE_ARN arn:aws:iam::123456789012:role/other")
+	wantError(t, err, "AccessDenied: not authorized to assume the role")
+}
+
+func TestAssumeRoleRenewal(t *testing.T) {
+	config, sts := loadRoleConfig(t, time.Hour, nil)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := config.Dest.credentials.retrieve(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sts.calls() != 1 {
+		t.Fatalf("STS was called %d times for credentials valid for an hour, want once", sts.calls())
+	}
+
+	// Credentials within credentialsRefreshWindow of their expiry are
+	// renewed before they are used again.
+	config, sts = loadRoleConfig(t, credentialsRefreshWindow-time.Minute, nil)
+	first, err := config.Dest.credentials.retrieve(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := config.Dest.credentials.retrieve(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sts.calls() != 2 || first.accessKey == second.accessKey {
+		t.Errorf("STS was called %d times, got %s then %s; want the expiring credentials renewed", sts.calls(), first.accessKey, second.accessKey)
+	}
+}
+
+// sessionRclone stops the first stops syncs as if --max-duration was reached
+// and records the session token each run got for the destination.
+func sessionRclone(t *testing.T, stops int) (path, calls, tokens string) {
+	path, calls = fakeRclone(t, fmt.Sprintf(`dir=$(dirname "$0")
+echo "$RCLONE_CONFIG_DEST_SESSION_TOKEN" >> "$dir/tokens"
+[ "$(wc -l < "$dir/calls")" -le %d ] && exit 10
+exit 0`, stops))
+	return path, calls, filepath.Join(filepath.Dir(calls), "tokens")
+}
+
+// maxDurations returns the --max-duration of each run in calls.
+func maxDurations(t *testing.T, calls []string) []time.Duration {
+	t.Helper()
+	var durations []time.Duration
+	for _, call := range calls {
+		args := strings.Fields(call)
+		for i, arg := range args {
+			if arg == "--max-duration" && i+1 < len(args) {
+				d, err := time.ParseDuration(args[i+1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				durations = append(durations, d)
+			}
+		}
+	}
+	return durations
+}
+
+func TestRunRoleSessions(t *testing.T) {
+	path, calls, tokens := sessionRclone(t, 2)
+	config, sts := loadRoleConfig(t, time.Hour, map[string]string{"RCLONE_PATH": path})
+	remotes, cleanup, err := setupRemotes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	if _, err := runRoleSessions(config, remotes, logger); err != nil {
+		t.Fatalf("runRoleSessions: %v", err)
+	}
+	runs := readCalls(t, calls)
+	if len(runs) != 3 {
+		t.Fatalf("rclone ran %d times, want 3: %q", len(runs), runs)
+	}
+	durations := maxDurations(t, runs)
+	if len(durations) != 3 {
+		t.Fatalf("got --max-duration %v, want one per run", durations)
+	}
+	// Each run ends credentialsRefreshWindow before the credentials expire.
+	for _, d := range durations {
+		if d > time.Hour-credentialsRefreshWindow || d < time.Hour-credentialsRefreshWindow-time.Minute {
+			t.Errorf("--max-duration %v, want about %v", d, time.Hour-credentialsRefreshWindow)
+		}
+	}
+	for _, run := range runs {
+		if !strings.Contains(run, "--cutoff-mode soft") {
+			t.Errorf("run %q doesn't finish its transfers with --cutoff-mode soft", run)
+		}
+	}
+	// The credentials are still valid for longer than a run, so they are
+	// assumed once and passed to every run.
+	if data, _ := os.ReadFile(tokens); string(data) != strings.Repeat("role-token-1\n", 3) || sts.calls() != 1 {
+		t.Errorf("rclone got session tokens %q from %d STS calls, want the role's from one", data, sts.calls())
+	}
+	if config.MaxDuration != "" || config.CutoffMode != "" {
+		t.Errorf("MAX_DURATION %q and CUTOFF_MODE %q aren't restored", config.MaxDuration, config.CutoffMode)
+	}
+}
+
+func TestRunRoleSessionsBudget(t *testing.T) {
+	path, calls, _ := sessionRclone(t, 2)
+	config, _ := loadRoleConfig(t, time.Hour, map[string]string{"RCLONE_PATH": path, "MAX_DURATION": "10m"})
+	remotes, cleanup, err := setupRemotes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	// MAX_DURATION ends before the credentials expire, so the run it stops
+	// ends the sync.
+	_, err = runRoleSessions(config, remotes, logger)
+	var budgetErr *budgetError
+	if !errors.As(err, &budgetErr) || budgetErr.budget != "MAX_DURATION" {
+		t.Fatalf("runRoleSessions = %v, want the MAX_DURATION budget error", err)
+	}
+	runs := readCalls(t, calls)
+	durations := maxDurations(t, runs)
+	if len(runs) != 1 || len(durations) != 1 || durations[0] > 10*time.Minute || durations[0] < 9*time.Minute {
+		t.Errorf("runs %q, want a single one limited to MAX_DURATION", runs)
+	}
+	if config.MaxDuration != "10m" {
+		t.Errorf("MAX_DURATION = %q, want it restored to 10m", config.MaxDuration)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// templateToken matches a {name} placeholder in BACKUP_DIR or BACKUP_SUFFIX.
+var templateToken = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// expandTemplate replaces {name} placeholders with their value from tokens.
+// Unknown placeholders are an error so typos don't end up in object keys.
+func expandTemplate(key, value string, tokens map[string]string) (string, error) {
+	var unknown []string
+	expanded := templateToken.ReplaceAllStringFunc(value, func(match string) string {
+		name := match[1 : len(match)-1]
+		if v, ok := tokens[name]; ok {
+			return v
+		}
+		unknown = append(unknown, match)
+		return match
+	})
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("%s=%q contains unknown placeholder %s", key, value, strings.Join(unknown, ", "))
+	}
+	return expanded, nil
+}
+
+// backupTokens returns the placeholders available in BACKUP_DIR and
+// BACKUP_SUFFIX. Times are in UTC so that runs in different time zones agree
+// on the names.
+func backupTokens(now time.Time) map[string]string {
+	return map[string]string{
+		"date":      now.UTC().Format("2006-01-02"),
+		"timestamp": now.UTC().Format("2006-01-02T15:04:05Z"),
+	}
+}
+
+// prefixesOverlap reports whether one of the cleaned prefixes a and b equals
+// or contains the other. The empty prefix is the bucket root and contains
+// everything.
+func prefixesOverlap(a, b string) bool {
+	return a == "" || b == "" || a == b ||
+		strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
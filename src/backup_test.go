@@ -0,0 +1,115 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	tokens := backupTokens(time.Date(2024, 3, 9, 23, 30, 5, 0, time.FixedZone("CET", -3600)))
+	if tokens["date"] != "2024-03-10" || tokens["timestamp"] != "2024-03-10T00:30:05Z" {
+		t.Errorf("backupTokens = %v, want UTC", tokens)
+	}
+	for _, tt := range []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{"", "", ""},
+		{"backups", "backups", ""},
+		{"backups/{date}", "backups/2024-03-10", ""},
+		{"{date}/{timestamp}", "2024-03-10/2024-03-10T00:30:05Z", ""},
+		{"backups/{day}", "", `BACKUP_DIR="backups/{day}" contains unknown placeholder {day}`},
+		{"{x}{}", "", "unknown placeholder {x}, {}"},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := expandTemplate("BACKUP_DIR", tt.value, tokens)
+			wantError(t, err, tt.err)
+			if got != tt.want {
+				t.Errorf("expandTemplate = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixesOverlap(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want bool
+	}{
+		{"backups", "mirror", false},
+		{"backups", "backups", true},
+		{"mirror/backups", "mirror", true},
+		{"mirror", "mirror/backups", true},
+		{"mirror-backups", "mirror", false},
+		{"", "mirror", true},
+	} {
+		if got := prefixesOverlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("prefixesOverlap(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestBackupDir(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"DEST_PREFIX": "mirror", "BACKUP_DIR": "/backups/{date}/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "dest:dest-bucket/backups/" + time.Now().UTC().Format("2006-01-02")
+	if got, _ := argValue(syncArgs(config), "--backup-dir"); got != want {
+		t.Errorf("--backup-dir = %q, want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"DEST_PREFIX": "mirror", "BACKUP_DIR": "mirror/old"}, `BACKUP_DIR "mirror/old" overlaps the destination "dest:dest-bucket/mirror"`},
+		{map[string]string{"BACKUP_DIR": "{when}"}, `BACKUP_DIR="{when}" contains unknown placeholder {when}`},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+
+	config, err = loadTestConfig(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(syncArgs(config), "--backup-dir") {
+		t.Errorf("rclone gets --backup-dir without BACKUP_DIR")
+	}
+}
+
+func TestBackupSuffix(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"BACKUP_SUFFIX": ".{date}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := syncArgs(config)
+	want := "." + time.Now().UTC().Format("2006-01-02")
+	if got, _ := argValue(args, "--suffix"); got != want {
+		t.Errorf("--suffix = %q, want %q", got, want)
+	}
+	if !slices.Contains(args, "--suffix-keep-extension") {
+		t.Errorf("rclone arguments %q lack --suffix-keep-extension", args)
+	}
+
+	// Together with BACKUP_DIR, the suffix names the objects moved there.
+	config, err = loadTestConfig(t, map[string]string{"BACKUP_DIR": "backups", "BACKUP_SUFFIX": "-old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args = syncArgs(config)
+	if dir, _ := argValue(args, "--backup-dir"); dir != "dest:dest-bucket/backups" || !slices.Contains(args, "-old") {
+		t.Errorf("rclone arguments %q, want the backup dir and suffix", args)
+	}
+
+	for value, want := range map[string]string{
+		"/{date}": "must not contain a slash",
+		".{rev}":  `BACKUP_SUFFIX=".{rev}" contains unknown placeholder {rev}`,
+	} {
+		_, err := loadTestConfig(t, map[string]string{"BACKUP_SUFFIX": value})
+		wantError(t, err, want)
+	}
+}
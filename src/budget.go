@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// rclone exit codes for a run stopped by --max-transfer and --max-duration.
+const (
+	rcloneExitTransferExceeded = 8
+	rcloneExitDurationExceeded = 10
+)
+
+// cutoffModes are the CUTOFF_MODE values: hard stops at the limit, soft
+// starts no new transfers once it is reached, and cautious starts none that
+// would exceed it.
+var cutoffModes = []string{"hard", "soft", "cautious"}
+
+func validateBudget(config *Config) error {
+	if config.MaxTransfer != "" {
+		if _, err := parseSize(config.MaxTransfer); err != nil {
+			return fmt.Errorf("invalid MAX_TRANSFER: %w", err)
+		}
+	}
+	if config.MaxDuration != "" {
+		d, err := time.ParseDuration(config.MaxDuration)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid MAX_DURATION %q: must be a positive duration like 4h or 90m", config.MaxDuration)
+		}
+	}
+	if config.CutoffMode != "" {
+		if !contains(cutoffModes, config.CutoffMode) {
+			return fmt.Errorf("invalid CUTOFF_MODE %q: must be one of hard, soft, cautious", config.CutoffMode)
+		}
+		if config.MaxTransfer == "" && config.MaxDuration == "" {
+			return fmt.Errorf("CUTOFF_MODE requires MAX_TRANSFER or MAX_DURATION")
+		}
+	}
+	return nil
+}
+
+func budgetArgs(config *Config) []string {
+	var args []string
+	if config.MaxTransfer != "" {
+		args = append(args, "--max-transfer", config.MaxTransfer)
+	}
+	if config.MaxDuration != "" {
+		args = append(args, "--max-duration", config.MaxDuration)
+	}
+	if config.CutoffMode != "" {
+		args = append(args, "--cutoff-mode", config.CutoffMode)
+	}
+	return args
+}
+
+// budgetError reports that rclone stopped because a budget was used up.
+type budgetError struct {
+	budget string // MAX_TRANSFER or MAX_DURATION
+	err    error
+}
+
+func (e *budgetError) Error() string {
+	return fmt.Sprintf("%s reached, partial sync: %v", e.budget, e.err)
+}
+
+func (e *budgetError) Unwrap() error { return e.err }
+
+// asBudgetError wraps err in a budgetError if rclone's exit code says a
+// budget was exceeded, and returns it unchanged otherwise.
+func asBudgetError(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	switch exitErr.ExitCode() {
+	case rcloneExitTransferExceeded:
+		return &budgetError{budget: "MAX_TRANSFER", err: err}
+	case rcloneExitDurationExceeded:
+		return &budgetError{budget: "MAX_DURATION", err: err}
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestBudget(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		want []string
+		err  string
+	}{
+		{name: "unlimited"},
+		{name: "transfer", env: map[string]string{"MAX_TRANSFER": "500G"}, want: []string{"--max-transfer", "500G"}},
+		{name: "duration", env: map[string]string{"MAX_DURATION": "4h", "CUTOFF_MODE": "Soft"}, want: []string{"--max-duration", "4h", "--cutoff-mode", "soft"}},
+		{name: "bad size", env: map[string]string{"MAX_TRANSFER": "lots"}, err: "invalid MAX_TRANSFER"},
+		{name: "bad duration", env: map[string]string{"MAX_DURATION": "4 hours"}, err: `invalid MAX_DURATION "4 hours": must be a positive duration like 4h or 90m`},
+		{name: "negative duration", env: map[string]string{"MAX_DURATION": "-1h"}, err: "invalid MAX_DURATION"},
+		{name: "bad cutoff mode", env: map[string]string{"MAX_DURATION": "4h", "CUTOFF_MODE": "gentle"}, err: `invalid CUTOFF_MODE "gentle"`},
+		{name: "cutoff mode alone", env: map[string]string{"CUTOFF_MODE": "soft"}, err: "CUTOFF_MODE requires MAX_TRANSFER or MAX_DURATION"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.env)
+			wantError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			if got := budgetArgs(config); !slices.Equal(got, tt.want) {
+				t.Errorf("budgetArgs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAsBudgetError(t *testing.T) {
+	for _, tt := range []struct {
+		code   int
+		budget string
+	}{
+		{rcloneExitTransferExceeded, "MAX_TRANSFER"},
+		{rcloneExitDurationExceeded, "MAX_DURATION"},
+		{1, ""},
+	} {
+		err := exitError(t, tt.code)
+		got := asBudgetError(err)
+		var budgetErr *budgetError
+		switch {
+		case tt.budget == "" && got != err:
+			t.Errorf("rclone exit %d became %v", tt.code, got)
+		case tt.budget != "" && (!errors.As(got, &budgetErr) || budgetErr.budget != tt.budget):
+			t.Errorf("rclone exit %d = %v, want a %s budget error", tt.code, got, tt.budget)
+		}
+	}
+	if err := errors.New("failed"); asBudgetError(err) != err {
+		t.Errorf("asBudgetError changed an error without an exit code")
+	}
+}
+
+func TestBudgetExitCode(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 8`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "MAX_TRANSFER": "1G", "LOG_LEVEL": "error"}))
+	var result runResult
+	captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 5 {
+		t.Errorf("run = %d, want 5 for a partial sync", result.code)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const bandwidthLimitExample = `"10M", "10M:1G" (upload:download) or a timetable like "08:00,512k 19:00,10M 23:00,off"`
+
+// validateBandwidthLimit checks value against the grammar rclone accepts for
+// --bwlimit: a single rate ("10M", "off", or "up:down" such as "10M:1G") or a
+// space-separated timetable of "[Day-]HH:MM,rate" entries. An empty value
+// means unlimited.
+func validateBandwidthLimit(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	entries := strings.Fields(value)
+	if len(entries) == 1 && !strings.Contains(entries[0], ",") {
+		if err := parseBandwidthRate(entries[0]); err != nil {
+			return fmt.Errorf("invalid BANDWIDTH_LIMIT %q: %v; expected a rate like %s", value, err, bandwidthLimitExample)
+		}
+		return nil
+	}
+
+	for _, entry := range entries {
+		at, rate, ok := strings.Cut(entry, ",")
+		if !ok {
+			return fmt.Errorf("invalid BANDWIDTH_LIMIT %q: timetable entry %q is not of the form HH:MM,rate; expected a rate like %s", value, entry, bandwidthLimitExample)
+		}
+		if err := parseTimetableTime(at); err != nil {
+			return fmt.Errorf("invalid BANDWIDTH_LIMIT %q: entry %q: %v; expected a rate like %s", value, entry, err, bandwidthLimitExample)
+		}
+		if err := parseBandwidthRate(rate); err != nil {
+			return fmt.Errorf("invalid BANDWIDTH_LIMIT %q: entry %q: %v; expected a rate like %s", value, entry, err, bandwidthLimitExample)
+		}
+	}
+
+	return nil
+}
+
+// parseBandwidthRate checks a rate or an "upload:download" pair of rates.
+func parseBandwidthRate(rate string) error {
+	up, down, asymmetric := strings.Cut(rate, ":")
+	if err := parseSingleRate(up); err != nil {
+		return err
+	}
+	if asymmetric {
+		if err := parseSingleRate(down); err != nil {
+			return fmt.Errorf("download rate: %w", err)
+		}
+	}
+	return nil
+}
+
+func parseSingleRate(rate string) error {
+	if strings.EqualFold(rate, "off") {
+		return nil
+	}
+	_, err := parseSize(rate)
+	return err
+}
+
+// weekdays are the day names rclone accepts in timetable entries such as
+// "Mon-08:00,512k", by their three-letter abbreviation or in full.
+var weekdays = []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
+
+// parseTimetableTime checks the time of a timetable entry, optionally
+// prefixed with a weekday.
+func parseTimetableTime(value string) error {
+	if day, at, ok := strings.Cut(value, "-"); ok {
+		valid := false
+		for _, weekday := range weekdays {
+			if strings.EqualFold(day, weekday) || strings.EqualFold(day, weekday[:3]) {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%q is not a weekday (Mon, Tue, ... or Monday, Tuesday, ...)", day)
+		}
+		value = at
+	}
+	return parseTimeOfDay(value)
+}
+
+func parseTimeOfDay(value string) error {
+	hours, minutes, ok := strings.Cut(value, ":")
+	if !ok || len(hours) == 0 || len(hours) > 2 || len(minutes) != 2 {
+		return fmt.Errorf("time %q is not of the form HH:MM", value)
+	}
+	h, errH := strconv.Atoi(hours)
+	m, errM := strconv.Atoi(minutes)
+	if errH != nil || errM != nil || h < 0 || h > 23 || m < 0 || m > 59 {
+		return fmt.Errorf("time %q is not a valid time of day", value)
+	}
+	return nil
+}
+
+// divideBandwidthLimit returns a BANDWIDTH_LIMIT that gives each of n
+// concurrent jobs an equal share of value, dividing every rate of a
+// timetable or an upload:download pair. "off" stays unlimited.
+func divideBandwidthLimit(value string, n int) string {
+	if value == "" || n <= 1 {
+		return value
+	}
+	entries := strings.Fields(value)
+	for i, entry := range entries {
+		at, rate, timed := strings.Cut(entry, ",")
+		if !timed {
+			rate = at
+		}
+		rates := strings.Split(rate, ":")
+		for j, r := range rates {
+			if size, err := parseSize(r); err == nil && !strings.EqualFold(r, "off") {
+				rates[j] = strconv.FormatInt(max(size/int64(n)>>10, 1), 10) + "k"
+			}
+		}
+		rate = strings.Join(rates, ":")
+		if timed {
+			entries[i] = at + "," + rate
+		} else {
+			entries[i] = rate
+		}
+	}
+	return strings.Join(entries, " ")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestValidateBandwidthLimit(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"10M", ""},
+		{"512k", ""},
+		{"1.5G", ""},
+		{"2048", ""},
+		{"off", ""},
+		{"OFF", ""},
+		{"08:00,512k 19:00,10M 23:00,off", ""},
+		{"8:00,1M", ""},
+		{"10M:1G", ""},
+		{"off:512k", ""},
+		{"Mon-08:00,512k Sat-00:00,off", ""},
+		{"monday-08:00,1M:off sunday-20:00,10M", ""},
+		{"10M:fast", `download rate: size "fast" is not a non-negative number`},
+		{"Mo-08:00,1M", `"Mo" is not a weekday (Mon, Tue, ... or Monday, Tuesday, ...)`},
+		{"10 MB/s", `invalid BANDWIDTH_LIMIT "10 MB/s": timetable entry "10" is not of the form HH:MM,rate`},
+		{"slow", `invalid BANDWIDTH_LIMIT "slow": size "slow" has an unknown suffix "w"`},
+		{"10x", `size "10x" has an unknown suffix "x"`},
+		{"-1M", `size "-1M" is not a non-negative number`},
+		{"08:00,512k 19:00", `timetable entry "19:00" is not of the form HH:MM,rate`},
+		{"24:00,1M", `entry "24:00,1M": time "24:00" is not a valid time of day`},
+		{"08:60,1M", `time "08:60" is not a valid time of day`},
+		{"0800,1M", `time "0800" is not of the form HH:MM`},
+		{"08:00,lots", `entry "08:00,lots": size "lots" has an unknown suffix "s"`},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			wantError(t, validateBandwidthLimit(tt.value), tt.want)
+		})
+	}
+}
+
+func TestBandwidthLimitFailsLoading(t *testing.T) {
+	_, err := loadTestConfig(t, map[string]string{"BANDWIDTH_LIMIT": "10 MB/s"})
+	wantError(t, err, `invalid BANDWIDTH_LIMIT "10 MB/s"`)
+	wantError(t, err, `expected a rate like "10M"`)
+
+	config, err := loadTestConfig(t, map[string]string{"BANDWIDTH_LIMIT": "08:00,512k 23:00,off"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.BandwidthLimit != "08:00,512k 23:00,off" {
+		t.Errorf("BandwidthLimit = %q", config.BandwidthLimit)
+	}
+}
+
+func TestBandwidthLimitPerFile(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"BANDWIDTH_LIMIT": "10M:1G"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit, _ := argValue(syncArgs(config), "--bwlimit"); limit != "10M:1G" {
+		t.Errorf("--bwlimit = %q, want 10M:1G", limit)
+	}
+
+	config, err = loadTestConfig(t, map[string]string{"BANDWIDTH_LIMIT": "1M", "BWLIMIT_FILE": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := syncArgs(config)
+	if limit, _ := argValue(args, "--bwlimit-file"); limit != "1M" || slices.Contains(args, "--bwlimit") {
+		t.Errorf("rclone arguments %q, want --bwlimit-file 1M only", args)
+	}
+
+	_, err = loadTestConfig(t, map[string]string{"BWLIMIT_FILE": "true"})
+	wantError(t, err, "BWLIMIT_FILE requires BANDWIDTH_LIMIT")
+}
+
+func TestDivideBandwidthLimit(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		n     int
+		want  string
+	}{
+		{"10M", 2, "5120k"},
+		{"10M", 1, "10M"},
+		{"", 4, ""},
+		{"10M:1G", 4, "2560k:262144k"},
+		{"08:00,512k 19:00,10M 23:00,off", 2, "08:00,256k 19:00,5120k 23:00,off"},
+		{"1k", 4, "1k"},
+	} {
+		if got := divideBandwidthLimit(tt.value, tt.n); got != tt.want {
+			t.Errorf("divideBandwidthLimit(%q, %d) = %q, want %q", tt.value, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// accessError describes why a remote could not be accessed.
+type accessError struct {
+	reason string // auth, dns, missing_bucket, connection or unknown
+	detail string
+	err    error
+}
+
+func (e *accessError) Error() string {
+	if e.detail == "" {
+		return fmt.Sprintf("%s: %v", e.reason, e.err)
+	}
+	return fmt.Sprintf("%s: %v: %s", e.reason, e.err, e.detail)
+}
+
+func (e *accessError) Unwrap() error { return e.err }
+
+// accessCheckError reports a failed access check with the sides that
+// failed it: source, dest or both.
+type accessCheckError struct {
+	sides []string
+}
+
+func (e *accessCheckError) Error() string {
+	return fmt.Sprintf("access check of %s failed", strings.Join(e.sides, " and "))
+}
+
+// runAccessCheck verifies that both remotes are reachable with the configured
+// credentials without transferring anything.
+func runAccessCheck(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) error {
+	sides := []struct {
+		name   string
+		remote string
+	}{
+		{"source", remotePath("source", config.Source.Bucket, config.Source.Prefix)},
+		{"dest", remotePath("dest", config.Dest.Bucket, "")},
+	}
+
+	var failed []string
+	for _, side := range sides {
+		entry := logger.WithFields(logrus.Fields{
+			"side":   side.name,
+			"remote": side.remote,
+		})
+		if err := checkRemote(config, remotes, side.remote); err != nil {
+			failed = append(failed, side.name)
+			reason := "unknown"
+			if accessErr, ok := err.(*accessError); ok {
+				reason = accessErr.reason
+			}
+			entry.WithError(err).WithField("reason", reason).Error("Access check failed")
+			continue
+		}
+		entry.Info("Access check succeeded")
+	}
+
+	if len(failed) > 0 {
+		return &accessCheckError{sides: failed}
+	}
+	return nil
+}
+
+// checkRemote lists the remote and stops after the first entry, which is
+// enough to prove that the endpoint, credentials and bucket are all valid.
+func checkRemote(config *Config, remotes *rcloneRemotes, remote string) error {
+	cmd := remotes.command(config, "lsf", remote,
+		"--max-depth", "1",
+		"--retries", "1",
+		"--low-level-retries", "1",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start rclone: %w", err)
+	}
+
+	if _, err := bufio.NewReader(stdout).ReadString('\n'); err == nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil
+	}
+
+	if err := cmd.Wait(); err != nil {
+		output := strings.TrimSpace(stderr.String())
+		return &accessError{
+			reason: classifyAccessError(output),
+			detail: lastLine(output),
+			err:    err,
+		}
+	}
+
+	// An empty bucket lists nothing but is still accessible.
+	return nil
+}
+
+func classifyAccessError(output string) string {
+	lower := strings.ToLower(output)
+	switch {
+	case strings.Contains(lower, "no such host"):
+		return "dns"
+	case strings.Contains(lower, "nosuchbucket"),
+		strings.Contains(lower, "bucket does not exist"),
+		strings.Contains(lower, "directory not found"):
+		return "missing_bucket"
+	case strings.Contains(lower, "accessdenied"),
+		strings.Contains(lower, "invalidaccesskeyid"),
+		strings.Contains(lower, "signaturedoesnotmatch"),
+		strings.Contains(lower, "403"):
+		return "auth"
+	case strings.Contains(lower, "connection refused"),
+		strings.Contains(lower, "i/o timeout"),
+		strings.Contains(lower, "tls"):
+		return "connection"
+	}
+	return "unknown"
+}
+
+func lastLine(output string) string {
+	if i := strings.LastIndexByte(output, '\n'); i >= 0 {
+		return output[i+1:]
+	}
+	return output
+}
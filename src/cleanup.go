@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// multipartCleanupModes are the CLEANUP_MULTIPART values besides true and
+// false: whether abandoned uploads are aborted before or after the sync.
+var multipartCleanupModes = []string{"before", "after"}
+
+// minMultipartMaxAge keeps the cleanup away from uploads a concurrent run
+// may still be sending.
+const minMultipartMaxAge = time.Hour
+
+// maxLoggedKeys is how many keys of abandoned uploads are logged.
+const maxLoggedKeys = 10
+
+// multipartCleanupMode normalizes CLEANUP_MULTIPART: true means before, and
+// false or 0 turn the cleanup off.
+func multipartCleanupMode(value string) string {
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case "true", "1":
+		return "before"
+	case "false", "0", "":
+		return ""
+	}
+	return value
+}
+
+func validateCleanup(config *Config) error {
+	if config.CleanupMultipart == "" {
+		return nil
+	}
+	if !contains(multipartCleanupModes, config.CleanupMultipart) {
+		return fmt.Errorf("invalid CLEANUP_MULTIPART %q: must be true, false, %s",
+			config.CleanupMultipart, strings.Join(multipartCleanupModes, " or "))
+	}
+	if d, err := time.ParseDuration(config.MultipartMaxAge); err != nil || d < minMultipartMaxAge {
+		return fmt.Errorf("invalid MULTIPART_MAX_AGE %q: must be a duration of at least 1h, so uploads in progress aren't aborted", config.MultipartMaxAge)
+	}
+	return nil
+}
+
+// multipartUpload is an incomplete upload as rclone's list-multipart-uploads
+// reports it.
+type multipartUpload struct {
+	Key       string    `json:"Key"`
+	UploadID  string    `json:"UploadId"`
+	Initiated time.Time `json:"Initiated"`
+}
+
+// cleanupMultipart aborts the multipart uploads under the destination that
+// were started more than MULTIPART_MAX_AGE ago. Interrupted runs leave them
+// behind, and providers bill their parts until a lifecycle rule or this
+// removes them. Failures are logged as warnings and counted in the metrics,
+// but don't fail the run. Dry runs only report what would be aborted.
+func cleanupMultipart(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) {
+	remote := remotePath("dest", config.Dest.Bucket, config.Dest.Prefix)
+	maxAge, _ := time.ParseDuration(config.MultipartMaxAge)
+	entry := logger.WithFields(logrus.Fields{"dest": remote, "multipart_max_age": config.MultipartMaxAge})
+
+	uploads, err := listMultipartUploads(config, remotes, remote)
+	if err != nil {
+		metrics.recordMultipartCleanup(config, 0, err)
+		entry.WithError(err).Warn("Failed to list incomplete multipart uploads, skipping the cleanup")
+		return
+	}
+	var stale []string
+	for _, u := range uploads {
+		if time.Since(u.Initiated) > maxAge {
+			stale = append(stale, u.Key)
+		}
+	}
+	abandoned := len(stale)
+	entry = entry.WithFields(logrus.Fields{"incomplete_uploads": len(uploads), "abandoned_uploads": abandoned})
+	if abandoned == 0 {
+		entry.Info("No abandoned multipart uploads")
+		return
+	}
+	if len(stale) > maxLoggedKeys {
+		stale = stale[:maxLoggedKeys]
+	}
+	entry = entry.WithField("keys", stale)
+	if config.DryRun {
+		entry.Info("Dry run, not aborting abandoned multipart uploads")
+		return
+	}
+
+	var stderr bytes.Buffer
+	cmd := remotes.command(config, "backend", "cleanup", remote, "-o", "max-age="+config.MultipartMaxAge)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		err = fmt.Errorf("rclone backend cleanup failed: %w: %s", err, lastLine(strings.TrimSpace(stderr.String())))
+		metrics.recordMultipartCleanup(config, 0, err)
+		entry.WithError(err).Warn("Failed to abort abandoned multipart uploads")
+		return
+	}
+	// The listing has no part sizes, so the space reclaimed isn't known.
+	metrics.recordMultipartCleanup(config, abandoned, nil)
+	entry.Info("Aborted abandoned multipart uploads")
+}
+
+// listMultipartUploads returns the incomplete multipart uploads under
+// remote.
+func listMultipartUploads(config *Config, remotes *rcloneRemotes, remote string) ([]multipartUpload, error) {
+	var stderr bytes.Buffer
+	cmd := remotes.command(config, "backend", "list-multipart-uploads", remote)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("rclone backend list-multipart-uploads failed: %w: %s", err, lastLine(strings.TrimSpace(stderr.String())))
+	}
+	// The output maps each bucket to its uploads.
+	var byBucket map[string][]multipartUpload
+	if err := json.Unmarshal(output, &byBucket); err != nil {
+		return nil, fmt.Errorf("unexpected output from rclone backend list-multipart-uploads: %w", err)
+	}
+	var uploads []multipartUpload
+	for _, u := range byBucket {
+		uploads = append(uploads, u...)
+	}
+	return uploads, nil
+}
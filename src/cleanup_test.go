@@ -0,0 +1,114 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMultipartCleanupMode(t *testing.T) {
+	for value, want := range map[string]string{"true": "before", "1": "before", "After": "after", "false": "", "0": "", "": "", "later": "later"} {
+		if got := multipartCleanupMode(value); got != want {
+			t.Errorf("multipartCleanupMode(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestValidateCleanup(t *testing.T) {
+	_, err := loadTestConfig(t, map[string]string{"CLEANUP_MULTIPART": "later"})
+	wantError(t, err, `invalid CLEANUP_MULTIPART "later": must be true, false, before or after`)
+	_, err = loadTestConfig(t, map[string]string{"CLEANUP_MULTIPART": "true", "MULTIPART_MAX_AGE": "30m"})
+	wantError(t, err, `invalid MULTIPART_MAX_AGE "30m": must be a duration of at least 1h`)
+}
+
+// multipartRclone lists one upload started in 2024 and one started now under
+// the destination, and fails backend cleanup with exit.
+func multipartRclone(t *testing.T, exit string) (path, calls string) {
+	return fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+if [ "$2" = list-multipart-uploads ]; then
+	echo '{"dest-bucket":[{"Key":"old.bin","UploadId":"1","Initiated":"2024-01-01T00:00:00Z"},{"Key":"new.bin","UploadId":"2","Initiated":"'$(date -u +%Y-%m-%dT%H:%M:%SZ)'"}]}'
+	exit 0
+fi
+if [ "$2" = cleanup ]; then
+	echo "AccessDenied" >&2
+	exit `+exit+`
+fi
+exit 0`)
+}
+
+// commands returns the rclone commands of calls, with the backend command
+// they ran.
+func commands(calls []string) []string {
+	var cmds []string
+	for _, call := range calls {
+		args := strings.Fields(call)
+		if args[0] == "backend" {
+			cmds = append(cmds, args[0]+" "+args[1])
+		} else if args[0] != "version" {
+			cmds = append(cmds, args[0])
+		}
+	}
+	return cmds
+}
+
+func TestCleanupMultipart(t *testing.T) {
+	for _, tt := range []struct {
+		mode string
+		want []string
+	}{
+		{"true", []string{"backend list-multipart-uploads", "backend cleanup", "sync"}},
+		{"after", []string{"sync", "backend list-multipart-uploads", "backend cleanup"}},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			path, calls := multipartRclone(t, "0")
+			setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "CLEANUP_MULTIPART": tt.mode, "MULTIPART_MAX_AGE": "48h"}))
+			var result runResult
+			out := captureOutput(t, func() { result, _ = run(nil) })
+			if result.code != 0 {
+				t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+			}
+			runs := readCalls(t, calls)
+			if got := commands(runs); !slices.Equal(got, tt.want) {
+				t.Errorf("rclone ran %q, want %q", got, tt.want)
+			}
+			for _, run := range runs {
+				if strings.HasPrefix(run, "backend cleanup ") && !strings.HasSuffix(run, "dest:dest-bucket/source-bucket -o max-age=48h") {
+					t.Errorf("cleanup ran %q, want MULTIPART_MAX_AGE", run)
+				}
+			}
+			e := findEntry(logEntries(t, out), "Aborted abandoned multipart uploads")
+			if e == nil || e["incomplete_uploads"] != float64(2) || e["abandoned_uploads"] != float64(1) {
+				t.Errorf("cleanup logged as %v", e)
+			} else if keys := e["keys"].([]any); len(keys) != 1 || keys[0] != "old.bin" {
+				t.Errorf("logged keys %v, want old.bin", keys)
+			}
+		})
+	}
+}
+
+func TestCleanupMultipartDryRun(t *testing.T) {
+	path, calls := multipartRclone(t, "0")
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "CLEANUP_MULTIPART": "true", "DRY_RUN": "true"}))
+	out := captureOutput(t, func() { run(nil) })
+	if slices.Contains(commands(readCalls(t, calls)), "backend cleanup") {
+		t.Error("dry run aborted uploads")
+	}
+	if findEntry(logEntries(t, out), "Dry run, not aborting abandoned multipart uploads") == nil {
+		t.Errorf("dry run not logged:\n%s", out)
+	}
+}
+
+func TestCleanupMultipartFails(t *testing.T) {
+	path, calls := multipartRclone(t, "1")
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "CLEANUP_MULTIPART": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	// A failed cleanup doesn't fail the run or keep it from syncing.
+	if result.code != 0 || !synced(readCalls(t, calls)) {
+		t.Errorf("run = %d, want 0 after syncing", result.code)
+	}
+	e := findEntry(logEntries(t, out), "Failed to abort abandoned multipart uploads")
+	if e == nil || e["level"] != "warning" || !strings.Contains(e["error"].(string), "AccessDenied") {
+		t.Errorf("failure logged as %v", e)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfigFile reads a YAML or JSON configuration file. Keys are the
+// lower-cased environment variable names (e.g. source_bucket or
+// source_secret_key_file). The result is keyed by environment variable name.
+func loadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	known := make(map[string]string, len(options))
+	for _, opt := range allOptions() {
+		if opt.env != "CONFIG_FILE" {
+			known[strings.ToLower(opt.env)] = opt.env
+		}
+	}
+
+	values := make(map[string]string, len(raw))
+	var unknown []string
+	for key, value := range raw {
+		env, ok := known[strings.ToLower(key)]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+
+		str, err := scalarString(value)
+		if err != nil {
+			return nil, fmt.Errorf("config file %s: key %s: %w", path, key, err)
+		}
+		values[env] = str
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("config file %s: unknown keys: %s", path, strings.Join(unknown, ", "))
+	}
+
+	return values, nil
+}
+
+func scalarString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("expected a scalar value, got %T", value)
+	}
+}
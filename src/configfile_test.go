@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfigFile writes content to a config file in a temporary directory
+// and returns its path.
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	file := writeConfigFile(t, "config.yaml", `
+source_prefix: file-source
+dest_prefix: file-dest
+transfers: 16
+dry_run: true
+`)
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		// prefix is the DEST_PREFIX that applies.
+		prefix    string
+		transfers int
+		dryRun    bool
+	}{
+		{name: "file", prefix: "file-dest", transfers: 16, dryRun: true},
+		{name: "environment over file", env: map[string]string{"DEST_PREFIX": "env-dest", "TRANSFERS": "8"}, prefix: "env-dest", transfers: 8, dryRun: true},
+		{name: "flag over environment", env: map[string]string{"DEST_PREFIX": "env-dest"}, args: []string{"--dest-prefix", "flag-dest", "--dry-run=false"}, prefix: "flag-dest", transfers: 16},
+		// A set variable overrides the file even when it is empty; a setting
+		// that needs a value then has its default.
+		{name: "empty variable", env: map[string]string{"DEST_PREFIX": "", "TRANSFERS": ""}, prefix: "", transfers: 4, dryRun: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestEnv(t, withEnv(map[string]string{"CONFIG_FILE": file}))
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			configs, err := loadConfigs(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := configs[0]
+			if config.Dest.Prefix != tt.prefix || config.Transfers != tt.transfers || config.DryRun != tt.dryRun {
+				t.Errorf("DEST_PREFIX %q, TRANSFERS %d, DRY_RUN %v; want %q, %d, %v",
+					config.Dest.Prefix, config.Transfers, config.DryRun, tt.prefix, tt.transfers, tt.dryRun)
+			}
+			if config.Source.Prefix != "file-source" {
+				t.Errorf("SOURCE_PREFIX = %q, want the file's", config.Source.Prefix)
+			}
+		})
+	}
+}
+
+func TestConfigFileDefaults(t *testing.T) {
+	setTestEnv(t, withEnv(map[string]string{"CONFIG_FILE": writeConfigFile(t, "config.yaml", "dest_prefix: backup\n")}))
+	configs, err := loadConfigs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := configs[0]; config.Transfers != 4 || config.SyncMode != "sync" || config.MaxDelete != 1000 {
+		t.Errorf("TRANSFERS %d, SYNC_MODE %q, MAX_DELETE %d; want the defaults", config.Transfers, config.SyncMode, config.MaxDelete)
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, file, content, want string
+	}{
+		{"unknown keys", "config.yaml", "dest_bucket: media\ntransfer: 8\nsoruce_prefix: a\n", "unknown keys: soruce_prefix, transfer"},
+		{"CONFIG_FILE itself", "config.yaml", "config_file: other.yaml\n", "unknown keys: config_file"},
+		{"not a scalar", "config.yaml", "exclude_prefixes:\n  - tmp\n", "key exclude_prefixes: expected a scalar value"},
+		{"invalid YAML", "config.yaml", "dest_bucket: [media\n", "failed to parse config file"},
+		{"invalid JSON", "config.json", `{"dest_bucket": "media"`, "failed to parse config file"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfigFile(writeConfigFile(t, tt.file, tt.content))
+			wantError(t, err, tt.want)
+		})
+	}
+	_, err := loadConfigFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	wantError(t, err, "failed to read config file")
+}
+
+func TestConfigFileSecrets(t *testing.T) {
+	secretFile := writeConfigFile(t, "dest-secret", "file-secret\n")
+	for _, tt := range []struct {
+		name    string
+		content string
+		env     map[string]string
+		want    string
+		err     string
+	}{
+		{name: "inline", content: "dest_secret_key: inline-secret\n", want: "inline-secret"},
+		{name: "_file key", content: "dest_secret_key_file: " + secretFile + "\n", want: "file-secret"},
+		{name: "JSON _file key", content: `{"dest_secret_key_file": "` + secretFile + `"}`, want: "file-secret"},
+		{name: "environment over _file key", content: "dest_secret_key_file: " + secretFile + "\n", env: map[string]string{"DEST_SECRET_KEY": "env-secret"}, want: "env-secret"},
+		{name: "both forms in the file", content: "dest_secret_key: inline-secret\ndest_secret_key_file: " + secretFile + "\n", err: "both DEST_SECRET_KEY and DEST_SECRET_KEY_FILE are set"},
+		{name: "missing secret file", content: "dest_secret_key_file: /nonexistent/secret\n", err: "DEST_SECRET_KEY_FILE"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env := withEnv(map[string]string{"CONFIG_FILE": writeConfigFile(t, "config.yaml", tt.content), "DEST_SECRET_KEY": ""})
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			setTestEnv(t, env)
+			configs, err := loadConfigs(nil)
+			wantError(t, err, tt.err)
+			if err == nil && configs[0].Dest.SecretKey != tt.want {
+				t.Errorf("DEST_SECRET_KEY = %q, want %q", configs[0].Dest.SecretKey, tt.want)
+			}
+		})
+	}
+}
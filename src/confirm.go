@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// confirmPollInterval is how often CONFIRM_TOKEN_FILE is checked.
+const confirmPollInterval = time.Second
+
+var (
+	errConfirmRejected = errors.New("the plan was rejected")
+	errConfirmTimeout  = errors.New("no confirmation arrived before CONFIRM_TIMEOUT")
+)
+
+func validateConfirm(config *Config) error {
+	if !config.Confirm {
+		if config.ConfirmTokenFile != "" {
+			return fmt.Errorf("CONFIRM_TOKEN_FILE requires CONFIRM=true")
+		}
+		return nil
+	}
+	if d, err := time.ParseDuration(config.ConfirmTimeout); err != nil || d <= 0 {
+		return fmt.Errorf("invalid CONFIRM_TIMEOUT %q: must be a positive duration like 15m", config.ConfirmTimeout)
+	}
+	if config.SQSQueueURL != "" {
+		return fmt.Errorf("CONFIRM is not available with SQS_QUEUE_URL")
+	}
+	if config.ConfirmTokenFile == "" {
+		switch {
+		case config.Schedule != "" || config.HTTPAddr != "":
+			return fmt.Errorf("CONFIRM with SCHEDULE or HTTP_ADDR needs CONFIRM_TOKEN_FILE, as nobody answers on stdin")
+		case config.JobConcurrency > 1:
+			return fmt.Errorf("CONFIRM on stdin is not available with JOB_CONCURRENCY > 1; set CONFIRM_TOKEN_FILE")
+		}
+	}
+	return nil
+}
+
+// planAndConfirm runs the sync as a dry run, shows what it would change and
+// waits for approval. It returns false if the plan has no changes, so there
+// is nothing to apply. The plan uses the same configuration as the real
+// sync except for DRY_RUN, so both run with the same rclone arguments; the
+// source may still change in between.
+func planAndConfirm(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) (bool, error) {
+	plan := *config
+	plan.DryRun = true
+	plan.manifest = nil
+	plan.diff = newDiffReport(config.DiffKeyLimit)
+
+	if err := clearToken(config, logger); err != nil {
+		return false, &classError{class: "confirmation", err: err}
+	}
+	logger.Info("CONFIRM is set, planning the sync with a dry run")
+	if _, err := runSync(&plan, remotes, logger); err != nil {
+		return false, err
+	}
+	entry := logger.WithFields(plan.diff.fields())
+	if config.DiffReportFile != "" {
+		path := jobPath(config, config.DiffReportFile)
+		if err := writeDiffReport(path, plan.diff); err != nil {
+			return false, &classError{class: "setup", err: err}
+		}
+		entry = entry.WithField("diff_report_file", path)
+	}
+	if plan.diff.empty() {
+		entry.Info("The plan has no changes, nothing to apply")
+		return false, nil
+	}
+
+	timeout, _ := time.ParseDuration(config.ConfirmTimeout)
+	var err error
+	if config.ConfirmTokenFile != "" {
+		entry.WithFields(logrus.Fields{
+			"confirm_token_file": config.ConfirmTokenFile,
+			"confirm_timeout":    config.ConfirmTimeout,
+		}).Warn("Plan ready, create CONFIRM_TOKEN_FILE to apply it")
+		err = waitForToken(config.ConfirmTokenFile, timeout)
+	} else {
+		entry.Warn("Plan ready, waiting for confirmation on stdin")
+		fmt.Fprintf(os.Stderr, "\nPlan: %d to copy (%s), %d to update (%s), %d to delete.\n",
+			plan.diff.Copy.Count, formatSize(plan.diff.Copy.Bytes),
+			plan.diff.Update.Count, formatSize(plan.diff.Update.Bytes),
+			plan.diff.Delete.Count)
+		fmt.Fprintf(os.Stderr, "Apply this plan to %s? Only 'yes' will be accepted: ",
+			remotePath("dest", config.Dest.Bucket, config.Dest.Prefix))
+		err = askConfirmation(os.Stdin, timeout)
+	}
+	if err != nil {
+		return false, &classError{class: "confirmation", err: err}
+	}
+	logger.Info("Plan confirmed, applying it")
+	return true, nil
+}
+
+// askConfirmation reads one line from r and accepts only "yes". A closed
+// stdin counts as a rejection.
+func askConfirmation(r io.Reader, timeout time.Duration) error {
+	answer := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		answer <- strings.TrimSpace(line)
+	}()
+	select {
+	case a := <-answer:
+		if a != "yes" {
+			return errConfirmRejected
+		}
+		return nil
+	case <-time.After(timeout):
+		return errConfirmTimeout
+	case <-shutdown.interrupted():
+		return shutdown.err()
+	}
+}
+
+// waitForToken waits for path to appear and removes it, so that one token
+// approves one plan. A token containing "no" rejects the plan.
+func waitForToken(path string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		content, err := os.ReadFile(path)
+		if err == nil {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove CONFIRM_TOKEN_FILE: %w", err)
+			}
+			if strings.EqualFold(strings.TrimSpace(string(content)), "no") {
+				return errConfirmRejected
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read CONFIRM_TOKEN_FILE: %w", err)
+		}
+		if time.Now().After(deadline) {
+			return errConfirmTimeout
+		}
+		select {
+		case <-time.After(confirmPollInterval):
+		case <-shutdown.interrupted():
+			return shutdown.err()
+		}
+	}
+}
+
+// clearToken removes a CONFIRM_TOKEN_FILE that exists before planning, so
+// that a stale token can't approve a plan nobody has seen.
+func clearToken(config *Config, logger *logrus.Logger) error {
+	if config.ConfirmTokenFile == "" {
+		return nil
+	}
+	err := os.Remove(config.ConfirmTokenFile)
+	switch {
+	case err == nil:
+		logger.WithField("confirm_token_file", config.ConfirmTokenFile).Warn("Removed a stale confirmation token")
+	case !errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("failed to remove stale CONFIRM_TOKEN_FILE: %w", err)
+	}
+	return nil
+}
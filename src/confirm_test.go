@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateConfirm(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"CONFIRM": "true"}, ""},
+		{map[string]string{"CONFIRM": "true", "CONFIRM_TOKEN_FILE": "/tmp/token", "SCHEDULE": "@hourly"}, ""},
+		{map[string]string{"CONFIRM_TOKEN_FILE": "/tmp/token"}, "CONFIRM_TOKEN_FILE requires CONFIRM=true"},
+		{map[string]string{"CONFIRM": "true", "CONFIRM_TIMEOUT": "soon"}, `invalid CONFIRM_TIMEOUT "soon"`},
+		{map[string]string{"CONFIRM": "true", "CONFIRM_TIMEOUT": "0s"}, `invalid CONFIRM_TIMEOUT "0s"`},
+		{map[string]string{"CONFIRM": "true", "SCHEDULE": "@hourly"}, "CONFIRM with SCHEDULE or HTTP_ADDR needs CONFIRM_TOKEN_FILE"},
+		{map[string]string{"CONFIRM": "true", "SQS_QUEUE_URL": "https://sqs.eu-west-1.amazonaws.com/1/queue"}, "CONFIRM is not available with SQS_QUEUE_URL"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestAskConfirmation(t *testing.T) {
+	for answer, want := range map[string]error{
+		"yes\n":   nil,
+		" yes \n": nil,
+		"yes":     nil,
+		"y\n":     errConfirmRejected,
+		"YES\n":   errConfirmRejected,
+		"no\n":    errConfirmRejected,
+		"":        errConfirmRejected,
+	} {
+		if err := askConfirmation(strings.NewReader(answer), time.Second); err != want {
+			t.Errorf("answer %q: %v, want %v", answer, err, want)
+		}
+	}
+
+	// Nobody answers.
+	r, w := io.Pipe()
+	defer w.Close()
+	if err := askConfirmation(r, 10*time.Millisecond); err != errConfirmTimeout {
+		t.Errorf("no answer: %v, want %v", err, errConfirmTimeout)
+	}
+}
+
+func TestWaitForToken(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	for content, want := range map[string]error{
+		"":      nil,
+		"yes\n": nil,
+		"NO\n":  errConfirmRejected,
+	} {
+		if err := os.WriteFile(token, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := waitForToken(token, time.Second); err != want {
+			t.Errorf("token %q: %v, want %v", content, err, want)
+		}
+		// One token approves one plan.
+		if _, err := os.Stat(token); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("token %q wasn't removed", content)
+		}
+	}
+	if err := waitForToken(token, 0); err != errConfirmTimeout {
+		t.Errorf("missing token: %v, want %v", err, errConfirmTimeout)
+	}
+}
+
+// confirmRclone plans the changes of diffRclone in a dry run and then
+// writes content to the token file, as the person who confirms would.
+func confirmRclone(t *testing.T, token, content string) (path, calls string) {
+	return fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+case "$*" in *--dry-run*)
+echo '{"level":"notice","msg":"Skipped copy as --dry-run is set (size 5)","object":"new.txt","size":5}' >&2
+printf '`+content+`' > `+token+`
+esac
+exit 0`)
+}
+
+// syncRuns returns the rclone sync runs in calls and how many of them were
+// dry runs.
+func syncRuns(t *testing.T, calls string) (runs, dryRuns int) {
+	t.Helper()
+	for _, call := range readCalls(t, calls) {
+		if !strings.HasPrefix(call, "sync ") {
+			continue
+		}
+		runs++
+		if strings.Contains(call, "--dry-run") {
+			dryRuns++
+		}
+	}
+	return runs, dryRuns
+}
+
+func TestConfirmTokenFile(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	// A token from before the plan is removed rather than taken as approval.
+	if err := os.WriteFile(token, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path, calls := confirmRclone(t, token, "yes")
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "CONFIRM": "true", "CONFIRM_TOKEN_FILE": token}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+	entries := logEntries(t, out)
+	if findEntry(entries, "Removed a stale confirmation token") == nil || findEntry(entries, "Plan confirmed, applying it") == nil {
+		t.Errorf("stale token or confirmation not logged:\n%s", out)
+	}
+	if runs, dryRuns := syncRuns(t, calls); runs != 2 || dryRuns != 1 {
+		t.Errorf("rclone synced %d times, %d of them dry runs; want the plan and then the sync", runs, dryRuns)
+	}
+}
+
+func TestConfirmRejected(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	path, calls := confirmRclone(t, token, "no")
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "CONFIRM": "true", "CONFIRM_TOKEN_FILE": token}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 1 {
+		t.Errorf("run = %d, want 1 for a rejected plan:\n%s", result.code, out)
+	}
+	if entry := findEntry(logEntries(t, out), "S3 sync job failed"); entry == nil || entry["error_class"] != "confirmation" {
+		t.Errorf("rejection logged as %v, want error_class confirmation", entry)
+	}
+	if runs, dryRuns := syncRuns(t, calls); runs != 1 || dryRuns != 1 {
+		t.Errorf("rclone synced %d times, %d of them dry runs; want only the plan", runs, dryRuns)
+	}
+}
+
+func TestConfirmNoChanges(t *testing.T) {
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+	token := filepath.Join(t.TempDir(), "token")
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "CONFIRM": "true", "CONFIRM_TOKEN_FILE": token}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 || findEntry(logEntries(t, out), "The plan has no changes, nothing to apply") == nil {
+		t.Errorf("run = %d, want 0 and nothing to apply:\n%s", result.code, out)
+	}
+	if runs, _ := syncRuns(t, calls); runs != 1 {
+		t.Errorf("rclone synced %d times, want only the plan", runs)
+	}
+}
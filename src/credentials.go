@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// authModes are the values the _AUTH settings accept: the static keys of
+// _ACCESS_KEY and _SECRET_KEY, the AWS_* variables of the environment, or the
+// IAM role of the pod (IRSA), ECS task or EC2 instance.
+var authModes = []string{"static", "env", "iam"}
+
+// awsCredentialVars are the variables rclone's env_auth would read keys from
+// before it gets to the IAM role.
+var awsCredentialVars = []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE"}
+
+// credentialsRefreshWindow is how long before they expire temporary
+// credentials are fetched again, so that no request is signed with
+// credentials that run out on the way.
+const credentialsRefreshWindow = 5 * time.Minute
+
+// credentialProvider gives the credentials to sign a request with.
+type credentialProvider interface {
+	retrieve(ctx context.Context) (awsCredentials, error)
+}
+
+type staticCredentials awsCredentials
+
+func (c staticCredentials) retrieve(context.Context) (awsCredentials, error) {
+	return awsCredentials(c), nil
+}
+
+// refreshingCredentials caches the temporary credentials fetch returns until
+// shortly before they expire. It is shared by the clients of a remote.
+type refreshingCredentials struct {
+	fetch func(ctx context.Context) (awsCredentials, error)
+
+	mu    sync.Mutex
+	creds awsCredentials
+}
+
+func (c *refreshingCredentials) retrieve(ctx context.Context) (awsCredentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.creds.accessKey != "" && time.Until(c.creds.expires) > credentialsRefreshWindow {
+		return c.creds, nil
+	}
+	creds, err := c.fetch(ctx)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	c.creds = creds
+	return creds, nil
+}
+
+// newCredentialProvider returns the provider of the credentials of remote
+// for the requests s3-sync signs itself.
+func newCredentialProvider(remote RemoteConfig) credentialProvider {
+	var provider credentialProvider
+	switch remote.Auth {
+	case "env":
+		provider = staticCredentials(remote.envCredentials)
+	case "iam":
+		provider = &refreshingCredentials{fetch: roleCredentials}
+	default:
+		provider = staticCredentials{accessKey: remote.AccessKey, secretKey: remote.SecretKey}
+	}
+	if remote.RoleARN == "" {
+		return provider
+	}
+	// The credentials of _AUTH are then only used to assume the role.
+	return &refreshingCredentials{fetch: func(ctx context.Context) (awsCredentials, error) {
+		return assumeRole(ctx, remote, provider)
+	}}
+}
+
+// loadEnvCredentials reads the keys of _AUTH=env from the AWS_* variables,
+// which can be given as _FILE like the other keys.
+func loadEnvCredentials(src *configSource) awsCredentials {
+	return awsCredentials{
+		accessKey:    src.getSecret("AWS_ACCESS_KEY_ID"),
+		secretKey:    src.getSecret("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: src.getSecret("AWS_SESSION_TOKEN"),
+	}
+}
+
+// credentialsClient fetches role credentials. The metadata endpoints answer
+// quickly or not at all, e.g. outside of EC2.
+var credentialsClient = &http.Client{Timeout: 10 * time.Second}
+
+// roleCredentials fetches the credentials of the IAM role s3-sync runs as,
+// trying the sources in the order of the AWS SDKs: a web identity token
+// (IRSA on EKS), the ECS container endpoint, then the EC2 instance metadata.
+func roleCredentials(ctx context.Context) (awsCredentials, error) {
+	if os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "" {
+		return webIdentityCredentials(ctx)
+	}
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		return containerCredentials(ctx)
+	}
+	return instanceCredentials(ctx)
+}
+
+// webIdentityCredentials exchanges the service account token for role
+// credentials with STS AssumeRoleWithWebIdentity. The token file is read on
+// every refresh, as the kubelet rotates it.
+func webIdentityCredentials(ctx context.Context) (awsCredentials, error) {
+	token, err := os.ReadFile(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to read the web identity token: %w", err)
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("s3-sync-%d", time.Now().Unix())
+	}
+	params := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, stsEndpoint(), strings.NewReader(params.Encode()))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	data, err := fetchCredentials(req, "STS AssumeRoleWithWebIdentity credentials")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var result struct {
+		Credentials stsCredentials `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(data, &result); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid STS AssumeRoleWithWebIdentity response: %w", err)
+	}
+	return result.Credentials.credentials()
+}
+
+// stsEndpoint is the STS endpoint of AWS_REGION, or the global one.
+// AWS_ENDPOINT_URL_STS overrides it as in the AWS SDKs.
+func stsEndpoint() string {
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL_STS"); endpoint != "" {
+		return endpoint
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return "https://sts." + region + ".amazonaws.com"
+	}
+	return "https://sts.amazonaws.com"
+}
+
+// stsRegion is the region requests to stsEndpoint are signed for.
+func stsRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+// stsCredentials are the temporary credentials in an STS response.
+type stsCredentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+func (c stsCredentials) credentials() (awsCredentials, error) {
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return awsCredentials{}, errors.New("the STS response has no credentials")
+	}
+	return awsCredentials{accessKey: c.AccessKeyID, secretKey: c.SecretAccessKey, sessionToken: c.SessionToken, expires: c.Expiration}, nil
+}
+
+// containerCredentials fetches the task role credentials from the ECS (or
+// EKS Pod Identity) container endpoint.
+func containerCredentials(ctx context.Context) (awsCredentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = "http://169.254.170.2" + relative
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if path := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("failed to read the container authorization token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	data, err := fetchCredentials(req, "container credentials")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	return parseRoleCredentials(data, "container credentials")
+}
+
+// instanceCredentials fetches the instance profile credentials from the EC2
+// instance metadata service, with an IMDSv2 session token.
+// AWS_EC2_METADATA_SERVICE_ENDPOINT overrides its address as in the AWS SDKs.
+func instanceCredentials(ctx context.Context) (awsCredentials, error) {
+	endpoint := strings.TrimSuffix(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+	if endpoint == "" {
+		endpoint = "http://169.254.169.254"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := fetchCredentials(req, "instance metadata token")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	get := func(path, what string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/latest/meta-data/iam/security-credentials/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return fetchCredentials(req, what)
+	}
+	roles, err := get("", "instance profile")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, errors.New("the instance has no instance profile")
+	}
+	data, err := get(role, "instance profile credentials")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	return parseRoleCredentials(data, "instance profile credentials")
+}
+
+// fetchCredentials sends req and returns the body of a successful response.
+func fetchCredentials(req *http.Request, what string) ([]byte, error) {
+	resp, err := credentialsClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", what, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", what, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		// STS has the error in XML, the metadata endpoints in plain text.
+		var failure struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &failure) == nil && failure.Code != "" {
+			return nil, fmt.Errorf("failed to get %s: %s: %s", what, failure.Code, failure.Message)
+		}
+		return nil, fmt.Errorf("failed to get %s: %s: %s", what, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// parseRoleCredentials decodes the JSON credentials of the container and
+// instance metadata endpoints.
+func parseRoleCredentials(data []byte, what string) (awsCredentials, error) {
+	var creds struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid %s: %w", what, err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("invalid %s: no access key", what)
+	}
+	return awsCredentials{accessKey: creds.AccessKeyID, secretKey: creds.SecretAccessKey, sessionToken: creds.Token, expires: creds.Expiration}, nil
+}
+
+// rcloneEnviron is the environment rclone inherits. With a remote on
+// _AUTH=iam the AWS keys of the environment are left out, so that rclone's
+// credential chain gets to the role for it rather than picking up keys
+// meant for the other remote; those are passed to their remote through its
+// own options.
+func rcloneEnviron(config *Config) []string {
+	if config.Source.Auth != "iam" && config.Dest.Auth != "iam" {
+		return os.Environ()
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if !contains(awsCredentialVars, name) {
+			env = append(env, kv)
+		}
+	}
+	// A shared credentials file would come before the role as well.
+	return append(env, "AWS_SHARED_CREDENTIALS_FILE="+os.DevNull)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// envAuth configures the destination with _AUTH=env instead of its keys.
+var envAuth = map[string]string{"DEST_AUTH": "env", "DEST_ACCESS_KEY": "", "DEST_SECRET_KEY": ""}
+
+func TestAuthValidation(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{
+			name: "env",
+			env:  map[string]string{"AWS_ACCESS_KEY_ID": "aws-access", "AWS_SECRET_ACCESS_KEY": "aws-secret"},
+		},
+		{
+			name: "env without keys",
+			want: "DEST_AUTH=env requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY",
+		},
+		{
+			name: "env with the destination keys",
+			env:  map[string]string{"AWS_ACCESS_KEY_ID": "aws-access", "AWS_SECRET_ACCESS_KEY": "aws-secret", "DEST_ACCESS_KEY": "dest-access"},
+			want: "DEST_AUTH=env doesn't use DEST_ACCESS_KEY",
+		},
+		{
+			name: "iam",
+			env:  map[string]string{"DEST_AUTH": "iam"},
+		},
+		{
+			name: "unknown mode",
+			env:  map[string]string{"DEST_AUTH": "profile"},
+			want: `invalid DEST_AUTH "profile"`,
+		},
+		{
+			name: "static without keys",
+			env:  map[string]string{"DEST_AUTH": "static"},
+			want: "required environment variable DEST_ACCESS_KEY is not set",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{}
+			for key, value := range envAuth {
+				env[key] = value
+			}
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			_, err := loadTestConfig(t, env)
+			wantError(t, err, tt.want)
+		})
+	}
+}
+
+func TestEnvAuthSources(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("file-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configFile, []byte("aws_access_key_id: file-access\naws_session_token: file-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		want awsCredentials
+	}{
+		{
+			name: "environment",
+			env:  map[string]string{"AWS_ACCESS_KEY_ID": "env-access", "AWS_SECRET_ACCESS_KEY": "env-secret"},
+			want: awsCredentials{accessKey: "env-access", secretKey: "env-secret"},
+		},
+		{
+			name: "secret file",
+			env:  map[string]string{"AWS_ACCESS_KEY_ID": "env-access", "AWS_SECRET_ACCESS_KEY_FILE": secretFile},
+			want: awsCredentials{accessKey: "env-access", secretKey: "file-secret"},
+		},
+		{
+			name: "config file",
+			env:  map[string]string{"CONFIG_FILE": configFile, "AWS_SECRET_ACCESS_KEY": "env-secret"},
+			want: awsCredentials{accessKey: "file-access", secretKey: "env-secret", sessionToken: "file-token"},
+		},
+		{
+			name: "flags",
+			env:  map[string]string{"AWS_ACCESS_KEY_ID": "env-access"},
+			args: []string{"--aws-access-key-id", "flag-access", "--aws-secret-access-key", "flag-secret"},
+			want: awsCredentials{accessKey: "flag-access", secretKey: "flag-secret"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env := withEnv(envAuth)
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			setTestEnv(t, env)
+			configs, err := loadConfigs(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := configs[0].Dest.envCredentials; got != tt.want {
+				t.Errorf("credentials = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvAuthRcloneEnv(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{
+		"DEST_AUTH": "env", "DEST_ACCESS_KEY": "", "DEST_SECRET_KEY": "",
+		"AWS_ACCESS_KEY_ID": "aws-access", "AWS_SECRET_ACCESS_KEY": "aws-secret", "AWS_SESSION_TOKEN": "aws-token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := renderRcloneEnv(config)
+	for _, want := range []string{
+		"RCLONE_CONFIG_SOURCE_ACCESS_KEY_ID=source-access",
+		"RCLONE_CONFIG_DEST_ENV_AUTH=true",
+		"RCLONE_CONFIG_DEST_ACCESS_KEY_ID=aws-access",
+		"RCLONE_CONFIG_DEST_SECRET_ACCESS_KEY=aws-secret",
+		"RCLONE_CONFIG_DEST_SESSION_TOKEN=aws-token",
+	} {
+		if !slices.Contains(env, want) {
+			t.Errorf("rclone environment lacks %s: %v", want, env)
+		}
+	}
+	if slices.Contains(env, "RCLONE_CONFIG_SOURCE_ENV_AUTH=true") {
+		t.Errorf("static source has env_auth: %v", env)
+	}
+}
+
+func TestIAMAuthRcloneEnv(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{
+		"DEST_AUTH": "iam", "DEST_ACCESS_KEY": "", "DEST_SECRET_KEY": "",
+		"AWS_ACCESS_KEY_ID": "aws-access", "AWS_SECRET_ACCESS_KEY": "aws-secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_PROFILE", "other")
+	env := rcloneEnviron(config)
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if contains(awsCredentialVars, name) {
+			t.Errorf("rclone inherits %s with DEST_AUTH=iam", kv)
+		}
+	}
+	if !slices.Contains(env, "AWS_SHARED_CREDENTIALS_FILE="+os.DevNull) {
+		t.Errorf("rclone environment doesn't disable the shared credentials file")
+	}
+	if !slices.Contains(renderRcloneEnv(config), "RCLONE_CONFIG_DEST_ENV_AUTH=true") {
+		t.Errorf("iam remote lacks env_auth")
+	}
+}
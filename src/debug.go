@@ -0,0 +1,94 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runtimeStatsInterval is how often DEBUG_ADDR logs goroutine and heap
+// statistics.
+const runtimeStatsInterval = time.Minute
+
+func validateDebug(config *Config) error {
+	if config.DebugAddr != "" {
+		if _, _, err := net.SplitHostPort(config.DebugAddr); err != nil {
+			return fmt.Errorf("invalid DEBUG_ADDR %q: must look like 127.0.0.1:6060", config.DebugAddr)
+		}
+		if config.DebugAddr == config.HTTPAddr {
+			return fmt.Errorf("DEBUG_ADDR must differ from HTTP_ADDR, so profiles are never served on the main port")
+		}
+	}
+	if config.RcloneRCAddr != "" {
+		if _, _, err := net.SplitHostPort(config.RcloneRCAddr); err != nil {
+			return fmt.Errorf("invalid RCLONE_RC_ADDR %q: must look like 127.0.0.1:5572", config.RcloneRCAddr)
+		}
+		if config.JobConcurrency > 1 {
+			return fmt.Errorf("RCLONE_RC_ADDR can't be combined with JOB_CONCURRENCY above 1, as only one rclone can listen on it")
+		}
+	}
+	return nil
+}
+
+// rcArgs makes rclone serve its remote control API on RCLONE_RC_ADDR.
+func rcArgs(config *Config) []string {
+	if config.RcloneRCAddr == "" {
+		return nil
+	}
+	return []string{"--rc", "--rc-addr", config.RcloneRCAddr}
+}
+
+// startDebugServer serves pprof and expvar on DEBUG_ADDR and logs runtime
+// statistics at debug level until the process exits. It uses its own
+// listener and mux, so none of this is reachable through HTTP_ADDR.
+func startDebugServer(config *Config, logger *logrus.Logger) {
+	if config.DebugAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	listener, err := net.Listen("tcp", config.DebugAddr)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to start the debug server, continuing without it")
+		return
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logger.WithError(err).Warn("Debug server stopped")
+		}
+	}()
+	logger.WithField("addr", listener.Addr().String()).Info("Debug server started, serving /debug/pprof/, /debug/vars and /metrics")
+
+	go func() {
+		for range time.Tick(runtimeStatsInterval) {
+			logRuntimeStats(logger)
+		}
+	}()
+}
+
+func logRuntimeStats(logger *logrus.Logger) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	logger.WithFields(logrus.Fields{
+		"goroutines":   runtime.NumGoroutine(),
+		"heap_alloc":   m.HeapAlloc,
+		"heap_inuse":   m.HeapInuse,
+		"heap_objects": m.HeapObjects,
+		"sys":          m.Sys,
+		"num_gc":       m.NumGC,
+	}).Debug("Runtime statistics")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestDebugValidation(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		err  string
+	}{
+		{name: "debug server", env: map[string]string{"DEBUG_ADDR": "127.0.0.1:6060"}},
+		{name: "rc", env: map[string]string{"RCLONE_RC_ADDR": "127.0.0.1:5572"}},
+		{name: "bad address", env: map[string]string{"DEBUG_ADDR": "6060"}, err: `invalid DEBUG_ADDR "6060": must look like 127.0.0.1:6060`},
+		{name: "main port", env: map[string]string{"DEBUG_ADDR": ":8080", "HTTP_ADDR": ":8080"}, err: "DEBUG_ADDR must differ from HTTP_ADDR"},
+		{name: "bad rc address", env: map[string]string{"RCLONE_RC_ADDR": "localhost"}, err: `invalid RCLONE_RC_ADDR "localhost"`},
+		{name: "rc with parallel jobs", env: map[string]string{"RCLONE_RC_ADDR": "127.0.0.1:5572", "JOB_CONCURRENCY": "2"}, err: "RCLONE_RC_ADDR can't be combined with JOB_CONCURRENCY above 1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, tt.env)
+			wantError(t, err, tt.err)
+		})
+	}
+}
+
+func TestRcArgs(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"RCLONE_RC_ADDR": "127.0.0.1:5572"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := syncArgs(config)
+	if addr, _ := argValue(args, "--rc-addr"); addr != "127.0.0.1:5572" || !slices.Contains(args, "--rc") {
+		t.Errorf("rclone arguments %q don't serve the rc API on RCLONE_RC_ADDR", args)
+	}
+}
+
+func TestDebugServer(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"DEBUG_ADDR": "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetOutput(&logs)
+	startDebugServer(config, logger)
+
+	var started struct{ Addr string }
+	if err := json.Unmarshal(logs.Bytes(), &started); err != nil || started.Addr == "" {
+		t.Fatalf("the debug server didn't log its address: %s", logs.String())
+	}
+	for path, want := range map[string]string{"/debug/pprof/": "goroutine", "/debug/vars": `"memstats"`} {
+		resp, err := http.Get("http://" + started.Addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), want) {
+			t.Errorf("%s = %d, want a page with %s", path, resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// deletePercentFallbacks are the MAX_DELETE_PERCENT_ON_ERROR values: fail
+// aborts the run if the destination can't be counted, max-delete carries on
+// with MAX_DELETE alone.
+var deletePercentFallbacks = []string{"fail", "max-delete"}
+
+func validateDeletePercent(config *Config) error {
+	if !contains(deletePercentFallbacks, config.MaxDeletePercentOnError) {
+		return fmt.Errorf("invalid MAX_DELETE_PERCENT_ON_ERROR %q: must be one of %s",
+			config.MaxDeletePercentOnError, strings.Join(deletePercentFallbacks, ", "))
+	}
+	if config.MaxDeletePercent == 0 {
+		return nil
+	}
+	if config.MaxDeletePercent < 0 || config.MaxDeletePercent > 100 {
+		return fmt.Errorf("MAX_DELETE_PERCENT must be between 0 and 100, got %g", config.MaxDeletePercent)
+	}
+	if config.SyncMode != "sync" || config.DeleteStrategy == "none" {
+		return fmt.Errorf("MAX_DELETE_PERCENT only applies to SYNC_MODE=sync with deletions enabled; unset it")
+	}
+	return nil
+}
+
+// rcloneExitFatal is rclone's exit code for an error that retries won't fix,
+// which is how it reports reaching --max-delete.
+const rcloneExitFatal = 7
+
+// deleteLimitMarker is what rclone logs for each deletion it refuses once
+// --max-delete is reached.
+const deleteLimitMarker = "--max-delete threshold reached"
+
+// failedDeletesPattern matches rclone's closing count of the deletions that
+// failed, e.g. "failed to delete 12 files".
+var failedDeletesPattern = regexp.MustCompile(`failed to delete (\d+) files`)
+
+// deleteLimitError reports that rclone stopped deleting at the delete limit,
+// leaving extraneous objects in the destination.
+type deleteLimitError struct {
+	limit int
+	// skipped is the number of deletions rclone refused, or 0 if it didn't
+	// report them.
+	skipped int
+	err     error
+}
+
+func (e *deleteLimitError) Error() string {
+	return fmt.Sprintf("delete limit of %d reached, partial sync: %v", e.limit, e.err)
+}
+
+func (e *deleteLimitError) Unwrap() error { return e.err }
+
+// asDeleteLimitError wraps err in a deleteLimitError if rclone exited with a
+// fatal error after logging that --max-delete was reached, and returns it
+// unchanged otherwise.
+func asDeleteLimitError(config *Config, err error, stderr *lineTail) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != rcloneExitFatal || !stderr.contains(deleteLimitMarker) {
+		return err
+	}
+	limit, _ := deleteLimit(config)
+	limitErr := &deleteLimitError{limit: limit, err: err}
+	for _, line := range stderr.Lines() {
+		if m := failedDeletesPattern.FindStringSubmatch(line); m != nil {
+			limitErr.skipped, _ = strconv.Atoi(m[1])
+		}
+	}
+	return limitErr
+}
+
+// deleteLimit returns the --max-delete value for a sync: the smaller of
+// MAX_DELETE and the limit computed from MAX_DELETE_PERCENT for this run,
+// and false if neither applies. A MAX_DELETE of 0 allows no deletions, and a
+// negative one means no limit.
+func deleteLimit(config *Config) (int, bool) {
+	limit, ok := config.MaxDelete, config.MaxDelete >= 0
+	if p := config.percentDeleteLimit; p != nil && (!ok || *p < limit) {
+		limit, ok = *p, true
+	}
+	return limit, ok
+}
+
+// applyDeletePercent counts the destination objects and sets the delete
+// limit for this run to MAX_DELETE_PERCENT of them, rounded down. If
+// counting fails, MAX_DELETE_PERCENT_ON_ERROR decides between failing the
+// run and going ahead with MAX_DELETE alone.
+func applyDeletePercent(config *Config, counts *objectCounts, logger *logrus.Logger) error {
+	config.percentDeleteLimit = nil
+	if config.MaxDeletePercent == 0 {
+		return nil
+	}
+	count, err := counts.dest()
+	if err != nil {
+		if config.MaxDeletePercentOnError == "fail" {
+			return &classError{class: "preflight", err: fmt.Errorf("MAX_DELETE_PERCENT: %w", err)}
+		}
+		logger.WithError(err).WithField("max_delete", config.MaxDelete).
+			Warn("Failed to count the destination objects, falling back to MAX_DELETE")
+		return nil
+	}
+
+	limit := int(float64(count) * config.MaxDeletePercent / 100)
+	config.percentDeleteLimit = &limit
+	effective, _ := deleteLimit(config)
+	logger.WithFields(logrus.Fields{
+		"dest_objects":       count,
+		"max_delete_percent": config.MaxDeletePercent,
+		"percent_limit":      limit,
+		"max_delete":         effective,
+	}).Info("Deletion threshold")
+	return nil
+}
+
+// objectCounts counts the objects of the source and destination once per
+// run, for the checks that need them before the sync.
+type objectCounts struct {
+	config  *Config
+	remotes *rcloneRemotes
+
+	sourceCount, destCount *int64
+}
+
+func newObjectCounts(config *Config, remotes *rcloneRemotes) *objectCounts {
+	return &objectCounts{config: config, remotes: remotes}
+}
+
+func (c *objectCounts) source() (int64, error) {
+	return c.count(&c.sourceCount, remotePath("source", c.config.Source.Bucket, c.config.Source.Prefix))
+}
+
+func (c *objectCounts) dest() (int64, error) {
+	return c.count(&c.destCount, remotePath("dest", c.config.Dest.Bucket, c.config.Dest.Prefix))
+}
+
+func (c *objectCounts) count(cached **int64, remote string) (int64, error) {
+	if *cached != nil {
+		return **cached, nil
+	}
+	n, err := countObjects(c.config, c.remotes, remote)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count the objects in %s: %w", remote, err)
+	}
+	*cached = &n
+	return n, nil
+}
+
+// countObjects returns the number of objects at remote that the filters
+// select, i.e. those the sync covers.
+func countObjects(config *Config, remotes *rcloneRemotes, remote string) (int64, error) {
+	args := []string{"size", remote, "--json"}
+	if config.FastList {
+		args = append(args, "--fast-list")
+	}
+	args = append(args, tpsArgs(config)...)
+	args = append(args, filterArgs(config)...)
+	var stderr bytes.Buffer
+	cmd := remotes.command(config, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", err, lastLine(strings.TrimSpace(stderr.String())))
+	}
+	var size struct {
+		Count *int64 `json:"count"`
+	}
+	if err := json.Unmarshal(output, &size); err != nil || size.Count == nil {
+		return 0, fmt.Errorf("unexpected output from rclone size: %q", lastLine(strings.TrimSpace(string(output))))
+	}
+	return *size.Count, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxDeleteArgs(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		// want is the --max-delete value, or empty if the flag is absent.
+		want  string
+		warns bool
+	}{
+		{name: "unset", want: "1000"},
+		{name: "zero", env: map[string]string{"MAX_DELETE": "0"}, want: "0", warns: true},
+		{name: "positive", env: map[string]string{"MAX_DELETE": "25"}, want: "25"},
+		{name: "negative", env: map[string]string{"MAX_DELETE": "-1"}},
+		{name: "deletions disabled", env: map[string]string{"DELETE_DISABLED": "true"}},
+		{name: "copy", env: map[string]string{"SYNC_MODE": "copy"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := syncArgs(config)
+			got, ok := argValue(args, "--max-delete")
+			switch {
+			case tt.want == "" && ok:
+				t.Errorf("args have --max-delete %s, want none: %v", got, args)
+			case tt.want != "" && got != tt.want:
+				t.Errorf("--max-delete = %q, want %q: %v", got, tt.want, args)
+			}
+			// The changed meaning of 0 is pointed out.
+			warns := slices.ContainsFunc(config.warnings, func(w string) bool { return strings.Contains(w, "MAX_DELETE=0 allows no deletions") })
+			if warns != tt.warns {
+				t.Errorf("warnings = %q, want the MAX_DELETE=0 one: %v", config.warnings, tt.warns)
+			}
+		})
+	}
+}
+
+// maxDeleteStderr is what rclone v1.66 logs when a sync reaches
+// --max-delete 2 with three objects to delete.
+const maxDeleteStderr = `2024/05/02 10:00:01 INFO  : old/a.txt: Deleted
+2024/05/02 10:00:01 INFO  : old/b.txt: Deleted
+2024/05/02 10:00:01 ERROR : old/c.txt: Couldn't delete: --max-delete threshold reached
+2024/05/02 10:00:01 ERROR : Attempt 1/1 failed with 1 errors and: failed to delete 1 files
+2024/05/02 10:00:01 Failed to sync with 1 errors: last error was: failed to delete 1 files
+`
+
+// exitError returns the error of a process that exited with code.
+func exitError(t *testing.T, code int) error {
+	t.Helper()
+	err := exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("sh exited with %v", err)
+	}
+	return err
+}
+
+func TestAsDeleteLimitError(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		err    error
+		stderr string
+		// skipped is the reported skipped deletions, or -1 for an error
+		// that must be left as it is.
+		skipped int
+		code    int
+	}{
+		{"limit reached", exitError(t, rcloneExitFatal), maxDeleteStderr, 1, 5},
+		{"limit reached without a count", exitError(t, rcloneExitFatal),
+			"2024/05/02 10:00:01 ERROR : old/c.txt: Couldn't delete: --max-delete threshold reached\n", 0, 5},
+		{"other fatal error", exitError(t, rcloneExitFatal),
+			"2024/05/02 10:00:01 ERROR : Fatal error received - not attempting retries\n", -1, exitSyncFailed},
+		{"marker with another exit code", exitError(t, 1), maxDeleteStderr, -1, exitSyncFailed},
+		{"not an exit", errors.New("rclone not found"), maxDeleteStderr, -1, exitSyncFailed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			stderr := newLineTail(100)
+			fmt.Fprint(stderr, tt.stderr)
+			config := &Config{MaxDelete: 2}
+			err := asDeleteLimitError(config, tt.err, stderr)
+			var limitErr *deleteLimitError
+			switch {
+			case tt.skipped < 0 && err != tt.err:
+				t.Fatalf("asDeleteLimitError = %v, want the error unchanged", err)
+			case tt.skipped >= 0 && !errors.As(err, &limitErr):
+				t.Fatalf("asDeleteLimitError = %v, want a deleteLimitError", err)
+			case limitErr != nil && (limitErr.skipped != tt.skipped || limitErr.limit != 2):
+				t.Errorf("skipped %d of limit %d, want %d of 2", limitErr.skipped, limitErr.limit, tt.skipped)
+			}
+			if code := exitCode(err); code != tt.code {
+				t.Errorf("exit code %d, want %d", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestDeleteLimitSummary(t *testing.T) {
+	stderr := newLineTail(100)
+	fmt.Fprint(stderr, maxDeleteStderr)
+	err := asDeleteLimitError(&Config{MaxDelete: 2}, exitError(t, rcloneExitFatal), stderr)
+	report := &runSummary{StartedAt: time.Now()}
+	report.finish(err, RunStats{Deletes: 2})
+	if report.Result != "partial" || report.ErrorClass != "delete_limit" || report.ExitCode != 5 || report.SkippedDeletes != 1 {
+		t.Errorf("summary %+v, want a partial run with 1 skipped deletion", report)
+	}
+}
+
+func TestDeleteLimit(t *testing.T) {
+	percent := func(n int) *int { return &n }
+	for _, tt := range []struct {
+		name      string
+		maxDelete int
+		percent   *int
+		want      int
+		ok        bool
+	}{
+		{"MAX_DELETE", 100, nil, 100, true},
+		{"no limit", -1, nil, -1, false},
+		{"no deletions", 0, percent(5), 0, true},
+		{"percentage lower", 100, percent(5), 5, true},
+		{"percentage higher", 100, percent(500), 100, true},
+		{"percentage without MAX_DELETE", -1, percent(500), 500, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, ok := deleteLimit(&Config{MaxDelete: tt.maxDelete, percentDeleteLimit: tt.percent})
+			if limit != tt.want || ok != tt.ok {
+				t.Errorf("deleteLimit = %d, %v; want %d, %v", limit, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidateDeletePercent(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"MAX_DELETE_PERCENT": "101"}, "MAX_DELETE_PERCENT must be between 0 and 100, got 101"},
+		{map[string]string{"MAX_DELETE_PERCENT": "5", "SYNC_MODE": "copy"}, "MAX_DELETE_PERCENT only applies to SYNC_MODE=sync"},
+		{map[string]string{"MAX_DELETE_PERCENT": "5", "DELETE_STRATEGY": "none"}, "MAX_DELETE_PERCENT only applies to SYNC_MODE=sync"},
+		{map[string]string{"MAX_DELETE_PERCENT_ON_ERROR": "ignore"}, `invalid MAX_DELETE_PERCENT_ON_ERROR "ignore": must be one of fail, max-delete`},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestMaxDeletePercent(t *testing.T) {
+	counted := `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = size ] && { echo '{"count":250,"bytes":1000}'; exit 0; }
+exit 0`
+	countFails := `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = size ] && { echo "directory not found" >&2; exit 3; }
+exit 0`
+	for _, tt := range []struct {
+		name   string
+		script string
+		env    map[string]string
+		code   int
+		limit  string
+	}{
+		// 5% of 250 objects, rounded down, is lower than MAX_DELETE.
+		{"percentage", counted, map[string]string{"MAX_DELETE_PERCENT": "5", "MAX_DELETE": "100"}, 0, "12"},
+		{"MAX_DELETE lower", counted, map[string]string{"MAX_DELETE_PERCENT": "50", "MAX_DELETE": "100"}, 0, "100"},
+		{"count fails", countFails, map[string]string{"MAX_DELETE_PERCENT": "5"}, exitPreflightFailed, ""},
+		{"fall back to MAX_DELETE", countFails, map[string]string{"MAX_DELETE_PERCENT": "5", "MAX_DELETE": "100", "MAX_DELETE_PERCENT_ON_ERROR": "max-delete"}, 0, "100"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, calls := fakeRclone(t, tt.script)
+			tt.env["RCLONE_PATH"] = path
+			setTestEnv(t, withEnv(tt.env))
+			var result runResult
+			out := captureOutput(t, func() { result, _ = run(nil) })
+			if result.code != tt.code {
+				t.Fatalf("run = %d, want %d:\n%s", result.code, tt.code, out)
+			}
+			var sync string
+			for _, run := range readCalls(t, calls) {
+				if strings.HasPrefix(run, "sync ") {
+					sync = run
+				}
+			}
+			if tt.limit == "" {
+				if sync != "" {
+					t.Errorf("synced without a delete limit: %q", sync)
+				}
+				return
+			}
+			if limit, _ := argValue(strings.Fields(sync), "--max-delete"); limit != tt.limit {
+				t.Errorf("--max-delete = %q, want %s", limit, tt.limit)
+			}
+		})
+	}
+}
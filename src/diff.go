@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// diffCategory is one kind of change a dry run found: the number of
+// objects, their total size and, up to DIFF_KEY_LIMIT, their keys.
+type diffCategory struct {
+	Count     int      `json:"count"`
+	Bytes     int64    `json:"bytes"`
+	Keys      []string `json:"keys"`
+	Truncated bool     `json:"truncated"`
+}
+
+// diffReport lists what a dry run would change in the destination. Keys are
+// relative to SOURCE_PREFIX and DEST_PREFIX.
+type diffReport struct {
+	Copy   diffCategory `json:"would_copy"`
+	Update diffCategory `json:"would_update"`
+	Delete diffCategory `json:"would_delete"`
+
+	limit int
+	// differs holds the keys rclone found to differ from the destination,
+	// which tells an update from a new object.
+	differs map[string]bool
+}
+
+func newDiffReport(limit int) *diffReport {
+	r := &diffReport{limit: limit, differs: make(map[string]bool)}
+	for _, c := range []*diffCategory{&r.Copy, &r.Update, &r.Delete} {
+		c.Keys = []string{}
+	}
+	return r
+}
+
+// record classifies one rclone log message. In a dry run rclone logs
+// "Skipped copy as --dry-run is set" for new and changed objects alike; the
+// DEBUG line it logs first when comparing, e.g. "Sizes differ (src 2 vs
+// dst 1)" or "md5 differ", marks the changed ones.
+func (r *diffReport) record(msg, object string, size *int64) {
+	if object == "" {
+		return
+	}
+	var category *diffCategory
+	switch {
+	case strings.Contains(msg, " differ"):
+		r.differs[object] = true
+		return
+	case strings.HasPrefix(msg, "Skipped copy"), strings.HasPrefix(msg, "Skipped move"):
+		category = &r.Copy
+		if r.differs[object] {
+			category = &r.Update
+			delete(r.differs, object)
+		}
+	case strings.HasPrefix(msg, "Skipped update modification time"):
+		category = &r.Update
+	case strings.HasPrefix(msg, "Skipped delete"):
+		category = &r.Delete
+	default:
+		return
+	}
+	category.Count++
+	if size != nil {
+		category.Bytes += *size
+	}
+	if len(category.Keys) < r.limit {
+		category.Keys = append(category.Keys, object)
+	} else {
+		category.Truncated = true
+	}
+}
+
+func (r *diffReport) empty() bool {
+	return r.Copy.Count == 0 && r.Update.Count == 0 && r.Delete.Count == 0
+}
+
+func (r *diffReport) fields() logrus.Fields {
+	return logrus.Fields{
+		"would_copy":         r.Copy.Count,
+		"would_copy_bytes":   r.Copy.Bytes,
+		"would_update":       r.Update.Count,
+		"would_update_bytes": r.Update.Bytes,
+		"would_delete":       r.Delete.Count,
+		"would_delete_bytes": r.Delete.Bytes,
+	}
+}
+
+// diffError reports that a dry run with FAIL_ON_DIFF found differences.
+type diffError struct {
+	report *diffReport
+}
+
+func (e *diffError) Error() string {
+	return fmt.Sprintf("destination differs from the source: %d to copy, %d to update, %d to delete",
+		e.report.Copy.Count, e.report.Update.Count, e.report.Delete.Count)
+}
+
+func validateDiff(config *Config) error {
+	if config.DiffKeyLimit < 0 {
+		return fmt.Errorf("DIFF_KEY_LIMIT must not be negative, got %d", config.DiffKeyLimit)
+	}
+	if !config.DryRun {
+		switch {
+		case config.DiffReportFile != "" && !config.Confirm:
+			return fmt.Errorf("DIFF_REPORT_FILE requires DRY_RUN=true or CONFIRM=true")
+		case config.FailOnDiff:
+			return fmt.Errorf("FAIL_ON_DIFF requires DRY_RUN=true")
+		}
+	}
+	return nil
+}
+
+func writeDiffReport(path string, report *diffReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write DIFF_REPORT_FILE: %w", err)
+	}
+	return nil
+}
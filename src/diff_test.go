@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiffReport(t *testing.T) {
+	report := newDiffReport(2)
+	for _, line := range []struct {
+		msg, object string
+		size        int64
+	}{
+		{"Skipped copy as --dry-run is set (size 5)", "new.txt", 5},
+		{"Sizes differ (src 7 vs dst 3)", "changed.txt", 0},
+		{"Skipped copy as --dry-run is set (size 7)", "changed.txt", 7},
+		{"md5 differ", "other.txt", 0},
+		{"Skipped copy as --dry-run is set (size 1)", "other.txt", 1},
+		{"Skipped update modification time as --dry-run is set", "touched.txt", 0},
+		{"Skipped delete as --dry-run is set (size 2)", "old.txt", 2},
+		{"Skipped copy as --dry-run is set (size 3)", "new2.txt", 3},
+		{"Skipped copy as --dry-run is set (size 4)", "new3.txt", 4},
+		{"There was nothing to transfer", "", 0},
+		{"Unchanged skipping", "same.txt", 0},
+	} {
+		size := line.size
+		report.record(line.msg, line.object, &size)
+	}
+
+	if c := report.Copy; c.Count != 3 || c.Bytes != 12 || !slices.Equal(c.Keys, []string{"new.txt", "new2.txt"}) || !c.Truncated {
+		t.Errorf("would_copy = %+v, want 3 objects, the first 2 listed", c)
+	}
+	if c := report.Update; c.Count != 3 || c.Bytes != 8 || !slices.Equal(c.Keys, []string{"changed.txt", "other.txt"}) || !c.Truncated {
+		t.Errorf("would_update = %+v, want the 3 changed objects", c)
+	}
+	if c := report.Delete; c.Count != 1 || c.Bytes != 2 || !slices.Equal(c.Keys, []string{"old.txt"}) || c.Truncated {
+		t.Errorf("would_delete = %+v, want old.txt", c)
+	}
+	if report.empty() {
+		t.Error("report with changes is empty")
+	}
+	if !newDiffReport(10).empty() {
+		t.Error("new report isn't empty")
+	}
+}
+
+func TestValidateDiff(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"DRY_RUN": "true", "DIFF_REPORT_FILE": "/tmp/diff.json", "FAIL_ON_DIFF": "true"}, ""},
+		{map[string]string{"CONFIRM": "true", "DIFF_REPORT_FILE": "/tmp/diff.json"}, ""},
+		{map[string]string{"DIFF_REPORT_FILE": "/tmp/diff.json"}, "DIFF_REPORT_FILE requires DRY_RUN=true or CONFIRM=true"},
+		{map[string]string{"FAIL_ON_DIFF": "true"}, "FAIL_ON_DIFF requires DRY_RUN=true"},
+		{map[string]string{"DRY_RUN": "true", "DIFF_KEY_LIMIT": "-1"}, "DIFF_KEY_LIMIT must not be negative, got -1"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+// diffRclone logs a dry run that would copy new.txt, update changed.txt and
+// delete old.txt.
+const diffRclone = `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+echo '{"level":"notice","msg":"Skipped copy as --dry-run is set (size 5)","object":"new.txt","size":5}' >&2
+echo '{"level":"debug","msg":"Sizes differ (src 7 vs dst 3)","object":"changed.txt"}' >&2
+echo '{"level":"notice","msg":"Skipped copy as --dry-run is set (size 7)","object":"changed.txt","size":7}' >&2
+echo '{"level":"notice","msg":"Skipped delete as --dry-run is set (size 2)","object":"old.txt","size":2}' >&2
+exit 0`
+
+func TestDiffReportFile(t *testing.T) {
+	path, calls := fakeRclone(t, diffRclone)
+	file := filepath.Join(t.TempDir(), "diff.json")
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "DRY_RUN": "true", "DIFF_REPORT_FILE": file}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0 without FAIL_ON_DIFF:\n%s", result.code, out)
+	}
+	runs := readCalls(t, calls)
+	if sync := runs[len(runs)-1]; !slices.Contains(strings.Fields(sync), "-vv") {
+		t.Errorf("dry run %q, want -vv for the comparisons", sync)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report diffReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.Copy.Keys, []string{"new.txt"}) || !slices.Equal(report.Update.Keys, []string{"changed.txt"}) || !slices.Equal(report.Delete.Keys, []string{"old.txt"}) {
+		t.Errorf("DIFF_REPORT_FILE = %s", data)
+	}
+	entry := findEntry(logEntries(t, out), "S3 sync job completed successfully")
+	if entry == nil || entry["would_copy"] != 1.0 || entry["would_update_bytes"] != 7.0 || entry["diff_report_file"] != file {
+		t.Errorf("completion logged as %v, want the diff counts", entry)
+	}
+}
+
+func TestFailOnDiff(t *testing.T) {
+	path, _ := fakeRclone(t, diffRclone)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "DRY_RUN": "true", "FAIL_ON_DIFF": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != exitVerifyFailed {
+		t.Errorf("run = %d, want %d for a dry run with differences:\n%s", result.code, exitVerifyFailed, out)
+	}
+	if findEntry(logEntries(t, out), "Dry run found differences and FAIL_ON_DIFF is set") == nil {
+		t.Errorf("differences aren't logged:\n%s", out)
+	}
+
+	// No differences, no failure.
+	path, _ = fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+	t.Setenv("RCLONE_PATH", path)
+	out = captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Errorf("run = %d, want 0 for a dry run without differences:\n%s", result.code, out)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// validateBucketPatterns checks SOURCE_BUCKET_PATTERN and EXCLUDE_BUCKETS,
+// which use shell-style wildcards such as tenant-*.
+func validateBucketPatterns(config *Config) error {
+	if config.SourceBucketPattern == "" {
+		if len(config.ExcludeBuckets) > 0 {
+			return fmt.Errorf("EXCLUDE_BUCKETS requires SOURCE_BUCKET_PATTERN")
+		}
+		return nil
+	}
+	for _, p := range append([]string{config.SourceBucketPattern}, config.ExcludeBuckets...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid bucket pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// discoverJobs lists the buckets on the source endpoint and returns a job
+// for each one matching SOURCE_BUCKET_PATTERN and none of EXCLUDE_BUCKETS,
+// with the settings of template. The resolved buckets and the job plan are
+// logged. A source that can't be listed is a preflight failure, a job plan
+// that isn't valid a configuration error.
+func discoverJobs(template *Config, logger *logrus.Logger) ([]*Config, error) {
+	remotes, cleanup, err := setupRemotes(template)
+	if err != nil {
+		return nil, &classError{class: "setup", err: fmt.Errorf("failed to create rclone config: %w", err)}
+	}
+	defer cleanup()
+
+	buckets, err := listBuckets(template, remotes)
+	if err != nil {
+		return nil, &classError{class: "preflight", err: err}
+	}
+
+	var matched, excluded []string
+	for _, bucket := range buckets {
+		if ok, _ := path.Match(template.SourceBucketPattern, bucket); !ok {
+			continue
+		}
+		if matchesAny(template.ExcludeBuckets, bucket) {
+			excluded = append(excluded, bucket)
+			continue
+		}
+		matched = append(matched, bucket)
+	}
+	logger.WithFields(logrus.Fields{
+		"pattern":  template.SourceBucketPattern,
+		"buckets":  matched,
+		"excluded": excluded,
+	}).Info("Discovered source buckets")
+	if len(matched) == 0 {
+		return nil, &classError{class: "config", err: fmt.Errorf("no source bucket matches SOURCE_BUCKET_PATTERN %q", template.SourceBucketPattern)}
+	}
+
+	configs := make([]*Config, 0, len(matched))
+	for _, bucket := range matched {
+		config := *template
+		config.JobName = bucket
+		config.Source.Bucket = bucket
+		if !config.destPrefixSet {
+			config.Dest.Prefix = cleanPrefix(defaultDestPrefix(config.Source))
+		}
+		if err := validateConfig(&config); err != nil {
+			return nil, &classError{class: "config", err: fmt.Errorf("bucket %s: %w", bucket, err)}
+		}
+		splitBandwidthLimit(&config, len(matched))
+		configs = append(configs, &config)
+	}
+	if err := validateJobDestinations(configs); err != nil {
+		return nil, &classError{class: "config", err: err}
+	}
+
+	for _, config := range configs {
+		logger.WithFields(logrus.Fields{
+			"job":    config.JobName,
+			"source": remotePath("source", config.Source.Bucket, config.Source.Prefix),
+			"dest":   remotePath("dest", config.Dest.Bucket, config.Dest.Prefix),
+			"mode":   config.SyncMode,
+		}).Info("Planned sync job")
+	}
+	return configs, nil
+}
+
+// listBuckets returns the names of the buckets on the source endpoint.
+func listBuckets(config *Config, remotes *rcloneRemotes) ([]string, error) {
+	buckets, err := listDirs(config, remotes, "source:")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list source buckets: %w", err)
+	}
+	return buckets, nil
+}
+
+// listDirs returns the names of the directories directly below remote; at
+// the root of an S3 remote these are the buckets.
+func listDirs(config *Config, remotes *rcloneRemotes, remote string) ([]string, error) {
+	cmd := remotes.command(config, "lsjson", remote, "--dirs-only")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, lastLine(strings.TrimSpace(stderr.String())))
+	}
+
+	var entries []struct {
+		Path  string
+		IsDir bool
+	}
+	if err := json.Unmarshal(output, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse the listing of %s: %w", remote, err)
+	}
+	dirs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir {
+			dirs = append(dirs, entry.Path)
+		}
+	}
+	return dirs, nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
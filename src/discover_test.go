@@ -0,0 +1,106 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// bucketsRclone lists the buckets tenant-a, tenant-b, tenant-test and logs
+// on the source and succeeds at everything else.
+const bucketsRclone = `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+if [ "$1" = lsjson ] && [ "$2" = source: ]; then
+	echo '[{"Path":"tenant-a","IsDir":true},{"Path":"tenant-b","IsDir":true},{"Path":"tenant-test","IsDir":true},{"Path":"logs","IsDir":true}]'
+	exit 0
+fi
+exit 0`
+
+func TestValidateBucketPatterns(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"EXCLUDE_BUCKETS": "tenant-test"}, "EXCLUDE_BUCKETS requires SOURCE_BUCKET_PATTERN"},
+		{map[string]string{"SOURCE_BUCKET": "", "SOURCE_BUCKET_PATTERN": "tenant-["}, `invalid bucket pattern "tenant-["`},
+		{map[string]string{"SOURCE_BUCKET_PATTERN": "tenant-*"}, "SOURCE_BUCKET_PATTERN can't be combined with SOURCE_BUCKET"},
+	} {
+		setTestEnv(t, withEnv(tt.env))
+		_, err := loadConfigs(nil)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestDiscoverJobs(t *testing.T) {
+	path, calls := fakeRclone(t, bucketsRclone)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SOURCE_BUCKET": "", "SOURCE_BUCKET_PATTERN": "tenant-*", "EXCLUDE_BUCKETS": "*-test"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+	var synced []string
+	for _, run := range readCalls(t, calls) {
+		if strings.HasPrefix(run, "sync ") {
+			synced = append(synced, strings.Fields(run)[2])
+		}
+	}
+	slices.Sort(synced)
+	if want := []string{"dest:dest-bucket/tenant-a", "dest:dest-bucket/tenant-b"}; !slices.Equal(synced, want) {
+		t.Errorf("synced into %q, want %q", synced, want)
+	}
+	e := findEntry(logEntries(t, out), "Discovered source buckets")
+	if e == nil || len(e["buckets"].([]any)) != 2 || len(e["excluded"].([]any)) != 1 {
+		t.Errorf("discovery logged as %v", e)
+	}
+}
+
+func TestDiscoverJobsDryRun(t *testing.T) {
+	path, calls := fakeRclone(t, bucketsRclone)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SOURCE_BUCKET": "", "SOURCE_BUCKET_PATTERN": "tenant-*", "DRY_RUN": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+	for _, run := range readCalls(t, calls) {
+		if strings.HasPrefix(run, "sync ") {
+			t.Errorf("synced during a dry run: %q", run)
+		}
+	}
+	planned := 0
+	for _, e := range logEntries(t, out) {
+		if e["msg"] == "Planned sync job" {
+			planned++
+		}
+	}
+	if planned != 3 {
+		t.Errorf("planned %d jobs, want 3:\n%s", planned, out)
+	}
+}
+
+func TestDiscoverJobsFails(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		script  string
+		pattern string
+		code    int
+	}{
+		{"no match", bucketsRclone, "media-*", exitConfigError},
+		{"listing fails", `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+echo "AccessDenied: Access Denied" >&2
+exit 1`, "tenant-*", exitPreflightFailed},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, _ := fakeRclone(t, tt.script)
+			setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SOURCE_BUCKET": "", "SOURCE_BUCKET_PATTERN": tt.pattern}))
+			var result runResult
+			out := captureOutput(t, func() { result, _ = run(nil) })
+			if result.code != tt.code {
+				t.Errorf("run = %d, want %d:\n%s", result.code, tt.code, out)
+			}
+			if findEntry(logEntries(t, out), "Bucket discovery failed") == nil {
+				t.Errorf("failure not logged:\n%s", out)
+			}
+		})
+	}
+}
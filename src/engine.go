@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syncEngines are the values ENGINE accepts.
+var syncEngines = []string{"rclone", "native"}
+
+// syncEngine runs one attempt of the sync of a job. Everything around it,
+// from the preflight checks and the delete limit to retries, reports and
+// notifications, is shared by the engines.
+type syncEngine interface {
+	sync(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) (RunStats, error)
+}
+
+// rcloneEngine runs rclone sync, copy or move.
+type rcloneEngine struct{}
+
+func (rcloneEngine) sync(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) (RunStats, error) {
+	if assumesRole(config) {
+		return runRoleSessions(config, remotes, logger)
+	}
+	return runSync(config, remotes, logger)
+}
+
+func newSyncEngine(config *Config) syncEngine {
+	if config.Engine == "native" {
+		return nativeEngine{}
+	}
+	return rcloneEngine{}
+}
+
+// validateEngine rejects the options the native engine doesn't implement, so
+// that switching engines never silently drops a safeguard or a filter.
+func validateEngine(config *Config) error {
+	if !contains(syncEngines, config.Engine) {
+		return fmt.Errorf("invalid ENGINE %q: must be one of %s", config.Engine, strings.Join(syncEngines, ", "))
+	}
+	if config.Engine != "native" {
+		return nil
+	}
+	unsupported := []struct {
+		key string
+		set bool
+	}{
+		{"SYNC_MODE=move", config.SyncMode == "move"},
+		{"IMMUTABLE", config.Immutable},
+		{"INCLUDE_PATTERNS", len(config.IncludePatterns) > 0},
+		{"EXCLUDE_PATTERNS", len(config.ExcludePatterns) > 0},
+		{"FILTER_FILE", len(config.FilterRules) > 0},
+		{"FILES_FROM", config.FilesFrom != ""},
+		{"MIN_AGE", config.MinAge != ""},
+		{"MAX_AGE", config.MaxAge != ""},
+		{"MIN_SIZE", config.MinSize != ""},
+		{"MAX_SIZE", config.MaxSize != ""},
+		{"BACKUP_DIR", config.BackupDir != ""},
+		{"BACKUP_SUFFIX", config.BackupSuffix != ""},
+		{"TRACK_RENAMES", config.TrackRenames},
+		{"IGNORE_CASE", config.IgnoreCase},
+		{"UNICODE_NORMALIZATION", config.UnicodeNormalization != ""},
+		{"TRANSFER_ORDER", config.TransferOrder != ""},
+		{"MAX_DELETE_PERCENT", config.MaxDeletePercent != 0},
+		{"MIN_SOURCE_OBJECTS", config.MinSourceObjects != 0},
+		{"MAX_SHRINK_PERCENT", config.MaxShrinkPercent != 0},
+		{"MAX_TRANSFER", config.MaxTransfer != ""},
+		{"MAX_DURATION", config.MaxDuration != ""},
+		{"TPS_LIMIT", config.TPSLimit != 0},
+		{"VERIFY_AFTER_SYNC", config.VerifyAfterSync},
+		{"VERIFY_ONLY", config.VerifyOnly},
+		{"VALIDATE_ONLY", config.ValidateOnly},
+		{"REPORT_PREFIX", config.ReportPrefix != ""},
+		{"LOCK", config.Lock},
+		{"HEARTBEAT_KEY", config.HeartbeatKey != ""},
+		{"INCREMENTAL", config.Incremental},
+		{"CONFIRM", config.Confirm},
+		{"CLEANUP_MULTIPART", config.CleanupMultipart != ""},
+		{"SHARD_BY_PREFIX", config.ShardByPrefix},
+		{"SOURCE_BUCKET_PATTERN", config.SourceBucketPattern != ""},
+		{"SQS_QUEUE_URL", config.SQSQueueURL != ""},
+		{"RCLONE_RC_ADDR", config.RcloneRCAddr != ""},
+		{"RCLONE_EXTRA_ARGS", len(config.RcloneExtraArgs) > 0},
+		// A timetable changes the rate during the run, which rclone does.
+		{"a BANDWIDTH_LIMIT timetable", strings.Contains(config.BandwidthLimit, ",")},
+	}
+	for _, option := range unsupported {
+		if option.set {
+			return fmt.Errorf("%s is not supported with ENGINE=native; use ENGINE=rclone", option.key)
+		}
+	}
+	return validateS3API(config, "ENGINE=native")
+}
+
+// validateS3API rejects the remotes that s3Client, rather than rclone, can't
+// talk to, for a feature that uses it.
+func validateS3API(config *Config, feature string) error {
+	for _, remote := range []struct {
+		side   string
+		config RemoteConfig
+	}{{"SOURCE", config.Source}, {"DEST", config.Dest}} {
+		if remote.config.V2Auth {
+			return fmt.Errorf("%s is not supported with %s_V2_AUTH", feature, remote.side)
+		}
+		// Only rclone knows the endpoints of the other providers' regions.
+		if remote.config.Endpoint == "" && !strings.EqualFold(remote.config.Provider, "AWS") {
+			return fmt.Errorf("%s requires %s_S3_ENDPOINT unless %s_PROVIDER is AWS", feature, remote.side, remote.side)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an S3 API for the tests of what s3Client calls, with its buckets
+// in memory and requests addressed path-style. It answers the operations the
+// native engine, PRESERVE_TAGS, ARCHIVED_OBJECTS and LOCK use.
+type fakeS3 struct {
+	*httptest.Server
+	t *testing.T
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*fakeObject
+	uploads map[string]*fakeUpload
+	// requests lists the operations received, e.g. "PutObject
+	// dest-bucket/a.txt".
+	requests []fakeRequest
+	// fail, if set, answers a request with an error status and code instead
+	// of the fake, unless it returns 0.
+	fail func(op, bucket, key string) (int, string)
+	// pageSize is the most keys a ListObjectsV2 page holds.
+	pageSize int
+}
+
+// fakeObject is an object of a fakeS3 bucket.
+type fakeObject struct {
+	data     []byte
+	etag     string
+	header   http.Header
+	tags     []s3Tag
+	modified time.Time
+	// archived objects can't be read until they are restored.
+	archived bool
+	restored bool
+}
+
+type fakeUpload struct {
+	bucket, key string
+	header      http.Header
+	parts       map[int][]byte
+}
+
+// s3Tagging is the body of GetObjectTagging and PutObjectTagging.
+type s3Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  []s3Tag  `xml:"TagSet>Tag"`
+}
+
+// fakeRequest is a request a fakeS3 received.
+type fakeRequest struct {
+	op, bucket, key string
+	header          http.Header
+	// chunked is set if the body was sent with Transfer-Encoding: chunked.
+	chunked bool
+}
+
+func (r fakeRequest) String() string {
+	return r.op + " " + r.bucket + "/" + r.key
+}
+
+// fakeStoredHeaders are the request headers a fakeS3 keeps with an object
+// and returns for it, besides X-Amz-Meta-*.
+var fakeStoredHeaders = []string{"Content-Type", "Cache-Control", "Content-Disposition", "Content-Encoding", "Content-Language", "Expires", "X-Amz-Storage-Class", "X-Amz-Acl"}
+
+// newFakeS3 starts a fakeS3 with the given buckets, empty.
+func newFakeS3(t *testing.T, buckets ...string) *fakeS3 {
+	f := &fakeS3{t: t, buckets: make(map[string]map[string]*fakeObject), uploads: make(map[string]*fakeUpload), pageSize: 1000}
+	for _, bucket := range buckets {
+		f.buckets[bucket] = make(map[string]*fakeObject)
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// put stores an object as PutObject would, with header as its stored
+// headers.
+func (f *fakeS3) put(bucket, key, data string, header http.Header) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sum := md5.Sum([]byte(data))
+	o := &fakeObject{data: []byte(data), etag: hex.EncodeToString(sum[:]), header: storedHeaders(header), modified: time.Now().UTC()}
+	f.buckets[bucket][key] = o
+	return o
+}
+
+// object returns an object, or nil.
+func (f *fakeS3) object(bucket, key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.buckets[bucket][key]
+}
+
+// keys returns the keys of a bucket in order.
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ops returns the operations received, as in fakeRequest.String, that are
+// one of ops, or all of them.
+func (f *fakeS3) ops(ops ...string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var received []string
+	for _, r := range f.requests {
+		if len(ops) == 0 || contains(ops, r.op) {
+			received = append(received, r.String())
+		}
+	}
+	return received
+}
+
+// received returns the requests received of operation op.
+func (f *fakeS3) received(op string) []fakeRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var received []fakeRequest
+	for _, r := range f.requests {
+		if r.op == op {
+			received = append(received, r)
+		}
+	}
+	return received
+}
+
+func storedHeaders(header http.Header) http.Header {
+	stored := http.Header{}
+	for name, values := range header {
+		name = http.CanonicalHeaderKey(name)
+		if contains(fakeStoredHeaders, name) || strings.HasPrefix(name, "X-Amz-Meta-") {
+			stored[name] = values
+		}
+	}
+	return stored
+}
+
+// fakeOperation names the S3 operation of a request.
+func fakeOperation(r *http.Request, key string) string {
+	q := r.URL.Query()
+	has := func(name string) bool { _, ok := q[name]; return ok }
+	switch r.Method {
+	case http.MethodGet:
+		switch {
+		case key == "":
+			return "ListObjectsV2"
+		case has("tagging"):
+			return "GetObjectTagging"
+		}
+		return "GetObject"
+	case http.MethodHead:
+		return "HeadObject"
+	case http.MethodPut:
+		switch {
+		case has("tagging"):
+			return "PutObjectTagging"
+		case has("uploadId"):
+			return "UploadPart"
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			return "CopyObject"
+		}
+		return "PutObject"
+	case http.MethodPost:
+		switch {
+		case has("uploads"):
+			return "CreateMultipartUpload"
+		case has("uploadId"):
+			return "CompleteMultipartUpload"
+		case has("delete"):
+			return "DeleteObjects"
+		case has("restore"):
+			return "RestoreObject"
+		}
+	case http.MethodDelete:
+		if has("uploadId") {
+			return "AbortMultipartUpload"
+		}
+		return "DeleteObject"
+	}
+	return r.Method
+}
+
+func (f *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	op := fakeOperation(r, key)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Errorf("%s %s/%s: reading the body: %v", op, bucket, key, err)
+	}
+	// Every request is signed with the keys of the remote.
+	if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=") {
+		f.t.Errorf("%s %s/%s is not signed: Authorization %q", op, bucket, key, auth)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, fakeRequest{op: op, bucket: bucket, key: key, header: r.Header.Clone(), chunked: slices.Contains(r.TransferEncoding, "chunked")})
+	if f.fail != nil {
+		if status, code := f.fail(op, bucket, key); status != 0 {
+			s3Fail(w, status, code)
+			return
+		}
+	}
+	objects, ok := f.buckets[bucket]
+	if !ok {
+		s3Fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	q := r.URL.Query()
+	o := objects[key]
+	switch op {
+	case "ListObjectsV2":
+		f.list(w, objects, q)
+	case "HeadObject", "GetObject":
+		if o == nil {
+			s3Fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		if op == "GetObject" && o.archived && !o.restored {
+			s3Fail(w, http.StatusForbidden, "InvalidObjectState")
+			return
+		}
+		for name, values := range o.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", `"`+o.etag+`"`)
+		w.Header().Set("Last-Modified", o.modified.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+		if len(o.tags) > 0 {
+			w.Header().Set(tagCountHeader, strconv.Itoa(len(o.tags)))
+		}
+		if op == "GetObject" {
+			w.Write(o.data)
+		}
+	case "GetObjectTagging":
+		if o == nil {
+			s3Fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		s3Write(w, s3Tagging{TagSet: o.tags})
+	case "PutObjectTagging":
+		if o == nil {
+			s3Fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		var tagging s3Tagging
+		if err := xml.Unmarshal(body, &tagging); err != nil {
+			s3Fail(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		o.tags = tagging.TagSet
+	case "PutObject":
+		// Conditional writes, as LOCK uses them.
+		if match := r.Header.Get("If-None-Match"); match == "*" && o != nil {
+			s3Fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if match := r.Header.Get("If-Match"); match != "" && (o == nil || strings.Trim(match, `"`) != o.etag) {
+			s3Fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		sum := md5.Sum(body)
+		o = &fakeObject{data: body, etag: hex.EncodeToString(sum[:]), header: storedHeaders(r.Header), modified: time.Now().UTC()}
+		objects[key] = o
+		w.Header().Set("ETag", `"`+o.etag+`"`)
+	case "CopyObject":
+		f.copy(w, r, objects, key)
+	case "CreateMultipartUpload":
+		id := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+		f.uploads[id] = &fakeUpload{bucket: bucket, key: key, header: storedHeaders(r.Header), parts: make(map[int][]byte)}
+		s3Write(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+	case "UploadPart":
+		upload, ok := f.uploads[q.Get("uploadId")]
+		number, _ := strconv.Atoi(q.Get("partNumber"))
+		if !ok || number < 1 {
+			s3Fail(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		upload.parts[number] = body
+		sum := md5.Sum(body)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case "CompleteMultipartUpload":
+		f.complete(w, objects, q.Get("uploadId"), body)
+	case "AbortMultipartUpload":
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case "DeleteObject":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case "DeleteObjects":
+		var request struct {
+			Objects []struct {
+				Key string `xml:"Key"`
+			} `xml:"Object"`
+		}
+		if err := xml.Unmarshal(body, &request); err != nil {
+			s3Fail(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		for _, object := range request.Objects {
+			delete(objects, object.Key)
+		}
+		s3Write(w, struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+		}{})
+	case "RestoreObject":
+		if o == nil {
+			s3Fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		o.restored = true
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		s3Fail(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, objects map[string]*fakeObject, q url.Values) {
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, q.Get("prefix")) && key > q.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	type content struct {
+		Key          string `xml:"Key"`
+		Size         int    `xml:"Size"`
+		ETag         string `xml:"ETag"`
+		LastModified string `xml:"LastModified"`
+	}
+	var page struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}
+	if len(keys) > f.pageSize {
+		keys, page.IsTruncated, page.NextContinuationToken = keys[:f.pageSize], true, keys[f.pageSize-1]
+	}
+	for _, key := range keys {
+		o := objects[key]
+		page.Contents = append(page.Contents, content{Key: key, Size: len(o.data), ETag: `"` + o.etag + `"`, LastModified: o.modified.Format(time.RFC3339)})
+	}
+	s3Write(w, page)
+}
+
+func (f *fakeS3) copy(w http.ResponseWriter, r *http.Request, objects map[string]*fakeObject, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	src := f.buckets[srcBucket][srcKey]
+	if err != nil || src == nil {
+		s3Fail(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if src.archived && !src.restored {
+		s3Fail(w, http.StatusForbidden, "InvalidObjectState")
+		return
+	}
+	o := &fakeObject{data: src.data, etag: src.etag, header: src.header, modified: time.Now().UTC()}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		o.header = storedHeaders(r.Header)
+	}
+	if r.Header.Get("X-Amz-Tagging-Directive") != "REPLACE" {
+		o.tags = src.tags
+	}
+	objects[key] = o
+	s3Write(w, struct {
+		XMLName xml.Name `xml:"CopyObjectResult"`
+		ETag    string   `xml:"ETag"`
+	}{ETag: `"` + o.etag + `"`})
+}
+
+// complete assembles a multipart upload, with the ETag S3 gives it: the MD5
+// of the MD5s of its parts, and their number.
+func (f *fakeS3) complete(w http.ResponseWriter, objects map[string]*fakeObject, id string, body []byte) {
+	upload, ok := f.uploads[id]
+	if !ok {
+		s3Fail(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	var request struct {
+		Parts []struct {
+			Number int    `xml:"PartNumber"`
+			ETag   string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil || len(request.Parts) == 0 {
+		s3Fail(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	var data, sums []byte
+	for i, part := range request.Parts {
+		content, ok := upload.parts[part.Number]
+		sum := md5.Sum(content)
+		if !ok || part.Number != i+1 || strings.Trim(part.ETag, `"`) != hex.EncodeToString(sum[:]) {
+			s3Fail(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		data, sums = append(data, content...), append(sums, sum[:]...)
+	}
+	sum := md5.Sum(sums)
+	etag := fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(request.Parts))
+	objects[upload.key] = &fakeObject{data: data, etag: etag, header: upload.header, modified: time.Now().UTC()}
+	delete(f.uploads, id)
+	s3Write(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		ETag    string   `xml:"ETag"`
+	}{ETag: `"` + etag + `"`})
+}
+
+func s3Write(w http.ResponseWriter, v any) {
+	data, _ := xml.Marshal(v)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(append([]byte(xml.Header), data...))
+}
+
+func s3Fail(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>fake %s</Message></Error>", xml.Header, code, code)
+}
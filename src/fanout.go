@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// destinationVariable matches per-destination settings such as
+// DEST_2_S3_ENDPOINT.
+var destinationVariable = regexp.MustCompile(`^DEST_([0-9]+)_([A-Z0-9_]+)$`)
+
+// loadDestinations returns a job per destination defined by DESTINATIONS or
+// DEST_<n>_* variables, each syncing the same source. It returns nil when
+// there is only the one destination of the DEST_* settings.
+func loadDestinations(src *configSource) ([]map[string]string, error) {
+	raw := src.getOrDefault("DESTINATIONS", "")
+	indexed, err := indexedDestinations(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case raw != "" && len(indexed) > 0:
+		return nil, fmt.Errorf("DESTINATIONS and indexed variables such as DEST_1_BUCKET are both set; use only one")
+	case raw != "":
+		return parseDestinations(raw)
+	}
+	return indexed, nil
+}
+
+// destinationKey maps a per-destination setting name to the variable it
+// overrides: S3_ENDPOINT to DEST_S3_ENDPOINT, BANDWIDTH_LIMIT to itself and
+// NAME to JOB_NAME. Source settings can't differ between destinations.
+func destinationKey(name string, known map[string]string) (string, bool) {
+	name = strings.ToUpper(name)
+	if name == "NAME" {
+		return "JOB_NAME", true
+	}
+	if env, ok := known["DEST_"+name]; ok {
+		return env, true
+	}
+	if strings.HasPrefix(name, "SOURCE_") {
+		return "", false
+	}
+	env, ok := known[name]
+	return env, ok
+}
+
+// parseDestinations parses the DESTINATIONS JSON array. Each entry holds
+// settings named as in DEST_<n>_*, e.g. {"s3_endpoint": ..., "bucket": ...}.
+func parseDestinations(raw string) ([]map[string]string, error) {
+	var entries []map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("invalid DESTINATIONS: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("DESTINATIONS contains no destinations")
+	}
+
+	known := jobKeys()
+	jobs := make([]map[string]string, 0, len(entries))
+	for i, entry := range entries {
+		job := map[string]string{"JOB_NAME": "dest-" + strconv.Itoa(i+1)}
+		for key, value := range entry {
+			env, ok := destinationKey(key, known)
+			if !ok {
+				return nil, fmt.Errorf("DESTINATIONS entry %d: unknown setting %s", i+1, key)
+			}
+			str, err := scalarString(value)
+			if err != nil {
+				return nil, fmt.Errorf("DESTINATIONS entry %d: %s: %w", i+1, key, err)
+			}
+			job[env] = str
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// indexedDestinations collects destinations from variables such as
+// DEST_1_S3_ENDPOINT and DEST_1_BUCKET, numbered from 1 without gaps.
+func indexedDestinations(environ []string) ([]map[string]string, error) {
+	known := jobKeys()
+	byIndex := make(map[int]map[string]string)
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		m := destinationVariable.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		env, ok := destinationKey(m[2], known)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s is not a destination setting", name, m[2])
+		}
+		index, err := strconv.Atoi(m[1])
+		if err != nil || index < 1 {
+			return nil, fmt.Errorf("%s: destinations are numbered from 1", name)
+		}
+		if byIndex[index] == nil {
+			byIndex[index] = map[string]string{"JOB_NAME": "dest-" + m[1]}
+		}
+		byIndex[index][env] = value
+	}
+
+	indices := make([]int, 0, len(byIndex))
+	for index := range byIndex {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+
+	jobs := make([]map[string]string, 0, len(indices))
+	for i, index := range indices {
+		if index != i+1 {
+			return nil, fmt.Errorf("destination %d is defined but destination %d is not; number destinations from 1 without gaps", index, i+1)
+		}
+		jobs = append(jobs, byIndex[index])
+	}
+	return jobs, nil
+}
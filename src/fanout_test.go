@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIndexedDestinations(t *testing.T) {
+	configs, err := loadTestConfigs(t, map[string]string{
+		"DEST_1_NAME":            "minio",
+		"DEST_1_BUCKET":          "media",
+		"DEST_2_S3_ENDPOINT":     "https://s3.eu-central-1.amazonaws.com",
+		"DEST_2_BUCKET":          "media-dr",
+		"DEST_2_PREFIX":          "replica",
+		"DEST_2_BANDWIDTH_LIMIT": "20M",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 {
+		t.Fatalf("loaded %d jobs, want one per destination", len(configs))
+	}
+	minio, dr := configs[0], configs[1]
+	if minio.JobName != "minio" || minio.Dest.Bucket != "media" || minio.Dest.Endpoint != "http://dest.test:9000" {
+		t.Errorf("first destination = %s into %s at %s", minio.JobName, minio.Dest.Bucket, minio.Dest.Endpoint)
+	}
+	if dr.JobName != "dest-2" || dr.Dest.Bucket != "media-dr" || dr.Dest.Prefix != "replica" || dr.BandwidthLimit != "20M" || dr.Dest.Endpoint != "https://s3.eu-central-1.amazonaws.com" {
+		t.Errorf("second destination = %+v", dr.Dest)
+	}
+	// Both sync the same source.
+	if minio.Source != dr.Source {
+		t.Errorf("destinations sync %+v and %+v, want the same source", minio.Source, dr.Source)
+	}
+
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"DEST_1_BUCKET": "a", "DEST_3_BUCKET": "b"}, "destination 3 is defined but destination 2 is not"},
+		{map[string]string{"DEST_1_SOURCE_BUCKET": "a"}, "DEST_1_SOURCE_BUCKET: SOURCE_BUCKET is not a destination setting"},
+		{map[string]string{"DEST_0_BUCKET": "a"}, "DEST_0_BUCKET: destinations are numbered from 1"},
+		{map[string]string{"DEST_1_BUCKET": "a", "DESTINATIONS": `[{"bucket": "b"}]`}, "DESTINATIONS and indexed variables such as DEST_1_BUCKET are both set"},
+		{map[string]string{"DEST_1_BUCKET": "a", "SOURCE_BUCKET_1": "media"}, "several destinations can't be combined with SYNC_JOBS or indexed jobs"},
+	} {
+		_, err := loadTestConfigs(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestParseDestinations(t *testing.T) {
+	configs, err := loadTestConfigs(t, map[string]string{
+		"DESTINATIONS": `[{"name": "minio", "bucket": "media"}, {"bucket": "media-dr", "TRANSFERS": 2}]`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 2 || configs[0].JobName != "minio" || configs[1].JobName != "dest-2" || configs[1].Transfers != 2 || configs[1].Dest.Bucket != "media-dr" {
+		t.Fatalf("jobs = %+v", configs)
+	}
+
+	for _, tt := range []struct {
+		raw  string
+		want string
+	}{
+		{`[]`, "DESTINATIONS contains no destinations"},
+		{`{"bucket": "a"}`, "invalid DESTINATIONS"},
+		{`[{"bucket": "a", "source_prefix": "x"}]`, "DESTINATIONS entry 1: unknown setting source_prefix"},
+		{`[{"bucket": ["a"]}]`, "DESTINATIONS entry 1: bucket"},
+	} {
+		_, err := loadTestConfigs(t, map[string]string{"DESTINATIONS": tt.raw})
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestFanOutContinueOnError(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		keepGoing string
+		code      int
+		syncs     int
+	}{
+		{"stop", "false", exitSyncFailed, 1},
+		{"continue", "true", exitSyncFailed, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = sync ] && [ "$3" = dest:media-a/source-bucket ] && exit 1
+exit 0`)
+			setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "DEST_1_BUCKET": "media-a", "DEST_2_BUCKET": "media-b", "CONTINUE_ON_ERROR": tt.keepGoing}))
+			var result runResult
+			out := captureOutput(t, func() { result, _ = run(nil) })
+			if result.code != tt.code {
+				t.Errorf("run = %d, want %d:\n%s", result.code, tt.code, out)
+			}
+			syncs := 0
+			for _, run := range readCalls(t, calls) {
+				if strings.HasPrefix(run, "sync ") {
+					syncs++
+				}
+			}
+			if syncs != tt.syncs {
+				t.Errorf("ran %d syncs, want %d", syncs, tt.syncs)
+			}
+		})
+	}
+}
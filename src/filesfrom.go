@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// readFilesFrom loads the key list named by FILES_FROM: a local file, or an
+// s3://bucket/key URL read through the source remote. Blank lines and lines
+// starting with # are dropped; everything else is kept verbatim, as keys may
+// contain leading or trailing spaces.
+func readFilesFrom(config *Config, remotes *rcloneRemotes) ([]string, error) {
+	var data []byte
+	if rest, ok := strings.CutPrefix(config.FilesFrom, "s3://"); ok {
+		bucket, key, _ := strings.Cut(rest, "/")
+		if bucket == "" || key == "" {
+			return nil, fmt.Errorf("FILES_FROM %q must look like s3://bucket/key", config.FilesFrom)
+		}
+		var stderr bytes.Buffer
+		cmd := remotes.command(config, "cat", remotePath("source", bucket, key))
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to download FILES_FROM %s: %w: %s", config.FilesFrom, err,
+				lastLine(strings.TrimSpace(stderr.String())))
+		}
+		data = out
+	} else {
+		var err error
+		if data, err = os.ReadFile(config.FilesFrom); err != nil {
+			return nil, fmt.Errorf("failed to read FILES_FROM: %w", err)
+		}
+	}
+
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, strings.TrimPrefix(line, "/"))
+	}
+	return keys, nil
+}
+
+// prepareFilesFrom loads FILES_FROM and writes the keys to a private file for
+// --files-from-raw, which rclone reads without any comment handling. It
+// sets config.filesFromFile and returns the cleanup for the file.
+func prepareFilesFrom(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) (func(), error) {
+	if config.FilesFrom == "" {
+		return func() {}, nil
+	}
+	keys, err := readFilesFrom(config, remotes)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("FILES_FROM %s contains no keys", config.FilesFrom)
+	}
+	logger.WithFields(logrus.Fields{
+		"files_from": config.FilesFrom,
+		"keys":       len(keys),
+	}).Info("Loaded key list")
+
+	path, cleanup, err := writePrivateFile(config, "rclone-files-from-", "files-from.txt", keys)
+	if err != nil {
+		return nil, err
+	}
+	config.filesFromFile = path
+	config.filesFromKeys = len(keys)
+	return cleanup, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// splitPatterns splits a pattern list on newlines and on sep, so patterns
+// containing the separator can be given one per line. Blank entries are
+// dropped.
+func splitPatterns(value, sep string) []string {
+	var patterns []string
+	for _, line := range strings.Split(value, "\n") {
+		parts := []string{line}
+		if sep != "" {
+			parts = strings.Split(line, sep)
+		}
+		for _, p := range parts {
+			if p = strings.TrimSpace(p); p != "" {
+				patterns = append(patterns, p)
+			}
+		}
+	}
+	return patterns
+}
+
+// prefixPattern turns an EXCLUDE_PREFIXES entry such as "logs" or "/logs/"
+// into the rclone pattern "/logs/**". The leading slash anchors it at the
+// root of the sync, so "logs" doesn't also match "app/logs". It returns ""
+// for entries that consist only of slashes.
+func prefixPattern(prefix string) string {
+	prefix = cleanPrefix(prefix)
+	if prefix == "" {
+		return ""
+	}
+	return "/" + escapeGlob(prefix) + "/**"
+}
+
+// escapeGlob escapes the characters that have a meaning in rclone patterns.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\*?[]{}`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// excludePatterns returns EXCLUDE_PREFIXES as patterns, followed by
+// EXCLUDE_PATTERNS.
+func excludePatterns(config *Config) []string {
+	var patterns []string
+	for _, prefix := range config.ExcludePrefixes {
+		if p := prefixPattern(prefix); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return append(patterns, config.ExcludePatterns...)
+}
+
+// patternRules translates EXCLUDE_PREFIXES, EXCLUDE_PATTERNS and
+// INCLUDE_PATTERNS into rclone's "+ pattern" / "- pattern" notation, in the
+// order rclone applies them. Excludes come first so that "skip tmp/" wins
+// over "*.jpg" for tmp/a.jpg, and includes end with the "- **" that rclone
+// implies for --include.
+func patternRules(config *Config) []string {
+	var rules []string
+	for _, p := range excludePatterns(config) {
+		rules = append(rules, "- "+p)
+	}
+	for _, p := range config.IncludePatterns {
+		rules = append(rules, "+ "+p)
+	}
+	if len(config.IncludePatterns) > 0 {
+		rules = append(rules, "- **")
+	}
+	return rules
+}
+
+// filterRules returns the effective filter, for logging.
+func filterRules(config *Config) []string {
+	return append(patternRules(config), config.FilterRules...)
+}
+
+// filterArgs returns the rclone flags selecting which objects are synced.
+func filterArgs(config *Config) []string {
+	var args []string
+	excludes := excludePatterns(config)
+	if len(config.IncludePatterns) > 0 && len(excludes) > 0 {
+		// rclone applies --include flags before --exclude flags, whatever
+		// their order on the command line, so spell the rules out with
+		// --filter, which keeps it.
+		for _, rule := range patternRules(config) {
+			args = append(args, "--filter", rule)
+		}
+	} else {
+		// --exclude and --filter are applied before --filter-from, so
+		// excluded prefixes also win over FILTER_FILE.
+		for _, p := range excludes {
+			args = append(args, "--exclude", p)
+		}
+		for _, p := range config.IncludePatterns {
+			args = append(args, "--include", p)
+		}
+	}
+	if config.filterFile != "" {
+		args = append(args, "--filter-from", config.filterFile)
+	}
+	if config.filesFromFile != "" {
+		args = append(args, "--files-from-raw", config.filesFromFile)
+	}
+	if config.MinAge != "" {
+		args = append(args, "--min-age", config.MinAge)
+	}
+	if config.MaxAge != "" {
+		args = append(args, "--max-age", config.MaxAge)
+	}
+	if config.MinSize != "" {
+		args = append(args, "--min-size", config.MinSize)
+	}
+	if config.MaxSize != "" {
+		args = append(args, "--max-size", config.MaxSize)
+	}
+	return args
+}
+
+// ageUnits are rclone's duration suffixes beyond Go's, with its definitions
+// of a month and a year.
+var ageUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"M":  30 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+var agePart = regexp.MustCompile(`^(\d+(?:\.\d+)?)(ms|s|m|h|d|w|M|y)`)
+
+// parseAge parses MIN_AGE/MAX_AGE the way rclone does: a Go duration such as
+// "1h30m", rclone units such as "2y" or "1w3d", or a bare number of seconds.
+func parseAge(value string) (time.Duration, error) {
+	total, err := time.ParseDuration(value)
+	if err != nil {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			total = time.Duration(seconds * float64(time.Second))
+		} else {
+			for rest := value; rest != ""; {
+				m := agePart.FindStringSubmatch(rest)
+				if m == nil {
+					return 0, fmt.Errorf("%q is not a duration; use e.g. 15m, 36h, 7d or 2y", value)
+				}
+				n, _ := strconv.ParseFloat(m[1], 64)
+				total += time.Duration(n * float64(ageUnits[m[2]]))
+				rest = rest[len(m[0]):]
+			}
+		}
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("%q must be positive", value)
+	}
+	return total, nil
+}
+
+func validateAgeFilters(config *Config) error {
+	var minAge, maxAge time.Duration
+	var err error
+	if config.MinAge != "" {
+		if minAge, err = parseAge(config.MinAge); err != nil {
+			return fmt.Errorf("invalid MIN_AGE: %w", err)
+		}
+	}
+	if config.MaxAge != "" {
+		if maxAge, err = parseAge(config.MaxAge); err != nil {
+			return fmt.Errorf("invalid MAX_AGE: %w", err)
+		}
+	}
+	if config.MinAge != "" && config.MaxAge != "" && maxAge <= minAge {
+		return fmt.Errorf("MAX_AGE (%s) must be longer than MIN_AGE (%s), otherwise no object matches", config.MaxAge, config.MinAge)
+	}
+	return nil
+}
+
+func validateSizeFilters(config *Config) error {
+	var minSize, maxSize int64
+	var err error
+	if config.MinSize != "" {
+		if minSize, err = parseSize(config.MinSize); err != nil {
+			return fmt.Errorf("invalid MIN_SIZE: %w", err)
+		}
+	}
+	if config.MaxSize != "" {
+		if maxSize, err = parseSize(config.MaxSize); err != nil {
+			return fmt.Errorf("invalid MAX_SIZE: %w", err)
+		}
+	}
+	if config.MinSize != "" && config.MaxSize != "" && maxSize < minSize {
+		return fmt.Errorf("MAX_SIZE (%s) must not be smaller than MIN_SIZE (%s), otherwise no object matches", config.MaxSize, config.MinSize)
+	}
+	return nil
+}
+
+// disableFilteredDeletes switches deletions off while filters are active
+// that rclone evaluates separately for each side. With MIN_AGE=15m, an object
+// replaced in the source a minute ago is filtered out there, but its older
+// copy on the destination is not, so sync would delete it; the same happens
+// when an object grows past MAX_SIZE. Setting ALLOW_FILTERED_DELETE=true
+// keeps deletions on.
+func disableFilteredDeletes(config *Config) {
+	var active []string
+	if config.MinAge != "" {
+		active = append(active, "MIN_AGE")
+	}
+	if config.MaxAge != "" {
+		active = append(active, "MAX_AGE")
+	}
+	if config.MinSize != "" {
+		active = append(active, "MIN_SIZE")
+	}
+	if config.MaxSize != "" {
+		active = append(active, "MAX_SIZE")
+	}
+	if len(active) == 0 || config.AllowFilteredDelete || config.SyncMode != "sync" || config.DeleteStrategy == "none" {
+		return
+	}
+	config.DeleteStrategy = "none"
+	config.maxDeleteSet = false
+	config.MaxDeletePercent = 0
+	config.warnings = append(config.warnings, fmt.Sprintf(
+		"%s set, so deletions are disabled: rclone would delete destination objects whose source counterpart is filtered out; "+
+			"set ALLOW_FILTERED_DELETE=true to delete anyway", strings.Join(active, ", ")))
+}
+
+// parseFilterRules splits FILTER_FILE into its rules, skipping blank lines
+// and comments, and checks that each rule is an include or exclude.
+func parseFilterRules(value string) ([]string, error) {
+	var rules []string
+	for _, line := range strings.Split(value, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if line != "!" && !strings.HasPrefix(line, "+ ") && !strings.HasPrefix(line, "- ") {
+			return nil, fmt.Errorf("FILTER_FILE rule %q must start with \"+ \" or \"- \"", line)
+		}
+		rules = append(rules, line)
+	}
+	return rules, nil
+}
+
+// writeFilterFile writes FILTER_FILE's rules to a private temporary file for
+// --filter-from. It returns "" and a no-op cleanup when no rules are set.
+func writeFilterFile(config *Config) (string, func(), error) {
+	if len(config.FilterRules) == 0 {
+		return "", func() {}, nil
+	}
+	return writePrivateFile(config, "rclone-filter-", "filter.txt", config.FilterRules)
+}
+
+// writePrivateFile writes lines to a file in a fresh directory under
+// RcloneConfigDir, like the rclone config. The returned cleanup function
+// removes the directory and also runs if the process is interrupted.
+func writePrivateFile(config *Config, dirPattern, name string, lines []string) (string, func(), error) {
+	if err := os.MkdirAll(config.RcloneConfigDir, 0700); err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(config.RcloneConfigDir, dirPattern)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	cleanup := removeOnExit(dir)
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return path, cleanup, nil
+}
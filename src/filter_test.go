@@ -0,0 +1,248 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitPatterns(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		sep   string
+		want  []string
+	}{
+		{"", ",", nil},
+		{"*.jpg, *.png ,,", ",", []string{"*.jpg", "*.png"}},
+		{"*.jpg\n\n  {a,b}/** \n", "", []string{"*.jpg", "{a,b}/**"}},
+		{"*.jpg;*.png\n*.gif", ";", []string{"*.jpg", "*.png", "*.gif"}},
+	} {
+		if got := splitPatterns(tt.value, tt.sep); !slices.Equal(got, tt.want) {
+			t.Errorf("splitPatterns(%q, %q) = %q, want %q", tt.value, tt.sep, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterRules(t *testing.T) {
+	rules, err := parseFilterRules("# media only\n+ *.jpg\n\n; and nothing else\n- **\n!\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"+ *.jpg", "- **", "!"}; !slices.Equal(rules, want) {
+		t.Errorf("parseFilterRules = %q, want %q", rules, want)
+	}
+	_, err = parseFilterRules("+ *.jpg\n*.png\n")
+	wantError(t, err, `FILTER_FILE rule "*.png" must start with "+ " or "- "`)
+}
+
+func TestFilterArgs(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{"none", nil, nil},
+		{"includes", map[string]string{"INCLUDE_PATTERNS": "*.jpg,*.png"}, []string{"--include", "*.jpg", "--include", "*.png"}},
+		{"excludes", map[string]string{"EXCLUDE_PATTERNS": "tmp/**"}, []string{"--exclude", "tmp/**"}},
+		// Both need --filter to be applied in order.
+		{"both", map[string]string{"INCLUDE_PATTERNS": "*.jpg", "EXCLUDE_PATTERNS": "tmp/**"}, []string{"--filter", "- tmp/**", "--filter", "+ *.jpg", "--filter", "- **"}},
+		{"newline separated", map[string]string{"INCLUDE_PATTERNS": "{a,b}.jpg\nc.jpg", "FILTER_SEPARATOR": ";"}, []string{"--include", "{a,b}.jpg", "--include", "c.jpg"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filterArgs(config); !slices.Equal(got, tt.want) {
+				t.Errorf("filterArgs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterFile(t *testing.T) {
+	_, err := loadTestConfig(t, map[string]string{"FILTER_FILE": "- tmp/**", "INCLUDE_PATTERNS": "*.jpg"})
+	wantError(t, err, "FILTER_FILE cannot be combined with INCLUDE_PATTERNS or EXCLUDE_PATTERNS")
+
+	config, err := loadTestConfig(t, map[string]string{"FILTER_FILE": "- tmp/**\n+ *.jpg\n- **", "RCLONE_CONFIG_DIR": t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, cleanup, err := writeFilterFile(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "- tmp/**\n+ *.jpg\n- **\n" {
+		t.Errorf("filter file has %q", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o600 {
+		t.Errorf("filter file has mode %o, want 600", info.Mode().Perm())
+	}
+	cleanup()
+	if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+		t.Errorf("the filter file's directory is left behind: %v", err)
+	}
+
+	// Without rules, there is no file.
+	config, err = loadTestConfig(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path, cleanup, err := writeFilterFile(config); path != "" || err != nil {
+		t.Errorf("writeFilterFile = %q, %v; want no file", path, err)
+	} else {
+		cleanup()
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+		err   string
+	}{
+		{"15m", 15 * time.Minute, ""},
+		{"1h30m", 90 * time.Minute, ""},
+		{"90", 90 * time.Second, ""},
+		{"7d", 7 * 24 * time.Hour, ""},
+		{"1w3d", 10 * 24 * time.Hour, ""},
+		{"2M", 60 * 24 * time.Hour, ""},
+		{"1.5y", 365 * 36 * time.Hour, ""},
+		{"soon", 0, `"soon" is not a duration; use e.g. 15m, 36h, 7d or 2y`},
+		{"3 days", 0, "is not a duration"},
+		{"0d", 0, `"0d" must be positive`},
+		{"-1h", 0, `"-1h" must be positive`},
+		{"0", 0, `"0" must be positive`},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseAge(tt.value)
+			wantError(t, err, tt.err)
+			if got != tt.want {
+				t.Errorf("parseAge = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgeFilters(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"MIN_AGE": "15m", "MAX_AGE": "30d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := syncArgs(config)
+	if minAge, _ := argValue(args, "--min-age"); minAge != "15m" {
+		t.Errorf("--min-age = %q, want 15m", minAge)
+	}
+	if maxAge, _ := argValue(args, "--max-age"); maxAge != "30d" {
+		t.Errorf("--max-age = %q, want 30d", maxAge)
+	}
+
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"MIN_AGE": "recent"}, "invalid MIN_AGE"},
+		{map[string]string{"MAX_AGE": "-1h"}, "invalid MAX_AGE"},
+		{map[string]string{"MIN_AGE": "2d", "MAX_AGE": "1d"}, "MAX_AGE (1d) must be longer than MIN_AGE (2d)"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestFilteredDeletes(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		env     map[string]string
+		deletes bool
+	}{
+		{"no filter", nil, true},
+		{"min age", map[string]string{"MIN_AGE": "15m"}, false},
+		{"max size", map[string]string{"MAX_SIZE": "1G"}, false},
+		{"allowed", map[string]string{"MIN_AGE": "15m", "ALLOW_FILTERED_DELETE": "true"}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.env)
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := syncArgs(config)
+			if deletes := args[0] == "sync"; deletes != tt.deletes {
+				t.Errorf("rclone runs %q, want deletions %v", args, tt.deletes)
+			}
+			warned := slices.ContainsFunc(config.warnings, func(w string) bool { return strings.Contains(w, "so deletions are disabled") })
+			if warned == tt.deletes {
+				t.Errorf("warnings %q, want a warning only when deletions are disabled", config.warnings)
+			}
+		})
+	}
+}
+
+func TestSizeFilters(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"MIN_SIZE": "1k", "MAX_SIZE": "5G", "ALLOW_FILTERED_DELETE": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := syncArgs(config)
+	if minSize, _ := argValue(args, "--min-size"); minSize != "1k" {
+		t.Errorf("--min-size = %q, want 1k", minSize)
+	}
+	if maxSize, _ := argValue(args, "--max-size"); maxSize != "5G" {
+		t.Errorf("--max-size = %q, want 5G", maxSize)
+	}
+
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"MIN_SIZE": "big"}, "invalid MIN_SIZE"},
+		{map[string]string{"MAX_SIZE": "-1"}, "invalid MAX_SIZE"},
+		{map[string]string{"MIN_SIZE": "1M", "MAX_SIZE": "1k"}, "MAX_SIZE (1k) must not be smaller than MIN_SIZE (1M)"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+	// Equal bounds match objects of exactly that size.
+	if _, err := loadTestConfig(t, map[string]string{"MIN_SIZE": "1M", "MAX_SIZE": "1024k"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExcludePrefixes(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"logs":         "/logs/**",
+		"/logs/":       "/logs/**",
+		"app//cache":   "/app/cache/**",
+		"raw[1]/*.tmp": `/raw\[1\]/\*.tmp/**`,
+		"{a,b}?":       `/\{a,b\}\?/**`,
+		"///":          "",
+	} {
+		if got := prefixPattern(prefix); got != want {
+			t.Errorf("prefixPattern(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+
+	config, err := loadTestConfig(t, map[string]string{"EXCLUDE_PREFIXES": "logs, /tmp/,/", "EXCLUDE_PATTERNS": "*.bak"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := filterArgs(config), []string{"--exclude", "/logs/**", "--exclude", "/tmp/**", "--exclude", "*.bak"}; !slices.Equal(got, want) {
+		t.Errorf("filterArgs = %q, want %q", got, want)
+	}
+
+	// Excluded prefixes also win over includes.
+	config, err = loadTestConfig(t, map[string]string{"EXCLUDE_PREFIXES": "logs", "INCLUDE_PATTERNS": "*.jpg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := filterArgs(config), []string{"--filter", "- /logs/**", "--filter", "+ *.jpg", "--filter", "- **"}; !slices.Equal(got, want) {
+		t.Errorf("filterArgs = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// option describes a configuration setting. Every option is read from the
+// environment variable env and can be overridden on the command line.
+type option struct {
+	env    string
+	flag   string // defaults to the lower-cased, dash-separated env name
+	usage  string
+	bool   bool
+	secret bool
+}
+
+var options = []option{
+	{env: "CONFIG_FILE", usage: "Path to a YAML or JSON file providing defaults for any of these settings"},
+	{env: "SYNC_JOBS", usage: "JSON array of jobs run in turn: [{\"name\", \"sourceBucket\", \"sourcePrefix\", \"destBucket\", \"destPrefix\", \"overrides\": {...}}]"},
+	{env: "DESTINATIONS", usage: "JSON array of destinations the source is synced to in turn, with DEST_<n>_* names: [{\"name\", \"s3_endpoint\", \"bucket\", ...}]"},
+	{env: "CONTINUE_ON_ERROR", usage: "Keep running the remaining jobs or destinations after one fails (exit code 4 if only some succeed)", bool: true},
+	{env: "JOB_CONCURRENCY", usage: "Number of jobs from SYNC_JOBS or indexed variables run at the same time (default 1)"},
+	{env: "SPLIT_BWLIMIT", usage: "Divide BANDWIDTH_LIMIT between the jobs running at the same time", bool: true},
+	{env: "JOB_NAME", usage: "Name of the job in log lines (default with several jobs: the source bucket)"},
+	{env: "RUN_ID", usage: "Correlation ID of the run for logs, summaries and notifications (default: a new UUID per job)"},
+	{env: "SOURCE_S3_ENDPOINT", flag: "source-endpoint", usage: "Source S3 endpoint URL (required unless SOURCE_REGION is set or the provider is AWS)"},
+	{env: "SOURCE_ACCESS_KEY", usage: "Source S3 access key (required unless SOURCE_ANONYMOUS or SOURCE_AUTH=env|iam)", secret: true},
+	{env: "SOURCE_SECRET_KEY", usage: "Source S3 secret key (required unless SOURCE_ANONYMOUS or SOURCE_AUTH=env|iam)", secret: true},
+	{env: "SOURCE_BUCKET", usage: "Source bucket name (required)"},
+	{env: "SOURCE_AUTH", usage: "Where the source credentials come from: static (the keys), env (AWS_ACCESS_KEY_ID etc.) or iam (IRSA, ECS task or instance role) (default static)"},
+	{env: "SOURCE_ROLE_ARN", usage: "IAM role to assume for the source with its credentials, e.g. in another account; renewed before it expires"},
+	{env: "SOURCE_ROLE_EXTERNAL_ID", usage: "External ID the trust policy of SOURCE_ROLE_ARN requires"},
+	{env: "SOURCE_ROLE_SESSION_NAME", usage: "Session name of SOURCE_ROLE_ARN, shown in CloudTrail (default s3-sync)"},
+	{env: "SOURCE_ROLE_DURATION", usage: "Session length of SOURCE_ROLE_ARN, 15m to 12h up to the role's maximum (default 1h)"},
+	{env: "SOURCE_ANONYMOUS", usage: "Read a public source bucket without credentials; SOURCE_ACCESS_KEY and SOURCE_SECRET_KEY must then be unset", bool: true},
+	{env: "SOURCE_BUCKET_PATTERN", usage: "Sync every source bucket matching this pattern, e.g. tenant-*, as a separate job (instead of SOURCE_BUCKET)"},
+	{env: "EXCLUDE_BUCKETS", usage: "Comma-separated buckets or patterns to skip with SOURCE_BUCKET_PATTERN"},
+	{env: "SHARD_BY_PREFIX", usage: "Split the sync into one job per top-level folder of the source, plus a final pass for the rest", bool: true},
+	{env: "SHARD_PREFIXES", usage: "Comma-separated top-level folders to shard by with SHARD_BY_PREFIX (default: list the source)"},
+	{env: "SOURCE_PREFIX", usage: "Only sync this sub-path of the source bucket (default: bucket root)"},
+	{env: "SOURCE_PROVIDER", usage: "rclone S3 provider of the source, e.g. AWS, Minio, Ceph (default Other)"},
+	{env: "SOURCE_REGION", usage: "Region of the source bucket, required for signing by some providers"},
+	{env: "SOURCE_FORCE_PATH_STYLE", usage: "true for path-style requests (MinIO, older Ceph), false for virtual-hosted style (default: rclone's choice)"},
+	{env: "SOURCE_V2_AUTH", usage: "Use AWS signature v2 for legacy gateways such as old Ceph radosgw", bool: true},
+	{env: "SOURCE_DISABLE_HTTP2", usage: "Disable HTTP/2 for gateways that misbehave with it", bool: true},
+	{env: "SOURCE_ACL", usage: "Canned ACL for objects created on the source (default private)"},
+	{env: "SOURCE_STORAGE_CLASS", usage: "Storage class of objects created on the source, e.g. STANDARD_IA (default: bucket default)"},
+	{env: "SOURCE_REQUESTER_PAYS", usage: "The source bucket is requester-pays: accept its charges; the usage is reported in the run summary", bool: true},
+	{env: "SOURCE_SSE", usage: "Server-side encryption of objects created on the source: AES256 or aws:kms (default: bucket default)"},
+	{env: "SOURCE_SSE_KMS_KEY_ID", usage: "KMS key for SOURCE_SSE=aws:kms"},
+	{env: "SOURCE_SSE_CUSTOMER_KEY", usage: "32-byte SSE-C key the source objects are encrypted with", secret: true},
+	{env: "DEST_S3_ENDPOINT", flag: "dest-endpoint", usage: "Destination S3 endpoint URL (required unless DEST_REGION is set or the provider is AWS)"},
+	{env: "ENDPOINT_DEFAULT_SCHEME", usage: "Scheme added to endpoints given without one: https or http (default https)"},
+	{env: "DEST_ACCESS_KEY", usage: "Destination S3 access key (required unless DEST_AUTH=env|iam)", secret: true},
+	{env: "DEST_SECRET_KEY", usage: "Destination S3 secret key (required unless DEST_AUTH=env|iam)", secret: true},
+	{env: "DEST_BUCKET", usage: "Destination bucket name (required)"},
+	{env: "DEST_ANONYMOUS", usage: "Not supported: writing to the destination always needs credentials", bool: true},
+	{env: "DEST_AUTH", usage: "Where the destination credentials come from: static (the keys), env (AWS_ACCESS_KEY_ID etc.) or iam (IRSA, ECS task or instance role) (default static)"},
+	{env: "DEST_ROLE_ARN", usage: "IAM role to assume for the destination with its credentials, e.g. in another account; renewed before it expires"},
+	{env: "DEST_ROLE_EXTERNAL_ID", usage: "External ID the trust policy of DEST_ROLE_ARN requires"},
+	{env: "DEST_ROLE_SESSION_NAME", usage: "Session name of DEST_ROLE_ARN, shown in CloudTrail (default s3-sync)"},
+	{env: "DEST_ROLE_DURATION", usage: "Session length of DEST_ROLE_ARN, 15m to 12h up to the role's maximum (default 1h)"},
+	{env: "AWS_ACCESS_KEY_ID", usage: "AWS access key of the remotes with _AUTH=env", secret: true},
+	{env: "AWS_SECRET_ACCESS_KEY", usage: "AWS secret key of the remotes with _AUTH=env", secret: true},
+	{env: "AWS_SESSION_TOKEN", usage: "AWS session token of the remotes with _AUTH=env, for temporary keys", secret: true},
+	{env: "DEST_PROVIDER", usage: "rclone S3 provider of the destination, e.g. AWS, Minio, Ceph (default Other)"},
+	{env: "DEST_REGION", usage: "Region of the destination bucket, required for signing by some providers"},
+	{env: "DEST_FORCE_PATH_STYLE", usage: "true for path-style requests (MinIO, older Ceph), false for virtual-hosted style (default: rclone's choice)"},
+	{env: "DEST_V2_AUTH", usage: "Use AWS signature v2 for legacy gateways such as old Ceph radosgw", bool: true},
+	{env: "DEST_DISABLE_HTTP2", usage: "Disable HTTP/2 for gateways that misbehave with it", bool: true},
+	{env: "DEST_ACL", usage: "Canned ACL for objects written to the destination, e.g. public-read (default private)"},
+	{env: "DEST_STORAGE_CLASS", usage: "Storage class of objects written to the destination: STANDARD, STANDARD_IA, ONEZONE_IA, INTELLIGENT_TIERING, GLACIER_IR, GLACIER, DEEP_ARCHIVE, ... (default: bucket default)"},
+	{env: "DEST_REQUESTER_PAYS", usage: "The destination bucket is requester-pays: accept its charges; the usage is reported in the run summary", bool: true},
+	{env: "DEST_SSE", usage: "Server-side encryption of objects written to the destination: AES256 or aws:kms (default: bucket default)"},
+	{env: "DEST_SSE_KMS_KEY_ID", usage: "KMS key ID or ARN for DEST_SSE=aws:kms (required with it)"},
+	{env: "DEST_SSE_CUSTOMER_KEY", usage: "32-byte SSE-C key to encrypt the destination objects with, for providers without SSE-S3/KMS", secret: true},
+	{env: "DEST_PREFIX", usage: "Prefix for the destination path; empty or \"/\" syncs into the bucket root (default: source bucket name plus SOURCE_PREFIX)"},
+	{env: "SYNC_MODE", usage: "sync (mirror, with deletions), copy (never delete) or move (delete source objects after transfer) (default sync)"},
+	{env: "DELETE_DISABLED", usage: "Never delete from the destination; a sync then runs rclone copy", bool: true},
+	{env: "DELETE_STRATEGY", usage: "When SYNC_MODE=sync deletes: during, after (once all transfers are done), before, or none (default during)"},
+	{env: "IMMUTABLE", usage: "Only add new objects: never overwrite or delete, and fail if an existing destination object differs", bool: true},
+	{env: "CONFIRM_MOVE", usage: "Must be true for SYNC_MODE=move outside dry runs, as source deletion is irreversible", bool: true},
+	{env: "COMPARE_MODE", usage: "How changed objects are detected: checksum, size-only or modtime (size and modification time) (default checksum)"},
+	{env: "IGNORE_CASE", usage: "Treat keys that differ only in case as the same object", bool: true},
+	{env: "UNICODE_NORMALIZATION", usage: "nfc or nfd: treat NFC and NFD spellings of a key as the same object (rclone default); off: compare byte by byte"},
+	{env: "TRACK_RENAMES", usage: "Detect renamed objects and move them on the destination instead of re-uploading (SYNC_MODE=sync only)", bool: true},
+	{env: "TRACK_RENAMES_STRATEGY", usage: "How renames are matched: comma-separated hash, modtime, leaf (rclone default hash)"},
+	{env: "SCHEDULE", usage: "Keep running and sync on a schedule: an interval such as 30m, or a cron expression such as \"0 2 * * *\" (default: sync once)"},
+	{env: "CLEANUP_MULTIPART", usage: "Abort abandoned multipart uploads in the destination: true or before the sync, after it, or false (default false)"},
+	{env: "MULTIPART_MAX_AGE", usage: "Only abort multipart uploads started longer ago than this, at least 1h (default 24h)"},
+	{env: "SYNC_TIMEOUT", usage: "Stop rclone if a sync runs longer than this, e.g. 6h; the run fails with error class timeout"},
+	{env: "JOBS_TIMEOUT", usage: "Stop the syncs of a multi-job run still running this long after it started"},
+	{env: "SHUTDOWN_GRACE", usage: "How long rclone may take to stop after SIGTERM before it is killed (default 30s)"},
+	{env: "STARTUP_JITTER", usage: "Wait a random time up to this duration before the first sync, e.g. 5m, so a fleet doesn't start at once"},
+	{env: "SCHEDULE_SPLAY", usage: "Delay each scheduled run by a random time up to this duration"},
+	{env: "SQS_QUEUE_URL", usage: "Keep running and apply S3 event notifications from this SQS queue with targeted copies and deletions"},
+	{env: "SQS_REGION", usage: "Region of the SQS queue (default: from SQS_QUEUE_URL, else SOURCE_REGION)"},
+	{env: "SQS_ACCESS_KEY", usage: "Access key for the SQS queue (default: the source credentials)", secret: true},
+	{env: "SQS_SECRET_KEY", usage: "Secret key for the SQS queue (default SOURCE_SECRET_KEY)", secret: true},
+	{env: "SQS_BATCH_WINDOW", usage: "How long events are collected after the first one before they are applied together (default 30s)"},
+	{env: "SQS_VISIBILITY_TIMEOUT", usage: "How long received messages stay hidden from other consumers; must cover applying a batch (default 15m)"},
+	{env: "HTTP_ADDR", usage: "Keep running and serve /healthz, /readyz, /metrics and, with HTTP_TOKEN, POST /sync and GET /runs/<id> on this address, e.g. :8080"},
+	{env: "HTTP_TOKEN", usage: "Bearer token required by POST /sync and GET /runs/<id>; without it they are not served", secret: true},
+	{env: "ALLOW_QUEUE", usage: "Queue syncs triggered over HTTP while one is running instead of answering 409", bool: true},
+	{env: "READY_CHECK_TTL", usage: "How long /readyz reuses its last source and destination access check (default 1m)"},
+	{env: "DEBUG_ADDR", usage: "Serve pprof profiles and expvar on this separate address, e.g. 127.0.0.1:6060, and log runtime statistics at debug level"},
+	{env: "RCLONE_RC_ADDR", usage: "Let rclone serve its remote control API on this address during the sync, e.g. 127.0.0.1:5572"},
+	{env: "PUSHGATEWAY_URL", usage: "Push the metrics to this Prometheus Pushgateway when a one-shot run ends, e.g. http://pushgateway:9091"},
+	{env: "PUSHGATEWAY_JOB", usage: "Job name the metrics are pushed under (default s3-sync)"},
+	{env: "STATSD_ADDR", usage: "Send DogStatsD metrics of every run over UDP to this address, e.g. 127.0.0.1:8125"},
+	{env: "STATSD_PREFIX", usage: "Prefix of the StatsD metric names (default s3_sync)"},
+	{env: "STATSD_TAGS", usage: "Tags added to every StatsD metric, separated by commas, e.g. env:prod,team:media"},
+	{env: "STATSD_PROGRESS", usage: "Also send rclone's stats as StatsD gauges during the sync", bool: true},
+	{env: "SUMMARY_FILE", usage: "Also write the JSON run summary printed to stdout to this file, one line per job"},
+	{env: "SLACK_WEBHOOK_URL", usage: "Slack incoming webhook to post run results to", secret: true},
+	{env: "WEBHOOK_URL", usage: "HTTP endpoint to send run results to, as the summary JSON or WEBHOOK_BODY_TEMPLATE", secret: true},
+	{env: "WEBHOOK_METHOD", usage: "HTTP method of the webhook: POST, PUT or PATCH (default POST)"},
+	{env: "WEBHOOK_HEADERS", usage: "Extra webhook request headers as a JSON object, e.g. {\"X-Team\": \"media\"}", secret: true},
+	{env: "WEBHOOK_BODY_TEMPLATE", usage: "Go text/template for the webhook body, rendered with the run summary, e.g. {\"status\": {{json .Result}}}"},
+	{env: "WEBHOOK_TOKEN", usage: "Bearer token sent in the Authorization header of the webhook", secret: true},
+	{env: "HEALTHCHECK_URL", usage: "Healthchecks.io-style ping URL, pinged at /start, on success and at /fail", secret: true},
+	{env: "SENTRY_DSN", usage: "Sentry DSN to report failed runs and panics to", secret: true},
+	{env: "SENTRY_ENVIRONMENT", usage: "Environment of the Sentry events, e.g. production"},
+	{env: "OTEL_EXPORTER_OTLP_ENDPOINT", usage: "OTLP/HTTP endpoint to export traces of the runs to, e.g. http://otel-collector:4318"},
+	{env: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", usage: "Full OTLP/HTTP URL for the traces, instead of OTEL_EXPORTER_OTLP_ENDPOINT/v1/traces"},
+	{env: "OTEL_EXPORTER_OTLP_HEADERS", usage: "Headers for the OTLP export as key=value pairs separated by commas", secret: true},
+	{env: "OTEL_EXPORTER_OTLP_PROTOCOL", usage: "OTLP protocol; only http/json is supported (default http/json)"},
+	{env: "OTEL_SERVICE_NAME", usage: "Service name of the exported traces (default s3-sync)"},
+	{env: "SMTP_HOST", usage: "SMTP server to mail run results to SMTP_TO"},
+	{env: "SMTP_PORT", usage: "SMTP server port (default 587, 465 with SMTP_TLS=tls, 25 with none)"},
+	{env: "SMTP_TLS", usage: "SMTP encryption: starttls, tls (implicit TLS) or none (default starttls)"},
+	{env: "SMTP_USERNAME", usage: "SMTP user name, authenticating with PLAIN"},
+	{env: "SMTP_PASSWORD", usage: "SMTP password", secret: true},
+	{env: "SMTP_FROM", usage: "Sender address of the notification mails (default s3-sync@localhost)"},
+	{env: "SMTP_TO", usage: "Comma-separated recipients of the notification mails"},
+	{env: "NOTIFY_ON", usage: "Which runs to notify about: failure, success or always (default failure)"},
+	{env: "NOTIFY_TEST", usage: "Send a test message to every notification target, then exit", bool: true},
+	{env: "DRY_RUN", usage: "Show what would be transferred without making changes", bool: true},
+	{env: "MAX_DELETE", usage: "Maximum number of files to delete in one sync: 0 allows none, negative means no limit; not allowed with SYNC_MODE=copy (default 1000)"},
+	{env: "MAX_DELETE_PERCENT", usage: "Also limit deletions to this percentage of the destination objects, counted before the sync"},
+	{env: "MIN_SOURCE_OBJECTS", usage: "Abort before syncing if the source has fewer objects than this"},
+	{env: "MAX_SHRINK_PERCENT", usage: "Abort before syncing if the source has this many percent fewer objects than the destination"},
+	{env: "FORCE", usage: "Skip the MIN_SOURCE_OBJECTS and MAX_SHRINK_PERCENT checks", bool: true},
+	{env: "MAX_DELETE_PERCENT_ON_ERROR", usage: "If the destination can't be counted: fail, or max-delete to go on with MAX_DELETE alone (default fail)"},
+	{env: "FAST_LIST", usage: "List buckets with fewer, larger requests at the cost of memory (about 1 KB per object)", bool: true},
+	{env: "EXPECTED_OBJECT_COUNT", usage: "Approximate number of objects, used to estimate FAST_LIST memory use"},
+	{env: "TRANSFER_ORDER", usage: "Order of transfers: name, size or modtime, optionally ,asc / ,desc / ,mixed, e.g. size,desc"},
+	{env: "MEMORY_PROFILE", usage: "Preset for BUFFER_SIZE, TRANSFERS, CHECKERS and UPLOAD_CHUNK_SIZE: low, default or high; explicit values win"},
+	{env: "TRANSFERS", usage: "Number of parallel transfers (default 4)"},
+	{env: "CHECKERS", usage: "Number of parallel checkers comparing objects (default 8)"},
+	{env: "MAX_CONCURRENCY", usage: "Upper limit for TRANSFERS and CHECKERS, protecting small endpoints (default 256)"},
+	{env: "RETRIES", usage: "Number of retries for failed operations (default 3)"},
+	{env: "RUN_RETRIES", usage: "Run the whole sync again this many times after a network, throttling or 5xx failure (default 0)"},
+	{env: "RUN_RETRY_BACKOFF", usage: "Wait before the first RUN_RETRIES attempt, doubled for each further one (default 30s)"},
+	{env: "INCLUDE_PATTERNS", usage: "Only sync objects matching these rclone patterns, separated by commas or newlines"},
+	{env: "EXCLUDE_PATTERNS", usage: "Skip objects matching these rclone patterns, separated by commas or newlines; applied before includes"},
+	{env: "EXCLUDE_PREFIXES", usage: "Skip these folders, relative to the source prefix, e.g. logs/,tmp/; applied before all other filters"},
+	{env: "FILTER_SEPARATOR", usage: "Separator for EXCLUDE_PREFIXES, INCLUDE_PATTERNS and EXCLUDE_PATTERNS besides newlines; empty for newlines only (default ,)"},
+	{env: "FILTER_FILE", usage: "rclone filter rules (\"+ pattern\" / \"- pattern\", one per line), passed via --filter-from"},
+	{env: "FILES_FROM", usage: "Only sync the keys listed in this file (one per line, relative to the source prefix); a local path or s3://bucket/key on the source"},
+	{env: "MIN_AGE", usage: "Only sync objects older than this, e.g. 15m (Go durations or rclone suffixes ms|s|m|h|d|w|M|y)"},
+	{env: "MAX_AGE", usage: "Only sync objects younger than this, e.g. 2y"},
+	{env: "MIN_SIZE", usage: "Only sync objects of at least this size, e.g. 10M (suffixes b|k|m|g|t|p, bare numbers are KiB)"},
+	{env: "MAX_SIZE", usage: "Only sync objects of at most this size, e.g. 500G"},
+	{env: "ALLOW_FILTERED_DELETE", usage: "Keep deletions enabled in sync mode while age or size filters are set", bool: true},
+	{env: "BACKUP_DIR", usage: "Prefix in the destination bucket to move replaced and deleted objects to; {date} expands to the UTC date"},
+	{env: "BACKUP_SUFFIX", usage: "Suffix added to replaced and deleted objects, before the extension; {timestamp} expands to the UTC start time"},
+	{env: "VERIFY_AFTER_SYNC", usage: "Run rclone check after a successful sync and fail with exit code 6 on differences", bool: true},
+	{env: "VERIFY_ONLY", usage: "Only run the verification, without syncing", bool: true},
+	{env: "PRESERVE_METADATA", usage: "Copy Content-Type, Cache-Control, the other content headers and user metadata (rclone --metadata)", bool: true},
+	{env: "PRESERVE_TAGS", usage: "Copy the object tags of transferred objects; failures are listed in the run summary", bool: true},
+	{env: "ARCHIVED_OBJECTS", usage: "What to do with source objects in GLACIER or DEEP_ARCHIVE that aren't restored: fail, skip, or restore (native engine) (default fail)"},
+	{env: "VERIFY_METADATA_SAMPLE", usage: "After the sync, compare the metadata of this many random objects with their copies and report mismatches"},
+	{env: "REPORT_PREFIX", usage: "Upload a report of every run to <timestamp>/ under this prefix of the destination bucket"},
+	{env: "MANIFEST", usage: "Add a gzip-compressed list of the transferred and deleted keys to the report", bool: true},
+	{env: "REPORT_RETENTION", usage: "Keep only this many of the latest reports (default 0, keep all)"},
+	{env: "STATE_FILE", usage: "Keep the result of the last run in this file (default: state.json under REPORT_PREFIX, if set)"},
+	{env: "LOCK", usage: "Hold a lock object in the destination bucket while syncing, so overlapping runs don't sync at once", bool: true},
+	{env: "LOCK_KEY", usage: "Key of the lock object in the destination bucket (default REPORT_PREFIX/.sync-lock)"},
+	{env: "LOCK_TTL", usage: "Expiry of the lock, refreshed while the sync runs; an expired lock is broken (default 10m)"},
+	{env: "HEARTBEAT_KEY", usage: "Key in the destination bucket to write a JSON heartbeat with the progress of the running sync to"},
+	{env: "HEARTBEAT_INTERVAL", usage: "How often to write HEARTBEAT_KEY while rclone runs (default 60s)"},
+	{env: "PRE_SYNC_HOOK", usage: "Command to run before the sync, split like a shell would but run without one; if it fails, the sync doesn't run"},
+	{env: "POST_SYNC_HOOK", usage: "Command to run after a successful sync, with S3_SYNC_RESULT and S3_SYNC_SUMMARY_FILE set"},
+	{env: "POST_FAILURE_HOOK", usage: "Command to run after a failed sync, with S3_SYNC_RESULT and S3_SYNC_SUMMARY_FILE set"},
+	{env: "HOOK_TIMEOUT", usage: "How long a hook may run before it is stopped (default 5m)"},
+	{env: "POST_HOOK_FAILURE", usage: "What a failing POST_SYNC_HOOK does: warn, or fail the run (default warn)"},
+	{env: "INCREMENTAL", usage: "Only copy objects modified since the last successful run, with a full sync every FULL_SYNC_EVERY", bool: true},
+	{env: "INCREMENTAL_MARGIN", usage: "Look this much further back than the last success, for clock skew (default 15m)"},
+	{env: "FULL_SYNC_EVERY", usage: "Run a full sync after this duration, or after this many runs (default 24h)"},
+	{env: "DIFF_REPORT_FILE", usage: "Write the changes a dry run found to this JSON file"},
+	{env: "DIFF_KEY_LIMIT", usage: "Maximum number of keys listed per kind of change in the dry-run diff (default 1000)"},
+	{env: "FAIL_ON_DIFF", usage: "Exit with code 6 if a dry run finds any difference", bool: true},
+	{env: "CONFIRM", usage: "Plan the sync with a dry run and apply it only once confirmed", bool: true},
+	{env: "CONFIRM_TOKEN_FILE", usage: "Wait for this file to appear instead of asking on stdin; containing \"no\" rejects the plan"},
+	{env: "CONFIRM_TIMEOUT", usage: "Abort if the plan isn't confirmed within this time (default 15m)"},
+	{env: "BANDWIDTH_LIMIT", flag: "bwlimit", usage: "Bandwidth limit, e.g. 10M, 10M:1G (upload:download) or a timetable like \"Mon-08:00,50M 18:00,off\" (default: unlimited)"},
+	{env: "BWLIMIT_FILE", usage: "Apply BANDWIDTH_LIMIT to each file instead of the whole transfer", bool: true},
+	{env: "MAX_TRANSFER", usage: "Stop after transferring this much data, e.g. 2T; exits with 5 (partial sync)"},
+	{env: "MAX_DURATION", usage: "Stop after running this long, e.g. 4h; exits with 5 (partial sync)"},
+	{env: "CUTOFF_MODE", usage: "How MAX_TRANSFER/MAX_DURATION stop: hard (at once), soft (finish running transfers) or cautious (start none that would exceed)"},
+	{env: "TPS_LIMIT", usage: "Maximum API transactions per second, e.g. 10 or 2.5 (default 0, unlimited)"},
+	{env: "TPS_LIMIT_BURST", usage: "Transactions allowed in a burst above TPS_LIMIT (rclone default 1)"},
+	{env: "BUFFER_SIZE", usage: "In-memory read-ahead buffer per transfer (rclone default 16M)"},
+	{env: "USE_MMAP", usage: "Allocate buffers with mmap so memory is returned to the system sooner", bool: true},
+	{env: "UPLOAD_CHUNK_SIZE", usage: "Multipart upload part size, e.g. 64M (rclone default 5M)"},
+	{env: "UPLOAD_CUTOFF", usage: "Objects larger than this are uploaded in parts, at most 5G (rclone default 200M)"},
+	{env: "UPLOAD_CONCURRENCY", usage: "Parts uploaded in parallel per object (rclone default 4)"},
+	{env: "COPY_CUTOFF", usage: "Server-side copies of objects larger than this are done in parts, at most 5G (rclone default 4.656G)"},
+	{env: "EXPECTED_MAX_OBJECT_SIZE", usage: "Largest object you expect; used to warn when UPLOAD_CHUNK_SIZE needs more than 10000 parts"},
+	{env: "PRINT_CONFIG", usage: "Set to \"only\" to print the effective configuration (secrets masked) as JSON and exit"},
+	{env: "VALIDATE_ONLY", usage: "Only check access to both buckets, then exit (same as the check-config command)", bool: true},
+	{env: "ENGINE", usage: "Sync engine: rclone, or native to sync through the S3 API without rclone (default rclone)"},
+	{env: "RCLONE_CONFIG_MODE", usage: "How remotes are passed to rclone: env (environment variables) or file (temporary config file) (default env)"},
+	{env: "RCLONE_CONFIG_DIR", usage: "Writable directory for the per-run rclone config in file mode (default: system temp dir)"},
+	{env: "RCLONE_PATH", usage: "rclone binary to run (default: rclone from PATH)"},
+	{env: "MIN_RCLONE_VERSION", usage: "Refuse to run with an older rclone (default 1.55.0)"},
+	{env: "RCLONE_EXTRA_ARGS", usage: "Additional rclone flags, split with shell quoting rules, e.g. '--fast-list --exclude \"my dir/**\"'"},
+	{env: "LOG_LEVEL", usage: "Log level: trace, debug, info, warn, error (default info)"},
+	{env: "LOG_FORMAT", usage: "Log format: json, logfmt or text (default text on a terminal, json otherwise)"},
+	{env: "LOG_TIMESTAMP_FORMAT", usage: "Log timestamp format: rfc3339, rfc3339nano or a Go time layout (default rfc3339, 15:04:05 for text)"},
+	{env: "LOG_FILE", usage: "Also write the logs to this file, rotated by size and age and reopened on SIGHUP"},
+	{env: "LOG_FILE_MAX_SIZE", usage: "Rotate LOG_FILE at this size, 0 for never (default 100M)"},
+	{env: "LOG_FILE_MAX_BACKUPS", usage: "How many rotated LOG_FILE files to keep as LOG_FILE.1 to .N (default 5)"},
+	{env: "LOG_FILE_MAX_AGE", usage: "Also rotate LOG_FILE once it was started this long ago, e.g. 24h"},
+	{env: "LOG_TRANSFERS", usage: "Log every copied, moved and deleted key with its size at debug level", bool: true},
+	{env: "STATS_INTERVAL", usage: "How often rclone logs its transfer stats (default 1m)"},
+	{env: "PROGRESS", usage: "true to pass --progress to rclone, false never (default: only when stdout is a terminal)"},
+}
+
+// allOptions returns options plus a _FILE variant for every secret, which
+// names a file to read the secret from.
+func allOptions() []option {
+	all := make([]option, 0, len(options))
+	for _, opt := range options {
+		all = append(all, opt)
+		if opt.secret {
+			usage := strings.TrimSuffix(opt.usage, " (required)")
+			all = append(all, option{
+				env:   opt.env + "_FILE",
+				flag:  opt.flagName() + "-file",
+				usage: "File containing the " + strings.ToLower(usage[:1]) + usage[1:],
+			})
+		}
+	}
+	return all
+}
+
+func (o option) flagName() string {
+	if o.flag != "" {
+		return o.flag
+	}
+	return strings.ToLower(strings.ReplaceAll(o.env, "_", "-"))
+}
+
+// flagValue records the raw string given for a flag so it can be merged with
+// the environment before any parsing happens.
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *flagValue) String() string     { return v.value }
+func (v *flagValue) Set(s string) error { v.value = s; return nil }
+func (v *flagValue) IsBoolFlag() bool   { return v.isBool }
+
+// parseFlags parses the command line and returns the values of all flags that
+// were explicitly set, keyed by their environment variable name. A leading
+// check-config command is translated into VALIDATE_ONLY.
+func parseFlags(args []string, usageOutput io.Writer) (map[string]string, error) {
+	checkConfig := len(args) > 0 && args[0] == "check-config"
+	if checkConfig {
+		args = args[1:]
+	}
+
+	fs := flag.NewFlagSet("s3-sync", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	envByFlag := make(map[string]string, len(options))
+	for _, opt := range allOptions() {
+		envByFlag[opt.flagName()] = opt.env
+		fs.Var(&flagValue{isBool: opt.bool}, opt.flagName(), opt.usage)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			printUsage(usageOutput)
+		}
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	values := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		values[envByFlag[f.Name]] = f.Value.String()
+	})
+	if checkConfig {
+		values["VALIDATE_ONLY"] = "true"
+	}
+
+	return values, nil
+}
+
+// exitCodes documents the exit codes in the usage.
+var exitCodes = [][2]string{
+	{"0", "success"},
+	{"1", "other failure, e.g. a failing hook or temporary files that couldn't be written"},
+	{"2", "configuration error"},
+	{"3", "preflight failed: rclone missing or too old, a _ROLE_ARN that can't be assumed, a source that can't be listed for discovery or sharding, a failed access check, or a source that looks emptied"},
+	{"4", "sync failed, also when only some jobs or destinations succeeded"},
+	{"5", "budget (MAX_TRANSFER, MAX_DURATION) or delete limit (MAX_DELETE, MAX_DELETE_PERCENT) reached, partial sync"},
+	{"6", "verification failed or FAIL_ON_DIFF found differences"},
+	{"7", "interrupted by SIGINT or SIGTERM"},
+	{"8", "lock held by another run, or unreadable"},
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: s3-sync [check-config] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "With check-config, access to both buckets is verified and nothing is synced.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Exit codes:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range exitCodes {
+		fmt.Fprintf(tw, "  %s\t%s\n", c[0], c[1])
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Every flag can also be set through the environment variable shown next to it.")
+	fmt.Fprintln(w, "Flags take precedence over environment variables, which take precedence over")
+	fmt.Fprintln(w, "CONFIG_FILE. Config file keys are the lower-cased variable names (e.g. source_bucket).")
+	fmt.Fprintln(w, "Several jobs can be defined with SYNC_JOBS or indexed variables such as SOURCE_BUCKET_1,")
+	fmt.Fprintln(w, "and several destinations with DESTINATIONS or variables such as DEST_1_BUCKET.")
+	fmt.Fprintln(w)
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, opt := range allOptions() {
+		name := "--" + opt.flagName()
+		if !opt.bool {
+			name += " value"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", name, opt.env, opt.usage)
+	}
+	tw.Flush()
+}
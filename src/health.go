@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// heartbeatInterval is how often the daemon loops report that they are
+	// alive, even while they have nothing else to do.
+	heartbeatInterval = 15 * time.Second
+	// heartbeatStale is how old a heartbeat may get before /healthz fails.
+	heartbeatStale = 4 * heartbeatInterval
+)
+
+// health answers the liveness and readiness probes of the HTTP server.
+type health struct {
+	configs  []*Config
+	ttl      time.Duration
+	draining func() bool
+
+	mu    sync.Mutex
+	beats map[string]time.Time
+
+	// checkMu serialises connectivity checks, so probes arriving together
+	// share one.
+	checkMu  sync.Mutex
+	checked  time.Time
+	checkErr error
+}
+
+func newHealth(configs []*Config, draining func() bool) *health {
+	ttl, _ := time.ParseDuration(configs[0].ReadyCheckTTL)
+	return &health{configs: configs, ttl: ttl, draining: draining, beats: make(map[string]time.Time)}
+}
+
+// beat records that loop is still iterating.
+func (h *health) beat(loop string) {
+	h.mu.Lock()
+	h.beats[loop] = time.Now()
+	h.mu.Unlock()
+}
+
+// stale returns the loops whose last heartbeat is older than heartbeatStale.
+func (h *health) stale() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var stale []string
+	for loop, at := range h.beats {
+		if time.Since(at) > heartbeatStale {
+			stale = append(stale, loop)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// connectivity returns the result of the last access check of the source
+// and destination of every job, repeating it once it is older than
+// READY_CHECK_TTL.
+func (h *health) connectivity() error {
+	h.checkMu.Lock()
+	defer h.checkMu.Unlock()
+	if !h.checked.IsZero() && time.Since(h.checked) < h.ttl {
+		return h.checkErr
+	}
+	var errs []error
+	for _, config := range h.configs {
+		errs = append(errs, checkConnectivity(config))
+	}
+	h.checked, h.checkErr = time.Now(), errors.Join(errs...)
+	return h.checkErr
+}
+
+// checkConnectivity lists the source and destination of config once. With
+// SOURCE_BUCKET_PATTERN, listing the source's buckets is checked instead.
+func checkConnectivity(config *Config) error {
+	remotes, cleanup, err := setupRemotes(config)
+	if err != nil {
+		return fmt.Errorf("failed to create rclone config: %w", err)
+	}
+	defer cleanup()
+	source := remotePath("source", config.Source.Bucket, config.Source.Prefix)
+	if config.SourceBucketPattern != "" {
+		source = "source:"
+	}
+	for _, remote := range []string{source, remotePath("dest", config.Dest.Bucket, "")} {
+		if err := checkRemote(config, remotes, remote); err != nil {
+			return fmt.Errorf("%s: %w", remote, err)
+		}
+	}
+	return nil
+}
+
+// handleHealthz serves /healthz: the process is alive and none of its loops
+// is stuck. A long sync doesn't fail it, as it runs outside the loops.
+func (h *health) handleHealthz(w http.ResponseWriter, req *http.Request) {
+	if stale := h.stale(); len(stale) > 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unhealthy", "stale_loops": stale})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz serves /readyz: the configuration is valid, which it is once
+// the server runs, and the last connectivity check succeeded. It fails while
+// the server shuts down.
+func (h *health) handleReadyz(w http.ResponseWriter, req *http.Request) {
+	if h.draining() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+	if err := h.connectivity(); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ready", "last_success": h.lastSuccesses()})
+}
+
+// lastSuccesses returns the time and age of the last successful run of each
+// job, for monitoring that looks at /readyz rather than /metrics. Jobs
+// without one are omitted.
+func (h *health) lastSuccesses() map[string]interface{} {
+	jobs := make(map[string]interface{})
+	for _, config := range h.configs {
+		last := metrics.lastSuccess(config)
+		if last.IsZero() {
+			continue
+		}
+		jobs[jobLabels(config).job] = map[string]interface{}{
+			"at":          last.UTC().Format(time.RFC3339),
+			"age_seconds": int64(time.Since(last).Seconds()),
+		}
+	}
+	return jobs
+}
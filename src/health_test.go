@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// probe sends a GET of path to handler and returns the status and decoded
+// body.
+func probe(t *testing.T, handler http.HandlerFunc, path string) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s answered %q: %v", path, rec.Body.String(), err)
+	}
+	return rec.Code, body
+}
+
+func TestHealthz(t *testing.T) {
+	config, err := loadTestConfig(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHealth([]*Config{config}, func() bool { return false })
+	h.beat("scheduler")
+	if code, body := probe(t, h.handleHealthz, "/healthz"); code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("/healthz = %d %v, want ok", code, body)
+	}
+
+	// A loop that stopped beating fails the liveness probe.
+	h.beats["events"] = time.Now().Add(-heartbeatStale - time.Second)
+	code, body := probe(t, h.handleHealthz, "/healthz")
+	if stale, _ := body["stale_loops"].([]interface{}); code != http.StatusServiceUnavailable || len(stale) != 1 || stale[0] != "events" {
+		t.Errorf("/healthz = %d %v, want the events loop stale", code, body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		script string
+		code   int
+		status string
+	}{
+		{"reachable", `echo "a.txt"`, http.StatusOK, "ready"},
+		{"denied", `echo "AccessDenied: Access Denied" >&2; exit 1`, http.StatusServiceUnavailable, "not ready"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, calls := fakeRclone(t, tt.script)
+			config, err := loadTestConfig(t, map[string]string{"RCLONE_PATH": path, "READY_CHECK_TTL": "1h"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := newHealth([]*Config{config}, func() bool { return false })
+			for i := 0; i < 2; i++ {
+				if code, body := probe(t, h.handleReadyz, "/readyz"); code != tt.code || body["status"] != tt.status {
+					t.Errorf("/readyz = %d %v, want %d %s", code, body, tt.code, tt.status)
+				}
+			}
+			// The second probe reuses the result of the first within
+			// READY_CHECK_TTL, which listed the source and, if that
+			// worked, the destination.
+			want := 2
+			if tt.code != http.StatusOK {
+				want = 1
+			}
+			if runs := readCalls(t, calls); len(runs) != want {
+				t.Errorf("rclone ran %q, want %d checks", runs, want)
+			}
+		})
+	}
+}
+
+func TestReadyzDraining(t *testing.T) {
+	path, calls := fakeRclone(t, `echo "a.txt"`)
+	config, err := loadTestConfig(t, map[string]string{"RCLONE_PATH": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHealth([]*Config{config}, func() bool { return true })
+	if code, body := probe(t, h.handleReadyz, "/readyz"); code != http.StatusServiceUnavailable || body["status"] != "shutting down" {
+		t.Errorf("/readyz = %d %v, want shutting down", code, body)
+	}
+	if runs := readCalls(t, calls); len(runs) != 0 {
+		t.Errorf("a draining server checked the remotes: %q", runs)
+	}
+}
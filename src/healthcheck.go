@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// healthcheckClient has a short timeout, so that an unreachable ping server
+// can't hold up a run for long.
+var healthcheckClient = &http.Client{Timeout: 5 * time.Second}
+
+func validateHealthcheck(config *Config) error {
+	if config.HealthcheckURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(config.HealthcheckURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+		return fmt.Errorf("invalid HEALTHCHECK_URL: must be an http:// or https:// ping URL without a query, like https://hc-ping.com/<uuid>")
+	}
+	return nil
+}
+
+// healthcheck pings HEALTHCHECK_URL for one run, following the protocol of
+// Healthchecks.io: /start when the run begins, the URL itself on success and
+// /fail on failure. The pings carry the same rid, so that the server can
+// match the end of a run to its start and measure its duration.
+type healthcheck struct {
+	url    string
+	rid    string
+	logger *logrus.Logger
+}
+
+// startHealthcheck sends the /start ping of a run. It returns nil if
+// HEALTHCHECK_URL is not set.
+func startHealthcheck(config *Config, logger *logrus.Logger) *healthcheck {
+	if config.HealthcheckURL == "" {
+		return nil
+	}
+	h := &healthcheck{url: strings.TrimSuffix(config.HealthcheckURL, "/"), rid: newUUID(), logger: logger}
+	h.ping("/start", nil)
+	return h
+}
+
+// finish sends the success ping, or the /fail ping with the run summary as
+// its body, for interrupted runs too. It does nothing on a nil healthcheck.
+func (h *healthcheck) finish(report *runSummary) {
+	if h == nil {
+		return
+	}
+	if report.Result == "success" {
+		h.ping("", nil)
+		return
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		h.logger.WithError(err).Warn("Failed to encode the run summary for the healthcheck")
+	}
+	h.ping("/fail", body)
+}
+
+// ping is retried like the notifications. A ping that still fails is logged
+// as a warning and doesn't change the outcome of the run.
+func (h *healthcheck) ping(suffix string, body []byte) {
+	target := h.url + suffix + "?rid=" + h.rid
+	if err := deliver(healthcheckClient, http.MethodPost, target, body, nil); err != nil {
+		name := strings.TrimPrefix(suffix, "/")
+		if name == "" {
+			name = "success"
+		}
+		h.logger.WithError(err).WithField("ping", name).Warn("Failed to ping HEALTHCHECK_URL")
+	}
+}
+
+// newUUID returns a random (version 4) UUID, the form Healthchecks.io
+// accepts as a run ID.
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		t := time.Now().UnixNano()
+		for i := range b {
+			b[i] = byte(t >> (8 * (i % 8)))
+		}
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
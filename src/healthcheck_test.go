@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+)
+
+func TestValidateHealthcheck(t *testing.T) {
+	for value, want := range map[string]string{
+		"https://hc-ping.com/0b7f3c52-1e0a-4a4e-9a8e-3c5d8f1a2b3c": "",
+		"http://healthchecks.internal/ping/abc/":                   "",
+		"hc-ping.com/abc":                                          "invalid HEALTHCHECK_URL",
+		"https://hc-ping.com/abc?rid=1":                            "must be an http:// or https:// ping URL without a query",
+	} {
+		_, err := loadTestConfig(t, map[string]string{"HEALTHCHECK_URL": value})
+		wantError(t, err, want)
+	}
+}
+
+func TestNewUUID(t *testing.T) {
+	format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		id := newUUID()
+		if !format.MatchString(id) || seen[id] {
+			t.Fatalf("newUUID = %q, want a new version 4 UUID", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestHealthcheckPings(t *testing.T) {
+	for _, tt := range []struct {
+		exit string
+		// end is the path of the ping that ends the run.
+		end string
+	}{
+		{"0", "/ping/abc"},
+		{"1", "/ping/abc/fail"},
+	} {
+		t.Run(tt.end, func(t *testing.T) {
+			server := newWebhookServer(t)
+			path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit `+tt.exit)
+			setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "HEALTHCHECK_URL": server.URL + "/ping/abc/"}))
+			captureOutput(t, func() { run(nil) })
+
+			bodies := server.received()
+			if len(server.requests) != 2 {
+				t.Fatalf("got %d pings, want the start and the end", len(server.requests))
+			}
+			start, end := server.requests[0], server.requests[1]
+			if start.URL.Path != "/ping/abc/start" || end.URL.Path != tt.end {
+				t.Errorf("pinged %s and %s, want /ping/abc/start and %s", start.URL.Path, end.URL.Path, tt.end)
+			}
+			if rid := start.URL.Query().Get("rid"); rid == "" || end.URL.Query().Get("rid") != rid {
+				t.Errorf("run IDs %q and %q, want the same one", rid, end.URL.Query().Get("rid"))
+			}
+			if tt.exit == "0" {
+				if bodies[1] != "" {
+					t.Errorf("success ping has body %q, want none", bodies[1])
+				}
+				return
+			}
+			// The failure ping carries the run summary.
+			var report runSummary
+			if err := json.Unmarshal([]byte(bodies[1]), &report); err != nil || report.Result != "failure" || report.ExitCode != exitSyncFailed {
+				t.Errorf("failure ping body %q, want the summary of the failed run", bodies[1])
+			}
+		})
+	}
+}
+
+func TestHealthcheckPingFails(t *testing.T) {
+	server := newWebhookServer(t, 404, 404)
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "HEALTHCHECK_URL": server.URL + "/ping/abc"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Errorf("run = %d, want failed pings not to fail it", result.code)
+	}
+	var warnings []interface{}
+	for _, entry := range logEntries(t, out) {
+		if entry["msg"] == "Failed to ping HEALTHCHECK_URL" {
+			warnings = append(warnings, entry["ping"])
+		}
+	}
+	if len(warnings) != 2 || warnings[0] != "start" || warnings[1] != "success" {
+		t.Errorf("failed pings logged for %v, want start and success", warnings)
+	}
+}
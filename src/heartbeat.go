@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// heartbeatWarnEvery throttles the warnings about failed heartbeat writes:
+// after the first, failures are only counted until this much time passed.
+const heartbeatWarnEvery = 10 * time.Minute
+
+func validateHeartbeat(config *Config) error {
+	if config.HeartbeatKey == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(config.HeartbeatInterval); err != nil || d < time.Second {
+		return fmt.Errorf("invalid HEARTBEAT_INTERVAL %q: must be a duration of at least 1s", config.HeartbeatInterval)
+	}
+	if config.SQSQueueURL != "" {
+		return fmt.Errorf("HEARTBEAT_KEY is not available with SQS_QUEUE_URL")
+	}
+	// Inside the synced path, the heartbeat would be deleted by the sync it
+	// reports on.
+	if prefixesOverlap(config.HeartbeatKey, config.Dest.Prefix) {
+		return fmt.Errorf("HEARTBEAT_KEY %q is inside the destination %q; use a key outside DEST_PREFIX",
+			config.HeartbeatKey, remotePath("dest", config.Dest.Bucket, config.Dest.Prefix))
+	}
+	if config.BackupDir != "" && prefixesOverlap(config.HeartbeatKey, config.BackupDir) {
+		return fmt.Errorf("HEARTBEAT_KEY %q is inside BACKUP_DIR %q", config.HeartbeatKey, config.BackupDir)
+	}
+	return nil
+}
+
+// heartbeatObject is the content of the heartbeat object.
+type heartbeatObject struct {
+	UpdatedAt time.Time `json:"updated_at"`
+	RunID     string    `json:"run_id"`
+	Job       string    `json:"job,omitempty"`
+	Hostname  string    `json:"hostname"`
+	StartedAt time.Time `json:"started_at"`
+	// State is "running" while rclone runs and "finished" after the final
+	// write, which also sets Result.
+	State  string `json:"state"`
+	Result string `json:"result,omitempty"`
+	// Stats are the counts of rclone's latest stats line, so they lag behind
+	// the transfers by up to a minute.
+	Stats RunStats `json:"stats"`
+}
+
+// heartbeat writes HEARTBEAT_KEY every HEARTBEAT_INTERVAL while the sync
+// runs, so that monitors that can only see the destination bucket can tell
+// whether replication is alive.
+type heartbeat struct {
+	config   *Config
+	remotes  *rcloneRemotes
+	logger   *logrus.Entry
+	path     string
+	interval time.Duration
+
+	mu   sync.Mutex
+	beat heartbeatObject
+	// source is the log of the running rclone, base the counts of the
+	// attempts before it.
+	source      *rcloneLog
+	base        RunStats
+	failures    int
+	lastWarning time.Time
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startHeartbeat writes the first heartbeat and starts the background
+// writes. It returns nil if HEARTBEAT_KEY is not set and for dry runs.
+func startHeartbeat(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) *heartbeat {
+	if config.HeartbeatKey == "" || config.DryRun {
+		return nil
+	}
+	interval, _ := time.ParseDuration(config.HeartbeatInterval)
+	path := remotePath("dest", config.Dest.Bucket, config.HeartbeatKey)
+	hostname, _ := os.Hostname()
+	now := time.Now().UTC()
+	h := &heartbeat{
+		config:   config,
+		remotes:  remotes,
+		logger:   logger.WithField("heartbeat", path),
+		path:     path,
+		interval: interval,
+		beat: heartbeatObject{
+			RunID:     config.runID,
+			Job:       config.JobName,
+			Hostname:  hostname,
+			StartedAt: now,
+			State:     "running",
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	h.write()
+	go h.loop()
+	return h
+}
+
+func (h *heartbeat) loop() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-shutdown.interrupted():
+			return
+		case <-ticker.C:
+		}
+		h.write()
+	}
+}
+
+// track takes the counts from the log of a new rclone run, adding the last
+// counts of the previous one for RUN_RETRIES. It does nothing on a nil
+// heartbeat.
+func (h *heartbeat) track(source *rcloneLog) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.source != nil {
+		stats, _ := h.source.latest()
+		h.base.add(stats)
+	}
+	h.source = source
+}
+
+// finish stops the background writes and writes the final heartbeat with
+// the counts and result of the run. It is safe to call on a nil heartbeat.
+func (h *heartbeat) finish(stats RunStats, err error) {
+	if h == nil {
+		return
+	}
+	h.once.Do(func() {
+		close(h.stop)
+		<-h.done
+		result := "success"
+		var interruptedErr *interruptedError
+		var limitErr *deleteLimitError
+		switch {
+		case errors.As(err, &interruptedErr):
+			result = "interrupted"
+		case errors.As(err, &limitErr):
+			result = "partial"
+		case err != nil:
+			result = "failure"
+		}
+		h.mu.Lock()
+		h.source = nil
+		h.base = stats
+		h.beat.State, h.beat.Result = "finished", result
+		h.mu.Unlock()
+		h.write()
+	})
+}
+
+// write uploads the heartbeat. Failures are logged as warnings, the first
+// one and then at most every heartbeatWarnEvery, and never fail the run.
+func (h *heartbeat) write() {
+	h.mu.Lock()
+	h.beat.UpdatedAt = time.Now().UTC()
+	h.beat.Stats = h.base
+	if h.source != nil {
+		stats, _ := h.source.latest()
+		h.beat.Stats.add(stats)
+		h.beat.Stats.Speed = stats.Speed
+	}
+	data, err := json.Marshal(h.beat)
+	h.mu.Unlock()
+	if err == nil {
+		err = rcat(h.config, h.remotes, h.path, bytes.NewReader(append(data, '\n')))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		if h.failures > 0 {
+			h.logger.WithField("failed_writes", h.failures).Info("Writing the heartbeat works again")
+			h.failures, h.lastWarning = 0, time.Time{}
+		}
+		h.logger.Debug("Wrote the heartbeat")
+		return
+	}
+	h.failures++
+	if time.Since(h.lastWarning) >= heartbeatWarnEvery {
+		h.logger.WithError(err).WithField("failed_writes", h.failures).Warn("Failed to write the heartbeat")
+		h.lastWarning = time.Now()
+	}
+}
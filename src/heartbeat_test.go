@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateHeartbeat(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"HEARTBEAT_KEY": "_heartbeat/media.json", "HEARTBEAT_INTERVAL": "30s"}, ""},
+		{map[string]string{"HEARTBEAT_KEY": "_heartbeat/media.json", "HEARTBEAT_INTERVAL": "500ms"}, `invalid HEARTBEAT_INTERVAL "500ms": must be a duration of at least 1s`},
+		{map[string]string{"HEARTBEAT_KEY": "source-bucket/heartbeat.json"}, `HEARTBEAT_KEY "source-bucket/heartbeat.json" is inside the destination "dest:dest-bucket/source-bucket"`},
+		{map[string]string{"HEARTBEAT_KEY": "_heartbeat.json", "DEST_PREFIX": "/"}, "is inside the destination"},
+		{map[string]string{"HEARTBEAT_KEY": "_backup/heartbeat.json", "BACKUP_DIR": "_backup"}, `HEARTBEAT_KEY "_backup/heartbeat.json" is inside BACKUP_DIR "_backup"`},
+		{map[string]string{"HEARTBEAT_KEY": "_heartbeat.json", "SQS_QUEUE_URL": "https://sqs.eu-west-1.amazonaws.com/1/queue"}, "HEARTBEAT_KEY is not available with SQS_QUEUE_URL"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+// heartbeatRclone syncs for long enough to write a heartbeat in between and
+// appends what rclone rcat gets to beats, one object per line.
+func heartbeatRclone(t *testing.T, rcat string) (path, beats string) {
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+dir=$(dirname "$0")
+case "$1" in
+rcat) `+rcat+` ;;
+sync)
+echo '{"level":"notice","msg":"stats","stats":{"bytes":1024,"transfers":1,"checks":3}}' >&2
+sleep 1.5
+echo '{"level":"notice","msg":"stats","stats":{"bytes":4096,"transfers":4,"checks":3}}' >&2
+;;
+esac
+exit 0`)
+	return path, filepath.Join(filepath.Dir(calls), "beats")
+}
+
+func TestHeartbeat(t *testing.T) {
+	path, beats := heartbeatRclone(t, `cat >> "$dir/beats"`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "HEARTBEAT_KEY": "_heartbeat/media.json", "HEARTBEAT_INTERVAL": "1s"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+	data, err := os.ReadFile(beats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("wrote %d heartbeats, want the first, one while syncing and the final one: %q", len(lines), lines)
+	}
+	var first, running, last heartbeatObject
+	for i, beat := range []*heartbeatObject{&first, &running, &last} {
+		if err := json.Unmarshal([]byte(lines[[]int{0, 1, len(lines) - 1}[i]]), beat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.State != "running" || first.RunID == "" || first.Hostname == "" || first.Stats.Transfers != 0 {
+		t.Errorf("first heartbeat = %+v", first)
+	}
+	if running.State != "running" || running.Stats.Transfers != 1 || running.Stats.Bytes != 1024 {
+		t.Errorf("heartbeat while syncing = %+v, want rclone's first stats", running)
+	}
+	if last.State != "finished" || last.Result != "success" || last.Stats.Transfers != 4 || last.RunID != first.RunID || !last.StartedAt.Equal(first.StartedAt) {
+		t.Errorf("final heartbeat = %+v, want the result and counts of the run", last)
+	}
+}
+
+func TestHeartbeatWriteFails(t *testing.T) {
+	path, _ := heartbeatRclone(t, `echo "ERROR : AccessDenied" >&2; exit 1`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "HEARTBEAT_KEY": "_heartbeat/media.json", "HEARTBEAT_INTERVAL": "1s"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Errorf("run = %d, want failed heartbeats not to fail it:\n%s", result.code, out)
+	}
+	// Only the first failure is logged within heartbeatWarnEvery.
+	if n := strings.Count(out, `"msg":"Failed to write the heartbeat"`); n != 1 {
+		t.Errorf("logged %d failed heartbeat writes, want 1:\n%s", n, out)
+	}
+}
+
+func TestHeartbeatDryRun(t *testing.T) {
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "HEARTBEAT_KEY": "_heartbeat/media.json", "DRY_RUN": "true"}))
+	captureOutput(t, func() { run(nil) })
+	for _, call := range readCalls(t, calls) {
+		if strings.HasPrefix(call, "rcat ") {
+			t.Errorf("dry run wrote a heartbeat: %q", call)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// minimalEnv is the smallest valid configuration: a sync between two
+// buckets with static keys.
+var minimalEnv = map[string]string{
+	"SOURCE_S3_ENDPOINT": "http://source.test:9000",
+	"SOURCE_ACCESS_KEY":  "source-access",
+	"SOURCE_SECRET_KEY":  "source-secret",
+	"SOURCE_BUCKET":      "source-bucket",
+	"DEST_S3_ENDPOINT":   "http://dest.test:9000",
+	"DEST_ACCESS_KEY":    "dest-access",
+	"DEST_SECRET_KEY":    "dest-secret",
+	"DEST_BUCKET":        "dest-bucket",
+}
+
+// setTestEnv unsets every setting of the options table, and the indexed
+// variables of jobs such as SOURCE_BUCKET_1, for the duration of the test and
+// then sets values.
+func setTestEnv(t *testing.T, values map[string]string) {
+	t.Helper()
+	keys := map[string]bool{}
+	for _, opt := range allOptions() {
+		keys[opt.env] = true
+	}
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		// Indexed job settings such as JOB_NAME_2 are cleared too.
+		base := strings.TrimRight(key, "0123456789")
+		if strings.HasPrefix(key, "SOURCE_") || strings.HasPrefix(key, "DEST_") || strings.HasSuffix(base, "_") && keys[strings.TrimSuffix(base, "_")] {
+			keys[key] = true
+		}
+	}
+	for key := range keys {
+		if _, ok := os.LookupEnv(key); ok {
+			// t.Setenv restores the variable when the test ends.
+			t.Setenv(key, "")
+			os.Unsetenv(key)
+		}
+	}
+	for key, value := range values {
+		t.Setenv(key, value)
+	}
+}
+
+// withEnv returns minimalEnv with overrides applied; an empty override
+// removes the setting.
+func withEnv(overrides map[string]string) map[string]string {
+	values := make(map[string]string, len(minimalEnv)+len(overrides))
+	for key, value := range minimalEnv {
+		values[key] = value
+	}
+	for key, value := range overrides {
+		if value == "" {
+			delete(values, key)
+			continue
+		}
+		values[key] = value
+	}
+	return values
+}
+
+// loadTestConfig loads the single job configured by minimalEnv with
+// overrides from the environment.
+func loadTestConfig(t *testing.T, overrides map[string]string) (*Config, error) {
+	t.Helper()
+	setTestEnv(t, withEnv(overrides))
+	configs, err := loadConfigs(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) != 1 {
+		t.Fatalf("loadConfigs returned %d jobs, want 1", len(configs))
+	}
+	return configs[0], nil
+}
+
+// wantError fails the test unless err is set and contains want, or is nil
+// if want is empty.
+func wantError(t *testing.T, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case want != "" && err == nil:
+		t.Fatalf("expected an error containing %q, got none", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Fatalf("expected an error containing %q, got: %v", want, err)
+	}
+}
+
+// fakeRclone writes an rclone stand-in running script with sh. It returns
+// its path, for RCLONE_PATH, and the file its arguments are appended to, one
+// run per line.
+func fakeRclone(t *testing.T, script string) (path, calls string) {
+	t.Helper()
+	dir := t.TempDir()
+	path, calls = filepath.Join(dir, "rclone"), filepath.Join(dir, "calls")
+	content := "#!/bin/sh\necho \"$*\" >> " + calls + "\n" + script + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path, calls
+}
+
+// readCalls returns the runs fakeRclone recorded in calls.
+func readCalls(t *testing.T, calls string) []string {
+	t.Helper()
+	data, err := os.ReadFile(calls)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// captureOutput runs f with stdout and stderr going to a file and returns
+// what was written to them.
+func captureOutput(t *testing.T, f func()) string {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = out, out
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+	f()
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// ptr returns a pointer to v, for optional settings in test tables.
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// argValue returns the value following flag in args, and whether the flag
+// is there.
+func argValue(args []string, flag string) (string, bool) {
+	i := slices.Index(args, flag)
+	if i < 0 || i+1 >= len(args) {
+		return "", false
+	}
+	return args[i+1], true
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// postHookFailureModes are the POST_HOOK_FAILURE values: a failed post-sync
+// hook is logged, or fails the run.
+var postHookFailureModes = []string{"warn", "fail"}
+
+// hookKillGrace is how long a hook has to exit after HOOK_TIMEOUT, once it
+// got SIGINT, before it is killed.
+const hookKillGrace = 5 * time.Second
+
+func validateHooks(config *Config) error {
+	if d, err := time.ParseDuration(config.HookTimeout); err != nil || d <= 0 {
+		return fmt.Errorf("invalid HOOK_TIMEOUT %q: must be a positive duration like 5m", config.HookTimeout)
+	}
+	if !contains(postHookFailureModes, config.PostHookFailure) {
+		return fmt.Errorf("invalid POST_HOOK_FAILURE %q: must be one of %s", config.PostHookFailure, strings.Join(postHookFailureModes, ", "))
+	}
+	return nil
+}
+
+// runPreSyncHook runs PRE_SYNC_HOOK before the sync. If it fails, the sync
+// doesn't run.
+func runPreSyncHook(config *Config, logger *logrus.Logger) error {
+	if len(config.PreSyncHook) == 0 {
+		return nil
+	}
+	if err := runHook(config, "pre_sync", config.PreSyncHook, hookEnv(config, nil, ""), logger); err != nil {
+		return &classError{class: "hook", err: fmt.Errorf("PRE_SYNC_HOOK failed, not syncing: %w", err)}
+	}
+	return nil
+}
+
+// runPostSyncHook runs POST_SYNC_HOOK after a successful sync or
+// POST_FAILURE_HOOK after a failed one, with the summary of the run in a
+// temporary file. Its error is nil unless the hook failed and
+// POST_HOOK_FAILURE=fail. Interrupted runs run no hook.
+func runPostSyncHook(config *Config, report *runSummary, err error, stats RunStats, logger *logrus.Logger) error {
+	name, key, command := "post_sync", "POST_SYNC_HOOK", config.PostSyncHook
+	if err != nil {
+		name, key, command = "post_failure", "POST_FAILURE_HOOK", config.PostFailureHook
+	}
+	if len(command) == 0 || shutdown.err() != nil {
+		return nil
+	}
+	// The summary is final once the hook has run; the hook sees it as if it
+	// succeeded.
+	outcome := *report
+	outcome.finish(err, stats)
+	summaryFile, remove, writeErr := writeHookSummary(&outcome)
+	if writeErr != nil {
+		logger.WithError(writeErr).WithField("hook", name).Warn("Failed to write the run summary for the hook")
+	}
+	defer remove()
+
+	hookErr := runHook(config, name, command, hookEnv(config, &outcome, summaryFile), logger)
+	if hookErr == nil {
+		return nil
+	}
+	if config.PostHookFailure == "fail" && err == nil {
+		return &classError{class: "hook", err: fmt.Errorf("%s failed: %w", key, hookErr)}
+	}
+	logger.WithError(hookErr).WithField("hook", name).Warn(key + " failed")
+	return nil
+}
+
+// hookEnv is the environment of a hook: that of the process, plus the
+// S3_SYNC_ variables describing the run. report is nil before the sync.
+func hookEnv(config *Config, report *runSummary, summaryFile string) []string {
+	env := append(os.Environ(),
+		"S3_SYNC_JOB="+config.JobName,
+		"S3_SYNC_RUN_ID="+config.runID,
+		"S3_SYNC_SOURCE="+remotePath("source", config.Source.Bucket, config.Source.Prefix),
+		"S3_SYNC_DEST="+remotePath("dest", config.Dest.Bucket, config.Dest.Prefix),
+		"S3_SYNC_MODE="+config.SyncMode,
+		"S3_SYNC_DRY_RUN="+strconv.FormatBool(config.DryRun),
+	)
+	if report != nil {
+		env = append(env,
+			"S3_SYNC_RESULT="+report.Result,
+			"S3_SYNC_EXIT_CODE="+strconv.Itoa(report.ExitCode),
+			"S3_SYNC_ERROR_CLASS="+report.ErrorClass,
+			"S3_SYNC_SUMMARY_FILE="+summaryFile,
+		)
+	}
+	return env
+}
+
+func writeHookSummary(report *runSummary) (string, func(), error) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return "", func() {}, err
+	}
+	f, err := os.CreateTemp("", "s3-sync-summary-*.json")
+	if err != nil {
+		return "", func() {}, err
+	}
+	remove := removeOnExit(f.Name())
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", func() {}, err
+	}
+	return f.Name(), remove, nil
+}
+
+// runHook runs command, without a shell, logging each line it prints with
+// the hook name. It gets SIGINT after HOOK_TIMEOUT and is killed
+// hookKillGrace later; a shutdown stops it like rclone.
+func runHook(config *Config, name string, command, env []string, logger *logrus.Logger) error {
+	timeout, _ := time.ParseDuration(config.HookTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stdout := &hookOutput{entry: logger.WithFields(logrus.Fields{"hook": name, "stream": "stdout"})}
+	stderr := &hookOutput{entry: logger.WithFields(logrus.Fields{"hook": name, "stream": "stderr"})}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = env
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	logger.WithFields(logrus.Fields{"hook": name, "command": command}).Info("Running hook")
+	start := time.Now()
+	err := shutdown.runContext(ctx, cmd, hookKillGrace)
+	stdout.flush()
+	stderr.flush()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after HOOK_TIMEOUT=%s: %w", config.HookTimeout, err)
+	}
+	if err != nil {
+		return err
+	}
+	logger.WithFields(logrus.Fields{"hook": name, "duration": time.Since(start).Round(time.Millisecond).String()}).Info("Hook succeeded")
+	return nil
+}
+
+// hookOutput logs the output of a hook line by line.
+type hookOutput struct {
+	entry   *logrus.Entry
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (o *hookOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	data := append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		o.log(data[:i])
+		data = data[i+1:]
+	}
+	o.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+func (o *hookOutput) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.partial) > 0 {
+		o.log(o.partial)
+		o.partial = nil
+	}
+}
+
+func (o *hookOutput) log(line []byte) {
+	if text := strings.TrimRight(string(line), "\r"); strings.TrimSpace(text) != "" {
+		o.entry.Info(text)
+	}
+}
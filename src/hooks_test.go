@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateHooks(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"PRE_SYNC_HOOK": "/hooks/snapshot.sh --all", "HOOK_TIMEOUT": "1m", "POST_HOOK_FAILURE": "FAIL"}, ""},
+		{map[string]string{"HOOK_TIMEOUT": "0s"}, `invalid HOOK_TIMEOUT "0s": must be a positive duration like 5m`},
+		{map[string]string{"POST_HOOK_FAILURE": "ignore"}, `invalid POST_HOOK_FAILURE "ignore": must be one of warn, fail`},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+// writeHook writes a shell script for a hook and returns its path.
+func writeHook(t *testing.T, script string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// runWithHooks runs a sync with rclone exiting with exit and the hooks in
+// env, and returns the exit code, the output and the rclone runs.
+func runWithHooks(t *testing.T, exit string, env map[string]string) (int, string, []string) {
+	t.Helper()
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit `+exit)
+	env["RCLONE_PATH"] = path
+	setTestEnv(t, withEnv(env))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	return result.code, out, readCalls(t, calls)
+}
+
+func synced(calls []string) bool {
+	for _, call := range calls {
+		if strings.HasPrefix(call, "sync ") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPreSyncHook(t *testing.T) {
+	hook := writeHook(t, `echo "snapshot of $S3_SYNC_SOURCE"; echo "for $1" >&2`)
+	code, out, calls := runWithHooks(t, "0", map[string]string{"PRE_SYNC_HOOK": hook + " 'nightly run'"})
+	if code != 0 || !synced(calls) {
+		t.Fatalf("run = %d, synced %v; want the sync after the hook:\n%s", code, synced(calls), out)
+	}
+	entries := logEntries(t, out)
+	if entry := findEntry(entries, "snapshot of source:source-bucket"); entry == nil || entry["hook"] != "pre_sync" || entry["stream"] != "stdout" {
+		t.Errorf("hook output logged as %v", entry)
+	}
+	if entry := findEntry(entries, "for nightly run"); entry == nil || entry["stream"] != "stderr" {
+		t.Errorf("hook stderr logged as %v, want the quoted argument", entry)
+	}
+}
+
+func TestPreSyncHookFails(t *testing.T) {
+	code, out, calls := runWithHooks(t, "0", map[string]string{"PRE_SYNC_HOOK": writeHook(t, "exit 3")})
+	if code != 1 || synced(calls) {
+		t.Errorf("run = %d, synced %v; want 1 and no sync", code, synced(calls))
+	}
+	entry := findEntry(logEntries(t, out), "S3 sync job failed")
+	if entry == nil || entry["error_class"] != "hook" || !strings.HasPrefix(entry["error"].(string), "PRE_SYNC_HOOK failed, not syncing: exit status 3") {
+		t.Errorf("failure logged as %v, want a hook error", entry)
+	}
+}
+
+func TestPostSyncHook(t *testing.T) {
+	dir := t.TempDir()
+	hook := writeHook(t, `env | grep ^S3_SYNC_ | sort > `+dir+`/env
+cp "$S3_SYNC_SUMMARY_FILE" `+dir+`/summary.json`)
+	failureHook := writeHook(t, "touch "+dir+"/failure")
+	code, out, _ := runWithHooks(t, "0", map[string]string{"POST_SYNC_HOOK": hook, "POST_FAILURE_HOOK": failureHook, "JOB_NAME": "media"})
+	if code != 0 {
+		t.Fatalf("run = %d:\n%s", code, out)
+	}
+	env, err := os.ReadFile(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"S3_SYNC_JOB=media", "S3_SYNC_SOURCE=source:source-bucket", "S3_SYNC_DEST=dest:dest-bucket/source-bucket",
+		"S3_SYNC_MODE=sync", "S3_SYNC_DRY_RUN=false", "S3_SYNC_RESULT=success", "S3_SYNC_EXIT_CODE=0", "S3_SYNC_ERROR_CLASS=\n",
+	} {
+		if !strings.Contains(string(env)+"\n", want) {
+			t.Errorf("hook environment lacks %q:\n%s", want, env)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "summary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary runSummary
+	if err := json.Unmarshal(data, &summary); err != nil || summary.Result != "success" || summary.FinishedAt.IsZero() {
+		t.Errorf("S3_SYNC_SUMMARY_FILE = %s, want the final summary", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failure")); err == nil {
+		t.Error("POST_FAILURE_HOOK ran after a successful sync")
+	}
+}
+
+func TestPostFailureHook(t *testing.T) {
+	dir := t.TempDir()
+	hook := writeHook(t, `echo "$S3_SYNC_RESULT $S3_SYNC_EXIT_CODE $S3_SYNC_ERROR_CLASS" > `+dir+`/outcome; exit 1`)
+	code, out, _ := runWithHooks(t, "1", map[string]string{"POST_FAILURE_HOOK": hook, "POST_HOOK_FAILURE": "fail"})
+	// A failing POST_FAILURE_HOOK is only logged.
+	if code != exitSyncFailed {
+		t.Errorf("run = %d, want %d for the failed sync", code, exitSyncFailed)
+	}
+	if outcome, _ := os.ReadFile(filepath.Join(dir, "outcome")); string(outcome) != "failure 4 sync\n" {
+		t.Errorf("hook saw %q, want the failed run", outcome)
+	}
+	if entry := findEntry(logEntries(t, out), "POST_FAILURE_HOOK failed"); entry == nil || entry["level"] != "warning" {
+		t.Errorf("hook failure logged as %v, want a warning", entry)
+	}
+}
+
+func TestPostHookFailure(t *testing.T) {
+	hook := writeHook(t, "exit 2")
+	code, out, _ := runWithHooks(t, "0", map[string]string{"POST_SYNC_HOOK": hook})
+	if code != 0 || findEntry(logEntries(t, out), "POST_SYNC_HOOK failed") == nil {
+		t.Errorf("run = %d, want 0 and a warning with POST_HOOK_FAILURE=warn:\n%s", code, out)
+	}
+
+	code, out, _ = runWithHooks(t, "0", map[string]string{"POST_SYNC_HOOK": hook, "POST_HOOK_FAILURE": "fail"})
+	if entry := findEntry(logEntries(t, out), "S3 sync job failed"); code != 1 || entry == nil || entry["error_class"] != "hook" {
+		t.Errorf("run = %d, failure logged as %v; want 1 and error class hook", code, entry)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	start := time.Now()
+	code, out, calls := runWithHooks(t, "0", map[string]string{"PRE_SYNC_HOOK": writeHook(t, "trap 'exit 1' INT; sleep 10"), "HOOK_TIMEOUT": "200ms"})
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run took %v, want the hook stopped after HOOK_TIMEOUT", elapsed)
+	}
+	if code != 1 || synced(calls) || !strings.Contains(out, "timed out after HOOK_TIMEOUT=200ms") {
+		t.Errorf("run = %d, synced %v; want the timed out hook to stop the run:\n%s", code, synced(calls), out)
+	}
+}
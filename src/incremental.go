@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func validateIncremental(config *Config) error {
+	if !config.Incremental {
+		return nil
+	}
+	if stateLocation(config) == "" {
+		return fmt.Errorf("INCREMENTAL needs the last successful run; set STATE_FILE or REPORT_PREFIX")
+	}
+	switch {
+	case config.SyncMode == "move":
+		return fmt.Errorf("INCREMENTAL is not available with SYNC_MODE=move")
+	case config.MaxAge != "":
+		return fmt.Errorf("INCREMENTAL sets the maximum age itself and cannot be combined with MAX_AGE")
+	case config.FilesFrom != "":
+		return fmt.Errorf("INCREMENTAL cannot be combined with FILES_FROM")
+	}
+	if d, err := time.ParseDuration(config.IncrementalMargin); err != nil || d < 0 {
+		return fmt.Errorf("invalid INCREMENTAL_MARGIN %q: must be a duration like 15m", config.IncrementalMargin)
+	}
+	if _, _, err := parseFullSyncEvery(config.FullSyncEvery); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseFullSyncEvery parses FULL_SYNC_EVERY, either a duration such as 24h
+// or a number of runs: 10 makes every tenth run a full sync.
+func parseFullSyncEvery(value string) (time.Duration, int, error) {
+	if runs, err := strconv.Atoi(value); err == nil {
+		if runs < 1 {
+			return 0, 0, fmt.Errorf("FULL_SYNC_EVERY must be at least 1 run, got %d", runs)
+		}
+		return 0, runs, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, 0, fmt.Errorf("invalid FULL_SYNC_EVERY %q: must be a duration like 24h or a number of runs", value)
+	}
+	return d, 0, nil
+}
+
+// planIncremental decides whether this run of an INCREMENTAL job only
+// copies the objects modified since the last success, less
+// INCREMENTAL_MARGIN for clock skew, or is a full sync. Incremental runs
+// never delete, so a full sync runs without a previous full success and
+// once FULL_SYNC_EVERY has passed, to catch deletions and objects whose
+// modification time doesn't reflect their upload.
+func planIncremental(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) {
+	config.incrementalWindow = 0
+	if !config.Incremental {
+		return
+	}
+	state, err := loadState(config, remotes)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to load the run state, running a full sync")
+		return
+	}
+
+	every, runs, _ := parseFullSyncEvery(config.FullSyncEvery)
+	var reason string
+	switch {
+	case state == nil || state.LastSuccess == nil || state.LastFullSuccess == nil:
+		reason = "no full sync has succeeded yet"
+	case every > 0 && time.Since(*state.LastFullSuccess) >= every:
+		reason = "FULL_SYNC_EVERY has passed since the last full sync"
+	case runs > 0 && state.IncrementalRuns+1 >= runs:
+		reason = fmt.Sprintf("FULL_SYNC_EVERY=%d runs reached", runs)
+	}
+	if reason != "" {
+		logger.WithField("reason", reason).Info("Running a full sync")
+		return
+	}
+
+	margin, _ := time.ParseDuration(config.IncrementalMargin)
+	config.incrementalWindow = time.Since(*state.LastSuccess) + margin
+	logger.WithFields(logrus.Fields{
+		"last_success": state.LastSuccess.Format(time.RFC3339),
+		"max_age":      config.incrementalWindow.Round(time.Second).String(),
+	}).Info("Running an incremental sync of the objects modified since the last success")
+}
+
+// incrementalArgs restricts an incremental run to recently modified
+// objects. Without --no-traverse rclone would still list the whole
+// destination.
+func incrementalArgs(config *Config) []string {
+	if config.incrementalWindow == 0 {
+		return nil
+	}
+	seconds := int64(config.incrementalWindow.Seconds()) + 1
+	return []string{"--max-age", strconv.FormatInt(seconds, 10) + "s", "--no-traverse"}
+}
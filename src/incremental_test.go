@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateIncremental(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state.json")
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"INCREMENTAL": "true"}, "INCREMENTAL needs the last successful run; set STATE_FILE or REPORT_PREFIX"},
+		{map[string]string{"INCREMENTAL": "true", "STATE_FILE": state, "MAX_AGE": "24h"}, "INCREMENTAL sets the maximum age itself"},
+		{map[string]string{"INCREMENTAL": "true", "STATE_FILE": state, "INCREMENTAL_MARGIN": "-5m"}, `invalid INCREMENTAL_MARGIN "-5m"`},
+		{map[string]string{"INCREMENTAL": "true", "STATE_FILE": state, "FULL_SYNC_EVERY": "0"}, "FULL_SYNC_EVERY must be at least 1 run, got 0"},
+		{map[string]string{"INCREMENTAL": "true", "STATE_FILE": state, "FULL_SYNC_EVERY": "daily"}, `invalid FULL_SYNC_EVERY "daily"`},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestParseFullSyncEvery(t *testing.T) {
+	if d, runs, err := parseFullSyncEvery("24h"); err != nil || d != 24*time.Hour || runs != 0 {
+		t.Errorf("parseFullSyncEvery(24h) = %v, %d, %v", d, runs, err)
+	}
+	if d, runs, err := parseFullSyncEvery("10"); err != nil || d != 0 || runs != 10 {
+		t.Errorf("parseFullSyncEvery(10) = %v, %d, %v", d, runs, err)
+	}
+}
+
+// writeState writes a state with the given last success, last full success
+// and incremental run count to path.
+func writeState(t *testing.T, path string, success, fullSuccess time.Time, runs int) {
+	t.Helper()
+	data, err := json.Marshal(runState{LastRun: success, LastResult: "success", LastSuccess: &success, LastFullSuccess: &fullSuccess, IncrementalRuns: runs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncrementalRun(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name        string
+		state       func(path string)
+		every       string
+		incremental bool
+		runs        int
+	}{
+		{"no state", func(string) {}, "24h", false, 0},
+		{"recent full sync", func(path string) { writeState(t, path, now.Add(-time.Hour), now.Add(-2*time.Hour), 3) }, "24h", true, 4},
+		{"full sync due", func(path string) { writeState(t, path, now.Add(-time.Hour), now.Add(-25*time.Hour), 3) }, "24h", false, 0},
+		{"run count reached", func(path string) { writeState(t, path, now.Add(-time.Hour), now.Add(-2*time.Hour), 4) }, "5", false, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+			state := filepath.Join(t.TempDir(), "state.json")
+			tt.state(state)
+			setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "INCREMENTAL": "true", "STATE_FILE": state, "FULL_SYNC_EVERY": tt.every, "INCREMENTAL_MARGIN": "15m"}))
+			var result runResult
+			out := captureOutput(t, func() { result, _ = run(nil) })
+			if result.code != 0 {
+				t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+			}
+			runs := readCalls(t, calls)
+			args := strings.Fields(runs[len(runs)-1])
+			maxAge, _ := argValue(args, "--max-age")
+			if !tt.incremental {
+				if args[0] != "sync" || maxAge != "" {
+					t.Errorf("full sync ran %q", args)
+				}
+			} else {
+				// An hour since the last success plus the margin.
+				seconds, _ := strconv.Atoi(strings.TrimSuffix(maxAge, "s"))
+				if args[0] != "copy" || seconds < 4500 || seconds > 4510 || !strings.Contains(runs[len(runs)-1], "--no-traverse") {
+					t.Errorf("incremental sync ran %q, want a copy of the last 75 minutes", args)
+				}
+			}
+
+			saved := readStateFile(t, state)
+			if saved.IncrementalRuns != tt.runs {
+				t.Errorf("state counts %d incremental runs, want %d", saved.IncrementalRuns, tt.runs)
+			}
+			if !tt.incremental && (saved.LastFullSuccess == nil || time.Since(*saved.LastFullSuccess) > time.Minute) {
+				t.Errorf("full sync not recorded: %+v", saved)
+			}
+			summaries := readSummaries(t, out)
+			if len(summaries) != 1 || summaries[0].Incremental != tt.incremental {
+				t.Errorf("summary = %v, want incremental %v", summaries, tt.incremental)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func validateJitter(config *Config) error {
+	for _, d := range []struct {
+		key   string
+		value string
+	}{{"STARTUP_JITTER", config.StartupJitter}, {"SCHEDULE_SPLAY", config.ScheduleSplay}} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v < 0 {
+			return fmt.Errorf("invalid %s %q: must be a duration like 30s or 5m", d.key, d.value)
+		}
+	}
+	if config.ScheduleSplay == "" {
+		return nil
+	}
+	if config.Schedule == "" {
+		return fmt.Errorf("SCHEDULE_SPLAY requires SCHEDULE")
+	}
+	// A splay as long as the interval would let runs overlap every tick.
+	sched, err := parseSchedule(config.Schedule)
+	if interval, ok := sched.(intervalSchedule); err == nil && ok && parseOptionalDuration(config.ScheduleSplay) >= time.Duration(interval) {
+		return fmt.Errorf("SCHEDULE_SPLAY %s must be shorter than the SCHEDULE interval %s", config.ScheduleSplay, config.Schedule)
+	}
+	return nil
+}
+
+// parseOptionalDuration parses an already validated duration setting, which
+// is zero when unset.
+func parseOptionalDuration(value string) time.Duration {
+	d, _ := time.ParseDuration(value)
+	return d
+}
+
+// newJitterSource returns a random source seeded from the host name and the
+// start time, so containers started at the same moment still differ.
+func newJitterSource() *rand.Rand {
+	h := fnv.New64a()
+	hostname, _ := os.Hostname()
+	h.Write([]byte(hostname))
+	return rand.New(rand.NewSource(int64(h.Sum64()) ^ time.Now().UnixNano() ^ int64(os.Getpid())))
+}
+
+// jitter returns a random duration in [0, max), or 0 if max is not positive.
+func jitter(rng *rand.Rand, max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rng.Int63n(int64(max)))
+}
+
+// startupJitter waits for a random part of STARTUP_JITTER. A SIGINT or
+// SIGTERM ends the wait, and interrupted reports that the process should
+// exit with code instead of syncing.
+func startupJitter(config *Config) (code int, interrupted bool) {
+	delay := jitter(newJitterSource(), parseOptionalDuration(config.StartupJitter))
+	if delay == 0 {
+		return 0, false
+	}
+	logger := setupLogger(config)
+	logger.WithFields(logrus.Fields{
+		"delay":    delay.Round(time.Second).String(),
+		"start_at": time.Now().Add(delay).Format(time.RFC3339),
+	}).Info("Delaying start by STARTUP_JITTER")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return 0, false
+	case sig := <-signals:
+		logger.WithField("signal", sig.String()).Info("Interrupted during the startup delay, exiting")
+		return exitInterrupted, true
+	}
+}
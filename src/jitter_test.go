@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestJitterValidation(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		err  string
+	}{
+		{name: "startup jitter", env: map[string]string{"STARTUP_JITTER": "5m"}},
+		{name: "splay", env: map[string]string{"SCHEDULE": "1h", "SCHEDULE_SPLAY": "10m"}},
+		{name: "splay with cron", env: map[string]string{"SCHEDULE": "0 2 * * *", "SCHEDULE_SPLAY": "30m"}},
+		{name: "bad duration", env: map[string]string{"STARTUP_JITTER": "5 minutes"}, err: `invalid STARTUP_JITTER "5 minutes": must be a duration like 30s or 5m`},
+		{name: "negative", env: map[string]string{"STARTUP_JITTER": "-1m"}, err: "invalid STARTUP_JITTER"},
+		{name: "splay without schedule", env: map[string]string{"SCHEDULE_SPLAY": "10m"}, err: "SCHEDULE_SPLAY requires SCHEDULE"},
+		{name: "splay as long as the interval", env: map[string]string{"SCHEDULE": "30m", "SCHEDULE_SPLAY": "30m"}, err: "SCHEDULE_SPLAY 30m must be shorter than the SCHEDULE interval 30m"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTestConfig(t, tt.env)
+			wantError(t, err, tt.err)
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	if d := jitter(rng, 0); d != 0 {
+		t.Errorf("jitter without a maximum = %v, want 0", d)
+	}
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		d := jitter(rng, time.Minute)
+		if d < 0 || d >= time.Minute {
+			t.Fatalf("jitter = %v, want it in [0, 1m)", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 90 {
+		t.Errorf("jitter returned only %d different delays in 100 draws", len(seen))
+	}
+}
+
+func TestStartupJitter(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"STARTUP_JITTER": "50ms", "LOG_LEVEL": "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if code, interrupted := startupJitter(config); interrupted || code != 0 {
+		t.Errorf("startupJitter = %d, %v; want the run to go ahead", code, interrupted)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("startupJitter waited %v for a jitter of 50ms", waited)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// jobSpec is one entry of SYNC_JOBS. Overrides are keyed by variable name,
+// like the keys of CONFIG_FILE.
+type jobSpec struct {
+	Name         string                 `json:"name"`
+	SourceBucket string                 `json:"sourceBucket"`
+	SourcePrefix string                 `json:"sourcePrefix"`
+	DestBucket   string                 `json:"destBucket"`
+	DestPrefix   *string                `json:"destPrefix"`
+	Overrides    map[string]interface{} `json:"overrides"`
+}
+
+// indexedVariable matches job settings such as SOURCE_BUCKET_2.
+var indexedVariable = regexp.MustCompile(`^([A-Z0-9_]+?)_([0-9]+)$`)
+
+// loadJobs returns the settings of each job defined by SYNC_JOBS, by
+// indexed environment variables or by several destinations, keyed by
+// variable name. Settings a job
+// doesn't define fall back to the shared ones. It returns nil when no jobs
+// are defined, i.e. for a single sync.
+func loadJobs(src *configSource) ([]map[string]string, error) {
+	raw := src.getOrDefault("SYNC_JOBS", "")
+	indexed, err := indexedJobs(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	destinations, err := loadDestinations(src)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case raw != "" && len(indexed) > 0:
+		return nil, fmt.Errorf("SYNC_JOBS and indexed variables such as SOURCE_BUCKET_1 are both set; use only one")
+	case len(destinations) > 0 && (raw != "" || len(indexed) > 0):
+		return nil, fmt.Errorf("several destinations can't be combined with SYNC_JOBS or indexed jobs")
+	case len(destinations) > 0:
+		return destinations, nil
+	case raw != "":
+		return parseSyncJobs(raw)
+	}
+	return indexed, nil
+}
+
+// parseSyncJobs parses the SYNC_JOBS JSON array.
+func parseSyncJobs(raw string) ([]map[string]string, error) {
+	var specs []jobSpec
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&specs); err != nil {
+		return nil, fmt.Errorf("invalid SYNC_JOBS: %w", err)
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("SYNC_JOBS contains no jobs")
+	}
+
+	known := jobKeys()
+	jobs := make([]map[string]string, 0, len(specs))
+	for i, spec := range specs {
+		job := make(map[string]string)
+		for key, value := range spec.Overrides {
+			env, ok := known[strings.ToUpper(key)]
+			if !ok {
+				return nil, fmt.Errorf("SYNC_JOBS entry %d: unknown override %s", i+1, key)
+			}
+			str, err := scalarString(value)
+			if err != nil {
+				return nil, fmt.Errorf("SYNC_JOBS entry %d: override %s: %w", i+1, key, err)
+			}
+			job[env] = str
+		}
+		for key, value := range map[string]string{
+			"JOB_NAME":      spec.Name,
+			"SOURCE_BUCKET": spec.SourceBucket,
+			"SOURCE_PREFIX": spec.SourcePrefix,
+			"DEST_BUCKET":   spec.DestBucket,
+		} {
+			if value != "" {
+				job[key] = value
+			}
+		}
+		// An empty destPrefix syncs into the bucket root.
+		if spec.DestPrefix != nil {
+			job["DEST_PREFIX"] = *spec.DestPrefix
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// indexedJobs collects jobs from variables such as SOURCE_BUCKET_1 and
+// DEST_PREFIX_1, numbered from 1 without gaps. Any setting can be given per
+// job this way.
+func indexedJobs(environ []string) ([]map[string]string, error) {
+	known := jobKeys()
+	byIndex := make(map[int]map[string]string)
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		m := indexedVariable.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		env, ok := known[m[1]]
+		if !ok {
+			continue
+		}
+		index, err := strconv.Atoi(m[2])
+		if err != nil || index < 1 {
+			return nil, fmt.Errorf("%s: jobs are numbered from 1", name)
+		}
+		if byIndex[index] == nil {
+			byIndex[index] = make(map[string]string)
+		}
+		byIndex[index][env] = value
+	}
+
+	indices := make([]int, 0, len(byIndex))
+	for index := range byIndex {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+
+	jobs := make([]map[string]string, 0, len(indices))
+	for i, index := range indices {
+		if index != i+1 {
+			return nil, fmt.Errorf("indexed job %d is defined but job %d is not; number jobs from 1 without gaps", index, i+1)
+		}
+		if byIndex[index]["SOURCE_BUCKET"] == "" {
+			return nil, fmt.Errorf("SOURCE_BUCKET_%d is not set, but other settings of job %d are", index, index)
+		}
+		jobs = append(jobs, byIndex[index])
+	}
+	return jobs, nil
+}
+
+// jobKeys returns the settings that can differ between jobs, keyed by their
+// upper-cased name. Settings that select the jobs themselves are global.
+func jobKeys() map[string]string {
+	keys := make(map[string]string, len(options))
+	for _, opt := range allOptions() {
+		switch opt.env {
+		case "CONFIG_FILE", "SYNC_JOBS", "DESTINATIONS", "JOB_CONCURRENCY", "SPLIT_BWLIMIT", "CONTINUE_ON_ERROR",
+			"SOURCE_BUCKET_PATTERN", "EXCLUDE_BUCKETS", "SHARD_BY_PREFIX", "SHARD_PREFIXES", "SCHEDULE", "SHUTDOWN_GRACE", "STARTUP_JITTER", "SCHEDULE_SPLAY",
+			"SQS_QUEUE_URL", "SQS_REGION", "SQS_ACCESS_KEY", "SQS_SECRET_KEY", "SQS_BATCH_WINDOW", "SQS_VISIBILITY_TIMEOUT",
+			"HTTP_ADDR", "HTTP_TOKEN", "ALLOW_QUEUE", "READY_CHECK_TTL", "DEBUG_ADDR", "RCLONE_RC_ADDR",
+			"PUSHGATEWAY_URL", "PUSHGATEWAY_JOB", "STATSD_ADDR", "STATSD_PREFIX", "STATSD_TAGS", "STATSD_PROGRESS", "SUMMARY_FILE", "JOBS_TIMEOUT", "NOTIFY_TEST", "LOG_FORMAT", "LOG_TIMESTAMP_FORMAT",
+			"LOG_FILE", "RUN_ID",
+			"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_EXPORTER_OTLP_HEADERS", "OTEL_EXPORTER_OTLP_PROTOCOL", "OTEL_SERVICE_NAME", "LOG_FILE_MAX_SIZE", "LOG_FILE_MAX_BACKUPS", "LOG_FILE_MAX_AGE":
+			continue
+		}
+		keys[opt.env] = opt.env
+	}
+	return keys
+}
+
+// jobLabel names the job at index i in error messages, before its
+// configuration is loaded.
+func jobLabel(i int, job map[string]string) string {
+	if name := job["JOB_NAME"]; name != "" {
+		return name
+	}
+	if bucket := job["SOURCE_BUCKET"]; bucket != "" {
+		return fmt.Sprintf("%d (%s)", i+1, bucket)
+	}
+	return strconv.Itoa(i + 1)
+}
+
+// jobPath adds the job name to a file path in multi-job runs, before the
+// extension, so that jobs don't overwrite each other's files: diff.json
+// becomes diff-media.json.
+func jobPath(config *Config, path string) string {
+	if config.JobName == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + config.JobName + ext
+}
+
+// splitBandwidthLimit gives config its share of BANDWIDTH_LIMIT when
+// SPLIT_BWLIMIT is set and up to JOB_CONCURRENCY of the jobs run at the same
+// time. Per-file limits are left alone.
+func splitBandwidthLimit(config *Config, jobs int) {
+	if config.SplitBandwidthLimit && !config.BandwidthLimitPerFile {
+		config.BandwidthLimit = divideBandwidthLimit(config.BandwidthLimit, min(config.JobConcurrency, jobs))
+	}
+}
+
+// validateJobDestinations rejects jobs whose destinations overlap when one
+// of them deletes, as each would delete the other's objects as extraneous.
+func validateJobDestinations(configs []*Config) error {
+	deletes := func(c *Config) bool { return c.SyncMode == "sync" && c.DeleteStrategy != "none" }
+	for i, a := range configs {
+		for _, b := range configs[i+1:] {
+			if a.Dest.Endpoint != b.Dest.Endpoint || a.Dest.Bucket != b.Dest.Bucket || !prefixesOverlap(a.Dest.Prefix, b.Dest.Prefix) {
+				continue
+			}
+			if deletes(a) || deletes(b) {
+				return fmt.Errorf("jobs %s and %s sync into overlapping destinations %s and %s, so each would delete the other's objects; "+
+					"give them separate DEST_PREFIX values", a.JobName, b.JobName,
+					remotePath("dest", a.Dest.Bucket, a.Dest.Prefix), remotePath("dest", b.Dest.Bucket, b.Dest.Prefix))
+			}
+		}
+	}
+	return nil
+}
+
+// jobResult is the outcome of one job of a multi-job run.
+type jobResult struct {
+	name     string
+	source   string
+	dest     string
+	status   string // succeeded, failed, skipped (after a failure) or cancelled
+	duration time.Duration
+	err      error
+}
+
+// jobHook adds the job name to every log line of a job, so the output of
+// concurrent jobs stays attributable.
+type jobHook string
+
+func (h jobHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (h jobHook) Fire(entry *logrus.Entry) error {
+	entry.Data["job"] = string(h)
+	return nil
+}
+
+// runJobs runs the jobs through a pool of JOB_CONCURRENCY workers. After a
+// failure (unless CONTINUE_ON_ERROR is set), or on SIGINT/SIGTERM, no further
+// jobs are started; running ones are left to finish. It logs the result of
+// every job and returns the process exit code: exitSyncFailed if only
+// some jobs succeeded, that of the first failed job if none did, or
+// exitInterrupted if interrupted.
+func runJobs(configs []*Config) int {
+	logger := setupLogger(configs[0])
+	concurrency := min(configs[0].JobConcurrency, len(configs))
+	names := make([]string, 0, len(configs))
+	for _, config := range configs {
+		names = append(names, config.JobName)
+	}
+	logger.WithFields(logrus.Fields{
+		"jobs":            names,
+		"job_concurrency": concurrency,
+	}).Info("Running sync jobs")
+
+	var (
+		mu          sync.Mutex
+		failed      error
+		interrupted os.Signal
+	)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			mu.Lock()
+			interrupted = sig
+			mu.Unlock()
+			logger.WithField("signal", sig.String()).Warn("Interrupted, not starting the remaining jobs; waiting for running jobs")
+		}
+	}()
+
+	start := time.Now()
+	if d := parseOptionalDuration(configs[0].JobsTimeout); d > 0 {
+		for _, config := range configs {
+			config.jobsDeadline = start.Add(d)
+		}
+	}
+	root := startTrace(configs[0], "sync", logger)
+	root.set("jobs", len(configs))
+	for _, config := range configs {
+		config.traceParent = root
+	}
+	results := make([]jobResult, len(configs))
+	pending := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				config := configs[i]
+				result := jobResult{
+					name:   config.JobName,
+					source: remotePath("source", config.Source.Bucket, config.Source.Prefix),
+					dest:   remotePath("dest", config.Dest.Bucket, config.Dest.Prefix),
+				}
+
+				mu.Lock()
+				switch {
+				case interrupted != nil:
+					result.status = "cancelled"
+				case failed != nil && !config.ContinueOnError:
+					result.status = "skipped"
+				}
+				mu.Unlock()
+				if result.status != "" {
+					results[i] = result
+					continue
+				}
+
+				jobLogger := setupLogger(config)
+				jobLogger.AddHook(jobHook(config.JobName))
+				jobStart := time.Now()
+				result.err = runJob(config, jobLogger)
+				result.duration = time.Since(jobStart)
+				result.status = "succeeded"
+				if result.err != nil {
+					reportJobError(jobLogger, result.err)
+					result.status = "failed"
+					mu.Lock()
+					if failed == nil {
+						failed = result.err
+					}
+					mu.Unlock()
+				}
+				results[i] = result
+			}
+		}()
+	}
+	for i := range configs {
+		pending <- i
+	}
+	close(pending)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+
+	counts := make(map[string]int)
+	var sequential time.Duration
+	var failures []logrus.Fields
+	for _, result := range results {
+		counts[result.status]++
+		sequential += result.duration
+		entry := logger.WithFields(logrus.Fields{
+			"job":      result.name,
+			"source":   result.source,
+			"dest":     result.dest,
+			"status":   result.status,
+			"duration": result.duration,
+		})
+		if result.err != nil {
+			entry = entry.WithError(result.err).WithField("error_class", errorClass(result.err))
+			failure := logrus.Fields{
+				"job":         result.name,
+				"error_class": errorClass(result.err),
+				"error":       result.err.Error(),
+			}
+			if class := rcloneErrorClass(result.err); class != "" {
+				entry = entry.WithField("rclone_error_class", class)
+				failure["rclone_error_class"] = class
+			}
+			failures = append(failures, failure)
+		}
+		entry.Info("Job result")
+	}
+	if len(failures) > 0 {
+		classes := make(map[string]int)
+		for _, failure := range failures {
+			classes[failure["error_class"].(string)]++
+		}
+		logger.WithFields(logrus.Fields{
+			"failed_jobs":   failures,
+			"error_classes": classes,
+		}).Error("Failure report")
+	}
+
+	summary := logger.WithFields(logrus.Fields{
+		"jobs_total":     len(results),
+		"jobs_succeeded": counts["succeeded"],
+		"jobs_failed":    counts["failed"],
+		"jobs_skipped":   counts["skipped"],
+		"jobs_cancelled": counts["cancelled"],
+		"duration":       elapsed,
+	})
+	if saved := sequential - elapsed; concurrency > 1 && saved > 0 {
+		summary = summary.WithField("duration_saved", saved)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	root.set("jobs_succeeded", counts["succeeded"])
+	root.set("jobs_failed", counts["failed"])
+	root.end(failed)
+	switch {
+	case interrupted != nil:
+		summary.Error("Sync jobs interrupted")
+		return exitInterrupted
+	case failed != nil && counts["succeeded"] > 0:
+		summary.Error("Some sync jobs failed")
+		return exitSyncFailed
+	case failed != nil:
+		summary.Error("Sync jobs failed")
+		return exitCode(failed)
+	}
+	summary.Info("All sync jobs completed successfully")
+	return 0
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// logEntries parses the JSON log lines in out, skipping other output.
+func logEntries(t *testing.T, out string) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// findEntry returns the first log entry with msg, or nil.
+func findEntry(entries []map[string]interface{}, msg string) map[string]interface{} {
+	for _, entry := range entries {
+		if entry["msg"] == msg {
+			return entry
+		}
+	}
+	return nil
+}
+
+func TestFailureReport(t *testing.T) {
+	// Syncs from the bucket named broken fail.
+	script := `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+case "$2" in *broken*) echo "ERROR : a.txt: Failed to copy: corrupted on transfer" >&2; exit 1 ;; esac
+exit 0`
+	for _, tt := range []struct {
+		name     string
+		env      map[string]string
+		code     int
+		statuses []string
+	}{
+		{"stop at the first failure", nil, exitSyncFailed, []string{"failed", "skipped"}},
+		{"continue on error", map[string]string{"CONTINUE_ON_ERROR": "true"}, exitSyncFailed, []string{"failed", "succeeded"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, _ := fakeRclone(t, script)
+			env := withEnv(map[string]string{
+				"RCLONE_PATH":     path,
+				"SOURCE_BUCKET_1": "broken",
+				"SOURCE_BUCKET_2": "good",
+				"JOB_CONCURRENCY": "1",
+			})
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			setTestEnv(t, env)
+			var result runResult
+			out := captureOutput(t, func() { result, _ = run(nil) })
+			if result.code != tt.code {
+				t.Errorf("run = %d, want %d", result.code, tt.code)
+			}
+
+			entries := logEntries(t, out)
+			var statuses []string
+			for _, entry := range entries {
+				if entry["msg"] == "Job result" {
+					statuses = append(statuses, entry["status"].(string))
+				}
+			}
+			if strings.Join(statuses, ",") != strings.Join(tt.statuses, ",") {
+				t.Errorf("job statuses %v, want %v", statuses, tt.statuses)
+			}
+
+			report := findEntry(entries, "Failure report")
+			if report == nil {
+				t.Fatalf("no failure report in:\n%s", out)
+			}
+			failed, _ := report["failed_jobs"].([]interface{})
+			if len(failed) != 1 {
+				t.Fatalf("failed_jobs = %v, want the broken job", report["failed_jobs"])
+			}
+			failure := failed[0].(map[string]interface{})
+			if failure["job"] != "broken" || failure["error_class"] != "sync" || failure["rclone_error_class"] != "other" {
+				t.Errorf("failure %v, want a sync error of the broken job", failure)
+			}
+			if classes, _ := report["error_classes"].(map[string]interface{}); classes["sync"] != 1.0 {
+				t.Errorf("error_classes = %v, want one sync error", report["error_classes"])
+			}
+		})
+	}
+}
+
+// loadTestConfigs loads the jobs configured by minimalEnv with overrides.
+func loadTestConfigs(t *testing.T, overrides map[string]string) ([]*Config, error) {
+	t.Helper()
+	setTestEnv(t, withEnv(overrides))
+	return loadConfigs(nil)
+}
+
+// jobNames returns the names of configs, in order.
+func jobNames(configs []*Config) []string {
+	names := make([]string, len(configs))
+	for i, config := range configs {
+		names[i] = config.JobName
+	}
+	return names
+}
+
+func TestSyncJobs(t *testing.T) {
+	configs, err := loadTestConfigs(t, map[string]string{
+		"DRY_RUN": "true",
+		"SYNC_JOBS": `[
+			{"name": "media", "sourceBucket": "media", "destPrefix": ""},
+			{"sourceBucket": "logs", "sourcePrefix": "2024", "destBucket": "archive", "overrides": {"dry_run": false, "TRANSFERS": 8}}
+		]`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := jobNames(configs); !slices.Equal(names, []string{"media", "logs"}) {
+		t.Fatalf("jobs %q, want media and logs", names)
+	}
+	media, logs := configs[0], configs[1]
+	// Settings a job doesn't define are shared.
+	if !media.DryRun || media.Dest.Bucket != "dest-bucket" || media.Dest.Prefix != "" {
+		t.Errorf("media job = dry run %v into %s/%s, want a dry run into the root of dest-bucket", media.DryRun, media.Dest.Bucket, media.Dest.Prefix)
+	}
+	if logs.DryRun || logs.Transfers != 8 || logs.Source.Prefix != "2024" || logs.Dest.Bucket != "archive" || logs.Dest.Prefix != "logs/2024" {
+		t.Errorf("logs job = %+v, want its overrides", logs)
+	}
+
+	for _, tt := range []struct {
+		jobs string
+		want string
+	}{
+		{`[]`, "SYNC_JOBS contains no jobs"},
+		{`{"name": "media"}`, "invalid SYNC_JOBS"},
+		{`[{"sourceBucket": "media", "bucket": "x"}]`, `invalid SYNC_JOBS: json: unknown field "bucket"`},
+		{`[{"sourceBucket": "media", "overrides": {"NO_SUCH_SETTING": 1}}]`, "SYNC_JOBS entry 1: unknown override NO_SUCH_SETTING"},
+		{`[{"sourceBucket": "media", "overrides": {"JOB_CONCURRENCY": 2}}]`, "SYNC_JOBS entry 1: unknown override JOB_CONCURRENCY"},
+		{`[{"sourceBucket": "media"}, {"sourceBucket": "media"}]`, `job name "media" is used more than once`},
+		{`[{"sourceBucket": "media", "overrides": {"TRANSFERS": "many"}}]`, `job 1 (media): configuration parsing failed: TRANSFERS="many"`},
+	} {
+		_, err := loadTestConfigs(t, map[string]string{"SYNC_JOBS": tt.jobs})
+		wantError(t, err, tt.want)
+	}
+
+	_, err = loadTestConfigs(t, map[string]string{"SYNC_JOBS": `[{"sourceBucket": "media"}]`, "SOURCE_BUCKET_1": "logs"})
+	wantError(t, err, "SYNC_JOBS and indexed variables such as SOURCE_BUCKET_1 are both set")
+}
+
+func TestIndexedJobs(t *testing.T) {
+	configs, err := loadTestConfigs(t, map[string]string{
+		"SOURCE_BUCKET_1": "media",
+		"SOURCE_BUCKET_2": "logs",
+		"JOB_NAME_2":      "nightly-logs",
+		"DEST_PREFIX_2":   "backup/logs",
+		"TRANSFERS":       "6",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := jobNames(configs); !slices.Equal(names, []string{"media", "nightly-logs"}) {
+		t.Fatalf("jobs %q, want media and nightly-logs", names)
+	}
+	if configs[1].Dest.Prefix != "backup/logs" || configs[0].Dest.Prefix != "media" || configs[0].Transfers != 6 || configs[1].Transfers != 6 {
+		t.Errorf("jobs = %+v, %+v", configs[0], configs[1])
+	}
+
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"SOURCE_BUCKET_1": "media", "SOURCE_BUCKET_3": "logs"}, "indexed job 3 is defined but job 2 is not"},
+		{map[string]string{"SOURCE_BUCKET_1": "media", "DEST_PREFIX_2": "logs"}, "SOURCE_BUCKET_2 is not set, but other settings of job 2 are"},
+		{map[string]string{"SOURCE_BUCKET_0": "media"}, "SOURCE_BUCKET_0: jobs are numbered from 1"},
+		{map[string]string{"SOURCE_BUCKET_1": "media", "TRANSFERS_1": "many"}, "job 1 (media)"},
+	} {
+		_, err := loadTestConfigs(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestValidateJobDestinations(t *testing.T) {
+	_, err := loadTestConfigs(t, map[string]string{"SOURCE_BUCKET_1": "media", "SOURCE_BUCKET_2": "logs", "DEST_PREFIX_1": "backup", "DEST_PREFIX_2": "backup/logs"})
+	wantError(t, err, "jobs media and logs sync into overlapping destinations dest:dest-bucket/backup and dest:dest-bucket/backup/logs")
+
+	// Jobs that don't delete may share a destination.
+	_, err = loadTestConfigs(t, map[string]string{"SOURCE_BUCKET_1": "media", "SOURCE_BUCKET_2": "logs", "DEST_PREFIX": "", "SYNC_MODE": "copy"})
+	wantError(t, err, "")
+}
+
+func TestJobPath(t *testing.T) {
+	if got := jobPath(&Config{}, "/tmp/diff.json"); got != "/tmp/diff.json" {
+		t.Errorf("jobPath of a single job = %q", got)
+	}
+	if got := jobPath(&Config{JobName: "media"}, "/tmp/diff.json"); got != "/tmp/diff-media.json" {
+		t.Errorf("jobPath = %q, want /tmp/diff-media.json", got)
+	}
+}
+
+func TestRunJobs(t *testing.T) {
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SOURCE_BUCKET_1": "media", "SOURCE_BUCKET_2": "logs"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+	var syncs []string
+	for _, run := range readCalls(t, calls) {
+		if strings.HasPrefix(run, "sync ") {
+			syncs = append(syncs, strings.Join(strings.Fields(run)[1:3], " "))
+		}
+	}
+	slices.Sort(syncs)
+	if want := []string{"source:logs dest:dest-bucket/logs", "source:media dest:dest-bucket/media"}; !slices.Equal(syncs, want) {
+		t.Errorf("synced %q, want both jobs", syncs)
+	}
+
+	entries := logEntries(t, out)
+	summary := findEntry(entries, "All sync jobs completed successfully")
+	if summary == nil || summary["jobs_total"] != float64(2) || summary["jobs_succeeded"] != float64(2) {
+		t.Errorf("summary = %v, want two succeeded jobs", summary)
+	}
+	// Every line of a job names it.
+	for _, e := range entries {
+		if e["msg"] == "S3 sync job completed successfully" && e["job"] != "media" && e["job"] != "logs" {
+			t.Errorf("job line without the job name: %v", e)
+		}
+	}
+}
+
+func TestJobConcurrency(t *testing.T) {
+	_, err := loadTestConfig(t, map[string]string{"JOB_CONCURRENCY": "0"})
+	wantError(t, err, "JOB_CONCURRENCY must be at least 1, got 0")
+
+	configs, err := loadTestConfigs(t, map[string]string{
+		"SOURCE_BUCKET_1":   "media",
+		"SOURCE_BUCKET_2":   "logs",
+		"SOURCE_BUCKET_3":   "assets",
+		"BANDWIDTH_LIMIT_3": "1M",
+		"BANDWIDTH_LIMIT":   "10M",
+		"JOB_CONCURRENCY":   "2",
+		"SPLIT_BWLIMIT":     "true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two jobs run at a time, so each gets half the limit; a job with its
+	// own limit keeps it.
+	for i, want := range []string{"5120k", "5120k", "1M"} {
+		if configs[i].BandwidthLimit != want {
+			t.Errorf("job %s BandwidthLimit = %q, want %q", configs[i].JobName, configs[i].BandwidthLimit, want)
+		}
+	}
+}
+
+func TestRunJobsConcurrently(t *testing.T) {
+	// Each sync waits up to two seconds for the other one to start, so the
+	// run only succeeds when both run at the same time.
+	dir := t.TempDir()
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+if [ "$1" = sync ]; then
+	bucket=${2#source:}
+	touch "`+dir+`/$bucket"
+	for i in 1 2 3 4 5 6 7 8 9 10 11 12 13 14 15 16 17 18 19 20; do
+		[ $(ls "`+dir+`" | wc -l) -ge 2 ] && exit 0
+		sleep 0.1
+	done
+	exit 1
+fi
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SOURCE_BUCKET_1": "media", "SOURCE_BUCKET_2": "logs", "JOB_CONCURRENCY": "2"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want the jobs to run at the same time:\n%s", result.code, out)
+	}
+	if e := findEntry(logEntries(t, out), "Running sync jobs"); e == nil || e["job_concurrency"] != float64(2) {
+		t.Errorf("start logged as %v", e)
+	}
+}
+
+func TestRunJobsStopsAfterFailure(t *testing.T) {
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = sync ] && exit 1
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SOURCE_BUCKET_1": "media", "SOURCE_BUCKET_2": "logs"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != exitSyncFailed {
+		t.Fatalf("run = %d, want %d:\n%s", result.code, exitSyncFailed, out)
+	}
+	syncs := 0
+	for _, run := range readCalls(t, calls) {
+		if strings.HasPrefix(run, "sync ") {
+			syncs++
+		}
+	}
+	if syncs != 1 {
+		t.Errorf("ran %d syncs, want no further job after the failure", syncs)
+	}
+	entries := logEntries(t, out)
+	if e := findEntry(entries, "Sync jobs failed"); e == nil || e["jobs_failed"] != float64(1) || e["jobs_skipped"] != float64(1) {
+		t.Errorf("summary = %v, want one failed and one skipped job", e)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lockSettleDelay is how long acquireLock waits before reading its lock
+// back on destinations without conditional writes. rclone can't make a
+// conditional PUT, so of two runs that write the lock at the same moment,
+// the one whose lock was overwritten backs off.
+const lockSettleDelay = 2 * time.Second
+
+// conditionalWriteProviders are the providers whose PutObject honours
+// If-None-Match and If-Match. Others may ignore the headers, which would let
+// two runs take the lock, so their lock is read back instead.
+var conditionalWriteProviders = []string{"AWS", "Cloudflare", "Minio"}
+
+// errLockChanged reports that a conditional write of the lock failed: the
+// lock was created, changed or removed since it was read.
+var errLockChanged = errors.New("the lock changed")
+
+// errNoConditionalWrites reports that the destination refused a conditional
+// write it doesn't implement.
+var errNoConditionalWrites = errors.New("conditional writes are not supported")
+
+func validateLock(config *Config) error {
+	if !config.Lock {
+		if config.LockKey != "" {
+			return fmt.Errorf("LOCK_KEY requires LOCK=true")
+		}
+		return nil
+	}
+	if ttl, err := time.ParseDuration(config.LockTTL); err != nil || ttl < time.Minute {
+		return fmt.Errorf("invalid LOCK_TTL %q: must be a duration of at least 1m", config.LockTTL)
+	}
+	if config.SQSQueueURL != "" {
+		return fmt.Errorf("LOCK is not available with SQS_QUEUE_URL")
+	}
+	if config.LockKey == "" {
+		if config.ReportPrefix == "" {
+			return fmt.Errorf("LOCK needs LOCK_KEY or REPORT_PREFIX for the lock object")
+		}
+		return nil
+	}
+	// Inside the synced path, the lock would be deleted by the sync it
+	// protects.
+	if prefixesOverlap(config.LockKey, config.Dest.Prefix) {
+		return fmt.Errorf("LOCK_KEY %q is inside the destination %q; use a key outside DEST_PREFIX",
+			config.LockKey, remotePath("dest", config.Dest.Bucket, config.Dest.Prefix))
+	}
+	if config.BackupDir != "" && prefixesOverlap(config.LockKey, config.BackupDir) {
+		return fmt.Errorf("LOCK_KEY %q is inside BACKUP_DIR %q", config.LockKey, config.BackupDir)
+	}
+	return nil
+}
+
+// lockKey returns the key of the lock object in the destination bucket:
+// LOCK_KEY, or .sync-lock next to the reports of the job.
+func lockKey(config *Config) string {
+	if config.LockKey != "" {
+		return config.LockKey
+	}
+	return reportRoot(config) + "/.sync-lock"
+}
+
+// syncLock is the content of the lock object.
+type syncLock struct {
+	Owner      string    `json:"owner"`
+	RunID      string    `json:"run_id,omitempty"`
+	Hostname   string    `json:"hostname"`
+	PID        int       `json:"pid"`
+	Job        string    `json:"job,omitempty"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// lockError reports that another run holds the lock.
+type lockError struct {
+	path string
+	lock *syncLock
+}
+
+func (e *lockError) Error() string {
+	return fmt.Sprintf("another sync holds the lock %s: %s (pid %d) since %s, until %s",
+		e.path, e.lock.Hostname, e.lock.PID,
+		e.lock.AcquiredAt.Format(time.RFC3339), e.lock.ExpiresAt.Format(time.RFC3339))
+}
+
+// heldLock is a lock acquired by this run, refreshed in the background
+// until it is released.
+type heldLock struct {
+	config  *Config
+	remotes *rcloneRemotes
+	logger  *logrus.Entry
+	path    string
+	ttl     time.Duration
+	// client writes the lock with conditional PUTs if the destination
+	// supports them, and etag is the ETag of the lock it wrote last. Without
+	// it the lock is read and written through rclone.
+	client *s3Client
+	etag   string
+
+	mu   sync.Mutex
+	lock syncLock
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+}
+
+// acquireLock takes the lock of the destination for this run, so that a run
+// overrunning its schedule and the next one don't sync at the same time. A
+// lock past its expiry is left by a run that died and is broken with a
+// warning. It returns nil if LOCK is not set or for dry runs, which change
+// nothing. Where the destination supports them, the lock is created with
+// If-None-Match: * and replaced with If-Match, so that of two runs only one
+// gets it. Elsewhere it is best effort: it is written with rclone, then read
+// back after lockSettleDelay.
+func acquireLock(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) (*heldLock, error) {
+	if !config.Lock || config.DryRun {
+		return nil, nil
+	}
+	ttl, _ := time.ParseDuration(config.LockTTL)
+	path := remotePath("dest", config.Dest.Bucket, lockKey(config))
+	hostname, _ := os.Hostname()
+	now := time.Now().UTC()
+	l := &heldLock{
+		config:  config,
+		remotes: remotes,
+		logger:  logger.WithField("lock", path),
+		path:    path,
+		ttl:     ttl,
+		client:  conditionalLockClient(config),
+		lock: syncLock{
+			Owner:      newRunID(),
+			RunID:      config.runID,
+			Hostname:   hostname,
+			PID:        os.Getpid(),
+			Job:        config.JobName,
+			AcquiredAt: now,
+			ExpiresAt:  now.Add(ttl),
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	var err error
+	if l.client != nil {
+		err = l.acquireConditional()
+		if errors.Is(err, errNoConditionalWrites) {
+			l.logger.Warn("The destination doesn't support conditional writes, reading the sync lock back instead")
+			l.client = nil
+		}
+	}
+	if l.client == nil {
+		err = l.acquireReadBack()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	go l.refresh()
+	l.logger.WithField("expires_at", l.lock.ExpiresAt.Format(time.RFC3339)).Info("Acquired the sync lock")
+	return l, nil
+}
+
+// conditionalLockClient returns the client that writes the lock of config
+// with conditional PUTs, or nil if the destination may not support them.
+func conditionalLockClient(config *Config) *s3Client {
+	if config.Dest.V2Auth {
+		return nil
+	}
+	for _, provider := range conditionalWriteProviders {
+		if strings.EqualFold(provider, config.Dest.Provider) {
+			client, err := newS3Client(config.Dest, config.Retries, 1)
+			if err != nil {
+				return nil
+			}
+			return client
+		}
+	}
+	return nil
+}
+
+// acquireConditional takes the lock with a PUT that only succeeds if the
+// lock is as it was read: missing, or stale with the same ETag. A run that
+// changed it in between wins, and the lock is read again.
+func (l *heldLock) acquireConditional() error {
+	for attempt := 0; attempt < 3; attempt++ {
+		existing, etag, err := l.readCurrent()
+		if err != nil {
+			return &classError{class: "lock", err: err}
+		}
+		if existing != nil {
+			if time.Now().Before(existing.ExpiresAt) {
+				return &lockError{path: l.path, lock: existing}
+			}
+			l.breakStale(existing)
+		}
+		err = l.writeIf(etag)
+		if !errors.Is(err, errLockChanged) {
+			return err
+		}
+	}
+	return &classError{class: "lock", err: fmt.Errorf("the lock %s kept changing while it was taken", l.path)}
+}
+
+// acquireReadBack writes the lock with rclone unless another run holds it,
+// and keeps it if it is still its own after lockSettleDelay.
+func (l *heldLock) acquireReadBack() error {
+	existing, err := readLock(l.config, l.remotes, l.path)
+	if err != nil {
+		return &classError{class: "lock", err: err}
+	}
+	if existing != nil {
+		if time.Now().Before(existing.ExpiresAt) {
+			return &lockError{path: l.path, lock: existing}
+		}
+		l.breakStale(existing)
+	}
+	if err := l.write(); err != nil {
+		return &classError{class: "lock", err: err}
+	}
+	time.Sleep(lockSettleDelay)
+	current, err := readLock(l.config, l.remotes, l.path)
+	if err != nil {
+		return &classError{class: "lock", err: err}
+	}
+	if current == nil || current.Owner != l.lock.Owner {
+		if current == nil {
+			return &classError{class: "lock", err: fmt.Errorf("the lock %s disappeared after it was written", l.path)}
+		}
+		return &lockError{path: l.path, lock: current}
+	}
+	return nil
+}
+
+func (l *heldLock) breakStale(existing *syncLock) {
+	l.logger.WithFields(logrus.Fields{
+		"lock_hostname": existing.Hostname,
+		"lock_pid":      existing.PID,
+		"expired_at":    existing.ExpiresAt.Format(time.RFC3339),
+	}).Warn("Breaking a stale lock left by a run that didn't release it")
+}
+
+// refresh moves the expiry of the lock forward every third of LOCK_TTL, so
+// that long runs keep it.
+func (l *heldLock) refresh() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		if l.client == nil {
+			current, err := readLock(l.config, l.remotes, l.path)
+			if err == nil && (current == nil || current.Owner != l.lock.Owner) {
+				l.logger.Warn("The sync lock was removed or taken over by another run, no longer refreshing it")
+				return
+			}
+		}
+		l.mu.Lock()
+		l.lock.ExpiresAt = time.Now().UTC().Add(l.ttl)
+		l.mu.Unlock()
+		var err error
+		if l.client != nil {
+			// The refresh only goes through if the lock is still the one
+			// written last.
+			err = l.writeIf(l.etag)
+		} else {
+			err = l.write()
+		}
+		if errors.Is(err, errLockChanged) {
+			l.logger.Warn("The sync lock was removed or taken over by another run, no longer refreshing it")
+			return
+		}
+		if err != nil {
+			l.logger.WithError(err).Warn("Failed to refresh the sync lock")
+			continue
+		}
+		l.logger.WithField("expires_at", l.lock.ExpiresAt.Format(time.RFC3339)).Debug("Refreshed the sync lock")
+	}
+}
+
+// release stops refreshing the lock and deletes it, unless another run has
+// taken it over in the meantime. It is safe to call more than once and on a
+// nil lock.
+func (l *heldLock) release() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		close(l.stop)
+		<-l.done
+		var current *syncLock
+		var err error
+		if l.client != nil {
+			current, _, err = l.readCurrent()
+		} else {
+			current, err = readLock(l.config, l.remotes, l.path)
+		}
+		if err != nil {
+			l.logger.WithError(err).Warn("Failed to release the sync lock, it expires after LOCK_TTL")
+			return
+		}
+		if current == nil || current.Owner != l.lock.Owner {
+			l.logger.Warn("The sync lock was taken over by another run, leaving it")
+			return
+		}
+		if l.client != nil {
+			if err := l.deleteLock(); err != nil {
+				l.logger.WithError(err).Warn("Failed to release the sync lock, it expires after LOCK_TTL")
+				return
+			}
+			l.logger.Info("Released the sync lock")
+			return
+		}
+		var stderr bytes.Buffer
+		cmd := l.remotes.command(l.config, "deletefile", l.path)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			l.logger.WithError(err).WithField("stderr", lastLine(strings.TrimSpace(stderr.String()))).
+				Warn("Failed to release the sync lock, it expires after LOCK_TTL")
+			return
+		}
+		l.logger.Info("Released the sync lock")
+	})
+}
+
+func (l *heldLock) write() error {
+	data, err := l.marshal()
+	if err != nil {
+		return err
+	}
+	return rcat(l.config, l.remotes, l.path, bytes.NewReader(data))
+}
+
+func (l *heldLock) marshal() ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data, err := json.Marshal(l.lock)
+	return append(data, '\n'), err
+}
+
+// writeIf writes the lock if the lock object still has etag, or if there is
+// none with an empty etag. It returns errLockChanged if the condition
+// failed, and errNoConditionalWrites if the destination doesn't implement
+// it.
+func (l *heldLock) writeIf(etag string) error {
+	data, err := l.marshal()
+	if err != nil {
+		return err
+	}
+	newETag, err := l.client.putIf(context.Background(), l.config.Dest.Bucket, l.key(), data, etag)
+	var s3Err *s3Error
+	switch {
+	case err == nil:
+		l.etag = newETag
+		return nil
+	// 409 ConditionalRequestConflict is the answer to a conditional write
+	// racing another one.
+	case errors.As(err, &s3Err) && (s3Err.status == http.StatusPreconditionFailed || s3Err.status == http.StatusConflict):
+		return errLockChanged
+	case errors.As(err, &s3Err) && (s3Err.status == http.StatusNotImplemented || s3Err.code == "NotImplemented"):
+		return errNoConditionalWrites
+	}
+	return &classError{class: "lock", err: fmt.Errorf("failed to write %s: %w", l.path, err)}
+}
+
+// readCurrent returns the lock and its ETag through the conditional client,
+// or nil if there is none. Like readLock, it counts an unparsable lock as
+// expired.
+func (l *heldLock) readCurrent() (*syncLock, string, error) {
+	resp, err := l.client.get(context.Background(), l.config.Dest.Bucket, l.key())
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) && s3Err.status == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", l.path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read %s: %w", l.path, err)
+	}
+	var lock syncLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return &syncLock{}, resp.Header.Get("ETag"), nil
+	}
+	return &lock, resp.Header.Get("ETag"), nil
+}
+
+// deleteLock deletes the lock through the conditional client. S3 has no
+// conditional delete all providers support, so a run taking the lock over
+// right after release read it loses it, as with rclone.
+func (l *heldLock) deleteLock() error {
+	failed, err := l.client.deleteKeys(context.Background(), l.config.Dest.Bucket, []string{l.key()})
+	if err != nil {
+		return err
+	}
+	return failed[l.key()]
+}
+
+// key is the key of the lock in the destination bucket.
+func (l *heldLock) key() string {
+	return lockKey(l.config)
+}
+
+// readLock returns the lock at path, or nil if there is none. A lock that
+// can't be parsed counts as expired, so a broken object can't block every
+// run.
+func readLock(config *Config, remotes *rcloneRemotes, path string) (*syncLock, error) {
+	data, err := readObject(config, remotes, path)
+	if err != nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil, err
+	}
+	var lock syncLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return &syncLock{}, nil
+	}
+	return &lock, nil
+}
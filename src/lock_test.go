@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateLock(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"LOCK_KEY": "locks/media"}, "LOCK_KEY requires LOCK=true"},
+		{map[string]string{"LOCK": "true", "LOCK_KEY": "locks/media", "LOCK_TTL": "30s"}, `invalid LOCK_TTL "30s": must be a duration of at least 1m`},
+		{map[string]string{"LOCK": "true"}, "LOCK needs LOCK_KEY or REPORT_PREFIX for the lock object"},
+		{map[string]string{"LOCK": "true", "LOCK_KEY": "source-bucket/.lock"}, `LOCK_KEY "source-bucket/.lock" is inside the destination`},
+		{map[string]string{"LOCK": "true", "LOCK_KEY": "trash/.lock", "BACKUP_DIR": "trash"}, `LOCK_KEY "trash/.lock" is inside BACKUP_DIR "trash"`},
+		{withSQS(map[string]string{"LOCK": "true", "LOCK_KEY": "locks/media"}), "LOCK is not available with SQS_QUEUE_URL"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestLockKey(t *testing.T) {
+	if key := lockKey(&Config{LockKey: "locks/media"}); key != "locks/media" {
+		t.Errorf("lockKey = %q, want LOCK_KEY", key)
+	}
+	if key := lockKey(&Config{ReportPrefix: "_reports", JobName: "media"}); key != "_reports/media/.sync-lock" {
+		t.Errorf("lockKey = %q, want .sync-lock next to the reports of the job", key)
+	}
+}
+
+// lockPath is where lockRclone keeps the lock object of LOCK_KEY=locks/media.
+const lockPath = "dest:dest-bucket/locks/media"
+
+// lockRclone keeps the objects rclone writes as files under dir, named by
+// their rclone path, and runs sync as given.
+func lockRclone(t *testing.T, dir, sync string) (path, calls string) {
+	return fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+object="`+dir+`/$2"
+case $1 in
+cat) [ -f "$object" ] || exit 3; cat "$object" ;;
+rcat) mkdir -p "$(dirname "$object")"; cat > "$object" ;;
+deletefile) rm "$object" ;;
+sync) `+sync+` ;;
+esac
+exit 0`)
+}
+
+// writeLock stores a lock held by another run, expiring at expires, where
+// lockRclone keeps it.
+func writeLock(t *testing.T, dir string, expires time.Time) {
+	t.Helper()
+	data, _ := json.Marshal(syncLock{Owner: "other", Hostname: "other-host", PID: 42, AcquiredAt: expires.Add(-time.Hour), ExpiresAt: expires})
+	path := filepath.Join(dir, lockPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLockFile returns the lock where lockRclone keeps it, or nil.
+func readLockFile(t *testing.T, path string) *syncLock {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	var lock syncLock
+	if err != nil || json.Unmarshal(data, &lock) != nil {
+		t.Fatalf("lock %s = %q, %v", path, data, err)
+	}
+	return &lock
+}
+
+// runLocked runs a sync with LOCK_KEY=locks/media through rclone at path and
+// returns its exit code and its log entries.
+func runLocked(t *testing.T, path string, env map[string]string) (int, []map[string]any) {
+	t.Helper()
+	overrides := map[string]string{"RCLONE_PATH": path, "LOCK": "true", "LOCK_KEY": "locks/media", "LOCK_TTL": "10m", "RUN_ID": "run-1"}
+	for k, v := range env {
+		overrides[k] = v
+	}
+	setTestEnv(t, withEnv(overrides))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	return result.code, logEntries(t, out)
+}
+
+func TestLockAcquireRelease(t *testing.T) {
+	dir := t.TempDir()
+	// The sync keeps a copy of the lock as it was while syncing.
+	path, calls := lockRclone(t, dir, `cp "`+dir+`/`+lockPath+`" "`+dir+`/during"`)
+	code, entries := runLocked(t, path, nil)
+	if code != 0 {
+		t.Fatalf("run = %d, want 0: %v", code, entries)
+	}
+	if !synced(readCalls(t, calls)) {
+		t.Fatal("did not sync")
+	}
+	held := readLockFile(t, filepath.Join(dir, "during"))
+	hostname, _ := os.Hostname()
+	if held == nil || held.Owner == "" || held.RunID != "run-1" || held.Hostname != hostname || held.PID != os.Getpid() {
+		t.Errorf("lock during the sync = %+v", held)
+	} else if ttl := held.ExpiresAt.Sub(held.AcquiredAt); ttl != 10*time.Minute {
+		t.Errorf("lock expires %s after it was acquired, want LOCK_TTL", ttl)
+	}
+	if lock := readLockFile(t, filepath.Join(dir, lockPath)); lock != nil {
+		t.Errorf("lock left after the run: %+v", lock)
+	}
+	for _, msg := range []string{"Acquired the sync lock", "Released the sync lock"} {
+		if findEntry(entries, msg) == nil {
+			t.Errorf("%q not logged", msg)
+		}
+	}
+}
+
+func TestLockHeld(t *testing.T) {
+	dir := t.TempDir()
+	path, calls := lockRclone(t, dir, "")
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	writeLock(t, dir, expires)
+	code, entries := runLocked(t, path, nil)
+	if code != exitLockHeld {
+		t.Errorf("run = %d, want %d", code, exitLockHeld)
+	}
+	if synced(readCalls(t, calls)) {
+		t.Error("synced without the lock")
+	}
+	// The other run's lock is left alone.
+	if lock := readLockFile(t, filepath.Join(dir, lockPath)); lock == nil || lock.Owner != "other" {
+		t.Errorf("lock after the run = %+v, want the other run's", lock)
+	}
+	e := findEntry(entries, "S3 sync job failed")
+	if e == nil || e["error_class"] != "lock" || !strings.Contains(e["error"].(string), "another sync holds the lock "+lockPath+": other-host (pid 42)") {
+		t.Errorf("failure logged as %v", e)
+	}
+}
+
+func TestLockBreakStale(t *testing.T) {
+	dir := t.TempDir()
+	path, calls := lockRclone(t, dir, "")
+	writeLock(t, dir, time.Now().Add(-time.Minute))
+	code, entries := runLocked(t, path, nil)
+	if code != 0 || !synced(readCalls(t, calls)) {
+		t.Fatalf("run = %d, want a sync after breaking the stale lock", code)
+	}
+	e := findEntry(entries, "Breaking a stale lock left by a run that didn't release it")
+	if e == nil || e["level"] != "warning" || e["lock_hostname"] != "other-host" || e["lock_pid"] != float64(42) {
+		t.Errorf("stale lock logged as %v", e)
+	}
+	if lock := readLockFile(t, filepath.Join(dir, lockPath)); lock != nil {
+		t.Errorf("lock left after the run: %+v", lock)
+	}
+}
+
+func TestLockLostRace(t *testing.T) {
+	dir := t.TempDir()
+	// Another run writes its lock right after this one, before the read
+	// back.
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+object="`+dir+`/$2"
+case $1 in
+cat) [ -f "$object" ] || exit 3; cat "$object" ;;
+rcat) mkdir -p "$(dirname "$object")"; cat > /dev/null
+	echo '{"owner":"other","hostname":"other-host","pid":42,"expires_at":"2999-01-01T00:00:00Z"}' > "$object" ;;
+esac
+exit 0`)
+	code, _ := runLocked(t, path, nil)
+	if code != exitLockHeld {
+		t.Errorf("run = %d, want %d", code, exitLockHeld)
+	}
+	if synced(readCalls(t, calls)) {
+		t.Error("synced after losing the lock")
+	}
+}
+
+func TestLockTakenOver(t *testing.T) {
+	dir := t.TempDir()
+	// Another run takes the lock over during the sync, e.g. after it
+	// expired.
+	path, _ := lockRclone(t, dir, `echo '{"owner":"other","hostname":"other-host","pid":42}' > "`+dir+`/`+lockPath+`"`)
+	code, entries := runLocked(t, path, nil)
+	if code != 0 {
+		t.Fatalf("run = %d, want 0", code)
+	}
+	if lock := readLockFile(t, filepath.Join(dir, lockPath)); lock == nil || lock.Owner != "other" {
+		t.Errorf("lock after the run = %+v, want the other run's", lock)
+	}
+	if findEntry(entries, "The sync lock was taken over by another run, leaving it") == nil {
+		t.Error("takeover not logged")
+	}
+}
+
+func TestLockDryRun(t *testing.T) {
+	dir := t.TempDir()
+	path, calls := lockRclone(t, dir, "")
+	code, _ := runLocked(t, path, map[string]string{"DRY_RUN": "true"})
+	if code != 0 {
+		t.Fatalf("run = %d, want 0", code)
+	}
+	for _, run := range readCalls(t, calls) {
+		if strings.HasPrefix(run, "rcat ") || strings.HasPrefix(run, "cat ") {
+			t.Errorf("dry run used the lock: %q", run)
+		}
+	}
+}
+
+func TestConditionalLockClient(t *testing.T) {
+	for _, tt := range []struct {
+		provider string
+		v2Auth   bool
+		want     bool
+	}{
+		{"AWS", false, true},
+		{"minio", false, true},
+		{"Cloudflare", false, true},
+		{"Other", false, false},
+		{"Ceph", false, false},
+		{"AWS", true, false},
+	} {
+		config := &Config{Dest: RemoteConfig{Provider: tt.provider, V2Auth: tt.v2Auth}}
+		if got := conditionalLockClient(config) != nil; got != tt.want {
+			t.Errorf("conditional writes for %s (v2 auth %v) = %v, want %v", tt.provider, tt.v2Auth, got, tt.want)
+		}
+	}
+}
+
+// runConditionalLocked runs a sync with LOCK_KEY=locks/media whose lock is
+// kept in the dest-bucket of s3, a provider with conditional writes.
+func runConditionalLocked(t *testing.T, s3 *fakeS3, path string) (int, []map[string]any) {
+	t.Helper()
+	return runLocked(t, path, map[string]string{"DEST_PROVIDER": "Minio", "DEST_S3_ENDPOINT": s3.URL})
+}
+
+// putLock stores a lock held by another run in s3, expiring at expires.
+func putLock(s3 *fakeS3, expires time.Time) *fakeObject {
+	data, _ := json.Marshal(syncLock{Owner: "other", Hostname: "other-host", PID: 42, AcquiredAt: expires.Add(-time.Hour), ExpiresAt: expires})
+	return s3.put("dest-bucket", "locks/media", string(data), nil)
+}
+
+// lockCalls returns the rclone runs of calls that read or wrote the lock.
+func lockCalls(t *testing.T, calls string) []string {
+	var runs []string
+	for _, run := range readCalls(t, calls) {
+		if strings.HasSuffix(run, lockPath) {
+			runs = append(runs, run)
+		}
+	}
+	return runs
+}
+
+func TestLockConditional(t *testing.T) {
+	s3 := newFakeS3(t, "dest-bucket")
+	path, calls := lockRclone(t, t.TempDir(), "")
+	start := time.Now()
+	code, entries := runConditionalLocked(t, s3, path)
+	if code != 0 || !synced(readCalls(t, calls)) {
+		t.Fatalf("run = %d, want a sync: %v", code, entries)
+	}
+	// The lock is created only if there is none, without the wait for the
+	// read back.
+	puts := s3.received("PutObject")
+	if len(puts) != 1 || puts[0].key != "locks/media" || puts[0].header.Get("If-None-Match") != "*" {
+		t.Errorf("PutObject requests %+v, want the lock created with If-None-Match: *", puts)
+	}
+	if elapsed := time.Since(start); elapsed >= lockSettleDelay {
+		t.Errorf("run took %v, want no lockSettleDelay", elapsed)
+	}
+	if runs := lockCalls(t, calls); len(runs) != 0 {
+		t.Errorf("rclone used the lock: %q", runs)
+	}
+	if s3.object("dest-bucket", "locks/media") != nil {
+		t.Error("lock left after the run")
+	}
+	for _, msg := range []string{"Acquired the sync lock", "Released the sync lock"} {
+		if findEntry(entries, msg) == nil {
+			t.Errorf("%q not logged", msg)
+		}
+	}
+}
+
+func TestLockConditionalHeld(t *testing.T) {
+	s3 := newFakeS3(t, "dest-bucket")
+	putLock(s3, time.Now().Add(time.Hour))
+	path, calls := lockRclone(t, t.TempDir(), "")
+	code, _ := runConditionalLocked(t, s3, path)
+	if code != exitLockHeld || synced(readCalls(t, calls)) {
+		t.Errorf("run = %d, want %d without a sync", code, exitLockHeld)
+	}
+	if got := s3.ops("PutObject", "DeleteObjects"); len(got) != 0 {
+		t.Errorf("requests %q for the lock of another run", got)
+	}
+}
+
+func TestLockConditionalBreakStale(t *testing.T) {
+	s3 := newFakeS3(t, "dest-bucket")
+	stale := putLock(s3, time.Now().Add(-time.Minute))
+	path, calls := lockRclone(t, t.TempDir(), "")
+	code, entries := runConditionalLocked(t, s3, path)
+	if code != 0 || !synced(readCalls(t, calls)) {
+		t.Fatalf("run = %d, want a sync after breaking the stale lock", code)
+	}
+	// The stale lock is only replaced as it was read.
+	if puts := s3.received("PutObject"); len(puts) != 1 || puts[0].header.Get("If-Match") != `"`+stale.etag+`"` {
+		t.Errorf("PutObject requests %+v, want If-Match the stale lock", puts)
+	}
+	if findEntry(entries, "Breaking a stale lock left by a run that didn't release it") == nil {
+		t.Error("stale lock not logged")
+	}
+}
+
+func TestLockConditionalLostRace(t *testing.T) {
+	s3 := newFakeS3(t, "dest-bucket")
+	data, _ := json.Marshal(syncLock{Owner: "other", Hostname: "other-host", PID: 42, ExpiresAt: time.Now().Add(time.Hour)})
+	// Another run creates its lock between the read and the write, and the
+	// write fails its If-None-Match.
+	s3.fail = func(op, bucket, key string) (int, string) {
+		if op == "PutObject" && s3.buckets[bucket][key] == nil {
+			s3.buckets[bucket][key] = &fakeObject{data: data, etag: "other"}
+		}
+		return 0, ""
+	}
+	path, calls := lockRclone(t, t.TempDir(), "")
+	code, entries := runConditionalLocked(t, s3, path)
+	if code != exitLockHeld || synced(readCalls(t, calls)) {
+		t.Errorf("run = %d, want %d without a sync", code, exitLockHeld)
+	}
+	e := findEntry(entries, "S3 sync job failed")
+	if e == nil || !strings.Contains(e["error"].(string), "another sync holds the lock "+lockPath+": other-host (pid 42)") {
+		t.Errorf("failure logged as %v", e)
+	}
+}
+
+func TestLockConditionalTakenOver(t *testing.T) {
+	s3 := newFakeS3(t, "dest-bucket")
+	data, _ := json.Marshal(syncLock{Owner: "other", Hostname: "other-host", PID: 42, ExpiresAt: time.Now().Add(time.Hour)})
+	// Another run takes the lock over before it is released.
+	reads := 0
+	s3.fail = func(op, bucket, key string) (int, string) {
+		if op == "GetObject" && key == "locks/media" {
+			if reads++; reads == 2 {
+				s3.buckets[bucket][key] = &fakeObject{data: data, etag: "other"}
+			}
+		}
+		return 0, ""
+	}
+	path, _ := lockRclone(t, t.TempDir(), "")
+	code, entries := runConditionalLocked(t, s3, path)
+	if code != 0 {
+		t.Fatalf("run = %d, want 0", code)
+	}
+	if o := s3.object("dest-bucket", "locks/media"); o == nil || o.etag != "other" {
+		t.Errorf("lock after the run = %+v, want the other run's", o)
+	}
+	if findEntry(entries, "The sync lock was taken over by another run, leaving it") == nil {
+		t.Error("takeover not logged")
+	}
+}
+
+func TestLockConditionalUnsupported(t *testing.T) {
+	s3 := newFakeS3(t, "dest-bucket")
+	s3.fail = func(op, bucket, key string) (int, string) {
+		if op == "PutObject" {
+			return http.StatusNotImplemented, "NotImplemented"
+		}
+		return 0, ""
+	}
+	dir := t.TempDir()
+	path, calls := lockRclone(t, dir, "")
+	code, entries := runConditionalLocked(t, s3, path)
+	if code != 0 || !synced(readCalls(t, calls)) {
+		t.Fatalf("run = %d, want a sync", code)
+	}
+	// The lock is taken through rclone instead.
+	if runs := lockCalls(t, calls); len(runs) < 2 || !strings.HasPrefix(runs[0], "cat ") || !strings.HasPrefix(runs[1], "rcat ") {
+		t.Errorf("rclone lock runs %q, want the lock read and written", runs)
+	}
+	if findEntry(entries, "The destination doesn't support conditional writes, reading the sync lock back instead") == nil {
+		t.Error("fallback not logged")
+	}
+	if lock := readLockFile(t, filepath.Join(dir, lockPath)); lock != nil {
+		t.Errorf("lock left after the run: %+v", lock)
+	}
+}
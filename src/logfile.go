@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// logFile is the LOG_FILE of the process, shared by every logger, or nil.
+var logFile *rotatingFile
+
+func validateLogFile(config *Config) error {
+	if config.LogFile == "" {
+		return nil
+	}
+	if config.LogFileMaxSize != "" && config.LogFileMaxSize != "0" {
+		if size, err := parseSize(config.LogFileMaxSize); err != nil || size < 1<<20 {
+			return fmt.Errorf("invalid LOG_FILE_MAX_SIZE %q: must be a size of at least 1M, or 0 to not rotate by size", config.LogFileMaxSize)
+		}
+	}
+	if config.LogFileMaxAge != "" {
+		if d, err := time.ParseDuration(config.LogFileMaxAge); err != nil || d < time.Minute {
+			return fmt.Errorf("invalid LOG_FILE_MAX_AGE %q: must be a duration of at least 1m", config.LogFileMaxAge)
+		}
+	}
+	if config.LogFileMaxBackups < 0 {
+		return fmt.Errorf("LOG_FILE_MAX_BACKUPS must not be negative, got %d", config.LogFileMaxBackups)
+	}
+	return nil
+}
+
+// openLogFile opens LOG_FILE, if set, for every logger of the process, and
+// reopens it on SIGHUP. It is called once at startup, so that a file that
+// can't be written is a configuration error.
+func openLogFile(config *Config) error {
+	if config.LogFile == "" {
+		return nil
+	}
+	f := &rotatingFile{path: config.LogFile, maxBackups: config.LogFileMaxBackups}
+	if config.LogFileMaxSize != "" && config.LogFileMaxSize != "0" {
+		f.maxSize, _ = parseSize(config.LogFileMaxSize)
+	}
+	if config.LogFileMaxAge != "" {
+		f.maxAge, _ = time.ParseDuration(config.LogFileMaxAge)
+	}
+	if err := f.open(); err != nil {
+		return fmt.Errorf("failed to open LOG_FILE: %w", err)
+	}
+	logFile = f
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if err := f.reopen(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to reopen LOG_FILE on SIGHUP: %v\n", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// logOutput is where the logs, and rclone output that isn't a log entry,
+// are written: stderr, and LOG_FILE if set.
+func logOutput() io.Writer {
+	if logFile == nil {
+		return scrubWriter{os.Stderr}
+	}
+	return scrubWriter{io.MultiWriter(os.Stderr, logFile)}
+}
+
+// rotatingFile is an append-only log file that is rotated once it reaches
+// maxSize bytes or was started maxAge ago: the file becomes path.1, older
+// ones move up to path.<maxBackups> and the oldest is deleted. SIGHUP
+// reopens it instead, for rotation by an external logrotate.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time
+}
+
+// Write never fails the caller: a write error is reported on stderr, which
+// gets every entry too.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.maxAge > 0 && time.Since(f.started) >= f.maxAge)) {
+		if err := f.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate LOG_FILE: %v\n", err)
+		}
+	}
+	if f.file == nil {
+		return len(p), nil
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write LOG_FILE: %v\n", err)
+	}
+	return len(p), nil
+}
+
+func (f *rotatingFile) open() error {
+	if dir := filepath.Dir(f.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	// The age of a file carried over from an earlier process counts from
+	// its last change, as its creation time isn't portable.
+	f.started = time.Now()
+	if f.size > 0 {
+		f.started = info.ModTime()
+	}
+	return nil
+}
+
+func (f *rotatingFile) reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return f.open()
+	}
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil && !os.IsNotExist(err) {
+		f.open()
+		return err
+	}
+	return f.open()
+}
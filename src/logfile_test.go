@@ -0,0 +1,140 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateLogFile(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"LOG_FILE": "/var/log/s3-sync.log", "LOG_FILE_MAX_SIZE": "10M", "LOG_FILE_MAX_AGE": "24h", "LOG_FILE_MAX_BACKUPS": "0"}, ""},
+		{map[string]string{"LOG_FILE": "/var/log/s3-sync.log", "LOG_FILE_MAX_SIZE": "0"}, ""},
+		{map[string]string{"LOG_FILE": "/var/log/s3-sync.log", "LOG_FILE_MAX_SIZE": "512k"}, `invalid LOG_FILE_MAX_SIZE "512k": must be a size of at least 1M`},
+		{map[string]string{"LOG_FILE": "/var/log/s3-sync.log", "LOG_FILE_MAX_AGE": "30s"}, `invalid LOG_FILE_MAX_AGE "30s": must be a duration of at least 1m`},
+		{map[string]string{"LOG_FILE": "/var/log/s3-sync.log", "LOG_FILE_MAX_BACKUPS": "-1"}, "LOG_FILE_MAX_BACKUPS must not be negative, got -1"},
+		// Without LOG_FILE the other settings are not checked.
+		{map[string]string{"LOG_FILE_MAX_SIZE": "512k"}, ""},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+// readLog returns the content of path, or "" if it doesn't exist.
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "s3-sync.log")
+	f := &rotatingFile{path: path, maxSize: 10, maxBackups: 2}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		f.Write([]byte(line))
+	}
+	// Each line would take the file over 10 bytes, so each starts a new
+	// one, and only two backups are kept.
+	for file, want := range map[string]string{path: "fourth\n", path + ".1": "third\n", path + ".2": "second\n", path + ".3": ""} {
+		if got := readLog(t, file); got != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+
+	// A file carried over from an earlier process counts towards the size.
+	f = &rotatingFile{path: path, maxSize: 10, maxBackups: 2}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("fifth\n"))
+	if got := readLog(t, path+".1"); got != "fourth\n" {
+		t.Errorf("%s.1 = %q, want the earlier file", filepath.Base(path), got)
+	}
+}
+
+func TestRotatingFileNoBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s3-sync.log")
+	f := &rotatingFile{path: path, maxSize: 10}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("first line\n"))
+	f.Write([]byte("second\n"))
+	if got := readLog(t, path); got != "second\n" {
+		t.Errorf("log = %q, want it started over", got)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("%d files, want no backups", len(entries))
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s3-sync.log")
+	f := &rotatingFile{path: path, maxAge: time.Hour, maxBackups: 1}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("old\n"))
+	f.Write([]byte("recent\n"))
+	if got := readLog(t, path); got != "old\nrecent\n" {
+		t.Fatalf("log = %q, want no rotation within LOG_FILE_MAX_AGE", got)
+	}
+	f.started = time.Now().Add(-2 * time.Hour)
+	f.Write([]byte("new\n"))
+	if got, backup := readLog(t, path), readLog(t, path+".1"); got != "new\n" || backup != "old\nrecent\n" {
+		t.Errorf("log = %q and backup %q, want it rotated after LOG_FILE_MAX_AGE", got, backup)
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s3-sync.log")
+	f := &rotatingFile{path: path}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("before\n"))
+	// logrotate moves the file and sends SIGHUP.
+	if err := os.Rename(path, path+".rotated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("after\n"))
+	if got, moved := readLog(t, path), readLog(t, path+".rotated"); got != "after\n" || moved != "before\n" {
+		t.Errorf("log = %q and moved %q, want a new file after reopening", got, moved)
+	}
+}
+
+func TestLogFileRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s3-sync.log")
+	config, err := loadTestConfig(t, map[string]string{"LOG_FILE": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logFile = nil })
+	if err := openLogFile(config); err != nil {
+		t.Fatal(err)
+	}
+	out := captureOutput(t, func() {
+		logger := setupLogger(config)
+		logger.Info("Starting S3 sync job")
+	})
+	if got := readLog(t, path); got != out || !strings.Contains(got, "Starting S3 sync job") {
+		t.Errorf("LOG_FILE = %q, want the same entries as stderr, %q", got, out)
+	}
+
+	wantError(t, openLogFile(&Config{LogFile: filepath.Join(path, "nested.log")}), "failed to open LOG_FILE")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logFormats are the LOG_FORMAT values. Without one, text is used if the
+// logs go to a terminal and JSON otherwise.
+var logFormats = []string{"json", "text", "logfmt"}
+
+// textTimestampFormat keeps the timestamps of the text format short.
+const textTimestampFormat = "15:04:05"
+
+// timestampFormats are the names LOG_TIMESTAMP_FORMAT accepts besides a Go
+// time layout.
+var timestampFormats = map[string]string{
+	"rfc3339":     time.RFC3339,
+	"rfc3339nano": time.RFC3339Nano,
+}
+
+func validateLogFormat(config *Config) error {
+	if config.LogFormat != "" && !contains(logFormats, config.LogFormat) {
+		return fmt.Errorf("invalid LOG_FORMAT %q: must be one of %s", config.LogFormat, strings.Join(logFormats, ", "))
+	}
+	if layout := timestampFormat(config); layout != "" {
+		// A layout without a single field would print the same text for
+		// every entry.
+		if time.Unix(0, 0).UTC().Format(layout) == time.Unix(86400+3600+60+1, 0).UTC().Format(layout) {
+			return fmt.Errorf("invalid LOG_TIMESTAMP_FORMAT %q: must be rfc3339, rfc3339nano or a Go time layout like 2006-01-02T15:04:05.000Z07:00", config.LogTimestampFormat)
+		}
+	}
+	return nil
+}
+
+// timestampFormat returns the Go layout of LOG_TIMESTAMP_FORMAT, or "" for
+// the default of the log format.
+func timestampFormat(config *Config) string {
+	if layout, ok := timestampFormats[strings.ToLower(config.LogTimestampFormat)]; ok {
+		return layout
+	}
+	return config.LogTimestampFormat
+}
+
+// logFormat returns LOG_FORMAT, or text if stderr, where the logs go, is a
+// terminal and json otherwise.
+func logFormat(config *Config) string {
+	if config.LogFormat != "" {
+		return config.LogFormat
+	}
+	if isTerminal(os.Stderr) {
+		return "text"
+	}
+	return "json"
+}
+
+// isTerminal reports whether f is a character device, as terminals are;
+// files and pipes are not, and neither is /dev/null, which is one too.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
+
+func newLogFormatter(config *Config) logrus.Formatter {
+	layout := timestampFormat(config)
+	switch logFormat(config) {
+	case "text":
+		if layout == "" {
+			layout = textTimestampFormat
+		}
+		// LOG_FILE gets the same bytes as the terminal, without colors.
+		return &textFormatter{TextFormatter: logrus.TextFormatter{
+			ForceColors:     config.LogFile == "",
+			DisableColors:   config.LogFile != "",
+			FullTimestamp:   true,
+			TimestampFormat: layout,
+		}}
+	case "logfmt":
+		return &logrus.TextFormatter{
+			DisableColors:   true,
+			FullTimestamp:   true,
+			TimestampFormat: layout,
+		}
+	}
+	return &logrus.JSONFormatter{TimestampFormat: layout}
+}
+
+// textFormatter is the human-readable format for interactive runs. Routine
+// entries that come with many fields are shortened: rclone's progress to a
+// single line, and the effective configuration, which PRINT_CONFIG=only
+// shows readably, to its message.
+type textFormatter struct {
+	logrus.TextFormatter
+}
+
+func (f *textFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	switch entry.Message {
+	case "rclone stats":
+		short := *entry
+		short.Data = logrus.Fields{}
+		short.Message = progressLine(entry.Data)
+		return f.TextFormatter.Format(&short)
+	case "Effective configuration":
+		short := *entry
+		short.Data = logrus.Fields{}
+		return f.TextFormatter.Format(&short)
+	}
+	if entry.Data["component"] == "rclone" {
+		short := *entry
+		short.Data = make(logrus.Fields, len(entry.Data))
+		for k, v := range entry.Data {
+			if k != "component" {
+				short.Data[k] = v
+			}
+		}
+		short.Message = "rclone: " + entry.Message
+		return f.TextFormatter.Format(&short)
+	}
+	return f.TextFormatter.Format(entry)
+}
+
+// progressLine formats the fields of an rclone stats entry like
+// "rclone: 1.5Gi of 4.0Gi, 12 transferred, 340 checked, 2 errors, ETA 5m0s".
+func progressLine(data logrus.Fields) string {
+	count := func(key string) int64 {
+		n, _ := data[key].(int64)
+		return n
+	}
+	line := "rclone: " + formatSize(count("bytes"))
+	if total := count("total_bytes"); total > 0 {
+		line += " of " + formatSize(total)
+	}
+	line += fmt.Sprintf(", %d transferred, %d checked", count("transfers"), count("checks"))
+	if deletes := count("deletes"); deletes > 0 {
+		line += fmt.Sprintf(", %d deleted", deletes)
+	}
+	if errs := count("errors"); errs > 0 {
+		line += fmt.Sprintf(", %d errors", errs)
+	}
+	if eta, ok := data["eta"].(float64); ok {
+		line += ", ETA " + (time.Duration(eta) * time.Second).String()
+	}
+	return line
+}
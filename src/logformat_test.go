@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidateLogFormat(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"LOG_FORMAT": "logfmt", "LOG_TIMESTAMP_FORMAT": "RFC3339Nano"}, ""},
+		{map[string]string{"LOG_TIMESTAMP_FORMAT": "2006-01-02 15:04:05.000"}, ""},
+		{map[string]string{"LOG_FORMAT": "yaml"}, `invalid LOG_FORMAT "yaml": must be one of json, text, logfmt`},
+		{map[string]string{"LOG_TIMESTAMP_FORMAT": "iso8601"}, `invalid LOG_TIMESTAMP_FORMAT "iso8601": must be rfc3339, rfc3339nano or a Go time layout`},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestTimestampFormat(t *testing.T) {
+	for value, want := range map[string]string{
+		"":                 "",
+		"rfc3339":          time.RFC3339,
+		"RFC3339Nano":      time.RFC3339Nano,
+		"2006-01-02 15:04": "2006-01-02 15:04",
+	} {
+		if got := timestampFormat(&Config{LogTimestampFormat: value}); got != want {
+			t.Errorf("timestampFormat(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestIsTerminal(t *testing.T) {
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	file, err := os.Create(filepath.Join(t.TempDir(), "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if isTerminal(null) || isTerminal(file) {
+		t.Error("/dev/null or a file is taken for a terminal")
+	}
+	// The tests' stderr is no terminal either, so logs default to JSON.
+	captureOutput(t, func() {
+		if got := logFormat(&Config{}); got != "json" {
+			t.Errorf("logFormat = %q, want json", got)
+		}
+	})
+}
+
+// formatEntry formats an info entry with msg and data for config.
+func formatEntry(t *testing.T, config *Config, msg string, data logrus.Fields) string {
+	t.Helper()
+	entry := logrus.NewEntry(logrus.New()).WithFields(data)
+	entry.Time, entry.Level, entry.Message = time.Date(2024, 5, 1, 2, 3, 4, 5e6, time.UTC), logrus.InfoLevel, msg
+	out, err := newLogFormatter(config).Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestLogFormats(t *testing.T) {
+	data := logrus.Fields{"job": "media"}
+	for _, tt := range []struct {
+		config *Config
+		want   string
+	}{
+		{&Config{LogFormat: "json"}, `{"job":"media","level":"info","msg":"Starting","time":"2024-05-01T02:03:04Z"}` + "\n"},
+		{&Config{LogFormat: "json", LogTimestampFormat: "rfc3339nano"}, `"time":"2024-05-01T02:03:04.005Z"`},
+		{&Config{LogFormat: "logfmt"}, `time="2024-05-01T02:03:04Z" level=info msg=Starting job=media` + "\n"},
+		{&Config{LogFormat: "text", LogFile: "/var/log/s3-sync.log"}, `time="02:03:04" level=info msg=Starting job=media` + "\n"},
+	} {
+		if got := formatEntry(t, tt.config, "Starting", data); !strings.Contains(got, tt.want) {
+			t.Errorf("LOG_FORMAT=%s LOG_TIMESTAMP_FORMAT=%s: %q, want %q", tt.config.LogFormat, tt.config.LogTimestampFormat, got, tt.want)
+		}
+	}
+}
+
+func TestTextFormatter(t *testing.T) {
+	config := &Config{LogFormat: "text", LogFile: "/var/log/s3-sync.log"}
+	stats := logrus.Fields{"bytes": int64(1 << 30), "total_bytes": int64(4 << 30), "transfers": int64(12), "checks": int64(340), "errors": int64(2), "eta": 300.0}
+	if got := formatEntry(t, config, "rclone stats", stats); !strings.Contains(got, `msg="rclone: 1.0Gi of 4.0Gi, 12 transferred, 340 checked, 2 errors, ETA 5m0s"`+"\n") {
+		t.Errorf("stats = %q, want a progress line", got)
+	}
+	if got := formatEntry(t, config, "Effective configuration", logrus.Fields{"transfers": 4}); strings.Contains(got, "transfers") {
+		t.Errorf("configuration = %q, want only the message", got)
+	}
+	got := formatEntry(t, config, "a.txt: Copied (new)", logrus.Fields{"component": "rclone", "object": "a.txt"})
+	if !strings.Contains(got, `msg="rclone: a.txt: Copied (new)"`) || strings.Contains(got, "component") || !strings.Contains(got, "object=a.txt") {
+		t.Errorf("rclone entry = %q", got)
+	}
+	// Colors are for terminals only.
+	if got := formatEntry(t, &Config{LogFormat: "text"}, "Starting", nil); !strings.Contains(got, "\x1b[") {
+		t.Errorf("text without LOG_FILE = %q, want colors", got)
+	}
+}
+
+func TestProgressLine(t *testing.T) {
+	for _, tt := range []struct {
+		data logrus.Fields
+		want string
+	}{
+		{logrus.Fields{}, "rclone: 0.0, 0 transferred, 0 checked"},
+		{logrus.Fields{"bytes": int64(1536), "transfers": int64(1), "checks": int64(2), "deletes": int64(3)}, "rclone: 1.5Ki, 1 transferred, 2 checked, 3 deleted"},
+	} {
+		if got := progressLine(tt.data); got != tt.want {
+			t.Errorf("progressLine(%v) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
@@ -1,203 +1,1512 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 type Config struct {
-	SourceEndpoint      string
-	SourceAccessKey     string
-	SourceSecretKey     string
-	SourceBucket        string
-	DestEndpoint        string
-	DestAccessKey       string
-	DestSecretKey       string
-	DestBucket          string
-	DestPrefix          string
-	DryRun              bool
-	MaxDelete           int
-	Retries             int
-	BandwidthLimit      string
-	LogLevel            string
-}
-
-func loadConfig() (*Config, error) {
-	sourceBucket := getEnvOrDefault("SOURCE_BUCKET", "")
+	JobName                 string
+	RunID                   string
+	JobConcurrency          int
+	SplitBandwidthLimit     bool
+	ContinueOnError         bool
+	SourceBucketPattern     string
+	ExcludeBuckets          []string
+	ShardByPrefix           bool
+	ShardPrefixes           []string
+	Schedule                string
+	ShutdownGrace           string
+	SyncTimeout             string
+	CleanupMultipart        string
+	MultipartMaxAge         string
+	JobsTimeout             string
+	StartupJitter           string
+	ScheduleSplay           string
+	SQSQueueURL             string
+	SQSRegion               string
+	SQSAccessKey            string `secret:"true"`
+	SQSSecretKey            string `secret:"true"`
+	SQSBatchWindow          string
+	SQSVisibilityTimeout    string
+	HTTPAddr                string
+	HTTPToken               string `secret:"true"`
+	AllowQueue              bool
+	ReadyCheckTTL           string
+	DebugAddr               string
+	RcloneRCAddr            string
+	PushgatewayURL          string
+	PushgatewayJob          string
+	StatsDAddr              string
+	StatsDPrefix            string
+	StatsDTags              string
+	StatsDProgress          bool
+	SummaryFile             string
+	SlackWebhookURL         string `secret:"true"`
+	NotifyOn                string
+	NotifyTest              bool
+	SMTPHost                string
+	SMTPPort                int
+	SMTPTLS                 string
+	SMTPUsername            string
+	SMTPPassword            string `secret:"true"`
+	SMTPFrom                string
+	SMTPTo                  []string
+	HealthcheckURL          string `secret:"true"`
+	SentryDSN               string `secret:"true"`
+	SentryEnvironment       string
+	OTelEndpoint            string
+	OTelTracesEndpoint      string
+	OTelHeaders             string `secret:"true"`
+	OTelProtocol            string
+	OTelServiceName         string
+	WebhookURL              string `secret:"true"`
+	WebhookMethod           string
+	WebhookHeaders          string `secret:"true"`
+	WebhookBodyTemplate     string
+	WebhookToken            string `secret:"true"`
+	Source                  RemoteConfig
+	Dest                    RemoteConfig
+	SyncMode                string
+	DeleteStrategy          string
+	DeleteDisabled          bool
+	Immutable               bool
+	CompareMode             string
+	IgnoreCase              bool
+	UnicodeNormalization    string
+	TrackRenames            bool
+	TrackRenamesStrategy    string
+	ConfirmMove             bool
+	DryRun                  bool
+	MaxDelete               int
+	MaxDeletePercent        float64
+	MaxDeletePercentOnError string
+	MinSourceObjects        int
+	MaxShrinkPercent        float64
+	Force                   bool
+	IncludePatterns         []string
+	ExcludePatterns         []string
+	ExcludePrefixes         []string
+	FilterRules             []string
+	FilesFrom               string
+	MinAge                  string
+	MaxAge                  string
+	MinSize                 string
+	MaxSize                 string
+	AllowFilteredDelete     bool
+	BackupDir               string
+	BackupSuffix            string
+	VerifyAfterSync         bool
+	VerifyOnly              bool
+	PreserveMetadata        bool
+	PreserveTags            bool
+	ArchivedObjects         string
+	VerifyMetadataSample    int
+	ReportPrefix            string
+	Manifest                bool
+	LogTransfers            bool
+	StatsInterval           string
+	// Progress is nil when unset, for --progress only on a terminal.
+	Progress              *bool
+	ReportRetention       int
+	StateFile             string
+	Lock                  bool
+	LockKey               string
+	LockTTL               string
+	HeartbeatKey          string
+	HeartbeatInterval     string
+	PreSyncHook           []string
+	PostSyncHook          []string
+	PostFailureHook       []string
+	HookTimeout           string
+	PostHookFailure       string
+	Incremental           bool
+	IncrementalMargin     string
+	FullSyncEvery         string
+	DiffReportFile        string
+	DiffKeyLimit          int
+	FailOnDiff            bool
+	Confirm               bool
+	ConfirmTokenFile      string
+	ConfirmTimeout        string
+	Retries               int
+	RunRetries            int
+	RunRetryBackoff       string
+	MaxTransfer           string
+	MaxDuration           string
+	CutoffMode            string
+	TPSLimit              float64
+	TPSLimitBurst         int
+	TransferOrder         string
+	MemoryProfile         string
+	Transfers             int
+	FastList              bool
+	ExpectedObjectCount   int
+	Checkers              int
+	MaxConcurrency        int
+	BandwidthLimit        string
+	BandwidthLimitPerFile bool
+	BufferSize            string
+	UseMmap               bool
+	UploadChunkSize       string
+	UploadCutoff          string
+	UploadConcurrency     int
+	CopyCutoff            string
+	ExpectedMaxObjectSize string
+	LogLevel              string
+	LogFormat             string
+	LogTimestampFormat    string
+	LogFile               string
+	LogFileMaxSize        string
+	LogFileMaxBackups     int
+	LogFileMaxAge         string
+	PrintConfig           string
+	ValidateOnly          bool
+	Engine                string
+	RcloneConfigMode      string
+	RcloneConfigDir       string
+	RclonePath            string
+	MinRcloneVersion      string
+	RcloneExtraArgs       []string
+
+	// warnings are noticed while loading and logged once the logger exists.
+	warnings      []string
+	maxDeleteSet  bool
+	destPrefixSet bool
+	// filterFile holds FilterRules for --filter-from once it is written.
+	filterFile string
+	// filesFromFile holds the FilesFrom keys for --files-from-raw.
+	filesFromFile string
+	filesFromKeys int
+	// manifest records the keys rclone transferred when MANIFEST is set, or
+	// PRESERVE_TAGS needs them.
+	manifest *manifestWriter
+	// tags counts the objects PRESERVE_TAGS tagged.
+	tags *tagReport
+	// archived collects the archived objects ARCHIVED_OBJECTS skipped.
+	archived *archivedReport
+	// diff collects the changes a dry run would make.
+	diff *diffReport
+	// percentDeleteLimit is MAX_DELETE_PERCENT of the destination objects,
+	// counted at the start of the run.
+	percentDeleteLimit *int
+	// incrementalWindow is the --max-age of an incremental run, or 0 for a
+	// full sync.
+	incrementalWindow time.Duration
+	// jobsDeadline is the end of JOBS_TIMEOUT for the jobs of a multi-job
+	// run, or zero.
+	jobsDeadline time.Time
+	// webhookTemplate is WEBHOOK_BODY_TEMPLATE, parsed at startup.
+	webhookTemplate *template.Template
+	// heartbeat is set while the sync of a HEARTBEAT_KEY job runs.
+	heartbeat *heartbeat
+	// runID identifies the current run of the job, see startRun.
+	runID string
+	// traceParent is the root span of a multi-job run, and span the span
+	// of the job while it runs; both are nil without tracing.
+	traceParent *span
+	span        *span
+}
+
+// loadConfigs returns one configuration per sync job: the jobs defined by
+// SYNC_JOBS, indexed variables or several destinations, or a single job from
+// the plain settings. Bucket discovery and sharding need rclone, so for them
+// a single template is returned that main expands.
+func loadConfigs(args []string) ([]*Config, error) {
+	flags, err := parseFlags(args, os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	src := &configSource{flags: flags}
+
+	if path := src.getOrDefault("CONFIG_FILE", ""); path != "" {
+		if src.file, err = loadConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	jobs, err := loadJobs(src)
+	if err != nil {
+		return nil, fmt.Errorf("configuration parsing failed: %w", err)
+	}
+	pattern := src.getOrDefault("SOURCE_BUCKET_PATTERN", "")
+	if src.getBoolOrDefault("SHARD_BY_PREFIX", false) && (len(jobs) > 0 || pattern != "") {
+		return nil, fmt.Errorf("configuration validation failed: SHARD_BY_PREFIX shards a single sync and can't be combined with several jobs, destinations or SOURCE_BUCKET_PATTERN")
+	}
+	if src.getOrDefault("SQS_QUEUE_URL", "") != "" && (len(jobs) > 0 || pattern != "" || src.getBoolOrDefault("SHARD_BY_PREFIX", false)) {
+		return nil, fmt.Errorf("configuration validation failed: SQS_QUEUE_URL applies events to a single sync and can't be combined with several jobs, destinations, SOURCE_BUCKET_PATTERN or SHARD_BY_PREFIX")
+	}
+	if pattern != "" {
+		if len(jobs) > 0 || src.isSet("SOURCE_BUCKET") {
+			return nil, fmt.Errorf("configuration validation failed: SOURCE_BUCKET_PATTERN can't be combined with SOURCE_BUCKET, SYNC_JOBS, indexed jobs or several destinations")
+		}
+		template, err := loadConfig(&configSource{job: map[string]string{"SOURCE_BUCKET": pattern}, flags: src.flags, file: src.file})
+		if err != nil {
+			return nil, err
+		}
+		return []*Config{template}, nil
+	}
+	if len(jobs) == 0 {
+		config, err := loadConfig(src)
+		if err != nil {
+			return nil, err
+		}
+		return []*Config{config}, nil
+	}
+
+	var configs []*Config
+	var errs []error
+	names := make(map[string]bool, len(jobs))
+	for i, job := range jobs {
+		config, err := loadConfig(&configSource{job: job, flags: src.flags, file: src.file})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("job %s: %w", jobLabel(i, job), err))
+			continue
+		}
+		if config.JobName == "" {
+			config.JobName = config.Source.Bucket
+		}
+		if names[config.JobName] {
+			errs = append(errs, fmt.Errorf("job name %q is used more than once; set a distinct name for each job", config.JobName))
+		}
+		names[config.JobName] = true
+		// With SPLIT_BWLIMIT, jobs running at the same time share the
+		// limit unless they set their own.
+		if _, own := job["BANDWIDTH_LIMIT"]; !own {
+			splitBandwidthLimit(config, len(jobs))
+		}
+		configs = append(configs, config)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	if err := validateJobDestinations(configs); err != nil {
+		return nil, fmt.Errorf("configuration validation failed: %w", err)
+	}
+	return configs, nil
+}
+
+// loadConfig builds and validates the configuration of a single job.
+func loadConfig(src *configSource) (*Config, error) {
+	var err error
+	source := loadRemote(src, "SOURCE")
+	source.Prefix = cleanPrefix(src.getOrDefault("SOURCE_PREFIX", ""))
+	dest := loadRemote(src, "DEST")
+	dest.Prefix = cleanPrefix(src.getOrDefaultAllowEmpty("DEST_PREFIX", defaultDestPrefix(source)))
+
+	var warnings []string
+	defaultScheme := strings.ToLower(src.getOrDefault("ENDPOINT_DEFAULT_SCHEME", "https"))
+	for _, r := range []struct {
+		side   string
+		remote *RemoteConfig
+	}{{"SOURCE", &source}, {"DEST", &dest}} {
+		endpoint, err := normalizeEndpoint(r.remote.Endpoint, defaultScheme)
+		if err != nil {
+			src.errs = append(src.errs, fmt.Errorf("%s_S3_ENDPOINT: %w", r.side, err))
+			continue
+		}
+		r.remote.Endpoint = endpoint
+		if strings.HasPrefix(endpoint, "http://") {
+			warnings = append(warnings, fmt.Sprintf("%s_S3_ENDPOINT uses plain http; credentials and data are sent unencrypted", r.side))
+		}
+	}
+
+	tokens := backupTokens(time.Now())
+	backupDir, err := expandTemplate("BACKUP_DIR", src.getOrDefault("BACKUP_DIR", ""), tokens)
+	if err != nil {
+		src.errs = append(src.errs, err)
+	}
+	backupSuffix, err := expandTemplate("BACKUP_SUFFIX", src.getOrDefault("BACKUP_SUFFIX", ""), tokens)
+	if err != nil {
+		src.errs = append(src.errs, err)
+	}
+
+	// The queue usually lives in the source account. With SOURCE_ROLE_ARN,
+	// in the role's account, so SQS uses the source's credentials as a
+	// whole rather than its keys.
+	var sqsCreds awsCredentials
+	if source.RoleARN == "" {
+		sqsCreds = awsCredentials{accessKey: source.AccessKey, secretKey: source.SecretKey}
+	}
+	if src.isSet("SQS_ACCESS_KEY") || src.isSet("SQS_ACCESS_KEY_FILE") {
+		sqsCreds = awsCredentials{accessKey: src.getSecret("SQS_ACCESS_KEY"), secretKey: src.getSecret("SQS_SECRET_KEY")}
+	}
+
+	immutable := src.getBoolOrDefault("IMMUTABLE", false)
+	defaultSyncMode := "sync"
+	if immutable {
+		defaultSyncMode = "copy"
+	}
+	syncMode := strings.ToLower(src.getOrDefault("SYNC_MODE", defaultSyncMode))
+	deleteDisabled := src.getBoolOrDefault("DELETE_DISABLED", false)
+	defaultDeleteStrategy := ""
+	if syncMode == "sync" {
+		defaultDeleteStrategy = "during"
+		if deleteDisabled {
+			defaultDeleteStrategy = "none"
+		}
+	}
+
+	// Explicit settings win over the preset, which only supplies defaults.
+	memoryProfileName := strings.ToLower(src.getOrDefault("MEMORY_PROFILE", ""))
+	profile, ok := memoryProfiles[memoryProfileName]
+	if !ok {
+		profile = memoryProfiles["default"]
+	}
+
+	filterSeparator := src.getOrDefaultAllowEmpty("FILTER_SEPARATOR", ",")
+	filterRules, err := parseFilterRules(src.getOrDefault("FILTER_FILE", ""))
+	if err != nil {
+		src.errs = append(src.errs, err)
+	}
+
 	config := &Config{
-		SourceEndpoint:  getEnvOrDefault("SOURCE_S3_ENDPOINT", ""),
-		SourceAccessKey: getEnvOrDefault("SOURCE_ACCESS_KEY", ""),
-		SourceSecretKey: getEnvOrDefault("SOURCE_SECRET_KEY", ""),
-		SourceBucket:    sourceBucket,
-		DestEndpoint:    getEnvOrDefault("DEST_S3_ENDPOINT", ""),
-		DestAccessKey:   getEnvOrDefault("DEST_ACCESS_KEY", ""),
-		DestSecretKey:   getEnvOrDefault("DEST_SECRET_KEY", ""),
-		DestBucket:      getEnvOrDefault("DEST_BUCKET", ""),
-		DestPrefix:      getEnvOrDefault("DEST_PREFIX", sourceBucket),
-		DryRun:          getEnvOrDefault("DRY_RUN", "false") == "true",
-		MaxDelete:       getEnvIntOrDefault("MAX_DELETE", 1000),
-		Retries:         getEnvIntOrDefault("RETRIES", 3),
-		BandwidthLimit:  cleanBandwidthLimit(getEnvOrDefault("BANDWIDTH_LIMIT", "")),
-		LogLevel:        getEnvOrDefault("LOG_LEVEL", "info"),
+		JobName:                 src.getOrDefault("JOB_NAME", ""),
+		RunID:                   strings.TrimSpace(src.getOrDefault("RUN_ID", "")),
+		JobConcurrency:          src.getIntOrDefault("JOB_CONCURRENCY", 1),
+		SplitBandwidthLimit:     src.getBoolOrDefault("SPLIT_BWLIMIT", false),
+		ContinueOnError:         src.getBoolOrDefault("CONTINUE_ON_ERROR", false),
+		SourceBucketPattern:     src.getOrDefault("SOURCE_BUCKET_PATTERN", ""),
+		ExcludeBuckets:          splitPatterns(src.getOrDefault("EXCLUDE_BUCKETS", ""), ","),
+		ShardByPrefix:           src.getBoolOrDefault("SHARD_BY_PREFIX", false),
+		ShardPrefixes:           splitPatterns(src.getOrDefault("SHARD_PREFIXES", ""), ","),
+		Schedule:                strings.TrimSpace(src.getOrDefault("SCHEDULE", "")),
+		ShutdownGrace:           strings.TrimSpace(src.getOrDefault("SHUTDOWN_GRACE", "30s")),
+		SyncTimeout:             src.getOrDefault("SYNC_TIMEOUT", ""),
+		CleanupMultipart:        multipartCleanupMode(src.getOrDefault("CLEANUP_MULTIPART", "false")),
+		MultipartMaxAge:         src.getOrDefault("MULTIPART_MAX_AGE", "24h"),
+		JobsTimeout:             src.getOrDefault("JOBS_TIMEOUT", ""),
+		StartupJitter:           strings.TrimSpace(src.getOrDefault("STARTUP_JITTER", "")),
+		ScheduleSplay:           strings.TrimSpace(src.getOrDefault("SCHEDULE_SPLAY", "")),
+		SQSQueueURL:             strings.TrimSpace(src.getOrDefault("SQS_QUEUE_URL", "")),
+		SQSRegion:               src.getOrDefault("SQS_REGION", ""),
+		SQSAccessKey:            sqsCreds.accessKey,
+		SQSSecretKey:            sqsCreds.secretKey,
+		SQSBatchWindow:          strings.TrimSpace(src.getOrDefault("SQS_BATCH_WINDOW", "30s")),
+		SQSVisibilityTimeout:    strings.TrimSpace(src.getOrDefault("SQS_VISIBILITY_TIMEOUT", "15m")),
+		HTTPAddr:                strings.TrimSpace(src.getOrDefault("HTTP_ADDR", "")),
+		HTTPToken:               src.getSecret("HTTP_TOKEN"),
+		AllowQueue:              src.getBoolOrDefault("ALLOW_QUEUE", false),
+		ReadyCheckTTL:           strings.TrimSpace(src.getOrDefault("READY_CHECK_TTL", "1m")),
+		DebugAddr:               strings.TrimSpace(src.getOrDefault("DEBUG_ADDR", "")),
+		RcloneRCAddr:            strings.TrimSpace(src.getOrDefault("RCLONE_RC_ADDR", "")),
+		PushgatewayURL:          strings.TrimSpace(src.getOrDefault("PUSHGATEWAY_URL", "")),
+		PushgatewayJob:          strings.TrimSpace(src.getOrDefault("PUSHGATEWAY_JOB", "s3-sync")),
+		StatsDAddr:              strings.TrimSpace(src.getOrDefault("STATSD_ADDR", "")),
+		StatsDPrefix:            strings.TrimSpace(src.getOrDefault("STATSD_PREFIX", "s3_sync")),
+		StatsDTags:              src.getOrDefault("STATSD_TAGS", ""),
+		StatsDProgress:          src.getBoolOrDefault("STATSD_PROGRESS", false),
+		SummaryFile:             src.getOrDefault("SUMMARY_FILE", ""),
+		SlackWebhookURL:         src.getSecret("SLACK_WEBHOOK_URL"),
+		NotifyOn:                strings.ToLower(src.getOrDefault("NOTIFY_ON", "failure")),
+		NotifyTest:              src.getBoolOrDefault("NOTIFY_TEST", false),
+		SMTPHost:                src.getOrDefault("SMTP_HOST", ""),
+		SMTPPort:                src.getIntOrDefault("SMTP_PORT", 0),
+		SMTPTLS:                 strings.ToLower(src.getOrDefault("SMTP_TLS", "starttls")),
+		SMTPUsername:            src.getOrDefault("SMTP_USERNAME", ""),
+		SMTPPassword:            src.getSecret("SMTP_PASSWORD"),
+		SMTPFrom:                src.getOrDefault("SMTP_FROM", "s3-sync@localhost"),
+		SMTPTo:                  splitPatterns(src.getOrDefault("SMTP_TO", ""), ","),
+		HealthcheckURL:          src.getSecret("HEALTHCHECK_URL"),
+		SentryDSN:               src.getSecret("SENTRY_DSN"),
+		SentryEnvironment:       src.getOrDefault("SENTRY_ENVIRONMENT", ""),
+		OTelEndpoint:            strings.TrimSpace(src.getOrDefault("OTEL_EXPORTER_OTLP_ENDPOINT", "")),
+		OTelTracesEndpoint:      strings.TrimSpace(src.getOrDefault("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")),
+		OTelHeaders:             src.getSecret("OTEL_EXPORTER_OTLP_HEADERS"),
+		OTelProtocol:            strings.ToLower(src.getOrDefault("OTEL_EXPORTER_OTLP_PROTOCOL", "")),
+		OTelServiceName:         src.getOrDefault("OTEL_SERVICE_NAME", "s3-sync"),
+		WebhookURL:              src.getSecret("WEBHOOK_URL"),
+		WebhookMethod:           strings.ToUpper(src.getOrDefault("WEBHOOK_METHOD", "POST")),
+		WebhookHeaders:          src.getSecret("WEBHOOK_HEADERS"),
+		WebhookBodyTemplate:     src.getOrDefault("WEBHOOK_BODY_TEMPLATE", ""),
+		WebhookToken:            src.getSecret("WEBHOOK_TOKEN"),
+		Source:                  source,
+		Dest:                    dest,
+		SyncMode:                syncMode,
+		Immutable:               immutable,
+		CompareMode:             strings.ToLower(src.getOrDefault("COMPARE_MODE", "checksum")),
+		IgnoreCase:              src.getBoolOrDefault("IGNORE_CASE", false),
+		UnicodeNormalization:    strings.ToLower(src.getOrDefault("UNICODE_NORMALIZATION", "")),
+		TrackRenames:            src.getBoolOrDefault("TRACK_RENAMES", false),
+		TrackRenamesStrategy:    strings.ToLower(src.getOrDefault("TRACK_RENAMES_STRATEGY", "")),
+		DeleteStrategy:          strings.TrimPrefix(strings.ToLower(src.getOrDefault("DELETE_STRATEGY", defaultDeleteStrategy)), "delete-"),
+		DeleteDisabled:          deleteDisabled,
+		ConfirmMove:             src.getBoolOrDefault("CONFIRM_MOVE", false),
+		DryRun:                  src.getBoolOrDefault("DRY_RUN", false),
+		MaxDelete:               src.getIntOrDefault("MAX_DELETE", 1000),
+		MaxDeletePercent:        src.getFloatOrDefault("MAX_DELETE_PERCENT", 0),
+		MaxDeletePercentOnError: strings.ToLower(src.getOrDefault("MAX_DELETE_PERCENT_ON_ERROR", "fail")),
+		MinSourceObjects:        src.getIntOrDefault("MIN_SOURCE_OBJECTS", 0),
+		MaxShrinkPercent:        src.getFloatOrDefault("MAX_SHRINK_PERCENT", 0),
+		Force:                   src.getBoolOrDefault("FORCE", false),
+		IncludePatterns:         splitPatterns(src.getOrDefault("INCLUDE_PATTERNS", ""), filterSeparator),
+		ExcludePatterns:         splitPatterns(src.getOrDefault("EXCLUDE_PATTERNS", ""), filterSeparator),
+		ExcludePrefixes:         splitPatterns(src.getOrDefault("EXCLUDE_PREFIXES", ""), filterSeparator),
+		FilterRules:             filterRules,
+		FilesFrom:               src.getOrDefault("FILES_FROM", ""),
+		MinAge:                  strings.TrimSpace(src.getOrDefault("MIN_AGE", "")),
+		MaxAge:                  strings.TrimSpace(src.getOrDefault("MAX_AGE", "")),
+		MinSize:                 strings.TrimSpace(src.getOrDefault("MIN_SIZE", "")),
+		MaxSize:                 strings.TrimSpace(src.getOrDefault("MAX_SIZE", "")),
+		AllowFilteredDelete:     src.getBoolOrDefault("ALLOW_FILTERED_DELETE", false),
+		BackupDir:               cleanPrefix(backupDir),
+		BackupSuffix:            backupSuffix,
+		VerifyAfterSync:         src.getBoolOrDefault("VERIFY_AFTER_SYNC", false),
+		VerifyOnly:              src.getBoolOrDefault("VERIFY_ONLY", false),
+		PreserveMetadata:        src.getBoolOrDefault("PRESERVE_METADATA", false),
+		PreserveTags:            src.getBoolOrDefault("PRESERVE_TAGS", false),
+		ArchivedObjects:         strings.ToLower(src.getOrDefault("ARCHIVED_OBJECTS", "fail")),
+		VerifyMetadataSample:    src.getIntOrDefault("VERIFY_METADATA_SAMPLE", 0),
+		ReportPrefix:            cleanPrefix(src.getOrDefault("REPORT_PREFIX", "")),
+		Manifest:                src.getBoolOrDefault("MANIFEST", false),
+		LogTransfers:            src.getBoolOrDefault("LOG_TRANSFERS", false),
+		StatsInterval:           src.getOrDefault("STATS_INTERVAL", "1m"),
+		Progress:                src.getOptionalBool("PROGRESS"),
+		ReportRetention:         src.getIntOrDefault("REPORT_RETENTION", 0),
+		StateFile:               src.getOrDefault("STATE_FILE", ""),
+		Lock:                    src.getBoolOrDefault("LOCK", false),
+		LockKey:                 cleanPrefix(src.getOrDefault("LOCK_KEY", "")),
+		LockTTL:                 src.getOrDefault("LOCK_TTL", "10m"),
+		HeartbeatKey:            cleanPrefix(src.getOrDefault("HEARTBEAT_KEY", "")),
+		HeartbeatInterval:       src.getOrDefault("HEARTBEAT_INTERVAL", "60s"),
+		PreSyncHook:             src.getWords("PRE_SYNC_HOOK"),
+		PostSyncHook:            src.getWords("POST_SYNC_HOOK"),
+		PostFailureHook:         src.getWords("POST_FAILURE_HOOK"),
+		HookTimeout:             src.getOrDefault("HOOK_TIMEOUT", "5m"),
+		PostHookFailure:         strings.ToLower(src.getOrDefault("POST_HOOK_FAILURE", "warn")),
+		Incremental:             src.getBoolOrDefault("INCREMENTAL", false),
+		IncrementalMargin:       src.getOrDefault("INCREMENTAL_MARGIN", "15m"),
+		FullSyncEvery:           src.getOrDefault("FULL_SYNC_EVERY", "24h"),
+		DiffReportFile:          src.getOrDefault("DIFF_REPORT_FILE", ""),
+		DiffKeyLimit:            src.getIntOrDefault("DIFF_KEY_LIMIT", 1000),
+		FailOnDiff:              src.getBoolOrDefault("FAIL_ON_DIFF", false),
+		Confirm:                 src.getBoolOrDefault("CONFIRM", false),
+		ConfirmTokenFile:        src.getOrDefault("CONFIRM_TOKEN_FILE", ""),
+		ConfirmTimeout:          src.getOrDefault("CONFIRM_TIMEOUT", "15m"),
+		Retries:                 src.getIntOrDefault("RETRIES", 3),
+		RunRetries:              src.getIntOrDefault("RUN_RETRIES", 0),
+		RunRetryBackoff:         src.getOrDefault("RUN_RETRY_BACKOFF", "30s"),
+		MaxTransfer:             strings.TrimSpace(src.getOrDefault("MAX_TRANSFER", "")),
+		MaxDuration:             strings.TrimSpace(src.getOrDefault("MAX_DURATION", "")),
+		CutoffMode:              strings.ToLower(src.getOrDefault("CUTOFF_MODE", "")),
+		TPSLimit:                src.getFloatOrDefault("TPS_LIMIT", 0),
+		TPSLimitBurst:           src.getIntOrDefault("TPS_LIMIT_BURST", 0),
+		TransferOrder:           strings.ToLower(strings.ReplaceAll(src.getOrDefault("TRANSFER_ORDER", ""), " ", "")),
+		MemoryProfile:           memoryProfileName,
+		Transfers:               src.getIntOrDefault("TRANSFERS", profile.transfers),
+		FastList:                src.getBoolOrDefault("FAST_LIST", false),
+		ExpectedObjectCount:     src.getIntOrDefault("EXPECTED_OBJECT_COUNT", 0),
+		Checkers:                src.getIntOrDefault("CHECKERS", profile.checkers),
+		MaxConcurrency:          src.getIntOrDefault("MAX_CONCURRENCY", 256),
+		BandwidthLimit:          cleanBandwidthLimit(src.getOrDefault("BANDWIDTH_LIMIT", "")),
+		BandwidthLimitPerFile:   src.getBoolOrDefault("BWLIMIT_FILE", false),
+		BufferSize:              strings.TrimSpace(src.getOrDefault("BUFFER_SIZE", profile.bufferSize)),
+		UseMmap:                 src.getBoolOrDefault("USE_MMAP", false),
+		UploadChunkSize:         strings.TrimSpace(src.getOrDefault("UPLOAD_CHUNK_SIZE", profile.chunkSize)),
+		UploadCutoff:            strings.TrimSpace(src.getOrDefault("UPLOAD_CUTOFF", "")),
+		UploadConcurrency:       src.getIntOrDefault("UPLOAD_CONCURRENCY", 0),
+		CopyCutoff:              strings.TrimSpace(src.getOrDefault("COPY_CUTOFF", "")),
+		ExpectedMaxObjectSize:   strings.TrimSpace(src.getOrDefault("EXPECTED_MAX_OBJECT_SIZE", "")),
+		LogLevel:                strings.ToLower(src.getOrDefault("LOG_LEVEL", "info")),
+		LogFormat:               strings.ToLower(src.getOrDefault("LOG_FORMAT", "")),
+		LogTimestampFormat:      src.getOrDefault("LOG_TIMESTAMP_FORMAT", ""),
+		LogFile:                 src.getOrDefault("LOG_FILE", ""),
+		LogFileMaxSize:          src.getOrDefault("LOG_FILE_MAX_SIZE", "100M"),
+		LogFileMaxBackups:       src.getIntOrDefault("LOG_FILE_MAX_BACKUPS", 5),
+		LogFileMaxAge:           src.getOrDefault("LOG_FILE_MAX_AGE", ""),
+		PrintConfig:             strings.ToLower(src.getOrDefault("PRINT_CONFIG", "")),
+		ValidateOnly:            src.getBoolOrDefault("VALIDATE_ONLY", false),
+		RcloneConfigMode:        strings.ToLower(src.getOrDefault("RCLONE_CONFIG_MODE", "env")),
+		RcloneConfigDir:         src.getOrDefault("RCLONE_CONFIG_DIR", os.TempDir()),
+		Engine:                  strings.ToLower(strings.TrimSpace(src.getOrDefault("ENGINE", "rclone"))),
+		RclonePath:              src.getOrDefault("RCLONE_PATH", "rclone"),
+		MinRcloneVersion:        src.getOrDefault("MIN_RCLONE_VERSION", "1.55.0"),
+		RcloneExtraArgs:         src.getWords("RCLONE_EXTRA_ARGS"),
+		warnings:                warnings,
+		maxDeleteSet:            src.isSet("MAX_DELETE"),
+		destPrefixSet:           src.present("DEST_PREFIX"),
 	}
 
+	config.warnings = append(config.warnings, keyMatchingWarnings(config)...)
+	if config.LogTransfers && config.LogLevel != "debug" && config.LogLevel != "trace" {
+		config.warnings = append(config.warnings, "LOG_TRANSFERS logs the transfers at debug level; set LOG_LEVEL=debug to see them")
+	}
+	if config.maxDeleteSet && config.MaxDelete == 0 {
+		config.warnings = append(config.warnings, "MAX_DELETE=0 allows no deletions at all (before, 0 meant no limit): a sync that would delete anything fails; "+
+			"set MAX_DELETE=-1 for no limit, or DELETE_DISABLED=true to skip deletions")
+	}
+	if config.CompareMode == "size-only" {
+		config.warnings = append(config.warnings, "COMPARE_MODE=size-only misses changes that keep an object's size; use it only when checksums are too expensive")
+		if config.TrackRenames && (config.TrackRenamesStrategy == "" || strings.Contains(config.TrackRenamesStrategy, "hash")) {
+			config.warnings = append(config.warnings, "TRACK_RENAMES matches renamed objects by hash, which rclone may not compare with COMPARE_MODE=size-only; "+
+				"renames can fall back to re-uploads (consider TRACK_RENAMES_STRATEGY=modtime or leaf)")
+		}
+	}
+
+	if err := src.err(); err != nil {
+		return nil, fmt.Errorf("configuration parsing failed: %w", err)
+	}
+
+	disableFilteredDeletes(config)
+
 	if err := validateConfig(config); err != nil {
 		return nil, fmt.Errorf("configuration validation failed: %w", err)
 	}
+	if warning := chunkSizeWarning(config); warning != "" {
+		config.warnings = append(config.warnings, warning)
+	}
+	if config.FastList {
+		config.warnings = append(config.warnings, fastListWarning(config.ExpectedObjectCount))
+	}
+	if config.TransferOrder != "" {
+		config.warnings = append(config.warnings, fmt.Sprintf("TRANSFER_ORDER=%s: rclone lists and sorts before it transfers, "+
+			"so transfers start later and the listing is held in memory much like with FAST_LIST", config.TransferOrder))
+	}
+	if config.VerifyAfterSync && contains(archiveStorageClasses, config.Dest.StorageClass) {
+		config.warnings = append(config.warnings, fmt.Sprintf("DEST_STORAGE_CLASS=%s objects can't be read until they are restored: "+
+			"VERIFY_AFTER_SYNC reads may fail or incur retrieval fees; consider GLACIER_IR", config.Dest.StorageClass))
+	}
 
 	return config, nil
 }
 
 func validateConfig(config *Config) error {
-	required := map[string]string{
-		"SOURCE_S3_ENDPOINT": config.SourceEndpoint,
-		"SOURCE_ACCESS_KEY":  config.SourceAccessKey,
-		"SOURCE_SECRET_KEY":  config.SourceSecretKey,
-		"SOURCE_BUCKET":      config.SourceBucket,
-		"DEST_S3_ENDPOINT":   config.DestEndpoint,
-		"DEST_ACCESS_KEY":    config.DestAccessKey,
-		"DEST_SECRET_KEY":    config.DestSecretKey,
-		"DEST_BUCKET":        config.DestBucket,
+	if err := validateRemote(config.Source, "SOURCE"); err != nil {
+		return err
+	}
+	if err := validateRemote(config.Dest, "DEST"); err != nil {
+		return err
 	}
 
-	for key, value := range required {
-		if value == "" {
-			return fmt.Errorf("required environment variable %s is not set", key)
+	if !contains(syncModes, config.SyncMode) {
+		return fmt.Errorf("invalid SYNC_MODE %q: must be one of %s", config.SyncMode, strings.Join(syncModes, ", "))
+	}
+	if config.SyncMode == "move" && config.Source.Anonymous {
+		return fmt.Errorf("SYNC_MODE=move deletes source objects, which SOURCE_ANONYMOUS can't")
+	}
+	if config.Immutable {
+		if config.SyncMode != "copy" {
+			return fmt.Errorf("IMMUTABLE=true only adds objects and cannot be combined with SYNC_MODE=%s", config.SyncMode)
 		}
+		if config.maxDeleteSet {
+			return fmt.Errorf("MAX_DELETE is irrelevant with IMMUTABLE=true, which never deletes; unset it")
+		}
+	}
+	if config.SyncMode == "sync" && !contains(deleteStrategies, config.DeleteStrategy) {
+		return fmt.Errorf("invalid DELETE_STRATEGY %q: must be one of %s", config.DeleteStrategy, strings.Join(deleteStrategies, ", "))
+	}
+	if config.SyncMode != "sync" && config.DeleteStrategy != "" {
+		return fmt.Errorf("DELETE_STRATEGY only applies to SYNC_MODE=sync")
+	}
+	if config.DeleteDisabled {
+		if config.SyncMode == "move" {
+			return fmt.Errorf("DELETE_DISABLED can't be combined with SYNC_MODE=move, which deletes every transferred object from the source")
+		}
+		if config.SyncMode == "sync" && config.DeleteStrategy != "none" {
+			return fmt.Errorf("DELETE_DISABLED=true turns deletions off, so DELETE_STRATEGY=%s has no effect; unset it", config.DeleteStrategy)
+		}
+		if config.maxDeleteSet {
+			return fmt.Errorf("MAX_DELETE has no effect with DELETE_DISABLED=true, which never deletes; unset it")
+		}
+	}
+	if (config.SyncMode == "copy" || config.DeleteStrategy == "none") && config.maxDeleteSet {
+		return fmt.Errorf("MAX_DELETE has no effect with SYNC_MODE=copy or DELETE_STRATEGY=none, which never delete; unset it")
+	}
+	// Dry runs delete nothing, so they may preview a move without the interlock.
+	if config.SyncMode == "move" && !config.ConfirmMove && !config.DryRun {
+		return fmt.Errorf("SYNC_MODE=move deletes source objects after transfer and cannot be undone; set CONFIRM_MOVE=true to proceed")
+	}
+
+	if err := validateAgeFilters(config); err != nil {
+		return err
+	}
+	if err := validateSizeFilters(config); err != nil {
+		return err
+	}
+
+	if len(config.FilterRules) > 0 && (len(config.IncludePatterns) > 0 || len(config.ExcludePatterns) > 0) {
+		return fmt.Errorf("FILTER_FILE cannot be combined with INCLUDE_PATTERNS or EXCLUDE_PATTERNS; put all rules in FILTER_FILE")
+	}
+
+	// rclone refuses a backup dir inside the destination path and vice versa.
+	if config.BackupDir != "" && prefixesOverlap(config.BackupDir, config.Dest.Prefix) {
+		return fmt.Errorf("BACKUP_DIR %q overlaps the destination %q; use a prefix outside DEST_PREFIX",
+			config.BackupDir, remotePath("dest", config.Dest.Bucket, config.Dest.Prefix))
 	}
 
+	if strings.Contains(config.BackupSuffix, "/") {
+		return fmt.Errorf("BACKUP_SUFFIX %q must not contain a slash", config.BackupSuffix)
+	}
+
+	if config.VerifyAfterSync && config.SyncMode == "move" {
+		return fmt.Errorf("VERIFY_AFTER_SYNC cannot be used with SYNC_MODE=move, which empties the source")
+	}
+
+	if _, ok := compareModeFlags[config.CompareMode]; !ok {
+		return fmt.Errorf("invalid COMPARE_MODE %q: must be checksum, size-only or modtime", config.CompareMode)
+	}
+
+	if config.UnicodeNormalization != "" && !contains(unicodeNormalizations, config.UnicodeNormalization) {
+		return fmt.Errorf("invalid UNICODE_NORMALIZATION %q: must be one of %s", config.UnicodeNormalization, strings.Join(unicodeNormalizations, ", "))
+	}
+
+	if err := validateTrackRenames(config); err != nil {
+		return err
+	}
+
+	if config.Retries < 0 {
+		return fmt.Errorf("RETRIES must not be negative, got %d", config.Retries)
+	}
+	if err := validateRunRetries(config); err != nil {
+		return err
+	}
+
+	if err := validateTransferOrder(config.TransferOrder); err != nil {
+		return err
+	}
+
+	if _, ok := memoryProfiles[config.MemoryProfile]; config.MemoryProfile != "" && !ok {
+		return fmt.Errorf("invalid MEMORY_PROFILE %q: must be low, default or high", config.MemoryProfile)
+	}
+
+	if config.ExpectedObjectCount < 0 {
+		return fmt.Errorf("EXPECTED_OBJECT_COUNT must not be negative, got %d", config.ExpectedObjectCount)
+	}
+
+	if err := validateBudget(config); err != nil {
+		return err
+	}
+
+	if config.TPSLimit < 0 || config.TPSLimitBurst < 0 {
+		return fmt.Errorf("TPS_LIMIT and TPS_LIMIT_BURST must not be negative")
+	}
+	if config.TPSLimitBurst > 0 && config.TPSLimit == 0 {
+		return fmt.Errorf("TPS_LIMIT_BURST requires TPS_LIMIT")
+	}
+
+	if err := validateBucketPatterns(config); err != nil {
+		return err
+	}
+	if err := validateSharding(config); err != nil {
+		return err
+	}
+	if config.Schedule != "" {
+		if _, err := parseSchedule(config.Schedule); err != nil {
+			return fmt.Errorf("invalid SCHEDULE %q: %w", config.Schedule, err)
+		}
+	}
+	if d, err := time.ParseDuration(config.ShutdownGrace); err != nil || d < 0 {
+		return fmt.Errorf("invalid SHUTDOWN_GRACE %q: must be a duration like 30s or 5m", config.ShutdownGrace)
+	}
+	if err := validateJitter(config); err != nil {
+		return err
+	}
+	if err := validateEvents(config); err != nil {
+		return err
+	}
+	if err := validateServer(config); err != nil {
+		return err
+	}
+	if err := validateDebug(config); err != nil {
+		return err
+	}
+	if err := validateMetrics(config); err != nil {
+		return err
+	}
+	if err := validateStatsD(config); err != nil {
+		return err
+	}
+	if err := validateReport(config); err != nil {
+		return err
+	}
+	if err := validateDiff(config); err != nil {
+		return err
+	}
+	if err := validateConfirm(config); err != nil {
+		return err
+	}
+	if err := validateDeletePercent(config); err != nil {
+		return err
+	}
+	if err := validateShrinkGuard(config); err != nil {
+		return err
+	}
+	if err := validateIncremental(config); err != nil {
+		return err
+	}
+	if err := validateLock(config); err != nil {
+		return err
+	}
+	if err := validateSyncTimeout(config); err != nil {
+		return err
+	}
+	if err := validateCleanup(config); err != nil {
+		return err
+	}
+	if err := validateNotify(config); err != nil {
+		return err
+	}
+	if err := validateWebhook(config); err != nil {
+		return err
+	}
+	if err := validateHealthcheck(config); err != nil {
+		return err
+	}
+	if err := validateSMTP(config); err != nil {
+		return err
+	}
+	if err := validateHeartbeat(config); err != nil {
+		return err
+	}
+	if err := validateHooks(config); err != nil {
+		return err
+	}
+	if err := validateSentry(config); err != nil {
+		return err
+	}
+	if err := validateRunID(config); err != nil {
+		return err
+	}
+	if err := validateTracing(config); err != nil {
+		return err
+	}
+	if err := validateEngine(config); err != nil {
+		return err
+	}
+	if err := validateMetadata(config); err != nil {
+		return err
+	}
+	if err := validateTags(config); err != nil {
+		return err
+	}
+	if err := validateArchived(config); err != nil {
+		return err
+	}
+
+	if config.JobConcurrency < 1 {
+		return fmt.Errorf("JOB_CONCURRENCY must be at least 1, got %d", config.JobConcurrency)
+	}
+
+	if config.MaxConcurrency < 1 {
+		return fmt.Errorf("MAX_CONCURRENCY must be at least 1, got %d", config.MaxConcurrency)
+	}
+	for _, c := range []struct {
+		key   string
+		value int
+	}{{"TRANSFERS", config.Transfers}, {"CHECKERS", config.Checkers}} {
+		if c.value < 1 || c.value > config.MaxConcurrency {
+			return fmt.Errorf("%s must be between 1 and MAX_CONCURRENCY (%d), got %d", c.key, config.MaxConcurrency, c.value)
+		}
+	}
+
+	if err := validateBandwidthLimit(config.BandwidthLimit); err != nil {
+		return err
+	}
+
+	if config.BandwidthLimitPerFile && config.BandwidthLimit == "" {
+		return fmt.Errorf("BWLIMIT_FILE requires BANDWIDTH_LIMIT")
+	}
+
+	if err := validateMultipart(config); err != nil {
+		return err
+	}
+
+	if !contains(logLevels, config.LogLevel) {
+		return fmt.Errorf("invalid LOG_LEVEL %q: must be one of %s", config.LogLevel, strings.Join(logLevels, ", "))
+	}
+	if err := validateLogFormat(config); err != nil {
+		return err
+	}
+	if err := validateLogFile(config); err != nil {
+		return err
+	}
+	if d, err := time.ParseDuration(config.StatsInterval); err != nil || d < time.Second {
+		return fmt.Errorf("invalid STATS_INTERVAL %q: must be a duration of at least 1s", config.StatsInterval)
+	}
+
+	if config.PrintConfig != "" && config.PrintConfig != "only" {
+		return fmt.Errorf("invalid PRINT_CONFIG %q: the only supported value is \"only\"", config.PrintConfig)
+	}
+
+	if config.RcloneConfigMode != "env" && config.RcloneConfigMode != "file" {
+		return fmt.Errorf("invalid RCLONE_CONFIG_MODE %q: must be env or file", config.RcloneConfigMode)
+	}
+
+	if _, err := parseRcloneVersion(config.MinRcloneVersion); err != nil {
+		return fmt.Errorf("invalid MIN_RCLONE_VERSION: %w", err)
+	}
+
+	for _, arg := range config.RcloneExtraArgs {
+		name, _, _ := strings.Cut(arg, "=")
+		for _, reserved := range reservedRcloneArgs {
+			if name == reserved {
+				return fmt.Errorf("RCLONE_EXTRA_ARGS must not contain %s, it is managed by s3-sync", reserved)
+			}
+		}
+	}
+
+	return nil
+}
+
+// trackRenamesStrategies are the building blocks of TRACK_RENAMES_STRATEGY.
+var trackRenamesStrategies = []string{"hash", "modtime", "leaf"}
+
+func validateTrackRenames(config *Config) error {
+	if config.TrackRenamesStrategy != "" && !config.TrackRenames {
+		return fmt.Errorf("TRACK_RENAMES_STRATEGY requires TRACK_RENAMES=true")
+	}
+	if !config.TrackRenames {
+		return nil
+	}
+	// rclone rejects --track-renames for copy and move in some versions, and
+	// with nothing being deleted there are no renames to detect anyway.
+	if config.SyncMode != "sync" || config.DeleteStrategy == "none" {
+		return fmt.Errorf("TRACK_RENAMES only works with SYNC_MODE=sync and deletions enabled")
+	}
+	if config.TrackRenamesStrategy == "" {
+		return nil
+	}
+	for _, strategy := range strings.Split(config.TrackRenamesStrategy, ",") {
+		if !contains(trackRenamesStrategies, strings.TrimSpace(strategy)) {
+			return fmt.Errorf("invalid TRACK_RENAMES_STRATEGY %q: must be a comma-separated list of %s",
+				config.TrackRenamesStrategy, strings.Join(trackRenamesStrategies, ", "))
+		}
+	}
 	return nil
 }
 
-func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
+// defaultDestPrefix is the destination prefix used when DEST_PREFIX is not
+// set: the source bucket name plus SOURCE_PREFIX.
+func defaultDestPrefix(source RemoteConfig) string {
+	if source.Prefix != "" {
+		return source.Bucket + "/" + source.Prefix
+	}
+	return source.Bucket
+}
+
+// configSource resolves setting values from the job's own settings,
+// command-line flags, the environment and the optional config file, in that
+// order of precedence. A setting that is present at a level wins even when
+// empty, e.g. an environment variable set to "" hides the config file's
+// value; most getters then apply their default, getOrDefaultAllowEmpty keeps
+// the empty value. Defaults are applied by the callers.
+type configSource struct {
+	job   map[string]string
+	flags map[string]string
+	file  map[string]string
+	errs  []error
+}
+
+func (s *configSource) layers() []func(string) (string, bool) {
+	return []func(string) (string, bool){
+		func(key string) (string, bool) { value, ok := s.job[key]; return value, ok },
+		func(key string) (string, bool) { value, ok := s.flags[key]; return value, ok },
+		os.LookupEnv,
+		func(key string) (string, bool) { value, ok := s.file[key]; return value, ok },
+	}
+}
+
+func (s *configSource) lookup(key string) (string, bool) {
+	for _, layer := range s.layers() {
+		if value, ok := layer(key); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func (s *configSource) isSet(key string) bool {
+	value, _ := s.lookup(key)
+	return value != ""
+}
+
+func (s *configSource) getOrDefault(key, defaultValue string) string {
+	if value, _ := s.lookup(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
 
-func getEnvIntOrDefault(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+// present reports whether key is set, counting a setting that is present
+// with an empty value, as getOrDefaultAllowEmpty does.
+func (s *configSource) present(key string) bool {
+	const unset = "\x00"
+	return s.getOrDefaultAllowEmpty(key, unset) != unset
+}
+
+// getOrDefaultAllowEmpty is like getOrDefault, but a setting that is present
+// with an empty value counts as explicitly empty instead of unset.
+func (s *configSource) getOrDefaultAllowEmpty(key, defaultValue string) string {
+	if value, ok := s.lookup(key); ok {
+		return value
+	}
+	return defaultValue
+}
+
+// getSecret returns the value of key, or the contents of the file named by
+// key_FILE so credentials can be mounted as Docker/Kubernetes secret files.
+// Setting both forms at the same level of precedence is an error.
+func (s *configSource) getSecret(key string) string {
+	fileKey := key + "_FILE"
+	for _, layer := range s.layers() {
+		value, hasValue := layer(key)
+		path, hasPath := layer(fileKey)
+		switch {
+		// An empty value next to the _FILE form, as templates tend to leave
+		// behind, is no conflict.
+		case hasValue && value != "" && hasPath:
+			s.errs = append(s.errs, fmt.Errorf("both %s and %s are set; use only one", key, fileKey))
+			return ""
+		case hasPath:
+			data, err := os.ReadFile(path)
+			if err != nil {
+				s.errs = append(s.errs, fmt.Errorf("failed to read %s: %w", fileKey, err))
+				return ""
+			}
+			return strings.TrimRight(string(data), "\r\n")
+		case hasValue:
+			return value
 		}
 	}
+	return ""
+}
+
+func (s *configSource) getIntOrDefault(key string, defaultValue int) int {
+	value, _ := s.lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+	intValue, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s=%q is not a valid integer", key, value))
+		return defaultValue
+	}
+	return intValue
+}
+
+func (s *configSource) getFloatOrDefault(key string, defaultValue float64) float64 {
+	value, _ := s.lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+	floatValue, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s=%q is not a valid number", key, value))
+		return defaultValue
+	}
+	return floatValue
+}
+
+func (s *configSource) getBoolOrDefault(key string, defaultValue bool) bool {
+	value, _ := s.lookup(key)
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "":
+		return defaultValue
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	}
+	s.errs = append(s.errs, fmt.Errorf("%s=%q is not a valid boolean (use true/false or 1/0)", key, value))
 	return defaultValue
 }
 
+// getOptionalBool is like getBoolOrDefault but returns nil when key is unset,
+// for settings where "not configured" must be distinguishable from false.
+func (s *configSource) getOptionalBool(key string) *bool {
+	if value, _ := s.lookup(key); value == "" {
+		return nil
+	}
+	b := s.getBoolOrDefault(key, false)
+	return &b
+}
+
+// getWords splits the value of key into arguments using shell quoting rules.
+func (s *configSource) getWords(key string) []string {
+	value, _ := s.lookup(key)
+	words, err := splitWords(value)
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("%s: %w", key, err))
+	}
+	return words
+}
+
+// err reports every malformed value seen so far, so that all typos are shown
+// in one go rather than one per run.
+func (s *configSource) err() error {
+	return errors.Join(s.errs...)
+}
+
+// cleanPrefix strips leading and trailing slashes and collapses repeated
+// slashes so prefixes can be joined into remote paths safely.
+func cleanPrefix(prefix string) string {
+	parts := strings.FieldsFunc(prefix, func(r rune) bool { return r == '/' })
+	return strings.Join(parts, "/")
+}
+
 func cleanBandwidthLimit(value string) string {
 	// Remove surrounding quotes and trim whitespace
 	cleaned := strings.Trim(strings.TrimSpace(value), "\"'")
 	return cleaned
 }
 
+// setupRemotes makes the source and dest remotes available to rclone. By
+// default they are passed through the environment; RCLONE_CONFIG_MODE=file
+// keeps the older behaviour of writing a temporary config file. The returned
+// cleanup function must be called when rclone is no longer needed.
+func setupRemotes(config *Config) (*rcloneRemotes, func(), error) {
+	remotes, cleanup := &rcloneRemotes{}, func() {}
+	if config.RcloneConfigMode == "file" {
+		configFile, removeConfig, err := createRcloneConfig(config)
+		if err != nil {
+			return nil, nil, err
+		}
+		remotes.configFile, cleanup = configFile, removeConfig
+	} else {
+		// Point rclone at an empty config so a stray rclone.conf in the
+		// container can't add options to our remotes.
+		remotes.env = append([]string{"RCLONE_CONFIG=" + os.DevNull}, renderRcloneEnv(config)...)
+	}
+	if err := remotes.refreshRoles(context.Background(), config); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return remotes, cleanup, nil
+}
 
-func createRcloneConfig(config *Config) (string, error) {
-	configDir := "/tmp/rclone-config"
-	if err := os.MkdirAll(configDir, 0700); err != nil {
-		return "", fmt.Errorf("failed to create rclone config directory: %w", err)
+// createRcloneConfig writes the rclone config into a fresh, private directory
+// under RcloneConfigDir, unique to this invocation. The returned cleanup
+// function removes the directory; it is safe to call more than once and also
+// runs if the process is interrupted.
+func createRcloneConfig(config *Config) (string, func(), error) {
+	if err := os.MkdirAll(config.RcloneConfigDir, 0700); err != nil {
+		return "", nil, fmt.Errorf("failed to create rclone config directory: %w", err)
+	}
+	configDir, err := os.MkdirTemp(config.RcloneConfigDir, "rclone-config-")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create rclone config directory: %w", err)
 	}
+	cleanup := removeOnExit(configDir)
 
 	configFile := filepath.Join(configDir, "rclone.conf")
-	configContent := fmt.Sprintf(`[source]
-type = s3
-provider = Other
-access_key_id = %s
-secret_access_key = %s
-endpoint = %s
-acl = private
+	if err := os.WriteFile(configFile, []byte(renderRcloneConfig(config)), 0600); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to write rclone config: %w", err)
+	}
+
+	return configFile, cleanup, nil
+}
+
+// reservedRcloneArgs are controlled by s3-sync itself and would conflict with
+// the generated command line if passed through RCLONE_EXTRA_ARGS.
+var reservedRcloneArgs = []string{"sync", "copy", "move", "--config", "--dry-run", "-n", "--backup-dir", "--suffix",
+	"--delete-during", "--delete-after", "--delete-before", "--immutable", "--metadata", "-M",
+	"--checksum", "-c", "--size-only", "--track-renames", "--track-renames-strategy",
+	"--filter-from", "--min-age", "--max-age", "--min-size", "--max-size",
+	"--files-from", "--files-from-raw", "--no-traverse",
+	"--ignore-case-sync", "--no-unicode-normalization", "--transfers", "--checkers", "--fast-list", "--tpslimit", "--tpslimit-burst",
+	"--bwlimit", "--bwlimit-file", "--order-by",
+	"--max-transfer", "--max-duration", "--cutoff-mode",
+	"--buffer-size", "--use-mmap", "--s3-chunk-size", "--s3-upload-cutoff", "--s3-upload-concurrency", "--s3-copy-cutoff"}
 
-[dest]
-type = s3
-provider = Other
-access_key_id = %s
-secret_access_key = %s
-endpoint = %s
-acl = private
-`, config.SourceAccessKey, config.SourceSecretKey, config.SourceEndpoint,
-		config.DestAccessKey, config.DestSecretKey, config.DestEndpoint)
+// syncModes are the supported SYNC_MODE values, each run as the rclone
+// subcommand of the same name: sync mirrors including deletions, copy never
+// deletes, and move removes source objects once transferred.
+var syncModes = []string{"sync", "copy", "move"}
 
-	if err := os.WriteFile(configFile, []byte(configContent), 0600); err != nil {
-		return "", fmt.Errorf("failed to write rclone config: %w", err)
+// compareModeFlags map COMPARE_MODE values to the rclone flag deciding
+// whether an object needs transferring. modtime is rclone's default of
+// comparing size and modification time.
+var compareModeFlags = map[string][]string{
+	"checksum":  {"--checksum"},
+	"size-only": {"--size-only"},
+	"modtime":   nil,
+}
+
+// fastListBytesPerObject is a rough estimate of the memory rclone needs per
+// object when holding a complete listing for --fast-list.
+const fastListBytesPerObject = 1024
+
+func fastListWarning(expectedObjects int) string {
+	if expectedObjects == 0 {
+		return "FAST_LIST keeps the complete listing in memory, roughly 1 KB per object; " +
+			"set EXPECTED_OBJECT_COUNT for an estimate and size the memory limit accordingly"
 	}
+	return fmt.Sprintf("FAST_LIST keeps the complete listing in memory, roughly 1 KB per object: "+
+		"about %s for %d objects; make sure the memory limit allows for it",
+		formatSize(int64(expectedObjects)*fastListBytesPerObject), expectedObjects)
+}
 
-	return configFile, nil
+// validateTransferOrder checks TRANSFER_ORDER against rclone's --order-by
+// syntax: a field (name, size or modtime), optionally followed by asc, desc
+// or mixed, and for mixed an optional percentage, e.g. "size,mixed,75".
+func validateTransferOrder(order string) error {
+	if order == "" {
+		return nil
+	}
+	parts := strings.Split(order, ",")
+	fail := func(reason string) error {
+		return fmt.Errorf("invalid TRANSFER_ORDER %q: %s; expected e.g. size,desc or modtime,asc", order, reason)
+	}
+	if !contains([]string{"name", "size", "modtime"}, parts[0]) {
+		return fail("the field must be name, size or modtime")
+	}
+	if len(parts) > 1 && !contains([]string{"asc", "ascending", "desc", "descending", "mixed"}, parts[1]) {
+		return fail("the direction must be asc, desc or mixed")
+	}
+	if len(parts) == 3 {
+		percent, err := strconv.Atoi(parts[2])
+		if parts[1] != "mixed" || err != nil || percent < 0 || percent > 100 {
+			return fail("only mixed takes a third part, a percentage from 0 to 100")
+		}
+	}
+	if len(parts) > 3 {
+		return fail("too many parts")
+	}
+	return nil
 }
 
-func runSync(config *Config, logger *logrus.Logger) error {
-	configFile, err := createRcloneConfig(config)
-	if err != nil {
-		return fmt.Errorf("failed to create rclone config: %w", err)
+// tpsArgs returns the flags limiting API transactions per second. Zero means
+// unlimited, rclone's default, rather than a limit of zero.
+func tpsArgs(config *Config) []string {
+	if config.TPSLimit == 0 {
+		return nil
+	}
+	args := []string{"--tpslimit", strconv.FormatFloat(config.TPSLimit, 'f', -1, 64)}
+	if config.TPSLimitBurst > 0 {
+		args = append(args, "--tpslimit-burst", strconv.Itoa(config.TPSLimitBurst))
 	}
-	defer os.Remove(configFile)
+	return args
+}
+
+// unicodeNormalizations are the UNICODE_NORMALIZATION values. rclone
+// compares keys in normalized form, so nfc and nfd select the same matching:
+// "é" as one code point equals "e" plus a combining accent. Keys are written
+// as they are in the source either way; off compares them byte by byte.
+var unicodeNormalizations = []string{"nfc", "nfd", "off"}
+
+// keyMatchingArgs returns the rclone flags deciding which source and
+// destination keys refer to the same object.
+func keyMatchingArgs(config *Config) []string {
+	var args []string
+	if config.IgnoreCase {
+		args = append(args, "--ignore-case-sync")
+	}
+	if config.UnicodeNormalization == "off" {
+		args = append(args, "--no-unicode-normalization")
+	}
+	return args
+}
+
+// keyMatchingWarnings describes the key equivalences in effect when they
+// were configured explicitly, as they decide which objects get replaced.
+func keyMatchingWarnings(config *Config) []string {
+	var warnings []string
+	if config.IgnoreCase {
+		warnings = append(warnings, "IGNORE_CASE is set: keys that differ only in case (photo.JPG, photo.jpg) are treated as the same object")
+	}
+	switch config.UnicodeNormalization {
+	case "nfc", "nfd":
+		warnings = append(warnings, "UNICODE_NORMALIZATION is set: keys that differ only in Unicode normal form "+
+			"(NFC from most systems, NFD from macOS) are treated as the same object; keys are written as they are named in the source")
+	case "off":
+		warnings = append(warnings, "UNICODE_NORMALIZATION=off: keys are compared byte by byte, so NFC and NFD spellings of a name are different objects")
+	}
+	return warnings
+}
 
-	sourceRemote := fmt.Sprintf("source:%s", config.SourceBucket)
-	destRemote := fmt.Sprintf("dest:%s/%s", config.DestBucket, config.DestPrefix)
+// deleteStrategies are the DELETE_STRATEGY values for SYNC_MODE=sync. The
+// first three select rclone's --delete-<strategy>; none skips deletions.
+var deleteStrategies = []string{"during", "after", "before", "none"}
+
+// remotePath builds an rclone path such as "source:bucket/some/prefix". The
+// prefix must already be cleaned; an empty prefix addresses the bucket root.
+func remotePath(remote, bucket, prefix string) string {
+	if prefix == "" {
+		return fmt.Sprintf("%s:%s", remote, bucket)
+	}
+	return fmt.Sprintf("%s:%s/%s", remote, bucket, prefix)
+}
+
+// syncArgs builds the rclone command line for the configured sync mode.
+func syncArgs(config *Config) []string {
+	subcommand := config.SyncMode
+	// Incremental runs only see recent objects, so they must not delete the
+	// others.
+	deletes := config.SyncMode == "sync" && config.DeleteStrategy != "none" && config.incrementalWindow == 0
+	if config.SyncMode == "sync" && !deletes {
+		// rclone sync cannot be told to skip deletions; copy is sync
+		// without them.
+		subcommand = "copy"
+	}
 
 	args := []string{
-		"sync",
-		sourceRemote,
-		destRemote,
-		"--config", configFile,
-		"--delete-during",
-		"--checksum",
+		subcommand,
+		remotePath("source", config.Source.Bucket, config.Source.Prefix),
+		remotePath("dest", config.Dest.Bucket, config.Dest.Prefix),
+	}
+
+	switch {
+	case deletes:
+		args = append(args, "--delete-"+config.DeleteStrategy)
+	case config.SyncMode == "move":
+		args = append(args, "--delete-empty-src-dirs")
+	}
+
+	args = append(args, compareModeFlags[config.CompareMode]...)
+	args = append(args, keyMatchingArgs(config)...)
+	if config.FastList {
+		args = append(args, "--fast-list")
+	}
+	if config.TransferOrder != "" {
+		args = append(args, "--order-by", config.TransferOrder)
+	}
+	args = append(args,
+		"--transfers", strconv.Itoa(config.Transfers),
+		"--checkers", strconv.Itoa(config.Checkers),
 		"--retries", strconv.Itoa(config.Retries),
-		"--stats", "1m",
-		"--stats-log-level", "INFO",
-		"--progress",
+		"--stats", config.StatsInterval,
+		// With --use-json-log the stats come as a JSON object that
+		// runSync can read, logged at NOTICE so that rclone's default
+		// verbosity shows them.
+		"--stats-log-level", "NOTICE",
+		"--use-json-log",
+	)
+	args = append(args, rcloneVerbosity(config)...)
+	if showProgress(config) {
+		args = append(args, "--progress")
 	}
 
 	if config.DryRun {
 		args = append(args, "--dry-run")
-		logger.Info("Running in dry-run mode - no changes will be made")
 	}
 
-	if config.MaxDelete > 0 {
-		args = append(args, "--max-delete", strconv.Itoa(config.MaxDelete))
+	if config.Immutable {
+		args = append(args, "--immutable")
+	}
+
+	if config.PreserveMetadata {
+		args = append(args, "--metadata")
+	}
+
+	if deletes && config.TrackRenames {
+		args = append(args, "--track-renames")
+		if config.TrackRenamesStrategy != "" {
+			args = append(args, "--track-renames-strategy", strings.ReplaceAll(config.TrackRenamesStrategy, " ", ""))
+		}
+	}
+
+	if limit, ok := deleteLimit(config); deletes && ok {
+		args = append(args, "--max-delete", strconv.Itoa(limit))
+	}
+
+	args = append(args, filterArgs(config)...)
+	args = append(args, incrementalArgs(config)...)
+
+	// With an explicit key list, looking the keys up directly is much
+	// cheaper than listing the whole destination.
+	if config.filesFromFile != "" {
+		args = append(args, "--no-traverse")
+	}
+
+	if config.BackupDir != "" {
+		args = append(args, "--backup-dir", remotePath("dest", config.Dest.Bucket, config.BackupDir))
+	}
+
+	// Without BACKUP_DIR, rclone renames replaced objects in place. Keeping
+	// the extension lets "a.jpg" become "a.<suffix>.jpg" rather than
+	// "a.jpg<suffix>".
+	if config.BackupSuffix != "" {
+		args = append(args, "--suffix", config.BackupSuffix, "--suffix-keep-extension")
 	}
 
 	if config.BandwidthLimit != "" {
-		args = append(args, "--bwlimit", config.BandwidthLimit)
+		flag := "--bwlimit"
+		if config.BandwidthLimitPerFile {
+			flag = "--bwlimit-file"
+		}
+		args = append(args, flag, config.BandwidthLimit)
+	}
+
+	args = append(args, tpsArgs(config)...)
+	args = append(args, budgetArgs(config)...)
+	args = append(args, multipartArgs(config)...)
+	args = append(args, rcArgs(config)...)
+
+	return append(args, config.RcloneExtraArgs...)
+}
+
+// runSync runs the sync and returns rclone's transfer counts, which are zero
+// if rclone logged no stats.
+func runSync(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) (RunStats, error) {
+	args := syncArgs(config)
+	sourceRemote, destRemote := args[1], args[2]
+
+	if config.DryRun {
+		logger.Info("Running in dry-run mode - no changes will be made")
 	}
 
 	logger.WithFields(logrus.Fields{
 		"source": sourceRemote,
 		"dest":   destRemote,
 		"args":   args,
+		"mode":   config.SyncMode,
 	}).Info("Starting rclone sync")
+	if config.RcloneRCAddr != "" {
+		logger.WithFields(logrus.Fields{
+			"rc_addr": config.RcloneRCAddr,
+			"hint":    "inspect the running sync with: rclone rc --url http://" + config.RcloneRCAddr + "/ core/stats",
+		}).Info("rclone remote control enabled")
+	}
 
-	cmd := exec.Command("rclone", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	stderr, rcloneOut := newLineTail(100), newRcloneLog(logger, logOutput())
+	rcloneOut.manifest, rcloneOut.diff, rcloneOut.archived = config.manifest, config.diff, config.archived
+	rcloneOut.logTransfers, rcloneOut.move = config.LogTransfers, config.SyncMode == "move"
+	config.heartbeat.track(rcloneOut)
+	if config.StatsDProgress {
+		rcloneOut.statsd = newStatsD(config)
+	}
+	cmd := remotes.command(config, args...)
+	cmd.Stdout = scrubWriter{os.Stdout}
+	cmd.Stderr = io.MultiWriter(stderr, rcloneOut)
+	logger.WithField("argv", cmd.Args).Debug("rclone command line")
 
+	ctx, cancel, timeout := syncContext(config)
+	defer cancel()
+	grace, _ := time.ParseDuration(config.ShutdownGrace)
 	start := time.Now()
-	err = cmd.Run()
+	err := shutdown.runContext(ctx, cmd, grace)
 	duration := time.Since(start)
+	stats, statsOK := rcloneOut.result()
 
-	logger.WithFields(logrus.Fields{
-		"duration": duration,
-		"success":  err == nil,
-	}).Info("Sync operation completed")
+	fields := logrus.Fields{
+		"duration":     duration,
+		"mode":         config.SyncMode,
+		"compare_mode": config.CompareMode,
+		"transfers":    config.Transfers,
+		"checkers":     config.Checkers,
+		"success":      err == nil,
+	}
+	if config.filesFromKeys > 0 {
+		fields["files_from_keys"] = config.filesFromKeys
+	}
+	if statsOK {
+		fields["bytes_transferred"] = stats.Bytes
+		fields["objects_transferred"] = stats.Transfers
+		fields["objects_checked"] = stats.Checks
+		fields["errors"] = stats.Errors
+		if config.SyncMode == "move" {
+			fields["source_objects_removed"] = stats.Deletes
+		} else {
+			fields["objects_deleted"] = stats.Deletes
+		}
+	}
+	logger.WithFields(fields).Info("Sync operation completed")
+
+	if throttled := stderr.count(throttlingMarkers...); throttled >= throttlingHintThreshold {
+		logger.WithFields(logrus.Fields{
+			"throttled_requests": throttled,
+			"hint":               "the provider is rate limiting requests; set TPS_LIMIT (and TPS_LIMIT_BURST) or lower TRANSFERS and CHECKERS",
+		}).Warn("rclone was throttled by the provider")
+	}
 
 	if err != nil {
-		return fmt.Errorf("rclone sync failed: %w", err)
+		var interruptedErr *interruptedError
+		if errors.As(err, &interruptedErr) {
+			return stats, err
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logger.WithFields(logrus.Fields{
+				"timeout":             timeout,
+				"bytes_transferred":   stats.Bytes,
+				"objects_transferred": stats.Transfers,
+				"objects_checked":     stats.Checks,
+			}).Error("The sync took too long and rclone was stopped; the counts are those of its last stats line")
+			return stats, &timeoutError{timeout: timeout, err: err}
+		}
+		if config.Immutable && stderr.contains("immutable file modified") {
+			logger.Error("IMMUTABLE is set but existing destination objects differ from the source; " +
+				"the affected keys are logged by rclone as \"immutable file modified\"")
+			return stats, &classError{class: "immutable", err: fmt.Errorf("rclone sync failed: existing destination objects would be modified: %w", err)}
+		}
+		if stderr.contains("NoSuchBucket") {
+			logger.WithField("hint", "NoSuchBucket is often caused by the wrong addressing style: "+
+				"set SOURCE_FORCE_PATH_STYLE/DEST_FORCE_PATH_STYLE to true for MinIO and older Ceph, "+
+				"or to false for AWS buckets with dots in their name").Warn("rclone could not find a bucket")
+		}
+		if budgetErr := asBudgetError(err); budgetErr != err {
+			return stats, budgetErr
+		}
+		if limitErr := asDeleteLimitError(config, err, stderr); limitErr != err {
+			return stats, limitErr
+		}
+		classes := rcloneOut.topErrors(3)
+		if onlyArchived(config, classes) {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				config.archived.rcloneExited(exitErr.ExitCode())
+			}
+			logger.WithField("archived_objects", config.archived.count()).Warn("rclone skipped archived source objects and synced the rest")
+			return stats, nil
+		}
+		if len(classes) > 0 {
+			logger.WithField("rclone_errors", classes).Error("rclone errors by class, most frequent first")
+		}
+		return stats, &rcloneError{classes: classes, lines: rcloneOut.lastErrors(), err: fmt.Errorf("rclone sync failed: %w", err)}
 	}
 
+	return stats, nil
+}
+
+// logLevels lists the accepted LOG_LEVEL values, most verbose first.
+var logLevels = []string{"trace", "debug", "info", "warn", "warning", "error"}
+
+// rcloneVerbosity returns the -v flags that make rclone log what LOG_LEVEL
+// shows: its INFO lines are re-emitted at debug level and its DEBUG lines at
+// trace. The manifest and LOG_TRANSFERS are built from the per-file lines,
+// which rclone logs at INFO, and the dry-run diff also needs its DEBUG
+// comparisons, so they raise the verbosity whatever the level. Quieter
+// levels don't pass -q, which would also hide the stats.
+func rcloneVerbosity(config *Config) []string {
+	switch {
+	case config.DryRun || config.LogLevel == "trace":
+		return []string{"-vv"}
+	case config.Manifest || config.LogTransfers || config.LogLevel == "debug" || config.PreserveTags:
+		return []string{"-v"}
+	}
 	return nil
 }
 
-func setupLogger(level string) *logrus.Logger {
+// showProgress reports whether rclone draws its progress: PROGRESS if set,
+// otherwise only when stdout is a terminal, as the redrawn lines would end
+// up in the collected logs.
+func showProgress(config *Config) bool {
+	if config.Progress != nil {
+		return *config.Progress
+	}
+	return isTerminal(os.Stdout)
+}
+
+func setupLogger(config *Config) *logrus.Logger {
 	logger := logrus.New()
-	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetFormatter(newLogFormatter(config))
+	logger.SetOutput(logOutput())
+	logger.AddHook(scrubHook{})
 
-	logLevel, err := logrus.ParseLevel(level)
+	logLevel, err := logrus.ParseLevel(config.LogLevel)
 	if err != nil {
 		logLevel = logrus.InfoLevel
 	}
@@ -207,24 +1516,546 @@ func setupLogger(level string) *logrus.Logger {
 }
 
 func main() {
-	config, err := loadConfig()
+	ended := make(chan int, 1)
+	go func() {
+		result, err := run(os.Args[1:])
+		if err != nil {
+			prefix := "Error"
+			if result.code == exitConfigError {
+				prefix = "Configuration error"
+			}
+			fmt.Fprintf(os.Stderr, "%s: %v\n", prefix, err)
+		}
+		ended <- result.code
+	}()
+	// A shutdown whose cleanup hangs exits without waiting for the run.
+	var code int
+	select {
+	case code = <-ended:
+	case code = <-shutdown.forced:
+	}
+	os.Exit(code)
+}
+
+// runResult is how run ended: code is the exit code the process exits with.
+type runResult struct {
+	code int
+}
+
+// run runs the process as configured by args. It never exits itself, so
+// that the deferred cleanup of every run, the lock release, summaries and
+// notifications have all happened once main exits with the code of the
+// result. The error is a failure that couldn't be logged, such as an invalid
+// configuration, for main to print; jobs log their own failures and only set
+// the code.
+func run(args []string) (runResult, error) {
+	configs, err := loadConfigs(args)
+	configLoaded = time.Now()
+	if errors.Is(err, flag.ErrHelp) {
+		return runResult{}, nil
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
-		os.Exit(1)
+		return runResult{code: exitConfigError}, err
 	}
 
-	logger := setupLogger(config.LogLevel)
+	scrubber.add(configs...)
+	defer reportPanic(configs[0])
+	if err := openLogFile(configs[0]); err != nil {
+		return runResult{code: exitConfigError}, err
+	}
 
-	logger.WithFields(logrus.Fields{
-		"source_bucket": config.SourceBucket,
-		"dest_bucket":   config.DestBucket,
-		"dest_prefix":   config.DestPrefix,
+	if configs[0].PrintConfig == "only" {
+		var printed interface{} = redactConfig(configs[0])
+		if len(configs) > 1 {
+			all := make([]map[string]interface{}, 0, len(configs))
+			for _, config := range configs {
+				all = append(all, redactConfig(config))
+			}
+			printed = all
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(printed); err != nil {
+			return runResult{code: 1}, fmt.Errorf("failed to print configuration: %w", err)
+		}
+		return runResult{}, nil
+	}
+
+	if configs[0].NotifyTest {
+		return runResult{code: runNotifyTest(configs)}, nil
+	}
+
+	startDebugServer(configs[0], setupLogger(configs[0]))
+	if !configs[0].ValidateOnly {
+		restoreStates(configs, setupLogger(configs[0]))
+	}
+	if code, interrupted := startupJitter(configs[0]); interrupted {
+		return runResult{code: code}, nil
+	}
+	defer handleShutdown(configs[0])()
+	if configs[0].HTTPAddr != "" && !configs[0].ValidateOnly {
+		return runResult{code: runServer(configs)}, nil
+	}
+	if configs[0].SQSQueueURL != "" && !configs[0].ValidateOnly {
+		return runResult{code: runEvents(configs)}, nil
+	}
+	if configs[0].Schedule != "" && !configs[0].ValidateOnly {
+		return runResult{code: runScheduled(configs)}, nil
+	}
+	code := runOnce(configs)
+	pushMetrics(configs[0], setupLogger(configs[0]))
+	return runResult{code: code}, nil
+}
+
+// runOnce runs the jobs once, expanding bucket discovery and sharding first,
+// and returns the process exit code.
+func runOnce(configs []*Config) int {
+	logger := setupLogger(configs[0])
+	if err := resetSummaryFile(configs[0]); err != nil {
+		logger.WithError(err).Warn("Run summaries will be appended to the previous ones")
+	}
+	switch {
+	case configs[0].SourceBucketPattern != "":
+		discovered, err := discoverJobs(configs[0], logger)
+		if err != nil {
+			logger.WithError(err).Error("Bucket discovery failed")
+			return exitCode(err)
+		}
+		if configs[0].DryRun {
+			logger.Info("DRY_RUN is set, showing the job plan without syncing")
+			return 0
+		}
+		return runJobs(discovered)
+	case configs[0].ShardByPrefix:
+		shards, err := shardJobs(configs[0], logger)
+		if err != nil {
+			logger.WithError(err).Error("Sharding failed")
+			return exitCode(err)
+		}
+		return runJobs(shards)
+	case len(configs) > 1:
+		return runJobs(configs)
+	}
+	if err := runJob(configs[0], logger); err != nil {
+		reportJobError(logger, err)
+		return exitCode(err)
+	}
+	return 0
+}
+
+// runJob runs a single sync job, or its access check or verification, and
+// returns once the temporary files it created have been removed. Sync runs
+// are recorded in the metrics.
+func runJob(config *Config, logger *logrus.Logger) (err error) {
+	defer reportPanic(config)
+	logger = startRun(config, logger)
+	start := time.Now()
+	var stats RunStats
+	config.span = startJobSpan(config, logger)
+	defer func() {
+		config.span.set("bytes", stats.Bytes)
+		config.span.set("transfers", stats.Transfers)
+		config.span.set("deletes", stats.Deletes)
+		config.span.end(err)
+		config.span = nil
+	}()
+	report := newRunSummary(config, start)
+	countRequests(config)
+	if !config.ValidateOnly && !config.VerifyOnly {
+		healthcheck := startHealthcheck(config, logger)
+		defer func() {
+			metrics.record(config, err, time.Since(start), stats)
+			recordStatsD(config, err, time.Since(start), stats)
+			report.finish(err, stats)
+			recordRequesterPays(config, report, stats, logger)
+			writeSummary(config, report, logger)
+			notify(config, report, logger)
+			captureFailure(config, report, err, logger)
+			healthcheck.finish(report)
+		}()
+	}
+
+	logger.WithFields(logrus.Fields(redactConfig(config))).Info("Effective configuration")
+	if config.MemoryProfile != "" {
+		logger.WithFields(logrus.Fields{
+			"memory_profile":    config.MemoryProfile,
+			"buffer_size":       config.BufferSize,
+			"transfers":         config.Transfers,
+			"checkers":          config.Checkers,
+			"upload_chunk_size": config.UploadChunkSize,
+		}).Info("Memory profile resolved; set these variables directly to fine-tune")
+	}
+	for _, warning := range config.warnings {
+		logger.Warn(warning)
+	}
+
+	preflight := config.span.child("preflight")
+	var version rcloneVersion
+	if config.Engine == "rclone" {
+		version, err = checkRcloneVersion(config)
+		if err != nil {
+			return preflight.fail(&classError{class: "preflight", err: fmt.Errorf("rclone preflight check failed: %w", err)})
+		}
+	}
+
+	if err := assumeRoles(config, logger); err != nil {
+		return preflight.fail(&classError{class: "preflight", err: err})
+	}
+
+	remotes, cleanup, err := setupRemotes(config)
+	if err != nil {
+		return preflight.fail(&classError{class: "setup", err: fmt.Errorf("failed to create rclone config: %w", err)})
+	}
+	defer cleanup()
+
+	if config.ValidateOnly {
+		if err := runAccessCheck(config, remotes, logger); err != nil {
+			return preflight.fail(err)
+		}
+		preflight.end(nil)
+		return nil
+	}
+	preflight.end(nil)
+
+	if rules := filterRules(config); len(rules) > 0 {
+		logger.WithField("filters", rules).Info("Filter rules")
+	}
+	filterFile, removeFilterFile, err := writeFilterFile(config)
+	if err != nil {
+		return &classError{class: "setup", err: fmt.Errorf("failed to write filter file: %w", err)}
+	}
+	defer removeFilterFile()
+	config.filterFile = filterFile
+
+	removeFilesFrom, err := prepareFilesFrom(config, remotes, logger)
+	if err != nil {
+		return &classError{class: "setup", err: fmt.Errorf("failed to load FILES_FROM: %w", err)}
+	}
+	defer removeFilesFrom()
+
+	if config.VerifyOnly {
+		logger.Info("VERIFY_ONLY is set, skipping the sync")
+		result, err := verify(config, remotes, logger)
+		if err != nil {
+			return err
+		}
+		logger.WithFields(result.fields()).Info("S3 verification job completed successfully")
+		return nil
+	}
+
+	startFields := logrus.Fields{
+		"source_bucket": config.Source.Bucket,
+		"source_prefix": config.Source.Prefix,
+		"dest_bucket":   config.Dest.Bucket,
+		"dest_prefix":   config.Dest.Prefix,
+		"mode":          config.SyncMode,
+		"immutable":     config.Immutable,
+		"transfers":     config.Transfers,
+		"checkers":      config.Checkers,
 		"dry_run":       config.DryRun,
-	}).Info("Starting S3 sync job")
+		"engine":        config.Engine,
+	}
+	if config.Engine == "rclone" {
+		startFields["rclone_version"] = version.String()
+	}
+	if config.DeleteStrategy != "" {
+		startFields["delete_strategy"] = config.DeleteStrategy
+	}
+	if config.TransferOrder != "" {
+		startFields["transfer_order"] = config.TransferOrder
+	}
+	if config.BackupDir != "" {
+		startFields["backup_dir"] = config.BackupDir
+	}
+	if config.BackupSuffix != "" {
+		startFields["backup_suffix"] = config.BackupSuffix
+	}
+	logger.WithFields(startFields).Info("Starting S3 sync job")
+
+	if config.Manifest || (config.PreserveTags && config.Engine == "rclone") {
+		manifest, removeManifest, err := createManifest(config)
+		if err != nil {
+			return &classError{class: "setup", err: fmt.Errorf("failed to create the manifest: %w", err)}
+		}
+		defer removeManifest()
+		config.manifest = manifest
+	}
+	lock, err := acquireLock(config, remotes, logger)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	// Runs before the remotes are cleaned up and the lock is released, so
+	// the report and state can be uploaded.
+	defer func() {
+		report.finish(err, stats)
+		uploadReport(config, remotes, report, logger)
+		recordState(config, remotes, report, logger)
+	}()
+	// Runs first, so that a POST_HOOK_FAILURE=fail hook fails the run.
+	defer func() {
+		if hookErr := runPostSyncHook(config, report, err, stats, logger); hookErr != nil {
+			err = hookErr
+		}
+	}()
+	if err := runPreSyncHook(config, logger); err != nil {
+		return err
+	}
+
+	if config.DryRun {
+		config.diff = newDiffReport(config.DiffKeyLimit)
+	}
+	planIncremental(config, remotes, logger)
+	report.Incremental = config.incrementalWindow > 0
+	if config.CleanupMultipart == "before" {
+		cleanupMultipart(config, remotes, logger)
+	}
+	estimate := config.span.child("estimate")
+	counts := newObjectCounts(config, remotes)
+	if err := checkSourceShrink(config, counts, logger); err != nil {
+		return estimate.fail(err)
+	}
+	if err := applyDeletePercent(config, counts, logger); err != nil {
+		return estimate.fail(err)
+	}
+	estimate.end(nil)
+	if limit, ok := deleteLimit(config); ok && config.SyncMode == "sync" && config.DeleteStrategy != "none" {
+		report.MaxDelete = &limit
+	}
+	if config.Confirm && !config.DryRun {
+		apply, err := planAndConfirm(config, remotes, logger)
+		if err != nil || !apply {
+			return err
+		}
+	}
+	config.heartbeat = startHeartbeat(config, remotes, logger)
+	if config.PreserveTags && !config.DryRun {
+		config.tags = &tagReport{}
+	}
+	if config.ArchivedObjects != "fail" {
+		config.archived = newArchivedReport()
+	}
+	syncSpan := config.span.child(config.Engine)
+	stats, err = runSyncWithRetries(config, remotes, report, logger)
+	syncSpan.set("bytes", stats.Bytes)
+	syncSpan.set("transfers", stats.Transfers)
+	syncSpan.set("attempts", report.Attempts)
+	syncSpan.end(err)
+	if config.tags != nil {
+		// Objects copied before a failure are tagged too, unless the run was
+		// interrupted.
+		if config.Engine == "rclone" && shutdown.err() == nil {
+			tagTransferred(config, logger)
+		}
+		config.tags.summarize(report)
+		config.tags = nil
+	}
+	if config.archived != nil {
+		config.archived.summarize(report)
+		config.archived = nil
+	}
+	config.heartbeat.finish(stats, err)
+	config.heartbeat = nil
+	if config.CleanupMultipart == "after" {
+		cleanupMultipart(config, remotes, logger)
+	}
+	if err != nil {
+		return err
+	}
+
+	summary := logrus.Fields{}
+	if config.diff != nil {
+		summary = config.diff.fields()
+		if config.DiffReportFile != "" {
+			path := jobPath(config, config.DiffReportFile)
+			if err := writeDiffReport(path, config.diff); err != nil {
+				return &classError{class: "setup", err: err}
+			}
+			summary["diff_report_file"] = path
+		}
+		if config.FailOnDiff && !config.diff.empty() {
+			return &diffError{report: config.diff}
+		}
+	}
+	switch {
+	case config.VerifyAfterSync && config.DryRun:
+		logger.Info("Skipping verification in dry-run mode, the destination was not changed")
+	case config.VerifyAfterSync:
+		result, err := verify(config, remotes, logger)
+		var verifyErr *verifyError
+		if err == nil || errors.As(err, &verifyErr) {
+			report.Verify = &result
+		}
+		if err != nil {
+			return err
+		}
+		summary = result.fields()
+	}
+	if config.VerifyMetadataSample > 0 && !config.DryRun {
+		runMetadataCheck(config, remotes, report, logger)
+	}
+
+	logger.WithFields(summary).Info("S3 sync job completed successfully")
+	return nil
+}
+
+// verify runs the verification pass and returns a verifyError if the
+// destination does not match the source.
+func verify(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) (verifyResult, error) {
+	span := config.span.child("verify")
+	result, err := runVerify(config, remotes, logger)
+	if err != nil {
+		return result, span.fail(&classError{class: "verification", err: fmt.Errorf("verification failed: %w", err)})
+	}
+	if !result.ok() {
+		return result, span.fail(&verifyError{result: result})
+	}
+	span.end(nil)
+	return result, nil
+}
 
-	if err := runSync(config, logger); err != nil {
-		logger.WithError(err).Fatal("Sync operation failed")
+// reportJobError logs why a job failed. Failed access checks have already
+// been logged per remote.
+func reportJobError(logger *logrus.Logger, err error) {
+	var budgetErr *budgetError
+	var verifyErr *verifyError
+	var diffErr *diffError
+	var checkErr *accessCheckError
+	var interruptedErr *interruptedError
+	var limitErr *deleteLimitError
+	switch {
+	case errors.As(err, &interruptedErr):
+		logger.WithError(err).Warn("S3 sync job interrupted")
+	case errors.As(err, &budgetErr):
+		logger.WithError(err).WithField("budget", budgetErr.budget).Warn("Budget exceeded, partial sync")
+	case errors.As(err, &limitErr):
+		logger.WithError(err).WithFields(logrus.Fields{
+			"max_delete":      limitErr.limit,
+			"skipped_deletes": limitErr.skipped,
+		}).Warn("Delete limit reached, deletions stopped; raise MAX_DELETE after checking that the deletions are intended")
+	case errors.As(err, &verifyErr):
+		logger.WithFields(verifyErr.result.fields()).Error("S3 sync job failed verification")
+	case errors.As(err, &diffErr):
+		logger.WithFields(diffErr.report.fields()).Error("Dry run found differences and FAIL_ON_DIFF is set")
+	case errors.As(err, &checkErr):
+	default:
+		entry := logger.WithError(err).WithField("error_class", errorClass(err))
+		if class := rcloneErrorClass(err); class != "" {
+			entry = entry.WithField("rclone_error_class", class)
+		}
+		entry.Error("S3 sync job failed")
 	}
+}
 
-	logger.Info("S3 sync job completed successfully")
-}
\ No newline at end of file
+// rcloneErrorClass returns the most frequent class of the errors rclone
+// logged before failing, or "".
+func rcloneErrorClass(err error) ErrorClass {
+	var rcloneErr *rcloneError
+	if errors.As(err, &rcloneErr) {
+		return rcloneErr.class()
+	}
+	return ""
+}
+
+// classError gives a job error its class for reports, where the error type
+// doesn't already tell.
+type classError struct {
+	class string
+	err   error
+}
+
+func (e *classError) Error() string { return e.err.Error() }
+
+func (e *classError) Unwrap() error { return e.err }
+
+// errorClass names the kind of a job failure: config, preflight, setup,
+// access, sync, immutable, budget, delete_limit, verification, drift, shrink,
+// lock, timeout, confirmation or interrupted.
+func errorClass(err error) string {
+	var interruptedErr *interruptedError
+	var budgetErr *budgetError
+	var limitErr *deleteLimitError
+	var verifyErr *verifyError
+	var diffErr *diffError
+	var shrinkErr *shrinkError
+	var lockErr *lockError
+	var timeoutErr *timeoutError
+	var checkErr *accessCheckError
+	var classErr *classError
+	switch {
+	case errors.As(err, &interruptedErr):
+		return "interrupted"
+	case errors.As(err, &budgetErr):
+		return "budget"
+	case errors.As(err, &limitErr):
+		return "delete_limit"
+	case errors.As(err, &verifyErr):
+		return "verification"
+	case errors.As(err, &diffErr):
+		return "drift"
+	case errors.As(err, &shrinkErr):
+		return "shrink"
+	case errors.As(err, &lockErr):
+		return "lock"
+	case errors.As(err, &timeoutErr):
+		return "timeout"
+	case errors.As(err, &checkErr):
+		return "access"
+	case errors.As(err, &classErr):
+		return classErr.class
+	}
+	return "sync"
+}
+
+// The exit codes of the process, which printUsage lists. 1 is any other
+// failure.
+const (
+	exitConfigError     = 2
+	exitPreflightFailed = 3
+	exitSyncFailed      = 4
+	exitPartialSync     = 5
+	exitVerifyFailed    = 6
+	exitInterrupted     = 7
+	exitLockHeld        = 8
+)
+
+// exitCode maps a job error to the process exit code. It is the one place
+// that does: checks that refuse to sync, such as the access check and the
+// shrink guard, count as a failed preflight, and a failed sync is 4 whatever
+// rclone's errors were; the summary's error_class and rclone_errors tell
+// them apart.
+func exitCode(err error) int {
+	var interruptedErr *interruptedError
+	var budgetErr *budgetError
+	var limitErr *deleteLimitError
+	var verifyErr *verifyError
+	var diffErr *diffError
+	var shrinkErr *shrinkError
+	var checkErr *accessCheckError
+	var lockErr *lockError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &interruptedErr):
+		return exitInterrupted
+	case errors.As(err, &budgetErr), errors.As(err, &limitErr):
+		return exitPartialSync
+	case errors.As(err, &verifyErr), errors.As(err, &diffErr):
+		return exitVerifyFailed
+	case errors.As(err, &shrinkErr), errors.As(err, &checkErr):
+		return exitPreflightFailed
+	case errors.As(err, &lockErr):
+		return exitLockHeld
+	}
+	switch errorClass(err) {
+	case "config":
+		return exitConfigError
+	case "preflight":
+		return exitPreflightFailed
+	case "lock":
+		return exitLockHeld
+	case "sync", "immutable", "timeout":
+		return exitSyncFailed
+	}
+	return 1
+}
@@ -0,0 +1,900 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRunOnceExpansionExitCodes(t *testing.T) {
+	discovery := map[string]string{"SOURCE_BUCKET_PATTERN": "media-*", "SOURCE_BUCKET": "", "DRY_RUN": "true"}
+	sharding := map[string]string{"SHARD_BY_PREFIX": "true"}
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		// lsjson is what rclone lsjson prints, or empty for a failing one.
+		lsjson string
+		want   int
+	}{
+		{"discovery", discovery, `[{"Path":"media-a","IsDir":true},{"Path":"logs","IsDir":true}]`, 0},
+		{"discovery without a match", discovery, `[{"Path":"logs","IsDir":true}]`, exitConfigError},
+		{"discovery unable to list", discovery, "", exitPreflightFailed},
+		{"sharding unable to list", sharding, "", exitPreflightFailed},
+		{"sharding without folders", sharding, `[]`, exitConfigError},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			script := `echo "AccessDenied: Access Denied" >&2; exit 1`
+			if tt.lsjson != "" {
+				script = `[ "$1" = lsjson ] && echo '` + tt.lsjson + `'; exit 0`
+			}
+			path, _ := fakeRclone(t, script)
+			env := map[string]string{"RCLONE_PATH": path, "LOG_LEVEL": "error"}
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			setTestEnv(t, withEnv(env))
+			configs, err := loadConfigs(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := runOnce(configs); got != tt.want {
+				t.Errorf("runOnce = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// storeRclone is an rclone stand-in keeping the objects cat, rcat and
+// deletefile work on as files under its directory. A sync fails with
+// rclone's exit code 1 when the file fail exists there.
+func storeRclone(t *testing.T) (path, calls string) {
+	return fakeRclone(t, `dir=$(dirname "$0")
+object="$dir/store/$(echo "$2" | tr : /)"
+case "$1" in
+version) echo "rclone v1.66.0" ;;
+cat) [ -f "$object" ] || exit 3; cat "$object" ;;
+rcat) mkdir -p "$(dirname "$object")"; cat > "$object" ;;
+deletefile) rm "$object" ;;
+sync|copy|move) [ -f "$dir/fail" ] && { echo "ERROR : a.txt: Failed to copy: corrupted on transfer" >&2; exit 1; } ;;
+esac
+exit 0`)
+}
+
+func TestRunLifecycle(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		fail   bool
+		code   int
+		result string
+	}{
+		{"success", false, 0, "success"},
+		{"failure", true, exitSyncFailed, "failure"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, calls := storeRclone(t)
+			dir := filepath.Dir(path)
+			if tt.fail {
+				if err := os.WriteFile(filepath.Join(dir, "fail"), nil, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var webhooks []map[string]interface{}
+			var mu sync.Mutex
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body map[string]interface{}
+				_ = json.NewDecoder(r.Body).Decode(&body)
+				mu.Lock()
+				webhooks = append(webhooks, body)
+				mu.Unlock()
+			}))
+			defer server.Close()
+			configDir, hookFile := t.TempDir(), filepath.Join(t.TempDir(), "hooks")
+			hook := func(name string) string {
+				return `sh -c 'echo ` + name + ` $S3_SYNC_RESULT >> ` + hookFile + `'`
+			}
+			setTestEnv(t, withEnv(map[string]string{
+				"RCLONE_PATH":        path,
+				"RCLONE_CONFIG_MODE": "file",
+				"RCLONE_CONFIG_DIR":  configDir,
+				"LOCK":               "true",
+				"LOCK_KEY":           "locks/sync.lock",
+				"WEBHOOK_URL":        server.URL,
+				"NOTIFY_ON":          "always",
+				"POST_SYNC_HOOK":     hook("post_sync"),
+				"POST_FAILURE_HOOK":  hook("post_failure"),
+				"LOG_LEVEL":          "error",
+			}))
+
+			result, err := run(nil)
+			if err != nil || result.code != tt.code {
+				t.Fatalf("run = %d, %v; want %d", result.code, err, tt.code)
+			}
+
+			// The temporary rclone config is removed.
+			if entries, _ := os.ReadDir(configDir); len(entries) != 0 {
+				t.Errorf("RCLONE_CONFIG_DIR still has %v", entries)
+			}
+			// The lock was taken and is released.
+			if runs := strings.Join(readCalls(t, calls), "\n"); !strings.Contains(runs, "rcat dest:dest-bucket/locks/sync.lock") || !strings.Contains(runs, "deletefile dest:dest-bucket/locks/sync.lock") {
+				t.Errorf("rclone runs don't take and release the lock:\n%s", runs)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "store/dest/dest-bucket/locks/sync.lock")); !os.IsNotExist(err) {
+				t.Errorf("the lock is left behind: %v", err)
+			}
+			// The hook of the outcome runs, and the webhook is notified.
+			hooks, _ := os.ReadFile(hookFile)
+			want := "post_sync success\n"
+			if tt.fail {
+				want = "post_failure failure\n"
+			}
+			if string(hooks) != want {
+				t.Errorf("hooks ran %q, want %q", hooks, want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(webhooks) != 1 || webhooks[0]["result"] != tt.result {
+				t.Errorf("webhook got %v, want one %s summary", webhooks, tt.result)
+			}
+		})
+	}
+}
+
+func TestGetIntOrDefault(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  int
+		err   string
+	}{
+		{"", 1000, ""},
+		{"25", 25, ""},
+		{" 25 ", 25, ""},
+		{"-1", -1, ""},
+		{"0", 0, ""},
+		{"10k", 1000, `MAX_DELETE="10k" is not a valid integer`},
+		{"three", 1000, `MAX_DELETE="three" is not a valid integer`},
+		{"2.5", 1000, `MAX_DELETE="2.5" is not a valid integer`},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			src := &configSource{job: map[string]string{"MAX_DELETE": tt.value}}
+			if got := src.getIntOrDefault("MAX_DELETE", 1000); got != tt.want {
+				t.Errorf("getIntOrDefault = %d, want %d", got, tt.want)
+			}
+			wantError(t, src.err(), tt.err)
+		})
+	}
+}
+
+func TestGetBoolOrDefault(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  bool
+		err   string
+	}{
+		{"", true, ""},
+		{"true", true, ""},
+		{"TRUE", true, ""},
+		{"1", true, ""},
+		{"false", false, ""},
+		{" 0 ", false, ""},
+		{"yes", true, `DRY_RUN="yes" is not a valid boolean`},
+		{"-1", true, `DRY_RUN="-1" is not a valid boolean`},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			src := &configSource{job: map[string]string{"DRY_RUN": tt.value}}
+			if got := src.getBoolOrDefault("DRY_RUN", true); got != tt.want {
+				t.Errorf("getBoolOrDefault = %v, want %v", got, tt.want)
+			}
+			wantError(t, src.err(), tt.err)
+		})
+	}
+}
+
+func TestMalformedValuesFailLoading(t *testing.T) {
+	// Every malformed value is reported at once.
+	_, err := loadTestConfig(t, map[string]string{"MAX_DELETE": "10k", "RETRIES": "three", "DRY_RUN": "yes"})
+	for _, want := range []string{`MAX_DELETE="10k"`, `RETRIES="three"`, `DRY_RUN="yes"`} {
+		wantError(t, err, want)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  logrus.Level
+		err   string
+	}{
+		{"", logrus.InfoLevel, ""},
+		{"trace", logrus.TraceLevel, ""},
+		{"DEBUG", logrus.DebugLevel, ""},
+		{"Warn", logrus.WarnLevel, ""},
+		{"warning", logrus.WarnLevel, ""},
+		{"error", logrus.ErrorLevel, ""},
+		{"verbose", 0, `invalid LOG_LEVEL "verbose": must be one of trace, debug, info, warn, warning, error`},
+		{"fatal", 0, `invalid LOG_LEVEL "fatal"`},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			config, err := loadTestConfig(t, map[string]string{"LOG_LEVEL": tt.value})
+			wantError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			if got := setupLogger(config).GetLevel(); got != tt.want {
+				t.Errorf("logger level = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourcePrefix(t *testing.T) {
+	for _, tt := range []struct {
+		prefix     string
+		source     string
+		dest       string
+		destPrefix string
+	}{
+		{"", "source:source-bucket", "dest:dest-bucket/source-bucket", "source-bucket"},
+		{"photos/2024", "source:source-bucket/photos/2024", "dest:dest-bucket/source-bucket/photos/2024", "source-bucket/photos/2024"},
+		{"/photos//2024/", "source:source-bucket/photos/2024", "dest:dest-bucket/source-bucket/photos/2024", "source-bucket/photos/2024"},
+	} {
+		t.Run(tt.prefix, func(t *testing.T) {
+			config, err := loadTestConfig(t, map[string]string{"SOURCE_PREFIX": tt.prefix})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Dest.Prefix != tt.destPrefix {
+				t.Errorf("DEST_PREFIX defaults to %q, want %q", config.Dest.Prefix, tt.destPrefix)
+			}
+			args := syncArgs(config)
+			if args[1] != tt.source || args[2] != tt.dest {
+				t.Errorf("rclone syncs %s to %s, want %s to %s", args[1], args[2], tt.source, tt.dest)
+			}
+		})
+	}
+}
+
+func TestDestPrefixBucketRoot(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// prefix is DEST_PREFIX, unset if nil.
+		prefix *string
+		dest   string
+	}{
+		{"unset", nil, "dest:dest-bucket/source-bucket/photos"},
+		{"empty", new(string), "dest:dest-bucket"},
+		{"slash", ptr("/"), "dest:dest-bucket"},
+		{"prefix", ptr("/mirror/"), "dest:dest-bucket/mirror"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env := withEnv(map[string]string{"SOURCE_PREFIX": "photos"})
+			if tt.prefix != nil {
+				env["DEST_PREFIX"] = *tt.prefix
+			}
+			setTestEnv(t, env)
+			configs, err := loadConfigs(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := syncArgs(configs[0])[2]; got != tt.dest {
+				t.Errorf("rclone syncs to %s, want %s", got, tt.dest)
+			}
+		})
+	}
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("file-secret\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		want string
+		err  string
+	}{
+		{name: "environment", env: map[string]string{"DEST_SECRET_KEY": "", "DEST_SECRET_KEY_FILE": secretFile}, want: "file-secret"},
+		{name: "flag", env: map[string]string{"DEST_SECRET_KEY": ""}, args: []string{"--dest-secret-key-file", secretFile}, want: "file-secret"},
+		{name: "empty value next to the file", env: map[string]string{"DEST_SECRET_KEY": "", "DEST_SECRET_KEY_FILE": secretFile}, want: "file-secret"},
+		{name: "both", env: map[string]string{"DEST_SECRET_KEY_FILE": secretFile}, err: "both DEST_SECRET_KEY and DEST_SECRET_KEY_FILE are set; use only one"},
+		{name: "missing file", env: map[string]string{"DEST_SECRET_KEY": "", "DEST_SECRET_KEY_FILE": filepath.Join(dir, "missing")}, err: "failed to read DEST_SECRET_KEY_FILE"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			env := withEnv(tt.env)
+			if tt.name == "empty value next to the file" {
+				env["DEST_SECRET_KEY"] = ""
+			}
+			setTestEnv(t, env)
+			configs, err := loadConfigs(tt.args)
+			wantError(t, err, tt.err)
+			if err == nil && configs[0].Dest.SecretKey != tt.want {
+				t.Errorf("DEST_SECRET_KEY = %q, want %q", configs[0].Dest.SecretKey, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretFileOptions(t *testing.T) {
+	options := map[string]option{}
+	for _, opt := range allOptions() {
+		options[opt.env] = opt
+	}
+	if opt, ok := options["SOURCE_ACCESS_KEY_FILE"]; !ok || opt.flagName() != "source-access-key-file" {
+		t.Errorf("SOURCE_ACCESS_KEY has no _FILE variant: %+v", opt)
+	}
+	if _, ok := options["SOURCE_BUCKET_FILE"]; ok {
+		t.Errorf("SOURCE_BUCKET, not a secret, has a _FILE variant")
+	}
+}
+
+func TestRcloneConfigDir(t *testing.T) {
+	config, err := loadTestConfig(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RcloneConfigDir != os.TempDir() {
+		t.Errorf("RCLONE_CONFIG_DIR defaults to %q, want %q", config.RcloneConfigDir, os.TempDir())
+	}
+
+	// A missing directory is created, e.g. on an emptyDir volume.
+	dir := filepath.Join(t.TempDir(), "nested", "rclone")
+	config, err = loadTestConfig(t, map[string]string{"RCLONE_CONFIG_MODE": "file", "RCLONE_CONFIG_DIR": dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, cleanup, err := createRcloneConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(file, dir+string(filepath.Separator)) {
+		t.Errorf("config file %s isn't under %s", file, dir)
+	}
+	cleanup()
+	cleanup()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("RCLONE_CONFIG_DIR still has %v", entries)
+	}
+
+	// A directory that can't be created fails the run.
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config.RcloneConfigDir = notDir
+	_, _, err = createRcloneConfig(config)
+	wantError(t, err, "failed to create rclone config directory")
+}
+
+func TestDeleteStrategy(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		// subcommand and flag are the rclone subcommand and its delete
+		// flag, if any.
+		subcommand string
+		flag       string
+		err        string
+	}{
+		{name: "default", subcommand: "sync", flag: "--delete-during"},
+		{name: "after", env: map[string]string{"DELETE_STRATEGY": "after"}, subcommand: "sync", flag: "--delete-after"},
+		{name: "rclone spelling", env: map[string]string{"DELETE_STRATEGY": "Delete-Before"}, subcommand: "sync", flag: "--delete-before"},
+		{name: "none", env: map[string]string{"DELETE_STRATEGY": "none"}, subcommand: "copy"},
+		{name: "disabled", env: map[string]string{"DELETE_DISABLED": "true"}, subcommand: "copy"},
+		{name: "unknown", env: map[string]string{"DELETE_STRATEGY": "later"}, err: `invalid DELETE_STRATEGY "later": must be one of during, after, before, none`},
+		{name: "copy", env: map[string]string{"SYNC_MODE": "copy", "DELETE_STRATEGY": "after"}, err: "DELETE_STRATEGY only applies to SYNC_MODE=sync"},
+		{name: "disabled with a strategy", env: map[string]string{"DELETE_DISABLED": "true", "DELETE_STRATEGY": "after"}, err: "DELETE_STRATEGY=after has no effect"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.env)
+			wantError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			args := syncArgs(config)
+			if args[0] != tt.subcommand {
+				t.Errorf("rclone runs %s, want %s", args[0], tt.subcommand)
+			}
+			for _, arg := range args {
+				if strings.HasPrefix(arg, "--delete-") && arg != tt.flag {
+					t.Errorf("rclone gets %s, want %q", arg, tt.flag)
+				}
+			}
+			if tt.flag != "" && !slices.Contains(args, tt.flag) {
+				t.Errorf("rclone arguments %q lack %s", args, tt.flag)
+			}
+		})
+	}
+}
+
+func TestTrackRenames(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		env      map[string]string
+		strategy string
+		err      string
+	}{
+		{name: "hash", env: map[string]string{"TRACK_RENAMES": "true"}},
+		{name: "strategy", env: map[string]string{"TRACK_RENAMES": "true", "TRACK_RENAMES_STRATEGY": "Modtime, leaf"}, strategy: "modtime,leaf"},
+		{name: "unknown strategy", env: map[string]string{"TRACK_RENAMES": "true", "TRACK_RENAMES_STRATEGY": "hash,name"}, err: `invalid TRACK_RENAMES_STRATEGY "hash,name": must be a comma-separated list of hash, modtime, leaf`},
+		{name: "strategy alone", env: map[string]string{"TRACK_RENAMES_STRATEGY": "leaf"}, err: "TRACK_RENAMES_STRATEGY requires TRACK_RENAMES=true"},
+		{name: "copy", env: map[string]string{"TRACK_RENAMES": "true", "SYNC_MODE": "copy"}, err: "TRACK_RENAMES only works with SYNC_MODE=sync and deletions enabled"},
+		{name: "no deletions", env: map[string]string{"TRACK_RENAMES": "true", "DELETE_STRATEGY": "none"}, err: "TRACK_RENAMES only works with SYNC_MODE=sync"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.env)
+			wantError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			args := syncArgs(config)
+			if !slices.Contains(args, "--track-renames") {
+				t.Errorf("rclone arguments %q lack --track-renames", args)
+			}
+			if strategy, _ := argValue(args, "--track-renames-strategy"); strategy != tt.strategy {
+				t.Errorf("--track-renames-strategy = %q, want %q", strategy, tt.strategy)
+			}
+		})
+	}
+
+	// Renames are matched by hash, which size-only comparisons may not
+	// have.
+	config, err := loadTestConfig(t, map[string]string{"TRACK_RENAMES": "true", "COMPARE_MODE": "size-only"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(config.warnings, func(w string) bool { return strings.HasPrefix(w, "TRACK_RENAMES matches renamed objects by hash") }) {
+		t.Errorf("warnings %q don't mention hash matching", config.warnings)
+	}
+}
+
+func TestKeyMatching(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		warning string
+		err     string
+	}{
+		{name: "default"},
+		{name: "ignore case", env: map[string]string{"IGNORE_CASE": "true"}, args: []string{"--ignore-case-sync"}, warning: "IGNORE_CASE is set"},
+		{name: "nfc", env: map[string]string{"UNICODE_NORMALIZATION": "NFC"}, warning: "UNICODE_NORMALIZATION is set"},
+		{name: "off", env: map[string]string{"UNICODE_NORMALIZATION": "off"}, args: []string{"--no-unicode-normalization"}, warning: "UNICODE_NORMALIZATION=off"},
+		{name: "unknown", env: map[string]string{"UNICODE_NORMALIZATION": "nfkc"}, err: `invalid UNICODE_NORMALIZATION "nfkc": must be one of nfc, nfd, off`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.env)
+			wantError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			if got := keyMatchingArgs(config); !slices.Equal(got, tt.args) {
+				t.Errorf("keyMatchingArgs = %q, want %q", got, tt.args)
+			}
+			// The verification compares keys the way the sync did.
+			for _, args := range [][]string{syncArgs(config), verifyArgs(config)} {
+				for _, arg := range tt.args {
+					if !slices.Contains(args, arg) {
+						t.Errorf("rclone arguments %q lack %s", args, arg)
+					}
+				}
+			}
+			warned := slices.ContainsFunc(config.warnings, func(w string) bool { return tt.warning != "" && strings.HasPrefix(w, tt.warning) })
+			if warned != (tt.warning != "") {
+				t.Errorf("warnings %q, want one starting with %q", config.warnings, tt.warning)
+			}
+		})
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		env       map[string]string
+		transfers string
+		checkers  string
+		err       string
+	}{
+		{name: "default", transfers: "4", checkers: "8"},
+		{name: "set", env: map[string]string{"TRANSFERS": "32", "CHECKERS": "64"}, transfers: "32", checkers: "64"},
+		{name: "above the cap", env: map[string]string{"TRANSFERS": "300"}, err: "TRANSFERS must be between 1 and MAX_CONCURRENCY (256), got 300"},
+		{name: "raised cap", env: map[string]string{"TRANSFERS": "300", "MAX_CONCURRENCY": "512"}, transfers: "300", checkers: "8"},
+		{name: "lowered cap", env: map[string]string{"MAX_CONCURRENCY": "6"}, err: "CHECKERS must be between 1 and MAX_CONCURRENCY (6), got 8"},
+		{name: "zero", env: map[string]string{"CHECKERS": "0"}, err: "CHECKERS must be between 1"},
+		{name: "zero cap", env: map[string]string{"MAX_CONCURRENCY": "0"}, err: "MAX_CONCURRENCY must be at least 1, got 0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.env)
+			wantError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			if transfers, _ := argValue(syncArgs(config), "--transfers"); transfers != tt.transfers {
+				t.Errorf("--transfers = %q, want %q", transfers, tt.transfers)
+			}
+			// rclone check transfers nothing, but checks as many objects.
+			for _, args := range [][]string{syncArgs(config), verifyArgs(config)} {
+				if checkers, _ := argValue(args, "--checkers"); checkers != tt.checkers {
+					t.Errorf("%s --checkers = %q, want %q", args[0], checkers, tt.checkers)
+				}
+			}
+		})
+	}
+}
+
+func TestTPSLimit(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		want []string
+		err  string
+	}{
+		{name: "unlimited"},
+		{name: "limit", env: map[string]string{"TPS_LIMIT": "12.5"}, want: []string{"--tpslimit", "12.5"}},
+		{name: "burst", env: map[string]string{"TPS_LIMIT": "10", "TPS_LIMIT_BURST": "20"}, want: []string{"--tpslimit", "10", "--tpslimit-burst", "20"}},
+		{name: "burst alone", env: map[string]string{"TPS_LIMIT_BURST": "20"}, err: "TPS_LIMIT_BURST requires TPS_LIMIT"},
+		{name: "negative", env: map[string]string{"TPS_LIMIT": "-1"}, err: "TPS_LIMIT and TPS_LIMIT_BURST must not be negative"},
+		{name: "not a number", env: map[string]string{"TPS_LIMIT": "ten"}, err: `TPS_LIMIT="ten" is not a valid number`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.env)
+			wantError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			if got := tpsArgs(config); !slices.Equal(got, tt.want) {
+				t.Errorf("tpsArgs = %q, want %q", got, tt.want)
+			}
+			for _, args := range [][]string{syncArgs(config), verifyArgs(config)} {
+				if limit, _ := argValue(args, "--tpslimit"); len(tt.want) > 0 && limit != tt.want[1] {
+					t.Errorf("%s --tpslimit = %q, want %q", args[0], limit, tt.want[1])
+				}
+			}
+		})
+	}
+}
+
+func TestThrottlingHint(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		throttled int
+		hint      bool
+	}{
+		{"below the threshold", throttlingHintThreshold - 1, false},
+		{"throttled", throttlingHintThreshold, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, _ := fakeRclone(t, fmt.Sprintf(`[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+for i in $(seq %d); do echo "ERROR : a$i.txt: Failed to copy: SlowDown: Please reduce your request rate" >&2; done
+exit 0`, tt.throttled))
+			setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "LOG_LEVEL": "warn"}))
+			out := captureOutput(t, func() { run(nil) })
+			if hint := strings.Contains(out, "rclone was throttled by the provider"); hint != tt.hint {
+				t.Errorf("hint logged %v, want %v:\n%s", hint, tt.hint, out)
+			}
+		})
+	}
+}
+
+func TestTransferOrder(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  string
+		err   string
+	}{
+		{"", "", ""},
+		{"size", "size", ""},
+		{"Size, Desc", "size,desc", ""},
+		{"modtime,ascending", "modtime,ascending", ""},
+		{"size,mixed,75", "size,mixed,75", ""},
+		{"age,desc", "", `invalid TRANSFER_ORDER "age,desc": the field must be name, size or modtime`},
+		{"size,down", "", "the direction must be asc, desc or mixed"},
+		{"size,desc,50", "", "only mixed takes a third part"},
+		{"size,mixed,101", "", "only mixed takes a third part, a percentage from 0 to 100"},
+		{"size,mixed,50,1", "", "too many parts"},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			config, err := loadTestConfig(t, map[string]string{"TRANSFER_ORDER": tt.value})
+			wantError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			if order, _ := argValue(syncArgs(config), "--order-by"); order != tt.want {
+				t.Errorf("--order-by = %q, want %q", order, tt.want)
+			}
+			warned := slices.ContainsFunc(config.warnings, func(w string) bool { return strings.HasPrefix(w, "TRANSFER_ORDER=") })
+			if warned != (tt.want != "") {
+				t.Errorf("warnings %q, want the sorting caveat only with TRANSFER_ORDER", config.warnings)
+			}
+		})
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	failed := errors.New("exit status 1")
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{failed, "sync"},
+		{&budgetError{budget: "MAX_TRANSFER", err: failed}, "budget"},
+		{fmt.Errorf("job: %w", &budgetError{budget: "MAX_TRANSFER", err: failed}), "budget"},
+		{&verifyError{}, "verification"},
+		{&accessCheckError{sides: []string{"dest"}}, "access"},
+		{&classError{class: "preflight", err: failed}, "preflight"},
+		{fmt.Errorf("job: %w", &classError{class: "immutable", err: failed}), "immutable"},
+		// The more specific type wins over the class it is wrapped in.
+		{&classError{class: "setup", err: &budgetError{budget: "MAX_DURATION", err: failed}}, "budget"},
+	} {
+		if got := errorClass(tt.err); got != tt.want {
+			t.Errorf("errorClass(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	failed := errors.New("exit status 1")
+	for _, tt := range []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{errors.New("failed to write the filter file"), 4},
+		{&classError{class: "setup", err: failed}, 1},
+		{&classError{class: "hook", err: failed}, 1},
+		{&classError{class: "config", err: failed}, 2},
+		{&classError{class: "preflight", err: failed}, 3},
+		{&accessCheckError{sides: []string{"source", "dest"}}, 3},
+		{&shrinkError{reason: "9 source objects"}, 3},
+		{&rcloneError{classes: []classCount{{Class: "access_denied", Count: 2}}, err: failed}, 4},
+		{&rcloneError{classes: []classCount{{Class: "throttled", Count: 2}}, err: failed}, 4},
+		{&timeoutError{timeout: "6h", err: failed}, 4},
+		{&classError{class: "immutable", err: failed}, 4},
+		{&budgetError{budget: "MAX_TRANSFER", err: failed}, 5},
+		{&deleteLimitError{limit: 10, err: failed}, 5},
+		{&verifyError{}, 6},
+		{&diffError{report: newDiffReport(10)}, 6},
+		{&interruptedError{sig: syscall.SIGTERM}, 7},
+		{&interruptedError{sig: syscall.SIGINT, err: failed}, 7},
+		{&lockError{path: "dest:dest-bucket/.sync-lock", lock: &syncLock{}}, 8},
+		{&classError{class: "lock", err: failed}, 8},
+		// Wrapping doesn't change the code.
+		{fmt.Errorf("job media: %w", &budgetError{budget: "MAX_DURATION", err: failed}), 5},
+		{&classError{class: "setup", err: &interruptedError{sig: syscall.SIGTERM}}, 7},
+	} {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRcloneVerbosity(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{nil, ""},
+		{map[string]string{"LOG_LEVEL": "error"}, ""},
+		{map[string]string{"LOG_LEVEL": "debug"}, "-v"},
+		{map[string]string{"LOG_LEVEL": "trace"}, "-vv"},
+		{map[string]string{"MANIFEST": "true", "REPORT_PREFIX": "_reports"}, "-v"},
+		{map[string]string{"LOG_TRANSFERS": "true", "LOG_LEVEL": "warn"}, "-v"},
+		{map[string]string{"DRY_RUN": "true", "LOG_LEVEL": "debug"}, "-vv"},
+	} {
+		config, err := loadTestConfig(t, tt.env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args := syncArgs(config)
+		var got []string
+		for _, arg := range args {
+			if arg == "-v" || arg == "-vv" || arg == "-q" {
+				got = append(got, arg)
+			}
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%v: verbosity %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestStatsInterval(t *testing.T) {
+	config, err := loadTestConfig(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval, _ := argValue(syncArgs(config), "--stats"); interval != "1m" {
+		t.Errorf("--stats = %q, want 1m by default", interval)
+	}
+	config, err = loadTestConfig(t, map[string]string{"STATS_INTERVAL": "10s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if interval, _ := argValue(syncArgs(config), "--stats"); interval != "10s" {
+		t.Errorf("--stats = %q, want 10s", interval)
+	}
+	for _, value := range []string{"500ms", "10"} {
+		_, err := loadTestConfig(t, map[string]string{"STATS_INTERVAL": value})
+		wantError(t, err, fmt.Sprintf("invalid STATS_INTERVAL %q: must be a duration of at least 1s", value))
+	}
+}
+
+func TestProgress(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  bool
+	}{
+		// The tests' stdout is no terminal.
+		{"", false},
+		{"true", true},
+		{"false", false},
+	} {
+		config, err := loadTestConfig(t, map[string]string{"PROGRESS": tt.value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got bool
+		captureOutput(t, func() { got = slices.Contains(syncArgs(config), "--progress") })
+		if got != tt.want {
+			t.Errorf("PROGRESS=%q: --progress %v, want %v", tt.value, got, tt.want)
+		}
+	}
+	_, err := loadTestConfig(t, map[string]string{"PROGRESS": "auto"})
+	wantError(t, err, `PROGRESS="auto"`)
+}
+
+func TestNoSuchBucketHint(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+echo "ERROR : S3 bucket dest-bucket: error reading destination root directory: NoSuchBucket: The specified bucket does not exist" >&2
+exit 1`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path}))
+	out := captureOutput(t, func() { run(nil) })
+	e := findEntry(logEntries(t, out), "rclone could not find a bucket")
+	if e == nil || !strings.Contains(e["hint"].(string), "DEST_FORCE_PATH_STYLE") {
+		t.Errorf("hint = %v, want one about the addressing style:\n%s", e, out)
+	}
+
+	path, _ = fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+echo "ERROR : a.txt: Failed to copy: connection reset by peer" >&2
+exit 1`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path}))
+	out = captureOutput(t, func() { run(nil) })
+	if e := findEntry(logEntries(t, out), "rclone could not find a bucket"); e != nil {
+		t.Errorf("addressing hint for another error: %v", e)
+	}
+}
+
+func TestMoveMode(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"SYNC_MODE": "move", "CONFIRM_MOVE": "true"}, ""},
+		{map[string]string{"SYNC_MODE": "move", "DRY_RUN": "true"}, ""},
+		{map[string]string{"SYNC_MODE": "move"}, "SYNC_MODE=move deletes source objects after transfer and cannot be undone; set CONFIRM_MOVE=true"},
+		{map[string]string{"SYNC_MODE": "move", "CONFIRM_MOVE": "true", "DELETE_DISABLED": "true"}, "DELETE_DISABLED can't be combined with SYNC_MODE=move"},
+		{map[string]string{"SYNC_MODE": "move", "CONFIRM_MOVE": "true", "SOURCE_ANONYMOUS": "true", "SOURCE_ACCESS_KEY": "", "SOURCE_SECRET_KEY": ""}, "SYNC_MODE=move deletes source objects, which SOURCE_ANONYMOUS can't"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+
+	config, err := loadTestConfig(t, map[string]string{"SYNC_MODE": "move", "CONFIRM_MOVE": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := syncArgs(config)
+	if args[0] != "move" || !slices.Contains(args, "--delete-empty-src-dirs") {
+		t.Errorf("rclone arguments %q, want move with --delete-empty-src-dirs", args)
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--delete-") && arg != "--delete-empty-src-dirs" {
+			t.Errorf("rclone arguments %q, want no destination deletions in move mode", args)
+		}
+	}
+}
+
+func TestMoveReportsRemovedObjects(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+echo '{"level":"notice","msg":"stats","stats":{"bytes":10,"transfers":3,"deletes":3,"checks":0}}' >&2
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SYNC_MODE": "move", "CONFIRM_MOVE": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+	if e := findEntry(logEntries(t, out), "Sync operation completed"); e == nil || e["source_objects_removed"] != float64(3) {
+		t.Errorf("completion logged as %v, want 3 source objects removed", e)
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"IMMUTABLE": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IMMUTABLE defaults to copy, which never deletes.
+	args := syncArgs(config)
+	if config.SyncMode != "copy" || args[0] != "copy" || !slices.Contains(args, "--immutable") {
+		t.Errorf("SYNC_MODE %q and rclone arguments %q, want copy with --immutable", config.SyncMode, args)
+	}
+
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"IMMUTABLE": "true", "SYNC_MODE": "sync"}, "IMMUTABLE=true only adds objects and cannot be combined with SYNC_MODE=sync"},
+		{map[string]string{"IMMUTABLE": "true", "SYNC_MODE": "move", "CONFIRM_MOVE": "true"}, "cannot be combined with SYNC_MODE=move"},
+		{map[string]string{"IMMUTABLE": "true", "MAX_DELETE": "10"}, "MAX_DELETE is irrelevant with IMMUTABLE=true"},
+		{map[string]string{"RCLONE_EXTRA_ARGS": "--immutable"}, "--immutable"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestImmutableViolation(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+echo "ERROR : a.txt: Source and destination exist but do not match: immutable file modified" >&2
+exit 1`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "IMMUTABLE": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	entries := logEntries(t, out)
+	e := findEntry(entries, "S3 sync job failed")
+	if result.code == 0 || e == nil || e["error_class"] != "immutable" || !strings.Contains(e["error"].(string), "existing destination objects would be modified") {
+		t.Errorf("run = %d and failure logged as %v, want an immutable error", result.code, e)
+	}
+	if findEntry(entries, "IMMUTABLE is set but existing destination objects differ from the source; the affected keys are logged by rclone as \"immutable file modified\"") == nil {
+		t.Errorf("no explanation logged:\n%s", out)
+	}
+}
+
+func TestCompareMode(t *testing.T) {
+	for _, tt := range []struct {
+		mode       string
+		flag       string
+		verifyFlag string
+		warns      bool
+	}{
+		{"", "--checksum", "--checksum", false},
+		{"checksum", "--checksum", "--checksum", false},
+		{"SIZE-ONLY", "--size-only", "--size-only", true},
+		{"modtime", "", "--checksum", false},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			config, err := loadTestConfig(t, map[string]string{"COMPARE_MODE": tt.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := syncArgs(config)
+			for _, flag := range []string{"--checksum", "--size-only"} {
+				if slices.Contains(args, flag) != (flag == tt.flag) {
+					t.Errorf("rclone arguments %q, want %q only", args, tt.flag)
+				}
+			}
+			if !slices.Contains(verifyArgs(config), tt.verifyFlag) {
+				t.Errorf("rclone check arguments %q lack %s", verifyArgs(config), tt.verifyFlag)
+			}
+			warned := slices.ContainsFunc(config.warnings, func(w string) bool { return strings.Contains(w, "COMPARE_MODE=size-only misses changes") })
+			if warned != tt.warns {
+				t.Errorf("warnings %q, want the size-only warning: %v", config.warnings, tt.warns)
+			}
+		})
+	}
+
+	_, err := loadTestConfig(t, map[string]string{"COMPARE_MODE": "etag"})
+	wantError(t, err, `invalid COMPARE_MODE "etag": must be checksum, size-only or modtime`)
+}
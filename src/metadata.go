@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// metadataRcloneVersion is the first rclone release with --metadata.
+var metadataRcloneVersion = rcloneVersion{major: 1, minor: 59}
+
+// metadataFields are the headers of an object compared besides its user
+// metadata, under the names rclone uses for them.
+var metadataFields = []string{"content-type", "cache-control", "content-encoding", "content-disposition", "content-language"}
+
+// ignoredMetadata are metadata keys that differ between an object and its
+// copy by design: rclone's modification and creation times, the storage
+// class, and the source ETag the native engine records.
+var ignoredMetadata = map[string]bool{"mtime": true, "btime": true, "tier": true, "s3sync-etag": true}
+
+// metadataMismatch is a metadata field that differs between a source object
+// and its copy; an empty value is a missing field.
+type metadataMismatch struct {
+	Key    string `json:"key"`
+	Field  string `json:"field"`
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+}
+
+func validateMetadata(config *Config) error {
+	if config.VerifyMetadataSample < 0 {
+		return fmt.Errorf("VERIFY_METADATA_SAMPLE must not be negative, got %d", config.VerifyMetadataSample)
+	}
+	if config.VerifyMetadataSample > 0 && config.SyncMode == "move" {
+		return fmt.Errorf("VERIFY_METADATA_SAMPLE is not available with SYNC_MODE=move, which leaves nothing in the source to compare")
+	}
+	return nil
+}
+
+// verifyMetadata compares the metadata of VERIFY_METADATA_SAMPLE random
+// source objects with that of their copies. It returns how many objects were
+// compared and the fields that differ; the error is only set if the sample
+// could not be taken.
+func verifyMetadata(config *Config, remotes *rcloneRemotes) (int, []metadataMismatch, error) {
+	if config.Engine == "native" {
+		return verifyMetadataNative(config)
+	}
+	keys, err := sampleKeys(config, remotes)
+	if err != nil {
+		return 0, nil, err
+	}
+	var mismatches []metadataMismatch
+	for _, key := range keys {
+		source, err := rcloneMetadata(config, remotes, remotePath("source", config.Source.Bucket, joinKey(config.Source.Prefix, key)))
+		if err != nil {
+			return 0, nil, err
+		}
+		dest, err := rcloneMetadata(config, remotes, remotePath("dest", config.Dest.Bucket, joinKey(config.Dest.Prefix, key)))
+		if err != nil {
+			return 0, nil, err
+		}
+		mismatches = append(mismatches, compareMetadata(key, source, dest)...)
+	}
+	return len(keys), mismatches, nil
+}
+
+// sampleKeys lists the source objects the sync covers and picks
+// VERIFY_METADATA_SAMPLE of them at random, keeping only the sample in
+// memory.
+func sampleKeys(config *Config, remotes *rcloneRemotes) ([]string, error) {
+	remote := remotePath("source", config.Source.Bucket, config.Source.Prefix)
+	args := []string{"lsf", remote, "-R", "--files-only"}
+	if config.FastList {
+		args = append(args, "--fast-list")
+	}
+	args = append(args, tpsArgs(config)...)
+	args = append(args, filterArgs(config)...)
+	var stderr bytes.Buffer
+	cmd := remotes.command(config, args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", remote, err)
+	}
+	sample := newKeySample(config.VerifyMetadataSample)
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if key := scanner.Text(); key != "" {
+			sample.add(key)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w: %s", remote, err, lastLine(strings.TrimSpace(stderr.String())))
+	}
+	return sample.keys, nil
+}
+
+// rcloneMetadata returns the metadata of the object at path as rclone
+// lsjson --metadata reports it.
+func rcloneMetadata(config *Config, remotes *rcloneRemotes, path string) (map[string]string, error) {
+	var stderr bytes.Buffer
+	cmd := remotes.command(config, append([]string{"lsjson", "--stat", "--metadata", path}, tpsArgs(config)...)...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the metadata of %s: %w: %s", path, err, lastLine(strings.TrimSpace(stderr.String())))
+	}
+	var object struct {
+		Metadata map[string]string `json:"Metadata"`
+	}
+	if err := json.Unmarshal(output, &object); err != nil {
+		return nil, fmt.Errorf("unexpected output from rclone lsjson for %s: %q", path, lastLine(strings.TrimSpace(string(output))))
+	}
+	return object.Metadata, nil
+}
+
+// verifyMetadataNative is verifyMetadata for ENGINE=native, reading the
+// headers with HeadObject.
+func verifyMetadataNative(config *Config) (int, []metadataMismatch, error) {
+	ctx := context.Background()
+	src, err := newS3Client(config.Source, config.Retries, config.Checkers)
+	if err != nil {
+		return 0, nil, err
+	}
+	dst, err := newS3Client(config.Dest, config.Retries, config.Checkers)
+	if err != nil {
+		return 0, nil, err
+	}
+	filter := &nativeSync{config: config}
+	sample := newKeySample(config.VerifyMetadataSample)
+	err = src.list(ctx, config.Source.Bucket, listPrefix(config.Source.Prefix), func(o s3Object) {
+		if key, ok := filter.relative(config.Source.Prefix, o.Key); ok {
+			sample.add(key)
+		}
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	var mismatches []metadataMismatch
+	for _, key := range sample.keys {
+		source, err := src.head(ctx, config.Source.Bucket, joinKey(config.Source.Prefix, key))
+		if err != nil {
+			return 0, nil, err
+		}
+		dest, err := dst.head(ctx, config.Dest.Bucket, joinKey(config.Dest.Prefix, key))
+		if err != nil {
+			return 0, nil, err
+		}
+		mismatches = append(mismatches, compareMetadata(key, headerMetadata(source), headerMetadata(dest))...)
+	}
+	return len(sample.keys), mismatches, nil
+}
+
+// headerMetadata returns the metadata in the headers of an object under
+// rclone's names: the content headers in lower case and the user metadata
+// without its x-amz-meta- prefix.
+func headerMetadata(header http.Header) map[string]string {
+	metadata := make(map[string]string)
+	for _, field := range metadataFields {
+		if v := header.Get(field); v != "" {
+			metadata[field] = v
+		}
+	}
+	for name := range header {
+		if key, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok {
+			metadata[key] = header.Get(name)
+		}
+	}
+	return metadata
+}
+
+// compareMetadata returns the fields of source that dest lacks or has with
+// another value. Fields only dest has are not a mismatch, as the
+// destination may add its own.
+func compareMetadata(key string, source, dest map[string]string) []metadataMismatch {
+	var fields []string
+	for field := range source {
+		if !ignoredMetadata[field] && dest[field] != source[field] {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	mismatches := make([]metadataMismatch, len(fields))
+	for i, field := range fields {
+		mismatches[i] = metadataMismatch{Key: key, Field: field, Source: source[field], Dest: dest[field]}
+	}
+	return mismatches
+}
+
+// keySample is a uniform random sample of a stream of keys.
+type keySample struct {
+	size, seen int
+	keys       []string
+	rng        *rand.Rand
+}
+
+func newKeySample(size int) *keySample {
+	return &keySample{size: size, rng: newJitterSource()}
+}
+
+func (s *keySample) add(key string) {
+	s.seen++
+	if len(s.keys) < s.size {
+		s.keys = append(s.keys, key)
+		return
+	}
+	if i := s.rng.Intn(s.seen); i < s.size {
+		s.keys[i] = key
+	}
+}
+
+// runMetadataCheck runs verifyMetadata after the sync and records the
+// result in report. Mismatches are logged and reported, and don't fail the
+// run.
+func runMetadataCheck(config *Config, remotes *rcloneRemotes, report *runSummary, logger *logrus.Logger) {
+	span := config.span.child("verify-metadata")
+	checked, mismatches, err := verifyMetadata(config, remotes)
+	span.set("checked", checked)
+	span.set("mismatches", len(mismatches))
+	span.end(err)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to compare the metadata of sampled objects")
+		return
+	}
+	report.MetadataChecked = checked
+	report.MetadataMismatches = mismatches
+	entry := logger.WithFields(logrus.Fields{"metadata_checked": checked, "metadata_mismatches": len(mismatches)})
+	if len(mismatches) == 0 {
+		entry.Info("Metadata of sampled objects matches")
+		return
+	}
+	for _, m := range mismatches {
+		logger.WithFields(logrus.Fields{"key": m.Key, "field": m.Field, "source": m.Source, "dest": m.Dest}).Warn("Metadata differs from the source")
+	}
+	entry.Warn("Metadata of sampled objects differs from the source; set PRESERVE_METADATA=true to copy it")
+}
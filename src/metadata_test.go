@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"PRESERVE_METADATA": "true", "VERIFY_METADATA_SAMPLE": "20"}, ""},
+		{map[string]string{"VERIFY_METADATA_SAMPLE": "-1"}, "VERIFY_METADATA_SAMPLE must not be negative, got -1"},
+		{map[string]string{"VERIFY_METADATA_SAMPLE": "5", "SYNC_MODE": "move", "CONFIRM_MOVE": "true"}, "VERIFY_METADATA_SAMPLE is not available with SYNC_MODE=move"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestPreserveMetadataArgs(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"PRESERVE_METADATA": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(syncArgs(config), "--metadata") {
+		t.Errorf("rclone arguments %q lack --metadata", syncArgs(config))
+	}
+	config.PreserveMetadata = false
+	if slices.Contains(syncArgs(config), "--metadata") {
+		t.Errorf("rclone arguments %q have --metadata without PRESERVE_METADATA", syncArgs(config))
+	}
+
+	_, err = loadTestConfig(t, map[string]string{"RCLONE_EXTRA_ARGS": "-M"})
+	wantError(t, err, "-M")
+}
+
+func TestMetadataRcloneVersion(t *testing.T) {
+	path, _ := fakeRclone(t, `echo "rclone v1.58.2"`)
+	config, err := loadTestConfig(t, map[string]string{"RCLONE_PATH": path, "VERIFY_METADATA_SAMPLE": "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRcloneVersion(config)
+	wantError(t, err, "PRESERVE_METADATA and VERIFY_METADATA_SAMPLE need rclone v1.59.0 or later, found v1.58.2")
+
+	config.VerifyMetadataSample = 0
+	if _, err := checkRcloneVersion(config); err != nil {
+		t.Errorf("checkRcloneVersion without metadata settings: %v", err)
+	}
+}
+
+func TestCompareMetadata(t *testing.T) {
+	source := map[string]string{"content-type": "image/png", "cache-control": "max-age=60", "owner": "media", "mtime": "2024-01-01T00:00:00Z"}
+	dest := map[string]string{"content-type": "image/png", "owner": "web", "mtime": "2024-06-01T00:00:00Z", "extra": "dest only"}
+	want := []metadataMismatch{
+		{Key: "a.png", Field: "cache-control", Source: "max-age=60"},
+		{Key: "a.png", Field: "owner", Source: "media", Dest: "web"},
+	}
+	if got := compareMetadata("a.png", source, dest); !reflect.DeepEqual(got, want) {
+		t.Errorf("compareMetadata = %+v, want %+v", got, want)
+	}
+	if got := compareMetadata("a.png", source, source); len(got) != 0 {
+		t.Errorf("compareMetadata of equal metadata = %+v", got)
+	}
+}
+
+func TestHeaderMetadata(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "text/html")
+	header.Set("Content-Encoding", "gzip")
+	header.Set("X-Amz-Meta-Owner", "media")
+	header.Set("Etag", `"abc"`)
+	want := map[string]string{"content-type": "text/html", "content-encoding": "gzip", "owner": "media"}
+	if got := headerMetadata(header); !reflect.DeepEqual(got, want) {
+		t.Errorf("headerMetadata = %v, want %v", got, want)
+	}
+}
+
+func TestCopyHeader(t *testing.T) {
+	source := http.Header{}
+	source.Set("Content-Type", "text/html")
+	source.Set("Cache-Control", "no-cache")
+	source.Set("X-Amz-Meta-Owner", "media")
+	config := &Config{Dest: RemoteConfig{ACL: "private"}}
+
+	header := (&nativeSync{config: config}).copyHeader(source, s3Object{Key: "a.html"})
+	if header.Get("Content-Type") != "text/html" || header.Get("Cache-Control") != "" || header.Get("X-Amz-Meta-Owner") != "" {
+		t.Errorf("headers without PRESERVE_METADATA = %v, want the Content-Type only", header)
+	}
+	config.PreserveMetadata = true
+	header = (&nativeSync{config: config}).copyHeader(source, s3Object{Key: "a.html"})
+	if header.Get("Content-Type") != "text/html" || header.Get("Cache-Control") != "no-cache" || header.Get("X-Amz-Meta-Owner") != "media" {
+		t.Errorf("headers with PRESERVE_METADATA = %v, want those of the source", header)
+	}
+	if header.Get("X-Amz-Acl") != "private" {
+		t.Errorf("X-Amz-Acl = %q, want private", header.Get("X-Amz-Acl"))
+	}
+}
+
+func TestKeySample(t *testing.T) {
+	sample := newKeySample(3)
+	sample.add("a")
+	sample.add("b")
+	if !reflect.DeepEqual(sample.keys, []string{"a", "b"}) {
+		t.Errorf("sample of two keys = %q, want both", sample.keys)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		sample := newKeySample(2)
+		for _, key := range []string{"a", "b", "c", "d"} {
+			sample.add(key)
+		}
+		if len(sample.keys) != 2 || sample.keys[0] == sample.keys[1] {
+			t.Fatalf("sample = %q, want two different keys", sample.keys)
+		}
+		for _, key := range sample.keys {
+			counts[key]++
+		}
+	}
+	// Each key is picked half of the time.
+	for key, n := range counts {
+		if n < 800 || n > 1200 {
+			t.Errorf("key %s was sampled %d times out of 2000, want about 1000", key, n)
+		}
+	}
+}
+
+// metadataRclone lists a.txt and b.txt and reports a different owner for
+// the copy of b.txt.
+const metadataRclone = `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+case "$1 $4" in
+"lsf "*) printf 'a.txt\nb.txt\n' ;;
+"lsjson dest:"*/b.txt) echo '{"Path":"b.txt","Metadata":{"content-type":"text/plain","owner":"web","mtime":"2024-06-01T00:00:00Z"}}' ;;
+"lsjson "*) echo '{"Path":"x","Metadata":{"content-type":"text/plain","owner":"media","mtime":"2024-01-01T00:00:00Z"}}' ;;
+esac
+exit 0`
+
+func TestVerifyMetadataSample(t *testing.T) {
+	path, calls := fakeRclone(t, metadataRclone)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "VERIFY_METADATA_SAMPLE": "5", "INCLUDE_PATTERNS": "*.txt"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	// Mismatches are reported and don't fail the run.
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+
+	summaries := readSummaries(t, out)
+	if len(summaries) != 1 {
+		t.Fatalf("printed %d summaries, want 1:\n%s", len(summaries), out)
+	}
+	want := []metadataMismatch{{Key: "b.txt", Field: "owner", Source: "media", Dest: "web"}}
+	if s := summaries[0]; s.MetadataChecked != 2 || !reflect.DeepEqual(s.MetadataMismatches, want) {
+		t.Errorf("summary reports %d objects checked and mismatches %+v, want 2 and %+v", s.MetadataChecked, s.MetadataMismatches, want)
+	}
+	entries := logEntries(t, out)
+	if e := findEntry(entries, "Metadata differs from the source"); e == nil || e["key"] != "b.txt" || e["field"] != "owner" {
+		t.Errorf("mismatch logged as %v", e)
+	}
+
+	var lsf, lsjson []string
+	for _, call := range readCalls(t, calls) {
+		switch {
+		case strings.HasPrefix(call, "lsf "):
+			lsf = append(lsf, call)
+		case strings.HasPrefix(call, "lsjson "):
+			lsjson = append(lsjson, call)
+		}
+	}
+	if len(lsf) != 1 || !strings.HasPrefix(lsf[0], "lsf source:source-bucket -R --files-only") || !strings.Contains(lsf[0], "--include *.txt") {
+		t.Errorf("listed the source with %q, want once with the filters", lsf)
+	}
+	if len(lsjson) != 4 {
+		t.Errorf("read metadata with %q, want the source and copy of both objects", lsjson)
+	}
+	for _, call := range lsjson {
+		if !strings.HasPrefix(call, "lsjson --stat --metadata ") {
+			t.Errorf("read metadata with %q", call)
+		}
+	}
+}
+
+func TestVerifyMetadataFails(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = lsf ] && { echo "directory not found" >&2; exit 3; }
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "VERIFY_METADATA_SAMPLE": "5"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0 as the check only warns:\n%s", result.code, out)
+	}
+	e := findEntry(logEntries(t, out), "Failed to compare the metadata of sampled objects")
+	if e == nil || !strings.Contains(e["error"].(string), "directory not found") {
+		t.Errorf("warning = %v, want rclone's error", e)
+	}
+}
+
+func TestVerifyMetadataDryRun(t *testing.T) {
+	path, calls := fakeRclone(t, metadataRclone)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "VERIFY_METADATA_SAMPLE": "5", "DRY_RUN": "true"}))
+	captureOutput(t, func() { run(nil) })
+	for _, call := range readCalls(t, calls) {
+		if strings.HasPrefix(call, "lsf ") || strings.HasPrefix(call, "lsjson ") {
+			t.Errorf("dry run compared metadata with %q", call)
+		}
+	}
+}
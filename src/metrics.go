@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// durationBuckets are the upper bounds of sync_duration_seconds, from a
+// second to a day.
+var durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600, 7200, 14400, 28800, 86400}
+
+// metricLabels identify the job a series belongs to. The job label is
+// called sync_job so it doesn't clash with the job label Prometheus and the
+// Pushgateway add themselves.
+type metricLabels struct {
+	job, sourceBucket, destBucket string
+}
+
+func (l metricLabels) String() string {
+	return fmt.Sprintf(`sync_job="%s",source_bucket="%s",dest_bucket="%s"`,
+		escapeLabel(l.job), escapeLabel(l.sourceBucket), escapeLabel(l.destBucket))
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+type jobMetrics struct {
+	runs          map[string]int64 // by result
+	buckets       []int64          // cumulative, per durationBuckets
+	durationSum   float64
+	durationCount int64
+	bytes         int64
+	objects       int64
+	deleted       int64
+	errors        int64
+	lastSuccess   time.Time
+	// multipartAborted and multipartFailures count CLEANUP_MULTIPART.
+	multipartAborted  int64
+	multipartFailures int64
+}
+
+// metricsRegistry holds the counters of all runs in this process.
+type metricsRegistry struct {
+	mu   sync.Mutex
+	jobs map[metricLabels]*jobMetrics
+}
+
+var metrics = &metricsRegistry{jobs: make(map[metricLabels]*jobMetrics)}
+
+func jobLabels(config *Config) metricLabels {
+	labels := metricLabels{job: config.JobName, sourceBucket: config.Source.Bucket, destBucket: config.Dest.Bucket}
+	if labels.job == "" {
+		labels.job = config.Source.Bucket
+	}
+	return labels
+}
+
+// job returns the metrics of config's job, creating them on first use. The
+// caller holds m.mu.
+func (m *metricsRegistry) job(config *Config) *jobMetrics {
+	labels := jobLabels(config)
+	j, ok := m.jobs[labels]
+	if !ok {
+		j = &jobMetrics{runs: make(map[string]int64), buckets: make([]int64, len(durationBuckets))}
+		m.jobs[labels] = j
+	}
+	return j
+}
+
+// record adds a finished run of config.
+func (m *metricsRegistry) record(config *Config, err error, duration time.Duration, stats RunStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.job(config)
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	j.runs[result]++
+	seconds := duration.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			j.buckets[i]++
+		}
+	}
+	j.durationSum += seconds
+	j.durationCount++
+	j.bytes += stats.Bytes
+	j.objects += stats.Transfers
+	j.deleted += stats.Deletes
+	j.errors += stats.Errors
+	if err == nil {
+		j.lastSuccess = time.Now()
+	}
+}
+
+// recordMultipartCleanup counts the uploads a multipart cleanup aborted, or
+// its failure.
+func (m *metricsRegistry) recordMultipartCleanup(config *Config, aborted int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.job(config)
+	j.multipartAborted += int64(aborted)
+	if err != nil {
+		j.multipartFailures++
+	}
+}
+
+// restoreLastSuccess sets the last success of config's job from its saved
+// state, unless this process has seen a later one.
+func (m *metricsRegistry) restoreLastSuccess(config *Config, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j := m.job(config); at.After(j.lastSuccess) {
+		j.lastSuccess = at
+	}
+}
+
+// lastSuccess returns the time of the last successful run of config's job,
+// or the zero time if there was none.
+func (m *metricsRegistry) lastSuccess(config *Config) time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j, ok := m.jobs[jobLabels(config)]; ok {
+		return j.lastSuccess
+	}
+	return time.Time{}
+}
+
+// write renders the metrics in the Prometheus text format.
+func (m *metricsRegistry) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := make([]metricLabels, 0, len(m.jobs))
+	for l := range m.jobs {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, k int) bool { return labels[i].String() < labels[k].String() })
+
+	header := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	header("sync_runs_total", "counter", "Sync runs by result.")
+	for _, l := range labels {
+		results := make([]string, 0, len(m.jobs[l].runs))
+		for result := range m.jobs[l].runs {
+			results = append(results, result)
+		}
+		sort.Strings(results)
+		for _, result := range results {
+			fmt.Fprintf(w, "sync_runs_total{%s,result=\"%s\"} %d\n", l, result, m.jobs[l].runs[result])
+		}
+	}
+	header("sync_duration_seconds", "histogram", "Duration of sync runs.")
+	for _, l := range labels {
+		j := m.jobs[l]
+		for i, bound := range durationBuckets {
+			fmt.Fprintf(w, "sync_duration_seconds_bucket{%s,le=\"%s\"} %d\n", l, strconv.FormatFloat(bound, 'f', -1, 64), j.buckets[i])
+		}
+		fmt.Fprintf(w, "sync_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, j.durationCount)
+		fmt.Fprintf(w, "sync_duration_seconds_sum{%s} %s\n", l, strconv.FormatFloat(j.durationSum, 'f', -1, 64))
+		fmt.Fprintf(w, "sync_duration_seconds_count{%s} %d\n", l, j.durationCount)
+	}
+	for _, c := range []struct {
+		name, help string
+		value      func(*jobMetrics) int64
+	}{
+		{"bytes_transferred_total", "Bytes transferred, from rclone's stats.", func(j *jobMetrics) int64 { return j.bytes }},
+		{"objects_transferred_total", "Objects transferred, from rclone's stats.", func(j *jobMetrics) int64 { return j.objects }},
+		{"objects_deleted_total", "Objects deleted, from rclone's stats.", func(j *jobMetrics) int64 { return j.deleted }},
+		{"errors_total", "Errors reported by rclone.", func(j *jobMetrics) int64 { return j.errors }},
+		{"multipart_uploads_aborted_total", "Abandoned multipart uploads aborted by CLEANUP_MULTIPART.", func(j *jobMetrics) int64 { return j.multipartAborted }},
+		{"multipart_cleanup_failures_total", "Failed CLEANUP_MULTIPART runs.", func(j *jobMetrics) int64 { return j.multipartFailures }},
+	} {
+		header(c.name, "counter", c.help)
+		for _, l := range labels {
+			fmt.Fprintf(w, "%s{%s} %d\n", c.name, l, c.value(m.jobs[l]))
+		}
+	}
+	header("last_success_timestamp_seconds", "gauge", "Unix time of the last successful sync run.")
+	for _, l := range labels {
+		if last := m.jobs[l].lastSuccess; !last.IsZero() {
+			fmt.Fprintf(w, "last_success_timestamp_seconds{%s} %d\n", l, last.Unix())
+		}
+	}
+}
+
+// handleMetrics serves /metrics.
+func handleMetrics(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.write(w)
+}
+
+// pushMetrics replaces the metrics of PUSHGATEWAY_JOB on PUSHGATEWAY_URL, so
+// one-shot runs can be graphed. Failures are only logged.
+func pushMetrics(config *Config, logger *logrus.Logger) {
+	if config.PushgatewayURL == "" {
+		return
+	}
+	var body bytes.Buffer
+	metrics.write(&body)
+	target := strings.TrimRight(config.PushgatewayURL, "/") + "/metrics/job/" + url.PathEscape(config.PushgatewayJob)
+	req, err := http.NewRequest(http.MethodPut, target, &body)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to push metrics")
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to push metrics")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		logger.WithFields(logrus.Fields{
+			"status": resp.Status,
+			"detail": strings.TrimSpace(string(detail)),
+		}).Warn("Pushgateway rejected the metrics")
+		return
+	}
+	logger.WithField("pushgateway", target).Info("Metrics pushed")
+}
+
+func validateMetrics(config *Config) error {
+	if config.PushgatewayURL == "" {
+		return nil
+	}
+	u, err := url.Parse(config.PushgatewayURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid PUSHGATEWAY_URL %q: must look like http://pushgateway:9091", config.PushgatewayURL)
+	}
+	if config.PushgatewayJob == "" {
+		return fmt.Errorf("PUSHGATEWAY_JOB must not be empty")
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := &metricsRegistry{jobs: make(map[metricLabels]*jobMetrics)}
+	config := &Config{JobName: `me"dia`, Source: RemoteConfig{Bucket: "media"}, Dest: RemoteConfig{Bucket: "backup"}}
+	m.record(config, nil, 42*time.Second, RunStats{Bytes: 1024, Transfers: 3, Deletes: 1})
+	m.record(config, errors.New("sync failed"), 2*time.Hour, RunStats{Bytes: 10, Errors: 2})
+	m.recordMultipartCleanup(config, 4, nil)
+
+	var out strings.Builder
+	m.write(&out)
+	labels := `sync_job="me\"dia",source_bucket="media",dest_bucket="backup"`
+	for _, want := range []string{
+		"# TYPE sync_runs_total counter",
+		`sync_runs_total{` + labels + `,result="failure"} 1`,
+		`sync_runs_total{` + labels + `,result="success"} 1`,
+		`sync_duration_seconds_bucket{` + labels + `,le="30"} 0`,
+		`sync_duration_seconds_bucket{` + labels + `,le="60"} 1`,
+		`sync_duration_seconds_bucket{` + labels + `,le="7200"} 2`,
+		`sync_duration_seconds_bucket{` + labels + `,le="+Inf"} 2`,
+		`sync_duration_seconds_sum{` + labels + `} 7242`,
+		`bytes_transferred_total{` + labels + `} 1034`,
+		`objects_transferred_total{` + labels + `} 3`,
+		`objects_deleted_total{` + labels + `} 1`,
+		`errors_total{` + labels + `} 2`,
+		`multipart_uploads_aborted_total{` + labels + `} 4`,
+		`last_success_timestamp_seconds{` + labels + `} `,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics lack %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestMetricsLastSuccess(t *testing.T) {
+	m := &metricsRegistry{jobs: make(map[metricLabels]*jobMetrics)}
+	config := &Config{Source: RemoteConfig{Bucket: "media"}}
+	if !m.lastSuccess(config).IsZero() {
+		t.Error("a job without runs has a last success")
+	}
+	saved := time.Now().Add(-time.Hour).Truncate(time.Second)
+	m.restoreLastSuccess(config, saved)
+	if got := m.lastSuccess(config); !got.Equal(saved) {
+		t.Errorf("lastSuccess = %v, want the saved %v", got, saved)
+	}
+	// A failure keeps the last success; a success replaces it.
+	m.record(config, errors.New("failed"), time.Second, RunStats{})
+	if got := m.lastSuccess(config); !got.Equal(saved) {
+		t.Errorf("lastSuccess after a failure = %v, want %v", got, saved)
+	}
+	m.record(config, nil, time.Second, RunStats{})
+	m.restoreLastSuccess(config, saved)
+	if got := m.lastSuccess(config); !got.After(saved) {
+		t.Errorf("lastSuccess = %v, want the run of this process", got)
+	}
+}
+
+func TestValidateMetrics(t *testing.T) {
+	_, err := loadTestConfig(t, map[string]string{"PUSHGATEWAY_URL": "pushgateway:9091"})
+	wantError(t, err, `invalid PUSHGATEWAY_URL "pushgateway:9091"`)
+	_, err = loadTestConfig(t, map[string]string{"PUSHGATEWAY_URL": "http://pushgateway:9091", "PUSHGATEWAY_JOB": " "})
+	wantError(t, err, "PUSHGATEWAY_JOB must not be empty")
+}
+
+func TestRunRecordsMetrics(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = sync ] && echo '{"level":"notice","msg":"stats","stats":{"bytes":2048,"transfers":2,"deletes":1,"checks":5}}' >&2
+exit 0`)
+
+	var pushed, pushPath string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method == http.MethodPut {
+			pushed, pushPath = string(body), r.URL.Path
+		}
+	}))
+	defer gateway.Close()
+
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "JOB_NAME": "metrics-test", "PUSHGATEWAY_URL": gateway.URL, "PUSHGATEWAY_JOB": "nightly sync"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	labels := `sync_job="metrics-test",source_bucket="source-bucket",dest_bucket="dest-bucket"`
+	for _, want := range []string{
+		`sync_runs_total{` + labels + `,result="success"} 1`,
+		`bytes_transferred_total{` + labels + `} 2048`,
+		`objects_transferred_total{` + labels + `} 2`,
+		`objects_deleted_total{` + labels + `} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("/metrics lacks %q:\n%s", want, w.Body)
+		}
+		if !strings.Contains(pushed, want) {
+			t.Errorf("pushed metrics lack %q", want)
+		}
+	}
+	if pushPath != "/metrics/job/nightly sync" {
+		t.Errorf("metrics pushed to %q, want /metrics/job/nightly sync", pushPath)
+	}
+}
+
+func TestPushMetricsRejected(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "text format parsing error", http.StatusBadRequest)
+	}))
+	defer gateway.Close()
+	config, err := loadTestConfig(t, map[string]string{"PUSHGATEWAY_URL": gateway.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := captureOutput(t, func() { pushMetrics(config, setupLogger(config)) })
+	e := findEntry(logEntries(t, out), "Pushgateway rejected the metrics")
+	if e == nil || e["detail"] != "text format parsing error" {
+		t.Errorf("rejection logged as %v", e)
+	}
+}
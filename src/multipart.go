@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// maxUploadParts is the S3 limit on parts per multipart upload.
+	maxUploadParts = 10000
+	// minChunkSize and maxCutoff are the S3 limits on part size and on
+	// single-request uploads and copies.
+	minChunkSize = 5 << 20
+	maxCutoff    = 5 << 30
+)
+
+// multipartArgs returns the rclone flags for in-memory buffering, multipart
+// uploads and server-side copies. Unset values keep rclone's defaults.
+func multipartArgs(config *Config) []string {
+	var args []string
+	if config.BufferSize != "" {
+		args = append(args, "--buffer-size", config.BufferSize)
+	}
+	if config.UseMmap {
+		args = append(args, "--use-mmap")
+	}
+	if config.UploadChunkSize != "" {
+		args = append(args, "--s3-chunk-size", config.UploadChunkSize)
+	}
+	if config.UploadCutoff != "" {
+		args = append(args, "--s3-upload-cutoff", config.UploadCutoff)
+	}
+	if config.UploadConcurrency > 0 {
+		args = append(args, "--s3-upload-concurrency", strconv.Itoa(config.UploadConcurrency))
+	}
+	if config.CopyCutoff != "" {
+		args = append(args, "--s3-copy-cutoff", config.CopyCutoff)
+	}
+	return args
+}
+
+func validateMultipart(config *Config) error {
+	if config.UploadChunkSize != "" {
+		size, err := parseSize(config.UploadChunkSize)
+		if err != nil {
+			return fmt.Errorf("invalid UPLOAD_CHUNK_SIZE: %w", err)
+		}
+		if size < minChunkSize {
+			return fmt.Errorf("UPLOAD_CHUNK_SIZE %s is below the S3 minimum part size of 5M", config.UploadChunkSize)
+		}
+	}
+	for _, c := range []struct {
+		key   string
+		value string
+	}{{"UPLOAD_CUTOFF", config.UploadCutoff}, {"COPY_CUTOFF", config.CopyCutoff}} {
+		if c.value == "" {
+			continue
+		}
+		size, err := parseSize(c.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", c.key, err)
+		}
+		if size > maxCutoff {
+			return fmt.Errorf("%s %s exceeds the S3 single-request limit of 5G", c.key, c.value)
+		}
+	}
+	if config.UploadConcurrency < 0 {
+		return fmt.Errorf("UPLOAD_CONCURRENCY must not be negative, got %d", config.UploadConcurrency)
+	}
+	if config.BufferSize != "" {
+		if _, err := parseSize(config.BufferSize); err != nil {
+			return fmt.Errorf("invalid BUFFER_SIZE: %w", err)
+		}
+	}
+	if config.ExpectedMaxObjectSize != "" {
+		if _, err := parseSize(config.ExpectedMaxObjectSize); err != nil {
+			return fmt.Errorf("invalid EXPECTED_MAX_OBJECT_SIZE: %w", err)
+		}
+	}
+	return nil
+}
+
+// chunkSizeWarning reports when UPLOAD_CHUNK_SIZE can't cover the largest
+// expected object in maxUploadParts parts. rclone then raises the chunk size
+// for that upload on its own, but only for objects of known size, and the
+// memory per transfer grows with it. The largest object is taken from
+// EXPECTED_MAX_OBJECT_SIZE, or MAX_SIZE when that filter is set.
+func chunkSizeWarning(config *Config) string {
+	expected := config.ExpectedMaxObjectSize
+	if expected == "" {
+		expected = config.MaxSize
+	}
+	if config.UploadChunkSize == "" || expected == "" {
+		return ""
+	}
+	chunk, errC := parseSize(config.UploadChunkSize)
+	largest, errL := parseSize(expected)
+	if errC != nil || errL != nil || chunk*maxUploadParts >= largest {
+		return ""
+	}
+	return fmt.Sprintf("UPLOAD_CHUNK_SIZE %s allows objects up to %s in %d parts, less than the expected %s; "+
+		"rclone will raise the chunk size for larger uploads, using more memory per transfer",
+		config.UploadChunkSize, formatSize(chunk*maxUploadParts), maxUploadParts, expected)
+}
+
+// memoryProfile is a consistent set of the settings that drive rclone's
+// memory use, roughly TRANSFERS × (BUFFER_SIZE + UPLOAD_CONCURRENCY ×
+// UPLOAD_CHUNK_SIZE). Empty sizes keep rclone's defaults.
+type memoryProfile struct {
+	bufferSize string
+	transfers  int
+	checkers   int
+	chunkSize  string
+}
+
+// memoryProfiles are the MEMORY_PROFILE presets. default matches rclone's
+// own defaults; low fits pods with around 512Mi.
+var memoryProfiles = map[string]memoryProfile{
+	"low":     {bufferSize: "4M", transfers: 2, checkers: 4, chunkSize: "5M"},
+	"default": {transfers: 4, checkers: 8},
+	"high":    {bufferSize: "64M", transfers: 16, checkers: 32, chunkSize: "64M"},
+}
+
+// formatSize renders a byte count with the largest binary suffix that keeps
+// it at or above 1, e.g. 48.8Gi.
+func formatSize(bytes int64) string {
+	units := []string{"", "Ki", "Mi", "Gi", "Ti", "Pi"}
+	value := float64(bytes)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + units[i]
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMemoryProfile(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		env  map[string]string
+		// want are the values of the flags; an empty value means the flag
+		// is absent.
+		want map[string]string
+		err  string
+	}{
+		{
+			name: "default",
+			want: map[string]string{"--transfers": "4", "--checkers": "8", "--buffer-size": "", "--s3-chunk-size": ""},
+		},
+		{
+			name: "low",
+			env:  map[string]string{"MEMORY_PROFILE": "Low"},
+			want: map[string]string{"--transfers": "2", "--checkers": "4", "--buffer-size": "4M", "--s3-chunk-size": "5M"},
+		},
+		{
+			name: "explicit settings win",
+			env:  map[string]string{"MEMORY_PROFILE": "high", "TRANSFERS": "8", "BUFFER_SIZE": "16M"},
+			want: map[string]string{"--transfers": "8", "--checkers": "32", "--buffer-size": "16M", "--s3-chunk-size": "64M"},
+		},
+		{
+			name: "unknown",
+			env:  map[string]string{"MEMORY_PROFILE": "tiny"},
+			err:  `invalid MEMORY_PROFILE "tiny": must be low, default or high`,
+		},
+		{
+			name: "bad buffer size",
+			env:  map[string]string{"BUFFER_SIZE": "16 megs"},
+			err:  "invalid BUFFER_SIZE",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.env)
+			wantError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			args := syncArgs(config)
+			for flag, want := range tt.want {
+				if got, _ := argValue(args, flag); got != want {
+					t.Errorf("%s = %q, want %q", flag, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUseMmap(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"USE_MMAP": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(syncArgs(config), "--use-mmap") {
+		t.Errorf("rclone arguments lack --use-mmap")
+	}
+}
+
+func TestMultipartArgs(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{
+		"UPLOAD_CHUNK_SIZE":  "64M",
+		"UPLOAD_CUTOFF":      "100M",
+		"UPLOAD_CONCURRENCY": "8",
+		"COPY_CUTOFF":        "1G",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := syncArgs(config)
+	for flag, want := range map[string]string{"--s3-chunk-size": "64M", "--s3-upload-cutoff": "100M", "--s3-upload-concurrency": "8", "--s3-copy-cutoff": "1G"} {
+		if got, _ := argValue(args, flag); got != want {
+			t.Errorf("%s = %q, want %q", flag, got, want)
+		}
+	}
+
+	// Unset, rclone's defaults apply.
+	config, err = loadTestConfig(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, flag := range []string{"--s3-upload-cutoff", "--s3-upload-concurrency", "--s3-copy-cutoff"} {
+		if value, ok := argValue(syncArgs(config), flag); ok {
+			t.Errorf("%s = %q without a setting", flag, value)
+		}
+	}
+}
+
+func TestValidateMultipart(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"UPLOAD_CHUNK_SIZE": "5M", "UPLOAD_CUTOFF": "5G", "COPY_CUTOFF": "5G"}, ""},
+		{map[string]string{"UPLOAD_CHUNK_SIZE": "4M"}, "UPLOAD_CHUNK_SIZE 4M is below the S3 minimum part size of 5M"},
+		{map[string]string{"UPLOAD_CHUNK_SIZE": "big"}, "invalid UPLOAD_CHUNK_SIZE"},
+		{map[string]string{"UPLOAD_CUTOFF": "6G"}, "UPLOAD_CUTOFF 6G exceeds the S3 single-request limit of 5G"},
+		{map[string]string{"COPY_CUTOFF": "6G"}, "COPY_CUTOFF 6G exceeds the S3 single-request limit of 5G"},
+		{map[string]string{"COPY_CUTOFF": "1 GB"}, "invalid COPY_CUTOFF"},
+		{map[string]string{"UPLOAD_CONCURRENCY": "-1"}, "UPLOAD_CONCURRENCY must not be negative, got -1"},
+		{map[string]string{"EXPECTED_MAX_OBJECT_SIZE": "huge"}, "invalid EXPECTED_MAX_OBJECT_SIZE"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestChunkSizeWarning(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"UPLOAD_CHUNK_SIZE": "5M", "EXPECTED_MAX_OBJECT_SIZE": "100G"}, "UPLOAD_CHUNK_SIZE 5M allows objects up to 48.8Gi in 10000 parts, less than the expected 100G"},
+		{map[string]string{"UPLOAD_CHUNK_SIZE": "5M", "MAX_SIZE": "100G"}, "less than the expected 100G"},
+		{map[string]string{"UPLOAD_CHUNK_SIZE": "16M", "EXPECTED_MAX_OBJECT_SIZE": "100G"}, ""},
+		{map[string]string{"UPLOAD_CHUNK_SIZE": "5M"}, ""},
+	} {
+		config, err := loadTestConfig(t, tt.env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := chunkSizeWarning(config)
+		if (tt.want == "") != (got == "") || !strings.Contains(got, tt.want) {
+			t.Errorf("%v: warning %q, want %q", tt.env, got, tt.want)
+		}
+		if got != "" && !slices.Contains(config.warnings, got) {
+			t.Errorf("%v: warning %q is not logged", tt.env, got)
+		}
+	}
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// nativeDefaultUploadCutoff and nativeDefaultChunkSize are rclone's S3
+// defaults, used when UPLOAD_CUTOFF and UPLOAD_CHUNK_SIZE are unset.
+const (
+	nativeDefaultUploadCutoff = 200 << 20
+	nativeDefaultChunkSize    = 5 << 20
+)
+
+// sourceETagHeader records the ETag of the source object on every copy, so
+// that a multipart source, whose ETag isn't the MD5 of its content, can still
+// be compared with its copy.
+const sourceETagHeader = "X-Amz-Meta-S3sync-Etag"
+
+// md5ETag matches the ETag of an object uploaded in one part, which is
+// the MD5 of its content.
+var md5ETag = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// preservedHeaders are the headers of a source object that PRESERVE_METADATA
+// keeps on its copy, besides Content-Type, which is always kept, and the
+// user metadata.
+var preservedHeaders = []string{"Cache-Control", "Content-Disposition", "Content-Encoding", "Content-Language", "Expires"}
+
+// nativeEngine syncs through the S3 API of both remotes instead of rclone.
+// It logs what it does in rclone's terms through an rcloneLog, so that the
+// manifest, the dry-run diff, LOG_TRANSFERS, the heartbeat and
+// STATSD_PROGRESS work as with rclone.
+type nativeEngine struct{}
+
+// nativeSync is one run of the native engine.
+type nativeSync struct {
+	config  *Config
+	ctx     context.Context
+	out     *rcloneLog
+	src     *s3Client
+	dst     *s3Client
+	limiter *bandwidthLimiter
+	// serverSide is set when both remotes are the same endpoint and account,
+	// so objects are copied with CopyObject instead of through s3-sync.
+	serverSide bool
+	start      time.Time
+
+	bytes, totalBytes, transfers, checks, deletes, serverSideCopies, errors atomic.Int64
+}
+
+// pendingCopy is an object to copy, and whether it replaces one.
+type pendingCopy struct {
+	object   s3Object
+	key      string
+	replaces bool
+}
+
+func (nativeEngine) sync(config *Config, _ *rcloneRemotes, logger *logrus.Logger) (RunStats, error) {
+	if config.DryRun {
+		logger.Info("Running in dry-run mode - no changes will be made")
+	}
+	conns := config.Transfers + config.Checkers
+	src, err := newS3Client(config.Source, config.Retries, conns)
+	if err != nil {
+		return RunStats{}, &classError{class: "setup", err: err}
+	}
+	dst, err := newS3Client(config.Dest, config.Retries, conns)
+	if err != nil {
+		return RunStats{}, &classError{class: "setup", err: err}
+	}
+
+	out := newRcloneLog(logger, logOutput())
+	out.manifest, out.diff, out.logTransfers = config.manifest, config.diff, config.LogTransfers
+	out.archived = config.archived
+	config.heartbeat.track(out)
+	if config.StatsDProgress {
+		out.statsd = newStatsD(config)
+	}
+	ctx, cancel, timeout := syncContext(config)
+	defer cancel()
+	go func() {
+		select {
+		case <-shutdown.interrupted():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	s := &nativeSync{
+		config: config,
+		ctx:    ctx,
+		out:    out,
+		src:    src,
+		dst:    dst,
+		serverSide: config.Source.Endpoint == config.Dest.Endpoint && config.Source.Region == config.Dest.Region &&
+			sameCredentials(config.Source, config.Dest),
+		start: time.Now(),
+	}
+	rate, perFile := nativeBandwidthRate(config.BandwidthLimit), config.BandwidthLimitPerFile
+	if rate > 0 && !perFile {
+		s.limiter = newBandwidthLimiter(rate)
+	}
+	logger.WithFields(logrus.Fields{
+		"source":      remotePath("source", config.Source.Bucket, config.Source.Prefix),
+		"dest":        remotePath("dest", config.Dest.Bucket, config.Dest.Prefix),
+		"mode":        config.SyncMode,
+		"server_side": s.serverSide,
+	}).Info("Starting native sync")
+
+	stopStats := s.logStats()
+	err = s.run(rate, perFile)
+	stopStats()
+	stats, _ := out.result()
+
+	fields := logrus.Fields{
+		"duration":            time.Since(s.start),
+		"mode":                config.SyncMode,
+		"compare_mode":        config.CompareMode,
+		"transfers":           config.Transfers,
+		"checkers":            config.Checkers,
+		"success":             err == nil,
+		"bytes_transferred":   stats.Bytes,
+		"objects_transferred": stats.Transfers,
+		"objects_checked":     stats.Checks,
+		"errors":              stats.Errors,
+		"objects_deleted":     stats.Deletes,
+	}
+	logger.WithFields(fields).Info("Sync operation completed")
+
+	var limitErr *deleteLimitError
+	switch {
+	case shutdown.err() != nil:
+		return stats, shutdown.err()
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		logger.WithFields(logrus.Fields{
+			"timeout":             timeout,
+			"bytes_transferred":   stats.Bytes,
+			"objects_transferred": stats.Transfers,
+			"objects_checked":     stats.Checks,
+		}).Error("The sync took too long and was stopped")
+		return stats, &timeoutError{timeout: timeout, err: ctx.Err()}
+	case errors.As(err, &limitErr):
+		return stats, err
+	case err != nil:
+		classes := out.topErrors(3)
+		if len(classes) > 0 {
+			logger.WithField("rclone_errors", classes).Error("Sync errors by class, most frequent first")
+		}
+		return stats, &rcloneError{classes: classes, lines: out.lastErrors(), err: fmt.Errorf("native sync failed: %w", err)}
+	}
+	return stats, nil
+}
+
+// run lists both sides, copies what is missing or differs, and deletes what
+// no longer exists in the source. A failure of a single object is counted
+// and logged, and the run goes on; deletions are skipped if anything failed,
+// as rclone does.
+func (s *nativeSync) run(rate float64, perFile bool) error {
+	config := s.config
+	var source []s3Object
+	dest := make(map[string]s3Object)
+	var wg sync.WaitGroup
+	var sourceErr, destErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sourceErr = s.src.list(s.ctx, config.Source.Bucket, listPrefix(config.Source.Prefix), func(o s3Object) {
+			if key, ok := s.relative(config.Source.Prefix, o.Key); ok {
+				o.Key = key
+				source = append(source, o)
+			}
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		destErr = s.dst.list(s.ctx, config.Dest.Bucket, listPrefix(config.Dest.Prefix), func(o s3Object) {
+			if key, ok := s.relative(config.Dest.Prefix, o.Key); ok {
+				o.Key = key
+				dest[key] = o
+			}
+		})
+	}()
+	wg.Wait()
+	for _, err := range []error{sourceErr, destErr} {
+		if err != nil {
+			s.fail("", "Failed to list", err)
+			return err
+		}
+	}
+
+	var extraneous []s3Object
+	if config.SyncMode == "sync" && config.DeleteStrategy != "none" {
+		inSource := make(map[string]bool, len(source))
+		for _, o := range source {
+			inSource[o.Key] = true
+		}
+		for key, o := range dest {
+			if !inSource[key] {
+				extraneous = append(extraneous, o)
+			}
+		}
+		sort.Slice(extraneous, func(i, j int) bool { return extraneous[i].Key < extraneous[j].Key })
+	}
+	if config.DeleteStrategy == "before" {
+		if err := s.delete(extraneous); err != nil {
+			return err
+		}
+		extraneous = nil
+	}
+
+	copies := make(chan pendingCopy)
+	go func() {
+		defer close(copies)
+		s.compare(source, dest, copies)
+	}()
+	var transfers sync.WaitGroup
+	for i := 0; i < max(config.Transfers, 1); i++ {
+		transfers.Add(1)
+		go func() {
+			defer transfers.Done()
+			limiter := s.limiter
+			for c := range copies {
+				if rate > 0 && perFile {
+					limiter = newBandwidthLimiter(rate)
+				}
+				s.copyWithRetries(c, limiter)
+			}
+		}()
+	}
+	transfers.Wait()
+
+	if s.ctx.Err() != nil {
+		return s.ctx.Err()
+	}
+	if n := s.errors.Load(); n > 0 {
+		if len(extraneous) > 0 {
+			s.out.log(rcloneLogEntry{Level: "error", Msg: "Not deleting files as there were IO errors"})
+		}
+		return fmt.Errorf("%d errors", n)
+	}
+	return s.delete(extraneous)
+}
+
+// listPrefix is the listing prefix of a bucket prefix: the "folder" itself.
+func listPrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// relative returns key relative to prefix, and false for the "folder"
+// markers some tools create and for keys under EXCLUDE_PREFIXES.
+func (s *nativeSync) relative(prefix, key string) (string, bool) {
+	if prefix != "" {
+		key = strings.TrimPrefix(key, prefix+"/")
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		return "", false
+	}
+	for _, excluded := range s.config.ExcludePrefixes {
+		if excluded = cleanPrefix(excluded); excluded != "" && strings.HasPrefix(key, excluded+"/") {
+			return "", false
+		}
+	}
+	return key, true
+}
+
+// compare sends the source objects that are missing from the destination or
+// differ from their copy to copies, with CHECKERS objects compared at once.
+func (s *nativeSync) compare(source []s3Object, dest map[string]s3Object, copies chan<- pendingCopy) {
+	objects := make(chan s3Object)
+	var checkers sync.WaitGroup
+	for i := 0; i < max(s.config.Checkers, 1); i++ {
+		checkers.Add(1)
+		go func() {
+			defer checkers.Done()
+			for o := range objects {
+				existing, ok := dest[o.Key]
+				if ok {
+					s.checks.Add(1)
+					same, reason, err := s.same(o, existing)
+					if err != nil {
+						s.fail(o.Key, "Failed to compare", err)
+						continue
+					}
+					if same {
+						continue
+					}
+					s.out.log(rcloneLogEntry{Level: "debug", Msg: reason, Object: o.Key})
+				}
+				s.totalBytes.Add(o.Size)
+				select {
+				case copies <- pendingCopy{object: o, key: o.Key, replaces: ok}:
+				case <-s.ctx.Done():
+				}
+			}
+		}()
+	}
+	for _, o := range source {
+		select {
+		case objects <- o:
+		case <-s.ctx.Done():
+		}
+		if s.ctx.Err() != nil {
+			break
+		}
+	}
+	close(objects)
+	checkers.Wait()
+}
+
+// same reports whether existing is a copy of o under COMPARE_MODE, and if not
+// why, in the words rclone uses. ETags are only the MD5 of the content for
+// objects uploaded in one part and not encrypted with SSE-KMS or SSE-C, so
+// otherwise the source ETag recorded on the copy is compared.
+func (s *nativeSync) same(o, existing s3Object) (bool, string, error) {
+	if o.Size != existing.Size {
+		return false, fmt.Sprintf("Sizes differ (src %d vs dst %d)", o.Size, existing.Size), nil
+	}
+	switch s.config.CompareMode {
+	case "size-only":
+		return true, "", nil
+	case "modtime":
+		if existing.LastModified.Before(o.LastModified) {
+			return false, "Modification times differ", nil
+		}
+		return true, "", nil
+	}
+	if o.ETag == existing.ETag {
+		return true, "", nil
+	}
+	if md5ETag.MatchString(o.ETag) && md5ETag.MatchString(existing.ETag) && s.config.Source.md5ETags() && s.config.Dest.md5ETags() {
+		return false, "md5 differ", nil
+	}
+	header, err := s.dst.head(s.ctx, s.config.Dest.Bucket, s.destKey(existing.Key))
+	if err != nil {
+		return false, "", err
+	}
+	if header.Get(sourceETagHeader) == o.ETag {
+		return true, "", nil
+	}
+	return false, "md5 differ", nil
+}
+
+func (s *nativeSync) sourceKey(key string) string { return joinKey(s.config.Source.Prefix, key) }
+
+func (s *nativeSync) destKey(key string) string { return joinKey(s.config.Dest.Prefix, key) }
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "/" + key
+}
+
+// copyWithRetries copies an object, trying RETRIES times in all if it fails
+// with a retryable error, as the stream of a failed copy can't be resent.
+func (s *nativeSync) copyWithRetries(c pendingCopy, limiter *bandwidthLimiter) {
+	if s.ctx.Err() != nil {
+		return
+	}
+	size := c.object.Size
+	if s.config.DryRun {
+		s.out.log(rcloneLogEntry{Level: "notice", Msg: fmt.Sprintf("Skipped copy as --dry-run is set (size %d)", size), Object: c.key, Size: &size})
+		return
+	}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		serverSide, err := s.copy(c, limiter)
+		if err == nil {
+			s.transfers.Add(1)
+			msg := "Copied (new)"
+			if serverSide {
+				s.serverSideCopies.Add(1)
+				msg = "Copied (server-side copy)"
+			} else if c.replaces {
+				msg = "Copied (replaced existing)"
+			}
+			s.out.log(rcloneLogEntry{Level: "info", Msg: msg, Object: c.key, Size: &size})
+			return
+		}
+		if s.config.archived != nil && archivedObject(err) {
+			s.skipArchived(c, err)
+			return
+		}
+		if attempt >= max(s.config.Retries, 1) || !retryableS3Error(err) || s.ctx.Err() != nil {
+			s.fail(c.key, "Failed to copy", err)
+			return
+		}
+		s.out.log(rcloneLogEntry{Level: "debug", Msg: fmt.Sprintf("Retrying copy (%d/%d): %v", attempt, s.config.Retries, err), Object: c.key})
+		select {
+		case <-time.After(backoff):
+		case <-s.ctx.Done():
+		}
+		backoff = min(2*backoff, s3MaxRetryBackoff)
+	}
+}
+
+// copy copies one object, server-side if possible, and reports whether it
+// was.
+func (s *nativeSync) copy(c pendingCopy, limiter *bandwidthLimiter) (bool, error) {
+	config := s.config
+	if s.serverSide && c.object.Size <= s3MaxCopySize {
+		source, err := s.src.head(s.ctx, config.Source.Bucket, s.sourceKey(c.key))
+		if err != nil {
+			return false, err
+		}
+		header := s.copyHeader(source, c.object)
+		if config.tags != nil {
+			// CopyObject copies the tags itself.
+			header.Set("X-Amz-Tagging-Directive", "COPY")
+		}
+		header = withHeaders(header, sseCustomerHeaders(config.Source, "X-Amz-Copy-Source-"))
+		if config.Source.RequesterPays {
+			// The copy reads the source, whose owner doesn't pay for it.
+			header.Set("X-Amz-Request-Payer", "requester")
+		}
+		err = s.dst.copy(s.ctx, config.Source.Bucket, s.sourceKey(c.key), config.Dest.Bucket, s.destKey(c.key), header)
+		if err == nil {
+			s.bytes.Add(c.object.Size)
+			if config.tags != nil && source.Get(tagCountHeader) != "" {
+				config.tags.record(c.key, nil, s.out.logger)
+			}
+		}
+		return true, err
+	}
+
+	resp, err := s.src.get(s.ctx, config.Source.Bucket, s.sourceKey(c.key))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	header := s.copyHeader(resp.Header, c.object)
+	body := &countingReader{r: resp.Body, limiter: limiter, counter: &s.bytes}
+	cutoff, chunk := int64(nativeDefaultUploadCutoff), int64(nativeDefaultChunkSize)
+	if v, err := parseSize(config.UploadCutoff); err == nil {
+		cutoff = v
+	}
+	if v, err := parseSize(config.UploadChunkSize); err == nil && v > 0 {
+		chunk = v
+	}
+	if c.object.Size < cutoff {
+		err = s.dst.put(s.ctx, config.Dest.Bucket, s.destKey(c.key), body, c.object.Size, header)
+	} else {
+		err = s.dst.putMultipart(s.ctx, config.Dest.Bucket, s.destKey(c.key), body, c.object.Size, chunk, header)
+	}
+	if err != nil {
+		// The bytes of a failed copy are sent again by the next attempt.
+		s.bytes.Add(-body.read)
+	} else if config.tags != nil {
+		copyTags(s.ctx, config, s.src, s.dst, c.key, resp.Header, s.out.logger)
+	}
+	return false, err
+}
+
+// copyHeader returns the headers for the copy of an object: its
+// Content-Type, with PRESERVE_METADATA its other content headers and user
+// metadata, the destination ACL and storage class, and its ETag. Copies
+// replace the metadata of the source even server-side, so that the ETag can
+// be recorded.
+func (s *nativeSync) copyHeader(source http.Header, o s3Object) http.Header {
+	header := http.Header{}
+	if v := source.Get("Content-Type"); v != "" {
+		header.Set("Content-Type", v)
+	}
+	if s.config.PreserveMetadata {
+		for _, name := range preservedHeaders {
+			if v := source.Get(name); v != "" {
+				header.Set(name, v)
+			}
+		}
+		for name, values := range source {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+				header[name] = values
+			}
+		}
+	}
+	header.Set("X-Amz-Acl", s.config.Dest.ACL)
+	if s.config.Dest.StorageClass != "" {
+		header.Set("X-Amz-Storage-Class", s.config.Dest.StorageClass)
+	}
+	header.Set(sourceETagHeader, o.ETag)
+	return header
+}
+
+// delete deletes the extraneous destination objects in batches, up to the
+// delete limit. Beyond it nothing more is deleted and a deleteLimitError is
+// returned, as rclone stops at --max-delete.
+func (s *nativeSync) delete(extraneous []s3Object) error {
+	var refused int
+	if limit, ok := deleteLimit(s.config); ok && len(extraneous) > limit {
+		refused = len(extraneous) - limit
+		extraneous = extraneous[:limit]
+	}
+	// rclone counts the objects it deletes as checks, as well as those it
+	// compares.
+	s.checks.Add(int64(len(extraneous)))
+	if s.config.DryRun {
+		for _, o := range extraneous {
+			size := o.Size
+			s.out.log(rcloneLogEntry{Level: "notice", Msg: fmt.Sprintf("Skipped delete as --dry-run is set (size %d)", size), Object: o.Key, Size: &size})
+		}
+	}
+	for start := 0; start < len(extraneous) && !s.config.DryRun; start += s3MaxDeleteKeys {
+		batch := extraneous[start:min(start+s3MaxDeleteKeys, len(extraneous))]
+		keys := make([]string, len(batch))
+		for i, o := range batch {
+			keys[i] = s.destKey(o.Key)
+		}
+		failed, err := s.dst.deleteKeys(s.ctx, s.config.Dest.Bucket, keys)
+		if err != nil {
+			s.fail("", "Failed to delete", err)
+			return err
+		}
+		for i, o := range batch {
+			if err := failed[keys[i]]; err != nil {
+				s.fail(o.Key, "Couldn't delete", err)
+				continue
+			}
+			s.deletes.Add(1)
+			size := o.Size
+			s.out.log(rcloneLogEntry{Level: "info", Msg: "Deleted", Object: o.Key, Size: &size})
+		}
+	}
+	if refused > 0 {
+		limit, _ := deleteLimit(s.config)
+		s.errors.Add(1)
+		s.out.log(rcloneLogEntry{Level: "error", Msg: fmt.Sprintf("Couldn't delete %d more files: --max-delete threshold reached", refused)})
+		return &deleteLimitError{limit: limit, skipped: refused, err: fmt.Errorf("%d deletions exceed the limit", refused)}
+	}
+	if n := s.errors.Load(); n > 0 {
+		return fmt.Errorf("%d errors", n)
+	}
+	return nil
+}
+
+// skipArchived passes an archived source object on to the rcloneLog, which
+// records it as skipped, after requesting its restore with
+// ARCHIVED_OBJECTS=restore.
+func (s *nativeSync) skipArchived(c pendingCopy, err error) {
+	if s.config.ArchivedObjects == "restore" {
+		entry := s.out.logger.WithFields(logrus.Fields{"component": "rclone", "object": c.key})
+		if restoreErr := s.src.restore(s.ctx, s.config.Source.Bucket, s.sourceKey(c.key), restoreDays, restoreTier); restoreErr != nil {
+			entry.WithError(restoreErr).Warn("Failed to request the restore of an archived source object")
+		} else {
+			s.config.archived.restored()
+			entry.Info("Requested the restore of an archived source object")
+		}
+	}
+	size := c.object.Size
+	s.out.log(rcloneLogEntry{Level: "error", Msg: "Failed to copy: " + err.Error(), Object: c.key, Size: &size})
+}
+
+// fail counts and logs the failure of an object, or of the run if key is "".
+func (s *nativeSync) fail(key, what string, err error) {
+	if s.ctx.Err() != nil {
+		// Stopped by SYNC_TIMEOUT or a signal, which is reported instead.
+		return
+	}
+	s.errors.Add(1)
+	s.out.log(rcloneLogEntry{Level: "error", Msg: what + ": " + err.Error(), Object: key})
+}
+
+// logStats logs a stats line every STATS_INTERVAL, and once more when the
+// returned function is called at the end of the run.
+func (s *nativeSync) logStats() func() {
+	interval := parseOptionalDuration(s.config.StatsInterval)
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.out.log(rcloneLogEntry{Level: "notice", Msg: "stats", Stats: &rcloneStats{RunStats: s.stats()}})
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		s.out.log(rcloneLogEntry{Level: "notice", Msg: "stats", Stats: &rcloneStats{RunStats: s.stats()}})
+	}
+}
+
+// stats returns the counts so far, as in an rclone stats line.
+func (s *nativeSync) stats() RunStats {
+	elapsed := time.Since(s.start).Seconds()
+	stats := RunStats{
+		Bytes:            s.bytes.Load(),
+		TotalBytes:       s.totalBytes.Load(),
+		Transfers:        s.transfers.Load(),
+		Checks:           s.checks.Load(),
+		Deletes:          s.deletes.Load(),
+		ServerSideCopies: s.serverSideCopies.Load(),
+		Errors:           s.errors.Load(),
+		ElapsedTime:      elapsed,
+	}
+	if elapsed > 0 {
+		stats.Speed = float64(stats.Bytes) / elapsed
+	}
+	return stats
+}
+
+// countingReader counts the bytes read through it, paced by limiter.
+type countingReader struct {
+	r       io.Reader
+	limiter *bandwidthLimiter
+	counter *atomic.Int64
+	read    int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if c.limiter != nil && len(p) > 64<<10 {
+		// Small reads keep the pace even.
+		p = p[:64<<10]
+	}
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	c.counter.Add(int64(n))
+	c.limiter.wait(n)
+	return n, err
+}
+
+// bandwidthLimiter paces the transfers that share it to a rate in bytes per
+// second.
+type bandwidthLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	next time.Time
+}
+
+func newBandwidthLimiter(rate float64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes fit the rate. It does nothing on a nil
+// limiter.
+func (l *bandwidthLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	until := l.next
+	l.mu.Unlock()
+	time.Sleep(time.Until(until))
+}
+
+// nativeBandwidthRate returns BANDWIDTH_LIMIT in bytes per second, or 0 for
+// no limit. Of an upload:download pair, the lower rate applies, as the
+// native engine downloads and uploads every byte.
+func nativeBandwidthRate(value string) float64 {
+	var rate float64
+	for _, r := range strings.Split(value, ":") {
+		if size, err := parseSize(r); err == nil && !strings.EqualFold(r, "off") && size > 0 && (rate == 0 || float64(size) < rate) {
+			rate = float64(size)
+		}
+	}
+	return rate
+}
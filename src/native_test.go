@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runNative runs a sync with ENGINE=native from the source-bucket of src to
+// the backup prefix of the dest-bucket of dst, and returns its exit code,
+// summary and output.
+func runNative(t *testing.T, src, dst *fakeS3, env map[string]string) (int, runSummary, string) {
+	t.Helper()
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+	env["RCLONE_PATH"], env["ENGINE"] = path, "native"
+	env["SOURCE_S3_ENDPOINT"], env["DEST_S3_ENDPOINT"] = src.URL, dst.URL
+	env["DEST_PREFIX"] = "backup"
+	setTestEnv(t, withEnv(env))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	summaries := readSummaries(t, out)
+	if len(summaries) != 1 {
+		t.Fatalf("summaries %+v:\n%s", summaries, out)
+	}
+	return result.code, summaries[0], out
+}
+
+// putKeys returns the keys of the PutObject requests f received.
+func putKeys(f *fakeS3) []string {
+	var keys []string
+	for _, r := range f.received("PutObject") {
+		keys = append(keys, r.key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestNativeCompare(t *testing.T) {
+	for _, tt := range []struct {
+		mode string
+		want []string
+	}{
+		{"checksum", []string{"backup/edited.txt", "backup/new.txt", "backup/resized.txt", "backup/stale.txt"}},
+		{"size-only", []string{"backup/new.txt", "backup/resized.txt"}},
+		{"modtime", []string{"backup/new.txt", "backup/resized.txt", "backup/stale.txt"}},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+			modified := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Second)
+			for _, o := range []struct {
+				key, source, dest string
+				// age is how much older the copy is than the source.
+				age time.Duration
+			}{
+				{"same.txt", "same", "same", 0},
+				{"edited.txt", "abc", "xyz", -time.Hour},
+				{"stale.txt", "abc", "xyz", time.Hour},
+				{"resized.txt", "four", "five!", -time.Hour},
+				{"new.txt", "new", "", 0},
+			} {
+				src.put("source-bucket", o.key, o.source, nil).modified = modified
+				if o.dest != "" {
+					dst.put("dest-bucket", "backup/"+o.key, o.dest, nil).modified = modified.Add(-o.age)
+				}
+			}
+			code, summary, out := runNative(t, src, dst, map[string]string{"COMPARE_MODE": tt.mode})
+			if code != 0 {
+				t.Fatalf("run = %d, want 0:\n%s", code, out)
+			}
+			if got := putKeys(dst); !slices.Equal(got, tt.want) {
+				t.Errorf("copied %q, want %q", got, tt.want)
+			}
+			if summary.Stats.Checks != 4 || summary.Stats.Transfers != int64(len(tt.want)) {
+				t.Errorf("stats %+v, want 4 checks and %d transfers", summary.Stats, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestNativeCompareSourceETag(t *testing.T) {
+	src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+	src.put("source-bucket", "a.txt", "content", nil).etag = "0123456789abcdef0123456789abcdef-2"
+	// A copy of the multipart source in one part: the ETags differ, the
+	// source ETag recorded with it doesn't.
+	dst.put("dest-bucket", "backup/a.txt", "content", http.Header{sourceETagHeader: {"0123456789abcdef0123456789abcdef-2"}})
+	code, summary, out := runNative(t, src, dst, map[string]string{})
+	if code != 0 || summary.Stats.Transfers != 0 || summary.Stats.Checks != 1 {
+		t.Fatalf("run = %d with stats %+v, want a.txt found unchanged:\n%s", code, summary.Stats, out)
+	}
+	if got := dst.ops("HeadObject"); !slices.Equal(got, []string{"HeadObject dest-bucket/backup/a.txt"}) {
+		t.Errorf("dest requests %q, want the copy's source ETag read", got)
+	}
+
+	// A source changed since has another ETag.
+	src.put("source-bucket", "a.txt", "changed", nil).etag = "fedcba9876543210fedcba9876543210-2"
+	code, summary, out = runNative(t, src, dst, map[string]string{})
+	if code != 0 || summary.Stats.Transfers != 1 {
+		t.Fatalf("run = %d with stats %+v, want a.txt copied:\n%s", code, summary.Stats, out)
+	}
+	if o := dst.object("dest-bucket", "backup/a.txt"); o == nil || string(o.data) != "changed" || o.header.Get(sourceETagHeader) != "fedcba9876543210fedcba9876543210-2" {
+		t.Errorf("copy %+v, want the changed content with its source ETag", o)
+	}
+}
+
+func TestNativeCopy(t *testing.T) {
+	header := http.Header{"Content-Type": {"text/html"}, "Cache-Control": {"max-age=60"}, "X-Amz-Meta-Owner": {"media"}}
+
+	t.Run("streamed", func(t *testing.T) {
+		src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+		source := src.put("source-bucket", "dir/a b.html", "<p>hello</p>", header)
+		code, summary, out := runNative(t, src, dst, map[string]string{"DEST_ACL": "bucket-owner-full-control"})
+		if code != 0 {
+			t.Fatalf("run = %d, want 0:\n%s", code, out)
+		}
+		o := dst.object("dest-bucket", "backup/dir/a b.html")
+		if o == nil || string(o.data) != "<p>hello</p>" || o.etag != source.etag {
+			t.Fatalf("copy %+v, want the content of the source", o)
+		}
+		// Without PRESERVE_METADATA only the Content-Type is kept.
+		for name, want := range map[string]string{"Content-Type": "text/html", "Cache-Control": "", "X-Amz-Meta-Owner": "", "X-Amz-Acl": "bucket-owner-full-control", sourceETagHeader: source.etag} {
+			if got := o.header.Get(name); got != want {
+				t.Errorf("copy %s = %q, want %q", name, got, want)
+			}
+		}
+		if got := src.ops("GetObject", "CopyObject"); !slices.Equal(got, []string{"GetObject source-bucket/dir/a b.html"}) {
+			t.Errorf("source requests %q, want one GetObject", got)
+		}
+		if r := dst.received("PutObject"); len(r) != 1 || r[0].chunked || r[0].header.Get("X-Amz-Content-Sha256") != "UNSIGNED-PAYLOAD" {
+			t.Errorf("PutObject sent as %+v, want it unsigned with its length", r)
+		}
+		if summary.Stats.Transfers != 1 || summary.Stats.Bytes != 12 || summary.Stats.ServerSideCopies != 0 {
+			t.Errorf("stats %+v, want 1 transfer of 12 bytes", summary.Stats)
+		}
+	})
+
+	t.Run("server-side", func(t *testing.T) {
+		s3 := newFakeS3(t, "source-bucket", "dest-bucket")
+		source := s3.put("source-bucket", "dir/a b.html", "<p>hello</p>", header)
+		code, summary, out := runNative(t, s3, s3, map[string]string{"PRESERVE_METADATA": "true", "DEST_ACCESS_KEY": "source-access", "DEST_SECRET_KEY": "source-secret"})
+		if code != 0 {
+			t.Fatalf("run = %d, want 0:\n%s", code, out)
+		}
+		if got := s3.ops("GetObject", "PutObject", "CopyObject"); !slices.Equal(got, []string{"CopyObject dest-bucket/backup/dir/a b.html"}) {
+			t.Errorf("requests %q, want one CopyObject", got)
+		}
+		o := s3.object("dest-bucket", "backup/dir/a b.html")
+		if o == nil || string(o.data) != "<p>hello</p>" {
+			t.Fatalf("copy %+v, want the content of the source", o)
+		}
+		for name, want := range map[string]string{"Content-Type": "text/html", "Cache-Control": "max-age=60", "X-Amz-Meta-Owner": "media", sourceETagHeader: source.etag} {
+			if got := o.header.Get(name); got != want {
+				t.Errorf("copy %s = %q, want %q", name, got, want)
+			}
+		}
+		if summary.Stats.Transfers != 1 || summary.Stats.ServerSideCopies != 1 || summary.Stats.Bytes != 12 {
+			t.Errorf("stats %+v, want 1 server-side copy of 12 bytes", summary.Stats)
+		}
+	})
+}
+
+func TestNativeMultipart(t *testing.T) {
+	src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+	data := strings.Repeat("0123456789abcdef", 11<<16) // 11M
+	source := src.put("source-bucket", "big.bin", data, nil)
+	env := map[string]string{"UPLOAD_CUTOFF": "5M", "UPLOAD_CHUNK_SIZE": "5M"}
+	code, summary, out := runNative(t, src, dst, env)
+	if code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", code, out)
+	}
+	if got := dst.ops("CreateMultipartUpload", "UploadPart", "CompleteMultipartUpload", "PutObject"); len(got) != 5 || got[0] != "CreateMultipartUpload dest-bucket/backup/big.bin" {
+		t.Errorf("requests %q, want an upload in 3 parts", got)
+	}
+	// The ETag of a multipart upload is the MD5 of the MD5s of its parts.
+	var sums []byte
+	for _, part := range []string{data[:5<<20], data[5<<20 : 10<<20], data[10<<20:]} {
+		sum := md5.Sum([]byte(part))
+		sums = append(sums, sum[:]...)
+	}
+	sum := md5.Sum(sums)
+	o := dst.object("dest-bucket", "backup/big.bin")
+	if want := hex.EncodeToString(sum[:]) + "-3"; o == nil || o.etag != want || string(o.data) != data {
+		t.Fatalf("copy %v, want the content with ETag %s", o != nil, want)
+	}
+	if o.header.Get(sourceETagHeader) != source.etag {
+		t.Errorf("copy records source ETag %q, want %q", o.header.Get(sourceETagHeader), source.etag)
+	}
+	if summary.Stats.Bytes != int64(len(data)) {
+		t.Errorf("stats %+v, want %d bytes", summary.Stats, len(data))
+	}
+
+	// The next run finds the copy through the recorded ETag.
+	code, summary, out = runNative(t, src, dst, env)
+	if code != 0 || summary.Stats.Transfers != 0 || summary.Stats.Checks != 1 {
+		t.Errorf("second run = %d with stats %+v, want big.bin unchanged:\n%s", code, summary.Stats, out)
+	}
+}
+
+func TestNativeDelete(t *testing.T) {
+	t.Run("batches", func(t *testing.T) {
+		src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+		src.put("source-bucket", "keep.txt", "keep", nil)
+		dst.put("dest-bucket", "backup/keep.txt", "keep", nil)
+		// More than one DeleteObjects request, and one ListObjectsV2 page,
+		// take.
+		for i := 0; i < s3MaxDeleteKeys+1; i++ {
+			dst.put("dest-bucket", fmt.Sprintf("backup/old/%04d.txt", i), "old", nil)
+		}
+		code, summary, out := runNative(t, src, dst, map[string]string{"MAX_DELETE": "2000"})
+		if code != 0 {
+			t.Fatalf("run = %d, want 0:\n%s", code, out)
+		}
+		if got := dst.keys("dest-bucket"); !slices.Equal(got, []string{"backup/keep.txt"}) {
+			t.Errorf("dest keys %d, want backup/keep.txt alone", len(got))
+		}
+		deletes := dst.received("DeleteObjects")
+		if len(deletes) != 2 {
+			t.Errorf("%d DeleteObjects requests, want 2", len(deletes))
+		}
+		for _, r := range deletes {
+			if r.header.Get("Content-Md5") == "" {
+				t.Errorf("%s without Content-MD5, which S3-compatible stores require", r)
+			}
+		}
+		if summary.Stats.Deletes != s3MaxDeleteKeys+1 {
+			t.Errorf("stats %+v, want %d deletes", summary.Stats, s3MaxDeleteKeys+1)
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+		dst.put("dest-bucket", "backup/a.txt", "old", nil)
+		dst.put("dest-bucket", "backup/b.txt", "old", nil)
+		code, summary, out := runNative(t, src, dst, map[string]string{"MAX_DELETE": "1"})
+		if code != 5 {
+			t.Fatalf("run = %d, want 5:\n%s", code, out)
+		}
+		if got := dst.keys("dest-bucket"); !slices.Equal(got, []string{"backup/b.txt"}) {
+			t.Errorf("dest keys %q, want the first key deleted only", got)
+		}
+		if summary.Stats.Deletes != 1 {
+			t.Errorf("stats %+v, want 1 delete", summary.Stats)
+		}
+	})
+
+	t.Run("not after errors", func(t *testing.T) {
+		src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+		src.put("source-bucket", "a.txt", "new", nil)
+		dst.put("dest-bucket", "backup/old.txt", "old", nil)
+		src.fail = func(op, bucket, key string) (int, string) {
+			if op == "GetObject" {
+				return http.StatusForbidden, "AccessDenied"
+			}
+			return 0, ""
+		}
+		code, summary, out := runNative(t, src, dst, map[string]string{})
+		if code != 4 {
+			t.Fatalf("run = %d, want 4:\n%s", code, out)
+		}
+		if got := dst.ops("DeleteObjects"); len(got) != 0 || dst.object("dest-bucket", "backup/old.txt") == nil {
+			t.Errorf("deleted with %q after a failed copy", got)
+		}
+		if summary.Stats.Errors != 1 || !strings.Contains(out, "Not deleting files as there were IO errors") {
+			t.Errorf("stats %+v, want the failed copy counted and the deletions skipped:\n%s", summary.Stats, out)
+		}
+	})
+}
+
+func TestNativeRetries(t *testing.T) {
+	src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+	src.put("source-bucket", "a.txt", "hello", nil)
+	// The first request of every operation fails.
+	once := func() func(op, bucket, key string) (int, string) {
+		var mu sync.Mutex
+		failed := make(map[string]bool)
+		return func(op, bucket, key string) (int, string) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failed[op] {
+				return 0, ""
+			}
+			failed[op] = true
+			return http.StatusServiceUnavailable, "SlowDown"
+		}
+	}
+	src.fail, dst.fail = once(), once()
+	code, summary, out := runNative(t, src, dst, map[string]string{"RETRIES": "2"})
+	if code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", code, out)
+	}
+	if o := dst.object("dest-bucket", "backup/a.txt"); o == nil || string(o.data) != "hello" {
+		t.Errorf("copy %+v, want a.txt copied", o)
+	}
+	// The SDK retries the listing and the read, the copy of the stream is
+	// started over.
+	if got := src.ops("ListObjectsV2", "GetObject"); len(got) != 5 {
+		t.Errorf("source requests %q, want ListObjectsV2 twice and GetObject three times", got)
+	}
+	if got := dst.ops("PutObject"); len(got) != 2 {
+		t.Errorf("dest requests %q, want PutObject twice", got)
+	}
+	if summary.Stats.Transfers != 1 || summary.Stats.Errors != 0 || summary.Stats.Bytes != 5 {
+		t.Errorf("stats %+v, want 1 transfer of 5 bytes without errors", summary.Stats)
+	}
+}
+
+// TestNativeStatsMatchRclone runs the same sync with both engines and
+// compares the stats of their summaries.
+func TestNativeStatsMatchRclone(t *testing.T) {
+	src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+	src.put("source-bucket", "new.txt", "hello", nil)
+	src.put("source-bucket", "same.txt", "same", nil)
+	src.put("source-bucket", "changed.txt", "new!", nil)
+	dst.put("dest-bucket", "backup/same.txt", "same", nil)
+	dst.put("dest-bucket", "backup/changed.txt", "old", nil)
+	dst.put("dest-bucket", "backup/extra.txt", "extra", nil)
+	code, native, out := runNative(t, src, dst, map[string]string{"LOG_TRANSFERS": "true"})
+	if code != 0 {
+		t.Fatalf("native run = %d, want 0:\n%s", code, out)
+	}
+
+	// What rclone logs for the same sync with -v: deleting counts as a
+	// check, as comparing does.
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+if [ "$1" = sync ]; then
+	echo '{"level":"info","msg":"Copied (replaced existing)","object":"changed.txt","size":4}' >&2
+	echo '{"level":"info","msg":"Copied (new)","object":"new.txt","size":5}' >&2
+	echo '{"level":"info","msg":"Deleted","object":"extra.txt","size":5}' >&2
+	echo '{"level":"notice","msg":"stats","stats":{"bytes":9,"totalBytes":9,"transfers":2,"checks":3,"deletes":1,"renames":0,"serverSideCopies":0,"serverSideMoves":0,"errors":0,"elapsedTime":0.1,"speed":90}}' >&2
+fi
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "LOG_TRANSFERS": "true", "DEST_PREFIX": "backup"}))
+	var result runResult
+	out = captureOutput(t, func() { result, _ = run(nil) })
+	summaries := readSummaries(t, out)
+	if result.code != 0 || len(summaries) != 1 {
+		t.Fatalf("rclone run = %d with summaries %+v:\n%s", result.code, summaries, out)
+	}
+	rclone := summaries[0]
+
+	for _, stats := range []*RunStats{&native.Stats, &rclone.Stats} {
+		stats.ElapsedTime, stats.Speed = 0, 0
+	}
+	if native.Stats != rclone.Stats {
+		t.Errorf("native stats %+v\nrclone stats %+v", native.Stats, rclone.Stats)
+	}
+	if native.Result != rclone.Result || native.ExitCode != rclone.ExitCode {
+		t.Errorf("native run %s with %d, rclone %s with %d", native.Result, native.ExitCode, rclone.Result, rclone.ExitCode)
+	}
+}
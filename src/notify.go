@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// notifyModes are the NOTIFY_ON values.
+var notifyModes = []string{"failure", "success", "always"}
+
+// notifyAttempts is how often a notification is posted before giving up,
+// waiting notifyRetryDelay, then twice as long, in between.
+const (
+	notifyAttempts   = 3
+	notifyRetryDelay = time.Second
+)
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+func validateNotify(config *Config) error {
+	if !contains(notifyModes, config.NotifyOn) {
+		return fmt.Errorf("invalid NOTIFY_ON %q: must be one of %s", config.NotifyOn, strings.Join(notifyModes, ", "))
+	}
+	if config.SlackWebhookURL != "" {
+		if u, err := url.Parse(config.SlackWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid SLACK_WEBHOOK_URL: must look like https://hooks.slack.com/services/...")
+		}
+	}
+	return nil
+}
+
+// shouldNotify reports whether NOTIFY_ON asks for a notification about a run
+// with this result. Interrupted and partial runs count as failures.
+func shouldNotify(config *Config, result string) bool {
+	switch config.NotifyOn {
+	case "always":
+		return true
+	case "success":
+		return result == "success"
+	}
+	return result != "success"
+}
+
+// notify sends the notifications configured for a finished run. Failed
+// deliveries are logged as warnings and don't change the outcome of the run.
+func notify(config *Config, report *runSummary, logger *logrus.Logger) {
+	if shouldNotify(config, report.Result) {
+		sendNotifications(config, report, logger)
+	}
+}
+
+// sendNotifications sends report to every configured notification target
+// and returns how many there were and how many of them failed.
+func sendNotifications(config *Config, report *runSummary, logger *logrus.Logger) (sent, failed int) {
+	targets := []struct {
+		name string
+		set  bool
+		send func() error
+	}{
+		{"Slack", config.SlackWebhookURL != "", func() error { return postJSON(config.SlackWebhookURL, slackMessage(report)) }},
+		{"webhook", config.WebhookURL != "", func() error { return sendWebhook(config, report) }},
+		{"mail", config.SMTPHost != "", func() error { return sendMail(config, report) }},
+	}
+	for _, target := range targets {
+		if !target.set {
+			continue
+		}
+		sent++
+		if err := target.send(); err != nil {
+			failed++
+			logger.WithError(err).Warnf("Failed to send the %s notification", target.name)
+			continue
+		}
+		logger.Debugf("Sent the %s notification", target.name)
+	}
+	return sent, failed
+}
+
+// runNotifyTest sends a test notification for every job to each of its
+// targets and returns the exit code: 1 if one failed or none is configured.
+func runNotifyTest(configs []*Config) int {
+	logger := setupLogger(configs[0])
+	code := 0
+	for _, config := range configs {
+		report := newRunSummary(config, time.Now())
+		report.Result = "test"
+		report.FinishedAt = report.StartedAt
+		sent, failed := sendNotifications(config, report, logger)
+		fields := logrus.Fields{"targets": sent, "failed": failed}
+		if config.JobName != "" {
+			fields["job"] = config.JobName
+		}
+		switch {
+		case sent == 0:
+			logger.WithFields(fields).Error("NOTIFY_TEST is set but no notification target is configured")
+			code = 1
+		case failed > 0:
+			logger.WithFields(fields).Error("Some test notifications failed")
+			code = 1
+		default:
+			logger.WithFields(fields).Info("Sent the test notifications")
+		}
+	}
+	return code
+}
+
+// notificationTitle is the one-line description of a run, such as
+// "S3 sync failure: media".
+func notificationTitle(report *runSummary) string {
+	name := report.Job
+	if name == "" {
+		name = report.Source + " → " + report.Dest
+	}
+	result := report.Result
+	if report.ErrorClass == "delete_limit" {
+		result += " – delete limit reached"
+	}
+	title := fmt.Sprintf("S3 sync %s: %s", result, name)
+	if report.DryRun {
+		title += " (dry run)"
+	}
+	return title
+}
+
+// notificationFields are the details of a run shown in notifications, as
+// name and value pairs.
+func notificationFields(report *runSummary) [][2]string {
+	fields := [][2]string{
+		{"Duration", time.Duration(report.Duration * float64(time.Second)).Round(time.Second).String()},
+		{"Transferred", fmt.Sprintf("%s in %d objects", formatSize(report.Stats.Bytes), report.Stats.Transfers)},
+		{"Deleted", fmt.Sprintf("%d objects", report.Stats.Deletes)},
+		{"Mode", report.Mode},
+	}
+	if report.Error != "" {
+		class := report.ErrorClass
+		if len(report.RcloneErrors) > 0 {
+			class += " / " + string(report.RcloneErrors[0].Class)
+		}
+		fields = append(fields, [2]string{"Error class", class}, [2]string{"Error", report.Error})
+	}
+	if report.SkippedDeletes > 0 {
+		fields = append(fields, [2]string{"Skipped deletes", fmt.Sprintf("%d objects", report.SkippedDeletes)})
+	}
+	if report.RunID != "" {
+		fields = append(fields, [2]string{"Run ID", report.RunID})
+	}
+	return fields
+}
+
+// notificationText describes a run in plain text, for mail.
+func notificationText(report *runSummary) string {
+	var b strings.Builder
+	b.WriteString(notificationTitle(report) + "\n\n")
+	fields := append([][2]string{
+		{"Source", report.Source},
+		{"Destination", report.Dest},
+		{"Started", report.StartedAt.Format(time.RFC3339)},
+	}, notificationFields(report)...)
+	fields = append(fields, [2]string{"Exit code", strconv.Itoa(report.ExitCode)})
+	for _, field := range fields {
+		fmt.Fprintf(&b, "%-12s %s\n", field[0]+":", field[1])
+	}
+	b.WriteString("\nThe full run summary is attached as summary.json.\n")
+	return b.String()
+}
+
+// slackMessage formats a run summary for a Slack incoming webhook.
+func slackMessage(report *runSummary) map[string]interface{} {
+	color, icon := "good", ":white_check_mark:"
+	switch report.Result {
+	case "success":
+	case "partial":
+		color, icon = "warning", ":warning:"
+	default:
+		color, icon = "danger", ":x:"
+	}
+	title := icon + " " + notificationTitle(report)
+	var fields []map[string]interface{}
+	for _, field := range notificationFields(report) {
+		fields = append(fields, map[string]interface{}{"title": field[0], "value": field[1], "short": field[0] != "Error"})
+	}
+	return map[string]interface{}{
+		"text": title,
+		"attachments": []map[string]interface{}{{
+			"color":    color,
+			"fallback": title,
+			"fields":   fields,
+			"footer":   fmt.Sprintf("%s → %s, exit code %d", report.Source, report.Dest, report.ExitCode),
+			"ts":       report.FinishedAt.Unix(),
+		}},
+	}
+}
+
+// postJSON posts payload as JSON to target.
+func postJSON(target string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return deliver(notifyClient, http.MethodPost, target, body, nil)
+}
+
+// deliver sends body to target with the given extra headers. The content
+// type is JSON unless the headers set another. Network errors and 5xx or 429
+// answers are retried; other answers aren't.
+func deliver(client *http.Client, method, target string, body []byte, headers map[string]string) error {
+	delay := notifyRetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := deliverOnce(client, method, target, body, headers)
+		if err == nil || !retry || attempt == notifyAttempts {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func deliverOnce(client *http.Client, method, target string, body []byte, headers map[string]string) (retry bool, err error) {
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return false, redactURLError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, redactURLError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(detail)))
+}
+
+// redactURLError drops the URL from an HTTP client error, as webhook URLs
+// carry their credentials in the path.
+func redactURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
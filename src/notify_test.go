@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateNotify(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"NOTIFY_ON": "Always", "SLACK_WEBHOOK_URL": "https://hooks.slack.com/services/T/B/x"}, ""},
+		{map[string]string{"NOTIFY_ON": "never"}, `invalid NOTIFY_ON "never": must be one of failure, success, always`},
+		{map[string]string{"SLACK_WEBHOOK_URL": "hooks.slack.com/services/T/B/x"}, "invalid SLACK_WEBHOOK_URL"},
+		{map[string]string{"SLACK_WEBHOOK_URL": "ftp://hooks.slack.com/x"}, "invalid SLACK_WEBHOOK_URL"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestShouldNotify(t *testing.T) {
+	for _, tt := range []struct {
+		notifyOn string
+		result   string
+		want     bool
+	}{
+		{"failure", "failure", true},
+		{"failure", "interrupted", true},
+		{"failure", "partial", true},
+		{"failure", "success", false},
+		{"success", "success", true},
+		{"success", "failure", false},
+		{"always", "success", true},
+		{"always", "failure", true},
+	} {
+		if got := shouldNotify(&Config{NotifyOn: tt.notifyOn}, tt.result); got != tt.want {
+			t.Errorf("NOTIFY_ON=%s, %s run: %v, want %v", tt.notifyOn, tt.result, got, tt.want)
+		}
+	}
+}
+
+func TestSlackMessage(t *testing.T) {
+	report := &runSummary{
+		Job:          "media",
+		RunID:        "run-1",
+		Source:       "source:media",
+		Dest:         "dest:media-replica",
+		Mode:         "sync",
+		Duration:     849.2,
+		FinishedAt:   time.Unix(1714529649, 0),
+		Result:       "failure",
+		Stats:        RunStats{Bytes: 2 << 20, Transfers: 12, Deletes: 3},
+		ExitCode:     exitSyncFailed,
+		Error:        "rclone sync failed: exit status 1 (access_denied)",
+		ErrorClass:   "sync",
+		RcloneErrors: []classCount{{Class: "access_denied", Count: 2}},
+	}
+	message := slackMessage(report)
+	if message["text"] != ":x: S3 sync failure: media" {
+		t.Errorf("text = %q", message["text"])
+	}
+	attachment := message["attachments"].([]map[string]interface{})[0]
+	if attachment["color"] != "danger" || attachment["ts"] != int64(1714529649) || attachment["footer"] != "source:media → dest:media-replica, exit code 4" {
+		t.Errorf("attachment = %v", attachment)
+	}
+	fields := map[string]interface{}{}
+	for _, field := range attachment["fields"].([]map[string]interface{}) {
+		fields[field["title"].(string)] = field["value"]
+		if short := field["title"] != "Error"; field["short"] != short {
+			t.Errorf("field %v isn't short %v", field["title"], short)
+		}
+	}
+	for title, want := range map[string]string{
+		"Duration":    "14m9s",
+		"Transferred": "2.0Mi in 12 objects",
+		"Deleted":     "3 objects",
+		"Mode":        "sync",
+		"Error class": "sync / access_denied",
+		"Error":       report.Error,
+		"Run ID":      "run-1",
+	} {
+		if fields[title] != want {
+			t.Errorf("%s = %v, want %q", title, fields[title], want)
+		}
+	}
+
+	report.Result, report.Job, report.DryRun = "partial", "", true
+	message = slackMessage(report)
+	if message["text"] != ":warning: S3 sync partial: source:media → dest:media-replica (dry run)" {
+		t.Errorf("text = %q", message["text"])
+	}
+	if color := message["attachments"].([]map[string]interface{})[0]["color"]; color != "warning" {
+		t.Errorf("color = %v, want warning", color)
+	}
+}
+
+// webhookServer records the requests it gets and answers them with the
+// given status codes in turn, then with 200.
+type webhookServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	t.Helper()
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(body))
+		if len(s.statuses) > 0 {
+			w.WriteHeader(s.statuses[0])
+			s.statuses = s.statuses[1:]
+			io.WriteString(w, "no")
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *webhookServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func TestDeliver(t *testing.T) {
+	server := newWebhookServer(t, http.StatusServiceUnavailable)
+	if err := postJSON(server.URL, map[string]string{"text": "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if bodies := server.received(); len(bodies) != 2 || bodies[1] != `{"text":"hi"}` {
+		t.Errorf("got %q, want the message retried after the 503", bodies)
+	}
+	if ct := server.requests[0].Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	// Client errors aren't retried.
+	server = newWebhookServer(t, http.StatusForbidden)
+	wantError(t, postJSON(server.URL, "hi"), "403 Forbidden: no")
+	if n := len(server.received()); n != 1 {
+		t.Errorf("posted %d times, want once", n)
+	}
+
+	// The URL, which holds the webhook's secret, isn't part of the error.
+	err := redactURLError(&url.Error{Op: "Post", URL: "https://hooks.slack.com/services/secret", Err: errors.New("connection refused")})
+	if err.Error() != "Post: connection refused" {
+		t.Errorf("error = %v, want one without the URL", err)
+	}
+}
+
+func TestSlackNotification(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		exit     string
+		notifyOn string
+		want     string
+	}{
+		{"failure", "1", "failure", ":x: S3 sync failure: source:source-bucket → dest:dest-bucket/source-bucket"},
+		{"success", "0", "failure", ""},
+		{"success notified", "0", "always", ":white_check_mark: S3 sync success: source:source-bucket → dest:dest-bucket/source-bucket"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newWebhookServer(t)
+			path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit `+tt.exit)
+			setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SLACK_WEBHOOK_URL": server.URL, "NOTIFY_ON": tt.notifyOn}))
+			captureOutput(t, func() { run(nil) })
+			bodies := server.received()
+			if tt.want == "" {
+				if len(bodies) != 0 {
+					t.Errorf("posted %q, want no notification", bodies)
+				}
+				return
+			}
+			if len(bodies) != 1 {
+				t.Fatalf("posted %d messages, want 1", len(bodies))
+			}
+			var message struct{ Text string }
+			if err := json.Unmarshal([]byte(bodies[0]), &message); err != nil {
+				t.Fatal(err)
+			}
+			if message.Text != tt.want {
+				t.Errorf("text = %q, want %q", message.Text, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rcloneVersion is a parsed rclone release number.
+type rcloneVersion struct {
+	major, minor, patch int
+}
+
+func (v rcloneVersion) String() string {
+	return fmt.Sprintf("v%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+func (v rcloneVersion) less(other rcloneVersion) bool {
+	if v.major != other.major {
+		return v.major < other.major
+	}
+	if v.minor != other.minor {
+		return v.minor < other.minor
+	}
+	return v.patch < other.patch
+}
+
+var versionPattern = regexp.MustCompile(`v?(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// parseRcloneVersion extracts the first version number from s, accepting
+// forms such as "1.66", "v1.66.0" and "rclone v1.66.0-beta.7800".
+func parseRcloneVersion(s string) (rcloneVersion, error) {
+	match := versionPattern.FindStringSubmatch(s)
+	if match == nil {
+		return rcloneVersion{}, fmt.Errorf("no version number found in %q", strings.TrimSpace(s))
+	}
+	var v rcloneVersion
+	v.major, _ = strconv.Atoi(match[1])
+	v.minor, _ = strconv.Atoi(match[2])
+	if match[3] != "" {
+		v.patch, _ = strconv.Atoi(match[3])
+	}
+	return v, nil
+}
+
+// checkRcloneVersion runs "rclone version" and fails if the binary is missing
+// or older than the configured minimum. It returns the installed version.
+func checkRcloneVersion(config *Config) (rcloneVersion, error) {
+	output, err := exec.Command(config.RclonePath, "version").Output()
+	if err != nil {
+		return rcloneVersion{}, fmt.Errorf("rclone binary %q is not usable (set RCLONE_PATH if it is installed elsewhere): %w", config.RclonePath, err)
+	}
+
+	firstLine, _, _ := strings.Cut(string(output), "\n")
+	installed, err := parseRcloneVersion(firstLine)
+	if err != nil {
+		return rcloneVersion{}, fmt.Errorf("failed to parse rclone version: %w", err)
+	}
+
+	minimum, err := parseRcloneVersion(config.MinRcloneVersion)
+	if err != nil {
+		return rcloneVersion{}, fmt.Errorf("invalid MIN_RCLONE_VERSION: %w", err)
+	}
+	if installed.less(minimum) {
+		return installed, fmt.Errorf("rclone %s is older than the required minimum %s", installed, minimum)
+	}
+	if (config.PreserveMetadata || config.VerifyMetadataSample > 0) && installed.less(metadataRcloneVersion) {
+		return installed, fmt.Errorf("PRESERVE_METADATA and VERIFY_METADATA_SAMPLE need rclone %s or later, found %s", metadataRcloneVersion, installed)
+	}
+
+	return installed, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestParseRcloneVersion(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		want  rcloneVersion
+		err   string
+	}{
+		{"rclone v1.66.0", rcloneVersion{1, 66, 0}, ""},
+		{"rclone v1.66.0-beta.7800.a8a1dc2ea", rcloneVersion{1, 66, 0}, ""},
+		{"1.55", rcloneVersion{1, 55, 0}, ""},
+		{"v2.0.3", rcloneVersion{2, 0, 3}, ""},
+		{"rclone unknown\n", rcloneVersion{}, `no version number found in "rclone unknown"`},
+	} {
+		got, err := parseRcloneVersion(tt.input)
+		wantError(t, err, tt.err)
+		if got != tt.want {
+			t.Errorf("parseRcloneVersion(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRcloneVersionLess(t *testing.T) {
+	for _, tt := range []struct {
+		a, b rcloneVersion
+		want bool
+	}{
+		{rcloneVersion{1, 54, 9}, rcloneVersion{1, 55, 0}, true},
+		{rcloneVersion{1, 55, 0}, rcloneVersion{1, 55, 0}, false},
+		{rcloneVersion{1, 55, 1}, rcloneVersion{1, 55, 0}, false},
+		{rcloneVersion{0, 99, 0}, rcloneVersion{1, 0, 0}, true},
+		{rcloneVersion{2, 0, 0}, rcloneVersion{1, 66, 0}, false},
+	} {
+		if got := tt.a.less(tt.b); got != tt.want {
+			t.Errorf("%v.less(%v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRcloneVersion(t *testing.T) {
+	current, _ := fakeRclone(t, `echo "rclone v1.66.0"; echo "- os/version: debian"`)
+	old, _ := fakeRclone(t, `echo "rclone v1.53.3"`)
+	garbled, _ := fakeRclone(t, `echo "rclone"`)
+	broken, _ := fakeRclone(t, `exit 1`)
+	for _, tt := range []struct {
+		name    string
+		path    string
+		minimum string
+		want    string
+	}{
+		{"current", current, "", ""},
+		{"minimum raised", current, "1.67", "rclone v1.66.0 is older than the required minimum v1.67.0"},
+		{"old", old, "", "rclone v1.53.3 is older than the required minimum v1.55.0"},
+		{"old but allowed", old, "1.50", ""},
+		{"missing", filepath.Join(t.TempDir(), "rclone"), "", "is not usable (set RCLONE_PATH if it is installed elsewhere)"},
+		{"failing", broken, "", "is not usable"},
+		{"unparsable", garbled, "", "failed to parse rclone version"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, map[string]string{"RCLONE_PATH": tt.path, "MIN_RCLONE_VERSION": tt.minimum})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = checkRcloneVersion(config)
+			wantError(t, err, tt.want)
+		})
+	}
+}
+
+func TestPreflightFails(t *testing.T) {
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.53.3"; exit 0; }
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != exitPreflightFailed {
+		t.Fatalf("run = %d, want %d:\n%s", result.code, exitPreflightFailed, out)
+	}
+	if runs := readCalls(t, calls); len(runs) != 1 || runs[0] != "version" {
+		t.Errorf("rclone ran %q, want only the version check", runs)
+	}
+}
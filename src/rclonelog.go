@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// rcloneLevels maps rclone's log levels onto ours, one step down, since
+// rclone's default NOTICE output is what we log at info. This matches the
+// LOG_LEVEL table in the README.
+var rcloneLevels = map[string]logrus.Level{
+	"emergency": logrus.ErrorLevel,
+	"alert":     logrus.ErrorLevel,
+	"critical":  logrus.ErrorLevel,
+	"error":     logrus.ErrorLevel,
+	"warning":   logrus.WarnLevel,
+	"notice":    logrus.InfoLevel,
+	"info":      logrus.DebugLevel,
+	"debug":     logrus.TraceLevel,
+}
+
+// rcloneLogEntry is one line of rclone's --use-json-log output.
+type rcloneLogEntry struct {
+	Level  string       `json:"level"`
+	Msg    string       `json:"msg"`
+	Object string       `json:"object"`
+	Size   *int64       `json:"size"`
+	Stats  *rcloneStats `json:"stats"`
+}
+
+// rcloneStats are the counts of a stats line.
+type rcloneStats struct {
+	RunStats
+	Eta *float64 `json:"eta"`
+}
+
+// rcloneLog is an io.Writer for rclone's stderr that re-emits its JSON log
+// lines through logger with structured fields, and keeps the last stats,
+// which are cumulative and so the total of the run, and a tally of its
+// errors. Other lines, such as panics or output from before logging is set
+// up, are copied to raw verbatim.
+type rcloneLog struct {
+	logger *logrus.Logger
+	raw    io.Writer
+
+	mu      sync.Mutex
+	partial []byte
+	stats   RunStats
+	seen    bool
+	errors  errorTally
+	// manifest and diff, if set, record the per-file messages.
+	manifest *manifestWriter
+	diff     *diffReport
+	// logTransfers logs the per-file messages as transfer entries for
+	// LOG_TRANSFERS, move names deletions as in the manifest.
+	logTransfers bool
+	move         bool
+	start        time.Time
+	// copied, moved and deleted count the per-file messages.
+	copied, moved, deleted int64
+	// statsd, if set, gets the stats as gauges for STATSD_PROGRESS.
+	statsd *statsdClient
+	// archived, if set, takes the archived source objects that couldn't be
+	// read, which are then warnings rather than errors.
+	archived *archivedReport
+}
+
+func newRcloneLog(logger *logrus.Logger, raw io.Writer) *rcloneLog {
+	return &rcloneLog{logger: logger, raw: raw, start: time.Now()}
+}
+
+func (l *rcloneLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	data := append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		l.emit(data[:i+1])
+		data = data[i+1:]
+	}
+	l.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+// emit handles one line, including its newline.
+func (l *rcloneLog) emit(line []byte) {
+	var entry rcloneLogEntry
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) == 0 || trimmed[0] != '{' || json.Unmarshal(trimmed, &entry) != nil || entry.Level == "" {
+		l.raw.Write(line)
+		if bytes.Contains(trimmed, []byte("ERROR")) {
+			l.errors.add(string(trimmed))
+		}
+		return
+	}
+	l.handle(entry)
+}
+
+// log handles an entry that didn't come from rclone's output, such as the
+// messages the native engine logs in rclone's terms.
+func (l *rcloneLog) log(entry rcloneLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handle(entry)
+}
+
+func (l *rcloneLog) handle(entry rcloneLogEntry) {
+	level, ok := rcloneLevels[entry.Level]
+	if !ok {
+		level = logrus.InfoLevel
+	}
+	msg := strings.TrimSpace(entry.Msg)
+	if level <= logrus.ErrorLevel && l.archived != nil && l.skipArchived(entry, msg) {
+		return
+	}
+	if level <= logrus.ErrorLevel {
+		l.errors.add(msg)
+	}
+	fields := logrus.Fields{"component": "rclone"}
+	if entry.Object != "" {
+		fields["object"] = entry.Object
+	}
+	if entry.Size != nil {
+		fields["size"] = *entry.Size
+	}
+	if l.manifest != nil {
+		l.manifest.record(msg, entry.Object, entry.Size)
+	}
+	if l.diff != nil {
+		l.diff.record(msg, entry.Object, entry.Size)
+	}
+	if action := fileAction(msg, l.move); action != "" && entry.Object != "" {
+		switch action {
+		case "copied":
+			l.copied++
+		case "moved":
+			l.moved++
+		default:
+			l.deleted++
+		}
+		if l.logTransfers {
+			// rclone doesn't log how long a transfer took, so elapsed is
+			// how far into the sync it completed.
+			transfer := logrus.Fields{
+				"component": "rclone",
+				"action":    action,
+				"key":       entry.Object,
+				"elapsed":   time.Since(l.start).Seconds(),
+			}
+			if entry.Size != nil {
+				transfer["size"] = *entry.Size
+			}
+			l.logger.WithFields(transfer).Debug("rclone transfer")
+			return
+		}
+	}
+	if entry.Stats != nil {
+		l.stats, l.seen = entry.Stats.RunStats, true
+		l.statsd.progress(entry.Stats.RunStats)
+		// The message repeats the stats as a text table.
+		msg = "rclone stats"
+		fields["bytes"] = entry.Stats.Bytes
+		fields["total_bytes"] = entry.Stats.TotalBytes
+		fields["transfers"] = entry.Stats.Transfers
+		fields["checks"] = entry.Stats.Checks
+		fields["deletes"] = entry.Stats.Deletes
+		fields["errors"] = entry.Stats.Errors
+		fields["speed"] = entry.Stats.Speed
+		fields["elapsed"] = entry.Stats.ElapsedTime
+		if entry.Stats.Eta != nil {
+			fields["eta"] = *entry.Stats.Eta
+		}
+	}
+	l.logger.WithFields(fields).Log(level, msg)
+}
+
+// skipArchived handles an error about an archived source object for
+// ARCHIVED_OBJECTS, and reports whether it was one. rclone then skips its
+// deletions, which is only a warning too.
+func (l *rcloneLog) skipArchived(entry rcloneLogEntry, msg string) bool {
+	if strings.HasSuffix(msg, "as there were IO errors") && l.archived.count() > 0 {
+		l.logger.WithField("component", "rclone").Warn(msg)
+		return true
+	}
+	if entry.Object == "" || classifyError(msg) != "archived" {
+		return false
+	}
+	if l.archived.skip(entry.Object) {
+		if l.manifest != nil {
+			l.manifest.add("archived", entry.Object, entry.Size)
+		}
+		l.logger.WithFields(logrus.Fields{"component": "rclone", "object": entry.Object, "error": msg}).Warn("Skipped an archived source object")
+	}
+	return true
+}
+
+// result flushes an unterminated last line and returns the last stats, and
+// false if rclone logged none.
+func (l *rcloneLog) result() (RunStats, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.partial) > 0 {
+		l.emit(append(l.partial, '\n'))
+		l.partial = nil
+	}
+	return l.counted(), l.seen
+}
+
+// counted returns the last stats with the per-file counts.
+func (l *rcloneLog) counted() RunStats {
+	stats := l.stats
+	stats.CopiedKeys, stats.MovedKeys, stats.DeletedKeys = l.copied, l.moved, l.deleted
+	return stats
+}
+
+// latest returns the stats of the last complete line so far, while rclone
+// is still running.
+func (l *rcloneLog) latest() (RunStats, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counted(), l.seen
+}
+
+// lastErrors returns the last error lines rclone logged, oldest first.
+func (l *rcloneLog) lastErrors() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.errors.last...)
+}
+
+// topErrors returns the n most frequent classes of the errors rclone logged.
+func (l *rcloneLog) topErrors(n int) []classCount {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.errors.top(n)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestRcloneLog returns an rcloneLog logging JSON at trace level into
+// logs, with raw lines going to raw.
+func newTestRcloneLog(logs, raw *strings.Builder) *rcloneLog {
+	logger := logrus.New()
+	logger.SetOutput(logs)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.TraceLevel)
+	return newRcloneLog(logger, raw)
+}
+
+func TestRcloneLog(t *testing.T) {
+	var logs, raw strings.Builder
+	l := newTestRcloneLog(&logs, &raw)
+	// Lines may be split across writes.
+	for _, chunk := range []string{
+		`{"level":"notice","msg":"Copied (new)","object":"a.txt","size":12}` + "\n" + `{"level":"err`,
+		`or","msg":"b.txt: Failed to copy: AccessDenied","object":"b.txt"}` + "\n",
+		`{"level":"debug","msg":"checking"}` + "\npanic: runtime error\n",
+		`2024/05/01 10:00:00 ERROR : c.txt: not JSON yet` + "\n",
+		`{"level":"notice","msg":"Transferred: 12 B","stats":{"bytes":12,"transfers":1,"errors":1,"eta":null}}`,
+	} {
+		l.Write([]byte(chunk))
+	}
+	if _, seen := l.latest(); seen {
+		t.Error("the unterminated stats line counted before the end")
+	}
+	stats, seen := l.result()
+	if !seen || stats.Bytes != 12 || stats.Transfers != 1 || stats.Errors != 1 || stats.CopiedKeys != 1 {
+		t.Errorf("result = %+v, %v, want the stats of the last line", stats, seen)
+	}
+
+	entries := logEntries(t, logs.String())
+	for _, tt := range []struct {
+		msg, level string
+	}{
+		{"Copied (new)", "info"},
+		{"b.txt: Failed to copy: AccessDenied", "error"},
+		{"checking", "trace"},
+		{"rclone stats", "info"},
+	} {
+		e := findEntry(entries, tt.msg)
+		if e == nil || e["level"] != tt.level || e["component"] != "rclone" {
+			t.Errorf("%q logged as %v, want level %s", tt.msg, e, tt.level)
+		}
+	}
+	if e := findEntry(entries, "Copied (new)"); e == nil || e["object"] != "a.txt" || e["size"] != float64(12) {
+		t.Errorf("copy logged as %v, want the object and size", e)
+	}
+	if e := findEntry(entries, "rclone stats"); e == nil || e["bytes"] != float64(12) {
+		t.Errorf("stats logged as %v", e)
+	}
+
+	// Lines that aren't rclone's JSON are copied as they are, and errors
+	// among them still count.
+	if raw.String() != "panic: runtime error\n2024/05/01 10:00:00 ERROR : c.txt: not JSON yet\n" {
+		t.Errorf("raw output = %q", raw.String())
+	}
+	if errs := l.lastErrors(); len(errs) != 2 || !strings.Contains(errs[0], "AccessDenied") || !strings.Contains(errs[1], "not JSON yet") {
+		t.Errorf("lastErrors = %q", errs)
+	}
+}
+
+func TestRcloneLogTransfers(t *testing.T) {
+	var logs, raw strings.Builder
+	l := newTestRcloneLog(&logs, &raw)
+	l.logTransfers = true
+	l.Write([]byte(`{"level":"notice","msg":"Copied (new)","object":"a.txt","size":3}` + "\n" +
+		`{"level":"notice","msg":"Deleted","object":"old.txt"}` + "\n"))
+	stats, _ := l.result()
+	if stats.CopiedKeys != 1 || stats.DeletedKeys != 1 {
+		t.Errorf("counted %+v, want one copy and one deletion", stats)
+	}
+	var actions []string
+	for _, e := range logEntries(t, logs.String()) {
+		if e["msg"] == "rclone transfer" {
+			actions = append(actions, e["action"].(string)+" "+e["key"].(string))
+		}
+	}
+	if strings.Join(actions, ", ") != "copied a.txt, deleted old.txt" {
+		t.Errorf("transfers logged as %q", actions)
+	}
+}
+
+func TestRunLogsRcloneOutput(t *testing.T) {
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+if [ "$1" = sync ]; then
+	echo '{"level":"warning","msg":"Time may be set wrong","object":"a.txt"}' >&2
+	echo '{"level":"notice","msg":"stats","stats":{"bytes":5,"transfers":1}}' >&2
+fi
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+	if runs := readCalls(t, calls); len(runs) != 2 || !strings.Contains(runs[1], "--use-json-log") {
+		t.Errorf("rclone ran %q, want the sync with --use-json-log", runs)
+	}
+	entries := logEntries(t, out)
+	if e := findEntry(entries, "Time may be set wrong"); e == nil || e["level"] != "warning" || e["object"] != "a.txt" {
+		t.Errorf("rclone warning logged as %v", e)
+	}
+}
+
+func TestRunLogsTransfers(t *testing.T) {
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+if [ "$1" = sync ]; then
+	echo '{"level":"info","msg":"Copied (new)","object":"a.txt","size":3}' >&2
+	echo '{"level":"info","msg":"Deleted","object":"old.txt"}' >&2
+	echo '{"level":"notice","msg":"stats","stats":{"bytes":3,"transfers":1,"deletes":1}}' >&2
+fi
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "LOG_TRANSFERS": "true", "LOG_LEVEL": "debug"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+	// rclone only logs the per-file lines with -v.
+	if runs := readCalls(t, calls); !slices.Contains(strings.Fields(runs[len(runs)-1]), "-v") {
+		t.Errorf("sync ran %q, want -v", runs[len(runs)-1])
+	}
+	var transfers []map[string]any
+	for _, e := range logEntries(t, out) {
+		if e["msg"] == "rclone transfer" {
+			transfers = append(transfers, e)
+		}
+	}
+	if len(transfers) != 2 {
+		t.Fatalf("logged transfers %v, want two", transfers)
+	}
+	if e := transfers[0]; e["level"] != "debug" || e["action"] != "copied" || e["key"] != "a.txt" || e["size"] != float64(3) || e["elapsed"] == nil {
+		t.Errorf("copy logged as %v", e)
+	}
+	if e := transfers[1]; e["action"] != "deleted" || e["key"] != "old.txt" || e["size"] != nil {
+		t.Errorf("deletion logged as %v", e)
+	}
+	// The summary counts what the log lists.
+	if summaries := readSummaries(t, out); len(summaries) != 1 || summaries[0].Stats.CopiedKeys != 1 || summaries[0].Stats.DeletedKeys != 1 {
+		t.Errorf("summary = %+v, want one copied and one deleted key", summaries)
+	}
+}
+
+func TestLogTransfersNeedsDebug(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"LOG_TRANSFERS": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(config.warnings, "LOG_TRANSFERS logs the transfers at debug level; set LOG_LEVEL=debug to see them") {
+		t.Errorf("warnings = %q, want the LOG_LEVEL hint", config.warnings)
+	}
+}
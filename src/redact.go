@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// secretFieldHints catches credential fields that were added without the
+// secret tag, so a forgotten tag fails safe rather than leaking.
+var secretFieldHints = []string{"secret", "password", "token", "accesskey", "credential"}
+
+// redactConfig returns the configuration as a flat map keyed by snake_case
+// field name, with every secret field masked. Fields tagged `secret:"true"`
+// or whose name looks like a credential are treated as secret. Nested
+// structs such as the remotes are flattened, e.g. source_endpoint.
+func redactConfig(config *Config) map[string]interface{} {
+	fields := make(map[string]interface{})
+	flattenFields(fields, "", reflect.ValueOf(config).Elem())
+	return fields
+}
+
+func flattenFields(fields map[string]interface{}, prefix string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := prefix + snakeCase(field.Name)
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			flattenFields(fields, name+"_", v.Field(i))
+		case isSecretField(field):
+			fields[name] = maskSecret(v.Field(i).String())
+		default:
+			fields[name] = v.Field(i).Interface()
+		}
+	}
+}
+
+func isSecretField(field reflect.StructField) bool {
+	if field.Tag.Get("secret") == "true" {
+		return true
+	}
+	name := strings.ToLower(field.Name)
+	for _, hint := range secretFieldHints {
+		if strings.Contains(name, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// maskSecret keeps the first four characters of a secret so operators can
+// tell which key is in use, and hides the rest.
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	if len(value) <= 4 {
+		return "****"
+	}
+	return value[:4] + "****"
+}
+
+func snakeCase(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
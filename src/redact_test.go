@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactConfig(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"DEST_SSE_CUSTOMER_KEY": "dest-sse-key-0123456789abcdefghi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := redactConfig(config)
+	for key, want := range map[string]interface{}{
+		"source_access_key":     "sour****",
+		"source_secret_key":     "sour****",
+		"dest_secret_key":       "dest****",
+		"dest_sse_customer_key": "dest****",
+		"source_endpoint":       "http://source.test:9000",
+		"dest_bucket":           "dest-bucket",
+		"dest_prefix":           "source-bucket",
+		"dry_run":               false,
+	} {
+		if got := fields[key]; got != want {
+			t.Errorf("%s = %#v, want %#v", key, got, want)
+		}
+	}
+	// Unexported fields such as the credential providers are left out.
+	if _, ok := fields["dest_credentials"]; ok {
+		t.Errorf("the redacted configuration has unexported fields")
+	}
+}
+
+func TestIsSecretField(t *testing.T) {
+	type fields struct {
+		Tagged     string `secret:"true"`
+		APIToken   string
+		DBPassword string
+		Bucket     string
+	}
+	typ := reflect.TypeOf(fields{})
+	for name, want := range map[string]bool{"Tagged": true, "APIToken": true, "DBPassword": true, "Bucket": false} {
+		field, _ := typ.FieldByName(name)
+		if got := isSecretField(field); got != want {
+			t.Errorf("isSecretField(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestMaskSecret(t *testing.T) {
+	for value, want := range map[string]string{"": "", "abc": "****", "abcd": "****", "abcdefgh": "abcd****"} {
+		if got := maskSecret(value); got != want {
+			t.Errorf("maskSecret(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	for name, want := range map[string]string{"DestBucket": "dest_bucket", "SSECustomerKey": "sse_customer_key", "KMSKeyID": "kms_key_id", "V2Auth": "v2_auth"} {
+		if got := snakeCase(name); got != want {
+			t.Errorf("snakeCase(%s) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestPrintConfigOnly(t *testing.T) {
+	path, calls := fakeRclone(t, "exit 0")
+	setTestEnv(t, withEnv(map[string]string{"PRINT_CONFIG": "only", "RCLONE_PATH": path}))
+	var result runResult
+	var err error
+	out := captureOutput(t, func() { result, err = run(nil) })
+	if err != nil || result.code != 0 {
+		t.Fatalf("run = %d, %v", result.code, err)
+	}
+	var printed map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &printed); err != nil {
+		t.Fatalf("PRINT_CONFIG=only printed %q: %v", out, err)
+	}
+	if printed["dest_bucket"] != "dest-bucket" || printed["dest_secret_key"] != "dest****" {
+		t.Errorf("printed configuration %v", printed)
+	}
+	if strings.Contains(out, "dest-secret") {
+		t.Errorf("printed configuration has the secret: %s", out)
+	}
+	if runs := readCalls(t, calls); len(runs) != 0 {
+		t.Errorf("PRINT_CONFIG=only ran rclone: %q", runs)
+	}
+
+	_, err = loadTestConfig(t, map[string]string{"PRINT_CONFIG": "yes"})
+	wantError(t, err, `invalid PRINT_CONFIG "yes"`)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RemoteConfig holds the connection settings for one side of the sync. The
+// environment variables for a side share a prefix, e.g. SOURCE_ or DEST_.
+type RemoteConfig struct {
+	Endpoint  string
+	AccessKey string `secret:"true"`
+	SecretKey string `secret:"true"`
+	Bucket    string
+	Prefix    string
+	Provider  string
+	ACL       string
+	Region    string
+	// ForcePathStyle is nil when unset so rclone's default applies.
+	ForcePathStyle *bool
+	V2Auth         bool
+	DisableHTTP2   bool
+	// SSE is the server-side encryption of the objects written: AES256,
+	// aws:kms or empty for the bucket default. SSECustomerKey is an SSE-C
+	// key, needed to read and write the objects encrypted with it.
+	SSE            string
+	KMSKeyID       string
+	SSECustomerKey string `secret:"true"`
+	// StorageClass is the class of the objects written, empty for the
+	// bucket default (STANDARD on AWS).
+	StorageClass string
+	// RequesterPays accepts the charges for the requests to a requester-pays
+	// bucket, which are counted in requests by the native engine.
+	RequesterPays bool
+	requests      *requestCounter
+	// Anonymous reads a public source without credentials.
+	Anonymous bool
+	// Auth is where the credentials come from, one of authModes. With env,
+	// envCredentials holds the keys of the AWS_* variables; credentials
+	// signs the requests s3-sync sends itself.
+	Auth           string
+	envCredentials awsCredentials
+	credentials    credentialProvider
+	// RoleARN is a role assumed with those credentials, e.g. in the account
+	// of a cross-account bucket; its temporary credentials are renewed
+	// before they expire.
+	RoleARN         string
+	RoleExternalID  string
+	RoleSessionName string
+	RoleDuration    string
+}
+
+// storageClasses are the S3 storage classes the _STORAGE_CLASS settings
+// accept.
+var storageClasses = []string{
+	"STANDARD",
+	"REDUCED_REDUNDANCY",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER_IR",
+	"GLACIER",
+	"DEEP_ARCHIVE",
+	"OUTPOSTS",
+	"EXPRESS_ONEZONE",
+}
+
+// archiveStorageClasses are the storage classes whose objects have to be
+// restored before they can be read.
+var archiveStorageClasses = []string{"GLACIER", "DEEP_ARCHIVE"}
+
+// sseAlgorithms are the values the _SSE settings accept.
+var sseAlgorithms = []string{"AES256", "aws:kms"}
+
+// cannedACLs are the S3 canned ACLs rclone accepts for the acl option.
+var cannedACLs = []string{
+	"private",
+	"public-read",
+	"public-read-write",
+	"authenticated-read",
+	"aws-exec-read",
+	"bucket-owner-read",
+	"bucket-owner-full-control",
+}
+
+// loadRemote reads the settings of the remote whose variables start with
+// side (SOURCE or DEST). The prefix is left for the caller, as the defaults
+// differ between source and destination.
+func loadRemote(src *configSource, side string) RemoteConfig {
+	remote := RemoteConfig{
+		Endpoint:  src.getOrDefault(side+"_S3_ENDPOINT", ""),
+		AccessKey: src.getSecret(side + "_ACCESS_KEY"),
+		SecretKey: src.getSecret(side + "_SECRET_KEY"),
+		Bucket:    src.getOrDefault(side+"_BUCKET", ""),
+		Provider:  src.getOrDefault(side+"_PROVIDER", "Other"),
+		ACL:       strings.ToLower(src.getOrDefault(side+"_ACL", "private")),
+		Region:    src.getOrDefault(side+"_REGION", ""),
+
+		ForcePathStyle: src.getOptionalBool(side + "_FORCE_PATH_STYLE"),
+		V2Auth:         src.getBoolOrDefault(side+"_V2_AUTH", false),
+		DisableHTTP2:   src.getBoolOrDefault(side+"_DISABLE_HTTP2", false),
+		SSE:            src.getOrDefault(side+"_SSE", ""),
+		KMSKeyID:       src.getOrDefault(side+"_SSE_KMS_KEY_ID", ""),
+		SSECustomerKey: src.getSecret(side + "_SSE_CUSTOMER_KEY"),
+		StorageClass:   strings.ToUpper(src.getOrDefault(side+"_STORAGE_CLASS", "")),
+		RequesterPays:  src.getBoolOrDefault(side+"_REQUESTER_PAYS", false),
+		Anonymous:      src.getBoolOrDefault(side+"_ANONYMOUS", false),
+		Auth:           strings.ToLower(src.getOrDefault(side+"_AUTH", "static")),
+
+		RoleARN:         strings.TrimSpace(src.getOrDefault(side+"_ROLE_ARN", "")),
+		RoleExternalID:  src.getOrDefault(side+"_ROLE_EXTERNAL_ID", ""),
+		RoleSessionName: src.getOrDefault(side+"_ROLE_SESSION_NAME", ""),
+		RoleDuration:    strings.TrimSpace(src.getOrDefault(side+"_ROLE_DURATION", "")),
+	}
+	if remote.Auth == "env" {
+		remote.envCredentials = loadEnvCredentials(src)
+	}
+	remote.credentials = newCredentialProvider(remote)
+	return remote
+}
+
+func validateRemote(remote RemoteConfig, side string) error {
+	// AWS derives the endpoint from the region (us-east-1 if unset), and other
+	// providers can too once a region is given.
+	if remote.Endpoint == "" && remote.Region == "" && !strings.EqualFold(remote.Provider, "AWS") {
+		return fmt.Errorf("required environment variable %s_S3_ENDPOINT is not set (or set %s_REGION)", side, side)
+	}
+
+	if !contains(authModes, remote.Auth) {
+		return fmt.Errorf("invalid %s_AUTH %q: must be one of %s", side, remote.Auth, strings.Join(authModes, ", "))
+	}
+	if remote.Auth != "static" {
+		switch {
+		case remote.Anonymous:
+			return fmt.Errorf("%s_ANONYMOUS reads without credentials; it can't be combined with %s_AUTH=%s", side, side, remote.Auth)
+		case remote.AccessKey != "" || remote.SecretKey != "":
+			return fmt.Errorf("%s_AUTH=%s doesn't use %s_ACCESS_KEY and %s_SECRET_KEY; unset them or use %s_AUTH=static", side, remote.Auth, side, side, side)
+		case remote.Auth == "env" && (remote.envCredentials.accessKey == "" || remote.envCredentials.secretKey == ""):
+			return fmt.Errorf("%s_AUTH=env requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY", side)
+		}
+	}
+
+	if remote.Anonymous {
+		switch {
+		case side != "SOURCE":
+			return fmt.Errorf("%s_ANONYMOUS is not supported: writing to the destination always needs credentials", side)
+		case remote.AccessKey != "" || remote.SecretKey != "":
+			return fmt.Errorf("%s_ANONYMOUS=true reads without credentials; unset %s_ACCESS_KEY and %s_SECRET_KEY", side, side, side)
+		case remote.RequesterPays:
+			return fmt.Errorf("%s_REQUESTER_PAYS needs credentials to bill the requests to; it can't be combined with %s_ANONYMOUS", side, side)
+		}
+	}
+
+	required := []struct {
+		key   string
+		value string
+		// credential is not required with _ANONYMOUS or _AUTH=env|iam.
+		credential bool
+	}{
+		{side + "_ACCESS_KEY", remote.AccessKey, true},
+		{side + "_SECRET_KEY", remote.SecretKey, true},
+		{side + "_BUCKET", remote.Bucket, false},
+	}
+	for _, r := range required {
+		if r.value == "" && !(r.credential && (remote.Anonymous || remote.Auth != "static")) {
+			return fmt.Errorf("required environment variable %s is not set", r.key)
+		}
+	}
+
+	if !contains(cannedACLs, remote.ACL) {
+		return fmt.Errorf("invalid %s_ACL %q: must be one of %s", side, remote.ACL, strings.Join(cannedACLs, ", "))
+	}
+
+	if remote.StorageClass != "" && !contains(storageClasses, remote.StorageClass) {
+		return fmt.Errorf("invalid %s_STORAGE_CLASS %q: must be one of %s", side, remote.StorageClass, strings.Join(storageClasses, ", "))
+	}
+
+	if err := validateRole(remote, side); err != nil {
+		return err
+	}
+	return validateSSE(remote, side)
+}
+
+func validateSSE(remote RemoteConfig, side string) error {
+	switch {
+	case remote.SSE != "" && !contains(sseAlgorithms, remote.SSE):
+		return fmt.Errorf("invalid %s_SSE %q: must be one of %s", side, remote.SSE, strings.Join(sseAlgorithms, ", "))
+	case remote.SSE == "aws:kms" && remote.KMSKeyID == "":
+		return fmt.Errorf("%s_SSE=aws:kms requires %s_SSE_KMS_KEY_ID", side, side)
+	case remote.KMSKeyID != "" && remote.SSE != "aws:kms":
+		return fmt.Errorf("%s_SSE_KMS_KEY_ID is only used with %s_SSE=aws:kms", side, side)
+	case remote.SSECustomerKey != "" && remote.SSE != "":
+		return fmt.Errorf("%s_SSE_CUSTOMER_KEY can't be combined with %s_SSE", side, side)
+	// SSE-C keys are 256 bits, given as rclone takes them.
+	case remote.SSECustomerKey != "" && len(remote.SSECustomerKey) != 32:
+		return fmt.Errorf("%s_SSE_CUSTOMER_KEY must be 32 bytes long, got %d", side, len(remote.SSECustomerKey))
+	}
+	return nil
+}
+
+// md5ETags reports whether the ETag of an object written to remote in one
+// part is the MD5 of its content, which it isn't with SSE-KMS or SSE-C.
+func (remote RemoteConfig) md5ETags() bool {
+	return remote.SSE != "aws:kms" && remote.SSECustomerKey == ""
+}
+
+// sameCredentials reports whether requests to a and b are signed with the
+// same credentials, so that a CopyObject signed for b can read from a.
+func sameCredentials(a, b RemoteConfig) bool {
+	// Requests to an anonymous source aren't signed, so the destination's
+	// credentials say nothing about access to it.
+	if a.Anonymous || b.Anonymous || a.Auth != b.Auth {
+		return false
+	}
+	// With a _ROLE_ARN, requests are signed with the credentials of the role.
+	if a.RoleARN != b.RoleARN || a.RoleExternalID != b.RoleExternalID {
+		return false
+	}
+	switch a.Auth {
+	case "env":
+		return a.envCredentials.accessKey == b.envCredentials.accessKey
+	case "iam":
+		// Both sides fetch the credentials of the role s3-sync runs as.
+		return true
+	}
+	return a.AccessKey == b.AccessKey
+}
+
+// normalizeEndpoint turns user input such as "minio.internal:9000/" into a
+// clean "scheme://host[:port]" URL, adding defaultScheme when the scheme is
+// missing. Endpoints must not carry a path, query string or credentials.
+func normalizeEndpoint(endpoint, defaultScheme string) (string, error) {
+	if endpoint == "" {
+		return "", nil
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = defaultScheme + "://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint URL %q: %w", endpoint, err)
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https":
+		return "", fmt.Errorf("endpoint %q must use http or https", endpoint)
+	case u.Host == "":
+		return "", fmt.Errorf("endpoint %q has no host", endpoint)
+	case u.User != nil:
+		return "", fmt.Errorf("endpoint %q must not contain credentials", endpoint)
+	case strings.Trim(u.Path, "/") != "":
+		return "", fmt.Errorf("endpoint %q must not contain a path; put the bucket in *_BUCKET and sub-paths in *_PREFIX", endpoint)
+	case u.RawQuery != "" || u.Fragment != "" || u.ForceQuery:
+		return "", fmt.Errorf("endpoint %q must not contain a query string", endpoint)
+	}
+
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// remoteOption is a single key = value line of an rclone remote definition.
+type remoteOption struct {
+	key   string
+	value string
+}
+
+// remoteOptions returns the rclone backend options for remote, in the order
+// they are written to the config file. Optional settings are only emitted
+// when set so rclone's own defaults apply otherwise.
+func remoteOptions(remote RemoteConfig) []remoteOption {
+	opts := []remoteOption{
+		{"type", "s3"},
+		{"provider", remote.Provider},
+	}
+	switch {
+	case remote.Anonymous:
+		// Without keys or env_auth, rclone doesn't sign its requests.
+		opts = append(opts, remoteOption{"env_auth", "false"})
+	case remote.RoleARN != "":
+		// The credentials of the role are passed to each rclone run; see
+		// rcloneRemotes.refreshRoles.
+		opts = append(opts, remoteOption{"env_auth", "false"})
+	case remote.Auth == "env":
+		// The keys are given to this remote alone: with env_auth only, rclone
+		// would use them for every remote whose chain reads the environment.
+		creds := remote.envCredentials
+		opts = append(opts, remoteOption{"env_auth", "true"},
+			remoteOption{"access_key_id", creds.accessKey}, remoteOption{"secret_access_key", creds.secretKey})
+		if creds.sessionToken != "" {
+			opts = append(opts, remoteOption{"session_token", creds.sessionToken})
+		}
+	case remote.Auth == "iam":
+		// rclone finds the role through its AWS credential chain; see
+		// rcloneEnviron.
+		opts = append(opts, remoteOption{"env_auth", "true"})
+	default:
+		opts = append(opts, remoteOption{"access_key_id", remote.AccessKey}, remoteOption{"secret_access_key", remote.SecretKey})
+	}
+	if remote.Endpoint != "" {
+		opts = append(opts, remoteOption{"endpoint", remote.Endpoint})
+	}
+	if remote.Region != "" {
+		opts = append(opts, remoteOption{"region", remote.Region})
+	}
+	opts = append(opts, remoteOption{"acl", remote.ACL})
+	if remote.StorageClass != "" {
+		opts = append(opts, remoteOption{"storage_class", remote.StorageClass})
+	}
+	if remote.ForcePathStyle != nil {
+		opts = append(opts, remoteOption{"force_path_style", strconv.FormatBool(*remote.ForcePathStyle)})
+	}
+	if remote.V2Auth {
+		opts = append(opts, remoteOption{"v2_auth", "true"})
+	}
+	if remote.DisableHTTP2 {
+		opts = append(opts, remoteOption{"disable_http2", "true"})
+	}
+	if remote.RequesterPays {
+		opts = append(opts, remoteOption{"requester_pays", "true"})
+	}
+	if remote.SSE != "" {
+		opts = append(opts, remoteOption{"server_side_encryption", remote.SSE})
+	}
+	if remote.KMSKeyID != "" {
+		opts = append(opts, remoteOption{"sse_kms_key_id", remote.KMSKeyID})
+	}
+	if remote.SSECustomerKey != "" {
+		opts = append(opts, remoteOption{"sse_customer_algorithm", "AES256"}, remoteOption{"sse_customer_key", remote.SSECustomerKey})
+	}
+	return opts
+}
+
+type namedRemote struct {
+	name   string
+	remote RemoteConfig
+}
+
+func configuredRemotes(config *Config) []namedRemote {
+	return []namedRemote{
+		{"source", config.Source},
+		{"dest", config.Dest},
+	}
+}
+
+// renderRcloneConfig renders the rclone config file defining the source and
+// dest remotes.
+func renderRcloneConfig(config *Config) string {
+	var b strings.Builder
+	for i, r := range configuredRemotes(config) {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "[%s]\n", r.name)
+		for _, opt := range remoteOptions(r.remote) {
+			fmt.Fprintf(&b, "%s = %s\n", opt.key, opt.value)
+		}
+	}
+	return b.String()
+}
+
+// renderRcloneEnv defines the source and dest remotes through rclone's
+// RCLONE_CONFIG_<REMOTE>_<OPTION> environment variables, so credentials never
+// touch the disk or the command line.
+func renderRcloneEnv(config *Config) []string {
+	var env []string
+	for _, r := range configuredRemotes(config) {
+		for _, opt := range remoteOptions(r.remote) {
+			env = append(env, fmt.Sprintf("RCLONE_CONFIG_%s_%s=%s", strings.ToUpper(r.name), strings.ToUpper(opt.key), opt.value))
+		}
+	}
+	return env
+}
+
+// rcloneRemotes tells rclone invocations where to find the remote
+// definitions: in the environment (the default) or in a config file.
+type rcloneRemotes struct {
+	configFile string
+	env        []string
+
+	// roles overrides the options of the remotes with _ROLE_ARN with the
+	// temporary credentials of the role, the first of which run out at
+	// expires.
+	mu      sync.Mutex
+	roles   []string
+	expires time.Time
+}
+
+// refreshRoles renews the role credentials of the remotes that will expire
+// soon, and passes them to the following rclone runs.
+func (r *rcloneRemotes) refreshRoles(ctx context.Context, config *Config) error {
+	var env []string
+	var expires time.Time
+	for _, remote := range configuredRemotes(config) {
+		if remote.remote.RoleARN == "" {
+			continue
+		}
+		creds, err := remote.remote.credentials.retrieve(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to assume %s_ROLE_ARN %s: %w", strings.ToUpper(remote.name), remote.remote.RoleARN, err)
+		}
+		prefix := "RCLONE_CONFIG_" + strings.ToUpper(remote.name) + "_"
+		env = append(env, prefix+"ACCESS_KEY_ID="+creds.accessKey, prefix+"SECRET_ACCESS_KEY="+creds.secretKey, prefix+"SESSION_TOKEN="+creds.sessionToken)
+		if expires.IsZero() || creds.expires.Before(expires) {
+			expires = creds.expires
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.roles, r.expires = env, expires
+	return nil
+}
+
+func (r *rcloneRemotes) rolesExpire() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.expires
+}
+
+// command returns an rclone command with access to the remotes.
+func (r *rcloneRemotes) command(config *Config, args ...string) *exec.Cmd {
+	if r.configFile != "" {
+		args = append(args, "--config", r.configFile)
+	}
+	cmd := exec.Command(config.RclonePath, args...)
+	// In its own process group, rclone only gets the signals handleShutdown
+	// forwards, not a second copy from the terminal.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if assumesRole(config) {
+		// Should the credentials not be renewed, the last ones are used:
+		// they may still be valid, and a sync renews them itself.
+		_ = r.refreshRoles(context.Background(), config)
+	}
+	r.mu.Lock()
+	roles := r.roles
+	r.mu.Unlock()
+	if r.env != nil || roles != nil || config.Source.Auth == "iam" || config.Dest.Auth == "iam" {
+		cmd.Env = append(append(rcloneEnviron(config), r.env...), roles...)
+	}
+	return cmd
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
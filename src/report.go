@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// reportTimeFormat names the directory of a report after the start of its
+// run. It sorts chronologically, which REPORT_RETENTION relies on.
+const reportTimeFormat = "20060102T150405Z"
+
+// reportDirName matches the directories named with reportTimeFormat, so
+// that pruning never touches anything else under REPORT_PREFIX.
+var reportDirName = regexp.MustCompile(`^\d{8}T\d{6}Z$`)
+
+func validateReport(config *Config) error {
+	if config.ReportPrefix == "" {
+		switch {
+		case config.Manifest:
+			return fmt.Errorf("MANIFEST requires REPORT_PREFIX")
+		case config.ReportRetention != 0:
+			return fmt.Errorf("REPORT_RETENTION requires REPORT_PREFIX")
+		}
+		return nil
+	}
+	if config.ReportRetention < 0 {
+		return fmt.Errorf("REPORT_RETENTION must not be negative, got %d", config.ReportRetention)
+	}
+	// Inside the synced path, the reports would be deleted by the next sync
+	// as objects missing from the source.
+	if prefixesOverlap(config.ReportPrefix, config.Dest.Prefix) {
+		return fmt.Errorf("REPORT_PREFIX %q overlaps the destination %q; use a prefix outside DEST_PREFIX",
+			config.ReportPrefix, remotePath("dest", config.Dest.Bucket, config.Dest.Prefix))
+	}
+	if config.BackupDir != "" && prefixesOverlap(config.ReportPrefix, config.BackupDir) {
+		return fmt.Errorf("REPORT_PREFIX %q overlaps BACKUP_DIR %q", config.ReportPrefix, config.BackupDir)
+	}
+	return nil
+}
+
+// reportRoot is where the reports of a job are kept: REPORT_PREFIX, with the
+// job name appended for multi-job runs so that jobs sharing a bucket keep
+// and prune their reports separately.
+func reportRoot(config *Config) string {
+	if config.JobName == "" {
+		return config.ReportPrefix
+	}
+	return config.ReportPrefix + "/" + config.JobName
+}
+
+// manifestEntry is one line of the manifest: what rclone did to a key,
+// relative to SOURCE_PREFIX and DEST_PREFIX.
+type manifestEntry struct {
+	Action string `json:"action"`
+	Key    string `json:"key"`
+	Size   *int64 `json:"size,omitempty"`
+}
+
+// manifestActions map the start of rclone's per-file INFO messages, e.g.
+// "Copied (new)" or "Copied (server-side copy)", onto manifest actions.
+var manifestActions = []struct {
+	prefix string
+	action string
+}{
+	{"Copied", "copied"},
+	{"Moved", "moved"},
+	{"Deleted", "deleted"},
+}
+
+// manifestWriter streams manifest entries into a gzip-compressed JSON Lines
+// file, so that the memory use doesn't grow with the number of transfers.
+type manifestWriter struct {
+	path    string
+	file    *os.File
+	gz      *gzip.Writer
+	encoder *json.Encoder
+	// move is set for SYNC_MODE=move, where rclone's deletions are the
+	// source objects it moved.
+	move    bool
+	entries int
+	err     error
+}
+
+// createManifest opens the manifest in a fresh directory under
+// RcloneConfigDir. The returned cleanup function removes it.
+func createManifest(config *Config) (*manifestWriter, func(), error) {
+	if err := os.MkdirAll(config.RcloneConfigDir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(config.RcloneConfigDir, "s3-sync-manifest-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	cleanup := removeOnExit(dir)
+
+	path := filepath.Join(dir, "manifest.jsonl.gz")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to create the manifest: %w", err)
+	}
+	gz := gzip.NewWriter(file)
+	m := &manifestWriter{path: path, file: file, gz: gz, encoder: json.NewEncoder(gz), move: config.SyncMode == "move"}
+	return m, func() {
+		m.close()
+		cleanup()
+	}, nil
+}
+
+// fileAction returns the manifest action of one of rclone's per-file
+// messages, or "" for other messages. In move mode rclone's deletions are
+// the source objects it moved.
+func fileAction(msg string, move bool) string {
+	for _, a := range manifestActions {
+		if !strings.HasPrefix(msg, a.prefix) {
+			continue
+		}
+		if a.action == "deleted" && move {
+			return "removed_from_source"
+		}
+		return a.action
+	}
+	return ""
+}
+
+// record adds an entry if msg is one of rclone's per-file messages. The
+// first write error is kept and reported by close.
+func (m *manifestWriter) record(msg, object string, size *int64) {
+	if object == "" || m.err != nil {
+		return
+	}
+	if action := fileAction(msg, m.move); action != "" {
+		m.add(action, object, size)
+	}
+}
+
+// add adds an entry with action, such as "archived" for the objects
+// ARCHIVED_OBJECTS skipped.
+func (m *manifestWriter) add(action, object string, size *int64) {
+	if m.err != nil {
+		return
+	}
+	m.err = m.encoder.Encode(manifestEntry{Action: action, Key: object, Size: size})
+	m.entries++
+}
+
+// close flushes the manifest. It is safe to call more than once.
+func (m *manifestWriter) close() error {
+	if m.file == nil {
+		return m.err
+	}
+	if err := m.gz.Close(); err != nil && m.err == nil {
+		m.err = err
+	}
+	if err := m.file.Close(); err != nil && m.err == nil {
+		m.err = err
+	}
+	m.file = nil
+	return m.err
+}
+
+// uploadReport uploads the summary, and the manifest if MANIFEST is set, to
+// <REPORT_PREFIX>/<timestamp>/ in the destination bucket, then prunes old
+// reports. The report is evidence, not part of the sync: failures are logged
+// as warnings and don't change the outcome of the run. Dry runs upload
+// nothing, as they must not change the destination.
+func uploadReport(config *Config, remotes *rcloneRemotes, report *runSummary, logger *logrus.Logger) {
+	if config.ReportPrefix == "" {
+		return
+	}
+	if config.DryRun {
+		logger.Info("DRY_RUN is set, not uploading the run report")
+		return
+	}
+	dir := remotePath("dest", config.Dest.Bucket, reportRoot(config)+"/"+report.StartedAt.Format(reportTimeFormat))
+	entry := logger.WithField("report", dir)
+	span := config.span.child("report-upload")
+
+	summary, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = rcat(config, remotes, dir+"/summary.json", bytes.NewReader(summary))
+	}
+	if err != nil {
+		entry.WithError(err).Warn("Failed to upload the run summary")
+		span.end(err)
+		return
+	}
+
+	if m := config.manifest; m != nil && config.Manifest {
+		if err := m.close(); err != nil {
+			entry.WithError(err).Warn("Failed to write the manifest, not uploading it")
+		} else if err := uploadFile(config, remotes, dir+"/manifest.jsonl.gz", m.path); err != nil {
+			entry.WithError(err).Warn("Failed to upload the manifest")
+		} else {
+			entry = entry.WithField("manifest_entries", m.entries)
+		}
+	}
+	entry.Info("Uploaded the run report")
+
+	if config.ReportRetention > 0 {
+		pruneReports(config, remotes, logger)
+	}
+	span.end(nil)
+}
+
+// pruneReports deletes all but the REPORT_RETENTION latest reports.
+func pruneReports(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) {
+	root := remotePath("dest", config.Dest.Bucket, reportRoot(config))
+	dirs, err := listDirs(config, remotes, root)
+	if err != nil {
+		logger.WithError(err).WithField("report_prefix", root).Warn("Failed to list old reports, not pruning them")
+		return
+	}
+	var reports []string
+	for _, dir := range dirs {
+		if reportDirName.MatchString(dir) {
+			reports = append(reports, dir)
+		}
+	}
+	sort.Strings(reports)
+	for _, dir := range reports[:max(len(reports)-config.ReportRetention, 0)] {
+		path := root + "/" + dir
+		var stderr bytes.Buffer
+		cmd := remotes.command(config, "purge", path)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			logger.WithError(fmt.Errorf("%w: %s", err, lastLine(strings.TrimSpace(stderr.String())))).
+				WithField("report", path).Warn("Failed to delete an old report")
+			continue
+		}
+		logger.WithField("report", path).Info("Deleted old report")
+	}
+}
+
+// rcat writes the contents of r to the object at path.
+func rcat(config *Config, remotes *rcloneRemotes, path string, r io.Reader) error {
+	var stderr bytes.Buffer
+	cmd := remotes.command(config, "rcat", path)
+	cmd.Stdin = r
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to write %s: %w: %s", path, err, lastLine(strings.TrimSpace(stderr.String())))
+	}
+	return nil
+}
+
+func uploadFile(config *Config, remotes *rcloneRemotes, path, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return rcat(config, remotes, path, f)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateReport(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"MANIFEST": "true"}, "MANIFEST requires REPORT_PREFIX"},
+		{map[string]string{"REPORT_RETENTION": "5"}, "REPORT_RETENTION requires REPORT_PREFIX"},
+		{map[string]string{"REPORT_PREFIX": "_reports", "REPORT_RETENTION": "-1"}, "REPORT_RETENTION must not be negative, got -1"},
+		{map[string]string{"REPORT_PREFIX": "source-bucket/_reports"}, `REPORT_PREFIX "source-bucket/_reports" overlaps the destination`},
+		{map[string]string{"REPORT_PREFIX": "_reports", "BACKUP_DIR": "_reports/trash"}, `REPORT_PREFIX "_reports" overlaps BACKUP_DIR "_reports/trash"`},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+// reportRclone keeps what rclone rcat writes under dir, by object path, and
+// lists old reports under _reports.
+func reportRclone(t *testing.T, dir string) (path, calls string) {
+	return fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+if [ "$1" = sync ]; then
+	echo '{"level":"info","msg":"Copied (new)","object":"a.txt","size":3}' >&2
+	echo '{"level":"info","msg":"Deleted","object":"old.txt"}' >&2
+	exit 0
+fi
+if [ "$1" = rcat ]; then
+	mkdir -p "`+dir+`/$(dirname "$2")"
+	cat > "`+dir+`/$2"
+	exit 0
+fi
+if [ "$1" = lsjson ]; then
+	echo '[{"Path":"20240101T000000Z","IsDir":true},{"Path":"20240102T000000Z","IsDir":true},{"Path":"notes","IsDir":true},{"Path":"20990101T000000Z","IsDir":true}]'
+	exit 0
+fi
+exit 0`)
+}
+
+func TestUploadReport(t *testing.T) {
+	dir := t.TempDir()
+	path, calls := reportRclone(t, dir)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "REPORT_PREFIX": "_reports", "MANIFEST": "true", "REPORT_RETENTION": "2"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+
+	reports, _ := filepath.Glob(filepath.Join(dir, "dest:dest-bucket", "_reports", "*T*Z"))
+	if len(reports) != 1 {
+		t.Fatalf("uploaded reports %q, want one", reports)
+	}
+	if !reportDirName.MatchString(filepath.Base(reports[0])) {
+		t.Errorf("report directory %q is not named after the start time", reports[0])
+	}
+	var summary map[string]any
+	data, err := os.ReadFile(filepath.Join(reports[0], "summary.json"))
+	if err != nil || json.Unmarshal(data, &summary) != nil || summary["result"] != "success" {
+		t.Errorf("summary.json = %s, %v", data, err)
+	}
+
+	f, err := os.Open(filepath.Join(reports[0], "manifest.jsonl.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	for scanner := bufio.NewScanner(gz); scanner.Scan(); {
+		entries = append(entries, scanner.Text())
+	}
+	if want := []string{`{"action":"copied","key":"a.txt","size":3}`, `{"action":"deleted","key":"old.txt"}`}; !slices.Equal(entries, want) {
+		t.Errorf("manifest = %q, want %q", entries, want)
+	}
+
+	// Of the three reports, only the oldest is pruned; other directories
+	// are left alone.
+	var purged []string
+	for _, run := range readCalls(t, calls) {
+		if strings.HasPrefix(run, "purge ") {
+			purged = append(purged, strings.Fields(run)[1])
+		}
+	}
+	if want := []string{"dest:dest-bucket/_reports/20240101T000000Z"}; !slices.Equal(purged, want) {
+		t.Errorf("purged %q, want %q", purged, want)
+	}
+	if e := findEntry(logEntries(t, out), "Uploaded the run report"); e == nil || e["manifest_entries"] != float64(2) {
+		t.Errorf("upload logged as %v", e)
+	}
+}
+
+func TestUploadReportDryRun(t *testing.T) {
+	dir := t.TempDir()
+	path, calls := reportRclone(t, dir)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "REPORT_PREFIX": "_reports", "DRY_RUN": "true"}))
+	out := captureOutput(t, func() { run(nil) })
+	for _, run := range readCalls(t, calls) {
+		if strings.HasPrefix(run, "rcat ") || strings.HasPrefix(run, "purge ") {
+			t.Errorf("dry run changed the destination: %q", run)
+		}
+	}
+	if findEntry(logEntries(t, out), "DRY_RUN is set, not uploading the run report") == nil {
+		t.Errorf("skipped upload not logged:\n%s", out)
+	}
+}
+
+func TestUploadReportFails(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = rcat ] && { echo "AccessDenied" >&2; exit 1; }
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "REPORT_PREFIX": "_reports"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	// The report doesn't change the outcome of the run.
+	if result.code != 0 {
+		t.Errorf("run = %d, want 0", result.code)
+	}
+	if e := findEntry(logEntries(t, out), "Failed to upload the run summary"); e == nil || e["level"] != "warning" {
+		t.Errorf("failed upload logged as %v", e)
+	}
+}
+
+func TestReportRoot(t *testing.T) {
+	if got := reportRoot(&Config{ReportPrefix: "_reports"}); got != "_reports" {
+		t.Errorf("reportRoot = %q", got)
+	}
+	if got := reportRoot(&Config{ReportPrefix: "_reports", JobName: "media"}); got != "_reports/media" {
+		t.Errorf("reportRoot of a job = %q, want _reports/media", got)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// requestCounter counts the S3 requests a run sends to a requester-pays
+// bucket, by operation, across the clients of the run. A nil counter counts
+// nothing.
+type requestCounter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newRequestCounter() *requestCounter {
+	return &requestCounter{counts: make(map[string]int64)}
+}
+
+func (c *requestCounter) add(op string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[op]++
+}
+
+// requestUsage is what a run was billed for by a requester-pays bucket: the
+// requests by operation, which only the native engine counts, and the bytes
+// read from the source.
+type requestUsage struct {
+	Requests      map[string]int64 `json:"requests,omitempty"`
+	TotalRequests int64            `json:"total_requests,omitempty"`
+	BytesRead     *int64           `json:"bytes_read,omitempty"`
+}
+
+// countRequests gives the requester-pays remotes of config fresh request
+// counters for a run of the native engine; rclone doesn't report its
+// requests.
+func countRequests(config *Config) {
+	for _, remote := range []*RemoteConfig{&config.Source, &config.Dest} {
+		remote.requests = nil
+		if remote.RequesterPays && config.Engine == "native" {
+			remote.requests = newRequestCounter()
+		}
+	}
+}
+
+// recordRequesterPays adds the usage of the requester-pays remotes to the
+// summary and logs it, for reconciling the bill.
+func recordRequesterPays(config *Config, report *runSummary, stats RunStats, logger *logrus.Logger) {
+	for _, r := range configuredRemotes(config) {
+		// Without request counts there's nothing to report for the
+		// destination, as nothing is read from it.
+		if !r.remote.RequesterPays || (r.name == "dest" && r.remote.requests == nil) {
+			continue
+		}
+		var usage requestUsage
+		if c := r.remote.requests; c != nil {
+			c.mu.Lock()
+			usage.Requests = make(map[string]int64, len(c.counts))
+			for op, n := range c.counts {
+				usage.Requests[op] = n
+				usage.TotalRequests += n
+			}
+			c.mu.Unlock()
+		}
+		fields := logrus.Fields{"remote": r.name, "requests": usage.Requests, "total_requests": usage.TotalRequests}
+		if r.name == "source" {
+			usage.BytesRead = &stats.Bytes
+			fields["bytes_read"] = stats.Bytes
+		}
+		if report.RequesterPays == nil {
+			report.RequesterPays = make(map[string]requestUsage)
+		}
+		report.RequesterPays[r.name] = usage
+		logger.WithFields(fields).Info("Requester-pays usage")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRequestCounter(t *testing.T) {
+	var none *requestCounter
+	none.add("GetObject")
+
+	c := newRequestCounter()
+	for _, op := range []string{"ListObjectsV2", "GetObject", "GetObject"} {
+		c.add(op)
+	}
+	if want := map[string]int64{"ListObjectsV2": 1, "GetObject": 2}; !reflect.DeepEqual(c.counts, want) {
+		t.Errorf("counts = %v, want %v", c.counts, want)
+	}
+}
+
+func TestCountRequests(t *testing.T) {
+	config := &Config{Engine: "native", Source: RemoteConfig{RequesterPays: true}}
+	countRequests(config)
+	if config.Source.requests == nil || config.Dest.requests != nil {
+		t.Fatalf("counters = %v, %v, want one for the requester-pays source", config.Source.requests, config.Dest.requests)
+	}
+	// Every run starts counting anew.
+	first := config.Source.requests
+	countRequests(config)
+	if config.Source.requests == first {
+		t.Error("the counter of the previous run is kept")
+	}
+
+	// rclone doesn't report its requests.
+	config.Engine = "rclone"
+	countRequests(config)
+	if config.Source.requests != nil {
+		t.Error("counting requests with ENGINE=rclone")
+	}
+}
+
+func TestS3ClientRequesterPays(t *testing.T) {
+	remote := RemoteConfig{Endpoint: "http://minio:9000", RequesterPays: true, requests: newRequestCounter(),
+		credentials: staticCredentials{accessKey: "key", secretKey: "secret"}}
+	client, err := newS3Client(remote, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &recordingTransport{}
+	sendThrough(client, transport)
+	ctx := context.Background()
+	if _, err := client.head(ctx, "media", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.get(ctx, "media", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	for _, header := range transport.headers {
+		if header.Get("X-Amz-Request-Payer") != "requester" {
+			t.Errorf("request without X-Amz-Request-Payer: %v", header)
+		}
+		// The header is signed.
+		if !strings.Contains(header.Get("Authorization"), "x-amz-request-payer") {
+			t.Errorf("Authorization = %q, want x-amz-request-payer signed", header.Get("Authorization"))
+		}
+	}
+	if want := map[string]int64{"HeadObject": 1, "GetObject": 1}; !reflect.DeepEqual(remote.requests.counts, want) {
+		t.Errorf("counts = %v, want %v", remote.requests.counts, want)
+	}
+
+	remote.RequesterPays, remote.requests = false, nil
+	client, err = newS3Client(remote, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport = &recordingTransport{}
+	sendThrough(client, transport)
+	if _, err := client.head(ctx, "media", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if v := transport.headers[0].Get("X-Amz-Request-Payer"); v != "" {
+		t.Errorf("X-Amz-Request-Payer = %q for a bucket that isn't requester-pays", v)
+	}
+}
+
+func TestRequesterPaysRemoteOptions(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"SOURCE_REQUESTER_PAYS": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := optionValue(remoteOptions(config.Source), "requester_pays"); got != "true" {
+		t.Errorf("source requester_pays = %q, want true", got)
+	}
+	if value, ok := optionValue(remoteOptions(config.Dest), "requester_pays"); ok {
+		t.Errorf("dest has requester_pays = %q", value)
+	}
+}
+
+func TestRecordRequesterPays(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	config := &Config{Engine: "native", Source: RemoteConfig{RequesterPays: true}, Dest: RemoteConfig{RequesterPays: true}}
+	countRequests(config)
+	config.Source.requests.add("ListObjectsV2")
+	config.Source.requests.add("GetObject")
+	config.Dest.requests.add("PutObject")
+	report := &runSummary{}
+	recordRequesterPays(config, report, RunStats{Bytes: 2048}, logger)
+
+	bytes := int64(2048)
+	want := map[string]requestUsage{
+		"source": {Requests: map[string]int64{"ListObjectsV2": 1, "GetObject": 1}, TotalRequests: 2, BytesRead: &bytes},
+		"dest":   {Requests: map[string]int64{"PutObject": 1}, TotalRequests: 1},
+	}
+	if !reflect.DeepEqual(report.RequesterPays, want) {
+		t.Errorf("usage = %+v, want %+v", report.RequesterPays, want)
+	}
+
+	// Without counts, rclone's destination has nothing to report.
+	config.Engine = "rclone"
+	countRequests(config)
+	report = &runSummary{}
+	recordRequesterPays(config, report, RunStats{Bytes: 2048}, logger)
+	if _, ok := report.RequesterPays["dest"]; ok || report.RequesterPays["source"].BytesRead == nil {
+		t.Errorf("usage = %+v, want the bytes read from the source only", report.RequesterPays)
+	}
+
+	config.Source.RequesterPays, config.Dest.RequesterPays = false, false
+	report = &runSummary{}
+	recordRequesterPays(config, report, RunStats{}, logger)
+	if report.RequesterPays != nil {
+		t.Errorf("usage = %+v without requester-pays buckets", report.RequesterPays)
+	}
+}
+
+func TestRequesterPaysSummary(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+echo '{"level":"notice","msg":"stats","stats":{"bytes":4096,"transfers":1,"checks":0}}' >&2
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SOURCE_REQUESTER_PAYS": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+	summaries := readSummaries(t, out)
+	if len(summaries) != 1 {
+		t.Fatalf("printed %d summaries, want 1:\n%s", len(summaries), out)
+	}
+	usage, ok := summaries[0].RequesterPays["source"]
+	if !ok || usage.BytesRead == nil || *usage.BytesRead != 4096 {
+		t.Errorf("requester-pays usage = %+v, want 4096 bytes read from the source", summaries[0].RequesterPays)
+	}
+	if e := findEntry(logEntries(t, out), "Requester-pays usage"); e == nil || e["remote"] != "source" || e["bytes_read"] != float64(4096) {
+		t.Errorf("usage logged as %v", e)
+	}
+}
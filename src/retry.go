@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxRunRetryBackoff caps the exponential RUN_RETRY_BACKOFF.
+const maxRunRetryBackoff = 30 * time.Minute
+
+// retryableClasses are the rclone error classes worth running the whole sync
+// again for: the endpoint was unreachable or overloaded, not misconfigured.
+var retryableClasses = []ErrorClass{"throttled", "server_error", "connection_refused", "timeout"}
+
+func validateRunRetries(config *Config) error {
+	if config.RunRetries < 0 {
+		return fmt.Errorf("RUN_RETRIES must not be negative, got %d", config.RunRetries)
+	}
+	if d, err := time.ParseDuration(config.RunRetryBackoff); err != nil || d <= 0 {
+		return fmt.Errorf("invalid RUN_RETRY_BACKOFF %q: must be a positive duration like 30s", config.RunRetryBackoff)
+	}
+	return nil
+}
+
+// retryable reports whether a failed sync may succeed when run again. Only
+// rclone failures whose most frequent error is retryable qualify; budgets,
+// IMMUTABLE violations, access and configuration errors never do.
+func retryable(err error) bool {
+	var rcloneErr *rcloneError
+	if !errors.As(err, &rcloneErr) {
+		return false
+	}
+	for _, class := range retryableClasses {
+		if rcloneErr.class() == class {
+			return true
+		}
+	}
+	return false
+}
+
+// runSyncWithRetries runs the sync and, with RUN_RETRIES, runs it again after
+// a retryable failure, waiting RUN_RETRY_BACKOFF doubled per attempt, with
+// jitter. rclone's own --retries cover single objects; this covers an
+// endpoint that is down for longer than those take. The returned counts are
+// the sum over all attempts, and the attempts are recorded in report.
+func runSyncWithRetries(config *Config, remotes *rcloneRemotes, report *runSummary, logger *logrus.Logger) (RunStats, error) {
+	backoff, _ := time.ParseDuration(config.RunRetryBackoff)
+	rng := newJitterSource()
+	start := time.Now()
+	var total RunStats
+	for attempt := 1; ; attempt++ {
+		if config.diff != nil {
+			// A dry run that failed half-way would count its differences twice.
+			config.diff = newDiffReport(config.DiffKeyLimit)
+		}
+		stats, err := newSyncEngine(config).sync(config, remotes, logger)
+		total.add(stats)
+		report.Attempts = attempt
+		if config.Engine == "rclone" {
+			report.rcloneExited(err)
+		}
+		if err == nil || attempt > config.RunRetries || !retryable(err) {
+			if err == nil && attempt > 1 {
+				logger.WithFields(logrus.Fields{
+					"attempt": attempt,
+					"elapsed": time.Since(start).Round(time.Second).String(),
+				}).Info("Sync succeeded after retrying")
+			}
+			return total, err
+		}
+
+		delay := backoff << (attempt - 1)
+		if delay <= 0 || delay > maxRunRetryBackoff {
+			delay = maxRunRetryBackoff
+		}
+		// Half the delay is fixed and half random, so jobs that failed
+		// together don't retry together.
+		delay = delay/2 + jitter(rng, delay/2)
+		logger.WithError(err).WithFields(logrus.Fields{
+			"attempt":     attempt,
+			"run_retries": config.RunRetries,
+			"error_class": rcloneErrorClass(err),
+			"elapsed":     time.Since(start).Round(time.Second).String(),
+			"retry_in":    delay.Round(time.Second).String(),
+		}).Warn("Sync failed with a retryable error, running it again")
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-shutdown.interrupted():
+			timer.Stop()
+			logger.Warn("Interrupted while waiting to retry, giving up")
+			return total, shutdown.err()
+		}
+	}
+}
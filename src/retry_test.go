@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidateRunRetries(t *testing.T) {
+	_, err := loadTestConfig(t, map[string]string{"RUN_RETRIES": "-1"})
+	wantError(t, err, "RUN_RETRIES must not be negative, got -1")
+	_, err = loadTestConfig(t, map[string]string{"RUN_RETRY_BACKOFF": "0s"})
+	wantError(t, err, `invalid RUN_RETRY_BACKOFF "0s"`)
+}
+
+func TestRetryable(t *testing.T) {
+	if retryable(errors.New("SlowDown")) || retryable(&budgetError{}) {
+		t.Error("an error that doesn't come from rclone is retryable")
+	}
+}
+
+// flakyRclone fails the first failures syncs with line on stderr.
+func flakyRclone(t *testing.T, failures int, line string) (path, calls string) {
+	dir := t.TempDir()
+	return fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+if [ "$1" = sync ]; then
+	echo x >> "`+dir+`/syncs"
+	if [ $(wc -l < "`+dir+`/syncs") -le `+strconv.Itoa(failures)+` ]; then
+		echo '{"level":"error","msg":"`+line+`"}' >&2
+		echo '{"level":"notice","msg":"stats","stats":{"bytes":1,"transfers":1,"errors":1}}' >&2
+		exit 1
+	fi
+	echo '{"level":"notice","msg":"stats","stats":{"bytes":10,"transfers":2}}' >&2
+fi
+exit 0`)
+}
+
+func TestRunRetries(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		failures int
+		line     string
+		retries  string
+		code     int
+		attempts int
+		bytes    int64
+	}{
+		{"recovers", 2, "Failed to copy: SlowDown: Please reduce your request rate", "3", 0, 3, 12},
+		{"gives up", 5, "Failed to copy: 503 Service Unavailable", "2", exitSyncFailed, 3, 3},
+		{"not retryable", 1, "Failed to copy: AccessDenied: Access Denied", "3", exitSyncFailed, 1, 1},
+		{"no retries", 1, "Failed to copy: SlowDown", "0", exitSyncFailed, 1, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, calls := flakyRclone(t, tt.failures, tt.line)
+			setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "RUN_RETRIES": tt.retries, "RUN_RETRY_BACKOFF": "10ms"}))
+			var result runResult
+			out := captureOutput(t, func() { result, _ = run(nil) })
+			if result.code != tt.code {
+				t.Fatalf("run = %d, want %d:\n%s", result.code, tt.code, out)
+			}
+			syncs := 0
+			for _, run := range readCalls(t, calls) {
+				if strings.HasPrefix(run, "sync ") {
+					syncs++
+				}
+			}
+			if syncs != tt.attempts {
+				t.Errorf("ran %d syncs, want %d", syncs, tt.attempts)
+			}
+			summaries := readSummaries(t, out)
+			if len(summaries) != 1 || summaries[0].Attempts != tt.attempts {
+				t.Fatalf("summaries = %+v, want %d attempts", summaries, tt.attempts)
+			}
+			// The counts add up over the attempts.
+			if summaries[0].Stats.Bytes != tt.bytes {
+				t.Errorf("summary counts %d bytes, want %d", summaries[0].Stats.Bytes, tt.bytes)
+			}
+			if tt.attempts > 1 {
+				if e := findEntry(logEntries(t, out), "Sync failed with a retryable error, running it again"); e == nil || e["error_class"] == nil {
+					t.Errorf("retry logged as %v", e)
+				}
+			}
+		})
+	}
+}
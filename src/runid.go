@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxRunIDLength keeps an injected RUN_ID short enough for a log field and
+// a Sentry tag.
+const maxRunIDLength = 128
+
+func validateRunID(config *Config) error {
+	if config.RunID == "" {
+		return nil
+	}
+	if len(config.RunID) > maxRunIDLength || strings.ContainsAny(config.RunID, " \t\r\n\"") {
+		return fmt.Errorf("invalid RUN_ID %q: must be at most %d characters without spaces or quotes", config.RunID, maxRunIDLength)
+	}
+	// A process that runs many syncs gives each its own ID.
+	switch {
+	case config.Schedule != "":
+		return fmt.Errorf("RUN_ID names a single run and can't be combined with SCHEDULE")
+	case config.HTTPAddr != "":
+		return fmt.Errorf("RUN_ID names a single run and can't be combined with HTTP_ADDR, which gives each run its ID")
+	case config.SQSQueueURL != "":
+		return fmt.Errorf("RUN_ID names a single run and can't be combined with SQS_QUEUE_URL")
+	}
+	return nil
+}
+
+// startRun sets the ID of a run of config: RUN_ID, or the ID of the HTTP
+// run it belongs to, shared by all its jobs, or a new UUID for each job. It
+// returns a logger that adds the ID to every entry as run_id, so that the
+// lines of one run can be grouped once the logs of several are interleaved.
+func startRun(config *Config, logger *logrus.Logger) *logrus.Logger {
+	config.runID = config.RunID
+	if config.runID == "" {
+		config.runID = newUUID()
+	}
+	run := logrus.New()
+	run.SetOutput(logger.Out)
+	run.SetFormatter(logger.Formatter)
+	run.SetLevel(logger.GetLevel())
+	for level, hooks := range logger.Hooks {
+		run.Hooks[level] = append([]logrus.Hook(nil), hooks...)
+	}
+	run.AddHook(runIDHook(config.runID))
+	return run
+}
+
+// runIDHook adds the run ID to every log line of a run.
+type runIDHook string
+
+func (h runIDHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (h runIDHook) Fire(entry *logrus.Entry) error {
+	entry.Data["run_id"] = string(h)
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidateRunID(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"RUN_ID": "argo-nightly-4711"}, ""},
+		{map[string]string{"RUN_ID": "two words"}, `invalid RUN_ID "two words": must be at most 128 characters without spaces or quotes`},
+		{map[string]string{"RUN_ID": `a"b`}, "invalid RUN_ID"},
+		{map[string]string{"RUN_ID": strings.Repeat("a", maxRunIDLength+1)}, "must be at most 128 characters"},
+		{map[string]string{"RUN_ID": "nightly", "SCHEDULE": "@hourly"}, "RUN_ID names a single run and can't be combined with SCHEDULE"},
+		{map[string]string{"RUN_ID": "nightly", "HTTP_ADDR": ":8080"}, "can't be combined with HTTP_ADDR"},
+		{map[string]string{"RUN_ID": "nightly", "SQS_QUEUE_URL": "https://sqs.eu-west-1.amazonaws.com/1/queue"}, "can't be combined with SQS_QUEUE_URL"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestStartRun(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.DebugLevel)
+
+	config := &Config{RunID: "argo-nightly-4711"}
+	startRun(config, logger).Debug("Starting")
+	if config.runID != "argo-nightly-4711" {
+		t.Errorf("run ID = %q, want RUN_ID", config.runID)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("entry %q: %v", out.String(), err)
+	}
+	if entry["run_id"] != "argo-nightly-4711" || entry["level"] != "debug" {
+		t.Errorf("entry = %v, want the run ID at the level of the logger", entry)
+	}
+	// The logger of the process is left alone.
+	out.Reset()
+	logger.Info("Next")
+	if strings.Contains(out.String(), "run_id") {
+		t.Errorf("entry %q of the process logger has a run ID", out.String())
+	}
+
+	// Without RUN_ID each run gets its own.
+	config = &Config{}
+	startRun(config, logger)
+	first := config.runID
+	startRun(config, logger)
+	if first == "" || config.runID == first {
+		t.Errorf("run IDs %q and %q, want two new ones", first, config.runID)
+	}
+}
+
+func TestRunIDLogged(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+echo '{"level":"notice","msg":"There was nothing to transfer"}' >&2
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "RUN_ID": "argo-nightly-4711"}))
+	out := captureOutput(t, func() { run(nil) })
+	entries := logEntries(t, out)
+	for _, msg := range []string{"Starting S3 sync job", "There was nothing to transfer", "S3 sync job completed successfully"} {
+		if entry := findEntry(entries, msg); entry == nil || entry["run_id"] != "argo-nightly-4711" {
+			t.Errorf("%q logged as %v, want run_id argo-nightly-4711", msg, entry)
+		}
+	}
+	if summaries := readSummaries(t, out); len(summaries) != 1 || summaries[0].RunID != "argo-nightly-4711" {
+		t.Errorf("summaries = %+v, want the run ID", summaries)
+	}
+}
+
+func TestRunIDPerJob(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+	env := withEnv(map[string]string{"RCLONE_PATH": path, "SOURCE_BUCKET": "", "SOURCE_BUCKET_1": "media", "SOURCE_BUCKET_2": "logs"})
+	setTestEnv(t, env)
+	out := captureOutput(t, func() { run(nil) })
+	summaries := readSummaries(t, out)
+	if len(summaries) != 2 || summaries[0].RunID == "" || summaries[0].RunID == summaries[1].RunID {
+		t.Errorf("summaries = %+v, want a run ID per job", summaries)
+	}
+
+	// An injected RUN_ID is shared by the jobs.
+	t.Setenv("RUN_ID", "argo-nightly-4711")
+	out = captureOutput(t, func() { run(nil) })
+	for _, s := range readSummaries(t, out) {
+		if s.RunID != "argo-nightly-4711" {
+			t.Errorf("job %s has run ID %q, want RUN_ID", s.Job, s.RunID)
+		}
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/ratelimit"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	// s3MaxRetryBackoff caps the wait between retries of a request.
+	s3MaxRetryBackoff = 30 * time.Second
+	// s3MaxDeleteKeys is the most keys DeleteObjects takes at once.
+	s3MaxDeleteKeys = 1000
+	// s3MaxParts is the most parts a multipart upload may have.
+	s3MaxParts = 10000
+	// s3MaxCopySize is the largest object CopyObject copies in one request.
+	s3MaxCopySize = 5 << 30
+)
+
+// s3Client calls the S3 API of one remote for ENGINE=native through
+// aws-sdk-go-v2, which signs, retries and parses its requests.
+type s3Client struct {
+	api *s3.Client
+	// sse goes with the requests that create an object, customer with every
+	// request for its content.
+	sse, customer http.Header
+	// requesterPays accepts the charges of a requester-pays bucket.
+	requesterPays bool
+}
+
+// newS3Client returns the client for remote. Without an endpoint it talks to
+// AWS in the remote's region. The addressing style is that of
+// usesPathStyle.
+func newS3Client(remote RemoteConfig, retries, conns int) (*s3Client, error) {
+	region := remote.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	if remote.Endpoint != "" {
+		if _, err := url.Parse(remote.Endpoint); err != nil {
+			return nil, err
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = conns
+	// Streams can take long, only the answer to a request must not.
+	transport.ResponseHeaderTimeout = 5 * time.Minute
+	// Objects are copied as stored: a Content-Encoding: gzip object must not
+	// be decompressed on the way.
+	transport.DisableCompression = true
+	if remote.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	var creds aws.CredentialsProvider = aws.AnonymousCredentials{}
+	if !remote.Anonymous {
+		creds = sdkCredentials(remote.credentials)
+	}
+	api := s3.New(s3.Options{
+		Region:       region,
+		Credentials:  creds,
+		HTTPClient:   &http.Client{Transport: transport},
+		UsePathStyle: usesPathStyle(remote),
+		// Requests carry the checksums the API requires and no others, which
+		// S3-compatible stores may not know.
+		RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+		ResponseChecksumValidation: aws.ResponseChecksumValidationWhenRequired,
+		Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = max(retries, 1)
+			o.Backoff = retry.NewExponentialJitterBackoff(s3MaxRetryBackoff)
+			o.Retryables = append(o.Retryables, retry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+				var respErr *awshttp.ResponseError
+				if errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusTooManyRequests {
+					return aws.TrueTernary
+				}
+				return aws.UnknownTernary
+			}))
+			// Every request is retried RETRIES times, however many failed
+			// before it.
+			o.RateLimiter = ratelimit.None
+		}),
+	}, func(o *s3.Options) {
+		if remote.Endpoint != "" {
+			o.BaseEndpoint = aws.String(remote.Endpoint)
+		}
+		if remote.requests != nil {
+			o.APIOptions = append(o.APIOptions, countingRequests(remote.requests))
+		}
+	})
+	return &s3Client{
+		api:           api,
+		sse:           sseHeaders(remote),
+		customer:      sseCustomerHeaders(remote, "X-Amz-"),
+		requesterPays: remote.RequesterPays,
+	}, nil
+}
+
+// sdkCredentials gives the SDK the credentials of provider, which caches
+// them itself.
+func sdkCredentials(provider credentialProvider) aws.CredentialsProvider {
+	return aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+		creds, err := provider.retrieve(ctx)
+		if err != nil {
+			return aws.Credentials{}, err
+		}
+		return aws.Credentials{
+			AccessKeyID:     creds.accessKey,
+			SecretAccessKey: creds.secretKey,
+			SessionToken:    creds.sessionToken,
+			CanExpire:       !creds.expires.IsZero(),
+			Expires:         creds.expires,
+		}, nil
+	})
+}
+
+// countingRequests counts every request sent, retries included, in requests.
+func countingRequests(requests *requestCounter) func(*middleware.Stack) error {
+	return func(stack *middleware.Stack) error {
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("CountRequests",
+			func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+				requests.add(middleware.GetOperationName(ctx))
+				return next.HandleFinalize(ctx, in)
+			}), middleware.After)
+	}
+}
+
+// sending sends the headers with a request as they are, after those the SDK
+// sets: like rclone, the content headers and metadata of an object are
+// copied even where the API would parse them, e.g. an Expires that is not a
+// date.
+func (c *s3Client) sending(headers ...http.Header) func(*s3.Options) {
+	header := withHeaders(nil, headers...)
+	if c.requesterPays {
+		header.Set("X-Amz-Request-Payer", "requester")
+	}
+	return func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			return stack.Build.Add(middleware.BuildMiddlewareFunc("SetHeaders",
+				func(ctx context.Context, in middleware.BuildInput, next middleware.BuildHandler) (middleware.BuildOutput, middleware.Metadata, error) {
+					if req, ok := in.Request.(*smithyhttp.Request); ok {
+						for name, values := range header {
+							req.Header[name] = values
+						}
+					}
+					return next.HandleBuild(ctx, in)
+				}), middleware.After)
+		})
+	}
+}
+
+// unsignedStream sends the body of a request unsigned, and only once: a
+// stream can't be hashed before it is sent, nor sent again.
+func unsignedStream(o *s3.Options) {
+	o.RetryMaxAttempts = 1
+	o.APIOptions = append(o.APIOptions, v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware)
+}
+
+// contentMD5 sends the MD5 of the body, which S3-compatible stores want
+// with the requests AWS takes a CRC32 checksum for.
+func contentMD5(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, smithyhttp.AddContentChecksumMiddleware)
+}
+
+// rawResponse returns the HTTP response to a call.
+func rawResponse(metadata middleware.Metadata) *http.Response {
+	if resp, ok := awsmiddleware.GetRawResponse(metadata).(*smithyhttp.Response); ok {
+		return resp.Response
+	}
+	return &http.Response{Header: http.Header{}, Body: http.NoBody}
+}
+
+// virtualHostProviders are the providers rclone sends virtual-hosted style
+// requests to unless _FORCE_PATH_STYLE=true; the others get path-style ones.
+var virtualHostProviders = []string{"AWS", "Alibaba", "DigitalOcean", "Dreamhost", "LyveCloud", "Qiniu", "Scaleway", "TencentCOS", "Wasabi"}
+
+// usesPathStyle reports whether requests to remote name the bucket in the
+// path rather than in the host name.
+func usesPathStyle(remote RemoteConfig) bool {
+	if remote.ForcePathStyle != nil {
+		return *remote.ForcePathStyle
+	}
+	for _, provider := range virtualHostProviders {
+		if strings.EqualFold(provider, remote.Provider) {
+			return false
+		}
+	}
+	return true
+}
+
+// sseHeaders returns the headers requesting _SSE for a new object.
+func sseHeaders(remote RemoteConfig) http.Header {
+	header := http.Header{}
+	if remote.SSE != "" {
+		header.Set("X-Amz-Server-Side-Encryption", remote.SSE)
+	}
+	if remote.KMSKeyID != "" {
+		header.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", remote.KMSKeyID)
+	}
+	return header
+}
+
+// sseCustomerHeaders returns the headers giving the SSE-C key of remote, named
+// with prefix: X-Amz- for the object of a request, X-Amz-Copy-Source- for the
+// source of a copy.
+func sseCustomerHeaders(remote RemoteConfig, prefix string) http.Header {
+	header := http.Header{}
+	if remote.SSECustomerKey != "" {
+		sum := md5.Sum([]byte(remote.SSECustomerKey))
+		header.Set(prefix+"Server-Side-Encryption-Customer-Algorithm", "AES256")
+		header.Set(prefix+"Server-Side-Encryption-Customer-Key", base64.StdEncoding.EncodeToString([]byte(remote.SSECustomerKey)))
+		header.Set(prefix+"Server-Side-Encryption-Customer-Key-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	return header
+}
+
+// withHeaders returns header with the values of extra added.
+func withHeaders(header http.Header, extra ...http.Header) http.Header {
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	for _, h := range extra {
+		for name, values := range h {
+			header[name] = values
+		}
+	}
+	return header
+}
+
+// s3Object is an object as ListObjectsV2 returns it.
+type s3Object struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// s3Error is an error answer of the S3 API. It quotes the status as rclone
+// does, so that classifyError recognises it.
+type s3Error struct {
+	op      string
+	key     string
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string {
+	target := e.key
+	if target != "" {
+		target = " " + target
+	}
+	if e.code == "" {
+		return fmt.Sprintf("S3 %s%s failed: status code: %d", e.op, target, e.status)
+	}
+	return fmt.Sprintf("S3 %s%s failed: %s: %s (status code: %d)", e.op, target, e.code, e.message, e.status)
+}
+
+// s3Failure returns the error of a call that failed with err: an s3Error
+// for an error answer, err wrapped otherwise.
+func s3Failure(op, key string, err error) error {
+	var respErr *awshttp.ResponseError
+	if !errors.As(err, &respErr) {
+		return fmt.Errorf("S3 %s %s failed: %w", op, key, err)
+	}
+	s3Err := &s3Error{op: op, key: key, status: respErr.HTTPStatusCode()}
+	var apiErr smithy.APIError
+	// HeadObject errors have no body, the SDK names them after the status.
+	if errors.As(err, &apiErr) && op != "HeadObject" {
+		s3Err.code, s3Err.message = apiErr.ErrorCode(), apiErr.ErrorMessage()
+	}
+	return s3Err
+}
+
+// retryableS3Error reports whether a request that failed with err may
+// succeed when sent again: throttling, server errors and network errors.
+func retryableS3Error(err error) bool {
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) {
+		return s3Err.status >= 500 || s3Err.status == http.StatusTooManyRequests || s3Err.code == "SlowDown"
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// awsURIEncode encodes s as SigV4 expects: everything but unreserved
+// characters, and slashes unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// list calls fn for every object under prefix, in key order, paging through
+// ListObjectsV2.
+func (c *s3Client) list(ctx context.Context, bucket, prefix string, fn func(s3Object)) error {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket), MaxKeys: aws.Int32(1000)}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	for {
+		page, err := c.api.ListObjectsV2(ctx, input, c.sending())
+		if err != nil {
+			return s3Failure("ListObjectsV2", bucket, err)
+		}
+		for _, object := range page.Contents {
+			fn(s3Object{
+				Key:          aws.ToString(object.Key),
+				Size:         aws.ToInt64(object.Size),
+				ETag:         strings.Trim(aws.ToString(object.ETag), `"`),
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+		if !aws.ToBool(page.IsTruncated) || aws.ToString(page.NextContinuationToken) == "" {
+			return nil
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+// head returns the headers of an object, including its metadata.
+func (c *s3Client) head(ctx context.Context, bucket, key string) (http.Header, error) {
+	out, err := c.api.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}, c.sending(c.customer))
+	if err != nil {
+		return nil, s3Failure("HeadObject", key, err)
+	}
+	return rawResponse(out.ResultMetadata).Header, nil
+}
+
+// get returns the response to a GetObject, with the content as its body.
+func (c *s3Client) get(ctx context.Context, bucket, key string) (*http.Response, error) {
+	out, err := c.api.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}, c.sending(c.customer))
+	if err != nil {
+		return nil, s3Failure("GetObject", key, err)
+	}
+	resp := rawResponse(out.ResultMetadata)
+	resp.Body = out.Body
+	return resp, nil
+}
+
+// put uploads size bytes from body in one request.
+func (c *s3Client) put(ctx context.Context, bucket, key string, body io.Reader, size int64, header http.Header) error {
+	// The SDK sends an io.Pipe chunked, without its length, which some
+	// providers refuse.
+	body = struct{ io.Reader }{body}
+	_, err := c.api.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(key), Body: body, ContentLength: aws.Int64(size)},
+		c.sending(header, c.sse, c.customer), unsignedStream)
+	if err != nil {
+		return s3Failure("PutObject", key, err)
+	}
+	return nil
+}
+
+// putIf uploads data as an object if the object is as expected: missing if
+// etag is empty, otherwise still with that ETag. It returns the ETag of the
+// new object; a failed condition is an s3Error with status 412.
+func (c *s3Client) putIf(ctx context.Context, bucket, key string, data []byte, etag string) (string, error) {
+	input := &s3.PutObjectInput{Bucket: aws.String(bucket), Key: aws.String(key), Body: bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))), ContentType: aws.String("application/json")}
+	if etag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(etag)
+	}
+	out, err := c.api.PutObject(ctx, input, c.sending(c.sse, c.customer))
+	if err != nil {
+		return "", s3Failure("PutObject", key, err)
+	}
+	return aws.ToString(out.ETag), nil
+}
+
+// putMultipart uploads size bytes from body in parts of partSize, raised
+// as far as needed to stay within s3MaxParts. A failed upload is aborted, so
+// its parts don't keep taking space.
+func (c *s3Client) putMultipart(ctx context.Context, bucket, key string, body io.Reader, size, partSize int64, header http.Header) error {
+	if least := (size + s3MaxParts - 1) / s3MaxParts; partSize < least {
+		partSize = (least + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+	created, err := c.api.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String(bucket), Key: aws.String(key)},
+		c.sending(header, c.sse, c.customer))
+	if err != nil {
+		return s3Failure("CreateMultipartUpload", key, err)
+	}
+	if aws.ToString(created.UploadId) == "" {
+		return fmt.Errorf("S3 CreateMultipartUpload %s returned no upload ID", key)
+	}
+
+	abort := func(err error) error {
+		// The context may be over, the abort should still go through.
+		abortCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		_, _ = c.api.AbortMultipartUpload(abortCtx, &s3.AbortMultipartUploadInput{Bucket: aws.String(bucket), Key: aws.String(key), UploadId: created.UploadId}, c.sending())
+		return err
+	}
+	var parts []types.CompletedPart
+	for number, offset := int32(1), int64(0); offset < size; number++ {
+		length := min(partSize, size-offset)
+		uploaded, err := c.api.UploadPart(ctx, &s3.UploadPartInput{Bucket: aws.String(bucket), Key: aws.String(key), UploadId: created.UploadId,
+			PartNumber: aws.Int32(number), Body: io.LimitReader(body, length), ContentLength: aws.Int64(length)},
+			c.sending(c.customer), unsignedStream)
+		if err != nil {
+			return abort(s3Failure("UploadPart", key, err))
+		}
+		parts = append(parts, types.CompletedPart{PartNumber: aws.Int32(number), ETag: uploaded.ETag})
+		offset += length
+	}
+
+	// Completing can fail after the 200 status has been sent, which the SDK
+	// returns as an InternalError.
+	_, err = c.api.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{Bucket: aws.String(bucket), Key: aws.String(key), UploadId: created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts}}, c.sending())
+	if err != nil {
+		return abort(s3Failure("CompleteMultipartUpload", key, err))
+	}
+	return nil
+}
+
+// copy copies an object server-side, replacing its metadata with header,
+// which also carries the SSE-C key of the source if it has one. Like
+// completing a multipart upload, a copy can fail after the 200.
+func (c *s3Client) copy(ctx context.Context, srcBucket, srcKey, bucket, key string, header http.Header) error {
+	_, err := c.api.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String("/" + awsURIEncode(srcBucket, true) + "/" + awsURIEncode(srcKey, false)),
+		MetadataDirective: types.MetadataDirectiveReplace,
+	}, c.sending(header, c.sse, c.customer))
+	if err != nil {
+		return s3Failure("CopyObject", key, err)
+	}
+	return nil
+}
+
+// restore requests a copy of an archived object to be readable for days,
+// restored at tier. A restore that is already in progress is not an error.
+func (c *s3Client) restore(ctx context.Context, bucket, key string, days int, tier string) error {
+	_, err := c.api.RestoreObject(ctx, &s3.RestoreObjectInput{Bucket: aws.String(bucket), Key: aws.String(key),
+		RestoreRequest: &types.RestoreRequest{Days: aws.Int32(int32(days)), GlacierJobParameters: &types.GlacierJobParameters{Tier: types.Tier(tier)}}},
+		c.sending(), contentMD5)
+	if err == nil {
+		return nil
+	}
+	err = s3Failure("RestoreObject", key, err)
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) && s3Err.code == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return err
+}
+
+// deleteKeys deletes up to s3MaxDeleteKeys objects with one DeleteObjects
+// request and returns the errors of the keys that weren't deleted, by key.
+func (c *s3Client) deleteKeys(ctx context.Context, bucket string, keys []string) (map[string]error, error) {
+	objects := make([]types.ObjectIdentifier, len(keys))
+	for i, key := range keys {
+		objects[i] = types.ObjectIdentifier{Key: aws.String(key)}
+	}
+	out, err := c.api.DeleteObjects(ctx, &s3.DeleteObjectsInput{Bucket: aws.String(bucket), Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)}},
+		c.sending(), contentMD5)
+	if err != nil {
+		return nil, s3Failure("DeleteObjects", bucket, err)
+	}
+	failed := make(map[string]error)
+	for _, e := range out.Errors {
+		key := aws.ToString(e.Key)
+		failed[key] = &s3Error{op: "DeleteObjects", key: key, status: http.StatusOK, code: aws.ToString(e.Code), message: aws.ToString(e.Message)}
+	}
+	return failed, nil
+}
+
+// s3Tag is an object tag.
+type s3Tag struct {
+	Key   string
+	Value string
+}
+
+// getTagging returns the tags of an object.
+func (c *s3Client) getTagging(ctx context.Context, bucket, key string) ([]s3Tag, error) {
+	out, err := c.api.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{Bucket: aws.String(bucket), Key: aws.String(key)}, c.sending())
+	if err != nil {
+		return nil, s3Failure("GetObjectTagging", key, err)
+	}
+	tags := make([]s3Tag, 0, len(out.TagSet))
+	for _, tag := range out.TagSet {
+		tags = append(tags, s3Tag{Key: aws.ToString(tag.Key), Value: aws.ToString(tag.Value)})
+	}
+	return tags, nil
+}
+
+// putTagging replaces the tags of an object.
+func (c *s3Client) putTagging(ctx context.Context, bucket, key string, tags []s3Tag) error {
+	tagSet := make([]types.Tag, len(tags))
+	for i, tag := range tags {
+		tagSet[i] = types.Tag{Key: aws.String(tag.Key), Value: aws.String(tag.Value)}
+	}
+	_, err := c.api.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{Bucket: aws.String(bucket), Key: aws.String(key), Tagging: &types.Tagging{TagSet: tagSet}},
+		c.sending(), contentMD5)
+	if err != nil {
+		return s3Failure("PutObjectTagging", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// recordingTransport answers every request with an empty 200 and records
+// its URL and headers.
+type recordingTransport struct {
+	urls    []string
+	headers []http.Header
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.urls = append(t.urls, req.URL.String())
+	t.headers = append(t.headers, req.Header.Clone())
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+// sendThrough makes client send its requests to transport.
+func sendThrough(client *s3Client, transport http.RoundTripper) {
+	client.api = s3.New(client.api.Options(), func(o *s3.Options) {
+		o.HTTPClient = &http.Client{Transport: transport}
+	})
+}
+
+func TestS3ClientAddressingStyle(t *testing.T) {
+	yes, no := true, false
+	for _, tt := range []struct {
+		name      string
+		provider  string
+		endpoint  string
+		pathStyle *bool
+		want      string
+	}{
+		{"AWS", "AWS", "", nil, "https://media.s3.eu-west-1.amazonaws.com/a%20b.txt"},
+		{"AWS case-insensitive", "aws", "", nil, "https://media.s3.eu-west-1.amazonaws.com/a%20b.txt"},
+		{"AWS forced to path style", "AWS", "", &yes, "https://s3.eu-west-1.amazonaws.com/media/a%20b.txt"},
+		{"Wasabi", "Wasabi", "https://s3.wasabisys.com", nil, "https://media.s3.wasabisys.com/a%20b.txt"},
+		{"MinIO", "Minio", "http://minio:9000", nil, "http://minio:9000/media/a%20b.txt"},
+		{"Other", "Other", "http://ceph:7480", nil, "http://ceph:7480/media/a%20b.txt"},
+		{"Other forced to virtual-hosted style", "Other", "http://ceph:7480", &no, "http://media.ceph:7480/a%20b.txt"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := RemoteConfig{
+				Provider:       tt.provider,
+				Endpoint:       tt.endpoint,
+				Region:         "eu-west-1",
+				ForcePathStyle: tt.pathStyle,
+				credentials:    staticCredentials{accessKey: "key", secretKey: "secret"},
+			}
+			client, err := newS3Client(remote, 1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transport := &recordingTransport{}
+			sendThrough(client, transport)
+			resp, err := client.get(context.Background(), "media", "a b.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if len(transport.urls) != 1 || strings.Split(transport.urls[0], "?")[0] != tt.want {
+				t.Errorf("requested %v, want %s", transport.urls, tt.want)
+			}
+		})
+	}
+}
+
+func TestS3ClientSSEHeaders(t *testing.T) {
+	key := secretEnv["DEST_SSE_CUSTOMER_KEY"]
+	sum := md5.Sum([]byte(key))
+	for _, tt := range []struct {
+		name   string
+		remote RemoteConfig
+		// create are the headers of requests creating an object, read those
+		// of requests for its content.
+		create, read map[string]string
+	}{
+		{"SSE-S3", RemoteConfig{SSE: "AES256"},
+			map[string]string{"X-Amz-Server-Side-Encryption": "AES256", "X-Amz-Server-Side-Encryption-Customer-Key": ""},
+			map[string]string{"X-Amz-Server-Side-Encryption": ""}},
+		{"SSE-KMS", RemoteConfig{SSE: "aws:kms", KMSKeyID: "alias/sync"},
+			map[string]string{"X-Amz-Server-Side-Encryption": "aws:kms", "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": "alias/sync"},
+			map[string]string{"X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id": ""}},
+		{"SSE-C", RemoteConfig{SSECustomerKey: key},
+			map[string]string{
+				"X-Amz-Server-Side-Encryption":                    "",
+				"X-Amz-Server-Side-Encryption-Customer-Algorithm": "AES256",
+				"X-Amz-Server-Side-Encryption-Customer-Key":       base64.StdEncoding.EncodeToString([]byte(key)),
+				"X-Amz-Server-Side-Encryption-Customer-Key-Md5":   base64.StdEncoding.EncodeToString(sum[:]),
+			},
+			map[string]string{"X-Amz-Server-Side-Encryption-Customer-Key": base64.StdEncoding.EncodeToString([]byte(key))}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := newFakeS3(t, "media")
+			tt.remote.Endpoint = s3.URL
+			tt.remote.credentials = staticCredentials{accessKey: "key", secretKey: "secret"}
+			client, err := newS3Client(tt.remote, 1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if err := client.put(ctx, "media", "a.txt", strings.NewReader("hello"), 5, http.Header{"Content-Type": {"text/plain"}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.copy(ctx, "media", "a.txt", "media", "b.txt", http.Header{}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.head(ctx, "media", "a.txt"); err != nil {
+				t.Fatal(err)
+			}
+			header := func(op string) http.Header { return s3.received(op)[0].header }
+			for _, op := range []string{"PutObject", "CopyObject"} {
+				for name, want := range tt.create {
+					if got := header(op).Get(name); got != want {
+						t.Errorf("%s %s = %q, want %q", op, name, got, want)
+					}
+				}
+			}
+			if header("PutObject").Get("Content-Type") != "text/plain" {
+				t.Errorf("PutObject lost its Content-Type: %v", header("PutObject"))
+			}
+			for name, want := range tt.read {
+				if got := header("HeadObject").Get(name); got != want {
+					t.Errorf("HeadObject %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSSECopySourceHeaders(t *testing.T) {
+	key := secretEnv["SOURCE_SSE_CUSTOMER_KEY"]
+	header := sseCustomerHeaders(RemoteConfig{SSECustomerKey: key}, "X-Amz-Copy-Source-")
+	if got := header.Get("X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key"); got != base64.StdEncoding.EncodeToString([]byte(key)) {
+		t.Errorf("copy source key = %q", got)
+	}
+	if len(sseCustomerHeaders(RemoteConfig{}, "X-Amz-")) != 0 {
+		t.Error("SSE-C headers without a key")
+	}
+
+	base := http.Header{"Content-Type": {"text/plain"}}
+	merged := withHeaders(base, header, http.Header{"X-Amz-Acl": {"private"}})
+	if merged.Get("Content-Type") != "text/plain" || merged.Get("X-Amz-Acl") != "private" || merged.Get("X-Amz-Copy-Source-Server-Side-Encryption-Customer-Algorithm") != "AES256" {
+		t.Errorf("withHeaders = %v", merged)
+	}
+	if len(base) != 1 {
+		t.Errorf("withHeaders changed its argument: %v", base)
+	}
+	if withHeaders(nil, header) == nil {
+		t.Error("withHeaders(nil) = nil")
+	}
+}
+
+func TestS3ClientPutEmpty(t *testing.T) {
+	s3 := newFakeS3(t, "media")
+	client, err := newS3Client(RemoteConfig{Endpoint: s3.URL, credentials: staticCredentials{accessKey: "key", secretKey: "secret"}}, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Streamed bodies are of no type net/http knows the length of.
+	body, w := io.Pipe()
+	w.Close()
+	if err := client.put(context.Background(), "media", "empty.txt", body, 0, http.Header{}); err != nil {
+		t.Fatal(err)
+	}
+	if o := s3.object("media", "empty.txt"); o == nil || len(o.data) != 0 {
+		t.Errorf("stored %+v, want an empty object", o)
+	}
+	// Some providers refuse a chunked PutObject without a length.
+	if r := s3.received("PutObject"); len(r) != 1 || r[0].chunked {
+		t.Errorf("PutObject sent as %+v, want it with Content-Length: 0", r)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// schedule returns the time of the next run after a given time.
+type schedule interface {
+	next(after time.Time) time.Time
+}
+
+// intervalSchedule runs every d, starting right away.
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) next(after time.Time) time.Time {
+	return after.Add(time.Duration(s))
+}
+
+// cronSchedule is a five-field cron expression in local time. Each field is
+// a bitmask of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// As in cron, a job runs when either day field matches if both are
+	// restricted.
+	domRestricted, dowRestricted bool
+}
+
+// cronMacros are the @ shorthands cron accepts.
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseSchedule parses SCHEDULE: a Go duration such as "30m" or a cron
+// expression such as "0 2 * * *".
+func parseSchedule(value string) (schedule, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		if d < time.Minute {
+			return nil, fmt.Errorf("interval must be at least 1m")
+		}
+		return intervalSchedule(d), nil
+	}
+	if macro, ok := cronMacros[strings.ToLower(value)]; ok {
+		value = macro
+	}
+	fields := strings.Fields(value)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected a duration like 30m or a cron expression with 5 fields (minute hour day-of-month month day-of-week)")
+	}
+
+	var s cronSchedule
+	var err error
+	for _, f := range []struct {
+		name     string
+		value    string
+		min, max int
+		mask     *uint64
+	}{
+		{"minute", fields[0], 0, 59, &s.minute},
+		{"hour", fields[1], 0, 23, &s.hour},
+		{"day of month", fields[2], 1, 31, &s.dom},
+		{"month", fields[3], 1, 12, &s.month},
+		{"day of week", fields[4], 0, 7, &s.dow},
+	} {
+		if *f.mask, err = parseCronField(f.value, f.min, f.max); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	// Sunday is 0 or 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domRestricted = fields[2] != "*"
+	s.dowRestricted = fields[4] != "*"
+	if s.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("the expression never matches a date")
+	}
+	return s, nil
+}
+
+// parseCronField parses a comma-separated list of *, n, a-b, */step or
+// a-b/step into a bitmask.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		from, to := min, max
+		if rangePart != "*" {
+			lo, hi, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if from, err = strconv.Atoi(lo); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(hi); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if hasStep {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+func (s cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+func (s cronSchedule) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// Five years covers every valid expression, including 29 February.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// scheduleClock returns whether SCHEDULE runs the first sync right away, as
+// intervals do, and a function returning the time of the next run with
+// SCHEDULE_SPLAY applied.
+func scheduleClock(config *Config) (immediate bool, nextRun func() time.Time) {
+	sched, _ := parseSchedule(config.Schedule)
+	splay := parseOptionalDuration(config.ScheduleSplay)
+	rng := newJitterSource()
+	_, immediate = sched.(intervalSchedule)
+	return immediate, func() time.Time {
+		return sched.next(time.Now()).Add(jitter(rng, splay))
+	}
+}
+
+// runScheduled keeps running the jobs on SCHEDULE until SIGINT or SIGTERM,
+// skipping a run while the previous one is still in progress. On a signal it
+// waits for a run in progress, which handleShutdown stops within
+// SHUTDOWN_GRACE, and returns the process exit code: 0 for a clean stop,
+// exitInterrupted if the run was interrupted.
+func runScheduled(configs []*Config) int {
+	logger := setupLogger(configs[0])
+	grace, _ := time.ParseDuration(configs[0].ShutdownGrace)
+	immediate, nextRun := scheduleClock(configs[0])
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	done := make(chan int, 1)
+	running := false
+	start := func() {
+		running = true
+		go func() { done <- runOnce(configs) }()
+	}
+
+	next := nextRun()
+	if immediate {
+		logger.WithField("schedule", configs[0].Schedule).Info("Scheduler started, running the first sync now")
+		start()
+	} else {
+		logger.WithField("schedule", configs[0].Schedule).Info("Scheduler started")
+	}
+	for {
+		logger.WithField("next_run", next.Format(time.RFC3339)).Info("Next sync scheduled")
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			if running {
+				logger.WithField("next_run", next.Format(time.RFC3339)).Warn("Previous sync is still running, skipping this run")
+			} else {
+				start()
+			}
+			next = nextRun()
+
+		case code := <-done:
+			timer.Stop()
+			running = false
+			logger.WithField("exit_code", code).Info("Scheduled sync finished")
+
+		case sig := <-signals:
+			timer.Stop()
+			if !running {
+				logger.WithField("signal", sig.String()).Info("Scheduler stopped")
+				return 0
+			}
+			logger.WithFields(logrus.Fields{
+				"signal": sig.String(),
+				"grace":  grace.String(),
+			}).Info("Scheduler stopping, waiting for the sync in progress")
+			code := <-done
+			logger.WithField("exit_code", code).Info("Scheduler stopped after the sync in progress ended")
+			if code == exitInterrupted {
+				return exitInterrupted
+			}
+			return 0
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  string
+	}{
+		{"30s", "interval must be at least 1m"},
+		{"0 2 * *", "expected a duration like 30m or a cron expression with 5 fields"},
+		{"60 * * * *", `minute: "60" is out of range 0-59`},
+		{"* * * * mon", `day of week: invalid value "mon"`},
+		{"*/0 * * * *", `minute: invalid step "0"`},
+		{"0 0 31 2 *", "the expression never matches a date"},
+	} {
+		_, err := parseSchedule(tt.value)
+		wantError(t, err, tt.want)
+	}
+
+	_, err := loadTestConfig(t, map[string]string{"SCHEDULE": "every day"})
+	wantError(t, err, `invalid SCHEDULE "every day"`)
+}
+
+func TestScheduleNext(t *testing.T) {
+	// Wednesday 1 May 2024, 10:17:30.
+	now := time.Date(2024, 5, 1, 10, 17, 30, 0, time.UTC)
+	for _, tt := range []struct {
+		value string
+		want  time.Time
+	}{
+		{"30m", now.Add(30 * time.Minute)},
+		{"0 2 * * *", time.Date(2024, 5, 2, 2, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted: the 15th or
+		// a Friday, whichever comes first.
+		{"0 0 15 * 5", time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+	} {
+		s, err := parseSchedule(tt.value)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", tt.value, err)
+			continue
+		}
+		if got := s.next(now); !got.Equal(tt.want) {
+			t.Errorf("%q: next run %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
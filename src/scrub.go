@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// scrubbedText replaces a configured secret wherever it appears in the logs.
+const scrubbedText = "[REDACTED]"
+
+// minScrubLength is the shortest secret that is scrubbed. Shorter values
+// would match all over ordinary log lines and can't be told apart from them.
+const minScrubLength = 4
+
+// scrubber holds the secret values of every job of the process: the fields
+// redactConfig masks, and the parts of them that can show up on their own,
+// such as the password of a URL or the value of a webhook header.
+var scrubber = &secretScrubber{}
+
+type secretScrubber struct {
+	mu       sync.RWMutex
+	secrets  map[string]bool
+	replacer *strings.Replacer
+}
+
+// add collects the secrets of configs.
+func (s *secretScrubber) add(configs ...*Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.secrets == nil {
+		s.secrets = make(map[string]bool)
+	}
+	for _, config := range configs {
+		collectSecrets(s.secrets, reflect.ValueOf(config).Elem())
+		// The keys of _AUTH=env aren't part of the configuration that's
+		// logged, but rclone could still echo them.
+		for _, remote := range []RemoteConfig{config.Source, config.Dest} {
+			addSecret(s.secrets, remote.envCredentials.accessKey)
+			addSecret(s.secrets, remote.envCredentials.secretKey)
+			addSecret(s.secrets, remote.envCredentials.sessionToken)
+		}
+	}
+
+	values := make([]string, 0, len(s.secrets))
+	for value := range s.secrets {
+		values = append(values, value)
+	}
+	// The replacer takes the first match in argument order, so a secret that
+	// contains another one has to come first to be replaced as a whole.
+	sort.Slice(values, func(i, j int) bool {
+		if len(values[i]) != len(values[j]) {
+			return len(values[i]) > len(values[j])
+		}
+		return values[i] < values[j]
+	})
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, scrubbedText)
+	}
+	s.replacer = strings.NewReplacer(pairs...)
+}
+
+// scrub returns text with every secret replaced by [REDACTED].
+func (s *secretScrubber) scrub(text string) string {
+	s.mu.RLock()
+	replacer := s.replacer
+	s.mu.RUnlock()
+	if replacer == nil {
+		return text
+	}
+	return replacer.Replace(text)
+}
+
+func collectSecrets(secrets map[string]bool, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			collectSecrets(secrets, v.Field(i))
+		case isSecretField(field) && field.Type.Kind() == reflect.String:
+			addSecret(secrets, v.Field(i).String())
+		}
+	}
+}
+
+func addSecret(secrets map[string]bool, value string) {
+	for _, part := range secretParts(value) {
+		if len(part) >= minScrubLength {
+			secrets[part] = true
+			// Secrets also end up in URLs and query strings escaped.
+			secrets[url.QueryEscape(part)] = true
+			secrets[url.PathEscape(part)] = true
+		}
+	}
+}
+
+// secretParts returns value and the parts of it that are secret on their
+// own: the user, password, path and query values of a URL such as
+// SLACK_WEBHOOK_URL or SENTRY_DSN, and the credential values of a JSON
+// object such as WEBHOOK_HEADERS.
+func secretParts(value string) []string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	parts := []string{value}
+	if u, err := url.Parse(value); err == nil && u.Scheme != "" && u.Host != "" {
+		if u.User != nil {
+			parts = append(parts, u.User.Username())
+			if password, ok := u.User.Password(); ok {
+				parts = append(parts, password)
+			}
+		}
+		if u.Path != "" && u.Path != "/" {
+			parts = append(parts, u.Host+u.Path)
+			// Tokens in the path, as in Slack webhooks, are long; short
+			// segments such as /api are not.
+			for _, segment := range strings.Split(u.Path, "/") {
+				if len(segment) >= 16 {
+					parts = append(parts, segment)
+				}
+			}
+		}
+		for _, values := range u.Query() {
+			parts = append(parts, values...)
+		}
+	}
+	var object map[string]string
+	if json.Unmarshal([]byte(value), &object) == nil {
+		for key, v := range object {
+			if isSecretName(key) {
+				parts = append(parts, v)
+			}
+		}
+	}
+	return parts
+}
+
+// scrubHook scrubs the message and fields of every entry before it is
+// formatted, so that a secret is caught before the JSON formatter escapes
+// it, including in the rclone lines forwarded through the logger.
+type scrubHook struct{}
+
+func (scrubHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (scrubHook) Fire(entry *logrus.Entry) error {
+	entry.Message = scrubber.scrub(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = scrubber.scrub(v)
+		case []string:
+			scrubbed := make([]string, len(v))
+			for i, s := range v {
+				scrubbed[i] = scrubber.scrub(s)
+			}
+			entry.Data[key] = scrubbed
+		case bool, int, int64, float64, nil:
+		default:
+			// Errors, URLs and config dumps are compared in the form the
+			// formatter would print them.
+			text := fmt.Sprint(v)
+			if scrubbed := scrubber.scrub(text); scrubbed != text {
+				entry.Data[key] = scrubbed
+			}
+		}
+	}
+	return nil
+}
+
+// scrubWriter scrubs what is written to the logs without going through the
+// logger, such as the raw output of rclone.
+type scrubWriter struct {
+	w io.Writer
+}
+
+func (s scrubWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(s.w, scrubber.scrub(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// isSecretName reports whether a header or key name looks like it carries a
+// credential, e.g. Authorization or X-Api-Key.
+func isSecretName(name string) bool {
+	name = strings.ToLower(name)
+	if strings.Contains(name, "auth") || strings.Contains(name, "key") {
+		return true
+	}
+	for _, hint := range secretFieldHints {
+		if strings.Contains(name, hint) {
+			return true
+		}
+	}
+	return false
+}
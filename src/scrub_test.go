@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// randomSecret returns a secret of 12 to 40 characters of the alphabet of
+// AWS secret keys.
+func randomSecret(r *rand.Rand) string {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789/+="
+	b := make([]byte, 12+r.Intn(29))
+	for i := range b {
+		b[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+// TestSecretsNeverLogged runs failing syncs with random secrets in every
+// kind of secret setting, and an rclone that echoes its whole command line
+// and environment, and checks that none of them reaches the logs or the
+// run summary.
+func TestSecretsNeverLogged(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	path, _ := fakeRclone(t, `case "$1" in
+version) echo "rclone v1.66.0" ;;
+sync)
+	env=$(env | grep -E '^(AWS|RCLONE_CONFIG|SOURCE|DEST|WEBHOOK)_')
+	echo "ERROR : a.txt: Failed to copy: $* $(echo "$env" | tr '\n' ' ')" >&2
+	echo "$env"
+	exit 1 ;;
+esac
+exit 0`)
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		secrets := map[string]string{}
+		for _, key := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "DEST_ACCESS_KEY", "DEST_SECRET_KEY", "URL_USER", "URL_PASSWORD", "URL_TOKEN", "URL_QUERY"} {
+			secrets[key] = randomSecret(r)
+		}
+		dir := t.TempDir()
+		secretFile := filepath.Join(dir, "dest-secret")
+		if err := os.WriteFile(secretFile, []byte(secrets["DEST_SECRET_KEY"]+"\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		webhook, _ := url.Parse(server.URL)
+		webhook.User = url.UserPassword(secrets["URL_USER"], secrets["URL_PASSWORD"])
+		webhook.Path = "/hooks/" + url.PathEscape(secrets["URL_TOKEN"])
+		webhook.RawQuery = url.Values{"token": {secrets["URL_QUERY"]}}.Encode()
+		summaryFile := filepath.Join(dir, "summary.json")
+
+		setTestEnv(t, withEnv(map[string]string{
+			"RCLONE_PATH":           path,
+			"SOURCE_AUTH":           "env",
+			"SOURCE_ACCESS_KEY":     "",
+			"SOURCE_SECRET_KEY":     "",
+			"AWS_ACCESS_KEY_ID":     secrets["AWS_ACCESS_KEY_ID"],
+			"AWS_SECRET_ACCESS_KEY": secrets["AWS_SECRET_ACCESS_KEY"],
+			"AWS_SESSION_TOKEN":     secrets["AWS_SESSION_TOKEN"],
+			"DEST_ACCESS_KEY":       secrets["DEST_ACCESS_KEY"],
+			"DEST_SECRET_KEY_FILE":  secretFile,
+			"DEST_SECRET_KEY":       "",
+			"WEBHOOK_URL":           webhook.String(),
+			"NOTIFY_ON":             "always",
+			"SUMMARY_FILE":          summaryFile,
+			"LOG_LEVEL":             "trace",
+		}))
+		output := captureOutput(t, func() {
+			if result, err := run(nil); err != nil || result.code == 0 {
+				t.Errorf("run = %d, %v; want the sync to fail", result.code, err)
+			}
+		})
+		summary, err := os.ReadFile(summaryFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(output, "Failed to copy") || !strings.Contains(output, scrubbedText) {
+			t.Fatalf("the output lacks the scrubbed rclone error:\n%s", output)
+		}
+		for name, secret := range secrets {
+			for _, form := range []string{secret, url.QueryEscape(secret), url.PathEscape(secret)} {
+				if strings.Contains(output, form) {
+					t.Errorf("run %d: %s %q is in the output:\n%s", i, name, form, output)
+				}
+				if strings.Contains(string(summary), form) {
+					t.Errorf("run %d: %s %q is in the summary:\n%s", i, name, form, summary)
+				}
+			}
+		}
+	}
+}
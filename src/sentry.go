@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sentryClient has a short timeout, as events are sent synchronously when a
+// run ends.
+var sentryClient = &http.Client{Timeout: 10 * time.Second}
+
+// panicReported is set once a panic has been sent, so that the recover in
+// main doesn't send the panic runJob already sent again.
+var panicReported atomic.Bool
+
+// sentryTarget is where the events of a SENTRY_DSN are sent.
+type sentryTarget struct {
+	storeURL string
+	auth     string
+}
+
+// parseSentryDSN parses a DSN such as https://<key>@o1.ingest.sentry.io/42.
+func parseSentryDSN(dsn string) (*sentryTarget, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: must look like https://<key>@<host>/<project>")
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	project := path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: no project ID in the path")
+	}
+	auth := "Sentry sentry_version=7, sentry_client=s3-sync/1.0, sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	return &sentryTarget{
+		storeURL: fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path[:i], project),
+		auth:     auth,
+	}, nil
+}
+
+func validateSentry(config *Config) error {
+	if config.SentryDSN == "" {
+		return nil
+	}
+	_, err := parseSentryDSN(config.SentryDSN)
+	return err
+}
+
+// sentryEvent is the part of the Sentry event payload that is sent.
+type sentryEvent struct {
+	EventID     string                 `json:"event_id"`
+	Timestamp   string                 `json:"timestamp"`
+	Level       string                 `json:"level"`
+	Platform    string                 `json:"platform"`
+	Logger      string                 `json:"logger"`
+	ServerName  string                 `json:"server_name,omitempty"`
+	Environment string                 `json:"environment,omitempty"`
+	Message     string                 `json:"message"`
+	Exception   map[string]interface{} `json:"exception"`
+	Fingerprint []string               `json:"fingerprint"`
+	Tags        map[string]string      `json:"tags"`
+	Breadcrumbs map[string]interface{} `json:"breadcrumbs,omitempty"`
+	Extra       map[string]interface{} `json:"extra,omitempty"`
+}
+
+// captureFailure sends a failed run to Sentry: its error and class, rclone's
+// last error lines as breadcrumbs, and the job as tags. Events of the same
+// job and error class are grouped into one issue. Successful and
+// interrupted runs send nothing, and nothing is sent without SENTRY_DSN.
+func captureFailure(config *Config, report *runSummary, err error, logger *logrus.Logger) {
+	if config.SentryDSN == "" || report.Result != "failure" {
+		return
+	}
+	event := newSentryEvent(config, "error", report.ErrorClass, err.Error())
+	event.Fingerprint = []string{"s3-sync", config.JobName, report.ErrorClass, string(rcloneErrorClass(err))}
+	event.Tags["error_class"] = report.ErrorClass
+	if class := rcloneErrorClass(err); class != "" {
+		event.Tags["rclone_error_class"] = string(class)
+	}
+	var rcloneErr *rcloneError
+	if errors.As(err, &rcloneErr) && len(rcloneErr.lines) > 0 {
+		crumbs := make([]map[string]interface{}, 0, len(rcloneErr.lines))
+		for _, line := range rcloneErr.lines {
+			crumbs = append(crumbs, map[string]interface{}{"category": "rclone", "level": "error", "message": line})
+		}
+		event.Breadcrumbs = map[string]interface{}{"values": crumbs}
+	}
+	event.Extra = map[string]interface{}{
+		"exit_code":        report.ExitCode,
+		"rclone_exit_code": report.RcloneExitCode,
+		"duration_seconds": report.Duration,
+		"stats":            report.Stats,
+	}
+	if err := sendSentryEvent(config, event); err != nil {
+		logger.WithError(err).Warn("Failed to send the failure to Sentry")
+		return
+	}
+	logger.WithField("sentry_event_id", event.EventID).Debug("Sent the failure to Sentry")
+}
+
+// reportPanic sends a panic to Sentry and panics again, so that the process
+// still crashes with the stack trace. Deferred in main and runJob; it does
+// nothing without SENTRY_DSN.
+func reportPanic(config *Config) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if config.SentryDSN != "" && panicReported.CompareAndSwap(false, true) {
+		event := newSentryEvent(config, "fatal", "panic", fmt.Sprint(r))
+		event.Fingerprint = []string{"s3-sync", "panic", fmt.Sprint(r)}
+		event.Extra = map[string]interface{}{"stack": string(debug.Stack())}
+		if err := sendSentryEvent(config, event); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to send the panic to Sentry: %v\n", err)
+		}
+	}
+	panic(r)
+}
+
+func newSentryEvent(config *Config, level, kind, message string) *sentryEvent {
+	hostname, _ := os.Hostname()
+	tags := map[string]string{
+		"source_bucket": config.Source.Bucket,
+		"dest_bucket":   config.Dest.Bucket,
+		"mode":          config.SyncMode,
+		"dry_run":       fmt.Sprint(config.DryRun),
+		"run_id":        config.runID,
+	}
+	if config.JobName != "" {
+		tags["job"] = config.JobName
+	}
+	return &sentryEvent{
+		EventID:     strings.ReplaceAll(newUUID(), "-", ""),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       level,
+		Platform:    "go",
+		Logger:      "s3-sync",
+		ServerName:  hostname,
+		Environment: config.SentryEnvironment,
+		Message:     message,
+		Exception: map[string]interface{}{
+			"values": []map[string]string{{"type": kind, "value": message}},
+		},
+		Tags: tags,
+	}
+}
+
+func sendSentryEvent(config *Config, event *sentryEvent) error {
+	target, err := parseSentryDSN(config.SentryDSN)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return deliver(sentryClient, http.MethodPost, target.storeURL, body, map[string]string{"X-Sentry-Auth": target.auth})
+}
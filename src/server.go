@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxQueuedRuns caps the runs waiting with ALLOW_QUEUE.
+	maxQueuedRuns = 100
+	// maxFinishedRuns is how many finished runs GET /runs/<id> remembers.
+	maxFinishedRuns = 100
+)
+
+var (
+	errRunBusy      = errors.New("a sync is already running")
+	errQueueFull    = errors.New("too many syncs are queued")
+	errShuttingDown = errors.New("the server is shutting down")
+)
+
+func validateServer(config *Config) error {
+	if config.HTTPAddr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(config.HTTPAddr); err != nil {
+		return fmt.Errorf("invalid HTTP_ADDR %q: must look like :8080 or 127.0.0.1:8080", config.HTTPAddr)
+	}
+	if d, err := time.ParseDuration(config.ReadyCheckTTL); err != nil || d < 0 {
+		return fmt.Errorf("invalid READY_CHECK_TTL %q: must be a duration like 1m", config.ReadyCheckTTL)
+	}
+	if config.SQSQueueURL != "" {
+		return fmt.Errorf("HTTP_ADDR can't be combined with SQS_QUEUE_URL")
+	}
+	return nil
+}
+
+// syncRun is one sync started through the HTTP server or the schedule, as
+// reported by GET /runs/<id>.
+type syncRun struct {
+	ID         string     `json:"id"`
+	Trigger    string     `json:"trigger"`
+	Status     string     `json:"status"`
+	Prefix     string     `json:"prefix,omitempty"`
+	DryRun     *bool      `json:"dry_run,omitempty"`
+	QueuedAt   time.Time  `json:"queued_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Duration   string     `json:"duration,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+
+	configs []*Config
+}
+
+// runOverrides are the settings POST /sync can change for one run.
+type runOverrides struct {
+	// Prefix narrows the sync to a sub-path of SOURCE_PREFIX, mapped to the
+	// same sub-path of DEST_PREFIX.
+	Prefix string `json:"prefix"`
+	DryRun *bool  `json:"dry_run"`
+}
+
+// apply returns copies of configs with the overrides applied.
+func (o runOverrides) apply(configs []*Config) ([]*Config, error) {
+	prefix := cleanPrefix(o.Prefix)
+	if prefix != "" && (len(configs) > 1 || configs[0].SourceBucketPattern != "" || configs[0].ShardByPrefix) {
+		return nil, fmt.Errorf("prefix can only be set for a single sync, not with several jobs, bucket discovery or sharding")
+	}
+	if strings.Contains("/"+prefix+"/", "/../") {
+		return nil, fmt.Errorf("prefix must not contain \"..\"")
+	}
+	clones := make([]*Config, 0, len(configs))
+	for _, config := range configs {
+		clone := *config
+		if prefix != "" {
+			clone.Source.Prefix = joinPrefix(clone.Source.Prefix, prefix)
+			clone.Dest.Prefix = joinPrefix(clone.Dest.Prefix, prefix)
+		}
+		if o.DryRun != nil {
+			clone.DryRun = *o.DryRun
+		}
+		clones = append(clones, &clone)
+	}
+	return clones, nil
+}
+
+// runner runs one sync at a time, in the order they were submitted, and
+// keeps their status for GET /runs/<id>.
+type runner struct {
+	configs []*Config
+	logger  *logrus.Logger
+
+	mu       sync.Mutex
+	runs     map[string]*syncRun
+	finished []string
+	queue    []*syncRun
+	active   *syncRun
+	stopping bool
+	// interrupted is set when a signal stopped a run in progress.
+	interrupted bool
+	wake        chan struct{}
+	done        chan struct{}
+}
+
+func newRunner(configs []*Config, logger *logrus.Logger) *runner {
+	return &runner{
+		configs: configs,
+		logger:  logger,
+		runs:    make(map[string]*syncRun),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// submit adds a run. Unless queue is set, it fails with errRunBusy while
+// another run is active or waiting.
+func (r *runner) submit(trigger string, overrides runOverrides, queue bool) (syncRun, error) {
+	configs, err := overrides.apply(r.configs)
+	if err != nil {
+		return syncRun{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case r.stopping:
+		return syncRun{}, errShuttingDown
+	case !queue && (r.active != nil || len(r.queue) > 0):
+		return syncRun{}, errRunBusy
+	case len(r.queue) >= maxQueuedRuns:
+		return syncRun{}, errQueueFull
+	}
+	run := &syncRun{
+		ID:       newRunID(),
+		Trigger:  trigger,
+		Status:   "queued",
+		Prefix:   cleanPrefix(overrides.Prefix),
+		DryRun:   overrides.DryRun,
+		QueuedAt: time.Now().UTC(),
+		configs:  configs,
+	}
+	// The jobs of the run log and report its ID.
+	for _, config := range configs {
+		config.RunID = run.ID
+	}
+	r.runs[run.ID] = run
+	r.queue = append(r.queue, run)
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return *run, nil
+}
+
+// get returns a snapshot of the run with the given ID.
+func (r *runner) get(id string) (syncRun, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return syncRun{}, false
+	}
+	return *run, true
+}
+
+// draining reports whether stop has been called.
+func (r *runner) draining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopping
+}
+
+// activeID returns the ID of the run in progress, or "".
+func (r *runner) activeID() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active == nil {
+		return ""
+	}
+	return r.active.ID
+}
+
+// work runs the queued syncs until stop is called, then closes done once the
+// run in progress has finished.
+func (r *runner) work() {
+	defer close(r.done)
+	for {
+		r.mu.Lock()
+		if r.stopping {
+			r.mu.Unlock()
+			return
+		}
+		if len(r.queue) == 0 {
+			r.mu.Unlock()
+			<-r.wake
+			continue
+		}
+		run := r.queue[0]
+		r.queue = r.queue[1:]
+		started := time.Now().UTC()
+		run.Status, run.StartedAt = "running", &started
+		r.active = run
+		r.mu.Unlock()
+
+		r.logger.WithFields(logrus.Fields{"run_id": run.ID, "trigger": run.Trigger}).Info("Sync run started")
+		code := runOnce(run.configs)
+
+		r.mu.Lock()
+		finished := time.Now().UTC()
+		run.FinishedAt, run.ExitCode = &finished, &code
+		run.Duration = finished.Sub(started).Round(time.Millisecond).String()
+		var interruptedErr *interruptedError
+		switch {
+		case code == 0:
+			run.Status = "succeeded"
+		case errors.As(shutdown.err(), &interruptedErr) && code == exitInterrupted:
+			run.Status = "interrupted"
+			r.interrupted = true
+		default:
+			run.Status = "failed"
+		}
+		r.active = nil
+		r.remember(run)
+		r.mu.Unlock()
+		r.logger.WithFields(logrus.Fields{
+			"run_id":    run.ID,
+			"status":    run.Status,
+			"exit_code": code,
+			"duration":  run.Duration,
+		}).Info("Sync run finished")
+	}
+}
+
+// remember records a finished run, forgetting the oldest beyond
+// maxFinishedRuns. The caller holds r.mu.
+func (r *runner) remember(run *syncRun) {
+	r.finished = append(r.finished, run.ID)
+	if len(r.finished) > maxFinishedRuns {
+		delete(r.runs, r.finished[0])
+		r.finished = r.finished[1:]
+	}
+}
+
+// stop cancels the queued runs and makes work return after the run in
+// progress. It returns the number of cancelled runs.
+func (r *runner) stop() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopping = true
+	cancelled := len(r.queue)
+	for _, run := range r.queue {
+		run.Status = "cancelled"
+		r.remember(run)
+	}
+	r.queue = nil
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return cancelled
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// requireToken rejects requests without "Authorization: Bearer HTTP_TOKEN".
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="s3-sync"`)
+			writeError(w, http.StatusUnauthorized, "missing or wrong bearer token")
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// handleSync serves POST /sync, which queues a run and answers 202 with its
+// ID. The optional JSON body holds runOverrides.
+func (r *runner) handleSync(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var overrides runOverrides
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, 64<<10))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&overrides); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+
+	run, err := r.submit("http", overrides, r.configs[0].AllowQueue)
+	switch {
+	case errors.Is(err, errRunBusy):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error(), "running": r.activeID()})
+		return
+	case errors.Is(err, errQueueFull):
+		writeError(w, http.StatusTooManyRequests, err.Error())
+		return
+	case errors.Is(err, errShuttingDown):
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	r.logger.WithFields(logrus.Fields{
+		"run_id": run.ID,
+		"remote": req.RemoteAddr,
+		"prefix": run.Prefix,
+	}).Info("Sync triggered over HTTP")
+	w.Header().Set("Location", "/runs/"+run.ID)
+	writeJSON(w, http.StatusAccepted, run)
+}
+
+// handleRun serves GET /runs/<id>.
+func (r *runner) handleRun(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	run, ok := r.get(strings.TrimPrefix(req.URL.Path, "/runs/"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such run")
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+// runServer serves the probes and, with HTTP_TOKEN, the HTTP API on
+// HTTP_ADDR until SIGINT or SIGTERM, and also runs the syncs due on SCHEDULE
+// if it is set. On a signal it stops
+// accepting requests, cancels queued runs and waits for the run in progress,
+// which handleShutdown stops within SHUTDOWN_GRACE, returning 0 for a clean
+// stop and exitInterrupted if the run was interrupted.
+func runServer(configs []*Config) int {
+	config := configs[0]
+	logger := setupLogger(config)
+	grace, _ := time.ParseDuration(config.ShutdownGrace)
+	r := newRunner(configs, logger)
+	h := newHealth(configs, r.draining)
+	h.beat("server")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.handleHealthz)
+	mux.HandleFunc("/readyz", h.handleReadyz)
+	mux.HandleFunc("/metrics", handleMetrics)
+	if config.HTTPToken != "" {
+		mux.Handle("/sync", requireToken(config.HTTPToken, http.HandlerFunc(r.handleSync)))
+		mux.Handle("/runs/", requireToken(config.HTTPToken, http.HandlerFunc(r.handleRun)))
+	} else {
+		logger.Info("HTTP_TOKEN is not set, serving only /healthz, /readyz and /metrics")
+	}
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	listener, err := net.Listen("tcp", config.HTTPAddr)
+	if err != nil {
+		logger.WithError(err).Error("Failed to start the HTTP server")
+		return 1
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Serve(listener) }()
+	go r.work()
+	logger.WithFields(logrus.Fields{
+		"addr":        listener.Addr().String(),
+		"allow_queue": config.AllowQueue,
+	}).Info("HTTP server started")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	stopSchedule := make(chan struct{})
+	if config.Schedule != "" {
+		h.beat("scheduler")
+		go r.schedule(stopSchedule, h)
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	var sig os.Signal
+	for sig == nil {
+		select {
+		case sig = <-signals:
+		case err := <-serveErr:
+			logger.WithError(err).Error("HTTP server failed")
+			r.stop()
+			return 1
+		case <-ticker.C:
+			h.beat("server")
+		}
+	}
+	close(stopSchedule)
+
+	deadline := time.Now().Add(grace)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	_ = server.Shutdown(ctx)
+	cancelled := r.stop()
+	logger.WithFields(logrus.Fields{
+		"signal":         sig.String(),
+		"grace":          grace.String(),
+		"cancelled_runs": cancelled,
+	}).Info("HTTP server stopped, waiting for the sync in progress")
+
+	<-r.done
+	r.mu.Lock()
+	interrupted := r.interrupted
+	r.mu.Unlock()
+	if interrupted {
+		logger.Warn("Server stopped, the sync in progress was interrupted")
+		return exitInterrupted
+	}
+	logger.Info("Server stopped")
+	return 0
+}
+
+// schedule submits a run whenever SCHEDULE is due, skipping it while another
+// run is active or queued, until stop is closed. It reports a heartbeat to h
+// while waiting.
+func (r *runner) schedule(stop <-chan struct{}, h *health) {
+	immediate, nextRun := scheduleClock(r.configs[0])
+	next := nextRun()
+	if immediate {
+		next = time.Now()
+	}
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		r.logger.WithField("next_run", next.Format(time.RFC3339)).Info("Next sync scheduled")
+		timer := time.NewTimer(time.Until(next))
+	wait:
+		for {
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-ticker.C:
+				h.beat("scheduler")
+			case <-timer.C:
+				break wait
+			}
+		}
+		h.beat("scheduler")
+		if _, err := r.submit("schedule", runOverrides{}, false); errors.Is(err, errRunBusy) {
+			r.logger.WithField("running", r.activeID()).Warn("Previous sync is still running, skipping this run")
+		}
+		next = nextRun()
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidateServer(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"HTTP_ADDR": "8080"}, `invalid HTTP_ADDR "8080"`},
+		{map[string]string{"HTTP_ADDR": ":8080", "READY_CHECK_TTL": "-1m"}, `invalid READY_CHECK_TTL "-1m"`},
+		{withSQS(map[string]string{"HTTP_ADDR": ":8080"}), "HTTP_ADDR can't be combined with SQS_QUEUE_URL"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestRunOverrides(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"SOURCE_PREFIX": "media", "DEST_PREFIX": "backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := runOverrides{Prefix: "/2024/05/", DryRun: ptr(true)}.apply([]*Config{config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := configs[0]; c.Source.Prefix != "media/2024/05" || c.Dest.Prefix != "backup/2024/05" || !c.DryRun {
+		t.Errorf("overridden run syncs %s to %s, dry run %v", c.Source.Prefix, c.Dest.Prefix, c.DryRun)
+	}
+	// The overrides apply to a copy.
+	if config.Source.Prefix != "media" || config.DryRun {
+		t.Errorf("apply changed the configuration: %+v", config.Source)
+	}
+
+	_, err = runOverrides{Prefix: "2024/../../secret"}.apply([]*Config{config})
+	wantError(t, err, `prefix must not contain ".."`)
+	_, err = runOverrides{Prefix: "2024"}.apply([]*Config{config, config})
+	wantError(t, err, "prefix can only be set for a single sync")
+}
+
+// newTestServer returns a runner for the jobs configured by env, and a
+// handler serving its API with the token "secret".
+func newTestServer(t *testing.T, env map[string]string) (*runner, http.Handler) {
+	t.Helper()
+	env["HTTP_TOKEN"] = "secret"
+	configs, err := loadTestConfigs(t, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	r := newRunner(configs, logger)
+	mux := http.NewServeMux()
+	mux.Handle("/sync", requireToken("secret", http.HandlerFunc(r.handleSync)))
+	mux.Handle("/runs/", requireToken("secret", http.HandlerFunc(r.handleRun)))
+	return r, mux
+}
+
+// serve sends a request to h with the bearer token and returns the response.
+func serve(h http.Handler, method, path, body, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestServerAPI(t *testing.T) {
+	r, h := newTestServer(t, map[string]string{})
+
+	if w := serve(h, http.MethodPost, "/sync", "", "wrong"); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("POST /sync with a wrong token = %d", w.Code)
+	}
+	if w := serve(h, http.MethodGet, "/sync", "", "secret"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /sync = %d, want 405", w.Code)
+	}
+	if w := serve(h, http.MethodPost, "/sync", `{"prefix": "a", "transfers": 8}`, "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /sync with an unknown field = %d, want 400", w.Code)
+	}
+
+	w := serve(h, http.MethodPost, "/sync", `{"prefix": "2024", "dry_run": true}`, "secret")
+	var run syncRun
+	if err := json.Unmarshal(w.Body.Bytes(), &run); err != nil || w.Code != http.StatusAccepted {
+		t.Fatalf("POST /sync = %d %s", w.Code, w.Body)
+	}
+	if run.Status != "queued" || run.Trigger != "http" || run.Prefix != "2024" || w.Header().Get("Location") != "/runs/"+run.ID {
+		t.Errorf("queued run = %+v, Location %q", run, w.Header().Get("Location"))
+	}
+	// The jobs of the run carry its ID.
+	if got, _ := r.get(run.ID); got.configs[0].RunID != run.ID {
+		t.Errorf("run configuration has RUN_ID %q, want %q", got.configs[0].RunID, run.ID)
+	}
+
+	// Without ALLOW_QUEUE, a second run is refused while one is waiting.
+	if w := serve(h, http.MethodPost, "/sync", "", "secret"); w.Code != http.StatusConflict {
+		t.Errorf("second POST /sync = %d, want 409", w.Code)
+	}
+
+	if w := serve(h, http.MethodGet, "/runs/"+run.ID, "", "secret"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"queued"`) {
+		t.Errorf("GET /runs/<id> = %d %s", w.Code, w.Body)
+	}
+	if w := serve(h, http.MethodGet, "/runs/nope", "", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("GET /runs/nope = %d, want 404", w.Code)
+	}
+
+	// Stopping cancels the queued run and refuses new ones.
+	if cancelled := r.stop(); cancelled != 1 {
+		t.Errorf("stop cancelled %d runs, want 1", cancelled)
+	}
+	if got, _ := r.get(run.ID); got.Status != "cancelled" {
+		t.Errorf("run is %s after stop, want cancelled", got.Status)
+	}
+	if w := serve(h, http.MethodPost, "/sync", "", "secret"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST /sync while stopping = %d, want 503", w.Code)
+	}
+}
+
+func TestServerQueue(t *testing.T) {
+	r, h := newTestServer(t, map[string]string{"ALLOW_QUEUE": "true"})
+	for i := 0; i < maxQueuedRuns; i++ {
+		if w := serve(h, http.MethodPost, "/sync", "", "secret"); w.Code != http.StatusAccepted {
+			t.Fatalf("POST /sync %d = %d", i, w.Code)
+		}
+	}
+	if w := serve(h, http.MethodPost, "/sync", "", "secret"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("POST /sync with a full queue = %d, want 429", w.Code)
+	}
+	// Only the latest maxFinishedRuns cancelled runs are remembered.
+	r.stop()
+	if len(r.runs) != maxFinishedRuns {
+		t.Errorf("%d runs remembered, want %d", len(r.runs), maxFinishedRuns)
+	}
+}
+
+func TestRunnerWork(t *testing.T) {
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = sync ] && [ "$2" = source:source-bucket/fail ] && exit 1
+exit 0`)
+	r, h := newTestServer(t, map[string]string{"RCLONE_PATH": path, "ALLOW_QUEUE": "true"})
+
+	var ids []string
+	for _, body := range []string{`{"prefix": "2024"}`, `{"prefix": "fail"}`} {
+		var run syncRun
+		json.Unmarshal(serve(h, http.MethodPost, "/sync", body, "secret").Body.Bytes(), &run)
+		ids = append(ids, run.ID)
+	}
+	captureOutput(t, func() {
+		go r.work()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if last, _ := r.get(ids[1]); last.FinishedAt != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		r.stop()
+		<-r.done
+	})
+
+	for i, want := range []string{"succeeded", "failed"} {
+		run, _ := r.get(ids[i])
+		if run.Status != want || run.ExitCode == nil || run.StartedAt == nil || run.Duration == "" {
+			t.Errorf("run %d = %+v, want %s", i, run, want)
+		}
+	}
+	var synced []string
+	for _, run := range readCalls(t, calls) {
+		if strings.HasPrefix(run, "sync ") {
+			synced = append(synced, strings.Fields(run)[1])
+		}
+	}
+	if strings.Join(synced, " ") != "source:source-bucket/2024 source:source-bucket/fail" {
+		t.Errorf("synced %q, want the runs in order", synced)
+	}
+}
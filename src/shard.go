@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// rootShard is the job name of the pass that syncs everything outside the
+// shard prefixes.
+const rootShard = "root"
+
+// validateSharding rejects the settings that can't be split by prefix:
+// filters anchored at the root of the sync and FILES_FROM keys, which are
+// relative to the source prefix rather than to a shard.
+func validateSharding(config *Config) error {
+	if !config.ShardByPrefix {
+		if len(config.ShardPrefixes) > 0 {
+			return fmt.Errorf("SHARD_PREFIXES requires SHARD_BY_PREFIX=true")
+		}
+		return nil
+	}
+	if config.FilesFrom != "" {
+		return fmt.Errorf("FILES_FROM can't be combined with SHARD_BY_PREFIX")
+	}
+	for _, p := range append(append([]string{}, config.IncludePatterns...), config.ExcludePatterns...) {
+		if strings.HasPrefix(p, "/") {
+			return fmt.Errorf("pattern %q is anchored at the root of the sync, which differs per shard; "+
+				"use EXCLUDE_PREFIXES or an unanchored pattern with SHARD_BY_PREFIX", p)
+		}
+	}
+	for _, rule := range config.FilterRules {
+		if strings.HasPrefix(strings.TrimLeft(rule, "+- "), "/") {
+			return fmt.Errorf("FILTER_FILE rule %q is anchored at the root of the sync, which differs per shard", rule)
+		}
+	}
+	for _, p := range config.ShardPrefixes {
+		if cleanPrefix(p) == "" || strings.Contains(cleanPrefix(p), "/") {
+			return fmt.Errorf("SHARD_PREFIXES entry %q must be a single top-level folder", p)
+		}
+	}
+	return nil
+}
+
+// shardJobs splits template into a job per shard prefix, from SHARD_PREFIXES
+// or the top-level folders of the source, plus a final root pass that
+// excludes them. Each job only deletes within its own part of the
+// destination, so objects outside every shard are left to the root pass.
+func shardJobs(template *Config, logger *logrus.Logger) ([]*Config, error) {
+	prefixes := make([]string, 0, len(template.ShardPrefixes))
+	for _, p := range template.ShardPrefixes {
+		prefixes = append(prefixes, cleanPrefix(p))
+	}
+	if len(prefixes) == 0 {
+		var err error
+		if prefixes, err = listShardPrefixes(template); err != nil {
+			return nil, err
+		}
+	}
+
+	var configs []*Config
+	var excluded []string
+	for _, prefix := range prefixes {
+		excludes, skip := rebasePrefixes(template.ExcludePrefixes, prefix)
+		if skip {
+			excluded = append(excluded, prefix)
+			continue
+		}
+		config := *template
+		config.JobName = prefix
+		config.Source.Prefix = joinPrefix(template.Source.Prefix, prefix)
+		config.Dest.Prefix = joinPrefix(template.Dest.Prefix, prefix)
+		config.ExcludePrefixes = excludes
+		// rclone keeps paths relative to the root of the sync in the
+		// backup directory, so shards need separate ones.
+		if config.BackupDir != "" {
+			config.BackupDir = joinPrefix(template.BackupDir, prefix)
+		}
+		configs = append(configs, &config)
+	}
+
+	root := *template
+	root.JobName = rootShard
+	root.ExcludePrefixes = append(append([]string{}, template.ExcludePrefixes...), prefixes...)
+	configs = append(configs, &root)
+
+	for _, config := range configs {
+		if err := validateConfig(config); err != nil {
+			return nil, &classError{class: "config", err: fmt.Errorf("shard %s: %w", config.JobName, err)}
+		}
+		splitBandwidthLimit(config, len(configs))
+	}
+
+	logger.WithFields(logrus.Fields{
+		"shards":   prefixes,
+		"excluded": excluded,
+		"source":   remotePath("source", template.Source.Bucket, template.Source.Prefix),
+	}).Info("Sharding the sync by prefix")
+	return configs, nil
+}
+
+// listShardPrefixes returns the top-level folders of the source.
+func listShardPrefixes(config *Config) ([]string, error) {
+	remotes, cleanup, err := setupRemotes(config)
+	if err != nil {
+		return nil, &classError{class: "setup", err: fmt.Errorf("failed to create rclone config: %w", err)}
+	}
+	defer cleanup()
+
+	prefixes, err := listDirs(config, remotes, remotePath("source", config.Source.Bucket, config.Source.Prefix))
+	if err != nil {
+		return nil, &classError{class: "preflight", err: fmt.Errorf("failed to list the source folders: %w", err)}
+	}
+	if len(prefixes) == 0 {
+		return nil, &classError{class: "config", err: fmt.Errorf("the source has no top-level folders to shard by; unset SHARD_BY_PREFIX")}
+	}
+	return prefixes, nil
+}
+
+// rebasePrefixes returns the EXCLUDE_PREFIXES entries that lie below shard,
+// relative to it. skip is true if an entry excludes the whole shard.
+func rebasePrefixes(excludes []string, shard string) (rebased []string, skip bool) {
+	for _, e := range excludes {
+		e = cleanPrefix(e)
+		switch {
+		case e == shard || strings.HasPrefix(shard, e+"/"):
+			return nil, true
+		case strings.HasPrefix(e, shard+"/"):
+			rebased = append(rebased, strings.TrimPrefix(e, shard+"/"))
+		}
+	}
+	return rebased, false
+}
+
+func joinPrefix(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidateSharding(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"SHARD_PREFIXES": "a,b"}, "SHARD_PREFIXES requires SHARD_BY_PREFIX=true"},
+		{map[string]string{"SHARD_BY_PREFIX": "true", "FILES_FROM": "/tmp/keys"}, "FILES_FROM can't be combined with SHARD_BY_PREFIX"},
+		{map[string]string{"SHARD_BY_PREFIX": "true", "EXCLUDE_PATTERNS": "/tmp/**"}, `pattern "/tmp/**" is anchored at the root of the sync`},
+		{map[string]string{"SHARD_BY_PREFIX": "true", "SHARD_PREFIXES": "a/b"}, `SHARD_PREFIXES entry "a/b" must be a single top-level folder`},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestShardJobs(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{
+		"SHARD_BY_PREFIX":  "true",
+		"SHARD_PREFIXES":   "images,videos,tmp",
+		"EXCLUDE_PREFIXES": "tmp,images/cache",
+		"DEST_PREFIX":      "backup",
+		"BACKUP_DIR":       "trash",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(new(strings.Builder))
+	configs, err := shardJobs(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := jobNames(configs); !slices.Equal(names, []string{"images", "videos", rootShard}) {
+		t.Fatalf("shards %q, want images, videos and the root pass", names)
+	}
+	images, root := configs[0], configs[2]
+	if images.Source.Prefix != "images" || images.Dest.Prefix != "backup/images" || images.BackupDir != "trash/images" {
+		t.Errorf("images shard syncs %s to %s, backup %s", images.Source.Prefix, images.Dest.Prefix, images.BackupDir)
+	}
+	// Excludes below a shard are made relative to it.
+	if !slices.Equal(images.ExcludePrefixes, []string{"cache"}) {
+		t.Errorf("images shard excludes %q, want cache", images.ExcludePrefixes)
+	}
+	// The root pass skips everything a shard syncs.
+	if want := []string{"tmp", "images/cache", "images", "videos", "tmp"}; !slices.Equal(root.ExcludePrefixes, want) {
+		t.Errorf("root pass excludes %q, want %q", root.ExcludePrefixes, want)
+	}
+	if root.Source.Prefix != "" || root.Dest.Prefix != "backup" {
+		t.Errorf("root pass syncs %s to %s", root.Source.Prefix, root.Dest.Prefix)
+	}
+}
+
+func TestShardByListedPrefixes(t *testing.T) {
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+if [ "$1" = lsjson ]; then
+	echo '[{"Path":"images","IsDir":true},{"Path":"videos","IsDir":true},{"Path":"index.html","IsDir":false}]'
+	exit 0
+fi
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SHARD_BY_PREFIX": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+	var synced []string
+	for _, run := range readCalls(t, calls) {
+		if strings.HasPrefix(run, "sync ") {
+			synced = append(synced, strings.Join(strings.Fields(run)[1:3], " "))
+		}
+	}
+	slices.Sort(synced)
+	want := []string{
+		"source:source-bucket dest:dest-bucket/source-bucket",
+		"source:source-bucket/images dest:dest-bucket/source-bucket/images",
+		"source:source-bucket/videos dest:dest-bucket/source-bucket/videos",
+	}
+	if !slices.Equal(synced, want) {
+		t.Errorf("synced %q, want %q", synced, want)
+	}
+}
+
+func TestShardNoPrefixes(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = lsjson ] && { echo '[]'; exit 0; }
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SHARD_BY_PREFIX": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != exitConfigError {
+		t.Errorf("run = %d, want %d:\n%s", result.code, exitConfigError, out)
+	}
+	if e := findEntry(logEntries(t, out), "Sharding failed"); e == nil || !strings.Contains(e["error"].(string), "no top-level folders") {
+		t.Errorf("failure logged as %v", e)
+	}
+}
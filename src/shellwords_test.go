@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []string
+		err  string
+	}{
+		{"", nil, ""},
+		{"  --fast-list\t--checksum \n", []string{"--fast-list", "--checksum"}, ""},
+		{`--exclude "my dir/**"`, []string{"--exclude", "my dir/**"}, ""},
+		{`--exclude 'it''s $HOME/*'`, []string{"--exclude", "its $HOME/*"}, ""},
+		{`--header "X-Note: \"quoted\" \\ \n"`, []string{"--header", `X-Note: "quoted" \ \n`}, ""},
+		{`my\ dir ""`, []string{"my dir", ""}, ""},
+		{`--user-agent=a"b c"d`, []string{"--user-agent=ab cd"}, ""},
+		{`--exclude 'open`, nil, "unterminated single quote"},
+		{`--exclude "open`, nil, "unterminated double quote"},
+	} {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := splitWords(tt.in)
+			wantError(t, err, tt.err)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("splitWords = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRcloneExtraArgs(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"RCLONE_EXTRA_ARGS": `--user-agent sync/1 --exclude "my dir/**"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := syncArgs(config)
+	if !slices.Equal(args[len(args)-4:], []string{"--user-agent", "sync/1", "--exclude", "my dir/**"}) {
+		t.Errorf("rclone arguments %q don't end with the extra arguments", args)
+	}
+
+	for value, want := range map[string]string{
+		"--dry-run":        "RCLONE_EXTRA_ARGS must not contain --dry-run, it is managed by s3-sync",
+		"--config=/x.conf": "RCLONE_EXTRA_ARGS must not contain --config",
+		"--exclude 'open":  "RCLONE_EXTRA_ARGS: unterminated single quote",
+	} {
+		_, err := loadTestConfig(t, map[string]string{"RCLONE_EXTRA_ARGS": value})
+		wantError(t, err, want)
+	}
+}
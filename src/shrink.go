@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+func validateShrinkGuard(config *Config) error {
+	if config.MinSourceObjects < 0 {
+		return fmt.Errorf("MIN_SOURCE_OBJECTS must not be negative, got %d", config.MinSourceObjects)
+	}
+	if config.MaxShrinkPercent < 0 || config.MaxShrinkPercent > 100 {
+		return fmt.Errorf("MAX_SHRINK_PERCENT must be between 0 and 100, got %g", config.MaxShrinkPercent)
+	}
+	return nil
+}
+
+// shrinkError reports that the source failed the shrink guard.
+type shrinkError struct {
+	reason string
+}
+
+func (e *shrinkError) Error() string {
+	return "source looks emptied, not syncing: " + e.reason
+}
+
+// checkSourceShrink compares the number of source objects against
+// MIN_SOURCE_OBJECTS and, with MAX_SHRINK_PERCENT, against the destination.
+// A source that has lost most of its objects is far more often a rotated
+// credential, a wrong bucket or an upstream accident than intended, and a
+// sync would delete the destination to match. FORCE=true skips the check.
+func checkSourceShrink(config *Config, counts *objectCounts, logger *logrus.Logger) error {
+	if config.MinSourceObjects == 0 && config.MaxShrinkPercent == 0 {
+		return nil
+	}
+	if config.Force {
+		logger.Warn("FORCE is set, skipping the MIN_SOURCE_OBJECTS and MAX_SHRINK_PERCENT checks")
+		return nil
+	}
+
+	source, err := counts.source()
+	if err != nil {
+		return &classError{class: "preflight", err: err}
+	}
+	fields := logrus.Fields{"source_objects": source}
+	var reason string
+	if source < int64(config.MinSourceObjects) {
+		reason = fmt.Sprintf("%d source objects, fewer than MIN_SOURCE_OBJECTS=%d", source, config.MinSourceObjects)
+	}
+	if reason == "" && config.MaxShrinkPercent > 0 {
+		dest, err := counts.dest()
+		if err != nil {
+			return &classError{class: "preflight", err: err}
+		}
+		fields["dest_objects"] = dest
+		if dest > 0 {
+			shrink := float64(dest-source) / float64(dest) * 100
+			fields["shrink_percent"] = shrink
+			if shrink > config.MaxShrinkPercent {
+				reason = fmt.Sprintf("the source has %.1f%% fewer objects than the destination (%d vs %d), more than MAX_SHRINK_PERCENT=%g",
+					shrink, source, dest, config.MaxShrinkPercent)
+			}
+		}
+	}
+
+	entry := logger.WithFields(fields)
+	if reason == "" {
+		entry.Info("Source object count check passed")
+		return nil
+	}
+	entry.WithField("hint", "check the source credentials, bucket and prefix; set FORCE=true if the source really shrank").
+		Error("ABORTING: the source looks emptied or shrunken, the sync would delete most of the destination")
+	return &shrinkError{reason: reason}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidateShrinkGuard(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"MIN_SOURCE_OBJECTS": "10", "MAX_SHRINK_PERCENT": "50"}, ""},
+		{map[string]string{"MAX_SHRINK_PERCENT": "100"}, ""},
+		{map[string]string{"MIN_SOURCE_OBJECTS": "-1"}, "MIN_SOURCE_OBJECTS must not be negative, got -1"},
+		{map[string]string{"MAX_SHRINK_PERCENT": "101"}, "MAX_SHRINK_PERCENT must be between 0 and 100, got 101"},
+		{map[string]string{"MAX_SHRINK_PERCENT": "-5"}, "MAX_SHRINK_PERCENT must be between 0 and 100, got -5"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+// countingRclone answers rclone size with the given object counts; a
+// negative count fails it.
+func countingRclone(t *testing.T, source, dest int) (path, calls string) {
+	return fakeRclone(t, fmt.Sprintf(`[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+count() { [ "$1" -lt 0 ] && { echo "ERROR : directory not found" >&2; exit 3; }; echo "{\"count\":$1,\"bytes\":0}"; exit 0; }
+case "$1 $2" in
+"size source:"*) count %d ;;
+"size dest:"*) count %d ;;
+esac
+exit 0`, source, dest))
+}
+
+func TestSourceShrink(t *testing.T) {
+	for _, tt := range []struct {
+		name          string
+		source, dest  int
+		env           map[string]string
+		code          int
+		reason        string
+		countsDest    bool
+		startsTheSync bool
+	}{
+		{name: "no guard", source: 0, dest: 100, startsTheSync: true},
+		{name: "enough objects", source: 10, dest: 100, env: map[string]string{"MIN_SOURCE_OBJECTS": "10"}, startsTheSync: true},
+		{name: "too few objects", source: 9, dest: 100, env: map[string]string{"MIN_SOURCE_OBJECTS": "10", "MAX_SHRINK_PERCENT": "95"},
+			code: exitPreflightFailed, reason: "9 source objects, fewer than MIN_SOURCE_OBJECTS=10"},
+		{name: "shrunk within the limit", source: 50, dest: 100, env: map[string]string{"MAX_SHRINK_PERCENT": "50"},
+			countsDest: true, startsTheSync: true},
+		{name: "shrunk", source: 40, dest: 100, env: map[string]string{"MAX_SHRINK_PERCENT": "50"},
+			code: exitPreflightFailed, countsDest: true,
+			reason: "the source has 60.0% fewer objects than the destination (40 vs 100), more than MAX_SHRINK_PERCENT=50"},
+		{name: "grown", source: 200, dest: 100, env: map[string]string{"MAX_SHRINK_PERCENT": "10"}, countsDest: true, startsTheSync: true},
+		{name: "empty destination", source: 0, dest: 0, env: map[string]string{"MAX_SHRINK_PERCENT": "10"}, countsDest: true, startsTheSync: true},
+		{name: "forced", source: 0, dest: 100, env: map[string]string{"MIN_SOURCE_OBJECTS": "10", "FORCE": "true"}, startsTheSync: true},
+		{name: "source count fails", source: -1, dest: 100, env: map[string]string{"MIN_SOURCE_OBJECTS": "10"},
+			code: exitPreflightFailed, reason: "failed to count the objects in source:source-bucket"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, calls := countingRclone(t, tt.source, tt.dest)
+			env := map[string]string{"RCLONE_PATH": path}
+			for key, value := range tt.env {
+				env[key] = value
+			}
+			setTestEnv(t, withEnv(env))
+			var result runResult
+			out := captureOutput(t, func() { result, _ = run(nil) })
+			if result.code != tt.code {
+				t.Fatalf("run = %d, want %d:\n%s", result.code, tt.code, out)
+			}
+			if tt.reason != "" && !strings.Contains(out, tt.reason) {
+				t.Errorf("output doesn't explain %q:\n%s", tt.reason, out)
+			}
+
+			var countedDest, synced bool
+			for _, call := range readCalls(t, calls) {
+				countedDest = countedDest || strings.HasPrefix(call, "size dest:")
+				synced = synced || strings.HasPrefix(call, "sync ")
+			}
+			if countedDest != tt.countsDest || synced != tt.startsTheSync {
+				t.Errorf("counted the destination %v and synced %v, want %v and %v: %q", countedDest, synced, tt.countsDest, tt.startsTheSync, readCalls(t, calls))
+			}
+		})
+	}
+}
+
+func TestObjectCountsOnce(t *testing.T) {
+	path, calls := countingRclone(t, 40, 100)
+	// Both MAX_SHRINK_PERCENT and MAX_DELETE_PERCENT need the destination
+	// count, which is listed once.
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "MAX_SHRINK_PERCENT": "80", "MAX_DELETE_PERCENT": "10"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+	var counts int
+	var maxDelete string
+	for _, call := range readCalls(t, calls) {
+		if strings.HasPrefix(call, "size dest:") {
+			counts++
+		}
+		if strings.HasPrefix(call, "sync ") {
+			maxDelete, _ = argValue(strings.Fields(call), "--max-delete")
+		}
+	}
+	if counts != 1 || maxDelete != "10" {
+		t.Errorf("destination counted %d times and --max-delete %q, want once and 10", counts, maxDelete)
+	}
+}
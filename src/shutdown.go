@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shutdownCleanupTimeout is how long the deferred cleanup of a run may take
+// once rclone has been killed at the end of SHUTDOWN_GRACE, before the
+// process exits anyway.
+const shutdownCleanupTimeout = 30 * time.Second
+
+// shutdown is the process-wide state of a SIGINT or SIGTERM: the signal, and
+// the rclone processes it has to reach.
+var shutdown = &shutdownState{
+	done:   make(chan struct{}),
+	procs:  make(map[*os.Process]bool),
+	paths:  make(map[string]bool),
+	forced: make(chan int, 1),
+}
+
+type shutdownState struct {
+	mu    sync.Mutex
+	sig   os.Signal
+	done  chan struct{}
+	procs map[*os.Process]bool
+	// paths are removed if the process has to exit before cleaning up.
+	paths map[string]bool
+	// forced gets the exit code if the cleanup didn't finish in time, for
+	// main to exit without waiting for the run.
+	forced chan int
+}
+
+// interruptedError reports that a run was stopped by a signal. err is the
+// error of the rclone process it stopped, or nil if none was running.
+type interruptedError struct {
+	sig os.Signal
+	err error
+}
+
+func (e *interruptedError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("interrupted by %s", e.sig)
+	}
+	return fmt.Sprintf("interrupted by %s: %v", e.sig, e.err)
+}
+
+func (e *interruptedError) Unwrap() error { return e.err }
+
+// interrupted is closed when the first SIGINT or SIGTERM arrives.
+func (s *shutdownState) interrupted() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done
+}
+
+// reset forgets the signal of a previous run.
+func (s *shutdownState) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sig = nil
+	s.done = make(chan struct{})
+}
+
+// err returns an interruptedError once a signal has arrived, and nil before.
+func (s *shutdownState) err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sig == nil {
+		return nil
+	}
+	return &interruptedError{sig: s.sig}
+}
+
+// run runs an rclone command that handleShutdown can stop. The command is
+// started in its own process group by rcloneRemotes.command, so the signal
+// reaches rclone once, through handleShutdown, and any children it has.
+func (s *shutdownState) run(cmd *exec.Cmd) error {
+	return s.runContext(context.Background(), cmd, 0)
+}
+
+// runContext is run with a context: when ctx ends, rclone gets SIGINT to
+// stop its transfers, and SIGKILL if it is still running after grace.
+func (s *shutdownState) runContext(ctx context.Context, cmd *exec.Cmd, grace time.Duration) error {
+	s.mu.Lock()
+	if s.sig != nil {
+		s.mu.Unlock()
+		return &interruptedError{sig: s.sig}
+	}
+	if err := cmd.Start(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.procs[cmd.Process] = true
+	s.mu.Unlock()
+
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-exited:
+			return
+		}
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+		select {
+		case <-time.After(grace):
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+	err := cmd.Wait()
+
+	s.mu.Lock()
+	delete(s.procs, cmd.Process)
+	sig := s.sig
+	s.mu.Unlock()
+	if sig != nil && err != nil {
+		return &interruptedError{sig: sig, err: err}
+	}
+	return err
+}
+
+// signalAll sends sig to the process groups of the running rclone commands
+// and returns how many there were.
+func (s *shutdownState) signalAll(sig syscall.Signal) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p := range s.procs {
+		_ = syscall.Kill(-p.Pid, sig)
+	}
+	return len(s.procs)
+}
+
+// removeOnExit returns a function that removes path. Until that function is
+// called, path is also removed if a shutdown has to exit before the run
+// cleans up, so credentials don't outlive an interrupted run.
+func removeOnExit(path string) func() {
+	shutdown.mu.Lock()
+	shutdown.paths[path] = true
+	shutdown.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			shutdown.mu.Lock()
+			delete(shutdown.paths, path)
+			shutdown.mu.Unlock()
+			os.RemoveAll(path)
+		})
+	}
+}
+
+// handleShutdown handles SIGINT and SIGTERM for the whole process. The first
+// signal is forwarded to rclone, which stops its transfers and exits, so that
+// the run ends through its usual cleanup: temporary files are removed, the
+// lock is released and the summary reports the run as interrupted. rclone
+// is killed if it is still running after SHUTDOWN_GRACE, or at a second
+// signal; if the cleanup then doesn't finish within shutdownCleanupTimeout,
+// the temporary files are removed and shutdown.forced tells main to exit.
+// The returned function stops handling signals at the end of the run, once
+// the handler has returned, and forgets the signal.
+func handleShutdown(config *Config) func() {
+	grace, _ := time.ParseDuration(config.ShutdownGrace)
+	shutdown.reset()
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		var sig os.Signal
+		select {
+		case sig = <-signals:
+		case <-stop:
+			return
+		}
+		shutdown.mu.Lock()
+		shutdown.sig = sig
+		close(shutdown.done)
+		shutdown.mu.Unlock()
+		logger := setupLogger(config)
+
+		if n := shutdown.signalAll(sig.(syscall.Signal)); n > 0 {
+			logger.WithFields(logrus.Fields{
+				"signal":         sig.String(),
+				"grace":          grace.String(),
+				"rclone_running": n,
+			}).Warn("Received a signal, stopping rclone")
+		}
+		select {
+		case <-time.After(grace):
+		case <-signals:
+		case <-stop:
+			return
+		}
+		if n := shutdown.signalAll(syscall.SIGKILL); n > 0 {
+			logger.WithField("rclone_running", n).Warn("rclone did not stop within SHUTDOWN_GRACE, killed it")
+		}
+
+		select {
+		case <-time.After(shutdownCleanupTimeout):
+		case <-signals:
+		case <-stop:
+			return
+		}
+		shutdown.mu.Lock()
+		for path := range shutdown.paths {
+			os.RemoveAll(path)
+		}
+		shutdown.mu.Unlock()
+		fmt.Fprintf(os.Stderr, "Received %s, cleanup did not finish in time, removed temporary files and exiting\n", sig)
+		select {
+		case shutdown.forced <- exitInterrupted:
+		default:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(stop)
+			<-stopped
+			shutdown.reset()
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestInterruptedExitCode(t *testing.T) {
+	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM} {
+		if code := exitCode(&interruptedError{sig: sig}); code != 7 {
+			t.Errorf("exit code for %s = %d, want 7", sig, code)
+		}
+	}
+}
+
+// signalWhen sends SIGTERM to the test process once ready reports true,
+// polling it until then.
+func signalWhen(t *testing.T, ready func() bool) {
+	t.Helper()
+	go func() {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if ready() {
+				_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+				return
+			}
+		}
+		t.Error("gave up waiting to send SIGTERM")
+	}()
+}
+
+// slowRclone fakes an rclone whose sync runs until it is stopped.
+func slowRclone(t *testing.T) (path, calls string) {
+	return fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = sync ] && sleep 30
+exit 0`)
+}
+
+// syncing reports whether the fake rclone recorded a sync in calls.
+func syncing(calls string) func() bool {
+	return func() bool {
+		data, _ := os.ReadFile(calls)
+		return strings.Contains(string(data), "sync ")
+	}
+}
+
+func TestRunInterrupted(t *testing.T) {
+	path, calls := slowRclone(t)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SHUTDOWN_GRACE": "5s"}))
+	signalWhen(t, syncing(calls))
+	start := time.Now()
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 7 {
+		t.Fatalf("run = %d, want 7:\n%s", result.code, out)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("run took %v, want rclone stopped at the signal", elapsed)
+	}
+	summaries := readSummaries(t, out)
+	if len(summaries) != 1 || summaries[0].Result != "interrupted" || summaries[0].ErrorClass != "interrupted" || summaries[0].ExitCode != 7 {
+		t.Errorf("summaries %+v, want one interrupted run", summaries)
+	}
+}
+
+func TestRunScheduled(t *testing.T) {
+	t.Run("interrupted", func(t *testing.T) {
+		path, calls := slowRclone(t)
+		setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SCHEDULE": "1h"}))
+		signalWhen(t, syncing(calls))
+		var result runResult
+		out := captureOutput(t, func() { result, _ = run(nil) })
+		if result.code != 7 {
+			t.Errorf("run = %d, want 7 with the sync in progress interrupted:\n%s", result.code, out)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+		setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SCHEDULE": "1h"}))
+		var result runResult
+		out := captureOutput(t, func() {
+			// Stop the scheduler once the first sync is done.
+			output := os.Stdout.Name()
+			signalWhen(t, func() bool {
+				data, _ := os.ReadFile(output)
+				return strings.Contains(string(data), "Scheduled sync finished")
+			})
+			result, _ = run(nil)
+		})
+		if result.code != 0 {
+			t.Errorf("run = %d, want 0 for a stop between runs:\n%s", result.code, out)
+		}
+		if !synced(readCalls(t, calls)) {
+			t.Error("the first sync didn't run at the start")
+		}
+	})
+}
+
+func TestShutdownForced(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"SHUTDOWN_GRACE": "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "rclone-config")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	defer removeOnExit(dir)()
+
+	// The second signal skips SHUTDOWN_GRACE and the third the wait for the
+	// cleanup, which never comes.
+	out := captureOutput(t, func() {
+		defer handleShutdown(config)()
+		if shutdown.err() != nil {
+			t.Fatalf("shutdown.err() = %v before any signal", shutdown.err())
+		}
+		for i := 0; i < 3; i++ {
+			_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+			time.Sleep(50 * time.Millisecond)
+		}
+		select {
+		case code := <-shutdown.forced:
+			if code != 7 {
+				t.Errorf("forced exit code %d, want 7", code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the shutdown didn't give up on the cleanup")
+		}
+	})
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("%s not removed: %v", dir, err)
+	}
+	if !strings.Contains(out, "cleanup did not finish in time") {
+		t.Errorf("output %q, want the forced exit explained", out)
+	}
+	if shutdown.err() != nil {
+		t.Errorf("shutdown.err() = %v after the handler stopped", shutdown.err())
+	}
+}
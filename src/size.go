@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseSize parses a human-readable size the way rclone does: a non-negative
+// number with an optional binary suffix (b, k, m, g, t, p, optionally written
+// as KiB etc). A bare number is taken as KiB, matching rclone.
+func parseSize(value string) (int64, error) {
+	s := strings.TrimSpace(value)
+	if s == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	lower := strings.ToLower(s)
+	if strings.HasSuffix(lower, "ib") && len(lower) > 3 {
+		lower = lower[:len(lower)-2]
+	}
+
+	multiplier := float64(1 << 10)
+	switch suffix := lower[len(lower)-1]; suffix {
+	case 'b':
+		multiplier = 1
+	case 'k':
+		multiplier = 1 << 10
+	case 'm':
+		multiplier = 1 << 20
+	case 'g':
+		multiplier = 1 << 30
+	case 't':
+		multiplier = 1 << 40
+	case 'p':
+		multiplier = 1 << 50
+	default:
+		if (suffix < '0' || suffix > '9') && suffix != '.' {
+			return 0, fmt.Errorf("size %q has an unknown suffix %q", value, string(s[len(s)-1]))
+		}
+		lower += "k"
+	}
+
+	number, err := strconv.ParseFloat(lower[:len(lower)-1], 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("size %q is not a non-negative number with an optional b/k/m/g/t/p suffix", value)
+	}
+
+	return int64(number * multiplier), nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  int64
+		err   string
+	}{
+		{"100b", 100, ""},
+		{"100B", 100, ""},
+		{"1k", 1 << 10, ""},
+		{"10", 10 << 10, ""},
+		{"1.5M", 3 << 19, ""},
+		{"2G", 2 << 30, ""},
+		{"1GiB", 1 << 30, ""},
+		{"1t", 1 << 40, ""},
+		{"1P", 1 << 50, ""},
+		{" 5m ", 5 << 20, ""},
+		{"", 0, "empty size"},
+		{"5x", 0, `size "5x" has an unknown suffix "x"`},
+		{"-5M", 0, `size "-5M" is not a non-negative number`},
+		{"M", 0, `size "M" is not a non-negative number`},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSize(tt.value)
+			wantError(t, err, tt.err)
+			if got != tt.want {
+				t.Errorf("parseSize = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
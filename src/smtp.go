@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smtpTLSModes are the SMTP_TLS values: STARTTLS after connecting, TLS from
+// the start (SMTPS, usually port 465), or no encryption.
+var smtpTLSModes = []string{"starttls", "tls", "none"}
+
+// smtpTimeout bounds a whole mail delivery, connecting included.
+const smtpTimeout = 30 * time.Second
+
+func validateSMTP(config *Config) error {
+	if config.SMTPHost == "" {
+		for key, set := range map[string]bool{
+			"SMTP_TO":       len(config.SMTPTo) > 0,
+			"SMTP_USERNAME": config.SMTPUsername != "",
+			"SMTP_PASSWORD": config.SMTPPassword != "",
+		} {
+			if set {
+				return fmt.Errorf("%s requires SMTP_HOST", key)
+			}
+		}
+		return nil
+	}
+	if !contains(smtpTLSModes, config.SMTPTLS) {
+		return fmt.Errorf("invalid SMTP_TLS %q: must be one of %s", config.SMTPTLS, strings.Join(smtpTLSModes, ", "))
+	}
+	if config.SMTPPort < 0 || config.SMTPPort > 65535 {
+		return fmt.Errorf("invalid SMTP_PORT %d", config.SMTPPort)
+	}
+	if (config.SMTPUsername == "") != (config.SMTPPassword == "") {
+		return fmt.Errorf("SMTP_USERNAME and SMTP_PASSWORD must be set together")
+	}
+	// Go's PLAIN authentication refuses to send the password unencrypted,
+	// except to localhost; say so now rather than after the first run.
+	if config.SMTPTLS == "none" && config.SMTPUsername != "" && !isLocalhost(config.SMTPHost) {
+		return fmt.Errorf("SMTP_USERNAME requires SMTP_TLS=starttls or tls, the password is not sent unencrypted")
+	}
+	if _, err := mail.ParseAddress(config.SMTPFrom); err != nil {
+		return fmt.Errorf("invalid SMTP_FROM %q: %w", config.SMTPFrom, err)
+	}
+	if len(config.SMTPTo) == 0 {
+		return fmt.Errorf("SMTP_HOST requires SMTP_TO, the recipients of the notifications")
+	}
+	for _, to := range config.SMTPTo {
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("invalid SMTP_TO address %q: %w", to, err)
+		}
+	}
+	return nil
+}
+
+func isLocalhost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// smtpPort returns SMTP_PORT, or the usual port of SMTP_TLS.
+func smtpPort(config *Config) int {
+	switch {
+	case config.SMTPPort != 0:
+		return config.SMTPPort
+	case config.SMTPTLS == "tls":
+		return 465
+	case config.SMTPTLS == "none":
+		return 25
+	}
+	return 587
+}
+
+// sendMail mails the run summary to SMTP_TO: a plain-text description, with
+// the JSON summary attached. Errors name the step of the conversation that
+// failed and the server's answer, never the password.
+func sendMail(config *Config, report *runSummary) error {
+	message, err := mailMessage(config, report)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(config.SMTPHost, strconv.Itoa(smtpPort(config)))
+	tlsConfig := &tls.Config{ServerName: config.SMTPHost}
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	var conn net.Conn
+	if config.SMTPTLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(smtpTimeout))
+	client, err := smtp.NewClient(conn, config.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP greeting from %s failed: %w", addr, err)
+	}
+	defer client.Close()
+
+	if config.SMTPTLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not offer STARTTLS; use SMTP_TLS=tls for implicit TLS or SMTP_TLS=none", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS with %s failed: %w", addr, err)
+		}
+	}
+	if config.SMTPUsername != "" {
+		if ok, mechanisms := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("%s does not offer authentication; unset SMTP_USERNAME", addr)
+		} else if !strings.Contains(" "+strings.ToUpper(mechanisms)+" ", " PLAIN ") {
+			return fmt.Errorf("%s does not offer PLAIN authentication, only %s", addr, mechanisms)
+		}
+		auth := smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, config.SMTPHost)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("SMTP authentication as %s failed: %w", config.SMTPUsername, err)
+		}
+	}
+	from, _ := mail.ParseAddress(config.SMTPFrom)
+	if err := client.Mail(from.Address); err != nil {
+		return fmt.Errorf("SMTP server rejected the sender %s: %w", from.Address, err)
+	}
+	for _, to := range config.SMTPTo {
+		rcpt, _ := mail.ParseAddress(to)
+		if err := client.Rcpt(rcpt.Address); err != nil {
+			return fmt.Errorf("SMTP server rejected the recipient %s: %w", rcpt.Address, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP server refused the message: %w", err)
+	}
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("failed to send the message: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("SMTP server refused the message: %w", err)
+	}
+	return client.Quit()
+}
+
+// mailMessage builds the notification mail: a multipart message with the
+// text from notificationText and the summary as summary.json.
+func mailMessage(config *Config, report *runSummary) ([]byte, error) {
+	summary, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	boundary := "s3-sync-" + hex.EncodeToString(b)
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	var msg bytes.Buffer
+	header := func(name, value string) { fmt.Fprintf(&msg, "%s: %s\r\n", name, value) }
+	header("From", config.SMTPFrom)
+	header("To", strings.Join(config.SMTPTo, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", notificationTitle(report)))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@%s>", newRunID(), hostname))
+	header("MIME-Version", "1.0")
+	header("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%q", boundary))
+	msg.WriteString("\r\n")
+
+	fmt.Fprintf(&msg, "--%s\r\n", boundary)
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "8bit")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(notificationText(report), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	fmt.Fprintf(&msg, "--%s\r\n", boundary)
+	header("Content-Type", `application/json; name="summary.json"`)
+	header("Content-Disposition", `attachment; filename="summary.json"`)
+	header("Content-Transfer-Encoding", "base64")
+	msg.WriteString("\r\n")
+	encoded := base64.StdEncoding.EncodeToString(summary)
+	for len(encoded) > 76 {
+		msg.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	msg.WriteString(encoded + "\r\n")
+	fmt.Fprintf(&msg, "--%s--\r\n", boundary)
+	return msg.Bytes(), nil
+}
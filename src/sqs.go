@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// sqsMaxWait is the longest long poll SQS allows.
+	sqsMaxWait = 20 * time.Second
+	// sqsMaxVisibility is the SQS limit on the visibility timeout.
+	sqsMaxVisibility = 12 * time.Hour
+	// maxBatchMessages caps the messages collected into one batch, so a
+	// busy queue doesn't keep a batch open past its window.
+	maxBatchMessages = 1000
+)
+
+// sqsRegionPatterns extract the region from AWS queue URLs, current and
+// legacy style.
+var sqsRegionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^sqs\.([a-z0-9-]+)\.amazonaws\.com`),
+	regexp.MustCompile(`^([a-z0-9-]+)\.queue\.amazonaws\.com`),
+}
+
+// sqsRegion returns SQS_REGION, else the region in the queue URL, else
+// SOURCE_REGION.
+func sqsRegion(config *Config) string {
+	if config.SQSRegion != "" {
+		return config.SQSRegion
+	}
+	if u, err := url.Parse(config.SQSQueueURL); err == nil {
+		for _, p := range sqsRegionPatterns {
+			if m := p.FindStringSubmatch(u.Hostname()); m != nil {
+				return m[1]
+			}
+		}
+	}
+	return config.Source.Region
+}
+
+func validateEvents(config *Config) error {
+	if config.SQSQueueURL == "" {
+		return nil
+	}
+	u, err := url.Parse(config.SQSQueueURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid SQS_QUEUE_URL %q: must look like https://sqs.<region>.amazonaws.com/<account>/<queue>", config.SQSQueueURL)
+	}
+	if sqsRegion(config) == "" {
+		return fmt.Errorf("SQS_REGION is required: it can't be derived from SQS_QUEUE_URL or SOURCE_REGION")
+	}
+	// Without keys of its own, SQS shares the credentials of SOURCE_AUTH=env|iam
+	// or SOURCE_ROLE_ARN.
+	sourceAuth := config.SQSAccessKey == "" && config.SQSSecretKey == "" && (config.Source.Auth != "static" || config.Source.RoleARN != "")
+	if !sourceAuth && (config.SQSAccessKey == "" || config.SQSSecretKey == "") {
+		return fmt.Errorf("SQS_ACCESS_KEY and SQS_SECRET_KEY are required with SQS_QUEUE_URL (default: the source credentials)")
+	}
+	window, err := time.ParseDuration(config.SQSBatchWindow)
+	if err != nil || window < 0 {
+		return fmt.Errorf("invalid SQS_BATCH_WINDOW %q: must be a duration like 30s or 2m", config.SQSBatchWindow)
+	}
+	visibility, err := time.ParseDuration(config.SQSVisibilityTimeout)
+	if err != nil || visibility < time.Second || visibility > sqsMaxVisibility {
+		return fmt.Errorf("invalid SQS_VISIBILITY_TIMEOUT %q: must be a duration between 1s and 12h", config.SQSVisibilityTimeout)
+	}
+	if visibility <= window {
+		return fmt.Errorf("SQS_VISIBILITY_TIMEOUT (%s) must be longer than SQS_BATCH_WINDOW (%s), "+
+			"otherwise messages are delivered again while their batch is still open", config.SQSVisibilityTimeout, config.SQSBatchWindow)
+	}
+	switch {
+	case config.FilesFrom != "":
+		return fmt.Errorf("SQS_QUEUE_URL and FILES_FROM both select the keys to sync; use only one")
+	case config.VerifyOnly:
+		return fmt.Errorf("VERIFY_ONLY can't be combined with SQS_QUEUE_URL")
+	}
+	return nil
+}
+
+// sqsClient receives and deletes messages of one queue through the SQS
+// query API.
+type sqsClient struct {
+	queueURL string
+	region   string
+	creds    credentialProvider
+	client   *http.Client
+}
+
+func newSQSClient(config *Config) *sqsClient {
+	var creds credentialProvider = staticCredentials{accessKey: config.SQSAccessKey, secretKey: config.SQSSecretKey}
+	if config.SQSAccessKey == "" {
+		// The source's credentials from the environment or a role.
+		creds = config.Source.credentials
+	}
+	return &sqsClient{
+		queueURL: config.SQSQueueURL,
+		region:   sqsRegion(config),
+		creds:    creds,
+		// Long polls take up to sqsMaxWait.
+		client: &http.Client{Timeout: sqsMaxWait + 30*time.Second},
+	}
+}
+
+type sqsMessage struct {
+	ID            string `xml:"MessageId"`
+	ReceiptHandle string `xml:"ReceiptHandle"`
+	Body          string `xml:"Body"`
+}
+
+// call posts action with params to the queue and decodes the XML response
+// into out.
+func (c *sqsClient) call(ctx context.Context, action string, params url.Values, out interface{}) error {
+	params.Set("Action", action)
+	params.Set("Version", "2012-11-05")
+	body := []byte(params.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.queueURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	creds, err := c.creds.retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("SQS %s failed: %w", action, err)
+	}
+	signV4(req, body, "sqs", c.region, creds, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("SQS %s failed: %w", action, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return fmt.Errorf("SQS %s failed: %w", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.Unmarshal(data, &failure) == nil && failure.Code != "" {
+			return fmt.Errorf("SQS %s failed: %s: %s", action, failure.Code, failure.Message)
+		}
+		return fmt.Errorf("SQS %s failed: HTTP %s", action, resp.Status)
+	}
+	if err := xml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("SQS %s returned an unreadable response: %w", action, err)
+	}
+	return nil
+}
+
+// receive long-polls for up to wait and hides the messages it returns for
+// visibility.
+func (c *sqsClient) receive(ctx context.Context, wait, visibility time.Duration) ([]sqsMessage, error) {
+	var resp struct {
+		Messages []sqsMessage `xml:"ReceiveMessageResult>Message"`
+	}
+	err := c.call(ctx, "ReceiveMessage", url.Values{
+		"MaxNumberOfMessages": {"10"},
+		"WaitTimeSeconds":     {strconv.Itoa(int((wait + time.Second - 1) / time.Second))},
+		"VisibilityTimeout":   {strconv.Itoa(int(visibility / time.Second))},
+	}, &resp)
+	return resp.Messages, err
+}
+
+// delete removes messages from the queue, ten per request. Messages that
+// could not be deleted are delivered again later, which is harmless as
+// applying an event twice gives the same result.
+func (c *sqsClient) delete(ctx context.Context, messages []sqsMessage) error {
+	var errs []error
+	for start := 0; start < len(messages); start += 10 {
+		params := url.Values{}
+		for i, m := range messages[start:min(start+10, len(messages))] {
+			prefix := fmt.Sprintf("DeleteMessageBatchRequestEntry.%d.", i+1)
+			params.Set(prefix+"Id", strconv.Itoa(i))
+			params.Set(prefix+"ReceiptHandle", m.ReceiptHandle)
+		}
+		var resp struct {
+			Failed []struct {
+				Code    string `xml:"Code"`
+				Message string `xml:"Message"`
+			} `xml:"DeleteMessageBatchResult>BatchResultErrorEntry"`
+		}
+		if err := c.call(ctx, "DeleteMessageBatch", params, &resp); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, f := range resp.Failed {
+			errs = append(errs, fmt.Errorf("SQS DeleteMessageBatch failed for a message: %s: %s", f.Code, f.Message))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// s3Event is an S3 event notification, as delivered to SQS directly or
+// wrapped in an SNS notification.
+type s3Event struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+	Event   string `json:"Event"`
+	Records []struct {
+		EventName string `json:"eventName"`
+		EventTime string `json:"eventTime"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key       string `json:"key"`
+				Sequencer string `json:"sequencer"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// objectChange is the latest event seen for one source key.
+type objectChange struct {
+	bucket    string
+	key       string
+	removed   bool
+	eventTime string
+	sequencer string
+}
+
+// after reports whether c happened after o. S3 orders the events of a key
+// by sequencer, a hex number whose string may vary in length.
+func (c objectChange) after(o objectChange) bool {
+	if c.sequencer != "" && o.sequencer != "" {
+		width := max(len(c.sequencer), len(o.sequencer))
+		pad := func(s string) string { return strings.Repeat("0", width-len(s)) + strings.ToUpper(s) }
+		return pad(c.sequencer) >= pad(o.sequencer)
+	}
+	return c.eventTime >= o.eventTime
+}
+
+// parseS3Event returns the object changes in an SQS message body. The test
+// event S3 sends when notifications are configured yields no changes; a body
+// that isn't an S3 event is an error.
+func parseS3Event(body string) ([]objectChange, error) {
+	var event s3Event
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return nil, fmt.Errorf("not JSON: %w", err)
+	}
+	if event.Type == "Notification" && event.Message != "" {
+		return parseS3Event(event.Message)
+	}
+	if event.Event == "s3:TestEvent" {
+		return nil, nil
+	}
+	if len(event.Records) == 0 {
+		return nil, fmt.Errorf("no Records in the message")
+	}
+	var changes []objectChange
+	for _, r := range event.Records {
+		var removed bool
+		switch {
+		case strings.HasPrefix(r.EventName, "ObjectCreated:"):
+		case strings.HasPrefix(r.EventName, "ObjectRemoved:"), strings.HasPrefix(r.EventName, "LifecycleExpiration:"):
+			removed = true
+		case r.EventName == "":
+			return nil, fmt.Errorf("record without eventName")
+		default:
+			continue
+		}
+		// Keys are URL-encoded, with spaces as "+".
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil || key == "" || r.S3.Bucket.Name == "" {
+			return nil, fmt.Errorf("record without a valid bucket and key")
+		}
+		changes = append(changes, objectChange{
+			bucket:    r.S3.Bucket.Name,
+			key:       key,
+			removed:   removed,
+			eventTime: r.EventTime,
+			sequencer: r.S3.Object.Sequencer,
+		})
+	}
+	return changes, nil
+}
+
+// eventBatch collects the changes of the messages received within one
+// SQS_BATCH_WINDOW, keyed by path relative to the source prefix.
+type eventBatch struct {
+	messages []sqsMessage
+	changes  map[string]objectChange
+	ignored  int
+}
+
+// add records the changes of message m. Malformed messages are logged as
+// dead letters and dropped with the batch, so they don't come back forever.
+func (b *eventBatch) add(config *Config, m sqsMessage, logger *logrus.Logger) {
+	b.messages = append(b.messages, m)
+	changes, err := parseS3Event(m.Body)
+	if err != nil {
+		body := m.Body
+		if len(body) > 1024 {
+			body = body[:1024] + "..."
+		}
+		logger.WithFields(logrus.Fields{
+			"message_id":  m.ID,
+			"body":        body,
+			"dead_letter": true,
+		}).WithError(err).Error("Dropping malformed SQS message")
+		return
+	}
+	for _, c := range changes {
+		rel, ok := relativeKey(config.Source, c)
+		if !ok {
+			b.ignored++
+			continue
+		}
+		if prev, seen := b.changes[rel]; !seen || c.after(prev) {
+			b.changes[rel] = c
+		}
+	}
+}
+
+// relativeKey returns the key of c relative to the source prefix, and false
+// for changes outside the source or to folder markers.
+func relativeKey(source RemoteConfig, c objectChange) (string, bool) {
+	if c.bucket != source.Bucket || strings.HasSuffix(c.key, "/") {
+		return "", false
+	}
+	if source.Prefix == "" {
+		return c.key, true
+	}
+	return strings.CutPrefix(c.key, source.Prefix+"/")
+}
+
+// split returns the created and the removed keys, sorted.
+func (b *eventBatch) split() (created, removed []string) {
+	for key, c := range b.changes {
+		if c.removed {
+			removed = append(removed, key)
+		} else {
+			created = append(created, key)
+		}
+	}
+	sort.Strings(created)
+	sort.Strings(removed)
+	return created, removed
+}
+
+// receiveBatch long-polls until the first messages arrive, then keeps
+// collecting until SQS_BATCH_WINDOW has passed. It returns no messages if a
+// poll came back empty, so the caller can check its schedule.
+func receiveBatch(ctx context.Context, config *Config, client *sqsClient, logger *logrus.Logger) ([]sqsMessage, error) {
+	window, _ := time.ParseDuration(config.SQSBatchWindow)
+	visibility, _ := time.ParseDuration(config.SQSVisibilityTimeout)
+	var messages []sqsMessage
+	var deadline time.Time
+	for len(messages) < maxBatchMessages {
+		wait := sqsMaxWait
+		if !deadline.IsZero() {
+			if wait = min(wait, time.Until(deadline)); wait <= 0 {
+				break
+			}
+		}
+		received, err := client.receive(ctx, wait, visibility)
+		if err != nil {
+			if len(messages) == 0 {
+				return nil, err
+			}
+			// Apply what was collected; the rest stays on the queue.
+			if ctx.Err() == nil {
+				logger.WithError(err).Warn("Receiving SQS messages failed, closing the batch early")
+			}
+			break
+		}
+		if deadline.IsZero() {
+			if len(received) == 0 {
+				return nil, nil
+			}
+			deadline = time.Now().Add(window)
+		}
+		messages = append(messages, received...)
+	}
+	return messages, nil
+}
+
+// eventDeleteBlocker returns why removed events can't be applied under the
+// delete safety settings, or "" if they can.
+func eventDeleteBlocker(config *Config) string {
+	switch {
+	case config.SyncMode != "sync":
+		return "SYNC_MODE=" + config.SyncMode + " never deletes from the destination"
+	case config.DeleteStrategy == "none":
+		return "deletions are disabled (DELETE_STRATEGY=none or DELETE_DISABLED=true)"
+	case config.BackupDir != "" || config.BackupSuffix != "":
+		return "rclone delete keeps no backup; with BACKUP_DIR or BACKUP_SUFFIX deletions are left to the full sync"
+	}
+	return ""
+}
+
+// applyBatch copies the created keys and deletes the removed ones from the
+// destination, returning the combined stats. An error means the batch has to
+// be retried as a whole.
+func applyBatch(config *Config, remotes *rcloneRemotes, batch *eventBatch, logger *logrus.Logger) (RunStats, error) {
+	created, removed := batch.split()
+	fields := logrus.Fields{
+		"messages": len(batch.messages),
+		"created":  len(created),
+		"removed":  len(removed),
+		"ignored":  batch.ignored,
+	}
+	logger.WithFields(fields).Info("Applying event batch")
+
+	var stats RunStats
+	if len(created) > 0 {
+		copied, err := copyKeys(config, remotes, created, logger)
+		stats.add(copied)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	if len(removed) > 0 {
+		if reason := eventDeleteBlocker(config); reason != "" {
+			logger.WithFields(logrus.Fields{"removed": len(removed), "reason": reason}).Info("Not applying removed events")
+		} else {
+			deleted, err := deleteKeys(config, remotes, removed, logger)
+			if err != nil {
+				return stats, err
+			}
+			stats.Deletes += int64(deleted)
+			fields["deleted"] = deleted
+		}
+	}
+	logger.WithFields(fields).Info("Event batch applied")
+	return stats, nil
+}
+
+// copyKeys runs a targeted copy of keys. SYNC_MODE=sync becomes a copy, as
+// sync with a key list would only consider those keys anyway and deletions
+// are handled separately.
+func copyKeys(config *Config, remotes *rcloneRemotes, keys []string, logger *logrus.Logger) (RunStats, error) {
+	path, cleanup, err := writePrivateFile(config, "rclone-files-from-", "files-from.txt", keys)
+	if err != nil {
+		return RunStats{}, &classError{class: "setup", err: err}
+	}
+	defer cleanup()
+
+	targeted := *config
+	if targeted.SyncMode == "sync" {
+		targeted.SyncMode = "copy"
+	}
+	targeted.filesFromFile = path
+	targeted.filesFromKeys = len(keys)
+	return runSync(&targeted, remotes, logger)
+}
+
+// deleteKeys deletes removed keys from the destination, skipping those that
+// exist in the source again, e.g. because the removal is an old event
+// delivered late. rclone delete with a key list is used instead of one
+// deletefile per key so that filters and MAX_DELETE apply as in a full sync.
+func deleteKeys(config *Config, remotes *rcloneRemotes, keys []string, logger *logrus.Logger) (int, error) {
+	path, cleanup, err := writePrivateFile(config, "rclone-files-from-", "files-from.txt", keys)
+	if err != nil {
+		return 0, &classError{class: "setup", err: err}
+	}
+	defer cleanup()
+
+	existing, err := listKeys(config, remotes, remotePath("source", config.Source.Bucket, config.Source.Prefix), path)
+	if err != nil {
+		return 0, err
+	}
+	var gone []string
+	for _, key := range keys {
+		if !existing[key] {
+			gone = append(gone, key)
+		}
+	}
+	if skipped := len(keys) - len(gone); skipped > 0 {
+		logger.WithField("keys", skipped).Info("Skipping removed events for keys that exist in the source")
+	}
+	if len(gone) == 0 {
+		return 0, nil
+	}
+	if config.MaxDelete >= 0 && len(gone) > config.MaxDelete {
+		return 0, fmt.Errorf("event batch would delete %d objects, more than MAX_DELETE=%d", len(gone), config.MaxDelete)
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(gone, "\n")+"\n"), 0600); err != nil {
+		return 0, &classError{class: "setup", err: fmt.Errorf("failed to write files-from.txt: %w", err)}
+	}
+
+	targeted := *config
+	targeted.filesFromFile = path
+	args := []string{
+		"delete",
+		remotePath("dest", config.Dest.Bucket, config.Dest.Prefix),
+		"--retries", strconv.Itoa(config.Retries),
+	}
+	if config.DryRun {
+		args = append(args, "--dry-run")
+	}
+	if config.MaxDelete >= 0 {
+		args = append(args, "--max-delete", strconv.Itoa(config.MaxDelete))
+	}
+	args = append(args, keyMatchingArgs(config)...)
+	args = append(args, filterArgs(&targeted)...)
+	args = append(args, tpsArgs(config)...)
+	args = append(args, config.RcloneExtraArgs...)
+	logger.WithFields(logrus.Fields{"args": args, "keys": len(gone)}).Info("Deleting removed objects from the destination")
+
+	stderr := newLineTail(100)
+	cmd := remotes.command(config, args...)
+	cmd.Stdout = scrubWriter{os.Stdout}
+	cmd.Stderr = io.MultiWriter(logOutput(), stderr)
+	if err := shutdown.run(cmd); err != nil {
+		return 0, fmt.Errorf("rclone delete failed: %w: %s", err, lastLine(strings.Join(stderr.Lines(), "\n")))
+	}
+	return len(gone), nil
+}
+
+// listKeys returns which keys of the list in path exist under remote.
+func listKeys(config *Config, remotes *rcloneRemotes, remote, path string) (map[string]bool, error) {
+	args := append([]string{"lsf", remote, "--files-only", "--files-from-raw", path}, keyMatchingArgs(config)...)
+	var stderr bytes.Buffer
+	cmd := remotes.command(config, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w: %s", remote, err, lastLine(strings.TrimSpace(stderr.String())))
+	}
+	keys := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		if line != "" {
+			keys[line] = true
+		}
+	}
+	return keys, nil
+}
+
+// runEvents consumes S3 event notifications from SQS_QUEUE_URL until SIGINT
+// or SIGTERM, applying each batch of changes with a targeted copy and
+// deletion. Messages are deleted from the queue only once their batch was
+// applied; after a failure SQS delivers them again. With SCHEDULE, a full
+// sync also runs between batches as a consistency backstop.
+func runEvents(configs []*Config) int {
+	config := configs[0]
+	logger := setupLogger(config)
+	logger.WithFields(logrus.Fields(redactConfig(config))).Info("Effective configuration")
+	for _, warning := range config.warnings {
+		logger.Warn(warning)
+	}
+
+	if _, err := checkRcloneVersion(config); err != nil {
+		logger.WithError(err).Error("rclone preflight check failed")
+		return 1
+	}
+	remotes, cleanup, err := setupRemotes(config)
+	if err != nil {
+		logger.WithError(err).Error("Failed to create rclone config")
+		return 1
+	}
+	defer cleanup()
+	filterFile, removeFilterFile, err := writeFilterFile(config)
+	if err != nil {
+		logger.WithError(err).Error("Failed to write filter file")
+		return 1
+	}
+	defer removeFilterFile()
+	config.filterFile = filterFile
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var sched schedule
+	var nextFull time.Time
+	if config.Schedule != "" {
+		sched, _ = parseSchedule(config.Schedule)
+		if _, ok := sched.(intervalSchedule); ok {
+			nextFull = time.Now()
+		} else {
+			nextFull = sched.next(time.Now())
+		}
+	}
+
+	client := newSQSClient(config)
+	logger.WithFields(logrus.Fields{
+		"queue":        config.SQSQueueURL,
+		"batch_window": config.SQSBatchWindow,
+	}).Info("Waiting for S3 events")
+	for ctx.Err() == nil {
+		if sched != nil && !time.Now().Before(nextFull) {
+			logger.Info("Running the scheduled full sync")
+			code := runOnce(configs)
+			nextFull = sched.next(time.Now())
+			logger.WithFields(logrus.Fields{
+				"exit_code": code,
+				"next_run":  nextFull.Format(time.RFC3339),
+			}).Info("Scheduled full sync finished")
+			continue
+		}
+
+		messages, err := receiveBatch(ctx, config, client, logger)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logger.WithError(err).Error("Failed to receive SQS messages, retrying in 10s")
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+		if len(messages) == 0 {
+			continue
+		}
+
+		batch := &eventBatch{changes: make(map[string]objectChange)}
+		for _, m := range messages {
+			batch.add(config, m, logger)
+		}
+		start := time.Now()
+		summary := newRunSummary(config, start)
+		if err := resetSummaryFile(config); err != nil {
+			logger.WithError(err).Warn("Run summaries will be appended to the previous ones")
+		}
+		stats, err := applyBatch(config, remotes, batch, logger)
+		metrics.record(config, err, time.Since(start), stats)
+		summary.finish(err, stats)
+		writeSummary(config, summary, logger)
+		if err != nil {
+			logger.WithError(err).WithField("error_class", errorClass(err)).
+				Error("Event batch failed, its messages will be delivered again after SQS_VISIBILITY_TIMEOUT")
+			continue
+		}
+		if config.DryRun {
+			logger.Info("DRY_RUN is set, leaving the messages on the queue")
+			continue
+		}
+		// Delete even when stopping: the batch has been applied.
+		if err := client.delete(context.Background(), batch.messages); err != nil {
+			logger.WithError(err).Warn("Failed to delete SQS messages, they will be applied again")
+		}
+	}
+	logger.Info("Stopped waiting for S3 events")
+	return 0
+}
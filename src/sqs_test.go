@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sqsEnv is a valid SQS_QUEUE_URL configuration with keys of its own.
+var sqsEnv = map[string]string{
+	"SQS_QUEUE_URL":  "https://sqs.eu-west-1.amazonaws.com/123456789012/media-events",
+	"SQS_ACCESS_KEY": "sqs-access",
+	"SQS_SECRET_KEY": "sqs-secret",
+}
+
+// withSQS returns sqsEnv with overrides applied.
+func withSQS(overrides map[string]string) map[string]string {
+	env := make(map[string]string, len(sqsEnv)+len(overrides))
+	for k, v := range sqsEnv {
+		env[k] = v
+	}
+	for k, v := range overrides {
+		env[k] = v
+	}
+	return env
+}
+
+func TestValidateEvents(t *testing.T) {
+	config, err := loadTestConfig(t, sqsEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region := sqsRegion(config); region != "eu-west-1" {
+		t.Errorf("sqsRegion = %q, want the region of the queue URL", region)
+	}
+
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"SQS_QUEUE_URL": "sqs.eu-west-1.amazonaws.com/queue"}, "invalid SQS_QUEUE_URL"},
+		{map[string]string{"SQS_QUEUE_URL": "http://elasticmq:9324/queue/events"}, "SQS_REGION is required"},
+		{map[string]string{"SQS_SECRET_KEY": ""}, "SQS_ACCESS_KEY and SQS_SECRET_KEY are required with SQS_QUEUE_URL"},
+		{map[string]string{"SQS_BATCH_WINDOW": "soon"}, `invalid SQS_BATCH_WINDOW "soon"`},
+		{map[string]string{"SQS_VISIBILITY_TIMEOUT": "13h"}, `invalid SQS_VISIBILITY_TIMEOUT "13h"`},
+		{map[string]string{"SQS_BATCH_WINDOW": "5m", "SQS_VISIBILITY_TIMEOUT": "1m"}, "SQS_VISIBILITY_TIMEOUT (1m) must be longer than SQS_BATCH_WINDOW (5m)"},
+		{map[string]string{"VERIFY_ONLY": "true"}, "VERIFY_ONLY can't be combined with SQS_QUEUE_URL"},
+	} {
+		_, err := loadTestConfig(t, withSQS(tt.env))
+		wantError(t, err, tt.want)
+	}
+
+	config, err = loadTestConfig(t, withSQS(map[string]string{"SQS_QUEUE_URL": "http://elasticmq:9324/queue/events", "SQS_REGION": "local"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region := sqsRegion(config); region != "local" {
+		t.Errorf("sqsRegion = %q, want SQS_REGION", region)
+	}
+}
+
+func TestParseS3Event(t *testing.T) {
+	changes, err := parseS3Event(`{"Records": [
+		{"eventName": "ObjectCreated:Put", "eventTime": "2024-05-01T10:00:00Z", "s3": {"bucket": {"name": "media"}, "object": {"key": "photos/summer+2024/a%C3%A9.jpg", "sequencer": "0A1"}}},
+		{"eventName": "ObjectRemoved:Delete", "s3": {"bucket": {"name": "media"}, "object": {"key": "old.txt"}}},
+		{"eventName": "LifecycleExpiration:Delete", "s3": {"bucket": {"name": "media"}, "object": {"key": "expired.txt"}}},
+		{"eventName": "ObjectRestore:Completed", "s3": {"bucket": {"name": "media"}, "object": {"key": "restored.txt"}}}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []objectChange{
+		{bucket: "media", key: "photos/summer 2024/aé.jpg", eventTime: "2024-05-01T10:00:00Z", sequencer: "0A1"},
+		{bucket: "media", key: "old.txt", removed: true},
+		{bucket: "media", key: "expired.txt", removed: true},
+	}
+	if !slices.Equal(changes, want) {
+		t.Errorf("parseS3Event = %+v, want %+v", changes, want)
+	}
+
+	// SNS wraps the event in a notification.
+	changes, err = parseS3Event(`{"Type": "Notification", "Message": "{\"Records\": [{\"eventName\": \"ObjectCreated:Copy\", \"s3\": {\"bucket\": {\"name\": \"media\"}, \"object\": {\"key\": \"b.txt\"}}}]}"}`)
+	if err != nil || len(changes) != 1 || changes[0].key != "b.txt" {
+		t.Errorf("parseS3Event of an SNS notification = %+v, %v", changes, err)
+	}
+	if changes, err := parseS3Event(`{"Service": "Amazon S3", "Event": "s3:TestEvent", "Bucket": "media"}`); err != nil || changes != nil {
+		t.Errorf("parseS3Event of the test event = %+v, %v, want no changes", changes, err)
+	}
+
+	for _, tt := range []struct {
+		body string
+		want string
+	}{
+		{"not json", "not JSON"},
+		{`{"Records": []}`, "no Records in the message"},
+		{`{"Records": [{"s3": {"bucket": {"name": "media"}, "object": {"key": "a"}}}]}`, "record without eventName"},
+		{`{"Records": [{"eventName": "ObjectCreated:Put", "s3": {"bucket": {"name": "media"}, "object": {"key": ""}}}]}`, "record without a valid bucket and key"},
+	} {
+		_, err := parseS3Event(tt.body)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestObjectChangeOrder(t *testing.T) {
+	for _, tt := range []struct {
+		c, o objectChange
+		want bool
+	}{
+		{objectChange{sequencer: "0A"}, objectChange{sequencer: "09"}, true},
+		// Sequencers of different length compare as numbers.
+		{objectChange{sequencer: "100"}, objectChange{sequencer: "FF"}, true},
+		{objectChange{sequencer: "0ff"}, objectChange{sequencer: "100"}, false},
+		{objectChange{eventTime: "2024-05-01T10:00:01Z"}, objectChange{eventTime: "2024-05-01T10:00:00Z", sequencer: "FF"}, true},
+	} {
+		if got := tt.c.after(tt.o); got != tt.want {
+			t.Errorf("%+v.after(%+v) = %v, want %v", tt.c, tt.o, got, tt.want)
+		}
+	}
+}
+
+// s3EventBody is an SQS message body with one record.
+func s3EventBody(name, bucket, key, sequencer string) string {
+	return `{"Records": [{"eventName": "` + name + `", "s3": {"bucket": {"name": "` + bucket + `"}, "object": {"key": "` + key + `", "sequencer": "` + sequencer + `"}}}]}`
+}
+
+func TestEventBatch(t *testing.T) {
+	config, err := loadTestConfig(t, withSQS(map[string]string{"SOURCE_PREFIX": "media"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log strings.Builder
+	logger := logrus.New()
+	logger.SetOutput(&log)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	batch := &eventBatch{changes: make(map[string]objectChange)}
+	for _, body := range []string{
+		s3EventBody("ObjectCreated:Put", "source-bucket", "media/a.jpg", "01"),
+		// The latest event of a key wins, whatever the delivery order.
+		s3EventBody("ObjectCreated:Put", "source-bucket", "media/b.jpg", "03"),
+		s3EventBody("ObjectRemoved:Delete", "source-bucket", "media/b.jpg", "02"),
+		s3EventBody("ObjectCreated:Put", "source-bucket", "media/c.jpg", "01"),
+		s3EventBody("ObjectRemoved:Delete", "source-bucket", "media/c.jpg", "02"),
+		// Outside the source prefix or bucket, and folder markers.
+		s3EventBody("ObjectCreated:Put", "source-bucket", "logs/x.log", "01"),
+		s3EventBody("ObjectCreated:Put", "other-bucket", "media/a.jpg", "01"),
+		s3EventBody("ObjectCreated:Put", "source-bucket", "media/folder/", "01"),
+		"garbage",
+	} {
+		batch.add(config, sqsMessage{ID: "m", Body: body}, logger)
+	}
+	created, removed := batch.split()
+	if !slices.Equal(created, []string{"a.jpg", "b.jpg"}) || !slices.Equal(removed, []string{"c.jpg"}) {
+		t.Errorf("split = %q created, %q removed", created, removed)
+	}
+	if batch.ignored != 3 || len(batch.messages) != 9 {
+		t.Errorf("batch has %d ignored changes of %d messages, want 3 of 9", batch.ignored, len(batch.messages))
+	}
+	if e := findEntry(logEntries(t, log.String()), "Dropping malformed SQS message"); e == nil || e["dead_letter"] != true {
+		t.Errorf("malformed message logged as %v", e)
+	}
+}
+
+func TestEventDeleteBlocker(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{nil, ""},
+		{map[string]string{"SYNC_MODE": "copy"}, "SYNC_MODE=copy never deletes from the destination"},
+		{map[string]string{"DELETE_STRATEGY": "none"}, "deletions are disabled"},
+		{map[string]string{"BACKUP_DIR": "trash"}, "rclone delete keeps no backup"},
+	} {
+		config, err := loadTestConfig(t, withSQS(tt.env))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := eventDeleteBlocker(config); !strings.HasPrefix(got, tt.want) || (tt.want == "") != (got == "") {
+			t.Errorf("eventDeleteBlocker with %v = %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
+
+// sqsServer is a fake SQS queue that returns messages once and records the
+// actions it receives.
+type sqsServer struct {
+	*httptest.Server
+	messages chan string
+	actions  chan url.Values
+}
+
+func newSQSServer(t *testing.T, deleteResponse string) *sqsServer {
+	s := &sqsServer{messages: make(chan string, 10), actions: make(chan url.Values, 100)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		params, _ := url.ParseQuery(string(body))
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=sqs-access/") {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<ErrorResponse><Error><Code>InvalidClientTokenId</Code><Message>unsigned</Message></Error></ErrorResponse>`)
+			return
+		}
+		s.actions <- params
+		switch params.Get("Action") {
+		case "ReceiveMessage":
+			io.WriteString(w, "<ReceiveMessageResponse><ReceiveMessageResult>")
+			select {
+			case body := <-s.messages:
+				io.WriteString(w, "<Message><MessageId>m1</MessageId><ReceiptHandle>r1</ReceiptHandle><Body><![CDATA["+body+"]]></Body></Message>")
+			default:
+			}
+			io.WriteString(w, "</ReceiveMessageResult></ReceiveMessageResponse>")
+		case "DeleteMessageBatch":
+			io.WriteString(w, deleteResponse)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `<ErrorResponse><Error><Code>InvalidAction</Code><Message>no such action</Message></Error></ErrorResponse>`)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSQSClient(t *testing.T) {
+	server := newSQSServer(t, `<DeleteMessageBatchResponse><DeleteMessageBatchResult>`+
+		`<BatchResultErrorEntry><Id>1</Id><Code>ReceiptHandleIsInvalid</Code><Message>stale</Message></BatchResultErrorEntry>`+
+		`</DeleteMessageBatchResult></DeleteMessageBatchResponse>`)
+	config, err := loadTestConfig(t, withSQS(map[string]string{"SQS_QUEUE_URL": server.URL + "/queue/events", "SQS_REGION": "local"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newSQSClient(config)
+	ctx := context.Background()
+
+	server.messages <- s3EventBody("ObjectCreated:Put", "source-bucket", "a.jpg", "01")
+	messages, err := client.receive(ctx, 2*time.Second, time.Minute)
+	if err != nil || len(messages) != 1 || messages[0].ReceiptHandle != "r1" || !strings.Contains(messages[0].Body, "a.jpg") {
+		t.Fatalf("receive = %+v, %v", messages, err)
+	}
+	if params := <-server.actions; params.Get("WaitTimeSeconds") != "2" || params.Get("VisibilityTimeout") != "60" || params.Get("MaxNumberOfMessages") != "10" {
+		t.Errorf("ReceiveMessage with %v", params)
+	}
+
+	// Messages are deleted ten per request.
+	batch := make([]sqsMessage, 12)
+	for i := range batch {
+		batch[i].ReceiptHandle = "r" + string(rune('a'+i))
+	}
+	err = client.delete(ctx, batch)
+	wantError(t, err, "SQS DeleteMessageBatch failed for a message: ReceiptHandleIsInvalid: stale")
+	first, second := <-server.actions, <-server.actions
+	if first.Get("DeleteMessageBatchRequestEntry.10.ReceiptHandle") != "rj" || second.Get("DeleteMessageBatchRequestEntry.2.ReceiptHandle") != "rl" {
+		t.Errorf("DeleteMessageBatch with %v and %v", first, second)
+	}
+
+	err = client.call(ctx, "PurgeQueue", url.Values{}, &struct{}{})
+	wantError(t, err, "SQS PurgeQueue failed: InvalidAction: no such action")
+}
+
+func TestApplyBatch(t *testing.T) {
+	keys := t.TempDir()
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+for arg; do
+	case $prev in --files-from-raw|--files-from) cp "$arg" "`+keys+`/$1" ;; esac
+	prev=$arg
+done
+# b.jpg was created again after its removal.
+[ "$1" = lsf ] && { echo b.jpg; exit 0; }
+exit 0`)
+	config, err := loadTestConfig(t, withSQS(map[string]string{"RCLONE_PATH": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remotes, cleanup, err := setupRemotes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	batch := &eventBatch{changes: map[string]objectChange{
+		"a.jpg": {key: "a.jpg"},
+		"b.jpg": {key: "b.jpg", removed: true},
+		"c.jpg": {key: "c.jpg", removed: true},
+	}}
+	stats, err := applyBatch(config, remotes, batch, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Deletes != 1 {
+		t.Errorf("deleted %d objects, want only c.jpg", stats.Deletes)
+	}
+	var commands []string
+	for _, run := range readCalls(t, calls) {
+		commands = append(commands, strings.Fields(run)[0])
+	}
+	// A copy rather than a sync, so only the listed keys are considered.
+	if !slices.Equal(commands, []string{"copy", "lsf", "delete"}) {
+		t.Errorf("rclone ran %q, want a copy and a delete", commands)
+	}
+	for command, want := range map[string]string{"copy": "a.jpg\n", "delete": "c.jpg\n"} {
+		if data, _ := os.ReadFile(filepath.Join(keys, command)); string(data) != want {
+			t.Errorf("rclone %s got keys %q, want %q", command, data, want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runState is what a job remembers between runs, so that the age of the
+// last success survives restarts and can be alerted on.
+type runState struct {
+	LastRun     time.Time  `json:"last_run"`
+	LastResult  string     `json:"last_result"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// LastFullSuccess and IncrementalRuns decide when an INCREMENTAL job
+	// runs its next full sync.
+	LastFullSuccess *time.Time `json:"last_full_success,omitempty"`
+	IncrementalRuns int        `json:"incremental_runs"`
+	// LastStats are the counts of the last run, successful or not.
+	LastStats RunStats `json:"last_stats"`
+}
+
+// stateLocation returns where the state of config is kept: STATE_FILE, or
+// state.json next to the reports in the destination bucket. It is "" if
+// neither is set.
+func stateLocation(config *Config) string {
+	switch {
+	case config.StateFile != "":
+		return jobPath(config, config.StateFile)
+	case config.ReportPrefix != "":
+		return remotePath("dest", config.Dest.Bucket, reportRoot(config)+"/state.json")
+	}
+	return ""
+}
+
+// loadState reads the state of config. It returns nil without an error if
+// no state has been recorded yet. A state that can't be parsed is an error;
+// callers log it and start over rather than fail the run.
+func loadState(config *Config, remotes *rcloneRemotes) (*runState, error) {
+	data, err := readState(config, remotes)
+	if err != nil || len(bytes.TrimSpace(data)) == 0 {
+		return nil, err
+	}
+	var state runState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("state %s is corrupt: %w", stateLocation(config), err)
+	}
+	if state.LastRun.IsZero() {
+		return nil, fmt.Errorf("state %s is corrupt: no last_run", stateLocation(config))
+	}
+	return &state, nil
+}
+
+func readState(config *Config, remotes *rcloneRemotes) ([]byte, error) {
+	if config.StateFile != "" {
+		data, err := os.ReadFile(stateLocation(config))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return data, err
+	}
+	return readObject(config, remotes, stateLocation(config))
+}
+
+// readObject returns the content of the object at path, or nil without an
+// error if it doesn't exist.
+func readObject(config *Config, remotes *rcloneRemotes, path string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := remotes.command(config, "cat", path)
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	var exitErr *exec.ExitError
+	// rclone exits with 3 or 4 for a missing directory or object, and S3
+	// may also answer with an empty listing.
+	if errors.As(err, &exitErr) && (exitErr.ExitCode() == 3 || exitErr.ExitCode() == 4) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w: %s", path, err, lastLine(strings.TrimSpace(stderr.String())))
+	}
+	return data, nil
+}
+
+// saveState writes state atomically: STATE_FILE is replaced by renaming a
+// temporary file in the same directory, and an S3 PUT replaces the object
+// as a whole, so a crash leaves either the old or the new state.
+func saveState(config *Config, remotes *rcloneRemotes, state *runState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if config.StateFile == "" {
+		return rcat(config, remotes, stateLocation(config), bytes.NewReader(data))
+	}
+
+	path := stateLocation(config)
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// recordState adds a finished run to the state of its job. Dry runs are not
+// recorded, as they don't keep the destination up to date. Failures are
+// logged as warnings and don't change the outcome of the run.
+func recordState(config *Config, remotes *rcloneRemotes, report *runSummary, logger *logrus.Logger) {
+	location := stateLocation(config)
+	if location == "" || config.DryRun {
+		return
+	}
+	entry := logger.WithField("state", location)
+	state, err := loadState(config, remotes)
+	if err != nil {
+		entry.WithError(err).Warn("Failed to load the previous state, starting over")
+	}
+	if state == nil {
+		state = &runState{}
+	}
+	state.LastRun = report.FinishedAt
+	state.LastResult = report.Result
+	state.LastStats = report.Stats
+	if report.Result == "success" {
+		finished := report.FinishedAt
+		state.LastSuccess = &finished
+		if report.Incremental {
+			state.IncrementalRuns++
+		} else {
+			state.LastFullSuccess, state.IncrementalRuns = &finished, 0
+		}
+	}
+	if err := saveState(config, remotes, state); err != nil {
+		entry.WithError(err).Warn("Failed to save the run state")
+		return
+	}
+	entry.Debug("Saved the run state")
+}
+
+// restoreStates loads the state of every job at startup, logs the age of
+// its last success and seeds last_success_timestamp_seconds with it, so
+// that the metric doesn't drop to nothing when the process restarts.
+func restoreStates(configs []*Config, logger *logrus.Logger) {
+	for _, config := range configs {
+		location := stateLocation(config)
+		if location == "" {
+			continue
+		}
+		entry := logger.WithField("state", location)
+		if config.JobName != "" {
+			entry = entry.WithField("job", config.JobName)
+		}
+		remotes, cleanup, err := setupRemotes(config)
+		if err != nil {
+			entry.WithError(err).Warn("Failed to load the run state")
+			continue
+		}
+		state, err := loadState(config, remotes)
+		cleanup()
+		switch {
+		case err != nil:
+			entry.WithError(err).Warn("Failed to load the run state, ignoring it")
+		case state == nil || state.LastSuccess == nil:
+			entry.Info("No successful run recorded yet")
+		default:
+			metrics.restoreLastSuccess(config, *state.LastSuccess)
+			entry.WithFields(logrus.Fields{
+				"last_success":     state.LastSuccess.Format(time.RFC3339),
+				"last_success_age": time.Since(*state.LastSuccess).Round(time.Second).String(),
+				"last_result":      state.LastResult,
+			}).Info("Loaded the run state")
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestStateLocation(t *testing.T) {
+	for _, tt := range []struct {
+		config *Config
+		want   string
+	}{
+		{&Config{}, ""},
+		{&Config{StateFile: "/data/state.json"}, "/data/state.json"},
+		{&Config{StateFile: "/data/state.json", JobName: "media"}, "/data/state-media.json"},
+		{&Config{StateFile: "/data/state.json", ReportPrefix: "_reports"}, "/data/state.json"},
+	} {
+		if got := stateLocation(tt.config); got != tt.want {
+			t.Errorf("stateLocation(%+v) = %q, want %q", tt.config, got, tt.want)
+		}
+	}
+
+	config, err := loadTestConfig(t, map[string]string{"REPORT_PREFIX": "_reports"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stateLocation(config), remotePath("dest", "dest-bucket", reportRoot(config)+"/state.json"); got != want {
+		t.Errorf("stateLocation = %q, want %q in the destination bucket", got, want)
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	config := &Config{StateFile: file}
+	if state, err := loadState(config, nil); state != nil || err != nil {
+		t.Errorf("missing state: %+v, %v; want nothing", state, err)
+	}
+	for content, want := range map[string]string{
+		"\n":                       "",
+		"{":                        "state " + file + " is corrupt",
+		`{"last_result":"ok"}`:     "state " + file + " is corrupt: no last_run",
+		`{"last_run":"yesterday"}`: "state " + file + " is corrupt",
+	} {
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		state, err := loadState(config, nil)
+		wantError(t, err, want)
+		if state != nil {
+			t.Errorf("state %q loaded as %+v", content, state)
+		}
+	}
+}
+
+func TestSaveState(t *testing.T) {
+	dir := t.TempDir()
+	config := &Config{StateFile: filepath.Join(dir, "state.json")}
+	success := time.Date(2024, 5, 1, 2, 0, 0, 0, time.UTC)
+	saved := &runState{
+		LastRun:     success.Add(time.Hour),
+		LastResult:  "failure",
+		LastSuccess: &success,
+		LastStats:   RunStats{Transfers: 3, Errors: 1},
+	}
+	for i := 0; i < 2; i++ {
+		if err := saveState(config, nil, saved); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state, err := loadState(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.LastRun.Equal(saved.LastRun) || state.LastResult != "failure" || !state.LastSuccess.Equal(success) || state.LastStats.Transfers != 3 {
+		t.Errorf("loaded %+v, want %+v", state, saved)
+	}
+	// The temporary file is renamed over the state.
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("state directory holds %d files, want only the state", len(entries))
+	}
+
+	config.StateFile = filepath.Join(dir, "missing", "state.json")
+	wantError(t, saveState(config, nil, saved), "failed to write "+config.StateFile)
+}
+
+// readStateFile decodes the state at path.
+func readStateFile(t *testing.T, path string) runState {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state runState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func TestRecordState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "STATE_FILE": file}))
+	captureOutput(t, func() { run(nil) })
+	state := readStateFile(t, file)
+	if state.LastResult != "success" || state.LastSuccess == nil || !state.LastSuccess.Equal(state.LastRun) || state.LastFullSuccess == nil {
+		t.Fatalf("state after a success = %+v", state)
+	}
+	success := *state.LastSuccess
+
+	// A failure keeps the last success.
+	path, _ = fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 1`)
+	t.Setenv("RCLONE_PATH", path)
+	captureOutput(t, func() { run(nil) })
+	state = readStateFile(t, file)
+	if state.LastResult != "failure" || !state.LastRun.After(success) || state.LastSuccess == nil || !state.LastSuccess.Equal(success) {
+		t.Errorf("state after a failure = %+v, want the last success at %v", state, success)
+	}
+
+	// Dry runs aren't recorded.
+	t.Setenv("DRY_RUN", "true")
+	before, _ := os.ReadFile(file)
+	captureOutput(t, func() { run(nil) })
+	if after, _ := os.ReadFile(file); string(after) != string(before) {
+		t.Errorf("dry run changed the state to %s", after)
+	}
+}
+
+func TestRecordStateCorrupt(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(file, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "STATE_FILE": file}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Errorf("run = %d, want a corrupt state not to fail it", result.code)
+	}
+	if findEntry(logEntries(t, out), "Failed to load the previous state, starting over") == nil {
+		t.Errorf("corrupt state not logged:\n%s", out)
+	}
+	if state := readStateFile(t, file); state.LastResult != "success" {
+		t.Errorf("state = %+v, want it started over", state)
+	}
+}
+
+func TestRestoreStates(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	config, err := loadTestConfig(t, map[string]string{"STATE_FILE": file, "SOURCE_BUCKET": "restored-bucket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	success := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	if err := saveState(config, nil, &runState{LastRun: success, LastResult: "success", LastSuccess: &success}); err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	restoreStates([]*Config{config}, logger)
+	if got := metrics.lastSuccess(config); !got.Equal(success) {
+		t.Errorf("last success = %v, want %v from the state", got, success)
+	}
+
+	// A later success of this process is kept.
+	earlier := success.Add(-time.Hour)
+	metrics.restoreLastSuccess(config, earlier)
+	if got := metrics.lastSuccess(config); !got.Equal(success) {
+		t.Errorf("last success = %v, want the later %v", got, success)
+	}
+
+	// /readyz reports it.
+	jobs := newHealth([]*Config{config}, func() bool { return false }).lastSuccesses()
+	job, ok := jobs["restored-bucket"].(map[string]interface{})
+	if !ok || job["at"] != success.UTC().Format(time.RFC3339) || job["age_seconds"].(int64) < 7200 {
+		t.Errorf("last_success = %v, want restored-bucket two hours ago", jobs)
+	}
+}
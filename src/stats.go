@@ -0,0 +1,40 @@
+package main
+
+// RunStats are the transfer counts of one rclone run, as reported in the
+// "stats" object rclone logs with --use-json-log.
+type RunStats struct {
+	Bytes            int64   `json:"bytes"`
+	TotalBytes       int64   `json:"totalBytes"`
+	Transfers        int64   `json:"transfers"`
+	Checks           int64   `json:"checks"`
+	Deletes          int64   `json:"deletes"`
+	Renames          int64   `json:"renames"`
+	ServerSideCopies int64   `json:"serverSideCopies"`
+	ServerSideMoves  int64   `json:"serverSideMoves"`
+	Errors           int64   `json:"errors"`
+	ElapsedTime      float64 `json:"elapsedTime"`
+	Speed            float64 `json:"speed"`
+	// CopiedKeys, MovedKeys and DeletedKeys count rclone's per-file log
+	// lines, which it only logs for MANIFEST and LOG_TRANSFERS. They match
+	// the manifest and the transfer log entries.
+	CopiedKeys  int64 `json:"copiedKeys,omitempty"`
+	MovedKeys   int64 `json:"movedKeys,omitempty"`
+	DeletedKeys int64 `json:"deletedKeys,omitempty"`
+}
+
+// add sums the counts of o into s, for runs made of several rclone calls.
+func (s *RunStats) add(o RunStats) {
+	s.Bytes += o.Bytes
+	s.TotalBytes += o.TotalBytes
+	s.Transfers += o.Transfers
+	s.Checks += o.Checks
+	s.Deletes += o.Deletes
+	s.Renames += o.Renames
+	s.ServerSideCopies += o.ServerSideCopies
+	s.ServerSideMoves += o.ServerSideMoves
+	s.Errors += o.Errors
+	s.ElapsedTime += o.ElapsedTime
+	s.CopiedKeys += o.CopiedKeys
+	s.MovedKeys += o.MovedKeys
+	s.DeletedKeys += o.DeletedKeys
+}
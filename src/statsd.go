@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacket keeps a datagram within the MTU of most networks, as the
+// Datadog agent recommends; longer batches are split.
+const statsdMaxPacket = 1432
+
+// statsdDialTimeout bounds resolving STATSD_ADDR, the only step of sending
+// that can wait.
+const statsdDialTimeout = time.Second
+
+func validateStatsD(config *Config) error {
+	if config.StatsDAddr == "" {
+		if config.StatsDTags != "" || config.StatsDProgress {
+			return fmt.Errorf("STATSD_TAGS and STATSD_PROGRESS require STATSD_ADDR")
+		}
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(config.StatsDAddr); err != nil || port == "" {
+		return fmt.Errorf("invalid STATSD_ADDR %q: must look like 127.0.0.1:8125 or datadog-agent:8125", config.StatsDAddr)
+	}
+	if config.StatsDPrefix != "" && strings.ContainsAny(config.StatsDPrefix, ":|#@, ") {
+		return fmt.Errorf("invalid STATSD_PREFIX %q: must not contain spaces or any of : | # @ ,", config.StatsDPrefix)
+	}
+	for _, tag := range splitPatterns(config.StatsDTags, ",") {
+		if strings.ContainsAny(tag, "|#@ ") {
+			return fmt.Errorf("invalid STATSD_TAGS: %q must look like key:value", tag)
+		}
+	}
+	return nil
+}
+
+// statsdClient sends DogStatsD metrics over UDP. Sending is fire-and-forget:
+// a missing agent or a lost datagram is not noticed and doesn't affect the
+// run.
+type statsdClient struct {
+	addr   string
+	prefix string
+	tags   string
+}
+
+// newStatsD returns the client for config's job, or nil if STATSD_ADDR is
+// not set. Every metric is tagged with the job and its buckets, like the
+// Prometheus metrics, and STATSD_TAGS.
+func newStatsD(config *Config) *statsdClient {
+	if config.StatsDAddr == "" {
+		return nil
+	}
+	labels := jobLabels(config)
+	tags := splitPatterns(config.StatsDTags, ",")
+	tags = append(tags,
+		"job:"+statsdTagValue(labels.job),
+		"source_bucket:"+statsdTagValue(labels.sourceBucket),
+		"dest_bucket:"+statsdTagValue(labels.destBucket),
+	)
+	prefix := config.StatsDPrefix
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &statsdClient{addr: config.StatsDAddr, prefix: prefix, tags: strings.Join(tags, ",")}
+}
+
+// statsdTagValue replaces the characters that end a tag or the tag list.
+func statsdTagValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '|', '#', '@', ' ', '\t', '\n':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// metric formats one metric line; extra tags are added to the job's.
+func (c *statsdClient) metric(name string, value interface{}, kind string, extra ...string) string {
+	tags := c.tags
+	if len(extra) > 0 {
+		tags += "," + strings.Join(extra, ",")
+	}
+	return fmt.Sprintf("%s%s:%v|%s|#%s", c.prefix, name, value, kind, tags)
+}
+
+// send writes the lines in as few datagrams as fit statsdMaxPacket.
+func (c *statsdClient) send(lines []string) {
+	conn, err := net.DialTimeout("udp", c.addr, statsdDialTimeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var packet strings.Builder
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			_, _ = conn.Write([]byte(packet.String()))
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		_, _ = conn.Write([]byte(packet.String()))
+	}
+}
+
+// recordStatsD sends the metrics of a finished run, the counterparts of the
+// Prometheus ones: runs by result, the duration as a timing, and the bytes,
+// objects, deletions and errors as counters.
+func recordStatsD(config *Config, err error, duration time.Duration, stats RunStats) {
+	c := newStatsD(config)
+	if c == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	c.send([]string{
+		c.metric("runs", 1, "c", "result:"+result),
+		c.metric("duration", duration.Milliseconds(), "ms", "result:"+result),
+		c.metric("bytes_transferred", stats.Bytes, "c"),
+		c.metric("objects_transferred", stats.Transfers, "c"),
+		c.metric("objects_deleted", stats.Deletes, "c"),
+		c.metric("errors", stats.Errors, "c"),
+	})
+}
+
+// progress sends the counts of an rclone stats line as gauges, for
+// STATSD_PROGRESS. It doesn't wait for the send, as it is called while
+// rclone's output is read.
+func (c *statsdClient) progress(stats RunStats) {
+	if c == nil {
+		return
+	}
+	go c.send([]string{
+		c.metric("progress.bytes", stats.Bytes, "g"),
+		c.metric("progress.total_bytes", stats.TotalBytes, "g"),
+		c.metric("progress.transfers", stats.Transfers, "g"),
+		c.metric("progress.checks", stats.Checks, "g"),
+		c.metric("progress.deletes", stats.Deletes, "g"),
+		c.metric("progress.errors", stats.Errors, "g"),
+		c.metric("progress.speed", strconv.FormatFloat(stats.Speed, 'f', -1, 64), "g"),
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateStatsD(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"STATSD_ADDR": "datadog-agent:8125", "STATSD_PREFIX": "s3.sync", "STATSD_TAGS": "env:prod, team:media", "STATSD_PROGRESS": "true"}, ""},
+		{map[string]string{"STATSD_TAGS": "env:prod"}, "STATSD_TAGS and STATSD_PROGRESS require STATSD_ADDR"},
+		{map[string]string{"STATSD_PROGRESS": "true"}, "STATSD_TAGS and STATSD_PROGRESS require STATSD_ADDR"},
+		{map[string]string{"STATSD_ADDR": "datadog-agent"}, `invalid STATSD_ADDR "datadog-agent": must look like 127.0.0.1:8125`},
+		{map[string]string{"STATSD_ADDR": "datadog-agent:"}, `invalid STATSD_ADDR "datadog-agent:"`},
+		{map[string]string{"STATSD_ADDR": "127.0.0.1:8125", "STATSD_PREFIX": "s3|sync"}, `invalid STATSD_PREFIX "s3|sync"`},
+		{map[string]string{"STATSD_ADDR": "127.0.0.1:8125", "STATSD_TAGS": "env:prod,team|media"}, `invalid STATSD_TAGS: "team|media" must look like key:value`},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestStatsDMetric(t *testing.T) {
+	c := newStatsD(&Config{
+		StatsDAddr:   "127.0.0.1:8125",
+		StatsDPrefix: "s3_sync",
+		StatsDTags:   "env:prod",
+		JobName:      "media, daily",
+		Source:       RemoteConfig{Bucket: "media"},
+		Dest:         RemoteConfig{Bucket: "media-replica"},
+	})
+	want := "s3_sync.runs:1|c|#env:prod,job:media__daily,source_bucket:media,dest_bucket:media-replica,result:success"
+	if got := c.metric("runs", 1, "c", "result:success"); got != want {
+		t.Errorf("metric = %q, want %q", got, want)
+	}
+	if c := newStatsD(&Config{StatsDAddr: "127.0.0.1:8125", StatsDPrefix: "s3.", Source: RemoteConfig{Bucket: "a"}}); !strings.HasPrefix(c.metric("runs", 1, "c"), "s3.runs:1|c|#job:a,") {
+		t.Errorf("metric = %q, want the prefix once", c.metric("runs", 1, "c"))
+	}
+	if newStatsD(&Config{}) != nil {
+		t.Error("client without STATSD_ADDR")
+	}
+}
+
+// statsdListener receives datagrams on a local UDP port.
+type statsdListener struct {
+	conn net.PacketConn
+}
+
+func newStatsDListener(t *testing.T) *statsdListener {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &statsdListener{conn: conn}
+}
+
+func (l *statsdListener) addr() string { return l.conn.LocalAddr().String() }
+
+// packets returns the datagrams that arrive until none did for wait.
+func (l *statsdListener) packets(t *testing.T, wait time.Duration) []string {
+	t.Helper()
+	var packets []string
+	buf := make([]byte, 65536)
+	for {
+		l.conn.SetReadDeadline(time.Now().Add(wait))
+		n, _, err := l.conn.ReadFrom(buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return packets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestStatsDSend(t *testing.T) {
+	l := newStatsDListener(t)
+	c := &statsdClient{addr: l.addr(), tags: "job:media"}
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, c.metric(fmt.Sprintf("metric_%d", i), i, "c"))
+	}
+	c.send(lines)
+	packets := l.packets(t, 200*time.Millisecond)
+	if len(packets) < 2 {
+		t.Fatalf("got %d datagrams, want the lines split", len(packets))
+	}
+	var got []string
+	for _, packet := range packets {
+		if len(packet) > statsdMaxPacket {
+			t.Errorf("datagram of %d bytes, want at most %d", len(packet), statsdMaxPacket)
+		}
+		got = append(got, strings.Split(packet, "\n")...)
+	}
+	if strings.Join(got, "\n") != strings.Join(lines, "\n") {
+		t.Errorf("received %d lines, want the %d sent in order", len(got), len(lines))
+	}
+}
+
+func TestRecordStatsD(t *testing.T) {
+	l := newStatsDListener(t)
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+echo '{"level":"notice","msg":"stats","stats":{"bytes":2048,"totalBytes":4096,"transfers":2,"checks":5,"speed":512.5}}' >&2
+exit 1`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "STATSD_ADDR": l.addr(), "STATSD_TAGS": "env:test", "STATSD_PROGRESS": "true"}))
+	captureOutput(t, func() { run(nil) })
+	received := strings.Join(l.packets(t, 300*time.Millisecond), "\n")
+	tags := "|#env:test,job:source-bucket,source_bucket:source-bucket,dest_bucket:dest-bucket"
+	for _, want := range []string{
+		"s3_sync.runs:1|c" + tags + ",result:failure",
+		"|ms" + tags + ",result:failure",
+		"s3_sync.bytes_transferred:2048|c" + tags,
+		"s3_sync.objects_transferred:2|c" + tags,
+		"s3_sync.objects_deleted:0|c" + tags,
+		"s3_sync.progress.total_bytes:4096|g" + tags,
+		"s3_sync.progress.speed:512.5|g" + tags,
+	} {
+		if !strings.Contains(received, want) {
+			t.Errorf("metrics lack %q:\n%s", want, received)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// lineTail is an io.Writer that keeps the last max complete lines written to
+// it, so rclone's output can be inspected after it exits without buffering
+// the whole run.
+type lineTail struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func newLineTail(max int) *lineTail {
+	return &lineTail{max: max}
+}
+
+func (t *lineTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	data := append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		t.add(string(data[:i]))
+		data = data[i+1:]
+	}
+	t.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+func (t *lineTail) add(line string) {
+	line = strings.TrimRight(line, "\r")
+	if line == "" {
+		return
+	}
+	// The lines are quoted in errors, which outlive the logs.
+	line = scrubber.scrub(line)
+	if len(t.lines) == t.max {
+		t.lines = t.lines[1:]
+	}
+	t.lines = append(t.lines, line)
+}
+
+// Lines returns the retained lines, oldest first, including an unterminated
+// final line.
+func (t *lineTail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := append([]string(nil), t.lines...)
+	if len(t.partial) > 0 {
+		lines = append(lines, string(t.partial))
+	}
+	return lines
+}
+
+// contains reports whether any retained line contains substr, ignoring case.
+func (t *lineTail) contains(substr string) bool {
+	substr = strings.ToLower(substr)
+	for _, line := range t.Lines() {
+		if strings.Contains(strings.ToLower(line), substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns how many retained lines contain any of substrs, ignoring
+// case.
+func (t *lineTail) count(substrs ...string) int {
+	n := 0
+	for _, line := range t.Lines() {
+		line = strings.ToLower(line)
+		for _, substr := range substrs {
+			if strings.Contains(line, strings.ToLower(substr)) {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// throttlingMarkers identify rclone errors caused by provider rate limiting:
+// S3's 503 SlowDown and HTTP 429 from other providers.
+var throttlingMarkers = []string{"SlowDown", "status code: 429", "Too Many Requests"}
+
+// throttlingHintThreshold is the number of throttled requests in the stderr
+// tail above which a TPS_LIMIT hint is logged.
+const throttlingHintThreshold = 3
+
+// ErrorClass is the kind of failure an rclone error line points to.
+type ErrorClass string
+
+// errorSignatures classify rclone error lines by the first matching marker,
+// compared case-insensitively.
+var errorSignatures = []struct {
+	class   ErrorClass
+	markers []string
+}{
+	// Archived objects are refused with a 403 too.
+	{"archived", []string{"InvalidObjectState"}},
+	{"access_denied", []string{"AccessDenied", "InvalidAccessKeyId", "403 Forbidden", "status code: 403"}},
+	{"signature_mismatch", []string{"SignatureDoesNotMatch", "RequestTimeTooSkewed"}},
+	{"no_such_bucket", []string{"NoSuchBucket", "bucket does not exist"}},
+	{"throttled", []string{"SlowDown", "status code: 503", "503 Service Unavailable", "status code: 429", "Too Many Requests"}},
+	{"server_error", []string{"InternalError", "status code: 500", "500 Internal Server Error", "status code: 502", "502 Bad Gateway", "status code: 504", "504 Gateway Timeout"}},
+	{"connection_refused", []string{"connection refused", "connection reset", "no such host"}},
+	{"timeout", []string{"context deadline exceeded", "i/o timeout", "TLS handshake timeout"}},
+}
+
+// classifyError returns the class of an rclone error line, or "other".
+func classifyError(line string) ErrorClass {
+	lower := strings.ToLower(line)
+	for _, s := range errorSignatures {
+		for _, marker := range s.markers {
+			if strings.Contains(lower, strings.ToLower(marker)) {
+				return s.class
+			}
+		}
+	}
+	return "other"
+}
+
+// classCount is how often rclone logged errors of one class, with the first
+// such error as a sample.
+type classCount struct {
+	Class  ErrorClass `json:"class"`
+	Count  int        `json:"count"`
+	Sample string     `json:"sample"`
+}
+
+// errorTally counts the classes of rclone's error lines and keeps the last
+// of them.
+type errorTally struct {
+	counts map[ErrorClass]*classCount
+	last   []string
+}
+
+// maxErrorLines is how many of rclone's last error lines are kept.
+const maxErrorLines = 20
+
+func (t *errorTally) add(line string) {
+	if t.counts == nil {
+		t.counts = make(map[ErrorClass]*classCount)
+	}
+	class := classifyError(line)
+	// The lines end up in the summary, notifications and Sentry events.
+	line = scrubber.scrub(line)
+	c, ok := t.counts[class]
+	if !ok {
+		c = &classCount{Class: class, Sample: line}
+		t.counts[class] = c
+	}
+	c.Count++
+	if len(t.last) == maxErrorLines {
+		t.last = t.last[1:]
+	}
+	t.last = append(t.last, line)
+}
+
+// top returns the n most frequent classes, most frequent first.
+func (t *errorTally) top(n int) []classCount {
+	classes := make([]classCount, 0, len(t.counts))
+	for _, c := range t.counts {
+		classes = append(classes, *c)
+	}
+	sort.Slice(classes, func(i, k int) bool {
+		if classes[i].Count != classes[k].Count {
+			return classes[i].Count > classes[k].Count
+		}
+		return classes[i].Class < classes[k].Class
+	})
+	if len(classes) > n {
+		classes = classes[:n]
+	}
+	return classes
+}
+
+// rcloneError is a failed rclone run, with the classes of the errors it
+// logged, most frequent first.
+type rcloneError struct {
+	classes []classCount
+	// lines are the last error lines rclone logged, oldest first.
+	lines []string
+	err   error
+}
+
+func (e *rcloneError) Error() string {
+	if len(e.classes) == 0 {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%v (%s)", e.err, e.classes[0].Class)
+}
+
+func (e *rcloneError) Unwrap() error { return e.err }
+
+// class returns the most frequent error class, or "" if rclone logged no
+// errors.
+func (e *rcloneError) class() ErrorClass {
+	if len(e.classes) == 0 {
+		return ""
+	}
+	return e.classes[0].Class
+}
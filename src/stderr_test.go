@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestLineTail(t *testing.T) {
+	tail := newLineTail(3)
+	for _, chunk := range []string{"one\ntw", "o\r\n\nthree\n", "four\nfi", "ve"} {
+		fmt.Fprint(tail, chunk)
+	}
+	// The oldest lines are dropped, empty ones skipped, and the unterminated
+	// last one kept.
+	if got, want := tail.Lines(), []string{"two", "three", "four", "five"}; !slices.Equal(got, want) {
+		t.Errorf("Lines = %q, want %q", got, want)
+	}
+	if !tail.contains("THREE") || tail.contains("one") {
+		t.Errorf("contains doesn't match the retained lines case-insensitively")
+	}
+}
+
+func TestLineTailCount(t *testing.T) {
+	tail := newLineTail(10)
+	fmt.Fprint(tail, "ERROR : a: SlowDown: Please reduce your request rate\n"+
+		"ERROR : b: status code: 429, Too Many Requests\n"+
+		"ERROR : c: slowdown\n"+
+		"ERROR : d: AccessDenied\n")
+	if got := tail.count(throttlingMarkers...); got != 3 {
+		t.Errorf("count = %d throttled lines, want 3", got)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	for line, want := range map[string]ErrorClass{
+		"ERROR : a.txt: Failed to copy: AccessDenied: Access Denied":               "access_denied",
+		"ERROR : a.txt: InvalidAccessKeyId: The key does not exist":                "access_denied",
+		"ERROR : a.txt: SignatureDoesNotMatch":                                     "signature_mismatch",
+		"ERROR : : error reading source root directory: NoSuchBucket":              "no_such_bucket",
+		"ERROR : a.txt: Failed to copy: SlowDown: Please reduce your request rate": "throttled",
+		"ERROR : a.txt: status code: 502, request id":                              "server_error",
+		"ERROR : a.txt: dial tcp 10.0.0.1:9000: connect: Connection Refused":       "connection_refused",
+		"ERROR : a.txt: Get \"https://s3.test\": context deadline exceeded":        "timeout",
+		"ERROR : a.txt: Failed to copy: InvalidObjectState: 403 Forbidden":         "archived",
+		"ERROR : a.txt: Failed to copy: corrupted on transfer: md5 hashes differ":  "other",
+	} {
+		if got := classifyError(line); got != want {
+			t.Errorf("classifyError(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestErrorTally(t *testing.T) {
+	var tally errorTally
+	for i := 0; i < maxErrorLines+5; i++ {
+		tally.add(fmt.Sprintf("ERROR : a%d.txt: AccessDenied", i))
+	}
+	tally.add("ERROR : b.txt: SlowDown")
+	tally.add("ERROR : c.txt: SlowDown")
+	tally.add("ERROR : d.txt: md5 hashes differ")
+
+	top := tally.top(2)
+	if len(top) != 2 || top[0].Class != "access_denied" || top[0].Count != maxErrorLines+5 || top[1].Class != "throttled" || top[1].Count != 2 {
+		t.Errorf("top = %+v, want access_denied then throttled", top)
+	}
+	if top[0].Sample != "ERROR : a0.txt: AccessDenied" {
+		t.Errorf("sample = %q, want the first access error", top[0].Sample)
+	}
+	if len(tally.last) != maxErrorLines || tally.last[maxErrorLines-1] != "ERROR : d.txt: md5 hashes differ" {
+		t.Errorf("last = %q, want the last %d lines", tally.last, maxErrorLines)
+	}
+}
+
+func TestRcloneErrorClass(t *testing.T) {
+	failed := errors.New("exit status 1")
+	for _, class := range []ErrorClass{"access_denied", "no_such_bucket", "throttled", "timeout", "server_error", "other"} {
+		err := &rcloneError{classes: []classCount{{Class: class, Count: 1}}, err: failed}
+		if want := "exit status 1 (" + string(class) + ")"; err.Error() != want {
+			t.Errorf("Error = %q, want %q", err.Error(), want)
+		}
+		// The class is reported, but every failed sync exits alike.
+		if got := exitCode(err); got != 4 {
+			t.Errorf("exit code for %s = %d, want 4", class, got)
+		}
+	}
+	if err := (&rcloneError{err: failed}); err.class() != "" || err.Error() != "exit status 1" {
+		t.Errorf("rclone error without error lines: class %q, %q", err.class(), err.Error())
+	}
+}
+
+func TestRcloneErrorClassExitCode(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+echo "ERROR : a.txt: Failed to copy: AccessDenied: Access Denied" >&2
+echo "ERROR : b.txt: Failed to copy: AccessDenied: Access Denied" >&2
+echo "ERROR : c.txt: Failed to copy: SlowDown: Please reduce your request rate" >&2
+exit 1`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != exitSyncFailed {
+		t.Errorf("run = %d, want %d for mostly access errors", result.code, exitSyncFailed)
+	}
+	if entry := findEntry(logEntries(t, out), "S3 sync job failed"); entry == nil || entry["rclone_error_class"] != "access_denied" {
+		t.Errorf("failure logged as %v, want rclone_error_class access_denied", entry)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// runSummary describes one sync run for CI and other automation. It is
+// printed to stdout as a single JSON line when the run ends. The counts are
+// the RunStats the metrics are recorded from.
+type runSummary struct {
+	Job   string `json:"job,omitempty"`
+	RunID string `json:"run_id"`
+	// TraceID joins the summary to the trace of the run, if exported.
+	TraceID    string    `json:"trace_id,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   float64   `json:"duration_seconds"`
+	Mode       string    `json:"mode"`
+	Source     string    `json:"source"`
+	Dest       string    `json:"dest"`
+	// DestStorageClass is DEST_STORAGE_CLASS, if set.
+	DestStorageClass string `json:"dest_storage_class,omitempty"`
+	DryRun           bool   `json:"dry_run"`
+	// Incremental is set for INCREMENTAL runs that only copied recently
+	// modified objects, and false for full syncs.
+	Incremental bool     `json:"incremental"`
+	Result      string   `json:"result"`
+	Stats       RunStats `json:"stats"`
+	// MaxDelete is the delete limit of the run, from MAX_DELETE and
+	// MAX_DELETE_PERCENT, or nil if it doesn't delete or has no limit.
+	MaxDelete *int `json:"max_delete,omitempty"`
+	// RcloneExitCode is nil if the run failed before rclone was started.
+	RcloneExitCode *int `json:"rclone_exit_code"`
+	// Attempts is how often rclone was run, more than 1 with RUN_RETRIES.
+	Attempts     int          `json:"attempts"`
+	ExitCode     int          `json:"exit_code"`
+	Error        string       `json:"error,omitempty"`
+	ErrorClass   string       `json:"error_class,omitempty"`
+	RcloneErrors []classCount `json:"rclone_errors,omitempty"`
+	// SkippedDeletes is the number of deletions rclone refused once the
+	// delete limit was reached, if it reported them.
+	SkippedDeletes int `json:"skipped_deletes,omitempty"`
+	// Verify holds the counts of VERIFY_AFTER_SYNC, if the check ran to the
+	// end.
+	Verify *verifyResult `json:"verify,omitempty"`
+	// MetadataChecked is how many objects VERIFY_METADATA_SAMPLE compared,
+	// and MetadataMismatches the fields that differ.
+	MetadataChecked    int                `json:"metadata_checked,omitempty"`
+	MetadataMismatches []metadataMismatch `json:"metadata_mismatches,omitempty"`
+	// TaggedObjects is how many copies PRESERVE_TAGS tagged, and TagFailures
+	// how many it couldn't, the first of which are listed in TagErrors.
+	TaggedObjects int          `json:"tagged_objects,omitempty"`
+	TagFailures   int          `json:"tag_failures,omitempty"`
+	TagErrors     []tagFailure `json:"tag_errors,omitempty"`
+	// ArchivedObjects is how many archived source objects ARCHIVED_OBJECTS
+	// skipped, and RestoreRequests for how many a restore was requested.
+	ArchivedObjects int `json:"archived_objects,omitempty"`
+	RestoreRequests int `json:"restore_requests,omitempty"`
+	// RequesterPays is the usage of the requester-pays remotes, by remote.
+	RequesterPays map[string]requestUsage `json:"requester_pays,omitempty"`
+}
+
+func newRunSummary(config *Config, start time.Time) *runSummary {
+	return &runSummary{
+		Job:       config.JobName,
+		RunID:     config.runID,
+		TraceID:   config.span.traceID(),
+		StartedAt: start.UTC(),
+		Mode:      config.SyncMode,
+		Source:    remotePath("source", config.Source.Bucket, config.Source.Prefix),
+		Dest:      remotePath("dest", config.Dest.Bucket, config.Dest.Prefix),
+		DryRun:    config.DryRun,
+
+		DestStorageClass: config.Dest.StorageClass,
+	}
+}
+
+// rcloneExited records the exit code of the rclone sync, given the error
+// runSync returned.
+func (s *runSummary) rcloneExited(err error) {
+	code := 0
+	var exitErr *exec.ExitError
+	var interruptedErr *interruptedError
+	if errors.As(err, &interruptedErr) && interruptedErr.err == nil {
+		return
+	}
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		code = 1
+	}
+	s.RcloneExitCode = &code
+}
+
+// finish completes the summary with the outcome of the run. Later calls
+// have no effect.
+func (s *runSummary) finish(err error, stats RunStats) {
+	if !s.FinishedAt.IsZero() {
+		return
+	}
+	finished := time.Now().UTC()
+	s.FinishedAt = finished
+	s.Duration = finished.Sub(s.StartedAt).Seconds()
+	s.Stats = stats
+	s.ExitCode = exitCode(err)
+	s.Result = "success"
+	if err == nil {
+		return
+	}
+	s.Result = "failure"
+	var interruptedErr *interruptedError
+	var limitErr *deleteLimitError
+	switch {
+	case errors.As(err, &interruptedErr):
+		s.Result = "interrupted"
+	case errors.As(err, &limitErr):
+		s.Result = "partial"
+		s.SkippedDeletes = limitErr.skipped
+	}
+	s.Error = err.Error()
+	s.ErrorClass = errorClass(err)
+	var rcloneErr *rcloneError
+	if errors.As(err, &rcloneErr) {
+		s.RcloneErrors = rcloneErr.classes
+	}
+}
+
+// summaryMu serializes writes of concurrent jobs to stdout and SUMMARY_FILE.
+var summaryMu sync.Mutex
+
+// resetSummaryFile empties SUMMARY_FILE at the start of a run, so that it
+// only holds the summaries of the latest one.
+func resetSummaryFile(config *Config) error {
+	if config.SummaryFile == "" {
+		return nil
+	}
+	summaryMu.Lock()
+	defer summaryMu.Unlock()
+	if err := os.WriteFile(config.SummaryFile, nil, 0o644); err != nil {
+		return fmt.Errorf("failed to reset SUMMARY_FILE: %w", err)
+	}
+	return nil
+}
+
+// writeSummary prints s to stdout and appends it to SUMMARY_FILE. Failing to
+// write the file is logged but doesn't fail the run.
+func writeSummary(config *Config, s *runSummary, logger *logrus.Logger) {
+	line, err := json.Marshal(s)
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode the run summary")
+		return
+	}
+	line = append(line, '\n')
+
+	summaryMu.Lock()
+	defer summaryMu.Unlock()
+	os.Stdout.Write(line)
+	if config.SummaryFile == "" {
+		return
+	}
+	f, err := os.OpenFile(config.SummaryFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err == nil {
+		_, err = f.Write(line)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		logger.WithError(err).WithField("summary_file", config.SummaryFile).Warn("Failed to write the run summary")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// readSummaries decodes the run summaries in the JSON lines of data that
+// have a run_id, skipping the log entries.
+func readSummaries(t *testing.T, data string) []runSummary {
+	t.Helper()
+	var summaries []runSummary
+	for _, line := range strings.Split(data, "\n") {
+		if !strings.Contains(line, `"run_id"`) || strings.Contains(line, `"msg"`) {
+			continue
+		}
+		var s runSummary
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			t.Fatalf("summary %q: %v", line, err)
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
+
+func TestRunSummary(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+	file := filepath.Join(t.TempDir(), "summary.jsonl")
+	if err := os.WriteFile(file, []byte("{\"stale\":true}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SUMMARY_FILE": file, "DRY_RUN": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != 0 {
+		t.Fatalf("run = %d, want 0:\n%s", result.code, out)
+	}
+
+	printed := readSummaries(t, out)
+	if len(printed) != 1 {
+		t.Fatalf("printed %d summaries, want 1:\n%s", len(printed), out)
+	}
+	s := printed[0]
+	if s.Result != "success" || s.Mode != "sync" || !s.DryRun || s.Source != "source:source-bucket" || s.Dest != "dest:dest-bucket/source-bucket" {
+		t.Errorf("summary = %+v", s)
+	}
+	if s.RcloneExitCode == nil || *s.RcloneExitCode != 0 || s.ExitCode != 0 || s.RunID == "" {
+		t.Errorf("summary = %+v, want rclone exit code 0 and a run ID", s)
+	}
+	if s.FinishedAt.Before(s.StartedAt) {
+		t.Errorf("finished at %v, before starting at %v", s.FinishedAt, s.StartedAt)
+	}
+
+	// SUMMARY_FILE is emptied when the run starts.
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written := readSummaries(t, string(data)); len(written) != 1 || strings.Contains(string(data), "stale") || written[0].RunID != s.RunID {
+		t.Errorf("SUMMARY_FILE = %q, want the printed summary only", data)
+	}
+}
+
+func TestRunSummaryFailure(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+echo "ERROR : a.txt: Failed to copy: AccessDenied: Access Denied" >&2
+exit 1`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+
+	summaries := readSummaries(t, out)
+	if len(summaries) != 1 {
+		t.Fatalf("printed %d summaries, want 1:\n%s", len(summaries), out)
+	}
+	s := summaries[0]
+	if s.Result != "failure" || s.ExitCode != result.code || s.ExitCode != exitSyncFailed || s.ErrorClass != "sync" {
+		t.Errorf("summary = %+v, want a sync failure exiting %d", s, exitSyncFailed)
+	}
+	if s.RcloneExitCode == nil || *s.RcloneExitCode != 1 {
+		t.Errorf("rclone_exit_code = %v, want 1", s.RcloneExitCode)
+	}
+	if len(s.RcloneErrors) != 1 || s.RcloneErrors[0].Class != "access_denied" || s.RcloneErrors[0].Count != 1 {
+		t.Errorf("rclone_errors = %+v, want one access_denied", s.RcloneErrors)
+	}
+}
+
+func TestRcloneExited(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		err  error
+		want *int
+	}{
+		{"success", nil, ptr(0)},
+		{"exit code", exec.Command("sh", "-c", "exit 3").Run(), ptr(3)},
+		{"not started", errors.New("exec: rclone: not found"), ptr(1)},
+		{"interrupted before the sync", &interruptedError{sig: syscall.SIGTERM}, nil},
+		{"interrupted sync", &interruptedError{sig: syscall.SIGTERM, err: exec.Command("sh", "-c", "exit 9").Run()}, ptr(9)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var s runSummary
+			s.rcloneExited(tt.err)
+			switch {
+			case tt.want == nil && s.RcloneExitCode != nil:
+				t.Errorf("rclone_exit_code = %d, want null", *s.RcloneExitCode)
+			case tt.want != nil && (s.RcloneExitCode == nil || *s.RcloneExitCode != *tt.want):
+				t.Errorf("rclone_exit_code = %v, want %d", s.RcloneExitCode, *tt.want)
+			}
+		})
+	}
+}
+
+func TestSummaryResult(t *testing.T) {
+	failed := errors.New("exit status 1")
+	for _, tt := range []struct {
+		err     error
+		result  string
+		skipped int
+	}{
+		{nil, "success", 0},
+		{failed, "failure", 0},
+		{&interruptedError{sig: syscall.SIGTERM, err: failed}, "interrupted", 0},
+		{&deleteLimitError{limit: 10, skipped: 4, err: failed}, "partial", 4},
+	} {
+		s := runSummary{StartedAt: time.Now().UTC()}
+		s.finish(tt.err, RunStats{Transfers: 2})
+		if s.Result != tt.result || s.SkippedDeletes != tt.skipped || s.Stats.Transfers != 2 {
+			t.Errorf("finish(%v): result %q, skipped %d, stats %+v; want %q and %d", tt.err, s.Result, s.SkippedDeletes, s.Stats, tt.result, tt.skipped)
+		}
+		if (tt.err == nil) != (s.Error == "") {
+			t.Errorf("finish(%v): error %q", tt.err, s.Error)
+		}
+		// Only the first outcome is recorded.
+		s.finish(failed, RunStats{})
+		if s.Result != tt.result {
+			t.Errorf("second finish changed the result from %q to %q", tt.result, s.Result)
+		}
+	}
+}
+
+func TestSummaryFileUnwritable(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+	file := filepath.Join(t.TempDir(), "missing", "summary.jsonl")
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SUMMARY_FILE": file}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	// The summary is still printed, and the run doesn't fail.
+	if result.code != 0 || len(readSummaries(t, out)) != 1 {
+		t.Errorf("run = %d with SUMMARY_FILE in a missing directory, want 0 and the summary printed:\n%s", result.code, out)
+	}
+	if entry := findEntry(logEntries(t, out), "Failed to write the run summary"); entry == nil || entry["level"] != "warning" {
+		t.Errorf("failed write logged as %v, want a warning", entry)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tagCountHeader is how many tags an object has, in the answer to GetObject
+// and HeadObject. It is missing for an object without tags.
+const tagCountHeader = "X-Amz-Tagging-Count"
+
+// maxTagErrors bounds the tagging failures listed in the run summary; all
+// are logged and counted.
+const maxTagErrors = 20
+
+func validateTags(config *Config) error {
+	if !config.PreserveTags {
+		return nil
+	}
+	// rclone moves are tagged after the sync, when the sources are gone.
+	if config.SyncMode == "move" {
+		return fmt.Errorf("PRESERVE_TAGS is not available with SYNC_MODE=move")
+	}
+	return validateS3API(config, "PRESERVE_TAGS")
+}
+
+// tagFailure is an object whose tags couldn't be copied.
+type tagFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// tagReport counts the objects whose tags were copied during a run, and
+// collects the failures, which don't fail the run.
+type tagReport struct {
+	mu       sync.Mutex
+	tagged   int
+	failed   int
+	failures []tagFailure
+}
+
+func (r *tagReport) record(key string, err error, logger *logrus.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		r.tagged++
+		return
+	}
+	r.failed++
+	if len(r.failures) < maxTagErrors {
+		r.failures = append(r.failures, tagFailure{Key: key, Error: err.Error()})
+	}
+	logger.WithError(err).WithField("key", key).Warn("Failed to copy the tags of an object")
+}
+
+// summarize adds the counts to the run summary.
+func (r *tagReport) summarize(report *runSummary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report.TaggedObjects = r.tagged
+	report.TagFailures = r.failed
+	report.TagErrors = r.failures
+}
+
+// copyTags copies the tags of the source object key to its copy. header, if
+// not nil, is that of the source object from GetObject; without a tag count
+// in it the object has no tags, and nothing is sent at all. Otherwise
+// GetObjectTagging is the one call made for an object without tags.
+func copyTags(ctx context.Context, config *Config, src, dst *s3Client, key string, header http.Header, logger *logrus.Logger) {
+	if header != nil && header.Get(tagCountHeader) == "" {
+		return
+	}
+	tags, err := src.getTagging(ctx, config.Source.Bucket, joinKey(config.Source.Prefix, key))
+	if err == nil && len(tags) == 0 {
+		return
+	}
+	if err == nil {
+		err = dst.putTagging(ctx, config.Dest.Bucket, joinKey(config.Dest.Prefix, key), tags)
+	}
+	config.tags.record(key, err, logger)
+}
+
+// tagTransferred copies the tags of the objects rclone copied, which it
+// doesn't do itself, after the sync. The keys come from the manifest;
+// CHECKERS objects are tagged at once.
+func tagTransferred(config *Config, logger *logrus.Logger) {
+	span := config.span.child("tags")
+	defer func() {
+		span.set("tagged", config.tags.tagged)
+		span.set("failed", config.tags.failed)
+		span.end(nil)
+	}()
+	fail := func(err error) {
+		config.tags.record("", err, logger)
+	}
+	if err := config.manifest.close(); err != nil {
+		fail(fmt.Errorf("failed to write the manifest: %w", err))
+		return
+	}
+	src, err := newS3Client(config.Source, config.Retries, config.Checkers)
+	if err != nil {
+		fail(err)
+		return
+	}
+	dst, err := newS3Client(config.Dest, config.Retries, config.Checkers)
+	if err != nil {
+		fail(err)
+		return
+	}
+	file, err := os.Open(config.manifest.path)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		fail(fmt.Errorf("failed to read the manifest: %w", err))
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-shutdown.interrupted():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	keys := make(chan string)
+	var workers sync.WaitGroup
+	for i := 0; i < config.Checkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for key := range keys {
+				copyTags(ctx, config, src, dst, key, nil, logger)
+			}
+		}()
+	}
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() && ctx.Err() == nil {
+		var entry manifestEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry.Action == "copied" {
+			keys <- entry.Key
+		}
+	}
+	close(keys)
+	workers.Wait()
+	if err := scanner.Err(); err != nil {
+		fail(fmt.Errorf("failed to read the manifest: %w", err))
+	}
+	logger.WithFields(logrus.Fields{"tagged": config.tags.tagged, "failed": config.tags.failed}).Info("Copied the tags of the transferred objects")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateTags(t *testing.T) {
+	_, err := loadTestConfig(t, map[string]string{"PRESERVE_TAGS": "true", "SYNC_MODE": "move", "CONFIRM_MOVE": "true"})
+	wantError(t, err, "PRESERVE_TAGS is not available with SYNC_MODE=move")
+	_, err = loadTestConfig(t, map[string]string{"PRESERVE_TAGS": "true", "DEST_V2_AUTH": "true"})
+	wantError(t, err, "PRESERVE_TAGS is not supported with DEST_V2_AUTH")
+}
+
+var mediaTags = []s3Tag{{Key: "team", Value: "media"}, {Key: "cost-center", Value: "42"}}
+
+// runTagged runs a sync with PRESERVE_TAGS from the source-bucket of src to
+// the backup prefix of the dest-bucket of dst, and returns its exit code and
+// summary.
+func runTagged(t *testing.T, src, dst *fakeS3, env map[string]string) (int, runSummary) {
+	t.Helper()
+	if _, ok := env["RCLONE_PATH"]; !ok {
+		path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+exit 0`)
+		env["RCLONE_PATH"] = path
+	}
+	env["SOURCE_S3_ENDPOINT"], env["DEST_S3_ENDPOINT"] = src.URL, dst.URL
+	env["DEST_PREFIX"], env["PRESERVE_TAGS"] = "backup", "true"
+	setTestEnv(t, withEnv(env))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	summaries := readSummaries(t, out)
+	if len(summaries) != 1 {
+		t.Fatalf("summaries %+v:\n%s", summaries, out)
+	}
+	return result.code, summaries[0]
+}
+
+func TestNativeCopiesTags(t *testing.T) {
+	src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+	src.put("source-bucket", "a.txt", "tagged", nil).tags = mediaTags
+	src.put("source-bucket", "b.txt", "untagged", nil)
+	code, summary := runTagged(t, src, dst, map[string]string{"ENGINE": "native"})
+	if code != 0 {
+		t.Fatalf("run = %d, want 0", code)
+	}
+	if o := dst.object("dest-bucket", "backup/a.txt"); o == nil || !slices.Equal(o.tags, mediaTags) {
+		t.Errorf("copy of a.txt = %+v, want the tags of the source", o)
+	}
+	// The untagged object costs no tagging calls: GetObject says it has
+	// none.
+	if got := src.ops("GetObjectTagging"); !slices.Equal(got, []string{"GetObjectTagging source-bucket/a.txt"}) {
+		t.Errorf("read the tags of %q, want a.txt only", got)
+	}
+	if got := dst.ops("PutObjectTagging"); !slices.Equal(got, []string{"PutObjectTagging dest-bucket/backup/a.txt"}) {
+		t.Errorf("tagged %q, want backup/a.txt only", got)
+	}
+	if summary.TaggedObjects != 1 || summary.TagFailures != 0 {
+		t.Errorf("summary counts %d tagged and %d failed, want 1 and 0", summary.TaggedObjects, summary.TagFailures)
+	}
+}
+
+func TestNativeServerSideCopiesTags(t *testing.T) {
+	s3 := newFakeS3(t, "source-bucket", "dest-bucket")
+	s3.put("source-bucket", "a.txt", "tagged", nil).tags = mediaTags
+	s3.put("source-bucket", "b.txt", "untagged", nil)
+	code, summary := runTagged(t, s3, s3, map[string]string{"ENGINE": "native", "DEST_ACCESS_KEY": "source-access", "DEST_SECRET_KEY": "source-secret"})
+	if code != 0 {
+		t.Fatalf("run = %d, want 0", code)
+	}
+	// CopyObject copies the tags along.
+	for _, r := range s3.received("CopyObject") {
+		if r.header.Get("X-Amz-Tagging-Directive") != "COPY" {
+			t.Errorf("%s without X-Amz-Tagging-Directive: COPY", r)
+		}
+	}
+	if o := s3.object("dest-bucket", "backup/a.txt"); o == nil || !slices.Equal(o.tags, mediaTags) {
+		t.Errorf("copy of a.txt = %+v, want the tags of the source", o)
+	}
+	if got := s3.ops("GetObjectTagging", "PutObjectTagging"); len(got) != 0 {
+		t.Errorf("server-side copies sent %q", got)
+	}
+	if summary.TaggedObjects != 1 {
+		t.Errorf("summary counts %d tagged objects, want 1", summary.TaggedObjects)
+	}
+}
+
+func TestTagFailures(t *testing.T) {
+	src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+	src.put("source-bucket", "a.txt", "tagged", nil).tags = mediaTags
+	dst.fail = func(op, bucket, key string) (int, string) {
+		if op == "PutObjectTagging" {
+			return http.StatusForbidden, "AccessDenied"
+		}
+		return 0, ""
+	}
+	code, summary := runTagged(t, src, dst, map[string]string{"ENGINE": "native"})
+	// The object is copied; only its tags are missing.
+	if code != 0 || dst.object("dest-bucket", "backup/a.txt") == nil {
+		t.Fatalf("run = %d, want 0 with a.txt copied", code)
+	}
+	if summary.TagFailures != 1 || len(summary.TagErrors) != 1 || summary.TagErrors[0].Key != "a.txt" || !strings.Contains(summary.TagErrors[0].Error, "AccessDenied") {
+		t.Errorf("summary counts %d failures: %+v", summary.TagFailures, summary.TagErrors)
+	}
+}
+
+func TestTagTransferred(t *testing.T) {
+	src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+	src.put("source-bucket", "a.txt", "tagged", nil).tags = mediaTags
+	src.put("source-bucket", "b.txt", "untagged", nil)
+	for _, key := range []string{"a.txt", "b.txt", "old.txt"} {
+		dst.put("dest-bucket", "backup/"+key, "copied", nil)
+	}
+	// rclone copies the objects, but not their tags.
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+if [ "$1" = sync ]; then
+	echo '{"level":"info","msg":"Copied (new)","object":"a.txt","size":6}' >&2
+	echo '{"level":"info","msg":"Copied (replaced existing)","object":"b.txt","size":8}' >&2
+	echo '{"level":"info","msg":"Deleted","object":"old.txt"}' >&2
+fi
+exit 0`)
+	code, summary := runTagged(t, src, dst, map[string]string{"RCLONE_PATH": path})
+	if code != 0 {
+		t.Fatalf("run = %d, want 0", code)
+	}
+	if runs := readCalls(t, calls); !slices.Contains(strings.Fields(runs[len(runs)-1]), "-v") {
+		t.Errorf("sync ran %q, want -v for the per-file lines", runs[len(runs)-1])
+	}
+	if got := src.ops("GetObjectTagging"); len(got) != 2 {
+		t.Errorf("read the tags of %q, want the two copies", got)
+	}
+	if got := dst.ops("PutObjectTagging"); !slices.Equal(got, []string{"PutObjectTagging dest-bucket/backup/a.txt"}) {
+		t.Errorf("tagged %q, want backup/a.txt only", got)
+	}
+	if o := dst.object("dest-bucket", "backup/a.txt"); !slices.Equal(o.tags, mediaTags) {
+		t.Errorf("tags of a.txt = %+v, want those of the source", o.tags)
+	}
+	if summary.TaggedObjects != 1 {
+		t.Errorf("summary counts %d tagged objects, want 1", summary.TaggedObjects)
+	}
+}
+
+func TestTagsDryRun(t *testing.T) {
+	src, dst := newFakeS3(t, "source-bucket"), newFakeS3(t, "dest-bucket")
+	src.put("source-bucket", "a.txt", "tagged", nil).tags = mediaTags
+	code, _ := runTagged(t, src, dst, map[string]string{"ENGINE": "native", "DRY_RUN": "true"})
+	if code != 0 {
+		t.Fatalf("run = %d, want 0", code)
+	}
+	if got := dst.ops("PutObject", "PutObjectTagging"); len(got) != 0 {
+		t.Errorf("dry run sent %q", got)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+func validateSyncTimeout(config *Config) error {
+	for _, d := range []struct {
+		key   string
+		value string
+	}{{"SYNC_TIMEOUT", config.SyncTimeout}, {"JOBS_TIMEOUT", config.JobsTimeout}} {
+		if d.value == "" {
+			continue
+		}
+		if v, err := time.ParseDuration(d.value); err != nil || v <= 0 {
+			return fmt.Errorf("invalid %s %q: must be a positive duration like 6h", d.key, d.value)
+		}
+	}
+	return nil
+}
+
+// timeoutError reports that the sync was stopped at SYNC_TIMEOUT or
+// JOBS_TIMEOUT.
+type timeoutError struct {
+	timeout string
+	err     error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s reached, the sync was stopped: %v", e.timeout, e.err)
+}
+
+func (e *timeoutError) Unwrap() error { return e.err }
+
+// syncContext returns the context the rclone sync runs in, which ends at
+// SYNC_TIMEOUT or at the JOBS_TIMEOUT deadline of a multi-job run, whichever
+// comes first, and the setting that ends it.
+func syncContext(config *Config) (context.Context, context.CancelFunc, string) {
+	deadline, timeout := config.jobsDeadline, "JOBS_TIMEOUT"
+	if d := parseOptionalDuration(config.SyncTimeout); d > 0 {
+		if at := time.Now().Add(d); deadline.IsZero() || at.Before(deadline) {
+			deadline, timeout = at, "SYNC_TIMEOUT"
+		}
+	}
+	if deadline.IsZero() {
+		ctx, cancel := context.WithCancel(context.Background())
+		return ctx, cancel, ""
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	return ctx, cancel, timeout
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateSyncTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"SYNC_TIMEOUT": "6h", "JOBS_TIMEOUT": "12h"}, ""},
+		{map[string]string{"SYNC_TIMEOUT": "6"}, `invalid SYNC_TIMEOUT "6": must be a positive duration like 6h`},
+		{map[string]string{"SYNC_TIMEOUT": "-1h"}, `invalid SYNC_TIMEOUT "-1h"`},
+		{map[string]string{"JOBS_TIMEOUT": "0s"}, `invalid JOBS_TIMEOUT "0s"`},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestSyncContext(t *testing.T) {
+	soon, later := time.Now().Add(time.Minute), time.Now().Add(2*time.Hour)
+	for _, tt := range []struct {
+		name   string
+		config *Config
+		want   string
+		// deadline is about when the context ends, or zero for never.
+		deadline time.Time
+	}{
+		{"none", &Config{}, "", time.Time{}},
+		{"sync timeout", &Config{SyncTimeout: "1h"}, "SYNC_TIMEOUT", time.Now().Add(time.Hour)},
+		{"jobs deadline", &Config{jobsDeadline: soon}, "JOBS_TIMEOUT", soon},
+		{"jobs deadline first", &Config{SyncTimeout: "1h", jobsDeadline: soon}, "JOBS_TIMEOUT", soon},
+		{"sync timeout first", &Config{SyncTimeout: "1h", jobsDeadline: later}, "SYNC_TIMEOUT", time.Now().Add(time.Hour)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel, timeout := syncContext(tt.config)
+			defer cancel()
+			if timeout != tt.want {
+				t.Errorf("timeout = %q, want %q", timeout, tt.want)
+			}
+			deadline, ok := ctx.Deadline()
+			switch {
+			case tt.deadline.IsZero() && ok:
+				t.Errorf("deadline %v, want none", deadline)
+			case !tt.deadline.IsZero() && (deadline.Before(tt.deadline.Add(-time.Second)) || deadline.After(tt.deadline.Add(time.Second))):
+				t.Errorf("deadline %v, want about %v", deadline, tt.deadline)
+			}
+		})
+	}
+}
+
+func TestSyncTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// script is how rclone reacts to SIGINT.
+		script string
+	}{
+		{"stops on SIGINT", `trap 'exit 1' INT`},
+		{"killed after SHUTDOWN_GRACE", `trap '' INT`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+`+tt.script+`
+echo '{"level":"notice","msg":"stats","stats":{"bytes":2048,"transfers":2,"checks":5}}' >&2
+sleep 10
+exit 0`)
+			setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "SYNC_TIMEOUT": "200ms", "SHUTDOWN_GRACE": "200ms"}))
+			start := time.Now()
+			var result runResult
+			out := captureOutput(t, func() { result, _ = run(nil) })
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("run took %v, want rclone stopped after SYNC_TIMEOUT", elapsed)
+			}
+			if result.code != exitSyncFailed {
+				t.Errorf("run = %d, want %d:\n%s", result.code, exitSyncFailed, out)
+			}
+			entries := logEntries(t, out)
+			if entry := findEntry(entries, "S3 sync job failed"); entry == nil || entry["error_class"] != "timeout" ||
+				!strings.HasPrefix(entry["error"].(string), "SYNC_TIMEOUT reached, the sync was stopped") {
+				t.Errorf("failure logged as %v, want a SYNC_TIMEOUT timeout", entry)
+			}
+			if entry := findEntry(entries, "The sync took too long and rclone was stopped; the counts are those of its last stats line"); entry == nil || entry["bytes_transferred"] != 2048.0 {
+				t.Errorf("timeout logged as %v, want the last stats", entry)
+			}
+		})
+	}
+}
+
+func TestJobsTimeout(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+trap 'exit 1' INT
+case "$2" in *slow*) sleep 10 ;; esac
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{
+		"RCLONE_PATH":     path,
+		"SOURCE_BUCKET":   "",
+		"SOURCE_BUCKET_1": "fast",
+		"SOURCE_BUCKET_2": "slow",
+		"JOB_CONCURRENCY": "2",
+		"JOBS_TIMEOUT":    "300ms",
+	}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != exitSyncFailed {
+		t.Errorf("run = %d, want %d:\n%s", result.code, exitSyncFailed, out)
+	}
+	for _, entry := range logEntries(t, out) {
+		if entry["msg"] != "Job result" {
+			continue
+		}
+		want := "succeeded"
+		if entry["job"] == "slow" {
+			want = "failed"
+		}
+		if entry["status"] != want {
+			t.Errorf("job %v %v, want %s", entry["job"], entry["status"], want)
+		}
+	}
+	if !strings.Contains(out, "JOBS_TIMEOUT reached, the sync was stopped") {
+		t.Errorf("JOBS_TIMEOUT not reported:\n%s", out)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var traceClient = &http.Client{Timeout: 10 * time.Second}
+
+// processStart and configLoaded bound the config-load span of the first
+// trace of the process; later runs of a scheduled process don't load it.
+var (
+	processStart   = time.Now()
+	configLoaded   time.Time
+	configLoadOnce sync.Once
+)
+
+func validateTracing(config *Config) error {
+	if config.OTelEndpoint == "" && config.OTelTracesEndpoint == "" {
+		if config.OTelHeaders != "" {
+			return fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS requires OTEL_EXPORTER_OTLP_ENDPOINT")
+		}
+		return nil
+	}
+	for _, endpoint := range []struct{ key, value string }{
+		{"OTEL_EXPORTER_OTLP_ENDPOINT", config.OTelEndpoint},
+		{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", config.OTelTracesEndpoint},
+	} {
+		if endpoint.value == "" {
+			continue
+		}
+		if u, err := url.Parse(endpoint.value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid %s: must be an http(s) URL like http://otel-collector:4318", endpoint.key)
+		}
+	}
+	// Without the OpenTelemetry SDK, spans are exported as OTLP JSON, which
+	// collectors accept on the same port as protobuf.
+	if config.OTelProtocol != "" && config.OTelProtocol != "http/json" {
+		return fmt.Errorf("invalid OTEL_EXPORTER_OTLP_PROTOCOL %q: only http/json is supported", config.OTelProtocol)
+	}
+	_, err := parseOTelHeaders(config.OTelHeaders)
+	return err
+}
+
+// tracesURL returns where spans are exported: the traces endpoint, or the
+// OTLP endpoint with /v1/traces, as the OpenTelemetry specification has it.
+// It is "" when tracing is off.
+func tracesURL(config *Config) string {
+	if config.OTelTracesEndpoint != "" {
+		return config.OTelTracesEndpoint
+	}
+	if config.OTelEndpoint != "" {
+		return strings.TrimSuffix(config.OTelEndpoint, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// parseOTelHeaders parses OTEL_EXPORTER_OTLP_HEADERS, a comma-separated
+// list of key=value pairs with URL-encoded values.
+func parseOTelHeaders(value string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range splitPatterns(value, ",") {
+		key, v, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		decoded, err := url.QueryUnescape(strings.TrimSpace(v))
+		if !ok || key == "" || err != nil {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS: must look like api-key=secret,tenant=media")
+		}
+		headers[key] = decoded
+	}
+	return headers, nil
+}
+
+// trace collects the spans of one run and exports them when its root span
+// ends.
+type trace struct {
+	config *Config
+	logger *logrus.Logger
+	id     string
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+// span is a phase of a run. A nil span is the no-op tracer used without an
+// OTLP endpoint: its methods do nothing, so phases are traced
+// unconditionally.
+type span struct {
+	trace  *trace
+	id     string
+	parent string
+	name   string
+	start  time.Time
+	attrs  map[string]interface{}
+}
+
+// startJobSpan starts the span of a job: a child of the root span of a
+// multi-job run, or the root span of its own trace.
+func startJobSpan(config *Config, logger *logrus.Logger) *span {
+	s := config.traceParent.child("job")
+	if config.traceParent == nil {
+		s = startTrace(config, "sync", logger)
+	}
+	s.set("run_id", config.runID)
+	if config.JobName != "" {
+		s.set("job", config.JobName)
+	}
+	s.set("source_bucket", config.Source.Bucket)
+	s.set("dest_bucket", config.Dest.Bucket)
+	s.set("mode", config.SyncMode)
+	s.set("dry_run", config.DryRun)
+	return s
+}
+
+// startTrace starts the root span of a run, or returns nil if tracing is
+// off. The first trace of the process also gets the config-load span.
+func startTrace(config *Config, name string, logger *logrus.Logger) *span {
+	if tracesURL(config) == "" {
+		return nil
+	}
+	t := &trace{config: config, logger: logger, id: randomHex(16)}
+	root := t.newSpan(name, "")
+	if config.RunID != "" {
+		root.set("run_id", config.RunID)
+	}
+	configLoadOnce.Do(func() {
+		if configLoaded.IsZero() {
+			return
+		}
+		root.start = processStart
+		load := t.newSpan("config-load", root.id)
+		load.start = processStart
+		load.endAt(configLoaded, nil)
+	})
+	return root
+}
+
+func (t *trace) newSpan(name, parent string) *span {
+	return &span{
+		trace:  t,
+		id:     randomHex(8),
+		parent: parent,
+		name:   name,
+		start:  time.Now(),
+		attrs:  make(map[string]interface{}),
+	}
+}
+
+// child starts a span for a phase of s.
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	return s.trace.newSpan(name, s.id)
+}
+
+// set adds an attribute to the span.
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = value
+}
+
+// traceID returns the ID of the trace of s, for the run summary, or "".
+func (s *span) traceID() string {
+	if s == nil {
+		return ""
+	}
+	return s.trace.id
+}
+
+// end ends the span, failed if err is set. Ending the root span exports the
+// trace.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.endAt(time.Now(), err)
+	if s.parent == "" {
+		s.trace.export()
+	}
+}
+
+// fail ends the span with err and returns err.
+func (s *span) fail(err error) error {
+	s.end(err)
+	return err
+}
+
+func (s *span) endAt(end time.Time, err error) {
+	out := otlpSpan{
+		TraceID:           s.trace.id,
+		SpanID:            s.id,
+		ParentSpanID:      s.parent,
+		Name:              s.name,
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Status:            otlpStatus{Code: otlpStatusOK},
+	}
+	if err != nil {
+		out.Status = otlpStatus{Code: otlpStatusError, Message: err.Error()}
+		s.attrs["error_class"] = errorClass(err)
+		if class := rcloneErrorClass(err); class != "" {
+			s.attrs["rclone_error_class"] = string(class)
+		}
+	}
+	for key, value := range s.attrs {
+		out.Attributes = append(out.Attributes, otlpAttribute(key, value))
+	}
+	s.trace.mu.Lock()
+	s.trace.spans = append(s.trace.spans, out)
+	s.trace.mu.Unlock()
+}
+
+// export sends the spans of the trace. A failed export is logged and
+// doesn't affect the run.
+func (t *trace) export() {
+	t.mu.Lock()
+	spans := t.spans
+	t.mu.Unlock()
+
+	hostname, _ := os.Hostname()
+	service := t.config.OTelServiceName
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{
+					otlpAttribute("service.name", service),
+					otlpAttribute("host.name", hostname),
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "s3-sync"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err == nil {
+		headers, _ := parseOTelHeaders(t.config.OTelHeaders)
+		err = deliver(traceClient, http.MethodPost, tracesURL(t.config), body, headers)
+	}
+	entry := t.logger.WithFields(logrus.Fields{"trace_id": t.id, "spans": len(spans)})
+	if err != nil {
+		entry.WithError(err).Warn("Failed to export the trace")
+		return
+	}
+	entry.Debug("Exported the trace")
+}
+
+const (
+	otlpKindInternal = 1
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+)
+
+// otlpSpan is a span in the JSON encoding of OTLP.
+type otlpSpan struct {
+	TraceID           string        `json:"traceId"`
+	SpanID            string        `json:"spanId"`
+	ParentSpanID      string        `json:"parentSpanId,omitempty"`
+	Name              string        `json:"name"`
+	Kind              int           `json:"kind"`
+	StartTimeUnixNano string        `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string        `json:"endTimeUnixNano"`
+	Attributes        []interface{} `json:"attributes,omitempty"`
+	Status            otlpStatus    `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpAttribute encodes an attribute; OTLP JSON has 64-bit integers as
+// strings.
+func otlpAttribute(key string, value interface{}) interface{} {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		v = map[string]interface{}{"doubleValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return map[string]interface{}{"key": key, "value": v}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t := time.Now().UnixNano()
+		for i := range b {
+			b[i] = byte(t >> (8 * (i % 8)))
+		}
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateTracing(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"OTEL_EXPORTER_OTLP_HEADERS": "api-key=secret"}, "OTEL_EXPORTER_OTLP_HEADERS requires OTEL_EXPORTER_OTLP_ENDPOINT"},
+		{map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "otel-collector:4318"}, "invalid OTEL_EXPORTER_OTLP_ENDPOINT: must be an http(s) URL"},
+		{map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "grpc://otel-collector:4317"}, "invalid OTEL_EXPORTER_OTLP_TRACES_ENDPOINT: must be an http(s) URL"},
+		{map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://otel-collector:4318", "OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"}, `invalid OTEL_EXPORTER_OTLP_PROTOCOL "grpc": only http/json is supported`},
+		{map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://otel-collector:4318", "OTEL_EXPORTER_OTLP_HEADERS": "api-key"}, "invalid OTEL_EXPORTER_OTLP_HEADERS"},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestTracesURL(t *testing.T) {
+	for _, tt := range []struct {
+		config Config
+		want   string
+	}{
+		{Config{}, ""},
+		{Config{OTelEndpoint: "http://otel:4318/"}, "http://otel:4318/v1/traces"},
+		{Config{OTelEndpoint: "http://otel:4318", OTelTracesEndpoint: "http://tempo:4318/traces"}, "http://tempo:4318/traces"},
+	} {
+		if got := tracesURL(&tt.config); got != tt.want {
+			t.Errorf("tracesURL(%+v) = %q, want %q", tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestParseOTelHeaders(t *testing.T) {
+	headers, err := parseOTelHeaders("api-key=s%3Dcret, tenant = media")
+	if err != nil || len(headers) != 2 || headers["api-key"] != "s=cret" || headers["tenant"] != "media" {
+		t.Errorf("parseOTelHeaders = %v, %v", headers, err)
+	}
+}
+
+func TestTracingOff(t *testing.T) {
+	// Without an endpoint the spans are nil and do nothing.
+	s := startTrace(&Config{}, "sync", nil)
+	if s != nil {
+		t.Fatalf("startTrace = %+v, want nil", s)
+	}
+	child := s.child("preflight")
+	child.set("bytes", 1)
+	child.end(nil)
+	if err := errors.New("failed"); s.fail(err) != err || s.traceID() != "" {
+		t.Error("the no-op span changed the error or has a trace ID")
+	}
+}
+
+// collectedSpan is a span as the collector received it.
+type collectedSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Attributes   []struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	} `json:"attributes"`
+	Status otlpStatus `json:"status"`
+}
+
+func (s collectedSpan) attr(key string) any {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// tracedRun runs a sync through a fake rclone exiting with exit, exporting to
+// a fake collector, and returns the spans it received by name and the run
+// output.
+func tracedRun(t *testing.T, exit string) (map[string]collectedSpan, string) {
+	t.Helper()
+	var received []collectedSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("api-key") != "secret" {
+			t.Errorf("exported to %s with api-key %q", r.URL.Path, r.Header.Get("api-key"))
+		}
+		var payload struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []collectedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		for _, rs := range payload.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				received = append(received, ss.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = sync ] && echo '{"level":"notice","msg":"stats","stats":{"bytes":2048,"transfers":2}}' >&2
+exit `+exit)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "OTEL_EXPORTER_OTLP_ENDPOINT": collector.URL, "OTEL_EXPORTER_OTLP_HEADERS": "api-key=secret"}))
+	out := captureOutput(t, func() { run(nil) })
+	spans := make(map[string]collectedSpan)
+	for _, s := range received {
+		spans[s.Name] = s
+	}
+	return spans, out
+}
+
+func TestRunExportsTrace(t *testing.T) {
+	spans, out := tracedRun(t, "0")
+	root, ok := spans["sync"]
+	if !ok || root.ParentSpanID != "" || root.Status.Code != otlpStatusOK {
+		t.Fatalf("root span = %+v, spans %v", root, spans)
+	}
+	if root.attr("source_bucket") != "source-bucket" || root.attr("dest_bucket") != "dest-bucket" || root.attr("bytes") != "2048" {
+		t.Errorf("root span attributes %+v", root.Attributes)
+	}
+	for _, name := range []string{"preflight", "estimate", "rclone"} {
+		if s, ok := spans[name]; !ok || s.ParentSpanID != root.SpanID || s.TraceID != root.TraceID {
+			t.Errorf("%s span = %+v, want a child of the root span", name, s)
+		}
+	}
+	if s := spans["rclone"]; s.attr("transfers") != "2" {
+		t.Errorf("rclone span attributes %+v", s.Attributes)
+	}
+	// The summary joins the logs to the trace.
+	if summaries := readSummaries(t, out); len(summaries) != 1 || summaries[0].TraceID != root.TraceID {
+		t.Errorf("summary = %+v, want trace ID %s", summaries, root.TraceID)
+	}
+}
+
+func TestRunExportsFailedTrace(t *testing.T) {
+	spans, _ := tracedRun(t, "1")
+	for _, name := range []string{"sync", "rclone"} {
+		s := spans[name]
+		if s.Status.Code != otlpStatusError || s.Status.Message == "" || s.attr("error_class") != "sync" {
+			t.Errorf("%s span = %+v, want it failed with error class sync", name, s)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// verifyResult holds the counts from rclone check's closing summary.
+type verifyResult struct {
+	Matched     int `json:"matched"`
+	Differences int `json:"differences"`
+	Missing     int `json:"missing"`
+	Errors      int `json:"errors"`
+}
+
+func (r verifyResult) ok() bool {
+	return r.Differences == 0 && r.Missing == 0 && r.Errors == 0
+}
+
+func (r verifyResult) fields() logrus.Fields {
+	return logrus.Fields{
+		"verify_matched":     r.Matched,
+		"verify_differences": r.Differences,
+		"verify_missing":     r.Missing,
+		"verify_errors":      r.Errors,
+	}
+}
+
+// verifyError reports that the destination does not match the source.
+type verifyError struct {
+	result verifyResult
+}
+
+func (e *verifyError) Error() string {
+	return fmt.Sprintf("destination does not match the source: %d differences, %d missing, %d errors",
+		e.result.Differences, e.result.Missing, e.result.Errors)
+}
+
+// verifyPatterns map the NOTICE lines rclone check ends with, e.g.
+// "dest: 3 differences found", onto verifyResult fields.
+var verifyPatterns = []struct {
+	pattern *regexp.Regexp
+	field   func(*verifyResult) *int
+}{
+	{regexp.MustCompile(`(\d+) matching files`), func(r *verifyResult) *int { return &r.Matched }},
+	{regexp.MustCompile(`(\d+) differences found`), func(r *verifyResult) *int { return &r.Differences }},
+	{regexp.MustCompile(`(\d+) files missing`), func(r *verifyResult) *int { return &r.Missing }},
+	{regexp.MustCompile(`(\d+) errors while checking`), func(r *verifyResult) *int { return &r.Errors }},
+}
+
+// parseVerifyResult extracts the summary counts from rclone check output.
+// ok is false if no summary line was found, meaning the check itself failed.
+func parseVerifyResult(lines []string) (result verifyResult, ok bool) {
+	for _, line := range lines {
+		for _, p := range verifyPatterns {
+			if m := p.pattern.FindStringSubmatch(line); m != nil {
+				n, _ := strconv.Atoi(m[1])
+				*p.field(&result) = n
+				ok = true
+			}
+		}
+	}
+	return result, ok
+}
+
+// verifyArgs builds the rclone check command line. The check is one-way:
+// extra files in the destination are not an error. rclone check has no
+// modtime comparison, so only COMPARE_MODE=size-only relaxes it.
+func verifyArgs(config *Config) []string {
+	compare := "--checksum"
+	if config.CompareMode == "size-only" {
+		compare = "--size-only"
+	}
+	args := []string{
+		"check",
+		remotePath("source", config.Source.Bucket, config.Source.Prefix),
+		remotePath("dest", config.Dest.Bucket, config.Dest.Prefix),
+		compare,
+		"--one-way",
+		"--checkers", strconv.Itoa(config.Checkers),
+		"--retries", strconv.Itoa(config.Retries),
+	}
+	if config.FastList {
+		args = append(args, "--fast-list")
+	}
+	args = append(args, tpsArgs(config)...)
+	args = append(args, keyMatchingArgs(config)...)
+	args = append(args, filterArgs(config)...)
+	return append(args, config.RcloneExtraArgs...)
+}
+
+// runVerify compares the destination against the source. Mismatches are
+// reported through the result; the error is only set if rclone could not
+// complete the check at all.
+func runVerify(config *Config, remotes *rcloneRemotes, logger *logrus.Logger) (verifyResult, error) {
+	args := verifyArgs(config)
+	logger.WithField("args", args).Info("Starting verification")
+
+	stderr := newLineTail(100)
+	cmd := remotes.command(config, args...)
+	cmd.Stdout = scrubWriter{os.Stdout}
+	cmd.Stderr = io.MultiWriter(logOutput(), stderr)
+	logger.WithField("argv", cmd.Args).Debug("rclone command line")
+
+	// rclone check exits non-zero when it finds differences, so the exit
+	// status alone doesn't tell a mismatch from a failed check.
+	err := shutdown.run(cmd)
+	result, ok := parseVerifyResult(stderr.Lines())
+	if !ok {
+		if err == nil {
+			err = fmt.Errorf("no summary in output")
+		}
+		return result, fmt.Errorf("rclone check failed: %w", err)
+	}
+
+	entry := logger.WithFields(result.fields())
+	if result.ok() {
+		entry.Info("Verification succeeded")
+	} else {
+		entry.Error("Verification found differences between source and destination")
+	}
+	return result, nil
+}
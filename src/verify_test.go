@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseVerifyResult(t *testing.T) {
+	lines := []string{
+		"2024/05/01 10:00:00 ERROR : b.txt: sizes differ",
+		"2024/05/01 10:00:00 NOTICE: S3 bucket dest-bucket path source-bucket: 1 files missing",
+		"2024/05/01 10:00:00 NOTICE: S3 bucket dest-bucket path source-bucket: 2 differences found",
+		"2024/05/01 10:00:00 NOTICE: S3 bucket dest-bucket path source-bucket: 1 errors while checking",
+		"2024/05/01 10:00:00 NOTICE: S3 bucket dest-bucket path source-bucket: 40 matching files",
+	}
+	result, ok := parseVerifyResult(lines)
+	if want := (verifyResult{Matched: 40, Differences: 2, Missing: 1, Errors: 1}); !ok || result != want {
+		t.Errorf("parseVerifyResult = %+v, %v, want %+v", result, ok, want)
+	}
+	if result.ok() {
+		t.Error("a result with differences is ok")
+	}
+
+	result, ok = parseVerifyResult([]string{"NOTICE: S3 bucket dest-bucket: 0 differences found", "NOTICE: S3 bucket dest-bucket: 12 matching files"})
+	if !ok || !result.ok() || result.Matched != 12 {
+		t.Errorf("parseVerifyResult = %+v, %v, want 12 matching files", result, ok)
+	}
+	if _, ok := parseVerifyResult([]string{"Failed to create file system: directory not found"}); ok {
+		t.Error("parseVerifyResult found a summary in an error")
+	}
+}
+
+func TestVerifyArgs(t *testing.T) {
+	config, err := loadTestConfig(t, map[string]string{"SOURCE_PREFIX": "media", "CHECKERS": "16", "RETRIES": "2", "FAST_LIST": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := verifyArgs(config)
+	want := []string{"check", "source:source-bucket/media", "dest:dest-bucket/source-bucket/media", "--checksum", "--one-way", "--checkers", "16", "--retries", "2", "--fast-list"}
+	if len(args) < len(want) || !slices.Equal(args[:len(want)], want) {
+		t.Errorf("verifyArgs = %q, want it to start with %q", args, want)
+	}
+}
+
+func TestValidateVerify(t *testing.T) {
+	_, err := loadTestConfig(t, map[string]string{"VERIFY_AFTER_SYNC": "true", "SYNC_MODE": "move", "CONFIRM_MOVE": "true"})
+	wantError(t, err, "VERIFY_AFTER_SYNC cannot be used with SYNC_MODE=move")
+}
+
+// verifyRclone syncs successfully, and has rclone check print summary and
+// exit with code, 1 when it finds differences.
+func verifyRclone(t *testing.T, summary string, code int) (path, calls string) {
+	return fakeRclone(t, fmt.Sprintf(`[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = check ] && { printf '%s' >&2; exit %d; }
+exit 0`, summary, code))
+}
+
+func TestVerifyAfterSync(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		summary string
+		code    int
+		msg     string
+		counts  verifyResult
+	}{
+		{"match", `NOTICE: S3 bucket dest-bucket: 0 differences found\nNOTICE: S3 bucket dest-bucket: 3 matching files\n`, 0, "Verification succeeded", verifyResult{Matched: 3}},
+		{"differences", `NOTICE: S3 bucket dest-bucket: 2 differences found\nNOTICE: S3 bucket dest-bucket: 1 files missing\nNOTICE: S3 bucket dest-bucket: 3 matching files\n`, 6, "Verification found differences between source and destination", verifyResult{Matched: 3, Differences: 2, Missing: 1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path, calls := verifyRclone(t, tt.summary, min(tt.code, 1))
+			setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "VERIFY_AFTER_SYNC": "true"}))
+			var result runResult
+			out := captureOutput(t, func() { result, _ = run(nil) })
+			if result.code != tt.code {
+				t.Fatalf("run = %d, want %d:\n%s", result.code, tt.code, out)
+			}
+			runs := readCalls(t, calls)
+			if len(runs) != 3 || !strings.HasPrefix(runs[1], "sync ") || !strings.HasPrefix(runs[2], "check ") {
+				t.Errorf("rclone ran %q, want the sync and then the check", runs)
+			}
+			if e := findEntry(logEntries(t, out), tt.msg); e == nil || e["verify_matched"] != float64(3) {
+				t.Errorf("%q logged as %v, want the counts", tt.msg, e)
+			}
+			if summaries := readSummaries(t, out); len(summaries) != 1 || summaries[0].Verify == nil || *summaries[0].Verify != tt.counts {
+				t.Errorf("summary = %+v, want verify counts %+v", summaries, tt.counts)
+			}
+		})
+	}
+}
+
+func TestVerifyFailedSync(t *testing.T) {
+	path, calls := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = sync ] && exit 1
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "VERIFY_AFTER_SYNC": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	// A failed sync is not reported as a failed verification, and nothing
+	// is verified.
+	if result.code != exitSyncFailed {
+		t.Fatalf("run = %d, want %d:\n%s", result.code, exitSyncFailed, out)
+	}
+	for _, run := range readCalls(t, calls) {
+		if strings.HasPrefix(run, "check ") {
+			t.Errorf("verified after a failed sync: %q", run)
+		}
+	}
+}
+
+func TestVerifyCheckFails(t *testing.T) {
+	path, _ := fakeRclone(t, `[ "$1" = version ] && { echo "rclone v1.66.0"; exit 0; }
+[ "$1" = check ] && { echo "Failed to create file system: directory not found" >&2; exit 3; }
+exit 0`)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "VERIFY_AFTER_SYNC": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code == 0 || result.code == exitVerifyFailed {
+		t.Errorf("run = %d, want a failure that isn't a mismatch", result.code)
+	}
+	e := findEntry(logEntries(t, out), "S3 sync job failed")
+	if e == nil || e["error_class"] != "verification" || !strings.Contains(e["error"].(string), "rclone check failed") {
+		t.Errorf("failure logged as %v", e)
+	}
+}
+
+func TestVerifyOnly(t *testing.T) {
+	path, calls := verifyRclone(t, `NOTICE: S3 bucket dest-bucket: 1 differences found\nNOTICE: S3 bucket dest-bucket: 3 matching files\n`, 1)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "VERIFY_ONLY": "true"}))
+	var result runResult
+	out := captureOutput(t, func() { result, _ = run(nil) })
+	if result.code != exitVerifyFailed {
+		t.Fatalf("run = %d, want %d:\n%s", result.code, exitVerifyFailed, out)
+	}
+	if runs := readCalls(t, calls); len(runs) != 2 || !strings.HasPrefix(runs[1], "check ") {
+		t.Errorf("rclone ran %q, want only the check", runs)
+	}
+}
+
+func TestVerifyDryRun(t *testing.T) {
+	path, calls := verifyRclone(t, `NOTICE: S3 bucket dest-bucket: 3 matching files\n`, 0)
+	setTestEnv(t, withEnv(map[string]string{"RCLONE_PATH": path, "VERIFY_AFTER_SYNC": "true", "DRY_RUN": "true"}))
+	out := captureOutput(t, func() { run(nil) })
+	for _, run := range readCalls(t, calls) {
+		if strings.HasPrefix(run, "check ") {
+			t.Errorf("verified a dry run: %q", run)
+		}
+	}
+	if findEntry(logEntries(t, out), "Skipping verification in dry-run mode, the destination was not changed") == nil {
+		t.Errorf("skipped verification not logged:\n%s", out)
+	}
+}
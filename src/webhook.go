@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// webhookMethods are the WEBHOOK_METHOD values.
+var webhookMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch}
+
+// webhookFuncs are available in WEBHOOK_BODY_TEMPLATE: json encodes a value,
+// e.g. {{json .Error}} for a quoted and escaped string, and size formats a
+// byte count like 1.5Gi.
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"size": formatSize,
+}
+
+// validateWebhook checks the webhook settings, parsing WEBHOOK_BODY_TEMPLATE
+// and WEBHOOK_HEADERS at startup so that a typo doesn't surface only once a
+// long sync has ended.
+func validateWebhook(config *Config) error {
+	if config.WebhookURL == "" {
+		for key, set := range map[string]bool{
+			"WEBHOOK_HEADERS":       config.WebhookHeaders != "",
+			"WEBHOOK_BODY_TEMPLATE": config.WebhookBodyTemplate != "",
+			"WEBHOOK_TOKEN":         config.WebhookToken != "",
+		} {
+			if set {
+				return fmt.Errorf("%s requires WEBHOOK_URL", key)
+			}
+		}
+		return nil
+	}
+	if u, err := url.Parse(config.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid WEBHOOK_URL: must be an http:// or https:// URL")
+	}
+	if !contains(webhookMethods, config.WebhookMethod) {
+		return fmt.Errorf("invalid WEBHOOK_METHOD %q: must be one of %s", config.WebhookMethod, strings.Join(webhookMethods, ", "))
+	}
+	if _, err := webhookHeaders(config); err != nil {
+		return err
+	}
+	if config.WebhookBodyTemplate != "" {
+		tmpl, err := template.New("WEBHOOK_BODY_TEMPLATE").Funcs(webhookFuncs).Option("missingkey=error").Parse(config.WebhookBodyTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid WEBHOOK_BODY_TEMPLATE: %w", err)
+		}
+		// Rendering a sample catches references to fields that don't exist.
+		if err := tmpl.Execute(new(bytes.Buffer), &runSummary{}); err != nil {
+			return fmt.Errorf("invalid WEBHOOK_BODY_TEMPLATE: %w", err)
+		}
+		config.webhookTemplate = tmpl
+	}
+	return nil
+}
+
+// webhookHeaders returns the headers of the webhook request: WEBHOOK_HEADERS,
+// a JSON object of names and values, and Authorization from WEBHOOK_TOKEN.
+func webhookHeaders(config *Config) (map[string]string, error) {
+	headers := make(map[string]string)
+	if config.WebhookHeaders != "" {
+		if err := json.Unmarshal([]byte(config.WebhookHeaders), &headers); err != nil {
+			return nil, fmt.Errorf(`invalid WEBHOOK_HEADERS: must be a JSON object like {"X-Source": "s3-sync"}: %w`, err)
+		}
+	}
+	if config.WebhookToken != "" {
+		headers["Authorization"] = "Bearer " + config.WebhookToken
+	}
+	return headers, nil
+}
+
+// sendWebhook sends the run summary to WEBHOOK_URL, as the summary JSON or
+// rendered with WEBHOOK_BODY_TEMPLATE.
+func sendWebhook(config *Config, report *runSummary) error {
+	var body []byte
+	if config.webhookTemplate == nil {
+		var err error
+		if body, err = json.Marshal(report); err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := config.webhookTemplate.Execute(&buf, report); err != nil {
+			return fmt.Errorf("failed to render WEBHOOK_BODY_TEMPLATE: %w", err)
+		}
+		body = buf.Bytes()
+	}
+	headers, err := webhookHeaders(config)
+	if err != nil {
+		return err
+	}
+	return deliver(notifyClient, config.WebhookMethod, config.WebhookURL, body, headers)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestValidateWebhook(t *testing.T) {
+	for _, tt := range []struct {
+		env  map[string]string
+		want string
+	}{
+		{map[string]string{"WEBHOOK_URL": "https://ops.test/hooks/sync", "WEBHOOK_METHOD": "put", "WEBHOOK_HEADERS": `{"X-Team": "media"}`,
+			"WEBHOOK_BODY_TEMPLATE": `{"status": {{json .Result}}, "size": "{{size .Stats.Bytes}}"}`}, ""},
+		{map[string]string{"WEBHOOK_HEADERS": `{"X-Team": "media"}`}, "WEBHOOK_HEADERS requires WEBHOOK_URL"},
+		{map[string]string{"WEBHOOK_TOKEN": "token"}, "WEBHOOK_TOKEN requires WEBHOOK_URL"},
+		{map[string]string{"WEBHOOK_URL": "ops.test/hooks"}, "invalid WEBHOOK_URL: must be an http:// or https:// URL"},
+		{map[string]string{"WEBHOOK_URL": "https://ops.test/hooks", "WEBHOOK_METHOD": "GET"}, `invalid WEBHOOK_METHOD "GET": must be one of POST, PUT, PATCH`},
+		{map[string]string{"WEBHOOK_URL": "https://ops.test/hooks", "WEBHOOK_HEADERS": "X-Team: media"}, "invalid WEBHOOK_HEADERS: must be a JSON object"},
+		{map[string]string{"WEBHOOK_URL": "https://ops.test/hooks", "WEBHOOK_BODY_TEMPLATE": "{{.Result"}, "invalid WEBHOOK_BODY_TEMPLATE"},
+		{map[string]string{"WEBHOOK_URL": "https://ops.test/hooks", "WEBHOOK_BODY_TEMPLATE": "{{.Status}}"}, "invalid WEBHOOK_BODY_TEMPLATE"},
+		{map[string]string{"WEBHOOK_URL": "https://ops.test/hooks", "WEBHOOK_BODY_TEMPLATE": "{{upper .Result}}"}, `function "upper" not defined`},
+	} {
+		_, err := loadTestConfig(t, tt.env)
+		wantError(t, err, tt.want)
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	server := newWebhookServer(t)
+	config, err := loadTestConfig(t, map[string]string{
+		"WEBHOOK_URL":           server.URL + "/hooks/sync",
+		"WEBHOOK_METHOD":        "PUT",
+		"WEBHOOK_HEADERS":       `{"X-Team": "media", "Content-Type": "text/plain"}`,
+		"WEBHOOK_TOKEN":         "webhook-token",
+		"WEBHOOK_BODY_TEMPLATE": `{{.Result}} {{json .Error}} {{size .Stats.Bytes}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &runSummary{Result: "failure", Error: `"quoted"`, Stats: RunStats{Bytes: 1536}}
+	if err := sendWebhook(config, report); err != nil {
+		t.Fatal(err)
+	}
+	if bodies := server.received(); len(bodies) != 1 || bodies[0] != `failure "\"quoted\"" 1.5Ki` {
+		t.Errorf("bodies = %q", bodies)
+	}
+	req := server.requests[0]
+	if req.Method != http.MethodPut || req.URL.Path != "/hooks/sync" {
+		t.Errorf("request %s %s, want PUT /hooks/sync", req.Method, req.URL.Path)
+	}
+	for name, want := range map[string]string{
+		"X-Team":        "media",
+		"Content-Type":  "text/plain",
+		"Authorization": "Bearer webhook-token",
+	} {
+		if got := req.Header.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSendWebhookSummary(t *testing.T) {
+	server := newWebhookServer(t)
+	config, err := loadTestConfig(t, map[string]string{"WEBHOOK_URL": server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := newRunSummary(config, time.Now())
+	report.finish(nil, RunStats{Transfers: 4})
+	if err := sendWebhook(config, report); err != nil {
+		t.Fatal(err)
+	}
+	var got runSummary
+	if bodies := server.received(); len(bodies) != 1 || json.Unmarshal([]byte(bodies[0]), &got) != nil {
+		t.Fatalf("bodies = %q, want the summary", bodies)
+	}
+	if got.Result != "success" || got.Stats.Transfers != 4 || got.Source != "source:source-bucket" {
+		t.Errorf("summary = %+v", got)
+	}
+	if method := server.requests[0].Method; method != http.MethodPost {
+		t.Errorf("method = %s, want POST by default", method)
+	}
+}
+
+func TestNotifyTest(t *testing.T) {
+	server := newWebhookServer(t)
+	config, err := loadTestConfig(t, map[string]string{"WEBHOOK_URL": server.URL, "WEBHOOK_BODY_TEMPLATE": "{{.Result}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var code int
+	captureOutput(t, func() { code = runNotifyTest([]*Config{config}) })
+	if bodies := server.received(); code != 0 || len(bodies) != 1 || bodies[0] != "test" {
+		t.Errorf("NOTIFY_TEST = %d and sent %q, want 0 and a test run", code, bodies)
+	}
+
+	config, err = loadTestConfig(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureOutput(t, func() { code = runNotifyTest([]*Config{config}) })
+	if code != 1 {
+		t.Errorf("NOTIFY_TEST without targets = %d, want 1", code)
+	}
+}